@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Config is the gateway route table, loaded from ROUTES_FILE
+type Config struct {
+	Routes []Route `json:"routes"`
+}
+
+// Route forwards requests under Prefix to Upstream
+type Route struct {
+	Name     string `json:"name"`
+	Prefix   string `json:"prefix"`
+	Upstream string `json:"upstream"`
+	// StripPrefix removes Prefix before forwarding
+	StripPrefix bool `json:"stripPrefix,omitempty"`
+	// Public skips gateway authentication (e.g. Gitea webhooks)
+	Public bool `json:"public,omitempty"`
+	// Headers are set on the upstream request; values expand ${ENV}
+	Headers map[string]string `json:"headers,omitempty"`
+	// RateLimit overrides the default requests per minute per client
+	RateLimit int `json:"rateLimit,omitempty"`
+
+	target *url.URL
+}
+
+// LoadConfig reads and validates the route table
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		if r.Name == "" || r.Prefix == "" || r.Upstream == "" {
+			return nil, fmt.Errorf("route %d: name, prefix and upstream are required", i)
+		}
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, fmt.Errorf("route %s: prefix must start with /", r.Name)
+		}
+		if seen[r.Prefix] {
+			return nil, fmt.Errorf("route %s: duplicate prefix %s", r.Name, r.Prefix)
+		}
+		seen[r.Prefix] = true
+
+		r.target, err = url.Parse(r.Upstream)
+		if err != nil || r.target.Host == "" {
+			return nil, fmt.Errorf("route %s: invalid upstream %q", r.Name, r.Upstream)
+		}
+		for k, v := range r.Headers {
+			r.Headers[k] = os.ExpandEnv(v)
+		}
+	}
+
+	// Longest prefix first so /api/v1/apps wins over /api
+	sort.SliceStable(cfg.Routes, func(i, j int) bool {
+		return len(cfg.Routes[i].Prefix) > len(cfg.Routes[j].Prefix)
+	})
+	return &cfg, nil
+}
+
+// Match returns the route for path, or nil
+func (c *Config) Match(path string) *Route {
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		prefix := strings.TrimSuffix(r.Prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") || prefix == "" {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/auth"
+	"github.com/homelab/internal/httpkit"
+)
+
+// Gateway routes requests to upstream services behind shared auth and rate limits
+type Gateway struct {
+	config       *Config
+	limiter      *RateLimiter
+	defaultLimit int
+	proxies      map[string]*httputil.ReverseProxy
+	// auth guards every route that is not public; none leaves them open
+	auth []auth.Authenticator
+}
+
+func NewGateway(cfg *Config, authenticators []auth.Authenticator, defaultLimit int) *Gateway {
+	g := &Gateway{
+		config:       cfg,
+		auth:         authenticators,
+		limiter:      NewRateLimiter(),
+		defaultLimit: defaultLimit,
+		proxies:      make(map[string]*httputil.ReverseProxy),
+	}
+	for i := range cfg.Routes {
+		g.proxies[cfg.Routes[i].Name] = newProxy(&cfg.Routes[i])
+	}
+	return g
+}
+
+func newProxy(route *Route) *httputil.ReverseProxy {
+	target := route.target
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			if route.StripPrefix {
+				path := strings.TrimPrefix(pr.In.URL.Path, strings.TrimSuffix(route.Prefix, "/"))
+				if !strings.HasPrefix(path, "/") {
+					path = "/" + path
+				}
+				pr.Out.URL.Path = joinPath(target.Path, path)
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetXForwarded()
+			// Gateway credentials are not forwarded; routes set their own
+			if !route.Public {
+				pr.Out.Header.Del("Authorization")
+			}
+			for k, v := range route.Headers {
+				pr.Out.Header.Set(k, v)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Failed to proxy %s to %s: %v", r.URL.Path, route.Name, err)
+			http.Error(w, "Upstream unavailable", http.StatusBadGateway)
+		},
+	}
+}
+
+func joinPath(base, path string) string {
+	return strings.TrimSuffix(base, "/") + path
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := httpkit.NewStatusRecorder(w)
+
+	route := g.config.Match(r.URL.Path)
+	routeName := "-"
+	if route != nil {
+		routeName = route.Name
+	}
+	client := clientIP(r)
+
+	defer func() {
+		log.Printf("%s %s %s route=%s status=%d bytes=%d duration=%s",
+			client, r.Method, r.URL.Path, routeName, rec.Status(), rec.Bytes(), time.Since(start).Round(time.Millisecond))
+	}()
+
+	if route == nil {
+		http.Error(rec, "Not found", http.StatusNotFound)
+		return
+	}
+
+	proxy := func(w http.ResponseWriter, r *http.Request) {
+		limit := g.defaultLimit
+		if route.RateLimit != 0 {
+			limit = route.RateLimit
+		}
+		if !g.limiter.Allow(route.Name+"|"+client, limit) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		g.proxies[route.Name].ServeHTTP(w, r)
+	}
+	if !route.Public {
+		proxy = auth.Require(proxy, g.auth...)
+	}
+	proxy(rec, r)
+}
+
+// clientIP prefers the address set by ingress-nginx
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
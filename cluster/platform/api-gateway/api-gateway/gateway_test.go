@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/homelab/internal/auth"
+)
+
+func newTestGateway(t *testing.T, tokens string) *Gateway {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Gateway credentials stop at the gateway
+		w.Header().Set("X-Upstream-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+	}))
+	t.Cleanup(upstream.Close)
+
+	routes, err := json.Marshal(Config{Routes: []Route{
+		{Name: "apps", Prefix: "/api/v1/apps", Upstream: upstream.URL, StripPrefix: true},
+		{Name: "hooks", Prefix: "/hooks", Upstream: upstream.URL, Public: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(file, routes, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGateway(cfg, auth.Bearer(tokens, "", "", nil), 100)
+}
+
+func TestGatewayAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens string
+		path   string
+		header string
+		want   int
+	}{
+		{name: "valid token", tokens: "ci=t0ken", path: "/api/v1/apps/web", header: "Bearer t0ken", want: http.StatusOK},
+		{name: "missing token", tokens: "ci=t0ken", path: "/api/v1/apps/web", want: http.StatusUnauthorized},
+		{name: "wrong token", tokens: "ci=t0ken", path: "/api/v1/apps/web", header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "public route", tokens: "ci=t0ken", path: "/hooks/gitea", want: http.StatusOK},
+		{name: "no tokens configured", path: "/api/v1/apps/web", want: http.StatusUnauthorized},
+		{name: "unknown route", tokens: "ci=t0ken", path: "/other", header: "Bearer t0ken", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGateway(t, tt.tokens)
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			g.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without WWW-Authenticate")
+			}
+			if w.Code == http.StatusOK && tt.path == "/api/v1/apps/web" {
+				if got := w.Header().Get("X-Upstream-Path"); got != "/web" {
+					t.Fatalf("upstream path = %q, want /web", got)
+				}
+				if w.Header().Get("X-Upstream-Authorization") != "" {
+					t.Fatal("gateway token forwarded upstream")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+module github.com/homelab/api-gateway
+
+go 1.21
+
+require (
+	github.com/homelab/internal/auth v0.0.0
+	github.com/homelab/internal/config v0.0.0
+	github.com/homelab/internal/health v0.0.0
+	github.com/homelab/internal/httpkit v0.0.0
+)
+
+require (
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+	sigs.k8s.io/yaml v1.3.0 // indirect
+)
+
+replace (
+	github.com/homelab/internal/auth => ../../../../internal/auth
+	github.com/homelab/internal/config => ../../../../internal/config
+	github.com/homelab/internal/health => ../../../../internal/health
+	github.com/homelab/internal/httpkit => ../../../../internal/httpkit
+)
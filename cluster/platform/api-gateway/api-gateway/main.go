@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/homelab/internal/auth"
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+)
+
+func main() {
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+
+	cfg, err := LoadConfig(settings.RoutesFile)
+	if err != nil {
+		log.Fatalf("Failed to load routes: %v", err)
+	}
+
+	authenticators := auth.AllowUnauthenticated(auth.Bearer(settings.APITokens, "", "", nil), settings.AllowUnauthenticated, "gateway")
+
+	gateway := NewGateway(cfg, authenticators, settings.RateLimit)
+
+	mux := http.NewServeMux()
+	// Upstreams have their own probes, so readiness has no checks; /health
+	// stays as an alias of /healthz
+	checks := health.New()
+	checks.Register(mux)
+	mux.HandleFunc("/health", checks.Live)
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		handleRoutes(w, r, cfg)
+	})
+	mux.Handle("/", gateway)
+
+	port := settings.Port
+	for _, route := range cfg.Routes {
+		log.Printf("Route %s -> %s (%s)", route.Prefix, route.Upstream, route.Name)
+	}
+	log.Printf("Starting api-gateway on port %s", port)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, mux)); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// handleRoutes lists the route table without header values
+func handleRoutes(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	type routeInfo struct {
+		Name     string `json:"name"`
+		Prefix   string `json:"prefix"`
+		Upstream string `json:"upstream"`
+		Public   bool   `json:"public"`
+	}
+	routes := make([]routeInfo, 0, len(cfg.Routes))
+	for _, route := range cfg.Routes {
+		routes = append(routes, routeInfo{route.Name, route.Prefix, route.Upstream, route.Public})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routes)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a per-key token bucket refilled continuously
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	rl := &RateLimiter{buckets: make(map[string]*bucket)}
+	go rl.cleanup()
+	return rl
+}
+
+// Allow takes a token for key from a bucket of perMinute capacity
+func (rl *RateLimiter) Allow(key string, perMinute int) bool {
+	if perMinute <= 0 {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(perMinute), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Minutes() * float64(perMinute)
+	if b.tokens > float64(perMinute) {
+		b.tokens = float64(perMinute)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanup drops buckets idle long enough to have refilled completely
+func (rl *RateLimiter) cleanup() {
+	for range time.Tick(5 * time.Minute) {
+		rl.mu.Lock()
+		for key, b := range rl.buckets {
+			if time.Since(b.last) > 5*time.Minute {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
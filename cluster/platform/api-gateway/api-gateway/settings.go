@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/homelab/internal/config"
+)
+
+// Settings are read at startup: defaults, then the -settings YAML file
+// (SETTINGS_FILE), then the environment, then flags
+type Settings struct {
+	Port       string `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+	RoutesFile string `json:"routesFile" env:"ROUTES_FILE" flag:"routes" usage:"JSON route table"`
+	// RateLimit is requests per minute per client and route, unless the
+	// route sets its own
+	RateLimit int `json:"rateLimit" env:"RATE_LIMIT" flag:"rate-limit" usage:"default requests per minute per client; 0 disables"`
+
+	// APITokens guard non-public routes; only read from the environment
+	APITokens string `json:"-" env:"API_TOKENS"`
+	// AllowUnauthenticated opens the API when no credentials are set;
+	// otherwise it refuses every request
+	AllowUnauthenticated bool `json:"allowUnauthenticated" env:"ALLOW_UNAUTHENTICATED" flag:"allow-unauthenticated"`
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		Port:       "8080",
+		RoutesFile: "/etc/api-gateway/routes.json",
+		RateLimit:  120,
+	}
+}
+
+// loadSettings layers the file, environment, and flags over the defaults
+func loadSettings() (*Settings, error) {
+	s := defaultSettings()
+	if err := config.Load(s, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate implements config.Validator
+func (s *Settings) Validate() error {
+	if s.RoutesFile == "" {
+		return fmt.Errorf("routes file is required")
+	}
+	return nil
+}
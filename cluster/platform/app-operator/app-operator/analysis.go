@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultErrorRateQuery is the 5xx ratio ingress-nginx reports for an Ingress
+const defaultErrorRateQuery = `sum(rate(nginx_ingress_controller_requests{ingress="{{.Ingress}}",status=~"5.."}[2m]))` +
+	` / sum(rate(nginx_ingress_controller_requests{ingress="{{.Ingress}}"}[2m]))`
+
+// verdict is the outcome of analysing one version of an app
+type verdict struct {
+	// Ready is true once every replica is updated and ready
+	Ready bool
+	// Failed explains why the version regressed; empty while healthy
+	Failed string
+}
+
+func analysisSpec(app *Application) AnalysisSpec {
+	if app.Spec.Strategy != nil && app.Spec.Strategy.Analysis != nil {
+		return *app.Spec.Strategy.Analysis
+	}
+	return AnalysisSpec{}
+}
+
+// durationOr parses a spec duration, falling back to def when unset
+func durationOr(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %w", value, err)
+	}
+	return d, nil
+}
+
+// analyse checks the pods of deployName, started at since, and the error rate
+// of ingressName when the app sets maxErrorPercent
+func (c *Controller) analyse(ctx context.Context, app *Application, deployName, ingressName string, since time.Time) (verdict, error) {
+	spec := analysisSpec(app)
+	deadline := progressDeadline(app)
+	maxRestarts := int32(2)
+	if spec.MaxRestarts != nil {
+		maxRestarts = *spec.MaxRestarts
+	}
+
+	deployment, err := c.kube.AppsV1().Deployments(app.Namespace).Get(ctx, deployName, metav1.GetOptions{})
+	if err != nil {
+		return verdict{}, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return verdict{}, err
+	}
+	pods, err := c.kube.CoreV1().Pods(app.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return verdict{}, err
+	}
+
+	image := deployment.Spec.Template.Spec.Containers[0].Image
+	for _, pod := range pods.Items {
+		if failed := podFailure(&pod, image, maxRestarts); failed != "" {
+			return verdict{Failed: failed}, nil
+		}
+	}
+
+	desired := int32(1)
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+	v := verdict{Ready: deployment.Status.ReadyReplicas >= desired && deployment.Status.UpdatedReplicas >= desired &&
+		deployment.Status.ObservedGeneration >= deployment.Generation}
+	if !v.Ready {
+		if time.Since(since) > deadline {
+			v.Failed = fmt.Sprintf("%s not ready within %s (%d/%d replicas)", deployName, deadline, deployment.Status.ReadyReplicas, desired)
+		}
+		return v, nil
+	}
+
+	if spec.MaxErrorPercent != nil && ingressName != "" {
+		rate, err := c.errorRate(ctx, app, spec, ingressName)
+		if err != nil {
+			return v, fmt.Errorf("querying error rate: %w", err)
+		}
+		if rate*100 > float64(*spec.MaxErrorPercent) {
+			v.Failed = fmt.Sprintf("%s error rate %.1f%% exceeds %d%%", ingressName, rate*100, *spec.MaxErrorPercent)
+		}
+	}
+	return v, nil
+}
+
+// podFailure reports a crash-looping, unpullable or restarting container in
+// a pod running image
+func podFailure(pod *corev1.Pod, image string, maxRestarts int32) string {
+	if len(pod.Spec.Containers) == 0 || pod.Spec.Containers[0].Image != image {
+		return ""
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if w := status.State.Waiting; w != nil {
+			switch w.Reason {
+			case "CrashLoopBackOff", "ImagePullBackOff", "ErrImagePull", "CreateContainerConfigError":
+				return fmt.Sprintf("pod %s: %s", pod.Name, w.Reason)
+			}
+		}
+		if status.RestartCount > maxRestarts {
+			return fmt.Sprintf("pod %s restarted %d times", pod.Name, status.RestartCount)
+		}
+	}
+	return ""
+}
+
+// errorRate runs the analysis query against Prometheus; no traffic is 0
+func (c *Controller) errorRate(ctx context.Context, app *Application, spec AnalysisSpec, ingressName string) (float64, error) {
+	if c.prometheusURL == "" {
+		return 0, fmt.Errorf("PROMETHEUS_URL is not set")
+	}
+
+	query := spec.ErrorRateQuery
+	if query == "" {
+		query = defaultErrorRateQuery
+	}
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(query)
+	if err != nil {
+		return 0, fmt.Errorf("invalid errorRateQuery: %w", err)
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, map[string]string{
+		"Namespace": app.Namespace,
+		"Name":      app.Name,
+		"Ingress":   ingressName,
+	}); err != nil {
+		return 0, fmt.Errorf("rendering errorRateQuery: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/api/v1/query?query=%s", c.prometheusURL, url.QueryEscape(rendered.String()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("prometheus returned %s", resp.Status)
+	}
+
+	var result struct {
+		Data struct {
+			Result []struct {
+				Value []interface{} `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	if len(result.Data.Result) == 0 || len(result.Data.Result[0].Value) < 2 {
+		return 0, nil
+	}
+	s, _ := result.Data.Result[0].Value[1].(string)
+	rate, err := strconv.ParseFloat(s, 64)
+	// NaN when there was no traffic
+	if err != nil || math.IsNaN(rate) {
+		return 0, nil
+	}
+	return rate, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/homelab/internal/auth"
+	"github.com/homelab/internal/httpkit"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// routeAPI registers the API on mux; without authenticators it is open
+func (c *Controller) routeAPI(mux *http.ServeMux, authenticators []auth.Authenticator) {
+	mux.HandleFunc("/api/v1/pipelines", auth.Require(c.handlePipeline, authenticators...))
+	mux.HandleFunc("/api/v1/promote", auth.Require(c.handlePromote, authenticators...))
+	mux.HandleFunc("/api/v1/resources", auth.Require(c.handleResources, authenticators...))
+}
+
+// pipelineFromRequest looks up the pipeline Application named by the
+// namespace and name query parameters
+func (c *Controller) pipelineFromRequest(w http.ResponseWriter, r *http.Request) *Application {
+	namespace, name := r.URL.Query().Get("namespace"), r.URL.Query().Get("name")
+	if namespace == "" || name == "" {
+		http.Error(w, "Missing namespace or name", http.StatusBadRequest)
+		return nil
+	}
+
+	obj, exists, err := c.appInformer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		http.Error(w, "Application not found", http.StatusNotFound)
+		return nil
+	}
+	app, err := fromUnstructured(obj.(*unstructured.Unstructured))
+	if err != nil {
+		http.Error(w, "Failed to decode application", http.StatusInternalServerError)
+		return nil
+	}
+	if app.Spec.Promotion == nil {
+		http.Error(w, "Application has no promotion pipeline", http.StatusNotFound)
+		return nil
+	}
+	return app
+}
+
+// handlePipeline handles GET /api/v1/pipelines?namespace=&name=, returning
+// the stages of a promotion pipeline
+func (c *Controller) handlePipeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	app := c.pipelineFromRequest(w, r)
+	if app == nil {
+		return
+	}
+
+	httpkit.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": app.Namespace,
+		"name":      app.Name,
+		"image":     app.Status.Image,
+		"stages":    app.Status.Stages,
+	})
+}
+
+// handlePromote handles POST /api/v1/promote?namespace=&name=&stage=,
+// approving the image waiting to be promoted into a Manual stage. The
+// approval is recorded as an annotation on the Application.
+func (c *Controller) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	app := c.pipelineFromRequest(w, r)
+	if app == nil {
+		return
+	}
+
+	stage := r.URL.Query().Get("stage")
+	var pending string
+	found := false
+	for _, st := range app.Status.Stages {
+		if st.Name == stage {
+			pending, found = st.PendingImage, true
+		}
+	}
+	if !found {
+		http.Error(w, "Unknown stage", http.StatusNotFound)
+		return
+	}
+	if pending == "" {
+		http.Error(w, "No image is awaiting approval for this stage", http.StatusConflict)
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{approvalAnnotation(stage): pending},
+		},
+	})
+	if err != nil {
+		http.Error(w, "Failed to build patch", http.StatusInternalServerError)
+		return
+	}
+	_, err = c.dynamic.Resource(applicationGVR).Namespace(app.Namespace).Patch(r.Context(), app.Name,
+		types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		log.Printf("Failed to approve %s for %s/%s: %v", pending, app.Namespace, app.Name, err)
+		http.Error(w, fmt.Sprintf("Failed to record approval: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Application %s/%s: %s approved for %s", app.Namespace, app.Name, pending, stage)
+	// Annotation changes do not bump the generation, so queue explicitly
+	c.queue.Add(app.Namespace + "/" + app.Name)
+	httpkit.WriteJSON(w, http.StatusOK, map[string]string{
+		"stage":    stage,
+		"approved": pending,
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/homelab/internal/auth"
+)
+
+func TestAPIRequiresAuth(t *testing.T) {
+	tokens := auth.NewTokenAuth("chatops=s3cret")
+	mux := http.NewServeMux()
+	(&Controller{}).routeAPI(mux, []auth.Authenticator{tokens})
+
+	for _, tt := range []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/api/v1/pipelines"},
+		{http.MethodPost, "/api/v1/promote"},
+		{http.MethodGet, "/api/v1/resources"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("without a token: status = %d, want 401", w.Code)
+			}
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer wrong")
+			w = httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("with a wrong token: status = %d, want 401", w.Code)
+			}
+		})
+	}
+
+	// Past auth, a promotion without its parameters is rejected by the handler
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/promote", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("with the token: status = %d, want 400: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Blue/green slots
+const (
+	slotBlue  = "blue"
+	slotGreen = "green"
+)
+
+func slotWorkload(app *Application, slot string) workload {
+	name := app.Name + "-" + slot
+	return workload{Name: name, Instance: name}
+}
+
+func otherSlot(slot string) string {
+	if slot == slotBlue {
+		return slotGreen
+	}
+	return slotBlue
+}
+
+func previewName(app *Application) string {
+	return app.Name + "-preview"
+}
+
+// rolloutBlueGreen keeps two slot Deployments. A new image goes to the idle
+// slot (reachable through the -preview Service and optional preview host)
+// and, once it has been healthy for promotionDelay, the app's Service is
+// switched to it. The previous slot keeps running for scaleDownDelay, and a
+// regression in that window switches straight back. It returns the workload
+// serving traffic and the image it runs.
+func (c *Controller) rolloutBlueGreen(ctx context.Context, app *Application, image string) (workload, string, error) {
+	r, err := c.rolloutStatus(ctx, app, StrategyBlueGreen)
+	if err != nil {
+		return stableWorkload(app), "", err
+	}
+	promotionDelay, scaleDownDelay := blueGreenDelays(app)
+	now := metav1.Now()
+
+	if r.ActiveSlot == "" {
+		return c.adoptBlueGreen(ctx, app, r, image)
+	}
+
+	active := slotWorkload(app, r.ActiveSlot)
+	idle := slotWorkload(app, otherSlot(r.ActiveSlot))
+	if err := c.applyDeployment(ctx, app, active, r.StableImage, nil); err != nil {
+		return active, r.StableImage, err
+	}
+
+	// New image: bring it up in the idle slot and switch once healthy
+	if image != r.StableImage && image != r.FailedImage {
+		if r.CandidateImage != image {
+			log.Printf("Application %s/%s: deploying %s to %s slot", app.Namespace, app.Name, image, idle.Name)
+			r.CandidateImage = image
+			r.StepStartedAt = &now
+			r.Phase = RolloutProgressing
+			r.PreviousImage = ""
+			r.Message = ""
+		}
+		if err := c.applyPreview(ctx, app, idle, image); err != nil {
+			return active, r.StableImage, err
+		}
+
+		previewIngress := ""
+		if bg := app.Spec.Strategy.BlueGreen; bg != nil && bg.PreviewHost != "" {
+			previewIngress = previewName(app)
+		}
+		v, err := c.analyse(ctx, app, idle.Name, previewIngress, r.StepStartedAt.Time)
+		if err != nil {
+			r.Message = err.Error()
+			c.requeueAfter(app, checkInterval)
+			return active, r.StableImage, nil
+		}
+		if v.Failed != "" {
+			log.Printf("Application %s/%s: abandoning %s: %s", app.Namespace, app.Name, image, v.Failed)
+			r.FailedImage = image
+			r.CandidateImage = ""
+			r.Phase = RolloutRolledBack
+			r.Message = v.Failed
+			c.notifyRollback(ctx, app, image, r.StableImage, v.Failed)
+			if err := c.deletePreview(ctx, app); err != nil {
+				return active, r.StableImage, err
+			}
+			return active, r.StableImage, c.scaleDownIdle(ctx, app, idle, r.StableImage)
+		}
+
+		elapsed := time.Since(r.StepStartedAt.Time)
+		if !v.Ready || elapsed < promotionDelay {
+			r.Message = fmt.Sprintf("%s slot warming up", otherSlot(r.ActiveSlot))
+			c.requeueAfter(app, minDuration(checkInterval, promotionDelay-elapsed))
+			return active, r.StableImage, nil
+		}
+
+		log.Printf("Application %s/%s: switching traffic to %s (%s)", app.Namespace, app.Name, idle.Name, image)
+		r.PreviousImage = r.StableImage
+		r.StableImage = image
+		r.CandidateImage = ""
+		r.ActiveSlot = otherSlot(r.ActiveSlot)
+		r.SwitchedAt = &now
+		r.Phase = RolloutSucceeded
+		r.Message = fmt.Sprintf("previous slot kept for %s", scaleDownDelay)
+		c.requeueAfter(app, checkInterval)
+		return idle, image, c.deletePreview(ctx, app)
+	}
+
+	// Just switched: watch the new slot, with the old one still warm
+	if r.PreviousImage != "" && r.SwitchedAt != nil && time.Since(r.SwitchedAt.Time) < scaleDownDelay {
+		if err := c.applyDeployment(ctx, app, idle, r.PreviousImage, nil); err != nil {
+			return active, r.StableImage, err
+		}
+
+		mainIngress := ""
+		if app.Spec.Ingress != nil && app.Spec.Ingress.Host != "" {
+			mainIngress = app.Name
+		}
+		v, err := c.analyse(ctx, app, active.Name, mainIngress, r.SwitchedAt.Time)
+		if err != nil {
+			r.Message = err.Error()
+		} else if v.Failed != "" {
+			log.Printf("Application %s/%s: switching back to %s: %s", app.Namespace, app.Name, idle.Name, v.Failed)
+			r.FailedImage = r.StableImage
+			r.StableImage = r.PreviousImage
+			r.PreviousImage = ""
+			r.ActiveSlot = otherSlot(r.ActiveSlot)
+			r.SwitchedAt = &now
+			r.Phase = RolloutRolledBack
+			r.Message = v.Failed
+			c.notifyRollback(ctx, app, r.FailedImage, r.StableImage, v.Failed)
+			return idle, r.StableImage, nil
+		}
+		c.requeueAfter(app, minDuration(checkInterval, scaleDownDelay-time.Since(r.SwitchedAt.Time)))
+		return active, r.StableImage, nil
+	}
+
+	// Settled: the idle slot only costs resources
+	if r.PreviousImage != "" {
+		r.PreviousImage = ""
+		if r.Phase == RolloutSucceeded {
+			r.Message = ""
+		}
+	}
+	return active, r.StableImage, c.scaleDownIdle(ctx, app, idle, r.StableImage)
+}
+
+// adoptBlueGreen moves an app onto the blue slot; the plain Deployment keeps
+// serving until blue is ready, then is removed
+func (c *Controller) adoptBlueGreen(ctx context.Context, app *Application, r *RolloutStatus, image string) (workload, string, error) {
+	blue := slotWorkload(app, slotBlue)
+	if err := c.applyDeployment(ctx, app, blue, image, nil); err != nil {
+		return blue, image, err
+	}
+
+	stable := stableWorkload(app)
+	_, err := c.kube.AppsV1().Deployments(app.Namespace).Get(ctx, stable.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		r.ActiveSlot = slotBlue
+		r.StableImage = image
+		r.Phase = RolloutSucceeded
+		return blue, image, nil
+	}
+	if err != nil {
+		return blue, image, err
+	}
+
+	if r.StepStartedAt == nil {
+		now := metav1.Now()
+		r.StepStartedAt = &now
+	}
+	v, err := c.analyse(ctx, app, blue.Name, "", r.StepStartedAt.Time)
+	if err != nil || !v.Ready {
+		if v.Failed != "" {
+			r.Message = "blue slot: " + v.Failed
+		}
+		c.requeueAfter(app, checkInterval)
+		return stable, app.Status.Image, err
+	}
+
+	log.Printf("Application %s/%s: switching to blue/green slots", app.Namespace, app.Name)
+	r.ActiveSlot = slotBlue
+	r.StableImage = image
+	r.StepStartedAt = nil
+	r.Phase = RolloutSucceeded
+	r.Message = ""
+	return blue, image, c.deleteObject(ctx, gvr("apps", "v1", "deployments"), app.Namespace, stable.Name)
+}
+
+func blueGreenDelays(app *Application) (promotion, scaleDown time.Duration) {
+	promotion, scaleDown = 2*time.Minute, 10*time.Minute
+	if bg := app.Spec.Strategy.BlueGreen; bg != nil {
+		if d, _ := durationOr(bg.PromotionDelay, 0); d > 0 {
+			promotion = d
+		}
+		if d, _ := durationOr(bg.ScaleDownDelay, 0); d > 0 {
+			scaleDown = d
+		}
+	}
+	return promotion, scaleDown
+}
+
+// applyPreview runs image in the idle slot behind the -preview Service and,
+// when set, the preview host
+func (c *Controller) applyPreview(ctx context.Context, app *Application, idle workload, image string) error {
+	if err := c.applyDeployment(ctx, app, idle, image, nil); err != nil {
+		return err
+	}
+
+	service := renderService(app, previewName(app), idle)
+	if err := c.apply(ctx, "", "v1", "services", app.Namespace, service.Name, service); err != nil {
+		return err
+	}
+
+	bg := app.Spec.Strategy.BlueGreen
+	if bg == nil || bg.PreviewHost == "" || app.Spec.Ingress == nil {
+		return nil
+	}
+	ingress := renderIngress(app, previewName(app), bg.PreviewHost, previewName(app))
+	return c.apply(ctx, "networking.k8s.io", "v1", "ingresses", app.Namespace, ingress.Name, ingress)
+}
+
+func (c *Controller) deletePreview(ctx context.Context, app *Application) error {
+	if err := c.deleteObject(ctx, gvr("networking.k8s.io", "v1", "ingresses"), app.Namespace, previewName(app)); err != nil {
+		return err
+	}
+	return c.deleteObject(ctx, gvr("", "v1", "services"), app.Namespace, previewName(app))
+}
+
+func (c *Controller) scaleDownIdle(ctx context.Context, app *Application, idle workload, image string) error {
+	zero := int32(0)
+	return c.applyDeployment(ctx, app, idle, image, &zero)
+}
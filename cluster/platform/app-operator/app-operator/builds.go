@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// buildAppName is the repository name the webhook receiver labels build jobs with
+func buildAppName(app *Application) string {
+	if app.Spec.Image.BuildApp != "" {
+		return app.Spec.Image.BuildApp
+	}
+	return app.Name
+}
+
+// resolveImage returns the full image reference the app should run
+func (c *Controller) resolveImage(app *Application) (string, error) {
+	if app.Spec.Image.Digest != "" {
+		return fmt.Sprintf("%s@%s", app.Spec.Image.Repository, app.Spec.Image.Digest), nil
+	}
+
+	tag := app.Spec.Image.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+
+	if app.Spec.Image.TagPolicy == TagPolicyLatestBuild {
+		buildTag, err := c.latestBuildTag(buildAppName(app))
+		if err != nil {
+			return "", err
+		}
+		if buildTag != "" {
+			tag = buildTag
+		}
+	}
+
+	return fmt.Sprintf("%s:%s", app.Spec.Image.Repository, tag), nil
+}
+
+// latestBuildTag finds the newest successful build job for buildApp and
+// recovers the image tag from its name (build-<app>-<tag>)
+func (c *Controller) latestBuildTag(buildApp string) (string, error) {
+	var latest *batchv1.Job
+	for _, obj := range c.jobInformer.GetStore().List() {
+		job, ok := obj.(*batchv1.Job)
+		if !ok || job.Labels["app-name"] != buildApp || job.Status.Succeeded == 0 {
+			continue
+		}
+		if job.Status.CompletionTime == nil {
+			continue
+		}
+		if latest == nil || latest.Status.CompletionTime.Before(job.Status.CompletionTime) {
+			latest = job
+		}
+	}
+
+	if latest == nil {
+		return "", nil
+	}
+
+	prefix := fmt.Sprintf("build-%s-", buildApp)
+	if !strings.HasPrefix(latest.Name, prefix) {
+		return "", fmt.Errorf("build job %s does not match %s<tag>", latest.Name, prefix)
+	}
+	return strings.TrimPrefix(latest.Name, prefix), nil
+}
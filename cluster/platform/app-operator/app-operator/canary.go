@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultCanaryWeights are used when spec.strategy.canary.weights is empty
+var defaultCanaryWeights = []int32{10, 25, 50}
+
+func canaryName(app *Application) string {
+	return app.Name + "-canary"
+}
+
+func canaryWorkload(app *Application) workload {
+	return workload{Name: canaryName(app), Instance: canaryName(app)}
+}
+
+// rolloutCanary runs a new image as a single-replica canary behind an
+// ingress-nginx canary Ingress, raising its traffic weight step by step while
+// analysis passes. After the last step the stable Deployment is updated and
+// the canary removed; a regression removes the canary and keeps the stable
+// image. It returns the workload serving traffic and the image it runs.
+func (c *Controller) rolloutCanary(ctx context.Context, app *Application, image string) (workload, string, error) {
+	stable := stableWorkload(app)
+	r, err := c.rolloutStatus(ctx, app, StrategyCanary)
+	if err != nil {
+		return stable, "", err
+	}
+
+	// A first deploy has nothing to compare against
+	if r.StableImage == "" {
+		r.StableImage = image
+	}
+
+	if image == r.StableImage || image == r.FailedImage {
+		if r.CandidateImage != "" {
+			log.Printf("Application %s/%s: abandoning canary of %s", app.Namespace, app.Name, r.CandidateImage)
+			r.CandidateImage = ""
+			r.Phase = RolloutSucceeded
+			if err := c.deleteCanary(ctx, app); err != nil {
+				return stable, r.StableImage, err
+			}
+		}
+		return stable, r.StableImage, c.applyDeployment(ctx, app, stable, r.StableImage, nil)
+	}
+
+	now := metav1.Now()
+	if r.CandidateImage != image {
+		log.Printf("Application %s/%s: starting canary of %s", app.Namespace, app.Name, image)
+		r.CandidateImage = image
+		r.Step = 0
+		r.StepStartedAt = &now
+		r.Phase = RolloutProgressing
+		r.Message = ""
+	}
+
+	weights, stepDuration := canarySteps(app)
+	// The weights may have been shortened mid-rollout
+	if int(r.Step) >= len(weights) {
+		r.Step = int32(len(weights) - 1)
+	}
+	if err := c.applyDeployment(ctx, app, stable, r.StableImage, nil); err != nil {
+		return stable, r.StableImage, err
+	}
+	if err := c.applyCanary(ctx, app, image, weights[r.Step]); err != nil {
+		return stable, r.StableImage, err
+	}
+
+	v, err := c.analyse(ctx, app, canaryName(app), canaryName(app), r.StepStartedAt.Time)
+	if err != nil {
+		// Missing metrics hold the rollout rather than failing it
+		r.Message = err.Error()
+		c.requeueAfter(app, checkInterval)
+		return stable, r.StableImage, nil
+	}
+	if v.Failed != "" {
+		log.Printf("Application %s/%s: rolling back canary of %s: %s", app.Namespace, app.Name, image, v.Failed)
+		r.FailedImage = image
+		r.CandidateImage = ""
+		r.Phase = RolloutRolledBack
+		r.Message = v.Failed
+		c.notifyRollback(ctx, app, image, r.StableImage, v.Failed)
+		return stable, r.StableImage, c.deleteCanary(ctx, app)
+	}
+
+	elapsed := time.Since(r.StepStartedAt.Time)
+	if !v.Ready || elapsed < stepDuration {
+		r.Message = fmt.Sprintf("step %d/%d at %d%% traffic", r.Step+1, len(weights), weights[r.Step])
+		c.requeueAfter(app, minDuration(checkInterval, stepDuration-elapsed))
+		return stable, r.StableImage, nil
+	}
+
+	r.Step++
+	r.StepStartedAt = &now
+	if int(r.Step) < len(weights) {
+		r.Message = fmt.Sprintf("step %d/%d at %d%% traffic", r.Step+1, len(weights), weights[r.Step])
+		c.requeueAfter(app, checkInterval)
+		return stable, r.StableImage, c.applyCanary(ctx, app, image, weights[r.Step])
+	}
+
+	// Every step passed: promote
+	log.Printf("Application %s/%s: promoting canary %s", app.Namespace, app.Name, image)
+	r.StableImage = image
+	r.CandidateImage = ""
+	r.Step = 0
+	r.Phase = RolloutSucceeded
+	r.Message = ""
+	if err := c.applyDeployment(ctx, app, stable, image, nil); err != nil {
+		return stable, image, err
+	}
+	return stable, image, c.deleteCanary(ctx, app)
+}
+
+func canarySteps(app *Application) ([]int32, time.Duration) {
+	weights := defaultCanaryWeights
+	var stepDuration time.Duration
+	if spec := app.Spec.Strategy.Canary; spec != nil {
+		if len(spec.Weights) > 0 {
+			weights = spec.Weights
+		}
+		stepDuration, _ = durationOr(spec.StepDuration, 0)
+	}
+	if stepDuration == 0 {
+		stepDuration = 2 * time.Minute
+	}
+	return weights, stepDuration
+}
+
+// applyCanary applies the canary Deployment, Service and weighted Ingress
+func (c *Controller) applyCanary(ctx context.Context, app *Application, image string, weight int32) error {
+	canary := canaryWorkload(app)
+	one := int32(1)
+	if err := c.applyDeployment(ctx, app, canary, image, &one); err != nil {
+		return err
+	}
+
+	service := renderService(app, canary.Name, canary)
+	if err := c.apply(ctx, "", "v1", "services", app.Namespace, service.Name, service); err != nil {
+		return err
+	}
+
+	// ingress-nginx splits traffic for the same host between the main and
+	// the canary Ingress; TLS stays on the main one
+	ingress := renderIngress(app, canary.Name, app.Spec.Ingress.Host, canary.Name)
+	ingress.Spec.TLS = nil
+	ingress.Annotations = map[string]string{
+		"nginx.ingress.kubernetes.io/canary":        "true",
+		"nginx.ingress.kubernetes.io/canary-weight": strconv.Itoa(int(weight)),
+	}
+	return c.apply(ctx, "networking.k8s.io", "v1", "ingresses", app.Namespace, ingress.Name, ingress)
+}
+
+func (c *Controller) deleteCanary(ctx context.Context, app *Application) error {
+	name := canaryName(app)
+	if err := c.deleteObject(ctx, gvr("networking.k8s.io", "v1", "ingresses"), app.Namespace, name); err != nil {
+		return err
+	}
+	if err := c.deleteObject(ctx, gvr("", "v1", "services"), app.Namespace, name); err != nil {
+		return err
+	}
+	return c.deleteObject(ctx, gvr("apps", "v1", "deployments"), app.Namespace, name)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
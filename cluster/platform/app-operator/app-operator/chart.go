@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// chartFinalizer holds an Application until the cluster-scoped objects its
+// chart rendered are deleted; namespaced ones go with their owner reference
+const chartFinalizer = "homelab.mcztest.com/chart-resources"
+
+// chartCacheTTL is how long a rendering is reused; unpinned chart versions
+// pick up new releases after it
+const chartCacheTTL = 10 * time.Minute
+
+// ChartCache keeps helm template output by chart, version, and values
+type ChartCache struct {
+	mu      sync.Mutex
+	entries map[string]chartRender
+}
+
+type chartRender struct {
+	manifest []byte
+	at       time.Time
+}
+
+func NewChartCache() *ChartCache {
+	return &ChartCache{entries: make(map[string]chartRender)}
+}
+
+func (c *ChartCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.entries[key]
+	if !ok || time.Since(r.at) > chartCacheTTL {
+		return nil, false
+	}
+	return r.manifest, true
+}
+
+func (c *ChartCache) put(key string, manifest []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, r := range c.entries {
+		if time.Since(r.at) > chartCacheTTL {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = chartRender{manifest: manifest, at: time.Now()}
+}
+
+// validateChart rejects charts combined with settings that only apply to the
+// operator's own Deployment
+func validateChart(app *Application) error {
+	chart := app.Spec.Chart
+	if chart == nil {
+		if app.Spec.Image.Repository == "" {
+			return fmt.Errorf("image.repository is required without a chart")
+		}
+		return nil
+	}
+	if chart.Chart == "" {
+		return fmt.Errorf("chart.chart is required")
+	}
+	if app.Spec.Promotion != nil {
+		return fmt.Errorf("chart cannot be combined with promotion")
+	}
+	if strategyType(app) != StrategyRolling {
+		return fmt.Errorf("chart cannot be combined with the %s strategy", strategyType(app))
+	}
+	if chart.ImageValues != nil && app.Spec.Image.Repository == "" {
+		return fmt.Errorf("chart.imageValues needs image.repository")
+	}
+	return nil
+}
+
+// reconcileChart renders spec.chart, applies every object it produces,
+// prunes objects it no longer renders, and reports workload readiness
+func (c *Controller) reconcileChart(ctx context.Context, app *Application) error {
+	image := ""
+	if app.Spec.Image.Repository != "" {
+		var err error
+		if image, err = c.resolveImage(app); err != nil {
+			return c.setFailed(ctx, app, "ImageResolveFailed", err)
+		}
+	}
+
+	objs, err := c.renderChart(ctx, app, image)
+	if err != nil {
+		return c.setFailed(ctx, app, "ChartRenderFailed", err)
+	}
+
+	clusterScoped := false
+	refs := make([]ResourceRef, 0, len(objs))
+	for _, obj := range objs {
+		namespaced, err := c.applyChartObject(ctx, app, obj)
+		if err != nil {
+			return c.setFailed(ctx, app, "ApplyFailed", err)
+		}
+		clusterScoped = clusterScoped || !namespaced
+		refs = append(refs, refOf(obj))
+	}
+	if clusterScoped {
+		if err := c.addFinalizer(ctx, app); err != nil {
+			return c.setFailed(ctx, app, "ApplyFailed", err)
+		}
+	}
+
+	if app.Status.Chart != nil {
+		if err := c.deleteResources(ctx, subtractRefs(app.Status.Chart.Resources, refs)); err != nil {
+			return c.setFailed(ctx, app, "PruneFailed", err)
+		}
+	}
+	now := metav1.Now()
+	app.Status.Chart = &ChartStatus{Chart: chartRef(app.Spec.Chart), Resources: refs, RenderedAt: &now}
+	app.Status.Image = image
+
+	ready, desired, err := c.workloadReadiness(ctx, refs)
+	if err != nil {
+		return err
+	}
+	app.Status.Ready = fmt.Sprintf("%d/%d", ready, desired)
+	cond := metav1.Condition{
+		Type:    "Ready",
+		Status:  metav1.ConditionFalse,
+		Reason:  "RolloutInProgress",
+		Message: fmt.Sprintf("%d of %d replicas ready across %d objects", ready, desired, len(refs)),
+	}
+	if ready >= desired {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "Available"
+	}
+	return c.updateStatus(ctx, app, cond)
+}
+
+func chartRef(chart *ChartSpec) string {
+	if chart.Version == "" {
+		return chart.Chart
+	}
+	return chart.Chart + "@" + chart.Version
+}
+
+// renderChart runs helm template with the app's values, the resolved image
+// written to the configured values paths
+func (c *Controller) renderChart(ctx context.Context, app *Application, image string) ([]*unstructured.Unstructured, error) {
+	chart := app.Spec.Chart
+	values, err := chartValues(chart, image)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"template", app.Name, chart.Chart, "--namespace", app.Namespace, "--include-crds", "--values", "-"}
+	if chart.Repo != "" {
+		args = append(args, "--repo", chart.Repo)
+	}
+	if chart.Version != "" {
+		args = append(args, "--version", chart.Version)
+	}
+	if chart.PlainHTTP {
+		args = append(args, "--plain-http")
+	}
+	if version, err := c.kube.Discovery().ServerVersion(); err == nil {
+		args = append(args, "--kube-version", version.GitVersion)
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(args, "\x00") + "\x00" + string(values)))
+	key := hex.EncodeToString(sum[:])
+	manifest, ok := c.charts.get(key)
+	if !ok {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, c.helmPath, args...)
+		cmd.Stdin = bytes.NewReader(values)
+		cmd.Env = append(os.Environ(), "HELM_CACHE_HOME=/tmp/helm/cache", "HELM_CONFIG_HOME=/tmp/helm/config", "HELM_DATA_HOME=/tmp/helm/data")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if manifest, err = cmd.Output(); err != nil {
+			return nil, fmt.Errorf("helm template %s: %v: %s", chartRef(chart), err, strings.TrimSpace(stderr.String()))
+		}
+		c.charts.put(key, manifest)
+		log.Printf("Rendered chart %s for %s/%s", chartRef(chart), app.Namespace, app.Name)
+	}
+	return decodeManifest(manifest)
+}
+
+// chartValues returns spec.chart.values as JSON (which helm reads as YAML)
+// with the image set at the configured paths
+func chartValues(chart *ChartSpec, image string) ([]byte, error) {
+	values := map[string]interface{}{}
+	if chart.Values != nil {
+		// Round-trip so setting the image never mutates the informer's copy
+		data, err := json.Marshal(chart.Values)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	}
+
+	if iv := chart.ImageValues; iv != nil && image != "" {
+		repository, tag, digest := splitImage(image)
+		if digest != "" && iv.Digest == "" {
+			return nil, fmt.Errorf("chart.imageValues.digest is needed to deploy %s", image)
+		}
+		for path, value := range map[string]string{iv.Repository: repository, iv.Tag: tag, iv.Digest: digest} {
+			if path == "" || value == "" {
+				continue
+			}
+			if err := setValuePath(values, path, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(values)
+}
+
+// splitImage splits repo:tag or repo@digest
+func splitImage(image string) (repository, tag, digest string) {
+	if repo, d, ok := strings.Cut(image, "@"); ok {
+		return repo, "", d
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:], ""
+	}
+	return image, "", ""
+}
+
+// setValuePath sets a dotted path such as image.tag, creating maps on the way
+func setValuePath(values map[string]interface{}, path, value string) error {
+	keys := strings.Split(path, ".")
+	m := values
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := m[key]
+		if !ok {
+			child := map[string]interface{}{}
+			m[key] = child
+			m = child
+			continue
+		}
+		child, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("values path %s: %s is not a map", path, key)
+		}
+		m = child
+	}
+	m[keys[len(keys)-1]] = value
+	return nil
+}
+
+// decodeManifest splits helm output into objects, dropping empty documents
+// and test hooks; CRDs and namespaces come first so later objects can use them
+func decodeManifest(manifest []byte) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 4096)
+	for {
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("decoding rendered chart: %w", err)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		u := &unstructured.Unstructured{Object: obj}
+		if strings.Contains(u.GetAnnotations()["helm.sh/hook"], "test") {
+			continue
+		}
+		if u.GetKind() == "" || u.GetName() == "" {
+			return nil, fmt.Errorf("rendered chart has an object without kind or name")
+		}
+		objs = append(objs, u)
+	}
+
+	rank := func(u *unstructured.Unstructured) int {
+		switch u.GetKind() {
+		case "CustomResourceDefinition":
+			return 0
+		case "Namespace":
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(objs, func(i, j int) bool { return rank(objs[i]) < rank(objs[j]) })
+	return objs, nil
+}
+
+// mapping resolves the object's resource, refreshing discovery once for
+// kinds installed since the last lookup (e.g. CRDs from the same chart)
+func (c *Controller) mapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	m, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		c.mapper.Reset()
+		m, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	return m, err
+}
+
+// applyChartObject server-side applies a rendered object, labelled and
+// owned by the Application. Namespaced objects must live in the app's
+// namespace and cluster-scoped ones must be of a kind in chartClusterKinds,
+// so an Application cannot reach beyond its namespace. It reports whether
+// the object is namespaced.
+func (c *Controller) applyChartObject(ctx context.Context, app *Application, obj *unstructured.Unstructured) (bool, error) {
+	m, err := c.mapping(obj.GroupVersionKind())
+	if err != nil {
+		return false, fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+	namespaced := m.Scope.Name() == meta.RESTScopeNameNamespace
+
+	if namespaced {
+		if ns := obj.GetNamespace(); ns != "" && ns != app.Namespace {
+			return false, fmt.Errorf("%s %s: namespace %s is outside the Application's namespace %s", obj.GetKind(), obj.GetName(), ns, app.Namespace)
+		}
+		obj.SetNamespace(app.Namespace)
+		obj.SetOwnerReferences(ownerRefs(app))
+	} else {
+		if !c.clusterKindAllowed(obj.GroupVersionKind().GroupKind()) {
+			return false, fmt.Errorf("%s %s: cluster-scoped kind is not allowed in charts (CHART_CLUSTER_KINDS)", obj.GetKind(), obj.GetName())
+		}
+		obj.SetNamespace("")
+	}
+
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["app.kubernetes.io/managed-by"] = fieldManager
+	obj.SetLabels(labels)
+
+	return namespaced, c.applyObject(ctx, m.Resource, obj)
+}
+
+// clusterKindAllowed reports whether charts may apply the cluster-scoped
+// kind, listed as Kind or Kind.group (e.g. CustomResourceDefinition or
+// CustomResourceDefinition.apiextensions.k8s.io)
+func (c *Controller) clusterKindAllowed(gk schema.GroupKind) bool {
+	for _, allowed := range c.chartClusterKinds {
+		if allowed == gk.Kind || allowed == gk.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func namespacedName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+func refOf(obj *unstructured.Unstructured) ResourceRef {
+	return ResourceRef{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+}
+
+// subtractRefs returns the refs in a that are not in b
+func subtractRefs(a, b []ResourceRef) []ResourceRef {
+	keep := make(map[ResourceRef]bool, len(b))
+	for _, ref := range b {
+		keep[ref] = true
+	}
+	var out []ResourceRef
+	for _, ref := range a {
+		if !keep[ref] {
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+// deleteResources deletes refs, ignoring ones already gone or whose kind no
+// longer exists
+func (c *Controller) deleteResources(ctx context.Context, refs []ResourceRef) error {
+	for _, ref := range refs {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			continue
+		}
+		m, err := c.mapping(gv.WithKind(ref.Kind))
+		if meta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = c.dynamic.Resource(m.Resource).Namespace(ref.Namespace).Delete(ctx, ref.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting %s %s: %w", ref.Kind, namespacedName(ref.Namespace, ref.Name), err)
+		}
+		log.Printf("Pruned %s %s", ref.Kind, namespacedName(ref.Namespace, ref.Name))
+	}
+	return nil
+}
+
+// workloadReadiness sums ready and desired replicas of the Deployments and
+// StatefulSets among refs
+func (c *Controller) workloadReadiness(ctx context.Context, refs []ResourceRef) (int32, int32, error) {
+	var ready, desired int32
+	for _, ref := range refs {
+		if ref.APIVersion != "apps/v1" {
+			continue
+		}
+		switch ref.Kind {
+		case "Deployment":
+			d, err := c.kube.AppsV1().Deployments(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return 0, 0, err
+			}
+			ready += d.Status.ReadyReplicas
+			desired += replicasOf(d.Spec.Replicas)
+		case "StatefulSet":
+			s, err := c.kube.AppsV1().StatefulSets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return 0, 0, err
+			}
+			ready += s.Status.ReadyReplicas
+			desired += replicasOf(s.Spec.Replicas)
+		}
+	}
+	return ready, desired, nil
+}
+
+func replicasOf(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// addFinalizer makes deletion wait for finalizeChart
+func (c *Controller) addFinalizer(ctx context.Context, app *Application) error {
+	for _, f := range app.Finalizers {
+		if f == chartFinalizer {
+			return nil
+		}
+	}
+	finalizers := append(append([]string{}, app.Finalizers...), chartFinalizer)
+	return c.patchFinalizers(ctx, app, finalizers)
+}
+
+// finalizeChart deletes the cluster-scoped objects of a deleted
+// Application's chart, then lets the deletion proceed
+func (c *Controller) finalizeChart(ctx context.Context, app *Application) error {
+	var finalizers []string
+	found := false
+	for _, f := range app.Finalizers {
+		if f == chartFinalizer {
+			found = true
+			continue
+		}
+		finalizers = append(finalizers, f)
+	}
+	if !found {
+		return nil
+	}
+
+	if app.Status.Chart != nil {
+		var clusterScoped []ResourceRef
+		for _, ref := range app.Status.Chart.Resources {
+			if ref.Namespace == "" {
+				clusterScoped = append(clusterScoped, ref)
+			}
+		}
+		if err := c.deleteResources(ctx, clusterScoped); err != nil {
+			return err
+		}
+	}
+	return c.patchFinalizers(ctx, app, finalizers)
+}
+
+func (c *Controller) patchFinalizers(ctx context.Context, app *Application, finalizers []string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": app.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	u, err := c.dynamic.Resource(applicationGVR).Namespace(app.Namespace).Patch(ctx, app.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+	// The status update that follows must not conflict with this write
+	app.ResourceVersion = u.GetResourceVersion()
+	app.Finalizers = finalizers
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// staticMapper is a fixed RESTMapper; Reset is a no-op
+type staticMapper struct{ *meta.DefaultRESTMapper }
+
+func (staticMapper) Reset() {}
+
+func newChartController(t *testing.T, clusterKinds ...string) (*Controller, *[]string) {
+	t.Helper()
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}, meta.RESTScopeRoot)
+
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	var applied []string
+	// The fake client cannot server-side apply; record the patch instead
+	dyn.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		applied = append(applied, namespacedName(patch.GetNamespace(), patch.GetName()))
+		return true, &unstructured.Unstructured{Object: map[string]interface{}{}}, nil
+	})
+	return &Controller{dynamic: dyn, mapper: staticMapper{mapper}, chartClusterKinds: clusterKinds}, &applied
+}
+
+func chartObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	return u
+}
+
+func TestApplyChartObjectScopesNamespacedObjects(t *testing.T) {
+	app := &Application{ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "my-app", UID: "uid-1"}}
+
+	tests := []struct {
+		name      string
+		namespace string
+		wantErr   string
+	}{
+		{name: "defaults to the app namespace"},
+		{name: "app namespace", namespace: "my-app"},
+		{name: "other namespace", namespace: "kube-system", wantErr: "outside the Application's namespace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, applied := newChartController(t)
+			obj := chartObject("v1", "ConfigMap", tt.namespace, "settings")
+			namespaced, err := c.applyChartObject(context.Background(), app, obj)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if len(*applied) != 0 {
+					t.Fatalf("applied %v despite the error", *applied)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !namespaced || obj.GetNamespace() != "my-app" {
+				t.Fatalf("namespaced = %v, namespace = %q", namespaced, obj.GetNamespace())
+			}
+			if refs := obj.GetOwnerReferences(); len(refs) != 1 || refs[0].UID != app.UID {
+				t.Fatalf("owner references = %v", refs)
+			}
+			if len(*applied) != 1 || (*applied)[0] != "my-app/settings" {
+				t.Fatalf("applied = %v", *applied)
+			}
+		})
+	}
+}
+
+func TestApplyChartObjectClusterScopedAllowlist(t *testing.T) {
+	app := &Application{ObjectMeta: metav1.ObjectMeta{Namespace: "my-app", Name: "my-app"}}
+
+	tests := []struct {
+		name    string
+		allowed []string
+		obj     *unstructured.Unstructured
+		wantErr bool
+	}{
+		{
+			name:    "refused by default",
+			obj:     chartObject("rbac.authorization.k8s.io/v1", "ClusterRole", "", "admin-everything"),
+			wantErr: true,
+		},
+		{
+			name:    "other kind allowed",
+			allowed: []string{"CustomResourceDefinition"},
+			obj:     chartObject("rbac.authorization.k8s.io/v1", "ClusterRole", "", "admin-everything"),
+			wantErr: true,
+		},
+		{
+			name:    "allowed by kind",
+			allowed: []string{"CustomResourceDefinition"},
+			obj:     chartObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", "widgets.example.com"),
+		},
+		{
+			name:    "allowed by kind and group",
+			allowed: []string{"CustomResourceDefinition.apiextensions.k8s.io"},
+			obj:     chartObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "my-app", "widgets.example.com"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, applied := newChartController(t, tt.allowed...)
+			namespaced, err := c.applyChartObject(context.Background(), app, tt.obj)
+			if tt.wantErr {
+				if err == nil || len(*applied) != 0 {
+					t.Fatalf("error = %v, applied = %v; want refusal", err, *applied)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if namespaced || tt.obj.GetNamespace() != "" || len(*applied) != 1 {
+				t.Fatalf("namespaced = %v, namespace = %q, applied = %v", namespaced, tt.obj.GetNamespace(), *applied)
+			}
+		})
+	}
+}
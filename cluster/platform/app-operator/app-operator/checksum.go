@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// configChecksumAnnotation is set on the pod template to a hash of the
+// ConfigMap and Secret data the app's env references, so editing them rolls
+// the Deployment like a new image does
+const configChecksumAnnotation = "homelab.mcztest.com/config-checksum"
+
+// configRef is a ConfigMap or Secret the pod reads; an empty key means all
+// of its data (envFrom)
+type configRef struct {
+	kind string
+	name string
+	key  string
+}
+
+// configRefs lists the ConfigMaps and Secrets referenced by env and envFrom
+func configRefs(app *Application) []configRef {
+	var refs []configRef
+	for _, e := range app.Spec.Env {
+		if e.ValueFrom == nil {
+			continue
+		}
+		if r := e.ValueFrom.ConfigMapKeyRef; r != nil {
+			refs = append(refs, configRef{kind: "ConfigMap", name: r.Name, key: r.Key})
+		}
+		if r := e.ValueFrom.SecretKeyRef; r != nil {
+			refs = append(refs, configRef{kind: "Secret", name: r.Name, key: r.Key})
+		}
+	}
+	for _, e := range app.Spec.EnvFrom {
+		if e.ConfigMapRef != nil {
+			refs = append(refs, configRef{kind: "ConfigMap", name: e.ConfigMapRef.Name})
+		}
+		if e.SecretRef != nil {
+			refs = append(refs, configRef{kind: "Secret", name: e.SecretRef.Name})
+		}
+	}
+	return refs
+}
+
+// configChecksum hashes the referenced data as the informers last saw it;
+// "" when the app references none
+func (c *Controller) configChecksum(app *Application) (string, error) {
+	refs := configRefs(app)
+	if len(refs) == 0 {
+		return "", nil
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := refs[i], refs[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.key < b.key
+	})
+
+	h := sha256.New()
+	for _, ref := range refs {
+		data, err := c.configData(app.Namespace, ref)
+		if err != nil {
+			return "", err
+		}
+		// A missing object hashes differently from an empty one, so creating
+		// an optional reference later restarts the pods too
+		if data == nil {
+			fmt.Fprintf(h, "%s/%s/%s missing\n", ref.kind, ref.name, ref.key)
+			continue
+		}
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			if ref.key == "" || k == ref.key {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "%s/%s/%s=%x\n", ref.kind, ref.name, k, sha256.Sum256(data[k]))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]), nil
+}
+
+// configData returns the data of the referenced object, or nil if it does
+// not exist
+func (c *Controller) configData(namespace string, ref configRef) (map[string][]byte, error) {
+	key := namespace + "/" + ref.name
+	if ref.kind == "Secret" {
+		obj, exists, err := c.secretInformer.GetStore().GetByKey(key)
+		if err != nil || !exists {
+			return nil, err
+		}
+		return obj.(*corev1.Secret).Data, nil
+	}
+
+	obj, exists, err := c.configMapInformer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	cm := obj.(*corev1.ConfigMap)
+	data := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+	for k, v := range cm.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range cm.BinaryData {
+		data[k] = v
+	}
+	return data, nil
+}
+
+// configHandler queues the Applications referencing a changed ConfigMap or
+// Secret of kind
+func (c *Controller) configHandler(kind string) cache.ResourceEventHandler {
+	changed := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return
+		}
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		c.enqueueForConfig(kind, namespace, name)
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: changed,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Resyncs arrive with an unchanged resourceVersion
+			if oldObj.(metav1.Object).GetResourceVersion() != newObj.(metav1.Object).GetResourceVersion() {
+				changed(newObj)
+			}
+		},
+		DeleteFunc: changed,
+	}
+}
+
+// enqueueForConfig queues every Application in namespace that references the
+// ConfigMap or Secret name
+func (c *Controller) enqueueForConfig(kind, namespace, name string) {
+	for _, obj := range c.appInformer.GetStore().List() {
+		u := obj.(*unstructured.Unstructured)
+		if u.GetNamespace() != namespace {
+			continue
+		}
+		app, err := fromUnstructured(u)
+		if err != nil || app.Spec.Chart != nil {
+			continue
+		}
+		for _, ref := range configRefs(app) {
+			if ref.kind == kind && ref.name == name {
+				c.enqueue(obj)
+				break
+			}
+		}
+	}
+}
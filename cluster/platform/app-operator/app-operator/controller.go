@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller watches Applications (and build jobs) and reconciles them
+type Controller struct {
+	kube    kubernetes.Interface
+	dynamic dynamic.Interface
+
+	appInformer cache.SharedIndexInformer
+	jobInformer cache.SharedIndexInformer
+	// ConfigMaps and Secrets referenced by env roll the Deployment on change
+	configMapInformer cache.SharedIndexInformer
+	secretInformer    cache.SharedIndexInformer
+	informers         []func(<-chan struct{})
+
+	queue          workqueue.RateLimitingInterface
+	buildNamespace string
+	// prometheusURL serves error-rate queries for rollout analysis
+	prometheusURL string
+	// notifyURL receives a JSON POST for every automatic rollback
+	notifyURL string
+	// registry pins promoted images to their digest
+	registry *RegistryClient
+	// pins exempts deployed images from registry-gc retention; nil disables
+	pins *ImagePinner
+
+	// mapper resolves the kinds rendered by Helm charts
+	mapper   meta.ResettableRESTMapper
+	charts   *ChartCache
+	helmPath string
+	// chartClusterKinds are the cluster-scoped kinds charts may apply; the
+	// ClusterRole must grant them too
+	chartClusterKinds []string
+}
+
+// NewController wires informers for Applications and build jobs into a work queue
+func NewController(kube kubernetes.Interface, dyn dynamic.Interface, buildNamespace, prometheusURL string, resync time.Duration) *Controller {
+	appFactory := dynamicinformer.NewDynamicSharedInformerFactory(dyn, resync)
+	jobFactory := informers.NewSharedInformerFactoryWithOptions(kube, resync, informers.WithNamespace(buildNamespace))
+	configFactory := informers.NewSharedInformerFactory(kube, resync)
+
+	c := &Controller{
+		kube:              kube,
+		dynamic:           dyn,
+		appInformer:       appFactory.ForResource(applicationGVR).Informer(),
+		jobInformer:       jobFactory.Batch().V1().Jobs().Informer(),
+		configMapInformer: configFactory.Core().V1().ConfigMaps().Informer(),
+		secretInformer:    configFactory.Core().V1().Secrets().Informer(),
+		informers:         []func(<-chan struct{}){appFactory.Start, jobFactory.Start, configFactory.Start},
+		queue:             workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		buildNamespace:    buildNamespace,
+		prometheusURL:     strings.TrimSuffix(prometheusURL, "/"),
+		mapper:            restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(kube.Discovery())),
+		charts:            NewChartCache(),
+		helmPath:          "helm",
+	}
+
+	c.appInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Skip our own status writes; resyncs arrive with an unchanged resourceVersion
+			oldApp, newApp := oldObj.(*unstructured.Unstructured), newObj.(*unstructured.Unstructured)
+			if oldApp.GetResourceVersion() == newApp.GetResourceVersion() || oldApp.GetGeneration() != newApp.GetGeneration() {
+				c.enqueue(newObj)
+			}
+			c.enqueuePipeline(newObj)
+			c.enqueueDependents(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueuePipeline(obj)
+			c.enqueueDependents(obj)
+		},
+	})
+
+	// A finished build may produce a new tag for apps following LatestBuild
+	c.jobInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			if job, ok := obj.(*batchv1.Job); ok && job.Status.Succeeded > 0 {
+				c.enqueueForBuild(job.Labels["app-name"])
+			}
+		},
+	})
+
+	c.configMapInformer.AddEventHandler(c.configHandler("ConfigMap"))
+	c.secretInformer.AddEventHandler(c.configHandler("Secret"))
+
+	return c
+}
+
+// Run starts the informers and workers, blocking until ctx is cancelled
+func (c *Controller) Run(ctx context.Context, workers int) error {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	for _, start := range c.informers {
+		start(ctx.Done())
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), c.appInformer.HasSynced, c.jobInformer.HasSynced,
+		c.configMapInformer.HasSynced, c.secretInformer.HasSynced) {
+		return fmt.Errorf("timed out waiting for caches to sync")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueueForBuild queues every Application that tracks builds of buildApp
+func (c *Controller) enqueueForBuild(buildApp string) {
+	if buildApp == "" {
+		return
+	}
+	for _, obj := range c.appInformer.GetStore().List() {
+		app, err := fromUnstructured(obj.(*unstructured.Unstructured))
+		if err != nil {
+			continue
+		}
+		if app.Spec.Image.TagPolicy == TagPolicyLatestBuild && buildAppName(app) == buildApp {
+			c.enqueue(obj)
+		}
+	}
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	if err := c.sync(ctx, key); err != nil {
+		log.Printf("Failed to reconcile %s: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// sync looks up the Application for key and reconciles it
+func (c *Controller) sync(ctx context.Context, key string) error {
+	obj, exists, err := c.appInformer.GetStore().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// Owned objects are garbage collected through their owner references;
+		// stage Applications live in other namespaces
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return err
+		}
+		return c.deleteStageApps(ctx, namespace, name, nil)
+	}
+
+	app, err := fromUnstructured(obj.(*unstructured.Unstructured))
+	if err != nil {
+		return fmt.Errorf("decoding application: %w", err)
+	}
+	if app.DeletionTimestamp != nil {
+		return c.finalizeChart(ctx, app)
+	}
+	return c.reconcile(withDriftReport(ctx, app), app)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// dependencyKeys returns the namespace/name keys of the Applications app
+// depends on
+func dependencyKeys(app *Application) []string {
+	keys := make([]string, 0, len(app.Spec.DependsOn))
+	for _, d := range app.Spec.DependsOn {
+		namespace := d.Namespace
+		if namespace == "" {
+			namespace = app.Namespace
+		}
+		keys = append(keys, namespace+"/"+d.Name)
+	}
+	return keys
+}
+
+// appFromStore returns the cached Application for key, or nil
+func (c *Controller) appFromStore(key string) *Application {
+	obj, exists, err := c.appInformer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return nil
+	}
+	app, err := fromUnstructured(obj.(*unstructured.Unstructured))
+	if err != nil {
+		return nil
+	}
+	return app
+}
+
+// validateDependencies rejects dependencies that could never be met: a
+// missing name, or a cycle back to app through the cached Applications
+func (c *Controller) validateDependencies(app *Application) error {
+	for _, d := range app.Spec.DependsOn {
+		if d.Name == "" {
+			return fmt.Errorf("dependsOn: name is required")
+		}
+	}
+
+	self := app.Namespace + "/" + app.Name
+	visited := make(map[string]bool)
+	var walk func(key string, path []string) []string
+	walk = func(key string, path []string) []string {
+		dep := c.appFromStore(key)
+		if key == self {
+			dep = app
+		}
+		if dep == nil {
+			return nil
+		}
+		for _, next := range dependencyKeys(dep) {
+			if next == self {
+				return append(path, next)
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			if cycle := walk(next, append(path, next)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	if cycle := walk(self, []string{self}); cycle != nil {
+		return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// unreadyDependencies lists the dependencies of app that are missing or
+// not Ready
+func (c *Controller) unreadyDependencies(app *Application) []string {
+	var waiting []string
+	for _, key := range dependencyKeys(app) {
+		dep := c.appFromStore(key)
+		if dep == nil {
+			waiting = append(waiting, key+" (not found)")
+			continue
+		}
+		if !meta.IsStatusConditionTrue(dep.Status.Conditions, "Ready") {
+			waiting = append(waiting, key)
+		}
+	}
+	return waiting
+}
+
+// holdForDependencies keeps app from rolling out while a dependency is not
+// Ready. An app that has no ready pods, e.g. when the whole stack starts
+// after a power outage, is held at 0 replicas rather than crash looping
+// against the missing dependency. One that is serving keeps running its
+// current image. Dependency status changes requeue the app.
+func (c *Controller) holdForDependencies(ctx context.Context, app *Application, waiting []string) error {
+	cond := metav1.Condition{
+		Type:    "Ready",
+		Status:  metav1.ConditionFalse,
+		Reason:  "WaitingForDependencies",
+		Message: "Waiting for " + strings.Join(waiting, ", "),
+	}
+
+	// Charts and pipelines render no Deployment of their own to hold
+	if app.Spec.Chart == nil && app.Spec.Promotion == nil {
+		w := scaledWorkload(app)
+		live, err := c.kube.AppsV1().Deployments(app.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err != nil || live.Status.ReadyReplicas == 0 {
+			image := app.Status.Image
+			if image == "" {
+				if image, err = c.resolveImage(app); err != nil {
+					return c.setFailed(ctx, app, "ImageResolveFailed", err)
+				}
+			}
+			zero := int32(0)
+			if err := c.applyDeployment(ctx, app, w, image, &zero); err != nil {
+				return c.setFailed(ctx, app, "ApplyFailed", err)
+			}
+			cond.Message += "; held at 0 replicas"
+		}
+	}
+
+	if readyReason(app) != cond.Reason {
+		log.Printf("Application %s/%s: waiting for %s", app.Namespace, app.Name, strings.Join(waiting, ", "))
+	}
+	c.requeueAfter(app, checkInterval)
+	return c.updateStatus(ctx, app, cond)
+}
+
+// readyReason is the reason of the app's Ready condition
+func readyReason(app *Application) string {
+	if cond := meta.FindStatusCondition(app.Status.Conditions, "Ready"); cond != nil {
+		return cond.Reason
+	}
+	return ""
+}
+
+// enqueueDependents queues the Applications depending on obj, so they
+// resume as soon as it becomes Ready
+func (c *Controller) enqueueDependents(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	key := u.GetNamespace() + "/" + u.GetName()
+	for _, item := range c.appInformer.GetStore().List() {
+		app, err := fromUnstructured(item.(*unstructured.Unstructured))
+		if err != nil {
+			continue
+		}
+		for _, dep := range dependencyKeys(app) {
+			if dep == key {
+				c.enqueue(item)
+				break
+			}
+		}
+	}
+}
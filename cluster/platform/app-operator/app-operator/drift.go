@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// appliedHashAnnotation is the hash of the configuration last applied to an
+// object. While it matches the desired configuration, any change a dry-run
+// apply would make was made outside the operator.
+const appliedHashAnnotation = "homelab.mcztest.com/applied-hash"
+
+// driftReport collects the objects found edited during one reconcile
+type driftReport struct {
+	selfHeal bool
+	checked  int
+	drifted  []ResourceRef
+	// evented is set once the revert Event is recorded
+	evented bool
+}
+
+type driftKey struct{}
+
+// withDriftReport starts a report for app's reconcile; apply adds to it
+func withDriftReport(ctx context.Context, app *Application) context.Context {
+	selfHeal := true
+	if app.Spec.Drift != nil && app.Spec.Drift.SelfHeal != nil {
+		selfHeal = *app.Spec.Drift.SelfHeal
+	}
+	return context.WithValue(ctx, driftKey{}, &driftReport{selfHeal: selfHeal})
+}
+
+func driftReportFrom(ctx context.Context) *driftReport {
+	r, _ := ctx.Value(driftKey{}).(*driftReport)
+	return r
+}
+
+// condition summarises the report as the Drifted condition
+func (r *driftReport) condition() metav1.Condition {
+	if len(r.drifted) == 0 {
+		return metav1.Condition{
+			Type:    "Drifted",
+			Status:  metav1.ConditionFalse,
+			Reason:  "InSync",
+			Message: fmt.Sprintf("%d objects match the desired state", r.checked),
+		}
+	}
+	names := make([]string, len(r.drifted))
+	for i, ref := range r.drifted {
+		names[i] = ref.Kind + " " + namespacedName(ref.Namespace, ref.Name)
+	}
+	cond := metav1.Condition{
+		Type:    "Drifted",
+		Status:  metav1.ConditionTrue,
+		Reason:  "ManualChanges",
+		Message: "Edited outside the operator: " + strings.Join(names, ", "),
+	}
+	if r.selfHeal {
+		cond.Reason = "Reverted"
+	}
+	return cond
+}
+
+// applyObject server-side applies obj unless the live object already
+// matches. An object edited since the operator last applied it is drift: it
+// is reported, and reverted unless the Application turns self-healing off.
+func (c *Controller) applyObject(ctx context.Context, resource schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	desired, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(desired)
+	hash := hex.EncodeToString(sum[:8])
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[appliedHashAnnotation] = hash
+	obj.SetAnnotations(annotations)
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	client := c.dynamic.Resource(resource).Namespace(obj.GetNamespace())
+	name := namespacedName(obj.GetNamespace(), obj.GetName())
+	force := true
+	live, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("getting %s %s: %w", resource.Resource, name, err)
+	}
+
+	if live != nil && live.GetAnnotations()[appliedHashAnnotation] == hash {
+		dryRun, err := client.Patch(ctx, obj.GetName(), types.ApplyPatchType, data,
+			metav1.PatchOptions{FieldManager: fieldManager, Force: &force, DryRun: []string{metav1.DryRunAll}})
+		if err != nil {
+			return fmt.Errorf("dry-run applying %s %s: %w", resource.Resource, name, err)
+		}
+		if sameObject(live, dryRun) {
+			if r := driftReportFrom(ctx); r != nil {
+				r.checked++
+			}
+			return nil
+		}
+
+		report := driftReportFrom(ctx)
+		if report != nil {
+			report.checked++
+			report.drifted = append(report.drifted, refOf(live))
+			if !report.selfHeal {
+				return nil
+			}
+		}
+		log.Printf("Reverting manual changes to %s %s", obj.GetKind(), name)
+	} else if r := driftReportFrom(ctx); r != nil {
+		r.checked++
+	}
+
+	_, err = client.Patch(ctx, obj.GetName(), types.ApplyPatchType, data,
+		metav1.PatchOptions{FieldManager: fieldManager, Force: &force})
+	if err != nil {
+		return fmt.Errorf("applying %s %s: %w", resource.Resource, name, err)
+	}
+	return nil
+}
+
+// sameObject compares objects without the fields every write or the
+// object's controller changes
+func sameObject(a, b *unstructured.Unstructured) bool {
+	strip := func(u *unstructured.Unstructured) map[string]interface{} {
+		obj := u.DeepCopy().Object
+		delete(obj, "status")
+		if m, ok := obj["metadata"].(map[string]interface{}); ok {
+			for _, field := range []string{"managedFields", "resourceVersion", "generation", "uid", "creationTimestamp"} {
+				delete(m, field)
+			}
+		}
+		return obj
+	}
+	return equality.Semantic.DeepEqual(strip(a), strip(b))
+}
+
+// reportDrift records the Drifted condition and, when objects were
+// reverted, a warning Event
+func (c *Controller) reportDrift(ctx context.Context, app *Application) {
+	r := driftReportFrom(ctx)
+	if r == nil || r.checked == 0 {
+		return
+	}
+	app.Status.Drifted = r.drifted
+	cond := r.condition()
+	cond.ObservedGeneration = app.Generation
+	setCondition(&app.Status.Conditions, cond)
+	if len(r.drifted) > 0 && r.selfHeal && !r.evented {
+		r.evented = true
+		c.recordEvent(ctx, app, corev1.EventTypeWarning, "DriftReverted", cond.Message)
+	}
+}
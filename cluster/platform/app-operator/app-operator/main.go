@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/homelab/internal/auth"
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func main() {
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+
+	// Create Kubernetes clients
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("Failed to get in-cluster config: %v", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create dynamic client: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	controller := NewController(kubeClient, dynamicClient, settings.BuildNamespace, settings.PrometheusURL, settings.ResyncInterval)
+	controller.notifyURL = settings.NotifyURL
+	controller.chartClusterKinds = settings.ChartClusterKinds
+	controller.registry = NewRegistryClient(settings.RegistryURL, settings.RegistryAuthFile)
+	if settings.PinsURL != "" {
+		controller.pins = NewImagePinner(settings.PinsURL, settings.PinsToken, settings.PinTTL)
+	}
+
+	// The API takes bearer tokens or OIDC tokens, like the build API;
+	// health stays open for probes
+	apiAuth := auth.AllowUnauthenticated(auth.Bearer(settings.APITokens, settings.OIDCIssuer, settings.OIDCAudience, settings.OIDCGroups),
+		settings.AllowUnauthenticated, "promotion API")
+
+	// /readyz fails while the API server is unreachable; /health stays as
+	// an alias of /healthz
+	checks := health.New()
+	checks.Add("kubernetes", func(ctx context.Context) error {
+		return kubeClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+	})
+	mux := http.NewServeMux()
+	checks.Register(mux)
+	mux.HandleFunc("/health", checks.Live)
+	controller.routeAPI(mux, apiAuth)
+
+	port := settings.Port
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		log.Printf("Starting health endpoint on port %s", port)
+		if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, mux)); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	log.Printf("Starting app-operator (build namespace %s, resync %s)", settings.BuildNamespace, settings.ResyncInterval)
+	if err := controller.Run(ctx, 2); err != nil {
+		log.Fatalf("Controller stopped: %v", err)
+	}
+	// Let in-flight requests finish
+	<-served
+}
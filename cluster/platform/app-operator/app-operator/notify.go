@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordEvent creates an Event on the Application, visible through
+// kubectl describe happ
+func (c *Controller) recordEvent(ctx context.Context, app *Application, eventType, reason, message string) {
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: app.Name + ".",
+			Namespace:    app.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      applicationGVR.GroupVersion().String(),
+			Kind:            "Application",
+			Name:            app.Name,
+			Namespace:       app.Namespace,
+			UID:             app.UID,
+			ResourceVersion: app.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: fieldManager},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := c.kube.CoreV1().Events(app.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		log.Printf("Failed to record event for %s/%s: %v", app.Namespace, app.Name, err)
+	}
+}
+
+// notifyRollback reports an automatic rollback as an Event and, when
+// NOTIFY_WEBHOOK_URL is set, to the notification webhook
+func (c *Controller) notifyRollback(ctx context.Context, app *Application, failedImage, restoredImage, reason string) {
+	message := fmt.Sprintf("Rolled back %s to %s: %s", failedImage, restoredImage, reason)
+	c.recordEvent(ctx, app, corev1.EventTypeWarning, "RolledBack", message)
+
+	if c.notifyURL == "" {
+		return
+	}
+	text := fmt.Sprintf("%s/%s: %s", app.Namespace, app.Name, message)
+	// text and content are what Slack- and Discord-style webhooks display
+	payload, err := json.Marshal(map[string]string{
+		"event":         "rollback",
+		"namespace":     app.Namespace,
+		"application":   app.Name,
+		"failedImage":   failedImage,
+		"restoredImage": restoredImage,
+		"reason":        reason,
+		"text":          text,
+		"content":       text,
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.notifyURL, bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("Failed to send rollback notification: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to send rollback notification: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Failed to send rollback notification: %s", resp.Status)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImagePinner pins the images Applications run in registry-gc, so they
+// outlive its age-based retention as rollback targets
+type ImagePinner struct {
+	url string
+	// token is sent as a bearer token; registry-gc refuses unauthenticated pins
+	token string
+	// ttl expires a pin once the image has not been deployed for that long
+	ttl  time.Duration
+	http *http.Client
+
+	// pinned records when each app's image was last pinned; pins are
+	// refreshed at a quarter of their ttl rather than on every reconcile
+	mu     sync.Mutex
+	pinned map[string]time.Time
+}
+
+func NewImagePinner(url, token string, ttl time.Duration) *ImagePinner {
+	return &ImagePinner{
+		url:    url,
+		token:  token,
+		ttl:    ttl,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		pinned: make(map[string]time.Time),
+	}
+}
+
+// pinDeployed pins the image of an Application whose rollout is Ready
+func (c *Controller) pinDeployed(ctx context.Context, app *Application, cond metav1.Condition) {
+	if c.pins == nil || app.Status.Image == "" || cond.Type != "Ready" || cond.Status != metav1.ConditionTrue {
+		return
+	}
+	owner := fmt.Sprintf("Application %s/%s", app.Namespace, app.Name)
+	if err := c.pins.Pin(ctx, app.Status.Image, owner); err != nil {
+		log.Printf("Failed to pin %s for %s/%s: %v", app.Status.Image, app.Namespace, app.Name, err)
+	}
+}
+
+// Pin pins image under owner unless it was pinned recently
+func (p *ImagePinner) Pin(ctx context.Context, image, owner string) error {
+	key := owner + "=" + image
+	p.mu.Lock()
+	now := time.Now()
+	if last, ok := p.pinned[key]; ok && now.Sub(last) < p.ttl/4 {
+		p.mu.Unlock()
+		return nil
+	}
+	for k, last := range p.pinned {
+		if now.Sub(last) >= p.ttl {
+			delete(p.pinned, k)
+		}
+	}
+	p.pinned[key] = now
+	p.mu.Unlock()
+
+	if err := p.post(ctx, image, owner); err != nil {
+		p.mu.Lock()
+		delete(p.pinned, key)
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (p *ImagePinner) post(ctx context.Context, image, owner string) error {
+	payload, err := json.Marshal(map[string]string{
+		"image":  image,
+		"owner":  owner,
+		"reason": "deployed by " + owner,
+		"ttl":    p.ttl.String(),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Images from other registries have nothing to pin
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("POST %s: %s: %s", p.url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestImagePinnerSendsToken(t *testing.T) {
+	var authorization string
+	var pin map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&pin); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	pinner := NewImagePinner(srv.URL, "s3cret", time.Hour)
+	if err := pinner.Pin(context.Background(), "registry.home.mcztest.com/app:v1", "Application apps/app"); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "Bearer s3cret" {
+		t.Fatalf("Authorization = %q", authorization)
+	}
+	if pin["image"] != "registry.home.mcztest.com/app:v1" || pin["ttl"] != "1h0m0s" {
+		t.Fatalf("pin = %v", pin)
+	}
+}
+
+func TestImagePinnerRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	pinner := NewImagePinner(srv.URL, "", time.Hour)
+	if err := pinner.Pin(context.Background(), "registry.home.mcztest.com/app:v1", "Application apps/app"); err == nil {
+		t.Fatal("refused pin succeeded")
+	}
+	// A refused pin is retried on the next reconcile
+	if len(pinner.pinned) != 0 {
+		t.Fatalf("pinned = %v", pinner.pinned)
+	}
+}
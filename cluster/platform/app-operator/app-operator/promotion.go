@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Labels tying a stage Application to the pipeline that renders it
+const (
+	pipelineLabel          = "homelab.mcztest.com/pipeline"
+	pipelineNamespaceLabel = "homelab.mcztest.com/pipeline-namespace"
+	stageLabel             = "homelab.mcztest.com/stage"
+)
+
+// approvalAnnotation holds the image approved for promotion into stage
+func approvalAnnotation(stage string) string {
+	return "homelab.mcztest.com/approve-" + stage
+}
+
+// stageApplication is a rendered stage Application; status is left to the
+// stage's own reconcile
+type stageApplication struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              ApplicationSpec `json:"spec"`
+}
+
+// validatePromotion rejects pipelines whose stages cannot be rendered
+func validatePromotion(app *Application) error {
+	p := app.Spec.Promotion
+	if p == nil {
+		return nil
+	}
+	if len(p.Stages) == 0 {
+		return fmt.Errorf("promotion needs at least one stage")
+	}
+
+	names, namespaces := map[string]bool{}, map[string]bool{}
+	for _, stage := range p.Stages {
+		if errs := validation.IsDNS1123Label(stage.Name); len(errs) > 0 {
+			return fmt.Errorf("stage name %q: %s", stage.Name, errs[0])
+		}
+		if names[stage.Name] {
+			return fmt.Errorf("duplicate stage %q", stage.Name)
+		}
+		names[stage.Name] = true
+
+		if errs := validation.IsDNS1123Label(stage.Namespace); len(errs) > 0 {
+			return fmt.Errorf("stage %s namespace %q: %s", stage.Name, stage.Namespace, errs[0])
+		}
+		// The stage Application shares the pipeline's name
+		if stage.Namespace == app.Namespace || namespaces[stage.Namespace] {
+			return fmt.Errorf("stage %s: namespace %s is already used by the pipeline", stage.Name, stage.Namespace)
+		}
+		namespaces[stage.Namespace] = true
+
+		if _, err := durationOr(stage.SoakTime, 0); err != nil {
+			return fmt.Errorf("stage %s soakTime: %w", stage.Name, err)
+		}
+		switch stage.Approval {
+		case "", ApprovalAutomatic, ApprovalManual:
+		default:
+			return fmt.Errorf("stage %s: unknown approval %q", stage.Name, stage.Approval)
+		}
+	}
+	return nil
+}
+
+// reconcilePipeline pins image to its digest, deploys it to the first stage
+// and promotes each stage's image to the next once it has soaked (and, for
+// Manual stages, been approved)
+func (c *Controller) reconcilePipeline(ctx context.Context, app *Application, image string) error {
+	// Objects rendered before the app became a pipeline
+	if app.Status.Rollout != nil {
+		if err := c.cleanupStrategies(ctx, app, ""); err != nil {
+			return c.setFailed(ctx, app, "ApplyFailed", err)
+		}
+		for _, obj := range []struct{ group, version, resource string }{
+			{"apps", "v1", "deployments"},
+			{"", "v1", "services"},
+			{"networking.k8s.io", "v1", "ingresses"},
+		} {
+			if err := c.deleteObject(ctx, gvr(obj.group, obj.version, obj.resource), app.Namespace, app.Name); err != nil {
+				return c.setFailed(ctx, app, "ApplyFailed", err)
+			}
+		}
+		app.Status.Rollout = nil
+	}
+
+	pinned, err := c.registry.pinDigest(ctx, image)
+	if err != nil {
+		return c.setFailed(ctx, app, "ImageResolveFailed", fmt.Errorf("resolving digest of %s: %w", image, err))
+	}
+	if err := c.deleteStageApps(ctx, app.Namespace, app.Name, app.Spec.Promotion.Stages); err != nil {
+		return c.setFailed(ctx, app, "ApplyFailed", err)
+	}
+
+	previous := map[string]StageStatus{}
+	for _, st := range app.Status.Stages {
+		previous[st.Name] = st
+	}
+
+	now := metav1.Now()
+	statuses := make([]StageStatus, len(app.Spec.Promotion.Stages))
+	healthy := 0
+	for i, stage := range app.Spec.Promotion.Stages {
+		st := previous[stage.Name]
+		st.Name, st.Namespace = stage.Name, stage.Namespace
+		st.PendingImage, st.Message = "", ""
+
+		// The first stage follows the resolved image; later ones take the
+		// previous stage's image once it has soaked
+		target := st.Image
+		if i == 0 {
+			target = pinned
+		} else if prev := statuses[i-1]; prev.Phase == StageReady && prev.Image != st.Image {
+			if stage.Approval != ApprovalManual || app.Annotations[approvalAnnotation(stage.Name)] == prev.Image {
+				target = prev.Image
+			} else {
+				st.PendingImage = prev.Image
+			}
+		}
+		if target == "" {
+			st.Phase = StagePending
+			statuses[i] = st
+			continue
+		}
+
+		if target != st.Image {
+			if i > 0 {
+				log.Printf("Application %s/%s: promoting %s to %s", app.Namespace, app.Name, target, stage.Name)
+				c.recordEvent(ctx, app, corev1.EventTypeNormal, "Promoted", fmt.Sprintf("Promoted %s to %s", target, stage.Name))
+			}
+			st.Image = target
+			st.PromotedAt = &now
+			st.HealthySince = nil
+		}
+		if err := c.applyStage(ctx, app, stage, st.Image); err != nil {
+			return c.setFailed(ctx, app, "ApplyFailed", err)
+		}
+
+		c.observeStage(app, stage, &st)
+		if st.Phase == StageSoaking || st.Phase == StageReady {
+			healthy++
+		}
+		if st.PendingImage != "" {
+			st.Phase = StageAwaitingApproval
+			st.Message = fmt.Sprintf("approve %s through the operator API", st.PendingImage)
+		}
+		statuses[i] = st
+	}
+	app.Status.Stages = statuses
+	app.Status.Image = pinned
+	app.Status.Ready = fmt.Sprintf("%d/%d stages", healthy, len(statuses))
+
+	cond := metav1.Condition{
+		Type:    "Ready",
+		Status:  metav1.ConditionFalse,
+		Reason:  "Promoting",
+		Message: fmt.Sprintf("%d of %d stages healthy", healthy, len(statuses)),
+	}
+	for _, st := range statuses {
+		if st.Phase == StageAwaitingApproval {
+			cond.Reason = "AwaitingApproval"
+			cond.Message = fmt.Sprintf("%s is waiting for approval", st.Name)
+			break
+		}
+	}
+	if healthy == len(statuses) && statuses[len(statuses)-1].Image == pinned {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "Available"
+	}
+	return c.updateStatus(ctx, app, cond)
+}
+
+// observeStage reads the stage Application's status into st, requeueing
+// the pipeline while the stage soaks
+func (c *Controller) observeStage(app *Application, stage StageSpec, st *StageStatus) {
+	obj, exists, err := c.appInformer.GetStore().GetByKey(stage.Namespace + "/" + app.Name)
+	if err != nil || !exists {
+		st.Phase = StageDeploying
+		return
+	}
+	child, err := fromUnstructured(obj.(*unstructured.Unstructured))
+	if err != nil {
+		st.Phase = StageDeploying
+		return
+	}
+
+	ready := meta.FindStatusCondition(child.Status.Conditions, "Ready")
+	switch {
+	case child.Status.Rollout != nil && child.Status.Rollout.FailedImage == st.Image:
+		st.Phase = StageFailed
+		st.Message = child.Status.Rollout.Message
+		st.HealthySince = nil
+		return
+	case child.Status.Image != st.Image || child.Status.ObservedGeneration != child.Generation ||
+		ready == nil || ready.Status != metav1.ConditionTrue:
+		st.Phase = StageDeploying
+		st.HealthySince = nil
+		return
+	}
+
+	if st.HealthySince == nil {
+		now := metav1.Now()
+		st.HealthySince = &now
+	}
+	soak, _ := durationOr(stage.SoakTime, 15*time.Minute)
+	elapsed := time.Since(st.HealthySince.Time)
+	if elapsed < soak {
+		st.Phase = StageSoaking
+		c.requeueAfter(app, minDuration(time.Minute, soak-elapsed))
+		return
+	}
+	st.Phase = StageReady
+}
+
+// applyStage renders the stage Application running image (a digest
+// reference) in the stage namespace, creating the namespace if needed
+func (c *Controller) applyStage(ctx context.Context, app *Application, stage StageSpec, image string) error {
+	namespace := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata":   map[string]interface{}{"name": stage.Namespace},
+	}
+	if err := c.apply(ctx, "", "v1", "namespaces", "", stage.Namespace, namespace); err != nil {
+		return err
+	}
+
+	spec := app.Spec
+	spec.Promotion = nil
+	_, digest, _ := strings.Cut(image, "@")
+	spec.Image = ImageSpec{Repository: app.Spec.Image.Repository, Digest: digest}
+	if stage.Replicas != nil {
+		spec.Replicas = stage.Replicas
+	}
+	spec.Ingress = nil
+	if app.Spec.Ingress != nil && stage.Host != "" {
+		ingress := *app.Spec.Ingress
+		ingress.Host = stage.Host
+		spec.Ingress = &ingress
+	}
+
+	obj := &stageApplication{
+		TypeMeta: metav1.TypeMeta{APIVersion: applicationGVR.GroupVersion().String(), Kind: "Application"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      app.Name,
+			Namespace: stage.Namespace,
+			Labels: map[string]string{
+				pipelineLabel:          app.Name,
+				pipelineNamespaceLabel: app.Namespace,
+				stageLabel:             stage.Name,
+			},
+		},
+		Spec: spec,
+	}
+	return c.apply(ctx, applicationGVR.Group, applicationGVR.Version, applicationGVR.Resource, stage.Namespace, app.Name, obj)
+}
+
+// deleteStageApps deletes the stage Applications of pipeline namespace/name
+// that are not in keep. Owner references cannot cross namespaces, so stage
+// Applications are found by label.
+func (c *Controller) deleteStageApps(ctx context.Context, namespace, name string, keep []StageSpec) error {
+	kept := map[string]bool{}
+	for _, stage := range keep {
+		kept[stage.Namespace] = true
+	}
+
+	for _, obj := range c.appInformer.GetStore().List() {
+		u := obj.(*unstructured.Unstructured)
+		labels := u.GetLabels()
+		if labels[pipelineLabel] != name || labels[pipelineNamespaceLabel] != namespace || kept[u.GetNamespace()] {
+			continue
+		}
+		log.Printf("Application %s/%s: removing stage %s", namespace, name, labels[stageLabel])
+		err := c.dynamic.Resource(applicationGVR).Namespace(u.GetNamespace()).Delete(ctx, u.GetName(), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting stage %s/%s: %w", u.GetNamespace(), u.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// enqueuePipeline queues the pipeline a stage Application belongs to, so
+// stage status changes move promotion along
+func (c *Controller) enqueuePipeline(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	labels := u.GetLabels()
+	if labels[pipelineLabel] != "" && labels[pipelineNamespaceLabel] != "" {
+		c.queue.Add(labels[pipelineNamespaceLabel] + "/" + labels[pipelineLabel])
+	}
+}
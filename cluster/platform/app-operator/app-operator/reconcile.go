@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const fieldManager = "app-operator"
+
+// reconcile renders the Application and applies the result, then records status
+func (c *Controller) reconcile(ctx context.Context, app *Application) error {
+	if err := validateChart(app); err != nil {
+		return c.setFailed(ctx, app, "InvalidChart", err)
+	}
+	if err := c.validateDependencies(app); err != nil {
+		return c.setFailed(ctx, app, "InvalidDependencies", err)
+	}
+	// Pipelines pass dependsOn to their stages, which wait themselves
+	if app.Spec.Promotion == nil {
+		if waiting := c.unreadyDependencies(app); len(waiting) > 0 {
+			return c.holdForDependencies(ctx, app, waiting)
+		}
+	}
+	if app.Spec.Chart != nil {
+		return c.reconcileChart(ctx, app)
+	}
+
+	image, err := c.resolveImage(app)
+	if err != nil {
+		return c.setFailed(ctx, app, "ImageResolveFailed", err)
+	}
+	if err := validateStrategy(app); err != nil {
+		return c.setFailed(ctx, app, "InvalidStrategy", err)
+	}
+	if err := validatePromotion(app); err != nil {
+		return c.setFailed(ctx, app, "InvalidPromotion", err)
+	}
+	if err := validateScaling(app); err != nil {
+		return c.setFailed(ctx, app, "InvalidScaling", err)
+	}
+
+	if app.Spec.Promotion != nil {
+		return c.reconcilePipeline(ctx, app, image)
+	}
+	// Stages left over from a removed pipeline
+	if app.Status.Stages != nil {
+		if err := c.deleteStageApps(ctx, app.Namespace, app.Name, nil); err != nil {
+			return c.setFailed(ctx, app, "ApplyFailed", err)
+		}
+		app.Status.Stages = nil
+	}
+
+	// The strategy applies the Deployments and picks the one serving traffic
+	var serving workload
+	switch strategyType(app) {
+	case StrategyCanary:
+		serving, image, err = c.rolloutCanary(ctx, app, image)
+	case StrategyBlueGreen:
+		serving, image, err = c.rolloutBlueGreen(ctx, app, image)
+	default:
+		serving, image, err = c.rolloutRolling(ctx, app, image)
+	}
+	if err != nil {
+		return c.setFailed(ctx, app, "ApplyFailed", err)
+	}
+
+	service := renderService(app, app.Name, serving)
+	if err := c.apply(ctx, "", "v1", "services", app.Namespace, service.Name, service); err != nil {
+		return c.setFailed(ctx, app, "ApplyFailed", err)
+	}
+
+	if app.Spec.Ingress != nil && app.Spec.Ingress.Host != "" {
+		ingress := renderIngress(app, app.Name, app.Spec.Ingress.Host, app.Name)
+		if err := c.apply(ctx, "networking.k8s.io", "v1", "ingresses", app.Namespace, ingress.Name, ingress); err != nil {
+			return c.setFailed(ctx, app, "ApplyFailed", err)
+		}
+	}
+
+	if err := c.applyScaling(ctx, app, serving); err != nil {
+		return c.setFailed(ctx, app, "ApplyFailed", err)
+	}
+
+	live, err := c.kube.AppsV1().Deployments(app.Namespace).Get(ctx, serving.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	desired := int32(1)
+	if live.Spec.Replicas != nil {
+		desired = *live.Spec.Replicas
+	}
+
+	if app.Status.Image != image {
+		log.Printf("Application %s/%s now running %s", app.Namespace, app.Name, image)
+	}
+	app.Status.Image = image
+	app.Status.Ready = fmt.Sprintf("%d/%d", live.Status.ReadyReplicas, desired)
+
+	cond := metav1.Condition{
+		Type:    "Ready",
+		Status:  metav1.ConditionFalse,
+		Reason:  "RolloutInProgress",
+		Message: fmt.Sprintf("%d of %d replicas ready", live.Status.ReadyReplicas, desired),
+	}
+	if live.Status.ReadyReplicas >= desired && live.Status.UpdatedReplicas >= desired {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "Available"
+	}
+	return c.updateStatus(ctx, app, cond)
+}
+
+// apply server-side applies obj, taking ownership of the fields the operator
+// renders; see applyObject for drift handling
+func (c *Controller) apply(ctx context.Context, group, version, resource, namespace, name string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &u.Object); err != nil {
+		return err
+	}
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	return c.applyObject(ctx, gvr(group, version, resource), u)
+}
+
+// setFailed records a failed reconcile in status and returns the original error
+func (c *Controller) setFailed(ctx context.Context, app *Application, reason string, cause error) error {
+	cond := metav1.Condition{
+		Type:    "Ready",
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: cause.Error(),
+	}
+	if err := c.updateStatus(ctx, app, cond); err != nil {
+		log.Printf("Failed to update status for %s/%s: %v", app.Namespace, app.Name, err)
+	}
+	return cause
+}
+
+// updateStatus writes the status subresource with cond merged into the conditions
+func (c *Controller) updateStatus(ctx context.Context, app *Application, cond metav1.Condition) error {
+	c.reportDrift(ctx, app)
+	c.reportUsage(ctx, app)
+	c.pinDeployed(ctx, app, cond)
+	cond.ObservedGeneration = app.Generation
+	setCondition(&app.Status.Conditions, cond)
+	app.Status.ObservedGeneration = app.Generation
+
+	u, err := toUnstructured(app)
+	if err != nil {
+		return err
+	}
+	_, err = c.dynamic.Resource(applicationGVR).Namespace(app.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// setCondition replaces the condition of the same type, keeping the transition
+// time when the status did not change
+func setCondition(conditions *[]metav1.Condition, cond metav1.Condition) {
+	cond.LastTransitionTime = metav1.Now()
+	for i, existing := range *conditions {
+		if existing.Type != cond.Type {
+			continue
+		}
+		if existing.Status == cond.Status {
+			cond.LastTransitionTime = existing.LastTransitionTime
+		}
+		(*conditions)[i] = cond
+		return
+	}
+	*conditions = append(*conditions, cond)
+}
+
+// labels are applied to every rendered object; instance matches the homelab-app chart
+func appLabels(app *Application) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":       app.Name,
+		"app.kubernetes.io/instance":   app.Name,
+		"app.kubernetes.io/managed-by": fieldManager,
+	}
+}
+
+// workload is one Deployment rendered for an app: the stable one, a canary,
+// or a blue/green slot. Pods are told apart by their instance label.
+type workload struct {
+	Name     string
+	Instance string
+}
+
+func stableWorkload(app *Application) workload {
+	return workload{Name: app.Name, Instance: app.Name}
+}
+
+func (w workload) selector() map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/instance": w.Instance,
+	}
+}
+
+func (w workload) podLabels(app *Application) map[string]string {
+	labels := appLabels(app)
+	labels["app.kubernetes.io/instance"] = w.Instance
+	return labels
+}
+
+func ownerRefs(app *Application) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{
+		APIVersion: applicationGVR.GroupVersion().String(),
+		Kind:       "Application",
+		Name:       app.Name,
+		UID:        app.UID,
+		Controller: &controller,
+	}}
+}
+
+func objectMeta(app *Application, name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       app.Namespace,
+		Labels:          appLabels(app),
+		OwnerReferences: ownerRefs(app),
+	}
+}
+
+func appPort(app *Application) int32 {
+	if app.Spec.Port != 0 {
+		return app.Spec.Port
+	}
+	return 8000
+}
+
+// applyDeployment renders and applies w running image; replicas overrides
+// spec.replicas, e.g. for a canary or an idle slot
+func (c *Controller) applyDeployment(ctx context.Context, app *Application, w workload, image string, replicas *int32) error {
+	deployment := renderDeployment(app, w, image, replicas)
+	checksum, err := c.configChecksum(app)
+	if err != nil {
+		return err
+	}
+	if checksum != "" {
+		deployment.Spec.Template.Annotations = map[string]string{configChecksumAnnotation: checksum}
+	}
+	return c.apply(ctx, "apps", "v1", "deployments", app.Namespace, deployment.Name, deployment)
+}
+
+func renderDeployment(app *Application, w workload, image string, replicasOverride *int32) *appsv1.Deployment {
+	replicas := int32(1)
+	if app.Spec.Replicas != nil {
+		replicas = *app.Spec.Replicas
+	}
+	if app.Spec.Autoscaling != nil {
+		replicas = minReplicas(app.Spec.Autoscaling)
+	}
+	if replicasOverride != nil {
+		replicas = *replicasOverride
+	}
+
+	deployment := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: objectMeta(app, w.Name),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: w.selector()},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: w.podLabels(app)},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:      "app",
+							Image:     image,
+							Env:       app.Spec.Env,
+							EnvFrom:   app.Spec.EnvFrom,
+							Resources: app.Spec.Resources,
+							Ports: []corev1.ContainerPort{
+								{Name: "http", ContainerPort: appPort(app), Protocol: corev1.ProtocolTCP},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	// The autoscaler owns the scaled Deployment's replicas; other
+	// workloads, e.g. a blue/green slot being brought up, start at
+	// minReplicas
+	if replicasOverride == nil && app.Spec.Autoscaling != nil && w == scaledWorkload(app) {
+		deployment.Spec.Replicas = nil
+	}
+	return deployment
+}
+
+// renderService renders Service name selecting w's pods
+func renderService(app *Application, name string, w workload) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: objectMeta(app, name),
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: w.selector(),
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http",
+					Port:       80,
+					TargetPort: intstr.FromString("http"),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
+// renderIngress renders Ingress name routing host to service
+func renderIngress(app *Application, name, host, service string) *networkingv1.Ingress {
+	spec := app.Spec.Ingress
+	path := spec.Path
+	if path == "" {
+		path = "/"
+	}
+	pathType := networkingv1.PathTypePrefix
+	className := "nginx"
+
+	ingress := &networkingv1.Ingress{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "Ingress"},
+		ObjectMeta: objectMeta(app, name),
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: &className,
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: host,
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{
+								{
+									Path:     path,
+									PathType: &pathType,
+									Backend: networkingv1.IngressBackend{
+										Service: &networkingv1.IngressServiceBackend{
+											Name: service,
+											Port: networkingv1.ServiceBackendPort{Name: "http"},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// TLS via cert-manager unless explicitly disabled
+	if spec.TLS == nil || *spec.TLS {
+		ingress.Annotations = map[string]string{
+			"cert-manager.io/cluster-issuer": "letsencrypt-cloudflare",
+		}
+		ingress.Spec.TLS = []networkingv1.IngressTLS{
+			{Hosts: []string{host}, SecretName: name + "-tls"},
+		}
+	}
+	return ingress
+}
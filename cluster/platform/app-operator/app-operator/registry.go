@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/registryauth"
+)
+
+// Manifest media types accepted when resolving tags
+var manifestAccept = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}, ", ")
+
+// RegistryClient resolves tags through the Docker Registry HTTP API v2
+type RegistryClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewRegistryClient logs in with the docker config at authFile, if set
+func NewRegistryClient(baseURL, authFile string) *RegistryClient {
+	return &RegistryClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    registryauth.Client(authFile, 10*time.Second),
+	}
+}
+
+// Digest returns the manifest digest repo:tag currently points at
+func (c *RegistryClient) Digest(ctx context.Context, repo, tag string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repo, tag), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", manifestAccept)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HEAD manifest %s:%s: %s", repo, tag, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry returned no digest for %s:%s", repo, tag)
+	}
+	return digest, nil
+}
+
+// pinDigest turns "registry.example.com/app:tag" into
+// "registry.example.com/app@sha256:..."; references already pinned are kept
+func (c *RegistryClient) pinDigest(ctx context.Context, image string) (string, error) {
+	if strings.Contains(image, "@") {
+		return image, nil
+	}
+
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	// The registry host is replaced by the in-cluster registry URL
+	repo := name
+	if i := strings.Index(name, "/"); i >= 0 {
+		repo = name[i+1:]
+	}
+
+	digest, err := c.Digest(ctx, repo, tag)
+	if err != nil {
+		return "", err
+	}
+	return name + "@" + digest, nil
+}
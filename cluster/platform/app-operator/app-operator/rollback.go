@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// rolloutRolling updates the single Deployment in place. For rollback.window
+// after an image update the new pods are watched; a crash loop or failed
+// readiness puts the previous image back. It returns the workload serving
+// traffic and the image it runs.
+func (c *Controller) rolloutRolling(ctx context.Context, app *Application, image string) (workload, string, error) {
+	stable := stableWorkload(app)
+	r, err := c.rolloutStatus(ctx, app, StrategyRolling)
+	if err != nil {
+		return stable, "", err
+	}
+	now := metav1.Now()
+
+	switch {
+	case r.StableImage == "":
+		r.StableImage = image
+	case image != r.StableImage && image != r.FailedImage:
+		r.PreviousImage = r.StableImage
+		r.StableImage = image
+		r.SwitchedAt = &now
+		r.Phase = RolloutProgressing
+		r.Message = ""
+	}
+	if err := c.applyDeployment(ctx, app, stable, r.StableImage, nil); err != nil {
+		return stable, r.StableImage, err
+	}
+
+	if r.Phase != RolloutProgressing || r.SwitchedAt == nil {
+		return stable, r.StableImage, nil
+	}
+
+	window := rollbackWindow(app)
+	elapsed := time.Since(r.SwitchedAt.Time)
+	if rollbackDisabled(app) || r.PreviousImage == "" || elapsed >= window {
+		r.Phase = RolloutSucceeded
+		r.Message = ""
+		return stable, r.StableImage, nil
+	}
+
+	v, err := c.analyse(ctx, app, stable.Name, "", r.SwitchedAt.Time)
+	if err != nil {
+		return stable, r.StableImage, err
+	}
+	if v.Failed == "" && !v.Ready && elapsed >= minDuration(window, progressDeadline(app)) {
+		v.Failed = fmt.Sprintf("not ready %s after update", elapsed.Round(time.Second))
+	}
+	if v.Failed == "" {
+		c.requeueAfter(app, minDuration(checkInterval, window-elapsed))
+		return stable, r.StableImage, nil
+	}
+
+	failed := r.StableImage
+	log.Printf("Application %s/%s: rolling back %s to %s: %s", app.Namespace, app.Name, failed, r.PreviousImage, v.Failed)
+	r.FailedImage = failed
+	r.StableImage = r.PreviousImage
+	r.PreviousImage = ""
+	r.Phase = RolloutRolledBack
+	r.Message = v.Failed
+	c.notifyRollback(ctx, app, failed, r.StableImage, v.Failed)
+	return stable, r.StableImage, c.applyDeployment(ctx, app, stable, r.StableImage, nil)
+}
+
+func rollbackDisabled(app *Application) bool {
+	return app.Spec.Rollback != nil && app.Spec.Rollback.Disabled
+}
+
+func rollbackWindow(app *Application) time.Duration {
+	if app.Spec.Rollback != nil {
+		if d, _ := durationOr(app.Spec.Rollback.Window, 0); d > 0 {
+			return d
+		}
+	}
+	return 10 * time.Minute
+}
+
+func progressDeadline(app *Application) time.Duration {
+	d, _ := durationOr(analysisSpec(app).ProgressDeadline, 0)
+	if d <= 0 {
+		d = 5 * time.Minute
+	}
+	return d
+}
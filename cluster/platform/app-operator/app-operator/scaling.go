@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// defaultTargetCPUPercent is the average CPU utilisation, of the requests,
+// the autoscaler aims for
+const defaultTargetCPUPercent = 80
+
+// validateScaling rejects autoscaling and availability settings the API
+// server would refuse
+func validateScaling(app *Application) error {
+	if a := app.Spec.Autoscaling; a != nil {
+		if app.Spec.Chart != nil {
+			return fmt.Errorf("autoscaling cannot be combined with a chart")
+		}
+		if minReplicas(a) < 1 {
+			return fmt.Errorf("autoscaling.minReplicas must be at least 1")
+		}
+		if a.MaxReplicas < minReplicas(a) {
+			return fmt.Errorf("autoscaling.maxReplicas must be at least minReplicas")
+		}
+		if a.TargetCPUPercent != nil && (*a.TargetCPUPercent < 1 || *a.TargetCPUPercent > 100) {
+			return fmt.Errorf("autoscaling.targetCPUPercent must be between 1 and 100")
+		}
+		if _, ok := app.Spec.Resources.Requests[corev1.ResourceCPU]; !ok {
+			return fmt.Errorf("autoscaling needs resources.requests.cpu")
+		}
+	}
+	if a := app.Spec.Availability; a != nil {
+		if app.Spec.Chart != nil {
+			return fmt.Errorf("availability cannot be combined with a chart")
+		}
+		if a.MinAvailable == nil {
+			return fmt.Errorf("availability.minAvailable is required")
+		}
+		if _, err := intstr.GetScaledValueFromIntOrPercent(a.MinAvailable, 100, true); err != nil {
+			return fmt.Errorf("availability.minAvailable: %w", err)
+		}
+	}
+	return nil
+}
+
+func minReplicas(a *AutoscalingSpec) int32 {
+	if a.MinReplicas == nil {
+		return 1
+	}
+	return *a.MinReplicas
+}
+
+// scaledWorkload is the Deployment the autoscaler sizes: the active
+// blue/green slot, else the stable Deployment
+func scaledWorkload(app *Application) workload {
+	if strategyType(app) == StrategyBlueGreen && app.Status.Rollout != nil && app.Status.Rollout.ActiveSlot != "" {
+		return slotWorkload(app, app.Status.Rollout.ActiveSlot)
+	}
+	return stableWorkload(app)
+}
+
+// applyScaling points the app's HorizontalPodAutoscaler and
+// PodDisruptionBudget at the serving workload, or deletes them once the
+// Application no longer asks for them
+func (c *Controller) applyScaling(ctx context.Context, app *Application, serving workload) error {
+	hpas := gvr("autoscaling", "v2", "horizontalpodautoscalers")
+	if app.Spec.Autoscaling == nil {
+		if err := c.deleteObject(ctx, hpas, app.Namespace, app.Name); err != nil {
+			return err
+		}
+	} else {
+		hpa := renderHPA(app, serving)
+		if err := c.apply(ctx, "autoscaling", "v2", "horizontalpodautoscalers", app.Namespace, hpa.Name, hpa); err != nil {
+			return err
+		}
+	}
+
+	pdbs := gvr("policy", "v1", "poddisruptionbudgets")
+	if app.Spec.Availability == nil {
+		return c.deleteObject(ctx, pdbs, app.Namespace, app.Name)
+	}
+	pdb := renderPDB(app, serving)
+	return c.apply(ctx, "policy", "v1", "poddisruptionbudgets", app.Namespace, pdb.Name, pdb)
+}
+
+// renderHPA scales w on average CPU utilisation
+func renderHPA(app *Application, w workload) *autoscalingv2.HorizontalPodAutoscaler {
+	a := app.Spec.Autoscaling
+	minimum := minReplicas(a)
+	target := int32(defaultTargetCPUPercent)
+	if a.TargetCPUPercent != nil {
+		target = *a.TargetCPUPercent
+	}
+
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "autoscaling/v2", Kind: "HorizontalPodAutoscaler"},
+		ObjectMeta: objectMeta(app, app.Name),
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       w.Name,
+			},
+			MinReplicas: &minimum,
+			MaxReplicas: a.MaxReplicas,
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ResourceMetricSourceType,
+					Resource: &autoscalingv2.ResourceMetricSource{
+						Name: corev1.ResourceCPU,
+						Target: autoscalingv2.MetricTarget{
+							Type:               autoscalingv2.UtilizationMetricType,
+							AverageUtilization: &target,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// renderPDB keeps minAvailable of w's pods up through voluntary
+// disruptions such as node drains
+func renderPDB(app *Application, w workload) *policyv1.PodDisruptionBudget {
+	return &policyv1.PodDisruptionBudget{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "policy/v1", Kind: "PodDisruptionBudget"},
+		ObjectMeta: objectMeta(app, app.Name),
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MinAvailable: app.Spec.Availability.MinAvailable,
+			Selector:     &metav1.LabelSelector{MatchLabels: w.selector()},
+		},
+	}
+}
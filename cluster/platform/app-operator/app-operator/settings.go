@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/homelab/internal/config"
+)
+
+// Settings are read at startup: defaults, then the -settings YAML file
+// (SETTINGS_FILE), then the environment, then flags
+type Settings struct {
+	Port             string        `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+	BuildNamespace   string        `json:"buildNamespace" env:"BUILD_NAMESPACE" flag:"build-namespace" usage:"namespace of the build jobs"`
+	ResyncInterval   time.Duration `json:"resyncInterval" env:"RESYNC_INTERVAL" flag:"resync-interval"`
+	PrometheusURL    string        `json:"prometheusURL" env:"PROMETHEUS_URL" flag:"prometheus-url" usage:"Prometheus for analysis queries"`
+	RegistryURL      string        `json:"registryURL" env:"REGISTRY_URL" flag:"registry-url" usage:"registry API"`
+	RegistryAuthFile string        `json:"registryAuthFile" env:"REGISTRY_AUTH_FILE" flag:"registry-auth-file" usage:"docker config with the registry login"`
+	NotifyURL        string        `json:"notifyURL" env:"NOTIFY_WEBHOOK_URL" flag:"notify-url" usage:"webhook told about rollouts"`
+	// ChartClusterKinds are cluster-scoped kinds charts may create
+	ChartClusterKinds []string `json:"chartClusterKinds" env:"CHART_CLUSTER_KINDS" flag:"chart-cluster-kinds" usage:"comma separated"`
+
+	// PinsURL enables image pinning in the registry when set
+	PinsURL string        `json:"pinsURL" env:"REGISTRY_PINS_URL" flag:"pins-url"`
+	PinTTL  time.Duration `json:"pinTTL" env:"PIN_TTL" flag:"pin-ttl" usage:"how long deployed images stay pinned"`
+	// PinsToken is one of registry-gc's API_TOKEN tokens
+	PinsToken string `json:"-" env:"REGISTRY_PINS_TOKEN"`
+
+	// The API takes bearer tokens or OIDC tokens, like the build API
+	APITokens    string   `json:"-" env:"API_TOKENS"`
+	OIDCIssuer   string   `json:"oidcIssuer" env:"OIDC_ISSUER" flag:"oidc-issuer"`
+	OIDCAudience string   `json:"oidcAudience" env:"OIDC_AUDIENCE" flag:"oidc-audience"`
+	OIDCGroups   []string `json:"oidcGroups" env:"OIDC_GROUPS" flag:"oidc-groups" usage:"groups allowed through OIDC, comma separated"`
+	// AllowUnauthenticated opens the API when no credentials are set;
+	// otherwise it refuses every request
+	AllowUnauthenticated bool `json:"allowUnauthenticated" env:"ALLOW_UNAUTHENTICATED" flag:"allow-unauthenticated"`
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		Port:           "8080",
+		BuildNamespace: "container-registry",
+		ResyncInterval: time.Minute,
+		PrometheusURL:  "http://prometheus.monitoring.svc.cluster.local:9090",
+		RegistryURL:    "https://docker-registry.container-registry.svc.cluster.local:5000",
+		PinTTL:         30 * 24 * time.Hour,
+	}
+}
+
+// loadSettings layers the file, environment, and flags over the defaults
+func loadSettings() (*Settings, error) {
+	s := defaultSettings()
+	if err := config.Load(s, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate implements config.Validator
+func (s *Settings) Validate() error {
+	if s.ResyncInterval <= 0 {
+		return fmt.Errorf("invalid RESYNC_INTERVAL: must be positive")
+	}
+	if s.PinTTL <= 0 {
+		return fmt.Errorf("invalid PIN_TTL: must be positive")
+	}
+	return nil
+}
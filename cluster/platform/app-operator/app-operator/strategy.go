@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// checkInterval is how often an in-flight rollout is re-analysed
+const checkInterval = 15 * time.Second
+
+func strategyType(app *Application) string {
+	if app.Spec.Strategy == nil || app.Spec.Strategy.Type == "" {
+		return StrategyRolling
+	}
+	return app.Spec.Strategy.Type
+}
+
+// validateStrategy rejects settings that would fail mid-rollout
+func validateStrategy(app *Application) error {
+	if rb := app.Spec.Rollback; rb != nil {
+		if _, err := durationOr(rb.Window, 0); err != nil {
+			return fmt.Errorf("rollback.window: %w", err)
+		}
+	}
+
+	s := app.Spec.Strategy
+	if s == nil {
+		return nil
+	}
+
+	switch strategyType(app) {
+	case StrategyRolling:
+	case StrategyCanary:
+		// Traffic is split by ingress-nginx, so there must be an Ingress
+		if app.Spec.Ingress == nil || app.Spec.Ingress.Host == "" {
+			return fmt.Errorf("canary strategy needs spec.ingress")
+		}
+		if s.Canary != nil {
+			for _, w := range s.Canary.Weights {
+				if w < 1 || w > 99 {
+					return fmt.Errorf("canary weights must be between 1 and 99, got %d", w)
+				}
+			}
+			if _, err := durationOr(s.Canary.StepDuration, 0); err != nil {
+				return fmt.Errorf("canary.stepDuration: %w", err)
+			}
+		}
+	case StrategyBlueGreen:
+		if bg := s.BlueGreen; bg != nil {
+			if _, err := durationOr(bg.PromotionDelay, 0); err != nil {
+				return fmt.Errorf("blueGreen.promotionDelay: %w", err)
+			}
+			if _, err := durationOr(bg.ScaleDownDelay, 0); err != nil {
+				return fmt.Errorf("blueGreen.scaleDownDelay: %w", err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown strategy %q", s.Type)
+	}
+
+	if a := s.Analysis; a != nil {
+		if _, err := durationOr(a.ProgressDeadline, 0); err != nil {
+			return fmt.Errorf("analysis.progressDeadline: %w", err)
+		}
+	}
+	return nil
+}
+
+// rolloutStatus returns the app's rollout state for strategy, starting fresh
+// (and removing the previous strategy's objects) when the strategy changed
+func (c *Controller) rolloutStatus(ctx context.Context, app *Application, strategy string) (*RolloutStatus, error) {
+	if r := app.Status.Rollout; r != nil && r.Strategy == strategy {
+		return r, nil
+	}
+	if err := c.cleanupStrategies(ctx, app, strategy); err != nil {
+		return nil, err
+	}
+	app.Status.Rollout = &RolloutStatus{Strategy: strategy, StableImage: app.Status.Image}
+	return app.Status.Rollout, nil
+}
+
+// cleanupStrategies deletes the objects other strategies render
+func (c *Controller) cleanupStrategies(ctx context.Context, app *Application, keep string) error {
+	type object struct {
+		resource schema.GroupVersionResource
+		name     string
+	}
+	var objects []object
+	add := func(resource schema.GroupVersionResource, name string) {
+		objects = append(objects, object{resource, name})
+	}
+
+	deployments := gvr("apps", "v1", "deployments")
+	services := gvr("", "v1", "services")
+	ingresses := gvr("networking.k8s.io", "v1", "ingresses")
+	if keep != StrategyCanary {
+		add(deployments, canaryName(app))
+		add(services, canaryName(app))
+		add(ingresses, canaryName(app))
+	}
+	if keep != StrategyBlueGreen {
+		add(deployments, slotWorkload(app, slotBlue).Name)
+		add(deployments, slotWorkload(app, slotGreen).Name)
+		add(services, previewName(app))
+		add(ingresses, previewName(app))
+	}
+
+	for _, obj := range objects {
+		if err := c.deleteObject(ctx, obj.resource, app.Namespace, obj.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteObject deletes an owned object, ignoring ones already gone
+func (c *Controller) deleteObject(ctx context.Context, resource schema.GroupVersionResource, namespace, name string) error {
+	err := c.dynamic.Resource(resource).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting %s %s/%s: %w", resource.Resource, namespace, name, err)
+	}
+	return nil
+}
+
+// requeueAfter re-reconciles app once an in-flight rollout step is due
+func (c *Controller) requeueAfter(app *Application, d time.Duration) {
+	if d < time.Second {
+		d = time.Second
+	}
+	c.queue.AddAfter(app.Namespace+"/"+app.Name, d)
+}
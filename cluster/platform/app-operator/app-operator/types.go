@@ -0,0 +1,343 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// applicationGVR identifies the Application custom resource
+var applicationGVR = schema.GroupVersionResource{
+	Group:    "homelab.mcztest.com",
+	Version:  "v1alpha1",
+	Resource: "applications",
+}
+
+func gvr(group, version, resource string) schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: group, Version: version, Resource: resource}
+}
+
+// Tag policies for ImageSpec.TagPolicy
+const (
+	TagPolicyPinned      = "Pinned"
+	TagPolicyLatestBuild = "LatestBuild"
+)
+
+// Application is the homelab app definition reconciled by the operator
+type Application struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ApplicationSpec   `json:"spec"`
+	Status ApplicationStatus `json:"status,omitempty"`
+}
+
+// ApplicationSpec is the desired state of an app
+type ApplicationSpec struct {
+	Image     ImageSpec                   `json:"image"`
+	Replicas  *int32                      `json:"replicas,omitempty"`
+	Port      int32                       `json:"port,omitempty"`
+	Env       []corev1.EnvVar             `json:"env,omitempty"`
+	EnvFrom   []corev1.EnvFromSource      `json:"envFrom,omitempty"`
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	Ingress   *IngressSpec                `json:"ingress,omitempty"`
+	Strategy  *StrategySpec               `json:"strategy,omitempty"`
+	Rollback  *RollbackSpec               `json:"rollback,omitempty"`
+	Promotion *PromotionSpec              `json:"promotion,omitempty"`
+	Drift     *DriftSpec                  `json:"drift,omitempty"`
+	// Autoscaling sizes the serving Deployment with a
+	// HorizontalPodAutoscaler; spec.replicas is then ignored
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
+	// Availability keeps pods up through node drains with a
+	// PodDisruptionBudget
+	Availability *AvailabilitySpec `json:"availability,omitempty"`
+	// DependsOn are Applications that must be Ready before this one rolls
+	// out, e.g. its database
+	DependsOn []DependencySpec `json:"dependsOn,omitempty"`
+	// Chart deploys a Helm chart in place of the rendered Deployment,
+	// Service, and Ingress
+	Chart *ChartSpec `json:"chart,omitempty"`
+}
+
+// DriftSpec controls what happens to rendered objects edited outside the
+// operator, e.g. with kubectl edit
+type DriftSpec struct {
+	// SelfHeal re-applies edited objects (default true); false only reports
+	// them in the Drifted condition and status.drifted
+	SelfHeal *bool `json:"selfHeal,omitempty"`
+}
+
+// DependencySpec names an Application this one depends on
+type DependencySpec struct {
+	Name string `json:"name"`
+	// Namespace defaults to the dependent Application's own
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// AutoscalingSpec scales the app between MinReplicas (default 1) and
+// MaxReplicas on average CPU utilisation of the requests
+type AutoscalingSpec struct {
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	MaxReplicas int32  `json:"maxReplicas"`
+	// TargetCPUPercent is the utilisation aimed for (default 80)
+	TargetCPUPercent *int32 `json:"targetCPUPercent,omitempty"`
+}
+
+// AvailabilitySpec is the disruption budget of the app's pods
+type AvailabilitySpec struct {
+	// MinAvailable is a pod count or a percentage, e.g. 1 or "50%"
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+}
+
+// ChartSpec renders a Helm chart with helm template and applies the result.
+// Chart is an oci:// reference, or a chart name in Repo.
+type ChartSpec struct {
+	Chart   string `json:"chart"`
+	Repo    string `json:"repo,omitempty"`
+	Version string `json:"version,omitempty"`
+	// PlainHTTP pulls oci:// charts over HTTP, e.g. from the in-cluster registry
+	PlainHTTP bool                   `json:"plainHTTP,omitempty"`
+	Values    map[string]interface{} `json:"values,omitempty"`
+	// ImageValues are the values paths the resolved spec.image is written to
+	ImageValues *ChartImageValues `json:"imageValues,omitempty"`
+}
+
+// ChartImageValues are dotted values paths, e.g. image.repository
+type ChartImageValues struct {
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	// Digest receives the digest of digest-pinned images
+	Digest string `json:"digest,omitempty"`
+}
+
+// RollbackSpec controls automatic rollback of Rolling updates
+type RollbackSpec struct {
+	// Disabled leaves a failing image in place
+	Disabled bool `json:"disabled,omitempty"`
+	// Window is how long after an image update crash loops or failed
+	// readiness roll back to the previous image
+	Window string `json:"window,omitempty"`
+}
+
+// Stage approvals for StageSpec.Approval
+const (
+	ApprovalAutomatic = "Automatic"
+	ApprovalManual    = "Manual"
+)
+
+// PromotionSpec turns the Application into a pipeline: the resolved image
+// runs in the first stage and the same digest is promoted stage by stage
+type PromotionSpec struct {
+	Stages []StageSpec `json:"stages"`
+}
+
+// StageSpec is one environment of a promotion pipeline, deployed as an
+// Application of the same name in its own namespace
+type StageSpec struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// SoakTime is how long the stage must stay healthy before its image is
+	// promoted to the next stage
+	SoakTime string `json:"soakTime,omitempty"`
+	// Approval is Automatic (default) or Manual; a Manual stage only takes a
+	// new image once it is approved through the API
+	Approval string `json:"approval,omitempty"`
+	// Host exposes the stage through spec.ingress settings on its own hostname
+	Host     string `json:"host,omitempty"`
+	Replicas *int32 `json:"replicas,omitempty"`
+}
+
+// ImageSpec selects the container image and how its tag is chosen
+type ImageSpec struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	TagPolicy  string `json:"tagPolicy,omitempty"`
+	BuildApp   string `json:"buildApp,omitempty"`
+	// Digest pins the image by content; it takes precedence over the tag
+	Digest string `json:"digest,omitempty"`
+}
+
+// IngressSpec exposes the app on a hostname through ingress-nginx
+type IngressSpec struct {
+	Host string `json:"host"`
+	Path string `json:"path,omitempty"`
+	TLS  *bool  `json:"tls,omitempty"`
+}
+
+// Rollout strategies for StrategySpec.Type
+const (
+	StrategyRolling   = "Rolling"
+	StrategyCanary    = "Canary"
+	StrategyBlueGreen = "BlueGreen"
+)
+
+// StrategySpec controls how a new image replaces the running one
+type StrategySpec struct {
+	Type      string         `json:"type,omitempty"`
+	Canary    *CanarySpec    `json:"canary,omitempty"`
+	BlueGreen *BlueGreenSpec `json:"blueGreen,omitempty"`
+	Analysis  *AnalysisSpec  `json:"analysis,omitempty"`
+}
+
+// CanarySpec shifts ingress traffic to the new version in weighted steps
+type CanarySpec struct {
+	// Weights are the percentages sent to the new version, one step each
+	Weights []int32 `json:"weights,omitempty"`
+	// StepDuration is how long each weight is held and analysed
+	StepDuration string `json:"stepDuration,omitempty"`
+}
+
+// BlueGreenSpec runs the new version in the idle slot and switches the
+// Service to it once healthy
+type BlueGreenSpec struct {
+	// PreviewHost exposes the idle slot through its own Ingress
+	PreviewHost string `json:"previewHost,omitempty"`
+	// PromotionDelay is how long the new slot must stay healthy before the switch
+	PromotionDelay string `json:"promotionDelay,omitempty"`
+	// ScaleDownDelay keeps the previous slot running after the switch so a
+	// regression can switch straight back
+	ScaleDownDelay string `json:"scaleDownDelay,omitempty"`
+}
+
+// AnalysisSpec decides whether a new version has regressed
+type AnalysisSpec struct {
+	// ProgressDeadline fails a new version whose pods are not ready in time
+	ProgressDeadline string `json:"progressDeadline,omitempty"`
+	// MaxRestarts fails a new version whose containers restart more often
+	MaxRestarts *int32 `json:"maxRestarts,omitempty"`
+	// MaxErrorPercent fails a new version whose 5xx ratio exceeds it; needs Prometheus
+	MaxErrorPercent *int32 `json:"maxErrorPercent,omitempty"`
+	// ErrorRateQuery overrides the ingress-nginx 5xx ratio query; it may use
+	// {{.Namespace}}, {{.Name}} and {{.Ingress}}
+	ErrorRateQuery string `json:"errorRateQuery,omitempty"`
+}
+
+// ApplicationStatus is written back by the operator after each reconcile
+type ApplicationStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Image              string             `json:"image,omitempty"`
+	Ready              string             `json:"ready,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	Rollout            *RolloutStatus     `json:"rollout,omitempty"`
+	Stages             []StageStatus      `json:"stages,omitempty"`
+	Chart              *ChartStatus       `json:"chart,omitempty"`
+	// Drifted are the objects found edited outside the operator on the last
+	// reconcile
+	Drifted []ResourceRef `json:"drifted,omitempty"`
+	// Resources is the app's resource usage against its requests and limits
+	Resources *ResourceUsage `json:"resources,omitempty"`
+}
+
+// ResourceUsage sums the app's running pods: usage from metrics-server and
+// the requests and limits they run with
+type ResourceUsage struct {
+	Pods   int32           `json:"pods"`
+	CPU    ResourceFigures `json:"cpu"`
+	Memory ResourceFigures `json:"memory"`
+	// PeakSince starts the window the peak figures cover
+	PeakSince *metav1.Time `json:"peakSince,omitempty"`
+	// Flags are NoRequests and NoLimits when a container sets none, and
+	// OverProvisionedCPU or OverProvisionedMemory when a window's peak
+	// usage stayed under 30% of the requests
+	Flags     []string     `json:"flags,omitempty"`
+	SampledAt *metav1.Time `json:"sampledAt,omitempty"`
+}
+
+// ResourceFigures are one resource's totals; Usage and Peak are unset
+// without metrics-server
+type ResourceFigures struct {
+	Usage    *resource.Quantity `json:"usage,omitempty"`
+	Peak     *resource.Quantity `json:"peak,omitempty"`
+	Requests *resource.Quantity `json:"requests,omitempty"`
+	Limits   *resource.Quantity `json:"limits,omitempty"`
+}
+
+// ChartStatus records the objects applied from spec.chart, so ones the
+// chart stops rendering are pruned
+type ChartStatus struct {
+	// Chart is the chart reference and version rendered
+	Chart      string        `json:"chart,omitempty"`
+	Resources  []ResourceRef `json:"resources,omitempty"`
+	RenderedAt *metav1.Time  `json:"renderedAt,omitempty"`
+}
+
+// ResourceRef identifies an object applied for an Application
+type ResourceRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+// Stage phases for StageStatus.Phase
+const (
+	StagePending          = "Pending"
+	StageDeploying        = "Deploying"
+	StageSoaking          = "Soaking"
+	StageReady            = "Ready"
+	StageAwaitingApproval = "AwaitingApproval"
+	StageFailed           = "Failed"
+)
+
+// StageStatus tracks one stage of a promotion pipeline
+type StageStatus struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Phase     string `json:"phase,omitempty"`
+	// Image is the digest reference deployed to the stage
+	Image string `json:"image,omitempty"`
+	// PendingImage is waiting for approval to be promoted into the stage
+	PendingImage string       `json:"pendingImage,omitempty"`
+	HealthySince *metav1.Time `json:"healthySince,omitempty"`
+	PromotedAt   *metav1.Time `json:"promotedAt,omitempty"`
+	Message      string       `json:"message,omitempty"`
+}
+
+// Rollout phases for RolloutStatus.Phase
+const (
+	RolloutProgressing = "Progressing"
+	RolloutSucceeded   = "Succeeded"
+	RolloutRolledBack  = "RolledBack"
+)
+
+// RolloutStatus tracks a canary or blue/green rollout across reconciles
+type RolloutStatus struct {
+	Strategy string `json:"strategy,omitempty"`
+	Phase    string `json:"phase,omitempty"`
+	// StableImage serves production traffic
+	StableImage string `json:"stableImage,omitempty"`
+	// CandidateImage is being rolled out
+	CandidateImage string `json:"candidateImage,omitempty"`
+	// FailedImage was rolled back and is not retried until the image changes
+	FailedImage   string       `json:"failedImage,omitempty"`
+	Step          int32        `json:"step,omitempty"`
+	StepStartedAt *metav1.Time `json:"stepStartedAt,omitempty"`
+	// ActiveSlot is the blue/green slot the Service selects
+	ActiveSlot string       `json:"activeSlot,omitempty"`
+	SwitchedAt *metav1.Time `json:"switchedAt,omitempty"`
+	// PreviousImage runs in the idle slot until ScaleDownDelay passes
+	PreviousImage string `json:"previousImage,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+// fromUnstructured converts a dynamic client object into an Application
+func fromUnstructured(u *unstructured.Unstructured) (*Application, error) {
+	var app Application
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &app); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// toUnstructured converts an Application back for status updates
+func toUnstructured(app *Application) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(app)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
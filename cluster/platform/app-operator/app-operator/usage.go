@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// podMetricsGVR is metrics-server's per-pod usage
+var podMetricsGVR = gvr("metrics.k8s.io", "v1beta1", "pods")
+
+// usageInterval spaces usage samples, as apps reconcile on every resync
+// and status write
+const usageInterval = time.Minute
+
+// overProvisionWindow is how long peak usage is tracked before it is
+// compared with the requests
+const overProvisionWindow = 72 * time.Hour
+
+// overProvisionRatio flags a resource whose peak usage over a whole window
+// stayed below this share of its requests
+const overProvisionRatio = 0.3
+
+// Resource usage flags for ResourceUsage.Flags
+const (
+	FlagNoRequests            = "NoRequests"
+	FlagNoLimits              = "NoLimits"
+	FlagOverProvisionedCPU    = "OverProvisionedCPU"
+	FlagOverProvisionedMemory = "OverProvisionedMemory"
+)
+
+// podSelectors selects the app's pods: those of its rendered Deployments,
+// or of the Deployments and StatefulSets its chart applied
+func (c *Controller) podSelectors(ctx context.Context, app *Application) ([]labels.Selector, error) {
+	if app.Spec.Chart == nil {
+		return []labels.Selector{labels.SelectorFromSet(labels.Set{
+			"app.kubernetes.io/name":       app.Name,
+			"app.kubernetes.io/managed-by": fieldManager,
+		})}, nil
+	}
+	if app.Status.Chart == nil {
+		return nil, nil
+	}
+
+	var selectors []labels.Selector
+	for _, ref := range app.Status.Chart.Resources {
+		if ref.APIVersion != "apps/v1" || ref.Namespace != app.Namespace {
+			continue
+		}
+		var selector *metav1.LabelSelector
+		switch ref.Kind {
+		case "Deployment":
+			d, err := c.kube.AppsV1().Deployments(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			selector = d.Spec.Selector
+		case "StatefulSet":
+			s, err := c.kube.AppsV1().StatefulSets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			selector = s.Spec.Selector
+		default:
+			continue
+		}
+		s, err := metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, s)
+	}
+	return selectors, nil
+}
+
+// addQuantity adds q to the running total at *sum
+func addQuantity(sum **resource.Quantity, q resource.Quantity) {
+	if *sum == nil {
+		zero := resource.Quantity{Format: q.Format}
+		*sum = &zero
+	}
+	(*sum).Add(q)
+}
+
+// sampleUsage sums requests, limits, and (when metrics-server answers)
+// usage over the app's running pods
+func (c *Controller) sampleUsage(ctx context.Context, app *Application) (*ResourceUsage, error) {
+	selectors, err := c.podSelectors(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &ResourceUsage{}
+	seen := make(map[string]bool)
+	metricsAvailable := true
+	noRequests, noLimits := false, false
+	for _, selector := range selectors {
+		pods, err := c.kube.CoreV1().Pods(app.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range pods.Items {
+			if seen[pod.Name] || pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+			seen[pod.Name] = true
+			u.Pods++
+			for _, container := range pod.Spec.Containers {
+				req, lim := container.Resources.Requests, container.Resources.Limits
+				if len(req) == 0 {
+					noRequests = true
+				}
+				if len(lim) == 0 {
+					noLimits = true
+				}
+				for name, figures := range map[corev1.ResourceName]*ResourceFigures{corev1.ResourceCPU: &u.CPU, corev1.ResourceMemory: &u.Memory} {
+					if q, ok := req[name]; ok {
+						addQuantity(&figures.Requests, q)
+					}
+					if q, ok := lim[name]; ok {
+						addQuantity(&figures.Limits, q)
+					}
+				}
+			}
+		}
+
+		if !metricsAvailable {
+			continue
+		}
+		list, err := c.dynamic.Resource(podMetricsGVR).Namespace(app.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			// Without metrics-server only requests and limits are reported
+			if !apierrors.IsNotFound(err) && !apierrors.IsServiceUnavailable(err) {
+				log.Printf("Failed to read pod metrics of %s/%s: %v", app.Namespace, app.Name, err)
+			}
+			metricsAvailable = false
+			continue
+		}
+		for _, item := range list.Items {
+			if !seen[item.GetName()] {
+				continue
+			}
+			if err := addPodUsage(u, &item); err != nil {
+				return nil, fmt.Errorf("reading metrics of pod %s: %w", item.GetName(), err)
+			}
+		}
+	}
+	if !metricsAvailable {
+		u.CPU.Usage, u.Memory.Usage = nil, nil
+	}
+	if noRequests {
+		u.Flags = append(u.Flags, FlagNoRequests)
+	}
+	if noLimits {
+		u.Flags = append(u.Flags, FlagNoLimits)
+	}
+	return u, nil
+}
+
+// addPodUsage adds a PodMetrics object's container usage to u
+func addPodUsage(u *ResourceUsage, item *unstructured.Unstructured) error {
+	containers, _, err := unstructured.NestedSlice(item.Object, "containers")
+	if err != nil {
+		return err
+	}
+	for _, obj := range containers {
+		container, ok := obj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		usage, _, err := unstructured.NestedStringMap(container, "usage")
+		if err != nil {
+			return err
+		}
+		for name, figures := range map[string]*ResourceFigures{"cpu": &u.CPU, "memory": &u.Memory} {
+			v, ok := usage[name]
+			if !ok {
+				continue
+			}
+			q, err := resource.ParseQuantity(v)
+			if err != nil {
+				return err
+			}
+			addQuantity(&figures.Usage, q)
+		}
+	}
+	return nil
+}
+
+// overProvisioned reports whether the window's peak usage stayed under
+// overProvisionRatio of the requests
+func overProvisioned(f ResourceFigures) bool {
+	if f.Peak == nil || f.Requests == nil || f.Requests.IsZero() {
+		return false
+	}
+	return f.Peak.AsApproximateFloat64() < overProvisionRatio*f.Requests.AsApproximateFloat64()
+}
+
+// reportUsage samples the app's resource usage into status.resources at
+// most every usageInterval. Peak usage is tracked over overProvisionWindow;
+// when a window ends, resources whose peak stayed well under their
+// requests are flagged until the next window ends. Newly raised flags are
+// recorded as a warning Event.
+func (c *Controller) reportUsage(ctx context.Context, app *Application) {
+	// Pipelines run nothing themselves; each stage reports its own usage
+	if app.Spec.Promotion != nil {
+		app.Status.Resources = nil
+		return
+	}
+	prev := app.Status.Resources
+	if prev != nil && prev.SampledAt != nil && time.Since(prev.SampledAt.Time) < usageInterval {
+		return
+	}
+
+	u, err := c.sampleUsage(ctx, app)
+	if err != nil {
+		log.Printf("Failed to sample resource usage of %s/%s: %v", app.Namespace, app.Name, err)
+		return
+	}
+	now := metav1.Now()
+	u.SampledAt = &now
+	u.PeakSince = &now
+	u.CPU.Peak, u.Memory.Peak = u.CPU.Usage, u.Memory.Usage
+	if prev != nil && prev.PeakSince != nil {
+		u.PeakSince = prev.PeakSince
+		for _, f := range []struct{ cur, prev *ResourceFigures }{{&u.CPU, &prev.CPU}, {&u.Memory, &prev.Memory}} {
+			if f.prev.Peak != nil && (f.cur.Peak == nil || f.prev.Peak.Cmp(*f.cur.Peak) > 0) {
+				f.cur.Peak = f.prev.Peak
+			}
+		}
+	}
+
+	if time.Since(u.PeakSince.Time) >= overProvisionWindow {
+		if overProvisioned(u.CPU) {
+			u.Flags = append(u.Flags, FlagOverProvisionedCPU)
+		}
+		if overProvisioned(u.Memory) {
+			u.Flags = append(u.Flags, FlagOverProvisionedMemory)
+		}
+		// Start the next window from the current usage
+		u.PeakSince = &now
+		u.CPU.Peak, u.Memory.Peak = u.CPU.Usage, u.Memory.Usage
+	} else if prev != nil {
+		// Over-provisioning is only judged at the end of a window
+		for _, flag := range prev.Flags {
+			if flag == FlagOverProvisionedCPU || flag == FlagOverProvisionedMemory {
+				u.Flags = append(u.Flags, flag)
+			}
+		}
+	}
+	sort.Strings(u.Flags)
+
+	var raised []string
+	for _, flag := range u.Flags {
+		if prev == nil || !hasFlag(prev.Flags, flag) {
+			raised = append(raised, flag)
+		}
+	}
+	if len(raised) > 0 {
+		c.recordEvent(ctx, app, corev1.EventTypeWarning, "ResourceUsage", "Flagged "+strings.Join(raised, ", "))
+	}
+	app.Status.Resources = u
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// handleResources handles GET /api/v1/resources?namespace=&flagged=true,
+// returning the resource usage of every Application, optionally only in
+// one namespace or only those with flags
+func (c *Controller) handleResources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	namespace := r.URL.Query().Get("namespace")
+	flagged := r.URL.Query().Get("flagged") == "true"
+
+	type appUsage struct {
+		Namespace string         `json:"namespace"`
+		Name      string         `json:"name"`
+		Resources *ResourceUsage `json:"resources"`
+	}
+	apps := []appUsage{}
+	for _, obj := range c.appInformer.GetStore().List() {
+		app, err := fromUnstructured(obj.(*unstructured.Unstructured))
+		if err != nil || app.Status.Resources == nil {
+			continue
+		}
+		if namespace != "" && app.Namespace != namespace {
+			continue
+		}
+		if flagged && len(app.Status.Resources.Flags) == 0 {
+			continue
+		}
+		apps = append(apps, appUsage{Namespace: app.Namespace, Name: app.Name, Resources: app.Status.Resources})
+	}
+	sort.Slice(apps, func(i, j int) bool {
+		return namespacedName(apps[i].Namespace, apps[i].Name) < namespacedName(apps[j].Namespace, apps[j].Name)
+	})
+	httpkit.WriteJSON(w, http.StatusOK, apps)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Annotations read from Services and Deployments
+const (
+	annotationPrefix      = "registry.homelab/"
+	exposeAnnotation      = annotationPrefix + "expose"
+	nameAnnotation        = annotationPrefix + "name"
+	descriptionAnnotation = annotationPrefix + "description"
+	categoryAnnotation    = annotationPrefix + "category"
+	urlAnnotation         = annotationPrefix + "url"
+)
+
+// defaultURLTemplate matches the in-cluster URL scripts/deploy-app.sh
+// registers for backend services
+const defaultURLTemplate = "http://{{.Name}}.{{.Namespace}}.svc.cluster.local"
+
+// urlContext is the data available to the url annotation template, e.g.
+// "https://{{.Name}}.home.mcztest.com" or "http://{{.Name}}.{{.Namespace}}:{{.Port}}"
+type urlContext struct {
+	Name      string
+	Namespace string
+	Port      int32
+}
+
+// Entry is a registry entry declared by an annotated object
+type Entry struct {
+	App    App
+	Source string
+}
+
+// entryFor builds the registry entry for an annotated object, or returns nil
+// when it is not exposed
+func entryFor(kind string, meta metav1.ObjectMeta, port int32) (*Entry, error) {
+	if meta.Annotations[exposeAnnotation] != "true" {
+		return nil, nil
+	}
+
+	name := meta.Annotations[nameAnnotation]
+	if name == "" {
+		name = meta.Name
+	}
+
+	category := meta.Annotations[categoryAnnotation]
+	if category == "" {
+		category = "application"
+	}
+
+	urlTemplate := meta.Annotations[urlAnnotation]
+	if urlTemplate == "" {
+		urlTemplate = defaultURLTemplate
+	}
+	tmpl, err := template.New("url").Option("missingkey=error").Parse(urlTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s/%s: invalid %s: %w", kind, meta.Namespace, meta.Name, urlAnnotation, err)
+	}
+	var url bytes.Buffer
+	if err := tmpl.Execute(&url, urlContext{Name: meta.Name, Namespace: meta.Namespace, Port: port}); err != nil {
+		return nil, fmt.Errorf("%s %s/%s: rendering %s: %w", kind, meta.Namespace, meta.Name, urlAnnotation, err)
+	}
+
+	return &Entry{
+		App: App{
+			Name:        name,
+			URL:         strings.TrimSpace(url.String()),
+			Description: meta.Annotations[descriptionAnnotation],
+			Category:    category,
+		},
+		Source: fmt.Sprintf("%s/%s/%s", strings.ToLower(kind), meta.Namespace, meta.Name),
+	}, nil
+}
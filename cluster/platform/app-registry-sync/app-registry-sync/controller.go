@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Controller creates registry entries for annotated Services and Deployments
+type Controller struct {
+	registry *RegistryClient
+	factory  informers.SharedInformerFactory
+
+	services    corelisters.ServiceLister
+	deployments appslisters.DeploymentLister
+	synced      []cache.InformerSynced
+
+	trigger chan struct{}
+	// reported avoids repeating drift warnings every pass
+	reported map[string]string
+}
+
+func NewController(kube kubernetes.Interface, registry *RegistryClient) *Controller {
+	factory := informers.NewSharedInformerFactory(kube, 10*time.Minute)
+	svcInformer := factory.Core().V1().Services()
+	deployInformer := factory.Apps().V1().Deployments()
+
+	c := &Controller{
+		registry:    registry,
+		factory:     factory,
+		services:    svcInformer.Lister(),
+		deployments: deployInformer.Lister(),
+		synced:      []cache.InformerSynced{svcInformer.Informer().HasSynced, deployInformer.Informer().HasSynced},
+		trigger:     make(chan struct{}, 1),
+		reported:    make(map[string]string),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { c.enqueue() },
+	}
+	svcInformer.Informer().AddEventHandler(handler)
+	deployInformer.Informer().AddEventHandler(handler)
+	return c
+}
+
+func (c *Controller) enqueue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs on object changes (debounced) and every interval
+func (c *Controller) Run(ctx context.Context, interval time.Duration) {
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Sync(ctx); err != nil {
+			log.Printf("Sync failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.trigger:
+			// Let a rollout's burst of updates settle
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
+
+// Sync registers every exposed object not yet in the registry
+func (c *Controller) Sync(ctx context.Context) error {
+	desired := c.desired()
+
+	existing, err := c.registry.List(ctx)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]App, len(existing))
+	for _, app := range existing {
+		byName[strings.ToLower(app.Name)] = app
+	}
+
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entry := desired[name]
+		current, ok := byName[strings.ToLower(name)]
+		if !ok {
+			if err := c.registry.Create(ctx, entry.App); err != nil {
+				log.Printf("Failed to register %s from %s: %v", name, entry.Source, err)
+				continue
+			}
+			log.Printf("Registered %s (%s) from %s", name, entry.App.URL, entry.Source)
+			continue
+		}
+
+		// The registry API only supports creation; surface drift for manual fixes
+		if current.URL != entry.App.URL && c.reported[name] != entry.App.URL {
+			log.Printf("Registry entry %s has url %s but %s declares %s", name, current.URL, entry.Source, entry.App.URL)
+			c.reported[name] = entry.App.URL
+		}
+	}
+	return nil
+}
+
+// desired collects entries from annotated Services, then Deployments; a
+// Service wins when both declare the same name
+func (c *Controller) desired() map[string]*Entry {
+	entries := make(map[string]*Entry)
+
+	services, _ := c.services.List(labels.Everything())
+	for _, svc := range services {
+		entry, err := entryFor("Service", svc.ObjectMeta, servicePort(svc))
+		c.add(entries, entry, err)
+	}
+
+	deployments, _ := c.deployments.List(labels.Everything())
+	for _, d := range deployments {
+		entry, err := entryFor("Deployment", d.ObjectMeta, containerPort(d))
+		c.add(entries, entry, err)
+	}
+	return entries
+}
+
+func (c *Controller) add(entries map[string]*Entry, entry *Entry, err error) {
+	if err != nil {
+		log.Printf("Skipping annotated object: %v", err)
+		return
+	}
+	if entry == nil {
+		return
+	}
+	if prev, ok := entries[entry.App.Name]; ok {
+		if prev.Source != entry.Source && c.reported["dup:"+entry.App.Name] != entry.Source {
+			log.Printf("Ignoring %s: %s already declares %s", entry.Source, prev.Source, entry.App.Name)
+			c.reported["dup:"+entry.App.Name] = entry.Source
+		}
+		return
+	}
+	entries[entry.App.Name] = entry
+}
+
+func servicePort(svc *corev1.Service) int32 {
+	if len(svc.Spec.Ports) == 0 {
+		return 0
+	}
+	return svc.Spec.Ports[0].Port
+}
+
+func containerPort(d *appsv1.Deployment) int32 {
+	for _, c := range d.Spec.Template.Spec.Containers {
+		if len(c.Ports) > 0 {
+			return c.Ports[0].ContainerPort
+		}
+	}
+	return 0
+}
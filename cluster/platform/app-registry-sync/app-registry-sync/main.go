@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func main() {
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+
+	// Create Kubernetes client
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("Failed to get in-cluster config: %v", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	registry := NewRegistryClient(settings.RegistryURL, settings.RegistryInsecure)
+	controller := NewController(kubeClient, registry)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// /readyz fails while the API server or the registry API is
+	// unreachable; /health stays as an alias of /healthz
+	checks := health.New()
+	checks.Add("kubernetes", func(ctx context.Context) error {
+		return kubeClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+	})
+	checks.Add("registry", health.HTTP(registry.HTTP, registry.BaseURL))
+	checks.Register(http.DefaultServeMux)
+	http.HandleFunc("/health", checks.Live)
+
+	port := settings.Port
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, http.DefaultServeMux)); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	log.Printf("Starting app-registry-sync (registry: %s, interval: %s)", settings.RegistryURL, settings.Interval)
+	controller.Run(ctx, settings.Interval)
+	// Let in-flight requests finish
+	<-served
+}
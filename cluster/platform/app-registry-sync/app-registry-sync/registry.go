@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// App is an app registry entry, as posted by scripts/deploy-app.sh
+type App struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+	Category    string `json:"category,omitempty"`
+}
+
+// RegistryClient talks to the app registry API
+type RegistryClient struct {
+	BaseURL string
+	HTTP    *http.Client
+}
+
+// NewRegistryClient creates a client; insecure skips TLS verification, as
+// the registry scripts do with curl -k
+func NewRegistryClient(baseURL string, insecure bool) *RegistryClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &RegistryClient{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		HTTP:    &http.Client{Timeout: 15 * time.Second, Transport: transport},
+	}
+}
+
+// List returns the registered apps; the API has returned both a bare array
+// and an {"apps": [...]} envelope
+func (c *RegistryClient) List(ctx context.Context) ([]App, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/api/v1/apps", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing apps: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var apps []App
+	if err := json.Unmarshal(data, &apps); err != nil {
+		var envelope struct {
+			Apps []App `json:"apps"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+		apps = envelope.Apps
+	}
+	return apps, nil
+}
+
+// Create registers a new app
+func (c *RegistryClient) Create(ctx context.Context, app App) error {
+	body, err := json.Marshal(app)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/api/v1/apps", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("creating %s: %s: %s", app.Name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/homelab/internal/config"
+)
+
+// Settings are read at startup: defaults, then the -settings YAML file
+// (SETTINGS_FILE), then the environment, then flags
+type Settings struct {
+	Port             string        `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+	Interval         time.Duration `json:"interval" env:"INTERVAL" flag:"interval" usage:"time between syncs"`
+	RegistryURL      string        `json:"registryURL" env:"REGISTRY_API_URL" flag:"registry-url" usage:"registry API"`
+	RegistryInsecure bool          `json:"registryInsecure" env:"REGISTRY_INSECURE" flag:"registry-insecure" usage:"skip TLS verification of the registry API"`
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		Port:        "8080",
+		Interval:    5 * time.Minute,
+		RegistryURL: "https://registry-api.home.mcztest.com",
+	}
+}
+
+// loadSettings layers the file, environment, and flags over the defaults
+func loadSettings() (*Settings, error) {
+	s := defaultSettings()
+	if err := config.Load(s, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate implements config.Validator
+func (s *Settings) Validate() error {
+	if s.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if s.RegistryURL == "" {
+		return fmt.Errorf("registry URL is required")
+	}
+	return nil
+}
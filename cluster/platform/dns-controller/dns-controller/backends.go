@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Backend manages A records in a DNS provider
+type Backend interface {
+	Name() string
+	// Upsert creates or updates an A record for host
+	Upsert(ctx context.Context, host, ip string) error
+	// Delete removes the A record for host (ip is the last known value)
+	Delete(ctx context.Context, host, ip string) error
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// doJSON sends an optional JSON body and decodes an optional JSON response
+func doJSON(ctx context.Context, method, url string, headers map[string]string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// CloudflareBackend manages records in a Cloudflare zone (same API as scripts/add-dns.sh)
+type CloudflareBackend struct {
+	Token  string
+	Zone   string
+	zoneID string
+}
+
+func (c *CloudflareBackend) Name() string { return "cloudflare" }
+
+func (c *CloudflareBackend) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + c.Token}
+}
+
+func (c *CloudflareBackend) lookupZone(ctx context.Context) (string, error) {
+	if c.zoneID != "" {
+		return c.zoneID, nil
+	}
+	var resp struct {
+		Result []struct {
+			ID string `json:"id"`
+		} `json:"result"`
+	}
+	endpoint := "https://api.cloudflare.com/client/v4/zones?name=" + url.QueryEscape(c.Zone)
+	if err := doJSON(ctx, http.MethodGet, endpoint, c.headers(), nil, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Result) == 0 {
+		return "", fmt.Errorf("cloudflare zone %s not found", c.Zone)
+	}
+	c.zoneID = resp.Result[0].ID
+	return c.zoneID, nil
+}
+
+func (c *CloudflareBackend) recordID(ctx context.Context, zoneID, host string) (string, error) {
+	var resp struct {
+		Result []struct {
+			ID string `json:"id"`
+		} `json:"result"`
+	}
+	endpoint := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records?type=A&name=%s", zoneID, url.QueryEscape(host))
+	if err := doJSON(ctx, http.MethodGet, endpoint, c.headers(), nil, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Result) == 0 {
+		return "", nil
+	}
+	return resp.Result[0].ID, nil
+}
+
+func (c *CloudflareBackend) Upsert(ctx context.Context, host, ip string) error {
+	zoneID, err := c.lookupZone(ctx)
+	if err != nil {
+		return err
+	}
+	id, err := c.recordID(ctx, zoneID, host)
+	if err != nil {
+		return err
+	}
+
+	record := map[string]interface{}{
+		"type":    "A",
+		"name":    host,
+		"content": ip,
+		"ttl":     300,
+		"proxied": false,
+		"comment": "managed-by: dns-controller",
+	}
+	if id == "" {
+		return doJSON(ctx, http.MethodPost, fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records", zoneID),
+			c.headers(), record, nil)
+	}
+	return doJSON(ctx, http.MethodPut, fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records/%s", zoneID, id),
+		c.headers(), record, nil)
+}
+
+func (c *CloudflareBackend) Delete(ctx context.Context, host, ip string) error {
+	zoneID, err := c.lookupZone(ctx)
+	if err != nil {
+		return err
+	}
+	id, err := c.recordID(ctx, zoneID, host)
+	if err != nil || id == "" {
+		return err
+	}
+	return doJSON(ctx, http.MethodDelete, fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records/%s", zoneID, id),
+		c.headers(), nil, nil)
+}
+
+// PiholeBackend manages Local DNS records through the Pi-hole v5 admin API
+type PiholeBackend struct {
+	URL   string
+	Token string
+}
+
+func (p *PiholeBackend) Name() string { return "pihole" }
+
+func (p *PiholeBackend) customDNS(ctx context.Context, action, host, ip string) error {
+	params := url.Values{
+		"customdns": {""},
+		"action":    {action},
+		"domain":    {host},
+		"ip":        {ip},
+		"auth":      {p.Token},
+	}
+	var resp struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	endpoint := strings.TrimSuffix(p.URL, "/") + "/admin/api.php?" + params.Encode()
+	if err := doJSON(ctx, http.MethodGet, endpoint, nil, nil, &resp); err != nil {
+		return err
+	}
+	if !resp.Success && !strings.Contains(resp.Message, "already") && !strings.Contains(resp.Message, "does not exist") {
+		return fmt.Errorf("pihole %s %s: %s", action, host, resp.Message)
+	}
+	return nil
+}
+
+func (p *PiholeBackend) Upsert(ctx context.Context, host, ip string) error {
+	// Pi-hole has no update; remove any existing entry for the host first
+	var list struct {
+		Data [][]string `json:"data"`
+	}
+	params := url.Values{"customdns": {""}, "action": {"get"}, "auth": {p.Token}}
+	endpoint := strings.TrimSuffix(p.URL, "/") + "/admin/api.php?" + params.Encode()
+	if err := doJSON(ctx, http.MethodGet, endpoint, nil, nil, &list); err != nil {
+		return err
+	}
+	for _, entry := range list.Data {
+		if len(entry) == 2 && entry[0] == host {
+			if entry[1] == ip {
+				return nil
+			}
+			if err := p.customDNS(ctx, "delete", host, entry[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return p.customDNS(ctx, "add", host, ip)
+}
+
+func (p *PiholeBackend) Delete(ctx context.Context, host, ip string) error {
+	return p.customDNS(ctx, "delete", host, ip)
+}
+
+// PowerDNSBackend manages rrsets through the PowerDNS authoritative API
+type PowerDNSBackend struct {
+	URL    string
+	APIKey string
+	Zone   string
+}
+
+func (p *PowerDNSBackend) Name() string { return "powerdns" }
+
+func (p *PowerDNSBackend) patch(ctx context.Context, rrset map[string]interface{}) error {
+	zone := strings.TrimSuffix(p.Zone, ".") + "."
+	endpoint := fmt.Sprintf("%s/api/v1/servers/localhost/zones/%s", strings.TrimSuffix(p.URL, "/"), zone)
+	body := map[string]interface{}{"rrsets": []interface{}{rrset}}
+	return doJSON(ctx, http.MethodPatch, endpoint, map[string]string{"X-API-Key": p.APIKey}, body, nil)
+}
+
+func (p *PowerDNSBackend) Upsert(ctx context.Context, host, ip string) error {
+	return p.patch(ctx, map[string]interface{}{
+		"name":       strings.TrimSuffix(host, ".") + ".",
+		"type":       "A",
+		"ttl":        300,
+		"changetype": "REPLACE",
+		"records":    []map[string]interface{}{{"content": ip, "disabled": false}},
+		"comments":   []map[string]interface{}{{"content": "managed-by: dns-controller", "account": "dns-controller"}},
+	})
+}
+
+func (p *PowerDNSBackend) Delete(ctx context.Context, host, ip string) error {
+	return p.patch(ctx, map[string]interface{}{
+		"name":       strings.TrimSuffix(host, ".") + ".",
+		"type":       "A",
+		"changetype": "DELETE",
+	})
+}
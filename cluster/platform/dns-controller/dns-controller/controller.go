@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Controller reconciles desired records into the DNS backend. Records it has
+// created are tracked in a ConfigMap so hand-made entries are never removed.
+type Controller struct {
+	kube      kubernetes.Interface
+	sources   *Sources
+	backend   Backend
+	namespace string
+	stateName string
+	dryRun    bool
+
+	// runMu serialises the loop with on-demand syncs
+	runMu   sync.Mutex
+	mu      sync.Mutex
+	records []Record
+	lastRun time.Time
+	lastErr error
+}
+
+// Run reconciles every interval until ctx is cancelled
+func (c *Controller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Reconcile(ctx); err != nil {
+			log.Printf("Reconcile failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile brings the backend in line with the desired records
+func (c *Controller) Reconcile(ctx context.Context) error {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	desired, err := c.sources.Desired(ctx)
+	if err != nil {
+		c.record(nil, err)
+		return err
+	}
+
+	state, err := c.loadState(ctx)
+	if err != nil {
+		c.record(nil, err)
+		return err
+	}
+
+	var failed int
+	for host, rec := range desired {
+		if state.Data[host] == rec.IP {
+			continue
+		}
+		if c.dryRun {
+			log.Printf("[dry-run] Would set %s -> %s (%s)", host, rec.IP, rec.Source)
+			continue
+		}
+		if err := c.backend.Upsert(ctx, host, rec.IP); err != nil {
+			log.Printf("Failed to set %s -> %s: %v", host, rec.IP, err)
+			failed++
+			continue
+		}
+		log.Printf("Set %s -> %s in %s (%s)", host, rec.IP, c.backend.Name(), rec.Source)
+		state.Data[host] = rec.IP
+	}
+
+	for host, ip := range state.Data {
+		if _, ok := desired[host]; ok {
+			continue
+		}
+		if c.dryRun {
+			log.Printf("[dry-run] Would delete %s", host)
+			continue
+		}
+		if err := c.backend.Delete(ctx, host, ip); err != nil {
+			log.Printf("Failed to delete %s: %v", host, err)
+			failed++
+			continue
+		}
+		log.Printf("Deleted %s from %s", host, c.backend.Name())
+		delete(state.Data, host)
+	}
+
+	if !c.dryRun {
+		if err := c.saveState(ctx, state); err != nil {
+			c.record(nil, err)
+			return err
+		}
+	}
+
+	records := make([]Record, 0, len(desired))
+	for _, rec := range desired {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Host < records[j].Host })
+
+	if failed > 0 {
+		err = fmt.Errorf("%d record operations failed", failed)
+	}
+	c.record(records, err)
+	return err
+}
+
+func (c *Controller) record(records []Record, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if records != nil {
+		c.records = records
+	}
+	c.lastRun = time.Now()
+	c.lastErr = err
+}
+
+// Status returns the records from the last reconcile
+func (c *Controller) Status() ([]Record, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.records, c.lastRun, c.lastErr
+}
+
+// loadState reads the managed host -> IP map, creating it on first run
+func (c *Controller) loadState(ctx context.Context) (*corev1.ConfigMap, error) {
+	cm, err := c.kube.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.stateName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      c.stateName,
+				Namespace: c.namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "dns-controller"},
+			},
+		}
+		if !c.dryRun {
+			cm, err = c.kube.CoreV1().ConfigMaps(c.namespace).Create(ctx, cm, metav1.CreateOptions{})
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading state configmap: %w", err)
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	return cm, nil
+}
+
+func (c *Controller) saveState(ctx context.Context, cm *corev1.ConfigMap) error {
+	if _, err := c.kube.CoreV1().ConfigMaps(c.namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("saving state configmap: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var controller *Controller
+
+func main() {
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+
+	backend, err := newBackend(settings)
+	if err != nil {
+		log.Fatalf("Failed to configure backend: %v", err)
+	}
+
+	// Create Kubernetes client
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("Failed to get in-cluster config: %v", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	controller = &Controller{
+		kube: kubeClient,
+		sources: &Sources{
+			kube:        kubeClient,
+			domain:      settings.Domain,
+			ingressIP:   settings.IngressIP,
+			registryURL: settings.RegistryURL,
+		},
+		backend:   backend,
+		namespace: settings.Namespace,
+		stateName: settings.StateName,
+		dryRun:    settings.DryRun,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// /readyz fails while the API server is unreachable; /health stays as
+	// an alias of /healthz
+	checks := health.New()
+	checks.Add("kubernetes", func(ctx context.Context) error {
+		return kubeClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+	})
+	checks.Register(http.DefaultServeMux)
+	http.HandleFunc("/health", checks.Live)
+	http.HandleFunc("/records", handleRecords)
+	http.HandleFunc("/sync", handleSync)
+
+	port := settings.Port
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, http.DefaultServeMux)); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	log.Printf("Starting dns-controller (backend: %s, domain: %s, interval: %s)", backend.Name(), settings.Domain, settings.Interval)
+	controller.Run(ctx, settings.Interval)
+	// Let in-flight requests finish
+	<-served
+}
+
+// newBackend builds the DNS backend selected by DNS_BACKEND
+func newBackend(s *Settings) (Backend, error) {
+	switch s.Backend {
+	case "pihole":
+		return &PiholeBackend{
+			URL:   s.PiholeURL,
+			Token: s.PiholeToken,
+		}, nil
+	case "powerdns":
+		if s.PDNSURL == "" {
+			return nil, fmt.Errorf("PDNS_API_URL is required for the powerdns backend")
+		}
+		zone := s.Zone
+		if zone == "" {
+			zone = s.Domain
+		}
+		return &PowerDNSBackend{
+			URL:    s.PDNSURL,
+			APIKey: s.PDNSAPIKey,
+			Zone:   zone,
+		}, nil
+	case "cloudflare":
+		if s.CloudflareToken == "" {
+			return nil, fmt.Errorf("CLOUDFLARE_API_TOKEN is required for the cloudflare backend")
+		}
+		zone := s.Zone
+		if zone == "" {
+			zone = "mcztest.com"
+		}
+		return &CloudflareBackend{
+			Token: s.CloudflareToken,
+			Zone:  zone,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown DNS_BACKEND %q (pihole, powerdns, cloudflare)", s.Backend)
+	}
+}
+
+// handleRecords lists the records from the last reconcile
+func handleRecords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	records, lastRun, lastErr := controller.Status()
+	resp := map[string]interface{}{
+		"backend": controller.backend.Name(),
+		"dryRun":  controller.dryRun,
+		"lastRun": lastRun,
+		"records": records,
+	}
+	if lastErr != nil {
+		resp["error"] = lastErr.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleSync triggers an immediate reconcile
+func handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := controller.Reconcile(r.Context()); err != nil {
+		http.Error(w, fmt.Sprintf("Sync failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Synced")
+}
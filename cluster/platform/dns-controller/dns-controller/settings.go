@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/homelab/internal/config"
+)
+
+// Settings are read at startup: defaults, then the -settings YAML file
+// (SETTINGS_FILE), then the environment, then flags
+type Settings struct {
+	Port      string        `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+	Namespace string        `json:"namespace" env:"POD_NAMESPACE" flag:"namespace" usage:"namespace of the state ConfigMap"`
+	StateName string        `json:"stateConfigMap" env:"STATE_CONFIGMAP" flag:"state-configmap"`
+	Interval  time.Duration `json:"interval" env:"INTERVAL" flag:"interval" usage:"time between reconciles"`
+	DryRun    bool          `json:"dryRun" env:"DRY_RUN" flag:"dry-run" usage:"log changes without applying them"`
+
+	Domain      string `json:"domain" env:"DOMAIN" flag:"domain" usage:"domain records are managed under"`
+	IngressIP   string `json:"ingressIP" env:"INGRESS_IP" flag:"ingress-ip" usage:"address ingress hosts resolve to"`
+	RegistryURL string `json:"registryURL" env:"REGISTRY_API_URL" flag:"registry-url" usage:"registry API app records are read from"`
+
+	// Backend is pihole, powerdns, or cloudflare; Zone defaults to Domain
+	// for powerdns and mcztest.com for cloudflare
+	Backend   string `json:"backend" env:"DNS_BACKEND" flag:"backend" usage:"DNS backend: pihole, powerdns, cloudflare"`
+	Zone      string `json:"zone" env:"DNS_ZONE" flag:"zone"`
+	PiholeURL string `json:"piholeURL" env:"PIHOLE_URL" flag:"pihole-url"`
+	PDNSURL   string `json:"pdnsURL" env:"PDNS_API_URL" flag:"pdns-url"`
+
+	// Credentials are only read from the environment
+	PiholeToken     string `json:"-" env:"PIHOLE_TOKEN"`
+	PDNSAPIKey      string `json:"-" env:"PDNS_API_KEY"`
+	CloudflareToken string `json:"-" env:"CLOUDFLARE_API_TOKEN"`
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		Port:      "8080",
+		Namespace: "dns-controller",
+		StateName: "dns-controller-state",
+		Interval:  time.Minute,
+		Domain:    "home.mcztest.com",
+		Backend:   "pihole",
+		PiholeURL: "http://192.168.68.55",
+	}
+}
+
+// loadSettings layers the file, environment, and flags over the defaults
+func loadSettings() (*Settings, error) {
+	s := defaultSettings()
+	if err := config.Load(s, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate implements config.Validator
+func (s *Settings) Validate() error {
+	if s.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if s.Domain == "" {
+		return fmt.Errorf("domain is required")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ignoreAnnotation opts an Ingress out of DNS management
+	ignoreAnnotation = "dns.homelab.mcztest.com/ignore"
+	// targetAnnotation overrides the record IP for an Ingress
+	targetAnnotation = "dns.homelab.mcztest.com/target"
+)
+
+// Record is a desired A record and where it came from
+type Record struct {
+	Host   string `json:"host"`
+	IP     string `json:"ip"`
+	Source string `json:"source"`
+}
+
+// Sources collects desired records from Ingresses and the app registry
+type Sources struct {
+	kube        kubernetes.Interface
+	domain      string
+	ingressIP   string
+	registryURL string
+}
+
+// Desired returns the records that should exist, keyed by host
+func (s *Sources) Desired(ctx context.Context) (map[string]Record, error) {
+	records := make(map[string]Record)
+
+	ingresses, err := s.kube.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing ingresses: %w", err)
+	}
+	for i := range ingresses.Items {
+		s.addIngress(records, &ingresses.Items[i])
+	}
+
+	if s.registryURL != "" {
+		apps, err := s.registryHosts(ctx)
+		if err != nil {
+			// Keep Ingress records flowing if the registry is down
+			log.Printf("Failed to list apps from registry: %v", err)
+		}
+		for _, host := range apps {
+			if _, exists := records[host]; exists || !s.managed(host) || s.ingressIP == "" {
+				continue
+			}
+			records[host] = Record{Host: host, IP: s.ingressIP, Source: "app-registry"}
+		}
+	}
+
+	return records, nil
+}
+
+func (s *Sources) addIngress(records map[string]Record, ing *networkingv1.Ingress) {
+	if ing.Annotations[ignoreAnnotation] == "true" {
+		return
+	}
+
+	ip := ing.Annotations[targetAnnotation]
+	if ip == "" {
+		ip = s.ingressIP
+	}
+	if ip == "" {
+		for _, lb := range ing.Status.LoadBalancer.Ingress {
+			if lb.IP != "" {
+				ip = lb.IP
+				break
+			}
+		}
+	}
+	if ip == "" {
+		return
+	}
+
+	source := fmt.Sprintf("ingress/%s/%s", ing.Namespace, ing.Name)
+	for _, rule := range ing.Spec.Rules {
+		host := strings.ToLower(rule.Host)
+		if host == "" || strings.HasPrefix(host, "*") || !s.managed(host) {
+			continue
+		}
+		records[host] = Record{Host: host, IP: ip, Source: source}
+	}
+}
+
+// managed reports whether host falls under the managed domain
+func (s *Sources) managed(host string) bool {
+	return host == s.domain || strings.HasSuffix(host, "."+s.domain)
+}
+
+// registryHosts returns the hostnames of app URLs in the app registry
+func (s *Sources) registryHosts(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(s.registryURL, "/")+"/api/v1/apps", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("app registry returned %s", resp.Status)
+	}
+
+	type app struct {
+		URL string `json:"url"`
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	// The registry has returned both a bare array and an {"apps": [...]} envelope
+	var apps []app
+	if err := json.Unmarshal(raw, &apps); err != nil {
+		var envelope struct {
+			Apps []app `json:"apps"`
+		}
+		if err := json.Unmarshal(raw, &envelope); err != nil {
+			return nil, err
+		}
+		apps = envelope.Apps
+	}
+
+	hosts := make([]string, 0, len(apps))
+	for _, a := range apps {
+		u, err := url.Parse(a.URL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		hosts = append(hosts, strings.ToLower(u.Hostname()))
+	}
+	return hosts, nil
+}
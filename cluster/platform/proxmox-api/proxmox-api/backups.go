@@ -0,0 +1,847 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+// Backup policy types
+const (
+	BackupSnapshot = "snapshot"
+	BackupVzdump   = "vzdump"
+)
+
+// backupTimeLayout suffixes snapshot names with their creation time. Seconds
+// keep two runs in the same minute, e.g. a manual run after a scheduled one,
+// from colliding.
+const backupTimeLayout = "20060102-150405"
+
+// legacyBackupTimeLayout is the suffix of snapshots taken before seconds
+// were added, still recognised so retention prunes them
+const legacyBackupTimeLayout = "20060102-1504"
+
+// maxRestores bounds the restore history; running restores are always kept
+const maxRestores = 100
+
+// backupNotesPrefix marks vzdump archives taken by a policy, so retention
+// never touches manual backups
+const backupNotesPrefix = "proxmox-api:"
+
+// Snapshot names must start with a letter; with the time suffix they stay
+// within Proxmox's 40 character limit
+var backupPolicyPattern = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,22}[a-z0-9])?$`)
+
+// BackupPolicy snapshots or backs up a set of VMs on a cron schedule
+type BackupPolicy struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	// Type is snapshot (fast, on the VM's own storage) or vzdump (a full
+	// archive on Storage)
+	Type string `json:"type"`
+	// VMs are those tagged Tag, plus any listed in VMIDs
+	Tag   string `json:"tag,omitempty"`
+	VMIDs []int  `json:"vmids,omitempty"`
+	// Storage, Mode, and Compress are vzdump options
+	Storage  string `json:"storage,omitempty"`
+	Mode     string `json:"mode,omitempty"`
+	Compress string `json:"compress,omitempty"`
+	// Keep is how many snapshots or archives per VM to retain, newest first
+	Keep int `json:"keep,omitempty"`
+
+	schedule *cronSchedule
+}
+
+// BackupResult is the outcome of backing up one VM
+type BackupResult struct {
+	VMID       int       `json:"vmid"`
+	Name       string    `json:"name"`
+	Target     string    `json:"target,omitempty"` // snapshot name or archive volid
+	Size       int64     `json:"size,omitempty"`
+	Duration   float64   `json:"durationSeconds"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// BackupStatus is a policy's state reported by the API
+type BackupStatus struct {
+	Name        string         `json:"name"`
+	Type        string         `json:"type"`
+	Schedule    string         `json:"schedule"`
+	Running     bool           `json:"running"`
+	LastRun     *time.Time     `json:"lastRun,omitempty"`
+	LastSuccess *time.Time     `json:"lastSuccess,omitempty"`
+	NextRun     *time.Time     `json:"nextRun,omitempty"`
+	Results     []BackupResult `json:"results"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// RestorePoint is a snapshot or archive a VM can be restored from
+type RestorePoint struct {
+	Type      string    `json:"type"`
+	Name      string    `json:"name"`
+	Policy    string    `json:"policy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Size      int64     `json:"size,omitempty"`
+}
+
+// RestoreRequest is the body of POST /restores; exactly one of Snapshot and
+// Archive is set
+type RestoreRequest struct {
+	VMID     int    `json:"vmid"`
+	Snapshot string `json:"snapshot,omitempty"`
+	Archive  string `json:"archive,omitempty"`
+	// Storage receives the restored disks; defaults to their original storage
+	Storage string `json:"storage,omitempty"`
+	// Start powers the VM on afterwards; defaults to its state before the restore
+	Start *bool `json:"start,omitempty"`
+}
+
+// Restore is a restore job reported by the API
+type Restore struct {
+	ID         int        `json:"id"`
+	VMID       int        `json:"vmid"`
+	Source     string     `json:"source"`
+	Phase      string     `json:"phase"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Restore phases
+const (
+	RestoreRunning   = "Running"
+	RestoreSucceeded = "Succeeded"
+	RestoreFailed    = "Failed"
+)
+
+// BackupManager runs backup policies and restores
+type BackupManager struct {
+	pve      *ProxmoxClient
+	policies []BackupPolicy
+
+	// jobs serializes Proxmox backup and restore tasks; vzdump and snapshot
+	// tasks on the same VM would fail on its config lock
+	jobs sync.Mutex
+
+	mu          sync.Mutex
+	status      map[string]*BackupStatus
+	restores    []*Restore
+	lastRestore int
+}
+
+// BackupSettings configure backup policies; File replaces the single
+// nightly policy built from the rest
+type BackupSettings struct {
+	File     string `json:"file" env:"BACKUP_POLICIES_FILE" flag:"backup-policies-file" usage:"JSON list of backup policies"`
+	Schedule string `json:"schedule" env:"BACKUP_SCHEDULE" flag:"backup-schedule" usage:"cron schedule of the nightly policy; empty disables it"`
+	Type     string `json:"type" env:"BACKUP_TYPE" flag:"backup-type" usage:"vzdump or snapshot"`
+	Tag      string `json:"tag" env:"BACKUP_TAG" flag:"backup-tag" usage:"back up VMs with this tag"`
+	Storage  string `json:"storage" env:"BACKUP_STORAGE" flag:"backup-storage" usage:"vzdump target storage"`
+	Keep     int    `json:"keep" env:"BACKUP_KEEP" flag:"backup-keep" usage:"snapshots or archives kept per VM"`
+}
+
+// loadBackupPolicies reads BACKUP_POLICIES_FILE (a JSON list) or builds a
+// single policy from the BACKUP_* settings; no BACKUP_SCHEDULE means none
+func loadBackupPolicies(settings BackupSettings) ([]BackupPolicy, error) {
+	var policies []BackupPolicy
+	if path := settings.File; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading BACKUP_POLICIES_FILE: %w", err)
+		}
+		if err := json.Unmarshal(data, &policies); err != nil {
+			return nil, fmt.Errorf("parsing BACKUP_POLICIES_FILE: %w", err)
+		}
+	} else if settings.Schedule != "" {
+		policies = []BackupPolicy{{
+			Name:     "nightly",
+			Schedule: settings.Schedule,
+			Type:     settings.Type,
+			Tag:      settings.Tag,
+			Storage:  settings.Storage,
+			Keep:     settings.Keep,
+		}}
+	}
+
+	seen := make(map[string]bool)
+	for i := range policies {
+		p := &policies[i]
+		if !backupPolicyPattern.MatchString(p.Name) {
+			return nil, fmt.Errorf("invalid backup policy name %q", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("duplicate backup policy %q", p.Name)
+		}
+		seen[p.Name] = true
+
+		schedule, err := parseCron(p.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("backup policy %s: %w", p.Name, err)
+		}
+		if schedule.Next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("backup policy %s: schedule %q never runs", p.Name, p.Schedule)
+		}
+		p.schedule = schedule
+
+		if p.Type == "" {
+			p.Type = BackupVzdump
+		}
+		if p.Type != BackupSnapshot && p.Type != BackupVzdump {
+			return nil, fmt.Errorf("backup policy %s: type must be %s or %s", p.Name, BackupSnapshot, BackupVzdump)
+		}
+		if p.Tag == "" && len(p.VMIDs) == 0 {
+			p.Tag = nodeTag
+		}
+		if p.Storage == "" {
+			p.Storage = "local"
+		}
+		if p.Mode == "" {
+			p.Mode = "snapshot"
+		}
+		if p.Compress == "" {
+			p.Compress = "zstd"
+		}
+		if p.Keep == 0 {
+			p.Keep = 7
+		}
+	}
+	return policies, nil
+}
+
+func NewBackupManager(pve *ProxmoxClient, policies []BackupPolicy) *BackupManager {
+	status := make(map[string]*BackupStatus)
+	now := time.Now()
+	for _, p := range policies {
+		next := p.schedule.Next(now)
+		status[p.Name] = &BackupStatus{
+			Name:     p.Name,
+			Type:     p.Type,
+			Schedule: p.Schedule,
+			NextRun:  &next,
+			Results:  []BackupResult{},
+		}
+	}
+	return &BackupManager{pve: pve, policies: policies, status: status}
+}
+
+func (m *BackupManager) policy(name string) *BackupPolicy {
+	for i := range m.policies {
+		if m.policies[i].Name == name {
+			return &m.policies[i]
+		}
+	}
+	return nil
+}
+
+// targets returns the VMs a policy covers, skipping templates
+func (m *BackupManager) targets(ctx context.Context, p *BackupPolicy) ([]VMStatus, error) {
+	vms, err := m.pve.ListVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int]bool)
+	for _, id := range p.VMIDs {
+		ids[id] = true
+	}
+
+	var targets []VMStatus
+	for _, vm := range vms {
+		if vm.Template == 1 {
+			continue
+		}
+		if ids[vm.VMID] || (p.Tag != "" && hasTag(vm.Tags, p.Tag)) {
+			targets = append(targets, vm)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].VMID < targets[j].VMID })
+	return targets, nil
+}
+
+// List reports every policy
+func (m *BackupManager) List() []BackupStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]BackupStatus, 0, len(m.policies))
+	for _, p := range m.policies {
+		status := *m.status[p.Name]
+		status.Results = append([]BackupResult(nil), status.Results...)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Trigger starts a run of the named policy in the background
+func (m *BackupManager) Trigger(name string) error {
+	p := m.policy(name)
+	if p == nil {
+		return fmt.Errorf("unknown backup policy %q", name)
+	}
+
+	m.mu.Lock()
+	status := m.status[name]
+	if status.Running {
+		m.mu.Unlock()
+		return errBackupInProgress
+	}
+	status.Running = true
+	m.mu.Unlock()
+
+	go m.run(p)
+	return nil
+}
+
+var errBackupInProgress = errors.New("backup already in progress")
+
+// run backs up every VM of the policy, verifies each result, and applies
+// retention
+func (m *BackupManager) run(p *BackupPolicy) {
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Hour)
+	defer cancel()
+
+	m.jobs.Lock()
+	defer m.jobs.Unlock()
+
+	started := time.Now()
+	var results []BackupResult
+	runErr := ""
+
+	vms, err := m.targets(ctx, p)
+	if err != nil {
+		runErr = fmt.Sprintf("listing VMs: %v", err)
+	} else if len(vms) == 0 {
+		runErr = "no VMs match the policy"
+	}
+
+	for _, vm := range vms {
+		result := m.backupVM(ctx, p, vm)
+		if result.Error != "" {
+			log.Printf("Backup %s of VM %d failed: %v", p.Name, vm.VMID, result.Error)
+		} else {
+			log.Printf("Backup %s of VM %d: %s", p.Name, vm.VMID, result.Target)
+			m.prune(ctx, p, vm.VMID)
+		}
+		results = append(results, result)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 && runErr == "" {
+		runErr = fmt.Sprintf("%d of %d VMs failed", failed, len(results))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status[p.Name]
+	status.Running = false
+	status.LastRun = &started
+	status.Error = runErr
+	if results != nil {
+		status.Results = results
+	}
+	if runErr == "" {
+		finished := time.Now()
+		status.LastSuccess = &finished
+	}
+	log.Printf("Backup policy %s finished in %s (%d VMs, %d failed)", p.Name, time.Since(started).Round(time.Second), len(results), failed)
+}
+
+// backupVM takes one snapshot or archive and checks it landed
+func (m *BackupManager) backupVM(ctx context.Context, p *BackupPolicy, vm VMStatus) BackupResult {
+	started := time.Now()
+	result := BackupResult{VMID: vm.VMID, Name: vm.Name}
+	finish := func(err error) BackupResult {
+		result.Duration = time.Since(started).Seconds()
+		result.FinishedAt = time.Now()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	}
+
+	switch p.Type {
+	case BackupSnapshot:
+		name := p.Name + "-" + started.UTC().Format(backupTimeLayout)
+		description := fmt.Sprintf("Taken %s by proxmox-api policy %s", started.UTC().Format(time.RFC3339), p.Name)
+		if err := m.pve.CreateSnapshot(ctx, vm.VMID, name, description); err != nil {
+			return finish(err)
+		}
+		snapshots, err := m.pve.ListSnapshots(ctx, vm.VMID)
+		if err != nil {
+			return finish(fmt.Errorf("verifying snapshot: %w", err))
+		}
+		for _, s := range snapshots {
+			if s.Name == name {
+				result.Target = name
+				return finish(nil)
+			}
+		}
+		return finish(fmt.Errorf("snapshot %s missing after the task succeeded", name))
+
+	default:
+		params := url.Values{
+			"mode":           {p.Mode},
+			"compress":       {p.Compress},
+			"notes-template": {backupNotesPrefix + p.Name},
+		}
+		if err := m.pve.Vzdump(ctx, vm.VMID, p.Storage, params); err != nil {
+			return finish(err)
+		}
+		// A successful task must have left a non-empty archive behind
+		backups, err := m.policyBackups(ctx, p, vm.VMID)
+		if err != nil {
+			return finish(fmt.Errorf("verifying backup: %w", err))
+		}
+		if len(backups) == 0 || backups[0].CTime < started.Add(-time.Minute).Unix() {
+			return finish(fmt.Errorf("no new archive on %s after the task succeeded", p.Storage))
+		}
+		if backups[0].Size == 0 {
+			return finish(fmt.Errorf("archive %s is empty", backups[0].VolID))
+		}
+		result.Target, result.Size = backups[0].VolID, backups[0].Size
+		return finish(nil)
+	}
+}
+
+// policySnapshots returns the policy's snapshots of a VM, newest first
+func (m *BackupManager) policySnapshots(ctx context.Context, p *BackupPolicy, vmid int) ([]Snapshot, error) {
+	all, err := m.pve.ListSnapshots(ctx, vmid)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, s := range all {
+		if policySnapshot(s.Name) == p.Name {
+			snapshots = append(snapshots, s)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].SnapTime > snapshots[j].SnapTime })
+	return snapshots, nil
+}
+
+// policySnapshot returns the policy that took a snapshot, or "" for manual ones
+func policySnapshot(name string) string {
+	for _, layout := range []string{backupTimeLayout, legacyBackupTimeLayout} {
+		if len(name) <= len(layout)+1 {
+			continue
+		}
+		policy, suffix := name[:len(name)-len(layout)-1], name[len(name)-len(layout)-1:]
+		if suffix[0] != '-' {
+			continue
+		}
+		if _, err := time.Parse(layout, suffix[1:]); err == nil {
+			return policy
+		}
+	}
+	return ""
+}
+
+// policyBackups returns the policy's archives of a VM, newest first
+func (m *BackupManager) policyBackups(ctx context.Context, p *BackupPolicy, vmid int) ([]BackupVolume, error) {
+	all, err := m.pve.ListBackups(ctx, p.Storage, vmid)
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupVolume
+	for _, b := range all {
+		if strings.TrimSpace(b.Notes) == backupNotesPrefix+p.Name {
+			backups = append(backups, b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CTime > backups[j].CTime })
+	return backups, nil
+}
+
+// prune removes the policy's snapshots or archives of a VM beyond Keep
+func (m *BackupManager) prune(ctx context.Context, p *BackupPolicy, vmid int) {
+	if p.Type == BackupSnapshot {
+		snapshots, err := m.policySnapshots(ctx, p, vmid)
+		if err != nil {
+			log.Printf("Failed to list snapshots of VM %d for pruning: %v", vmid, err)
+			return
+		}
+		for i := p.Keep; i < len(snapshots); i++ {
+			if err := m.pve.DeleteSnapshot(ctx, vmid, snapshots[i].Name); err != nil {
+				log.Printf("Failed to delete snapshot %s of VM %d: %v", snapshots[i].Name, vmid, err)
+				continue
+			}
+			log.Printf("Deleted old snapshot %s of VM %d", snapshots[i].Name, vmid)
+		}
+		return
+	}
+
+	backups, err := m.policyBackups(ctx, p, vmid)
+	if err != nil {
+		log.Printf("Failed to list backups of VM %d for pruning: %v", vmid, err)
+		return
+	}
+	for i := p.Keep; i < len(backups); i++ {
+		if backups[i].Protected == 1 {
+			continue
+		}
+		if err := m.pve.DeleteVolume(ctx, p.Storage, backups[i].VolID); err != nil {
+			log.Printf("Failed to delete backup %s: %v", backups[i].VolID, err)
+			continue
+		}
+		log.Printf("Deleted old backup %s", backups[i].VolID)
+	}
+}
+
+// RestorePoints lists the snapshots and archives of a VM, newest first.
+// Archives are looked up on every vzdump policy's storage.
+func (m *BackupManager) RestorePoints(ctx context.Context, vmid int) ([]RestorePoint, error) {
+	snapshots, err := m.pve.ListSnapshots(ctx, vmid)
+	if err != nil {
+		return nil, err
+	}
+	points := []RestorePoint{}
+	for _, s := range snapshots {
+		points = append(points, RestorePoint{
+			Type:      BackupSnapshot,
+			Name:      s.Name,
+			Policy:    policySnapshot(s.Name),
+			CreatedAt: time.Unix(s.SnapTime, 0).UTC(),
+		})
+	}
+
+	storages := map[string]bool{}
+	for _, p := range m.policies {
+		if p.Type == BackupVzdump {
+			storages[p.Storage] = true
+		}
+	}
+	for storage := range storages {
+		backups, err := m.pve.ListBackups(ctx, storage, vmid)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range backups {
+			points = append(points, RestorePoint{
+				Type:      BackupVzdump,
+				Name:      b.VolID,
+				Policy:    strings.TrimPrefix(strings.TrimSpace(b.Notes), backupNotesPrefix),
+				CreatedAt: time.Unix(b.CTime, 0).UTC(),
+				Size:      b.Size,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].CreatedAt.After(points[j].CreatedAt) })
+	return points, nil
+}
+
+// Restore validates req and starts the restore in the background
+func (m *BackupManager) Restore(ctx context.Context, req RestoreRequest) (*Restore, error) {
+	if (req.Snapshot == "") == (req.Archive == "") {
+		return nil, fmt.Errorf("exactly one of snapshot and archive is required")
+	}
+	vm, err := m.pve.Status(ctx, req.VMID)
+	if err != nil {
+		return nil, fmt.Errorf("VM %d not found: %w", req.VMID, err)
+	}
+	if vm.Template == 1 {
+		return nil, fmt.Errorf("VM %d is a template", req.VMID)
+	}
+
+	source := req.Snapshot
+	if req.Archive != "" {
+		source = req.Archive
+		if !strings.Contains(req.Archive, fmt.Sprintf("/vzdump-qemu-%d-", req.VMID)) {
+			return nil, fmt.Errorf("archive %s is not a backup of VM %d", req.Archive, req.VMID)
+		}
+	}
+	start := vm.Status == "running"
+	if req.Start != nil {
+		start = *req.Start
+	}
+
+	m.mu.Lock()
+	for _, r := range m.restores {
+		if r.VMID == req.VMID && r.Phase == RestoreRunning {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("VM %d is already being restored", req.VMID)
+		}
+	}
+	m.lastRestore++
+	restore := &Restore{
+		ID:        m.lastRestore,
+		VMID:      req.VMID,
+		Source:    source,
+		Phase:     RestoreRunning,
+		StartedAt: time.Now(),
+	}
+	m.restores = append(m.restores, restore)
+	m.trimRestores()
+	snapshot := *restore
+	m.mu.Unlock()
+
+	go m.restore(restore, req, start)
+	return &snapshot, nil
+}
+
+// trimRestores drops the oldest finished restores beyond maxRestores;
+// callers hold mu
+func (m *BackupManager) trimRestores() {
+	excess := len(m.restores) - maxRestores
+	if excess <= 0 {
+		return
+	}
+	kept := m.restores[:0]
+	for _, r := range m.restores {
+		if excess > 0 && r.Phase != RestoreRunning {
+			excess--
+			continue
+		}
+		kept = append(kept, r)
+	}
+	// Clear the tail so dropped restores can be collected
+	for i := len(kept); i < len(m.restores); i++ {
+		m.restores[i] = nil
+	}
+	m.restores = kept
+}
+
+// restore rolls back to a snapshot, or stops the VM and recreates it from an
+// archive, then powers it on if asked
+func (m *BackupManager) restore(restore *Restore, req RestoreRequest, start bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Hour)
+	defer cancel()
+
+	m.jobs.Lock()
+	defer m.jobs.Unlock()
+
+	log.Printf("Restoring VM %d from %s", req.VMID, restore.Source)
+	err := func() error {
+		if req.Snapshot != "" {
+			if err := m.pve.RollbackSnapshot(ctx, req.VMID, req.Snapshot); err != nil {
+				return err
+			}
+		} else {
+			if err := m.pve.Stop(ctx, req.VMID); err != nil {
+				return fmt.Errorf("stopping VM: %w", err)
+			}
+			if err := m.pve.RestoreBackup(ctx, req.VMID, req.Archive, req.Storage); err != nil {
+				return err
+			}
+		}
+
+		// Rollback to a snapshot without RAM state leaves the VM stopped
+		status, err := m.pve.Status(ctx, req.VMID)
+		if err != nil {
+			return err
+		}
+		if start && status.Status != "running" {
+			return m.pve.Start(ctx, req.VMID)
+		}
+		return nil
+	}()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	finished := time.Now()
+	restore.FinishedAt = &finished
+	if err != nil {
+		log.Printf("Failed to restore VM %d from %s: %v", req.VMID, restore.Source, err)
+		restore.Phase, restore.Error = RestoreFailed, err.Error()
+		return
+	}
+	log.Printf("Restored VM %d from %s", req.VMID, restore.Source)
+	restore.Phase = RestoreSucceeded
+}
+
+// Restores lists the last maxRestores restore jobs since startup, newest first
+func (m *BackupManager) Restores() []Restore {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	restores := make([]Restore, 0, len(m.restores))
+	for i := len(m.restores) - 1; i >= 0; i-- {
+		restores = append(restores, *m.restores[i])
+	}
+	return restores
+}
+
+// Run starts policies when their schedule comes due, checking every minute
+func (m *BackupManager) Run(ctx context.Context) {
+	if len(m.policies) == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for i := range m.policies {
+				p := &m.policies[i]
+				m.mu.Lock()
+				status := m.status[p.Name]
+				due := !now.Before(*status.NextRun)
+				if due {
+					next := p.schedule.Next(now)
+					status.NextRun = &next
+				}
+				m.mu.Unlock()
+
+				if !due {
+					continue
+				}
+				if err := m.Trigger(p.Name); err != nil {
+					log.Printf("Skipping scheduled backup %s: %v", p.Name, err)
+					continue
+				}
+				log.Printf("Started scheduled backup %s", p.Name)
+			}
+		}
+	}
+}
+
+// writeMetrics appends the backup gauges to a /metrics response
+func (m *BackupManager) writeMetrics(b *strings.Builder, gauge func(name, help string)) {
+	statuses := m.List()
+
+	gauge("proxmox_backup_running", "Whether the backup policy is running")
+	for _, s := range statuses {
+		fmt.Fprintf(b, "proxmox_backup_running{policy=%q} %d\n", s.Name, boolMetric(s.Running))
+	}
+	gauge("proxmox_backup_last_run_timestamp_seconds", "When the policy last finished a run")
+	for _, s := range statuses {
+		if s.LastRun != nil {
+			fmt.Fprintf(b, "proxmox_backup_last_run_timestamp_seconds{policy=%q} %d\n", s.Name, s.LastRun.Unix())
+		}
+	}
+	gauge("proxmox_backup_last_run_success", "Whether every VM of the last run was backed up and verified")
+	for _, s := range statuses {
+		if s.LastRun != nil {
+			fmt.Fprintf(b, "proxmox_backup_last_run_success{policy=%q} %d\n", s.Name, boolMetric(s.Error == ""))
+		}
+	}
+	gauge("proxmox_backup_last_success_timestamp_seconds", "When the policy last completed without failures")
+	for _, s := range statuses {
+		if s.LastSuccess != nil {
+			fmt.Fprintf(b, "proxmox_backup_last_success_timestamp_seconds{policy=%q} %d\n", s.Name, s.LastSuccess.Unix())
+		}
+	}
+	gauge("proxmox_backup_next_run_timestamp_seconds", "When the policy runs next")
+	for _, s := range statuses {
+		if s.NextRun != nil {
+			fmt.Fprintf(b, "proxmox_backup_next_run_timestamp_seconds{policy=%q} %d\n", s.Name, s.NextRun.Unix())
+		}
+	}
+	gauge("proxmox_backup_vm_success", "Whether the VM's last backup succeeded")
+	for _, s := range statuses {
+		for _, r := range s.Results {
+			fmt.Fprintf(b, "proxmox_backup_vm_success{policy=%q,vmid=\"%d\",name=%q} %d\n", s.Name, r.VMID, r.Name, boolMetric(r.Error == ""))
+		}
+	}
+	gauge("proxmox_backup_vm_duration_seconds", "How long the VM's last backup took")
+	for _, s := range statuses {
+		for _, r := range s.Results {
+			fmt.Fprintf(b, "proxmox_backup_vm_duration_seconds{policy=%q,vmid=\"%d\",name=%q} %g\n", s.Name, r.VMID, r.Name, r.Duration)
+		}
+	}
+	gauge("proxmox_backup_vm_size_bytes", "Size of the VM's last vzdump archive")
+	for _, s := range statuses {
+		for _, r := range s.Results {
+			if r.Size > 0 {
+				fmt.Fprintf(b, "proxmox_backup_vm_size_bytes{policy=%q,vmid=\"%d\",name=%q} %d\n", s.Name, r.VMID, r.Name, r.Size)
+			}
+		}
+	}
+}
+
+// handleBackups serves GET /backups
+func (s *Server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, s.backups.List())
+}
+
+// handleBackup serves POST /backups/{policy}/run
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/backups/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "run" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.backups.Trigger(parts[0]); err != nil {
+		if errors.Is(err, errBackupInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("Started backup %s", parts[0])
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Backing up %s", parts[0])
+}
+
+// handleRestores serves GET /restores and POST /restores
+func (s *Server) handleRestores(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		httpkit.WriteJSON(w, http.StatusOK, s.backups.Restores())
+
+	case http.MethodPost:
+		var req RestoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+		restore, err := s.backups.Restore(r.Context(), req)
+		if err != nil {
+			log.Printf("Failed to start restore: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpkit.WriteJSON(w, http.StatusAccepted, restore)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRestorePoints serves GET /restores/points?vmid=
+func (s *Server) handleRestorePoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	vmid, err := strconv.Atoi(r.URL.Query().Get("vmid"))
+	if err != nil {
+		http.Error(w, "Invalid vmid", http.StatusBadRequest)
+		return
+	}
+	points, err := s.backups.RestorePoints(r.Context(), vmid)
+	if err != nil {
+		log.Printf("Failed to list restore points of VM %d: %v", vmid, err)
+		http.Error(w, "Failed to list restore points", http.StatusBadGateway)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, points)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPolicySnapshot(t *testing.T) {
+	for name, want := range map[string]string{
+		"nightly-20261016-030002":   "nightly",
+		"pre-upgrade-20261016-0300": "pre-upgrade",
+		"nightly":                   "",
+		"before-upgrade":            "",
+		"nightly-20261316-030002":   "",
+		"nightly_20261016-030002":   "",
+	} {
+		if got := policySnapshot(name); got != want {
+			t.Errorf("policySnapshot(%s) = %q, want %q", name, got, want)
+		}
+	}
+
+	// Snapshots taken a few seconds apart get distinct names
+	at := time.Date(2026, 10, 16, 3, 0, 2, 0, time.UTC)
+	if a, b := at.Format(backupTimeLayout), at.Add(5*time.Second).Format(backupTimeLayout); a == b {
+		t.Fatalf("both runs named %s", a)
+	}
+	if name := "a-twenty-four-char-name1-" + at.Format(backupTimeLayout); len(name) > 40 {
+		t.Fatalf("%s is longer than Proxmox allows", name)
+	}
+}
+
+// testBackupProxmox serves VM 101's snapshots and archives on storage nas
+// and records what is deleted
+func testBackupProxmox(t *testing.T, snapshots []Snapshot, backups []BackupVolume) (*ProxmoxClient, func() []string) {
+	var mu sync.Mutex
+	var deleted []string
+	pve := newTestProxmox(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve/qemu/101/snapshot":
+			writeData(w, append(snapshots, Snapshot{Name: "current"}))
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve/storage/nas/content":
+			writeData(w, backups)
+		case r.Method == http.MethodGet && r.URL.Path == "/nodes/pve/qemu/101/status/current":
+			writeData(w, VMStatus{Name: "k8s-1", Status: "running"})
+		case r.Method == http.MethodDelete:
+			mu.Lock()
+			deleted = append(deleted, r.URL.Path)
+			mu.Unlock()
+			writeData(w, "")
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return pve, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(deleted)
+		return deleted
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	day := func(d int) int64 { return time.Date(2026, 10, d, 3, 0, 0, 0, time.UTC).Unix() }
+	pve, deleted := testBackupProxmox(t, []Snapshot{
+		{Name: "nightly-20261016-030000", SnapTime: day(16)},
+		{Name: "nightly-20261015-030000", SnapTime: day(15)},
+		{Name: "nightly-20261014-0300", SnapTime: day(14)},
+		{Name: "nightly-20261013-0300", SnapTime: day(13)},
+		{Name: "hourly-20261012-030000", SnapTime: day(12)},
+		{Name: "before-upgrade", SnapTime: day(11)},
+	}, nil)
+	p := &BackupPolicy{Name: "nightly", Type: BackupSnapshot, Keep: 2}
+	m := NewBackupManager(pve, nil)
+
+	m.prune(context.Background(), p, 101)
+	want := []string{
+		"/nodes/pve/qemu/101/snapshot/nightly-20261013-0300",
+		"/nodes/pve/qemu/101/snapshot/nightly-20261014-0300",
+	}
+	if got := deleted(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("deleted %v, want %v", got, want)
+	}
+}
+
+func TestPruneArchives(t *testing.T) {
+	archive := func(day int, notes string, protected int) BackupVolume {
+		return BackupVolume{
+			VolID:     fmt.Sprintf("nas:backup/vzdump-qemu-101-2026_10_%02d-03_00_00.vma.zst", day),
+			VMID:      101,
+			Size:      1 << 30,
+			CTime:     time.Date(2026, 10, day, 3, 0, 0, 0, time.UTC).Unix(),
+			Notes:     notes,
+			Protected: protected,
+		}
+	}
+	pve, deleted := testBackupProxmox(t, nil, []BackupVolume{
+		archive(12, "proxmox-api:nightly", 0),
+		archive(16, "proxmox-api:nightly\n", 0),
+		archive(13, "proxmox-api:nightly", 1),
+		archive(15, "proxmox-api:nightly", 0),
+		archive(14, "proxmox-api:weekly", 0),
+		archive(11, "", 0),
+	})
+	p := &BackupPolicy{Name: "nightly", Type: BackupVzdump, Storage: "nas", Keep: 2}
+	m := NewBackupManager(pve, nil)
+
+	m.prune(context.Background(), p, 101)
+	want := []string{"/nodes/pve/storage/nas/content/nas:backup/vzdump-qemu-101-2026_10_12-03_00_00.vma.zst"}
+	if got := deleted(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("deleted %v, want %v", got, want)
+	}
+}
+
+func TestRestoreChecksArchiveVM(t *testing.T) {
+	pve, _ := testBackupProxmox(t, nil, nil)
+	m := NewBackupManager(pve, nil)
+
+	tests := []struct {
+		req     RestoreRequest
+		wantErr string
+	}{
+		{
+			req:     RestoreRequest{VMID: 101, Archive: "nas:backup/vzdump-qemu-102-2026_10_16-03_00_00.vma.zst"},
+			wantErr: "is not a backup of VM 101",
+		},
+		{
+			req:     RestoreRequest{VMID: 101, Archive: "nas:backup/vzdump-qemu-1010-2026_10_16-03_00_00.vma.zst"},
+			wantErr: "is not a backup of VM 101",
+		},
+		{
+			req:     RestoreRequest{VMID: 101, Snapshot: "nightly-20261016-030000", Archive: "nas:backup/vzdump-qemu-101-2026_10_16-03_00_00.vma.zst"},
+			wantErr: "exactly one of snapshot and archive",
+		},
+		{
+			req:     RestoreRequest{VMID: 102, Snapshot: "nightly-20261016-030000"},
+			wantErr: "VM 102 not found",
+		},
+	}
+	for _, tt := range tests {
+		_, err := m.Restore(context.Background(), tt.req)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Fatalf("%+v: err = %v, want %q", tt.req, err, tt.wantErr)
+		}
+	}
+	if restores := m.Restores(); len(restores) != 0 {
+		t.Fatalf("refused restores recorded: %+v", restores)
+	}
+}
+
+func TestTrimRestores(t *testing.T) {
+	m := NewBackupManager(nil, nil)
+	for i := 1; i <= maxRestores+10; i++ {
+		phase := RestoreSucceeded
+		if i == 3 {
+			phase = RestoreRunning
+		}
+		m.lastRestore++
+		m.restores = append(m.restores, &Restore{ID: m.lastRestore, VMID: 100 + i, Phase: phase})
+		m.trimRestores()
+	}
+
+	restores := m.Restores()
+	if len(restores) != maxRestores {
+		t.Fatalf("kept %d restores, want %d", len(restores), maxRestores)
+	}
+	if newest := restores[0].ID; newest != maxRestores+10 {
+		t.Fatalf("newest restore = %d", newest)
+	}
+	// The running restore outlives finished ones started after it
+	if oldest := restores[len(restores)-1]; oldest.ID != 3 || restores[len(restores)-2].ID != 12 {
+		t.Fatalf("oldest restores = %d, %d", oldest.ID, restores[len(restores)-2].ID)
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	"sigs.k8s.io/yaml"
+)
+
+// Cluster VMs carry these tags next to k8s-node, so a pool's VMs can be found
+// after a restart and pools removed from the spec can be scaled away
+const (
+	clusterTagPrefix = "cluster-"
+	poolTagPrefix    = "pool-"
+)
+
+// ClusterSpec is the body of POST /clusters, in YAML or JSON: the VMs a
+// cluster should have. Nodes are named <cluster>-<pool>-<n>, n from 1.
+type ClusterSpec struct {
+	Name    string      `json:"name"`
+	Network NetworkSpec `json:"network,omitempty"`
+	Pools   []NodePool  `json:"pools"`
+}
+
+// NetworkSpec applies to every node; unset fields use the service defaults
+type NetworkSpec struct {
+	Bridge  string   `json:"bridge,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+}
+
+// NodePool is a group of identical nodes
+type NodePool struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	// Template, Cores, Memory, Disk, and Join default as in POST /nodes
+	Template int   `json:"template,omitempty"`
+	Cores    int   `json:"cores,omitempty"`
+	Memory   int   `json:"memory,omitempty"` // MiB
+	Disk     int   `json:"disk,omitempty"`   // GiB
+	Join     *bool `json:"join,omitempty"`
+	// Storage is the Proxmox storage pool holding the disks
+	Storage string `json:"storage,omitempty"`
+	// FirstIP is the CIDR address of node 1; node n gets the nth address
+	// from it. DHCP when both FirstIP and Subnet are empty.
+	FirstIP string `json:"firstIP,omitempty"`
+	// Subnet allocates each node's address from an IPAM subnet instead
+	Subnet string `json:"subnet,omitempty"`
+	// UserData and UserDataVars render the nodes' cloud-init user-data
+	UserData     string            `json:"userData,omitempty"`
+	UserDataVars map[string]string `json:"userDataVars,omitempty"`
+	// Devices are passed through to every node of the pool, placing each
+	// on a host with the devices free
+	Devices []DeviceSpec `json:"devices,omitempty"`
+}
+
+// ClusterStatus is a cluster's reconcile state reported by the API
+type ClusterStatus struct {
+	Name          string       `json:"name"`
+	Phase         string       `json:"phase"`
+	Pools         []PoolStatus `json:"pools"`
+	LastReconcile *time.Time   `json:"lastReconcile,omitempty"`
+	Error         string       `json:"error,omitempty"`
+	Spec          ClusterSpec  `json:"spec"`
+}
+
+// PoolStatus lists a pool's nodes against its desired count
+type PoolStatus struct {
+	Name    string `json:"name"`
+	Desired int    `json:"desired"`
+	Ready   int    `json:"ready"`
+	Nodes   []Node `json:"nodes"`
+}
+
+var errClusterNotFound = errors.New("cluster not found")
+
+// Cluster phases
+const (
+	ClusterReconciling = "Reconciling"
+	ClusterReady       = "Ready"
+	// ClusterDegraded has failed nodes, which are left for inspection
+	// instead of being replaced
+	ClusterDegraded = "Degraded"
+	ClusterFailed   = "Failed"
+)
+
+// managedCluster is a spec with its reconcile loop state
+type managedCluster struct {
+	spec    ClusterSpec
+	status  ClusterStatus
+	running bool
+	// again reruns the reconcile when the spec changed while it ran
+	again bool
+}
+
+// ClusterManager reconciles node VMs to declarative cluster specs
+type ClusterManager struct {
+	nodes *NodeManager
+	pve   *ProxmoxClient
+	// dir persists specs across restarts; empty keeps them in memory
+	dir    string
+	resync time.Duration
+
+	mu       sync.Mutex
+	clusters map[string]*managedCluster
+}
+
+// NewClusterManager loads the specs saved in dir
+func NewClusterManager(nodes *NodeManager, pve *ProxmoxClient, dir string, resync time.Duration) (*ClusterManager, error) {
+	m := &ClusterManager{nodes: nodes, pve: pve, dir: dir, resync: resync, clusters: make(map[string]*managedCluster)}
+	if dir == "" {
+		return m, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		spec, err := parseClusterSpec(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		m.clusters[spec.Name] = &managedCluster{spec: *spec, status: newClusterStatus(spec)}
+	}
+	return m, nil
+}
+
+func newClusterStatus(spec *ClusterSpec) ClusterStatus {
+	return ClusterStatus{Name: spec.Name, Phase: ClusterReconciling, Pools: []PoolStatus{}, Spec: *spec}
+}
+
+// parseClusterSpec decodes and validates a spec; unknown fields are errors
+// so a typo cannot silently fall back to a default
+func parseClusterSpec(data []byte) (*ClusterSpec, error) {
+	var spec ClusterSpec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return nil, fmt.Errorf("parsing cluster spec: %w", err)
+	}
+	if !nodeNamePattern.MatchString(spec.Name) {
+		return nil, fmt.Errorf("invalid cluster name %q", spec.Name)
+	}
+	seen := make(map[string]bool)
+	for _, pool := range spec.Pools {
+		if !nodeNamePattern.MatchString(pool.Name) {
+			return nil, fmt.Errorf("invalid pool name %q", pool.Name)
+		}
+		if seen[pool.Name] {
+			return nil, fmt.Errorf("duplicate pool %q", pool.Name)
+		}
+		seen[pool.Name] = true
+		if pool.Count < 0 {
+			return nil, fmt.Errorf("pool %s: count must not be negative", pool.Name)
+		}
+		// VM names are DNS labels
+		if name := nodeName(&spec, &pool, pool.Count); len(name) > 63 {
+			return nil, fmt.Errorf("pool %s: node name %s is longer than 63 characters", pool.Name, name)
+		}
+		if pool.FirstIP != "" && pool.Subnet != "" {
+			return nil, fmt.Errorf("pool %s: firstIP and subnet are mutually exclusive", pool.Name)
+		}
+		if pool.FirstIP != "" {
+			if _, err := nodeIP(&pool, pool.Count); err != nil {
+				return nil, fmt.Errorf("pool %s: %w", pool.Name, err)
+			}
+		}
+		if err := validateDevices(pool.Devices); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", pool.Name, err)
+		}
+	}
+	return &spec, nil
+}
+
+func nodeName(spec *ClusterSpec, pool *NodePool, n int) string {
+	return fmt.Sprintf("%s-%s-%d", spec.Name, pool.Name, n)
+}
+
+// nodeIP is the CIDR address of node n, counting from FirstIP as node 1
+func nodeIP(pool *NodePool, n int) (string, error) {
+	prefix, err := netip.ParsePrefix(pool.FirstIP)
+	if err != nil {
+		return "", fmt.Errorf("invalid firstIP %q: %w", pool.FirstIP, err)
+	}
+	addr := prefix.Addr()
+	for i := 1; i < n; i++ {
+		addr = addr.Next()
+	}
+	if !prefix.Masked().Contains(addr) {
+		return "", fmt.Errorf("node %d's address %s is outside %s", n, addr, prefix.Masked())
+	}
+	return netip.PrefixFrom(addr, prefix.Bits()).String(), nil
+}
+
+// nodeIndex parses n from a pool node name, or returns 0
+func nodeIndex(spec *ClusterSpec, pool *NodePool, name string) int {
+	suffix, ok := strings.CutPrefix(name, spec.Name+"-"+pool.Name+"-")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(suffix)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// Apply stores spec, replacing any previous spec of the same name, and
+// reconciles it in the background
+func (m *ClusterManager) Apply(spec *ClusterSpec) (ClusterStatus, error) {
+	if m.dir != "" {
+		data, err := yaml.Marshal(spec)
+		if err != nil {
+			return ClusterStatus{}, err
+		}
+		if err := os.WriteFile(filepath.Join(m.dir, spec.Name+".yaml"), data, 0o644); err != nil {
+			return ClusterStatus{}, fmt.Errorf("saving cluster spec: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	c, ok := m.clusters[spec.Name]
+	if !ok {
+		c = &managedCluster{status: newClusterStatus(spec)}
+		m.clusters[spec.Name] = c
+	}
+	c.spec = *spec
+	c.status.Spec = *spec
+	c.status.Phase = ClusterReconciling
+	status := c.status
+	m.mu.Unlock()
+
+	m.trigger(spec.Name)
+	return status, nil
+}
+
+// trigger starts a reconcile of the named cluster, or queues one after the
+// reconcile in flight
+func (m *ClusterManager) trigger(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.clusters[name]
+	if !ok {
+		return
+	}
+	if c.running {
+		c.again = true
+		return
+	}
+	c.running = true
+	go m.loop(name)
+}
+
+func (m *ClusterManager) loop(name string) {
+	for {
+		m.mu.Lock()
+		c, ok := m.clusters[name]
+		if !ok {
+			m.mu.Unlock()
+			return
+		}
+		spec := c.spec
+		c.again = false
+		m.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		status, err := m.reconcile(ctx, &spec)
+		cancel()
+		now := time.Now()
+		status.LastReconcile = &now
+		if err != nil {
+			log.Printf("Failed to reconcile cluster %s: %v", name, err)
+			status.Phase = ClusterFailed
+			status.Error = err.Error()
+		}
+
+		m.mu.Lock()
+		c, ok = m.clusters[name]
+		if ok {
+			c.status = status
+		}
+		if !ok || !c.again {
+			if ok {
+				c.running = false
+			}
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+	}
+}
+
+// reconcile creates missing nodes, destroys surplus ones (highest numbers
+// first), and reconfigures cores and memory that differ from the spec
+func (m *ClusterManager) reconcile(ctx context.Context, spec *ClusterSpec) (ClusterStatus, error) {
+	status := newClusterStatus(spec)
+	nodes, err := m.nodes.List(ctx)
+	if err != nil {
+		return status, fmt.Errorf("listing nodes: %w", err)
+	}
+	vms, err := m.pve.ListClusterVMs(ctx)
+	if err != nil {
+		return status, fmt.Errorf("listing VMs: %w", err)
+	}
+	vmByID := make(map[int]VMStatus, len(vms))
+	for _, vm := range vms {
+		vmByID[vm.VMID] = vm
+	}
+
+	var errs []error
+	pools := make(map[string]bool)
+	for i := range spec.Pools {
+		pool := &spec.Pools[i]
+		pools[pool.Name] = true
+		poolStatus, err := m.reconcilePool(ctx, spec, pool, nodes, vmByID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Name, err))
+		}
+		status.Pools = append(status.Pools, poolStatus)
+	}
+
+	// Pools removed from the spec are scaled to zero
+	for _, vm := range vms {
+		if !hasTag(vm.Tags, clusterTagPrefix+spec.Name) || hasPoolTag(vm.Tags, pools) {
+			continue
+		}
+		log.Printf("Cluster %s: destroying %s (%d), its pool was removed", spec.Name, vm.Name, vm.VMID)
+		if err := m.nodes.Delete(ctx, vm.VMID); err != nil {
+			errs = append(errs, fmt.Errorf("deleting %s: %w", vm.Name, err))
+		}
+	}
+
+	status.Phase = ClusterReady
+	for _, p := range status.Pools {
+		for _, n := range p.Nodes {
+			if n.Phase == PhaseFailed {
+				status.Phase = ClusterDegraded
+			}
+		}
+		if status.Phase == ClusterReady && (p.Ready != p.Desired || len(p.Nodes) != p.Desired) {
+			status.Phase = ClusterReconciling
+		}
+	}
+	return status, errors.Join(errs...)
+}
+
+func (m *ClusterManager) reconcilePool(ctx context.Context, spec *ClusterSpec, pool *NodePool, nodes []Node, vms map[int]VMStatus) (PoolStatus, error) {
+	status := PoolStatus{Name: pool.Name, Desired: pool.Count, Nodes: []Node{}}
+	existing := make(map[int]Node)
+	for _, node := range nodes {
+		if n := nodeIndex(spec, pool, node.Name); n > 0 && node.Phase != PhaseDeleting {
+			existing[n] = node
+		}
+	}
+
+	var errs []error
+	for n := 1; n <= pool.Count; n++ {
+		if node, ok := existing[n]; ok {
+			if vm, ok := vms[node.ID]; ok && node.Phase == PhaseReady {
+				if err := m.resize(ctx, pool, vm); err != nil {
+					errs = append(errs, fmt.Errorf("resizing %s: %w", node.Name, err))
+				}
+			}
+			if node.Phase == PhaseReady {
+				status.Ready++
+			}
+			status.Nodes = append(status.Nodes, node)
+			continue
+		}
+
+		req := NodeRequest{
+			Name:         nodeName(spec, pool, n),
+			Template:     pool.Template,
+			Cores:        pool.Cores,
+			Memory:       pool.Memory,
+			Disk:         pool.Disk,
+			Join:         pool.Join,
+			Subnet:       pool.Subnet,
+			UserData:     pool.UserData,
+			UserDataVars: pool.UserDataVars,
+			Devices:      pool.Devices,
+			Storage:      pool.Storage,
+			Bridge:       spec.Network.Bridge,
+			Gateway:      spec.Network.Gateway,
+			DNS:          spec.Network.DNS,
+			Tags:         []string{clusterTagPrefix + spec.Name, poolTagPrefix + pool.Name},
+		}
+		if pool.FirstIP != "" {
+			ip, err := nodeIP(pool, n)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			req.IP = ip
+		}
+		node, err := m.nodes.Create(req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("creating %s: %w", req.Name, err))
+			continue
+		}
+		log.Printf("Cluster %s: provisioning %s (%d)", spec.Name, node.Name, node.ID)
+		status.Nodes = append(status.Nodes, *node)
+	}
+
+	// Scale down from the highest number, so the remaining nodes stay 1..count
+	var surplus []int
+	for n := range existing {
+		if n > pool.Count {
+			surplus = append(surplus, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(surplus)))
+	for _, n := range surplus {
+		node := existing[n]
+		log.Printf("Cluster %s: destroying %s (%d)", spec.Name, node.Name, node.ID)
+		if err := m.nodes.Delete(ctx, node.ID); err != nil {
+			errs = append(errs, fmt.Errorf("deleting %s: %w", node.Name, err))
+		}
+	}
+	return status, errors.Join(errs...)
+}
+
+// resize sets cores and memory that differ from the pool's; Proxmox applies
+// them at the VM's next restart unless hotplug is enabled. Disks are never
+// shrunk, so disk size is only applied to new nodes.
+func (m *ClusterManager) resize(ctx context.Context, pool *NodePool, vm VMStatus) error {
+	params := url.Values{}
+	if pool.Cores != 0 && int(vm.CPUs) != pool.Cores {
+		params.Set("cores", strconv.Itoa(pool.Cores))
+	}
+	if pool.Memory != 0 && vm.MaxMem != int64(pool.Memory)<<20 {
+		params.Set("memory", strconv.Itoa(pool.Memory))
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	log.Printf("Reconfiguring %s (%d): %s", vm.Name, vm.VMID, params.Encode())
+	return m.pve.ForNode(vm.Node).Configure(ctx, vm.VMID, params)
+}
+
+func hasPoolTag(tags string, pools map[string]bool) bool {
+	for pool := range pools {
+		if hasTag(tags, poolTagPrefix+pool) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete stops managing the cluster; with destroy, its VMs are destroyed too
+func (m *ClusterManager) Delete(ctx context.Context, name string, destroy bool) error {
+	m.mu.Lock()
+	_, ok := m.clusters[name]
+	delete(m.clusters, name)
+	m.mu.Unlock()
+	if !ok {
+		return errClusterNotFound
+	}
+	if m.dir != "" {
+		if err := os.Remove(filepath.Join(m.dir, name+".yaml")); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove saved spec of cluster %s: %v", name, err)
+		}
+	}
+	if !destroy {
+		return nil
+	}
+
+	vms, err := m.pve.ListClusterVMs(ctx)
+	if err != nil {
+		return fmt.Errorf("listing VMs: %w", err)
+	}
+	var errs []error
+	for _, vm := range vms {
+		if hasTag(vm.Tags, clusterTagPrefix+name) {
+			if err := m.nodes.Delete(ctx, vm.VMID); err != nil {
+				errs = append(errs, fmt.Errorf("deleting %s: %w", vm.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List returns every cluster's status, by name
+func (m *ClusterManager) List() []ClusterStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clusters := []ClusterStatus{}
+	for _, c := range m.clusters {
+		clusters = append(clusters, c.status)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+	return clusters
+}
+
+// Get returns one cluster's status
+func (m *ClusterManager) Get(name string) (ClusterStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.clusters[name]
+	if !ok {
+		return ClusterStatus{}, false
+	}
+	return c.status, true
+}
+
+// Run reconciles every cluster on startup and then every resync interval,
+// replacing VMs removed by hand
+func (m *ClusterManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.resync)
+	defer ticker.Stop()
+
+	for {
+		m.mu.Lock()
+		names := make([]string, 0, len(m.clusters))
+		for name := range m.clusters {
+			names = append(names, name)
+		}
+		m.mu.Unlock()
+		for _, name := range names {
+			m.trigger(name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleClusters serves GET /clusters and POST /clusters
+func (s *Server) handleClusters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		httpkit.WriteJSON(w, http.StatusOK, s.clusters.List())
+
+	case http.MethodPost:
+		data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+		spec, err := parseClusterSpec(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := s.clusters.Apply(spec)
+		if err != nil {
+			log.Printf("Failed to apply cluster %s: %v", spec.Name, err)
+			http.Error(w, "Failed to apply cluster spec", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Applied cluster spec %s", spec.Name)
+		httpkit.WriteJSON(w, http.StatusAccepted, status)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCluster serves GET and DELETE /clusters/{name}
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/clusters/"), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		status, ok := s.clusters.Get(name)
+		if !ok {
+			http.Error(w, "Cluster not found", http.StatusNotFound)
+			return
+		}
+		httpkit.WriteJSON(w, http.StatusOK, status)
+
+	case http.MethodDelete:
+		destroy := r.URL.Query().Get("destroy") == "true"
+		err := s.clusters.Delete(r.Context(), name, destroy)
+		if errors.Is(err, errClusterNotFound) {
+			http.Error(w, "Cluster not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete cluster %s: %v", name, err)
+			http.Error(w, "Failed to destroy cluster nodes", http.StatusBadGateway)
+			return
+		}
+		log.Printf("Deleted cluster %s (destroy %t)", name, destroy)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Deleted cluster %s", name)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
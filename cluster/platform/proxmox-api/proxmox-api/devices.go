@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Passthrough device types, matching the Proxmox mapping kinds
+const (
+	DevicePCI = "pci"
+	DeviceUSB = "usb"
+)
+
+// deviceLabelPrefix prefixes the default node label of a passthrough device
+const deviceLabelPrefix = "devices.homelab.mcztest.com/"
+
+// Proxmox accepts hostpci0-15 and, on current machine types, usb0-4 for
+// every guest
+const (
+	maxPCIDevices = 16
+	maxUSBDevices = 5
+)
+
+// DeviceSpec requests a passthrough device through a Proxmox resource
+// mapping (Datacenter > Resource Mappings), which names the device on each
+// host that has one
+type DeviceSpec struct {
+	Type    string `json:"type"`
+	Mapping string `json:"mapping"`
+	// PCIe passes a PCI device as PCI Express, which GPUs usually need; it
+	// switches the VM to the q35 machine type
+	PCIe bool `json:"pcie,omitempty"`
+	// Label is the Kubernetes node label key=value set on the node
+	// (default devices.homelab.mcztest.com/<mapping>=true)
+	Label string `json:"label,omitempty"`
+}
+
+var (
+	mappingPattern = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	// Labels are passed to the k3s installer on a shell command line
+	labelPattern = regexp.MustCompile(`^[A-Za-z0-9./_-]+=[A-Za-z0-9._-]*$`)
+)
+
+// validateDevices rejects device requests Proxmox or k3s would refuse
+func validateDevices(devices []DeviceSpec) error {
+	counts := make(map[string]int)
+	for _, d := range devices {
+		if d.Type != DevicePCI && d.Type != DeviceUSB {
+			return fmt.Errorf("device %s: type must be %s or %s", d.Mapping, DevicePCI, DeviceUSB)
+		}
+		if !mappingPattern.MatchString(d.Mapping) || len(d.Mapping) > 63 {
+			return fmt.Errorf("invalid device mapping %q", d.Mapping)
+		}
+		if d.PCIe && d.Type != DevicePCI {
+			return fmt.Errorf("device %s: pcie only applies to pci devices", d.Mapping)
+		}
+		if d.Label != "" && !labelPattern.MatchString(d.Label) {
+			return fmt.Errorf("device %s: label must be key=value, got %q", d.Mapping, d.Label)
+		}
+		counts[d.Type]++
+	}
+	if counts[DevicePCI] > maxPCIDevices {
+		return fmt.Errorf("at most %d pci devices per node", maxPCIDevices)
+	}
+	if counts[DeviceUSB] > maxUSBDevices {
+		return fmt.Errorf("at most %d usb devices per node", maxUSBDevices)
+	}
+	return nil
+}
+
+// deviceLabels are the node labels announcing the devices to the scheduler
+func deviceLabels(devices []DeviceSpec) []string {
+	seen := make(map[string]bool)
+	var labels []string
+	for _, d := range devices {
+		label := d.Label
+		if label == "" {
+			label = deviceLabelPrefix + d.Mapping + "=true"
+		}
+		if !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// deviceParams adds the hostpciN and usbN entries of devices to a VM config
+func deviceParams(devices []DeviceSpec, params url.Values) {
+	pci, usb := 0, 0
+	for _, d := range devices {
+		switch d.Type {
+		case DevicePCI:
+			value := "mapping=" + d.Mapping
+			if d.PCIe {
+				value += ",pcie=1"
+				params.Set("machine", "q35")
+			}
+			params.Set(fmt.Sprintf("hostpci%d", pci), value)
+			pci++
+		case DeviceUSB:
+			params.Set(fmt.Sprintf("usb%d", usb), "mapping="+d.Mapping)
+			usb++
+		}
+	}
+}
+
+// deviceKey identifies a mapping across both kinds
+type deviceKey struct {
+	kind    string
+	mapping string
+}
+
+func (k deviceKey) String() string {
+	return k.kind + " mapping " + k.mapping
+}
+
+// placeDevices picks the Proxmox host for a node needing devices: one that
+// has a free instance of every requested mapping, preferring PROXMOX_NODE
+// (no migration) and then the host with the most free memory. The devices
+// are claimed for VM id until releaseDevices.
+func (m *NodeManager) placeDevices(ctx context.Context, id int, devices []DeviceSpec) (string, error) {
+	if len(devices) == 0 {
+		return m.config.Node, nil
+	}
+
+	// Placements are serialised so two nodes cannot pick the same device
+	m.placeMu.Lock()
+	defer m.placeMu.Unlock()
+
+	wanted := make(map[deviceKey]int)
+	for _, d := range devices {
+		wanted[deviceKey{d.Type, d.Mapping}]++
+	}
+
+	// Devices per host and key, from the mappings' node entries
+	available := make(map[string]map[deviceKey]int)
+	for _, kind := range []string{DevicePCI, DeviceUSB} {
+		mappings, err := m.pve.DeviceMappings(ctx, kind)
+		if err != nil {
+			return "", fmt.Errorf("listing %s mappings: %w", kind, err)
+		}
+		for _, mapping := range mappings {
+			key := deviceKey{kind, mapping.ID}
+			if wanted[key] == 0 {
+				continue
+			}
+			for _, entry := range mapping.Map {
+				for _, field := range strings.Split(entry, ",") {
+					if host, ok := strings.CutPrefix(field, "node="); ok {
+						if available[host] == nil {
+							available[host] = make(map[deviceKey]int)
+						}
+						available[host][key]++
+					}
+				}
+			}
+		}
+	}
+	for key := range wanted {
+		found := false
+		for host := range available {
+			found = found || available[host][key] > 0
+		}
+		if !found {
+			return "", fmt.Errorf("%s does not exist on any host", key)
+		}
+	}
+
+	resources, err := m.pve.ClusterResources(ctx)
+	if err != nil {
+		return "", fmt.Errorf("listing cluster resources: %w", err)
+	}
+
+	// VMs holding each device: running VMs and managed nodes, which keep
+	// their devices while powered off, plus placements still provisioning
+	used := make(map[string]map[deviceKey]map[int]bool)
+	claim := func(host string, key deviceKey, vmid int) {
+		if used[host] == nil {
+			used[host] = make(map[deviceKey]map[int]bool)
+		}
+		if used[host][key] == nil {
+			used[host][key] = make(map[int]bool)
+		}
+		used[host][key][vmid] = true
+	}
+	for _, r := range resources {
+		if r.Type != "qemu" || r.Template == 1 || available[r.Node] == nil {
+			continue
+		}
+		if r.Status != "running" && !hasTag(r.Tags, nodeTag) {
+			continue
+		}
+		config, err := m.pve.ForNode(r.Node).DeviceConfig(ctx, r.VMID)
+		if err != nil {
+			return "", fmt.Errorf("reading config of VM %d: %w", r.VMID, err)
+		}
+		for name, value := range config {
+			kind := DeviceUSB
+			if strings.HasPrefix(name, "hostpci") {
+				kind = DevicePCI
+			}
+			for _, field := range strings.Split(value, ",") {
+				mapping, ok := strings.CutPrefix(field, "mapping=")
+				if key := (deviceKey{kind, mapping}); ok && wanted[key] > 0 {
+					claim(r.Node, key, r.VMID)
+				}
+			}
+		}
+	}
+	m.mu.Lock()
+	for vmid, c := range m.claims {
+		for _, d := range c.devices {
+			claim(c.host, deviceKey{d.Type, d.Mapping}, vmid)
+		}
+	}
+	m.mu.Unlock()
+
+	free := make(map[string]int64)
+	for _, r := range resources {
+		if r.Type == "node" && r.Status == "online" {
+			free[r.Node] = r.MaxMem - r.Mem
+		}
+	}
+	var hosts []string
+	for host := range available {
+		if _, online := free[host]; !online {
+			continue
+		}
+		fits := true
+		for key, n := range wanted {
+			if available[host][key]-len(used[host][key]) < n {
+				fits = false
+			}
+		}
+		if fits {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		var names []string
+		for key := range wanted {
+			names = append(names, key.String())
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("no online host has %s free", strings.Join(names, ", "))
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if (hosts[i] == m.config.Node) != (hosts[j] == m.config.Node) {
+			return hosts[i] == m.config.Node
+		}
+		return free[hosts[i]] > free[hosts[j]]
+	})
+
+	m.mu.Lock()
+	m.claims[id] = deviceClaim{host: hosts[0], devices: devices}
+	m.mu.Unlock()
+	log.Printf("Placing VM %d on %s for %s", id, hosts[0], strings.Join(deviceLabels(devices), ", "))
+	return hosts[0], nil
+}
+
+// releaseDevices drops VM id's claim once its config holds the devices, or
+// provisioning gave up
+func (m *NodeManager) releaseDevices(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.claims, id)
+}
+
+// deviceClaim reserves devices on a host for a VM still being provisioned
+type deviceClaim struct {
+	host    string
+	devices []DeviceSpec
+}
+
+// host returns a client addressing the Proxmox node that runs VM id,
+// falling back to PROXMOX_NODE when the VM cannot be found
+func (m *NodeManager) host(ctx context.Context, id int) *ProxmoxClient {
+	vms, err := m.pve.ListClusterVMs(ctx)
+	if err != nil {
+		return m.pve
+	}
+	for _, vm := range vms {
+		if vm.VMID == id && vm.Node != "" {
+			return m.pve.ForNode(vm.Node)
+		}
+	}
+	return m.pve
+}
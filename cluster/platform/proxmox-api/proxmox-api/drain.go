@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// newInClusterKube returns a client using the pod's service account, or
+// nil when the service does not run in a cluster
+func newInClusterKube() (kubernetes.Interface, error) {
+	restConfig, err := rest.InClusterConfig()
+	if errors.Is(err, rest.ErrNotInCluster) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// setUnschedulable cordons or uncordons a node. Cordoned nodes carry
+// annotation, so only those can be uncordoned again.
+func setUnschedulable(ctx context.Context, kube kubernetes.Interface, node string, unschedulable bool, annotation string) error {
+	var value interface{}
+	if unschedulable {
+		value = "true"
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{annotation: value}},
+		"spec":     map[string]interface{}{"unschedulable": unschedulable},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = kube.CoreV1().Nodes().Patch(ctx, node, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// drain evicts every pod from node except DaemonSet and mirror pods,
+// retrying evictions a PodDisruptionBudget refuses, until the node is
+// empty or ctx ends
+func drain(ctx context.Context, kube kubernetes.Interface, node string) error {
+	for {
+		pods, err := kube.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + node})
+		if err != nil {
+			return fmt.Errorf("listing pods on %s: %w", node, err)
+		}
+
+		remaining := 0
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed || !evictable(pod) {
+				continue
+			}
+			remaining++
+			err := kube.PolicyV1().Evictions(pod.Namespace).Evict(ctx, &policyv1.Eviction{
+				ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+			})
+			// 429 is a PodDisruptionBudget asking to retry, 404 a pod already gone
+			if apierrors.IsTooManyRequests(err) || apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("evicting %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+		}
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d pods still on %s: %w", remaining, node, ctx.Err())
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// evictable reports whether draining should move the pod: DaemonSet pods
+// would be recreated in place and mirror pods cannot be evicted
+func evictable(pod *corev1.Pod) bool {
+	if _, mirror := pod.Annotations[corev1.MirrorPodAnnotationKey]; mirror {
+		return false
+	}
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "DaemonSet" {
+			return false
+		}
+	}
+	return true
+}
+
+// unschedulablePods counts pods the scheduler has marked Unschedulable for
+// longer than delay
+func unschedulablePods(ctx context.Context, kube kubernetes.Interface, delay time.Duration) (int, error) {
+	pods, err := kube.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "status.phase=Pending,spec.nodeName="})
+	if err != nil {
+		return 0, fmt.Errorf("listing pending pods: %w", err)
+	}
+	count := 0
+	for _, pod := range pods.Items {
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse &&
+				cond.Reason == corev1.PodReasonUnschedulable && time.Since(cond.LastTransitionTime.Time) > delay {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testPod(name string, mutate func(*corev1.Pod)) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "apps"},
+		Spec:       corev1.PodSpec{NodeName: "k8s-1"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if mutate != nil {
+		mutate(pod)
+	}
+	return pod
+}
+
+// evictions records evicted pods and removes them, like the API server
+// does once a PodDisruptionBudget allows it; refuse names pods whose
+// eviction a budget keeps refusing
+func evictions(kube *fake.Clientset, refuse string) *[]string {
+	var evicted []string
+	kube.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+		if eviction.Name == refuse {
+			return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+		}
+		evicted = append(evicted, eviction.Name)
+		return true, nil, kube.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("pods"), eviction.Namespace, eviction.Name)
+	})
+	return &evicted
+}
+
+func TestDrainEvictsMovablePods(t *testing.T) {
+	kube := fake.NewSimpleClientset(
+		testPod("web", func(p *corev1.Pod) {
+			p.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-abc"}}
+		}),
+		testPod("api", nil),
+		testPod("node-exporter", func(p *corev1.Pod) {
+			p.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "node-exporter"}}
+		}),
+		testPod("kube-vip", func(p *corev1.Pod) {
+			p.Annotations = map[string]string{corev1.MirrorPodAnnotationKey: "hash"}
+		}),
+		testPod("migrate", func(p *corev1.Pod) { p.Status.Phase = corev1.PodSucceeded }),
+	)
+	evicted := evictions(kube, "")
+
+	if err := drain(context.Background(), kube, "k8s-1"); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(*evicted)
+	if got := strings.Join(*evicted, ","); got != "api,web" {
+		t.Fatalf("evicted %s, want api,web", got)
+	}
+}
+
+func TestDrainRetriesDisruptionBudget(t *testing.T) {
+	kube := fake.NewSimpleClientset(testPod("db", nil))
+	evicted := evictions(kube, "db")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := drain(ctx, kube, "k8s-1")
+	if err == nil || !strings.Contains(err.Error(), "1 pods still on k8s-1") {
+		t.Fatalf("err = %v, want the drain to wait on the budget", err)
+	}
+	if len(*evicted) != 0 {
+		t.Fatalf("evicted %v", *evicted)
+	}
+}
+
+func TestSetUnschedulable(t *testing.T) {
+	ctx := context.Background()
+	kube := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "k8s-1"}})
+
+	if err := setUnschedulable(ctx, kube, "k8s-1", true, powerCordonAnnotation); err != nil {
+		t.Fatal(err)
+	}
+	node, err := kube.CoreV1().Nodes().Get(ctx, "k8s-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.Spec.Unschedulable || node.Annotations[powerCordonAnnotation] != "true" {
+		t.Fatalf("cordoned node = %+v %v", node.Spec, node.Annotations)
+	}
+
+	if err := setUnschedulable(ctx, kube, "k8s-1", false, powerCordonAnnotation); err != nil {
+		t.Fatal(err)
+	}
+	if node, err = kube.CoreV1().Nodes().Get(ctx, "k8s-1", metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, marked := node.Annotations[powerCordonAnnotation]; node.Spec.Unschedulable || marked {
+		t.Fatalf("uncordoned node = %+v %v", node.Spec, node.Annotations)
+	}
+}
+
+func TestUnschedulablePods(t *testing.T) {
+	pending := func(since time.Time) func(*corev1.Pod) {
+		return func(p *corev1.Pod) {
+			p.Spec.NodeName = ""
+			p.Status.Phase = corev1.PodPending
+			p.Status.Conditions = []corev1.PodCondition{{
+				Type:               corev1.PodScheduled,
+				Status:             corev1.ConditionFalse,
+				Reason:             corev1.PodReasonUnschedulable,
+				LastTransitionTime: metav1.NewTime(since),
+			}}
+		}
+	}
+	kube := fake.NewSimpleClientset(
+		testPod("waiting", pending(time.Now().Add(-5*time.Minute))),
+		testPod("just-created", pending(time.Now())),
+		testPod("running", nil),
+	)
+
+	count, err := unschedulablePods(context.Background(), kube, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("count = %d, want 1", count)
+	}
+}
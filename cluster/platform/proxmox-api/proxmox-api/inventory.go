@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+// defaultTemperatureQuery reads the hottest hwmon sensor that node_exporter
+// on the Proxmox host reports, matched to the PVE node by hostname
+const defaultTemperatureQuery = `max(node_hwmon_temp_celsius * on(instance) group_left(nodename) node_uname_info{nodename="{{.Node}}"})`
+
+// Usage is a used/total pair in bytes
+type Usage struct {
+	Used  int64 `json:"used"`
+	Total int64 `json:"total"`
+}
+
+// CPUUsage is the utilisation (0-1) across cores
+type CPUUsage struct {
+	Usage float64 `json:"usage"`
+	Cores float64 `json:"cores"`
+}
+
+// StorageInventory is one storage as seen from a node
+type StorageInventory struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Shared bool   `json:"shared"`
+	Usage
+}
+
+// NodeInventory is GET /proxmox/nodes
+type NodeInventory struct {
+	Name        string             `json:"name"`
+	Status      string             `json:"status"`
+	Uptime      int64              `json:"uptime"`
+	CPU         CPUUsage           `json:"cpu"`
+	Memory      Usage              `json:"memory"`
+	RootFS      Usage              `json:"rootfs"`
+	Storage     []StorageInventory `json:"storage"`
+	Temperature *float64           `json:"temperatureCelsius,omitempty"`
+	Guests      GuestCounts        `json:"guests"`
+}
+
+// GuestCounts counts VMs and containers on a node by power state
+type GuestCounts struct {
+	Running int `json:"running"`
+	Stopped int `json:"stopped"`
+}
+
+// VMInventory is GET /proxmox/vms
+type VMInventory struct {
+	VMID     int      `json:"vmid"`
+	Name     string   `json:"name"`
+	Node     string   `json:"node"`
+	Type     string   `json:"type"`
+	Status   string   `json:"status"`
+	Template bool     `json:"template"`
+	Tags     []string `json:"tags,omitempty"`
+	Uptime   int64    `json:"uptime"`
+	CPU      CPUUsage `json:"cpu"`
+	Memory   Usage    `json:"memory"`
+	Disk     Usage    `json:"disk"`
+	NetIn    int64    `json:"netIn"`
+	NetOut   int64    `json:"netOut"`
+}
+
+// Inventory aggregates cluster resources from Proxmox and host temperatures
+// from Prometheus
+type Inventory struct {
+	pve              *ProxmoxClient
+	prometheusURL    string
+	temperatureQuery *template.Template
+	http             *http.Client
+}
+
+func NewInventory(pve *ProxmoxClient, prometheusURL, temperatureQuery string) (*Inventory, error) {
+	tmpl, err := template.New("temperature").Option("missingkey=error").Parse(temperatureQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TEMPERATURE_QUERY: %w", err)
+	}
+	return &Inventory{
+		pve:              pve,
+		prometheusURL:    strings.TrimSuffix(prometheusURL, "/"),
+		temperatureQuery: tmpl,
+		http:             &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Nodes returns every PVE node with its usage, storage, and temperature
+func (inv *Inventory) Nodes(ctx context.Context) ([]NodeInventory, error) {
+	resources, err := inv.pve.ClusterResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*NodeInventory)
+	var names []string
+	for _, r := range resources {
+		if r.Type != "node" {
+			continue
+		}
+		byName[r.Node] = &NodeInventory{
+			Name:    r.Node,
+			Status:  r.Status,
+			Uptime:  r.Uptime,
+			CPU:     CPUUsage{Usage: r.CPU, Cores: r.MaxCPU},
+			Memory:  Usage{Used: r.Mem, Total: r.MaxMem},
+			RootFS:  Usage{Used: r.Disk, Total: r.MaxDisk},
+			Storage: []StorageInventory{},
+		}
+		names = append(names, r.Node)
+	}
+
+	for _, r := range resources {
+		node, ok := byName[r.Node]
+		if !ok {
+			continue
+		}
+		switch r.Type {
+		case "storage":
+			node.Storage = append(node.Storage, StorageInventory{
+				Name:   r.Storage,
+				Type:   r.Plugin,
+				Status: r.Status,
+				Shared: r.Shared == 1,
+				Usage:  Usage{Used: r.Disk, Total: r.MaxDisk},
+			})
+		case "qemu", "lxc":
+			if r.Template == 1 {
+				continue
+			}
+			if r.Status == "running" {
+				node.Guests.Running++
+			} else {
+				node.Guests.Stopped++
+			}
+		}
+	}
+
+	sort.Strings(names)
+	nodes := make([]NodeInventory, 0, len(names))
+	for _, name := range names {
+		nodes = append(nodes, *byName[name])
+	}
+	inv.addTemperatures(ctx, nodes)
+	return nodes, nil
+}
+
+// addTemperatures queries Prometheus per node; failures leave the
+// temperature unset
+func (inv *Inventory) addTemperatures(ctx context.Context, nodes []NodeInventory) {
+	if inv.prometheusURL == "" {
+		return
+	}
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(node *NodeInventory) {
+			defer wg.Done()
+			temp, err := inv.temperature(ctx, node.Name)
+			if err != nil {
+				log.Printf("Failed to read temperature of %s: %v", node.Name, err)
+				return
+			}
+			node.Temperature = temp
+		}(&nodes[i])
+	}
+	wg.Wait()
+}
+
+func (inv *Inventory) temperature(ctx context.Context, node string) (*float64, error) {
+	var query bytes.Buffer
+	if err := inv.temperatureQuery.Execute(&query, map[string]string{"Node": node}); err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/api/v1/query?query=%s", inv.prometheusURL, url.QueryEscape(query.String()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := inv.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("prometheus returned %s", resp.Status)
+	}
+
+	var result struct {
+		Data struct {
+			Result []struct {
+				Value []interface{} `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Data.Result) == 0 || len(result.Data.Result[0].Value) < 2 {
+		return nil, nil
+	}
+	s, _ := result.Data.Result[0].Value[1].(string)
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		return nil, nil
+	}
+	return &v, nil
+}
+
+// VMs returns every VM and container in the cluster, ordered by ID
+func (inv *Inventory) VMs(ctx context.Context) ([]VMInventory, error) {
+	resources, err := inv.pve.ClusterResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := []VMInventory{}
+	for _, r := range resources {
+		if r.Type != "qemu" && r.Type != "lxc" {
+			continue
+		}
+		vms = append(vms, VMInventory{
+			VMID:     r.VMID,
+			Name:     r.Name,
+			Node:     r.Node,
+			Type:     r.Type,
+			Status:   r.Status,
+			Template: r.Template == 1,
+			Tags:     strings.FieldsFunc(r.Tags, func(c rune) bool { return c == ';' || c == ',' }),
+			Uptime:   r.Uptime,
+			CPU:      CPUUsage{Usage: r.CPU, Cores: r.MaxCPU},
+			Memory:   Usage{Used: r.Mem, Total: r.MaxMem},
+			Disk:     Usage{Used: r.Disk, Total: r.MaxDisk},
+			NetIn:    r.NetIn,
+			NetOut:   r.NetOut,
+		})
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].VMID < vms[j].VMID })
+	return vms, nil
+}
+
+// handleProxmoxNodes serves GET /proxmox/nodes
+func (s *Server) handleProxmoxNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodes, err := s.inventory.Nodes(r.Context())
+	if err != nil {
+		log.Printf("Failed to load node inventory: %v", err)
+		http.Error(w, "Failed to load node inventory", http.StatusBadGateway)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, nodes)
+}
+
+// handleProxmoxVMs serves GET /proxmox/vms?node=&status=&tag=
+func (s *Server) handleProxmoxVMs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	vms, err := s.inventory.VMs(r.Context())
+	if err != nil {
+		log.Printf("Failed to load VM inventory: %v", err)
+		http.Error(w, "Failed to load VM inventory", http.StatusBadGateway)
+		return
+	}
+
+	q := r.URL.Query()
+	filtered := []VMInventory{}
+	for _, vm := range vms {
+		if node := q.Get("node"); node != "" && vm.Node != node {
+			continue
+		}
+		if status := q.Get("status"); status != "" && vm.Status != status {
+			continue
+		}
+		if tag := q.Get("tag"); tag != "" && !hasTag(strings.Join(vm.Tags, ";"), tag) {
+			continue
+		}
+		filtered = append(filtered, vm)
+	}
+	httpkit.WriteJSON(w, http.StatusOK, filtered)
+}
+
+// handleMetrics serves the inventory as Prometheus gauges
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	nodes, err := s.inventory.Nodes(r.Context())
+	if err != nil {
+		log.Printf("Failed to load node inventory: %v", err)
+		http.Error(w, "Failed to load node inventory", http.StatusBadGateway)
+		return
+	}
+	vms, err := s.inventory.VMs(r.Context())
+	if err != nil {
+		log.Printf("Failed to load VM inventory: %v", err)
+		http.Error(w, "Failed to load VM inventory", http.StatusBadGateway)
+		return
+	}
+
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("proxmox_node_up", "Whether the Proxmox node is online")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "proxmox_node_up{node=%q} %d\n", n.Name, boolMetric(n.Status == "online"))
+	}
+	gauge("proxmox_node_cpu_usage_ratio", "Node CPU utilisation (0-1)")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "proxmox_node_cpu_usage_ratio{node=%q} %g\n", n.Name, n.CPU.Usage)
+	}
+	gauge("proxmox_node_cpu_cores", "Node CPU cores")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "proxmox_node_cpu_cores{node=%q} %g\n", n.Name, n.CPU.Cores)
+	}
+	gauge("proxmox_node_memory_used_bytes", "Node memory in use")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "proxmox_node_memory_used_bytes{node=%q} %d\n", n.Name, n.Memory.Used)
+	}
+	gauge("proxmox_node_memory_total_bytes", "Node memory")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "proxmox_node_memory_total_bytes{node=%q} %d\n", n.Name, n.Memory.Total)
+	}
+	gauge("proxmox_node_uptime_seconds", "Node uptime")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "proxmox_node_uptime_seconds{node=%q} %d\n", n.Name, n.Uptime)
+	}
+	gauge("proxmox_node_temperature_celsius", "Hottest host sensor, from node_exporter")
+	for _, n := range nodes {
+		if n.Temperature != nil {
+			fmt.Fprintf(&b, "proxmox_node_temperature_celsius{node=%q} %g\n", n.Name, *n.Temperature)
+		}
+	}
+	gauge("proxmox_node_guests", "Guests on the node by power state")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "proxmox_node_guests{node=%q,state=\"running\"} %d\n", n.Name, n.Guests.Running)
+		fmt.Fprintf(&b, "proxmox_node_guests{node=%q,state=\"stopped\"} %d\n", n.Name, n.Guests.Stopped)
+	}
+	gauge("proxmox_storage_used_bytes", "Storage in use")
+	for _, n := range nodes {
+		for _, st := range n.Storage {
+			fmt.Fprintf(&b, "proxmox_storage_used_bytes{node=%q,storage=%q} %d\n", n.Name, st.Name, st.Used)
+		}
+	}
+	gauge("proxmox_storage_total_bytes", "Storage capacity")
+	for _, n := range nodes {
+		for _, st := range n.Storage {
+			fmt.Fprintf(&b, "proxmox_storage_total_bytes{node=%q,storage=%q} %d\n", n.Name, st.Name, st.Total)
+		}
+	}
+
+	gauge("proxmox_vm_up", "Whether the guest is running")
+	for _, vm := range vms {
+		if !vm.Template {
+			fmt.Fprintf(&b, "proxmox_vm_up{%s} %d\n", vmLabels(vm), boolMetric(vm.Status == "running"))
+		}
+	}
+	gauge("proxmox_vm_cpu_usage_ratio", "Guest CPU utilisation (0-1)")
+	for _, vm := range vms {
+		if !vm.Template {
+			fmt.Fprintf(&b, "proxmox_vm_cpu_usage_ratio{%s} %g\n", vmLabels(vm), vm.CPU.Usage)
+		}
+	}
+	gauge("proxmox_vm_cpu_cores", "Guest CPU cores")
+	for _, vm := range vms {
+		if !vm.Template {
+			fmt.Fprintf(&b, "proxmox_vm_cpu_cores{%s} %g\n", vmLabels(vm), vm.CPU.Cores)
+		}
+	}
+	gauge("proxmox_vm_memory_used_bytes", "Guest memory in use")
+	for _, vm := range vms {
+		if !vm.Template {
+			fmt.Fprintf(&b, "proxmox_vm_memory_used_bytes{%s} %d\n", vmLabels(vm), vm.Memory.Used)
+		}
+	}
+	gauge("proxmox_vm_memory_total_bytes", "Guest memory")
+	for _, vm := range vms {
+		if !vm.Template {
+			fmt.Fprintf(&b, "proxmox_vm_memory_total_bytes{%s} %d\n", vmLabels(vm), vm.Memory.Total)
+		}
+	}
+	gauge("proxmox_vm_disk_total_bytes", "Guest disk size")
+	for _, vm := range vms {
+		if !vm.Template {
+			fmt.Fprintf(&b, "proxmox_vm_disk_total_bytes{%s} %d\n", vmLabels(vm), vm.Disk.Total)
+		}
+	}
+
+	s.backups.writeMetrics(&b, gauge)
+	s.ipam.writeMetrics(&b, gauge)
+	s.power.writeMetrics(&b, gauge)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
+
+func vmLabels(vm VMInventory) string {
+	return fmt.Sprintf("node=%q,vmid=\"%d\",name=%q,type=%q", vm.Node, vm.VMID, vm.Name, vm.Type)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+const (
+	ipamSyncInterval = 10 * time.Minute
+	// leaseGrace keeps a lease whose VM is not visible yet, while the clone
+	// runs; it matches the provisioning timeout
+	leaseGrace = 30 * time.Minute
+)
+
+var errLeaseNotFound = errors.New("lease not found")
+
+// Subnet is an IPv4 network new nodes can be given static addresses from
+type Subnet struct {
+	Name string `json:"name"`
+	CIDR string `json:"cidr"`
+	// Gateway defaults to NETWORK_GATEWAY when it is inside CIDR; Bridge and
+	// DNS default as in POST /nodes
+	Gateway string   `json:"gateway,omitempty"`
+	Bridge  string   `json:"bridge,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+	// Range bounds the allocatable addresses as first-last; the whole subnet
+	// when empty
+	Range string `json:"range,omitempty"`
+	// DHCP lists the router's DHCP pools, which are never allocated and
+	// cannot be requested
+	DHCP []string `json:"dhcp,omitempty"`
+	// Reserved addresses and ranges are left for hosts managed by hand
+	Reserved []string `json:"reserved,omitempty"`
+
+	prefix   netip.Prefix
+	first    uint32
+	last     uint32
+	gateway  uint32
+	dhcp     []addrRange
+	reserved []addrRange
+}
+
+// Lease is an address held by a VM
+type Lease struct {
+	IP     string `json:"ip"`
+	Subnet string `json:"subnet"`
+	VMID   int    `json:"vmid"`
+	Name   string `json:"name"`
+	// Adopted leases were found on existing VMs rather than allocated
+	Adopted   bool      `json:"adopted,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SubnetStatus is a subnet's usage reported by the API
+type SubnetStatus struct {
+	Name    string  `json:"name"`
+	CIDR    string  `json:"cidr"`
+	Gateway string  `json:"gateway"`
+	Size    int     `json:"size"`
+	Free    int     `json:"free"`
+	Leases  []Lease `json:"leases"`
+}
+
+// addrRange is an inclusive range of IPv4 addresses
+type addrRange struct {
+	from, to uint32
+}
+
+func (r addrRange) contains(n uint32) bool {
+	return n >= r.from && n <= r.to
+}
+
+func ipv4(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func fromIPv4(n uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return netip.AddrFrom4(b)
+}
+
+// parseRange parses first-last or a single address
+func parseRange(s string) (addrRange, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+	a, err := netip.ParseAddr(strings.TrimSpace(from))
+	if err != nil || !a.Is4() {
+		return addrRange{}, fmt.Errorf("invalid address range %q", s)
+	}
+	b, err := netip.ParseAddr(strings.TrimSpace(to))
+	if err != nil || !b.Is4() || b.Less(a) {
+		return addrRange{}, fmt.Errorf("invalid address range %q", s)
+	}
+	return addrRange{ipv4(a), ipv4(b)}, nil
+}
+
+// IPAMSettings configure IPAM subnets; SubnetsFile replaces the single
+// default subnet built from the rest
+type IPAMSettings struct {
+	SubnetsFile string   `json:"subnetsFile" env:"IPAM_SUBNETS_FILE" flag:"ipam-subnets-file" usage:"JSON list of subnets"`
+	Subnet      string   `json:"subnet" env:"IPAM_SUBNET" flag:"ipam-subnet" usage:"CIDR of the default subnet; empty disables IPAM"`
+	Range       string   `json:"range" env:"IPAM_RANGE" flag:"ipam-range" usage:"allocatable first-last addresses"`
+	DHCPRanges  []string `json:"dhcpRanges" env:"IPAM_DHCP_RANGES" flag:"ipam-dhcp-ranges" usage:"DHCP pools to avoid, comma separated"`
+	Reserved    []string `json:"reserved" env:"IPAM_RESERVED" flag:"ipam-reserved" usage:"addresses or ranges to avoid, comma separated"`
+	LeasesFile  string   `json:"leasesFile" env:"IPAM_LEASES_FILE" flag:"ipam-leases-file" usage:"file leases are saved in"`
+}
+
+// loadSubnets reads IPAM_SUBNETS_FILE (a JSON list) or builds a single
+// default subnet from the IPAM_* settings; no IPAM_SUBNET means none
+func loadSubnets(config *Config) ([]Subnet, error) {
+	var subnets []Subnet
+	if path := config.IPAM.SubnetsFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading IPAM_SUBNETS_FILE: %w", err)
+		}
+		if err := json.Unmarshal(data, &subnets); err != nil {
+			return nil, fmt.Errorf("parsing IPAM_SUBNETS_FILE: %w", err)
+		}
+	} else if config.IPAM.Subnet != "" {
+		subnets = []Subnet{{
+			Name:     "default",
+			CIDR:     config.IPAM.Subnet,
+			Range:    config.IPAM.Range,
+			DHCP:     config.IPAM.DHCPRanges,
+			Reserved: config.IPAM.Reserved,
+		}}
+	}
+
+	seen := make(map[string]bool)
+	for i := range subnets {
+		s := &subnets[i]
+		if !nodeNamePattern.MatchString(s.Name) {
+			return nil, fmt.Errorf("invalid subnet name %q", s.Name)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("duplicate subnet %q", s.Name)
+		}
+		seen[s.Name] = true
+		if err := s.parse(config); err != nil {
+			return nil, fmt.Errorf("subnet %s: %w", s.Name, err)
+		}
+		for _, other := range subnets[:i] {
+			if other.prefix.Overlaps(s.prefix) {
+				return nil, fmt.Errorf("subnet %s overlaps %s", s.Name, other.Name)
+			}
+		}
+	}
+	return subnets, nil
+}
+
+func (s *Subnet) parse(config *Config) error {
+	prefix, err := netip.ParsePrefix(s.CIDR)
+	if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return fmt.Errorf("cidr must be an IPv4 network of at least 4 addresses, got %q", s.CIDR)
+	}
+	s.prefix = prefix.Masked()
+	s.CIDR = s.prefix.String()
+	network := ipv4(s.prefix.Addr())
+	broadcast := network | (1<<(32-s.prefix.Bits()) - 1)
+
+	s.first, s.last = network+1, broadcast-1
+	if s.Range != "" {
+		r, err := parseRange(s.Range)
+		if err != nil {
+			return err
+		}
+		if r.from <= network || r.to >= broadcast {
+			return fmt.Errorf("range %s is outside %s", s.Range, s.CIDR)
+		}
+		s.first, s.last = r.from, r.to
+	}
+
+	if s.Gateway == "" && config.Gateway != "" {
+		if gw, err := netip.ParseAddr(config.Gateway); err == nil && s.prefix.Contains(gw) {
+			s.Gateway = config.Gateway
+		}
+	}
+	gw, err := netip.ParseAddr(s.Gateway)
+	if err != nil || !s.prefix.Contains(gw) {
+		return fmt.Errorf("gateway %q must be an address in %s", s.Gateway, s.CIDR)
+	}
+	s.gateway = ipv4(gw)
+
+	for _, spec := range s.DHCP {
+		r, err := parseRange(spec)
+		if err != nil {
+			return fmt.Errorf("dhcp: %w", err)
+		}
+		s.dhcp = append(s.dhcp, r)
+	}
+	for _, spec := range s.Reserved {
+		r, err := parseRange(spec)
+		if err != nil {
+			return fmt.Errorf("reserved: %w", err)
+		}
+		s.reserved = append(s.reserved, r)
+	}
+	return nil
+}
+
+func (s *Subnet) inDHCP(n uint32) bool {
+	for _, r := range s.dhcp {
+		if r.contains(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// usable reports whether n may be allocated, ignoring leases
+func (s *Subnet) usable(n uint32) bool {
+	if n < s.first || n > s.last || n == s.gateway || s.inDHCP(n) {
+		return false
+	}
+	for _, r := range s.reserved {
+		if r.contains(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// IPAM hands out static addresses from the configured subnets and records
+// which VM holds each one
+type IPAM struct {
+	pve     *ProxmoxClient
+	subnets []Subnet
+	// path persists leases across restarts; empty keeps them in memory
+	path string
+
+	mu     sync.Mutex
+	leases map[netip.Addr]*Lease
+}
+
+// NewIPAM loads the leases saved at path
+func NewIPAM(pve *ProxmoxClient, subnets []Subnet, path string) (*IPAM, error) {
+	m := &IPAM{pve: pve, subnets: subnets, path: path, leases: make(map[netip.Addr]*Lease)}
+	if path == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var leases []Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i := range leases {
+		addr, err := netip.ParseAddr(leases[i].IP)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		m.leases[addr] = &leases[i]
+	}
+	return m, nil
+}
+
+func (m *IPAM) subnet(name string) *Subnet {
+	for i := range m.subnets {
+		if m.subnets[i].Name == name {
+			return &m.subnets[i]
+		}
+	}
+	return nil
+}
+
+func (m *IPAM) subnetOf(addr netip.Addr) *Subnet {
+	for i := range m.subnets {
+		if m.subnets[i].prefix.Contains(addr) {
+			return &m.subnets[i]
+		}
+	}
+	return nil
+}
+
+// Allocate leases the lowest free address of the named subnet to a VM and
+// returns it in CIDR form
+func (m *IPAM) Allocate(name string, vmid int, vmName string) (string, *Subnet, error) {
+	s := m.subnet(name)
+	if s == nil {
+		return "", nil, fmt.Errorf("unknown subnet %q", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for n := s.first; n <= s.last; n++ {
+		addr := fromIPv4(n)
+		if _, leased := m.leases[addr]; leased || !s.usable(n) {
+			continue
+		}
+		m.leases[addr] = &Lease{IP: addr.String(), Subnet: s.Name, VMID: vmid, Name: vmName, CreatedAt: time.Now()}
+		if err := m.save(); err != nil {
+			delete(m.leases, addr)
+			return "", nil, fmt.Errorf("saving lease: %w", err)
+		}
+		log.Printf("Leased %s to %s (%d)", addr, vmName, vmid)
+		return netip.PrefixFrom(addr, s.prefix.Bits()).String(), s, nil
+	}
+	return "", nil, fmt.Errorf("subnet %s has no free addresses", s.Name)
+}
+
+// Reserve records a requested address for a VM. Addresses outside every
+// subnet are not managed and return a nil subnet; inside one, DHCP pools,
+// the gateway, and other VMs' leases are refused.
+func (m *IPAM) Reserve(cidr string, vmid int, vmName string) (*Subnet, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip %q: %w", cidr, err)
+	}
+	addr := prefix.Addr()
+	s := m.subnetOf(addr)
+	if s == nil {
+		return nil, nil
+	}
+	if n := ipv4(addr); n == s.gateway {
+		return nil, fmt.Errorf("%s is the gateway of subnet %s", addr, s.Name)
+	} else if s.inDHCP(n) {
+		return nil, fmt.Errorf("%s is in subnet %s's DHCP range", addr, s.Name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lease, ok := m.leases[addr]; ok {
+		if lease.VMID != vmid {
+			return nil, fmt.Errorf("%s is leased to %s (%d)", addr, lease.Name, lease.VMID)
+		}
+		return s, nil
+	}
+	m.leases[addr] = &Lease{IP: addr.String(), Subnet: s.Name, VMID: vmid, Name: vmName, CreatedAt: time.Now()}
+	if err := m.save(); err != nil {
+		delete(m.leases, addr)
+		return nil, fmt.Errorf("saving lease: %w", err)
+	}
+	log.Printf("Leased %s to %s (%d)", addr, vmName, vmid)
+	return s, nil
+}
+
+// Release frees every address held by a VM
+func (m *IPAM) Release(vmid int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	released := false
+	for addr, lease := range m.leases {
+		if lease.VMID == vmid {
+			delete(m.leases, addr)
+			log.Printf("Released %s from %s (%d)", addr, lease.Name, vmid)
+			released = true
+		}
+	}
+	if released {
+		if err := m.save(); err != nil {
+			log.Printf("Failed to save leases: %v", err)
+		}
+	}
+}
+
+// ReleaseIP frees one address regardless of its VM
+func (m *IPAM) ReleaseIP(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return errLeaseNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.leases[addr]; !ok {
+		return errLeaseNotFound
+	}
+	delete(m.leases, addr)
+	return m.save()
+}
+
+// save writes the leases to path; callers hold mu
+func (m *IPAM) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return err
+	}
+	// Write and rename, so a crash never leaves a truncated file
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// sorted returns the leases by address; callers hold mu
+func (m *IPAM) sorted() []Lease {
+	addrs := make([]netip.Addr, 0, len(m.leases))
+	for addr := range m.leases {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	leases := make([]Lease, 0, len(addrs))
+	for _, addr := range addrs {
+		leases = append(leases, *m.leases[addr])
+	}
+	return leases
+}
+
+// sync releases leases of VMs that no longer exist and adopts static
+// addresses configured on VMs by hand (or by terraform), so they are never
+// handed out twice
+func (m *IPAM) sync(ctx context.Context) error {
+	vms, err := m.pve.ListClusterVMs(ctx)
+	if err != nil {
+		return fmt.Errorf("listing VMs: %w", err)
+	}
+	exists := make(map[int]bool, len(vms))
+	for _, vm := range vms {
+		exists[vm.VMID] = true
+	}
+
+	m.mu.Lock()
+	leased := make(map[int]bool)
+	for _, lease := range m.leases {
+		leased[lease.VMID] = true
+	}
+	m.mu.Unlock()
+
+	found := make(map[netip.Addr]Lease)
+	for _, vm := range vms {
+		if vm.Template == 1 || leased[vm.VMID] {
+			continue
+		}
+		config, err := m.pve.ForNode(vm.Node).Config(ctx, vm.VMID)
+		if err != nil {
+			log.Printf("Failed to read config of VM %d: %v", vm.VMID, err)
+			continue
+		}
+		addr, ok := staticIP(config.IPConfig0)
+		if !ok {
+			continue
+		}
+		if s := m.subnetOf(addr); s != nil {
+			found[addr] = Lease{IP: addr.String(), Subnet: s.Name, VMID: vm.VMID, Name: vm.Name, Adopted: true, CreatedAt: time.Now()}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := false
+	for addr, lease := range m.leases {
+		if !exists[lease.VMID] && time.Since(lease.CreatedAt) > leaseGrace {
+			delete(m.leases, addr)
+			log.Printf("Released %s, its VM %s (%d) is gone", addr, lease.Name, lease.VMID)
+			changed = true
+		}
+	}
+	for addr, lease := range found {
+		if held, ok := m.leases[addr]; ok {
+			if held.VMID != lease.VMID {
+				log.Printf("WARNING: %s is leased to %s (%d) but configured on %s (%d)", addr, held.Name, held.VMID, lease.Name, lease.VMID)
+			}
+			continue
+		}
+		lease := lease
+		m.leases[addr] = &lease
+		log.Printf("Adopted %s from %s (%d)", addr, lease.Name, lease.VMID)
+		changed = true
+	}
+	if changed {
+		return m.save()
+	}
+	return nil
+}
+
+// staticIP parses the address out of a cloud-init ipconfig value
+func staticIP(ipconfig string) (netip.Addr, bool) {
+	for _, field := range strings.Split(ipconfig, ",") {
+		value, ok := strings.CutPrefix(field, "ip=")
+		if !ok {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		return prefix.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
+// List returns every subnet with its leases and free addresses
+func (m *IPAM) List() []SubnetStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	leases := m.sorted()
+
+	statuses := []SubnetStatus{}
+	for i := range m.subnets {
+		s := &m.subnets[i]
+		status := SubnetStatus{Name: s.Name, CIDR: s.CIDR, Gateway: s.Gateway, Leases: []Lease{}}
+		for n := s.first; n <= s.last; n++ {
+			if !s.usable(n) {
+				continue
+			}
+			status.Size++
+			if _, leased := m.leases[fromIPv4(n)]; !leased {
+				status.Free++
+			}
+		}
+		for _, lease := range leases {
+			if lease.Subnet == s.Name {
+				status.Leases = append(status.Leases, lease)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Run syncs leases with Proxmox on startup and then periodically
+func (m *IPAM) Run(ctx context.Context) {
+	if len(m.subnets) == 0 {
+		return
+	}
+	ticker := time.NewTicker(ipamSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		syncCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		if err := m.sync(syncCtx); err != nil {
+			log.Printf("Failed to sync IP leases: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeMetrics appends the IPAM gauges to a /metrics response
+func (m *IPAM) writeMetrics(b *strings.Builder, gauge func(name, help string)) {
+	statuses := m.List()
+
+	gauge("proxmox_ipam_addresses", "Allocatable addresses of the subnet")
+	for _, s := range statuses {
+		fmt.Fprintf(b, "proxmox_ipam_addresses{subnet=%q} %d\n", s.Name, s.Size)
+	}
+	gauge("proxmox_ipam_addresses_free", "Allocatable addresses not leased")
+	for _, s := range statuses {
+		fmt.Fprintf(b, "proxmox_ipam_addresses_free{subnet=%q} %d\n", s.Name, s.Free)
+	}
+}
+
+// handleIPAM serves GET /ipam
+func (s *Server) handleIPAM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, s.ipam.List())
+}
+
+// handleLease serves DELETE /ipam/leases/{ip}
+func (s *Server) handleLease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ipam/leases/"), "/")
+	err := s.ipam.ReleaseIP(ip)
+	if errors.Is(err, errLeaseNotFound) {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to release %s: %v", ip, err)
+		http.Error(w, "Failed to save leases", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Released %s", ip)
+	fmt.Fprintf(w, "Released %s", ip)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIPAM has one subnet, 192.168.68.0/28: gateway .1, reserved .2, and
+// DHCP .5-.8, which leaves .3, .4, and .9-.14 to allocate
+func testIPAM(t *testing.T, pve *ProxmoxClient) *IPAM {
+	t.Helper()
+	subnets, err := loadSubnets(&Config{
+		Gateway: "192.168.68.1",
+		IPAM: IPAMSettings{
+			Subnet:     "192.168.68.0/28",
+			DHCPRanges: []string{"192.168.68.5-192.168.68.8"},
+			Reserved:   []string{"192.168.68.2"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewIPAM(pve, subnets, filepath.Join(t.TempDir(), "leases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// leased returns the VM holding each lease, by address
+func leased(m *IPAM) map[string]int {
+	leases := make(map[string]int)
+	for _, lease := range m.List()[0].Leases {
+		leases[lease.IP] = lease.VMID
+	}
+	return leases
+}
+
+func TestAllocate(t *testing.T) {
+	m := testIPAM(t, nil)
+
+	var got []string
+	for vmid := 100; ; vmid++ {
+		ip, subnet, err := m.Allocate("default", vmid, "k8s")
+		if err != nil {
+			if !strings.Contains(err.Error(), "no free addresses") {
+				t.Fatal(err)
+			}
+			break
+		}
+		if subnet.Gateway != "192.168.68.1" {
+			t.Fatalf("gateway = %s", subnet.Gateway)
+		}
+		got = append(got, ip)
+	}
+	want := []string{
+		"192.168.68.3/28", "192.168.68.4/28", "192.168.68.9/28", "192.168.68.10/28",
+		"192.168.68.11/28", "192.168.68.12/28", "192.168.68.13/28", "192.168.68.14/28",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("allocated %v, want %v", got, want)
+	}
+	if s := m.List()[0]; s.Size != 8 || s.Free != 0 {
+		t.Fatalf("size = %d, free = %d", s.Size, s.Free)
+	}
+
+	// Freed addresses are handed out again, lowest first
+	m.Release(101)
+	if ip, _, err := m.Allocate("default", 200, "k8s"); err != nil || ip != "192.168.68.4/28" {
+		t.Fatalf("ip = %s, err = %v", ip, err)
+	}
+
+	// Leases survive a restart
+	reloaded, err := NewIPAM(nil, m.subnets, m.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(leased(reloaded), leased(m)) {
+		t.Fatalf("reloaded %v, want %v", leased(reloaded), leased(m))
+	}
+}
+
+func TestReserve(t *testing.T) {
+	m := testIPAM(t, nil)
+	if _, err := m.Reserve("192.168.68.9/28", 100, "k8s-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cidr    string
+		vmid    int
+		wantErr string
+	}{
+		{cidr: "192.168.68.1/28", vmid: 101, wantErr: "is the gateway"},
+		{cidr: "192.168.68.6/28", vmid: 101, wantErr: "DHCP range"},
+		{cidr: "192.168.68.9/28", vmid: 101, wantErr: "is leased to k8s-1 (100)"},
+		// The VM holding the lease may request it again
+		{cidr: "192.168.68.9/28", vmid: 100},
+		// Reserved addresses are for hosts set up by hand
+		{cidr: "192.168.68.2/28", vmid: 101},
+	}
+	for _, tt := range tests {
+		_, err := m.Reserve(tt.cidr, tt.vmid, "k8s")
+		if tt.wantErr == "" && err != nil {
+			t.Fatalf("%s: %v", tt.cidr, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Fatalf("%s: err = %v, want %q", tt.cidr, err, tt.wantErr)
+		}
+	}
+
+	// Addresses outside every subnet are not managed
+	if s, err := m.Reserve("10.0.0.5/24", 102, "k8s-2"); s != nil || err != nil {
+		t.Fatalf("subnet = %v, err = %v", s, err)
+	}
+	want := map[string]int{"192.168.68.2": 101, "192.168.68.9": 100}
+	if got := leased(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("leases = %v, want %v", got, want)
+	}
+}
+
+func TestSync(t *testing.T) {
+	pve := newTestProxmox(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cluster/resources":
+			writeData(w, []ClusterResource{
+				{Type: "qemu", Node: "pve", Name: "k8s-1", VMID: 100},
+				{Type: "qemu", Node: "pve2", Name: "nas", VMID: 110},
+				{Type: "qemu", Node: "pve", Name: "dhcp-vm", VMID: 111},
+				{Type: "qemu", Node: "pve", Name: "template", VMID: 9000, Template: 1},
+			})
+		case "/nodes/pve2/qemu/110/config":
+			writeData(w, VMConfig{IPConfig0: "ip=192.168.68.12/28,gw=192.168.68.1"})
+		case "/nodes/pve/qemu/111/config":
+			writeData(w, VMConfig{IPConfig0: "ip=dhcp"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	m := testIPAM(t, pve)
+	for vmid, cidr := range map[int]string{100: "192.168.68.3/28", 101: "192.168.68.4/28", 102: "192.168.68.9/28"} {
+		if _, err := m.Reserve(cidr, vmid, "k8s"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// VM 101 was deleted long ago; VM 102 is still being cloned
+	m.leases[netip.MustParseAddr("192.168.68.4")].CreatedAt = time.Now().Add(-leaseGrace - time.Minute)
+
+	if err := m.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"192.168.68.3": 100, "192.168.68.9": 102, "192.168.68.12": 110}
+	if got := leased(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("leases = %v, want %v", got, want)
+	}
+	for _, lease := range m.List()[0].Leases {
+		if lease.Adopted != (lease.VMID == 110) {
+			t.Fatalf("lease %+v adopted = %v", lease, lease.Adopted)
+		}
+	}
+
+	// The adopted address is not allocated to new VMs
+	for i := 0; i < 5; i++ {
+		ip, _, err := m.Allocate("default", 200+i, "k8s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip == "192.168.68.12/28" {
+			t.Fatalf("allocated the adopted address to %d", 200+i)
+		}
+	}
+}
+
+func TestCreateReleasesLeaseWhenCloneFails(t *testing.T) {
+	pve := newTestProxmox(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/cluster/nextid":
+			writeData(w, "120")
+		case strings.HasSuffix(r.URL.Path, "/clone"):
+			writeData(w, "UPID:pve:clone")
+		case strings.HasPrefix(r.URL.Path, "/nodes/pve/tasks/"):
+			writeData(w, map[string]string{"status": "stopped", "exitstatus": "storage full"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	config := &Config{Node: "pve", TemplateID: 9000}
+	ipam := testIPAM(t, pve)
+	m := NewNodeManager(pve, config, NewTemplateManager(pve, config, nil), ipam, &UserDataManager{})
+
+	node, err := m.Create(NodeRequest{Name: "k8s-5", Subnet: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.IP != "192.168.68.3/28" {
+		t.Fatalf("ip = %s", node.IP)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(leased(ipam)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("lease kept after the clone failed: %v", leased(ipam))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.mu.Lock()
+	phase, errMsg := m.nodes[120].Phase, m.nodes[120].Error
+	m.mu.Unlock()
+	if phase != PhaseFailed || !strings.Contains(errMsg, "storage full") {
+		t.Fatalf("node = %s %q", phase, errMsg)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/homelab/internal/auth"
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+)
+
+func main() {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	specs, err := loadTemplateSpecs(config)
+	if err != nil {
+		log.Fatalf("Invalid template configuration: %v", err)
+	}
+	policies, err := loadBackupPolicies(config.Backups)
+	if err != nil {
+		log.Fatalf("Invalid backup configuration: %v", err)
+	}
+	subnets, err := loadSubnets(config)
+	if err != nil {
+		log.Fatalf("Invalid IPAM configuration: %v", err)
+	}
+	powerHosts, err := loadPowerHosts(config)
+	if err != nil {
+		log.Fatalf("Invalid power configuration: %v", err)
+	}
+
+	pve := NewProxmoxClient(config.ProxmoxURL, config.TokenID, config.TokenSecret, config.Node, config.Insecure)
+	templates := NewTemplateManager(pve, config, specs)
+	inventory, err := NewInventory(pve, config.PrometheusURL, config.TemperatureQuery)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	ipam, err := NewIPAM(pve, subnets, config.IPAM.LeasesFile)
+	if err != nil {
+		log.Fatalf("Invalid IP leases: %v", err)
+	}
+	userData, err := loadUserData(pve, config)
+	if err != nil {
+		log.Fatalf("Invalid user-data configuration: %v", err)
+	}
+	nodes := NewNodeManager(pve, config, templates, ipam, userData)
+	clusters, err := NewClusterManager(nodes, pve, config.ClustersDir, config.ClusterResyncInterval)
+	if err != nil {
+		log.Fatalf("Invalid cluster specs: %v", err)
+	}
+	kube, err := newInClusterKube()
+	if err != nil {
+		log.Fatalf("Invalid Kubernetes service account: %v", err)
+	}
+	server := &Server{
+		nodes:     nodes,
+		templates: templates,
+		inventory: inventory,
+		backups:   NewBackupManager(pve, policies),
+		clusters:  clusters,
+		ipam:      ipam,
+		power:     NewPowerManager(pve, kube, powerHosts, config.Power.NodeName, config.Power.PendingWakeDelay, config.Power.DrainTimeout),
+		pve:       pve,
+	}
+	go templates.Run(context.Background())
+	go server.backups.Run(context.Background())
+	go clusters.Run(context.Background())
+	go ipam.Run(context.Background())
+	go server.power.Run(context.Background())
+
+	apiAuth := auth.AllowUnauthenticated(auth.Bearer(config.APIToken, "", "", nil), config.AllowUnauthenticated, "provisioning API")
+	http.HandleFunc("/nodes", auth.Require(server.handleNodes, apiAuth...))
+	http.HandleFunc("/nodes/", auth.Require(server.handleNode, apiAuth...))
+	http.HandleFunc("/templates", auth.Require(server.handleTemplates, apiAuth...))
+	http.HandleFunc("/templates/", auth.Require(server.handleTemplate, apiAuth...))
+	http.HandleFunc("/clusters", auth.Require(server.handleClusters, apiAuth...))
+	http.HandleFunc("/clusters/", auth.Require(server.handleCluster, apiAuth...))
+	http.HandleFunc("/ipam", auth.Require(server.handleIPAM, apiAuth...))
+	http.HandleFunc("/ipam/leases/", auth.Require(server.handleLease, apiAuth...))
+	http.HandleFunc("/proxmox/nodes", auth.Require(server.handleProxmoxNodes, apiAuth...))
+	http.HandleFunc("/proxmox/vms", auth.Require(server.handleProxmoxVMs, apiAuth...))
+	http.HandleFunc("/backups", auth.Require(server.handleBackups, apiAuth...))
+	http.HandleFunc("/backups/", auth.Require(server.handleBackup, apiAuth...))
+	http.HandleFunc("/restores", auth.Require(server.handleRestores, apiAuth...))
+	http.HandleFunc("/restores/points", auth.Require(server.handleRestorePoints, apiAuth...))
+	http.HandleFunc("/power", auth.Require(server.handleHostPower, apiAuth...))
+	http.HandleFunc("/power/", auth.Require(server.handleHostPowerAction, apiAuth...))
+	// Unauthenticated so Prometheus can scrape it through pod annotations
+	http.HandleFunc("/metrics", server.handleMetrics)
+	// /readyz fails while the Proxmox API is unreachable; /health stays as
+	// an alias of /healthz
+	checks := health.New()
+	checks.Add("proxmox", pve.Ping)
+	checks.Register(http.DefaultServeMux)
+	http.HandleFunc("/health", checks.Live)
+
+	port := config.Port
+
+	log.Printf("Starting proxmox-api on port %s (node %s, template %d, join %t, %d backup policies, %d clusters, %d subnets, %d user-data templates, %d power hosts)",
+		port, config.Node, config.TemplateID, config.JoinEnabled(), len(policies), len(clusters.List()), len(subnets), len(userData.Templates()), len(powerHosts))
+	if len(powerHosts) > 0 && kube == nil {
+		log.Printf("WARNING: not running in Kubernetes, power hosts will not be drained or put to sleep")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, http.DefaultServeMux)); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+// nodeTag marks VMs created by this service so listing ignores hand-made VMs
+const nodeTag = "k8s-node"
+
+// NodeRequest is the body of POST /nodes
+type NodeRequest struct {
+	Name     string `json:"name"`
+	Template int    `json:"template,omitempty"`
+	Cores    int    `json:"cores,omitempty"`
+	Memory   int    `json:"memory,omitempty"` // MiB
+	Disk     int    `json:"disk,omitempty"`   // GiB
+	IP       string `json:"ip,omitempty"`     // CIDR, e.g. 192.168.68.60/24; DHCP when empty
+	Join     *bool  `json:"join,omitempty"`
+	// Subnet allocates IP from an IPAM subnet, which also supplies the
+	// gateway, bridge, and DNS defaults
+	Subnet string `json:"subnet,omitempty"`
+	// Storage, Bridge, Gateway, and DNS override the service defaults;
+	// Bridge replaces the template's network device
+	Storage string   `json:"storage,omitempty"`
+	Bridge  string   `json:"bridge,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+	// Tags are added to the k8s-node tag
+	Tags []string `json:"tags,omitempty"`
+	// UserData names a cloud-init user-data template (default:
+	// USER_DATA_TEMPLATE); UserDataVars are passed to it as .Vars
+	UserData     string            `json:"userData,omitempty"`
+	UserDataVars map[string]string `json:"userDataVars,omitempty"`
+	// Devices are passed through from the host the node is placed on, and
+	// announced as Kubernetes node labels
+	Devices []DeviceSpec `json:"devices,omitempty"`
+}
+
+// Node is the provisioning state reported by the API
+type Node struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Host      string    `json:"host,omitempty"`
+	Phase     string    `json:"phase"`
+	Power     string    `json:"power,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
+
+// Node phases
+const (
+	PhaseProvisioning = "Provisioning"
+	PhaseJoining      = "Joining"
+	PhaseReady        = "Ready"
+	PhaseFailed       = "Failed"
+	PhaseDeleting     = "Deleting"
+)
+
+var nodeNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// NodeManager provisions VMs and tracks in-flight operations
+type NodeManager struct {
+	pve    *ProxmoxClient
+	config *Config
+	// templates supplies the newest golden template when a request names none
+	templates *TemplateManager
+	ipam      *IPAM
+	userData  *UserDataManager
+
+	// placeMu serialises device placement
+	placeMu sync.Mutex
+
+	mu     sync.Mutex
+	nodes  map[int]*Node
+	claims map[int]deviceClaim
+}
+
+func NewNodeManager(pve *ProxmoxClient, config *Config, templates *TemplateManager, ipam *IPAM, userData *UserDataManager) *NodeManager {
+	return &NodeManager{
+		pve:       pve,
+		config:    config,
+		templates: templates,
+		ipam:      ipam,
+		userData:  userData,
+		nodes:     make(map[int]*Node),
+		claims:    make(map[int]deviceClaim),
+	}
+}
+
+func (m *NodeManager) setPhase(id int, phase, errMsg string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := m.nodes[id]; ok {
+		n.Phase = phase
+		n.Error = errMsg
+	}
+}
+
+// Create allocates a VM ID and provisions the node in the background
+func (m *NodeManager) Create(req NodeRequest) (*Node, error) {
+	if !nodeNamePattern.MatchString(req.Name) {
+		return nil, fmt.Errorf("invalid node name %q", req.Name)
+	}
+	if err := validateDevices(req.Devices); err != nil {
+		return nil, err
+	}
+	userData, err := m.userData.resolve(req.UserData)
+	if err != nil {
+		return nil, err
+	}
+	req.UserData = userData
+	ctx := context.Background()
+	if req.Template == 0 {
+		req.Template = m.templates.Current(ctx)
+	}
+	if req.Cores == 0 {
+		req.Cores = 2
+	}
+	if req.Memory == 0 {
+		req.Memory = 4096
+	}
+	if req.Disk == 0 {
+		req.Disk = 20
+	}
+	if req.Storage == "" {
+		req.Storage = m.config.Storage
+	}
+
+	id, err := m.pve.NextID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("allocating VM ID: %w", err)
+	}
+
+	// Requested addresses are checked against the IPAM subnets too, so a
+	// hand-picked IP cannot collide with a lease or a DHCP pool
+	var subnet *Subnet
+	if req.IP == "" && req.Subnet != "" {
+		req.IP, subnet, err = m.ipam.Allocate(req.Subnet, id, req.Name)
+	} else if req.IP != "" {
+		subnet, err = m.ipam.Reserve(req.IP, id, req.Name)
+		if err == nil && req.Subnet != "" && (subnet == nil || subnet.Name != req.Subnet) {
+			m.ipam.Release(id)
+			err = fmt.Errorf("ip %s is not in subnet %s", req.IP, req.Subnet)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subnet != nil {
+		if req.Gateway == "" {
+			req.Gateway = subnet.Gateway
+		}
+		if req.Bridge == "" {
+			req.Bridge = subnet.Bridge
+		}
+		if len(req.DNS) == 0 {
+			req.DNS = subnet.DNS
+		}
+	}
+	if req.Gateway == "" {
+		req.Gateway = m.config.Gateway
+	}
+	if len(req.DNS) == 0 {
+		req.DNS = m.config.DNSServers
+	}
+
+	host, err := m.placeDevices(ctx, id, req.Devices)
+	if err != nil {
+		m.ipam.Release(id)
+		return nil, err
+	}
+
+	node := &Node{ID: id, Name: req.Name, Host: host, Phase: PhaseProvisioning, IP: req.IP, CreatedAt: time.Now()}
+	m.mu.Lock()
+	created := *node
+	m.nodes[id] = node
+	m.mu.Unlock()
+
+	go m.provision(id, req, host)
+	return &created, nil
+}
+
+func (m *NodeManager) provision(id int, req NodeRequest, host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	defer m.releaseDevices(id)
+
+	fail := func(step string, err error) {
+		log.Printf("Provisioning %s (%d) failed at %s: %v", req.Name, id, step, err)
+		m.setPhase(id, PhaseFailed, fmt.Sprintf("%s: %v", step, err))
+	}
+
+	log.Printf("Cloning template %d into %s (%d)", req.Template, req.Name, id)
+	if err := m.pve.Clone(ctx, req.Template, id, req.Name, req.Storage); err != nil {
+		fail("clone", err)
+		m.ipam.Release(id)
+		return
+	}
+
+	// Templates live on PROXMOX_NODE; nodes placed elsewhere for their
+	// devices move there before the devices are configured
+	pve := m.pve
+	if host != m.config.Node {
+		log.Printf("Migrating %s (%d) to %s", req.Name, id, host)
+		if err := m.pve.Migrate(ctx, id, host); err != nil {
+			fail("migrate", err)
+			return
+		}
+		pve = m.pve.ForNode(host)
+	}
+
+	join := m.config.JoinEnabled()
+	if req.Join != nil {
+		join = *req.Join && m.config.JoinEnabled()
+	}
+
+	ipconfig := "ip=dhcp"
+	if req.IP != "" {
+		ipconfig = fmt.Sprintf("ip=%s,gw=%s", req.IP, req.Gateway)
+	}
+	params := url.Values{
+		"cores":     {strconv.Itoa(req.Cores)},
+		"memory":    {strconv.Itoa(req.Memory)},
+		"cpu":       {"host"},
+		"agent":     {"1"},
+		"tags":      {strings.Join(append([]string{nodeTag}, req.Tags...), ";")},
+		"ipconfig0": {ipconfig},
+		"ciuser":    {m.config.VMUser},
+	}
+	if req.Bridge != "" {
+		params.Set("net0", "virtio,bridge="+req.Bridge)
+	}
+	if len(req.DNS) > 0 {
+		params.Set("nameserver", strings.Join(req.DNS, " "))
+	}
+	deviceParams(req.Devices, params)
+	if m.config.SSHPublicKey != "" {
+		// Proxmox expects the key list URL-encoded inside the form value
+		params.Set("sshkeys", strings.ReplaceAll(url.QueryEscape(m.config.SSHPublicKey), "+", "%20"))
+	}
+	// A user-data snippet replaces the generated user config (user, keys),
+	// so templates render those themselves; network config is still generated
+	if req.UserData != "" {
+		volume, err := m.userData.Store(ctx, req.UserData, &UserData{
+			Hostname:   req.Name,
+			VMID:       id,
+			IP:         req.IP,
+			Gateway:    req.Gateway,
+			DNS:        req.DNS,
+			User:       m.config.VMUser,
+			SSHKeys:    sshKeys(m.config.SSHPublicKey),
+			Tags:       req.Tags,
+			Join:       join,
+			K3sURL:     m.config.K3sURL,
+			K3sToken:   m.config.K3sToken,
+			K3sChannel: m.config.K3sChannel,
+			RegistryCA: m.userData.registryCA,
+			NodeLabels: deviceLabels(req.Devices),
+			Vars:       req.UserDataVars,
+		})
+		if err != nil {
+			fail("user-data", err)
+			return
+		}
+		params.Set("cicustom", "user="+volume)
+	}
+	if err := pve.Configure(ctx, id, params); err != nil {
+		fail("configure", err)
+		return
+	}
+
+	if err := pve.ResizeDisk(ctx, id, "scsi0", req.Disk); err != nil {
+		fail("resize", err)
+		return
+	}
+
+	if err := pve.Start(ctx, id); err != nil {
+		fail("start", err)
+		return
+	}
+
+	if !join {
+		m.setPhase(id, PhaseReady, "")
+		log.Printf("Node %s (%d) started", req.Name, id)
+		return
+	}
+
+	m.setPhase(id, PhaseJoining, "")
+	if err := m.joinCluster(ctx, pve, id, req.UserData == "", deviceLabels(req.Devices)); err != nil {
+		fail("join", err)
+		return
+	}
+	m.setPhase(id, PhaseReady, "")
+	log.Printf("Node %s (%d) joined the cluster", req.Name, id)
+}
+
+// joinCluster waits for the guest agent and installs the k3s agent through
+// it, registering the node with labels; without install, the node's
+// user-data template joins it instead
+func (m *NodeManager) joinCluster(ctx context.Context, pve *ProxmoxClient, id int, install bool, labels []string) error {
+	for !pve.AgentPing(ctx, id) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("guest agent never came up: %w", ctx.Err())
+		case <-time.After(10 * time.Second):
+		}
+	}
+	if !install {
+		return nil
+	}
+
+	var exec string
+	if len(labels) > 0 {
+		exec = "INSTALL_K3S_EXEC='--node-label " + strings.Join(labels, " --node-label ") + "' "
+	}
+	script := fmt.Sprintf("curl -sfL https://get.k3s.io | INSTALL_K3S_CHANNEL=%s K3S_URL=%s K3S_TOKEN=%s %ssh -",
+		m.config.K3sChannel, m.config.K3sURL, m.config.K3sToken, exec)
+	_, err := pve.AgentExec(ctx, id, []string{"/bin/sh", "-c", script})
+	return err
+}
+
+// List merges Proxmox VMs tagged as nodes, on every host, with in-flight
+// operations
+func (m *NodeManager) List(ctx context.Context) ([]Node, error) {
+	vms, err := m.pve.ListClusterVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[int]bool)
+	var nodes []Node
+	for _, vm := range vms {
+		if !hasTag(vm.Tags, nodeTag) {
+			continue
+		}
+		node := Node{ID: vm.VMID, Name: vm.Name, Host: vm.Node, Phase: PhaseReady, Power: vm.Status}
+		if tracked, ok := m.nodes[vm.VMID]; ok {
+			node.Phase, node.Error, node.IP, node.CreatedAt = tracked.Phase, tracked.Error, tracked.IP, tracked.CreatedAt
+		}
+		seen[vm.VMID] = true
+		nodes = append(nodes, node)
+	}
+
+	// Nodes still cloning are not visible in Proxmox yet
+	for id, tracked := range m.nodes {
+		if !seen[id] {
+			nodes = append(nodes, *tracked)
+		}
+	}
+	return nodes, nil
+}
+
+// Get returns a single node by VM ID
+func (m *NodeManager) Get(ctx context.Context, id int) (*Node, error) {
+	m.mu.Lock()
+	tracked, ok := m.nodes[id]
+	var node Node
+	if ok {
+		node = *tracked
+	}
+	m.mu.Unlock()
+
+	pve := m.host(ctx, id)
+	status, err := pve.Status(ctx, id)
+	if err != nil {
+		if ok {
+			return &node, nil
+		}
+		return nil, err
+	}
+	node.Host = pve.node
+	if !ok {
+		if !hasTag(status.Tags, nodeTag) {
+			return nil, fmt.Errorf("VM %d is not a managed node", id)
+		}
+		node = Node{ID: id, Name: status.Name, Phase: PhaseReady}
+	}
+	node.Power = status.Status
+	return &node, nil
+}
+
+// Delete stops and destroys a managed node in the background
+func (m *NodeManager) Delete(ctx context.Context, id int) error {
+	node, err := m.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	node.Phase = PhaseDeleting
+	m.nodes[id] = node
+	m.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		pve := m.pve
+		if node.Host != "" {
+			pve = m.pve.ForNode(node.Host)
+		}
+		if node.Power == "running" {
+			if err := pve.Shutdown(ctx, id); err != nil {
+				log.Printf("Graceful shutdown of %d failed, stopping: %v", id, err)
+				_ = pve.Stop(ctx, id)
+			}
+		}
+		if err := pve.Destroy(ctx, id); err != nil {
+			log.Printf("Failed to destroy node %d: %v", id, err)
+			m.setPhase(id, PhaseFailed, fmt.Sprintf("destroy: %v", err))
+			return
+		}
+
+		m.mu.Lock()
+		delete(m.nodes, id)
+		m.mu.Unlock()
+		m.ipam.Release(id)
+		m.userData.Remove(ctx, id)
+		log.Printf("Node %s (%d) destroyed", node.Name, id)
+	}()
+	return nil
+}
+
+func hasTag(tags, tag string) bool {
+	for _, t := range strings.FieldsFunc(tags, func(r rune) bool { return r == ';' || r == ',' }) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Server holds the HTTP handlers for the provisioning API
+type Server struct {
+	nodes     *NodeManager
+	templates *TemplateManager
+	inventory *Inventory
+	backups   *BackupManager
+	clusters  *ClusterManager
+	ipam      *IPAM
+	power     *PowerManager
+	pve       *ProxmoxClient
+}
+
+// handleNodes serves GET /nodes and POST /nodes
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		nodes, err := s.nodes.List(r.Context())
+		if err != nil {
+			log.Printf("Failed to list nodes: %v", err)
+			http.Error(w, "Failed to list nodes", http.StatusBadGateway)
+			return
+		}
+		httpkit.WriteJSON(w, http.StatusOK, nodes)
+
+	case http.MethodPost:
+		var req NodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+		node, err := s.nodes.Create(req)
+		if err != nil {
+			log.Printf("Failed to create node: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Provisioning node %s (%d)", node.Name, node.ID)
+		httpkit.WriteJSON(w, http.StatusAccepted, node)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleNode serves /nodes/{id} and /nodes/{id}/{start|stop}
+func (s *Server) handleNode(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/nodes/"), "/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid node id", http.StatusBadRequest)
+		return
+	}
+
+	if len(parts) == 2 {
+		s.handlePower(w, r, id, parts[1])
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		node, err := s.nodes.Get(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		httpkit.WriteJSON(w, http.StatusOK, node)
+
+	case http.MethodDelete:
+		if err := s.nodes.Delete(r.Context(), id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("Deleting node %d", id)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Deleting node %d", id)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handlePower(w http.ResponseWriter, r *http.Request, id int, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := s.nodes.Get(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	pve := s.nodes.host(r.Context(), id)
+	var err error
+	switch action {
+	case "start":
+		err = pve.Start(r.Context(), id)
+	case "stop":
+		err = pve.Shutdown(r.Context(), id)
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to %s node %d: %v", action, id, err)
+		http.Error(w, fmt.Sprintf("Failed to %s node", action), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintf(w, "Node %d: %s complete", id, action)
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Host power phases
+const (
+	PowerOnline       = "Online"
+	PowerDraining     = "Draining"
+	PowerShuttingDown = "ShuttingDown"
+	PowerAsleep       = "Asleep"
+	PowerWaking       = "Waking"
+)
+
+// Wake methods
+const (
+	WakeWoL  = "wol"
+	WakeIPMI = "ipmi"
+)
+
+// controlPlaneLabel marks control-plane nodes; their hosts are never shut
+// down
+const controlPlaneLabel = "node-role.kubernetes.io/control-plane"
+
+// powerCordonAnnotation marks Kubernetes nodes cordoned so their host could
+// sleep; waking the host uncordons only those
+const powerCordonAnnotation = "homelab.mcztest.com/power-cordoned"
+
+// hostTransitionTimeout bounds a host shutdown or boot; a variable so
+// tests can shorten it
+var hostTransitionTimeout = 15 * time.Minute
+
+// wakeRetryInterval resends wake requests, since a magic packet is fire
+// and forget
+const wakeRetryInterval = 2 * time.Minute
+
+// PowerHost is a Proxmox host the service may shut down and wake
+type PowerHost struct {
+	Name string `json:"name"`
+	// Wake is wol (a magic packet sent by PROXMOX_NODE to the MAC set with
+	// pvenode config set --wakeonlan) or ipmi (chassis power on through the
+	// host's BMC)
+	Wake string    `json:"wake,omitempty"`
+	IPMI *IPMISpec `json:"ipmi,omitempty"`
+	// SleepAt and WakeAt are cron schedules opening and closing the window
+	// in which the host is shut down once idle; without them it only sleeps
+	// and wakes through the API or for pending pods
+	SleepAt string `json:"sleepAt,omitempty"`
+	WakeAt  string `json:"wakeAt,omitempty"`
+	// IdleCPU is the host CPU utilisation (0-1) under which it counts as
+	// idle (default 0.15)
+	IdleCPU float64 `json:"idleCPU,omitempty"`
+
+	sleepAt, wakeAt *cronSchedule
+}
+
+// IPMISpec reaches a host's BMC over IPMI-over-LAN with ipmitool
+type IPMISpec struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	// PasswordFile holds the BMC password, e.g. from a mounted Secret
+	PasswordFile string `json:"passwordFile"`
+}
+
+// HostPower is a host's power state reported by the API
+type HostPower struct {
+	Name    string `json:"name"`
+	Phase   string `json:"phase"`
+	Wake    string `json:"wake"`
+	SleepAt string `json:"sleepAt,omitempty"`
+	WakeAt  string `json:"wakeAt,omitempty"`
+	// SleepWindow is set between SleepAt and WakeAt
+	SleepWindow bool `json:"sleepWindow"`
+	// KeepAwake holds a host woken inside its window up until WakeAt
+	KeepAwake      bool       `json:"keepAwake"`
+	NextSleep      *time.Time `json:"nextSleep,omitempty"`
+	NextWake       *time.Time `json:"nextWake,omitempty"`
+	LastTransition *time.Time `json:"lastTransition,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
+	Error          string     `json:"error,omitempty"`
+
+	busy bool
+}
+
+var (
+	errPowerHostNotFound = errors.New("host not found")
+	errHostBusy          = errors.New("host power change in progress")
+)
+
+// PowerManager shuts idle Proxmox hosts down, after draining their
+// Kubernetes nodes, and wakes them on schedule, on demand, or when pods
+// cannot be scheduled
+type PowerManager struct {
+	pve  *ProxmoxClient
+	kube kubernetes.Interface
+	// selfNode is the Kubernetes node running this service; its host is
+	// never shut down
+	selfNode     string
+	pendingDelay time.Duration
+	drainTimeout time.Duration
+	hosts        []PowerHost
+
+	mu     sync.Mutex
+	status map[string]*HostPower
+}
+
+// PowerSettings configure host power management
+type PowerSettings struct {
+	// HostsFile is a JSON list of hosts; unset means no host is power managed
+	HostsFile        string        `json:"hostsFile" env:"POWER_HOSTS_FILE" flag:"power-hosts-file"`
+	PendingWakeDelay time.Duration `json:"pendingWakeDelay" env:"PENDING_WAKE_DELAY" flag:"pending-wake-delay" usage:"how long pods stay unschedulable before a sleeping host is woken"`
+	DrainTimeout     time.Duration `json:"drainTimeout" env:"DRAIN_TIMEOUT" flag:"drain-timeout" usage:"how long draining a host's nodes may take"`
+	// NodeName is the k8s node running the service, from the downward API
+	NodeName string `json:"nodeName" env:"NODE_NAME" flag:"node-name"`
+}
+
+// loadPowerHosts reads POWER_HOSTS_FILE (a JSON list); unset means no host
+// is power managed
+func loadPowerHosts(config *Config) ([]PowerHost, error) {
+	path := config.Power.HostsFile
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading POWER_HOSTS_FILE: %w", err)
+	}
+	var hosts []PowerHost
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, fmt.Errorf("parsing POWER_HOSTS_FILE: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range hosts {
+		h := &hosts[i]
+		if h.Name == "" {
+			return nil, fmt.Errorf("power host %d: name is required", i)
+		}
+		// The API and wake-on-LAN packets go through PROXMOX_NODE
+		if h.Name == config.Node {
+			return nil, fmt.Errorf("power host %s serves the Proxmox API and cannot be shut down", h.Name)
+		}
+		if seen[h.Name] {
+			return nil, fmt.Errorf("duplicate power host %q", h.Name)
+		}
+		seen[h.Name] = true
+
+		switch h.Wake {
+		case "":
+			h.Wake = WakeWoL
+		case WakeWoL:
+		case WakeIPMI:
+			if h.IPMI == nil || h.IPMI.Address == "" || h.IPMI.PasswordFile == "" {
+				return nil, fmt.Errorf("power host %s: ipmi needs address and passwordFile", h.Name)
+			}
+		default:
+			return nil, fmt.Errorf("power host %s: wake must be %s or %s", h.Name, WakeWoL, WakeIPMI)
+		}
+
+		if (h.SleepAt == "") != (h.WakeAt == "") {
+			return nil, fmt.Errorf("power host %s: sleepAt and wakeAt must be set together", h.Name)
+		}
+		if h.SleepAt != "" {
+			if h.sleepAt, err = parseCron(h.SleepAt); err != nil {
+				return nil, fmt.Errorf("power host %s: sleepAt: %w", h.Name, err)
+			}
+			if h.wakeAt, err = parseCron(h.WakeAt); err != nil {
+				return nil, fmt.Errorf("power host %s: wakeAt: %w", h.Name, err)
+			}
+			if h.sleepAt.Next(time.Now()).IsZero() || h.wakeAt.Next(time.Now()).IsZero() {
+				return nil, fmt.Errorf("power host %s: schedule never runs", h.Name)
+			}
+		}
+		if h.IdleCPU == 0 {
+			h.IdleCPU = 0.15
+		}
+		if h.IdleCPU < 0 || h.IdleCPU > 1 {
+			return nil, fmt.Errorf("power host %s: idleCPU must be between 0 and 1", h.Name)
+		}
+	}
+	return hosts, nil
+}
+
+func NewPowerManager(pve *ProxmoxClient, kube kubernetes.Interface, hosts []PowerHost, selfNode string, pendingDelay, drainTimeout time.Duration) *PowerManager {
+	status := make(map[string]*HostPower)
+	now := time.Now()
+	for _, h := range hosts {
+		st := &HostPower{Name: h.Name, Phase: PowerOnline, Wake: h.Wake, SleepAt: h.SleepAt, WakeAt: h.WakeAt}
+		if h.sleepAt != nil {
+			nextSleep, nextWake := h.sleepAt.Next(now), h.wakeAt.Next(now)
+			st.NextSleep, st.NextWake = &nextSleep, &nextWake
+			// Started inside the window when it closes before it next opens
+			st.SleepWindow = nextWake.Before(nextSleep)
+		}
+		status[h.Name] = st
+	}
+	return &PowerManager{
+		pve:          pve,
+		kube:         kube,
+		selfNode:     selfNode,
+		pendingDelay: pendingDelay,
+		drainTimeout: drainTimeout,
+		hosts:        hosts,
+		status:       status,
+	}
+}
+
+func (m *PowerManager) host(name string) *PowerHost {
+	for i := range m.hosts {
+		if m.hosts[i].Name == name {
+			return &m.hosts[i]
+		}
+	}
+	return nil
+}
+
+// setPhase records a transition; callers hold m.mu
+func (st *HostPower) setPhase(phase, reason string) {
+	now := time.Now()
+	st.Phase, st.Reason, st.LastTransition = phase, reason, &now
+}
+
+// finish ends a host's power change in phase
+func (m *PowerManager) finish(name, phase, errMsg string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.status[name]
+	st.busy = false
+	st.setPhase(phase, st.Reason)
+	st.Error = errMsg
+}
+
+// List returns every managed host's power state, in configured order
+func (m *PowerManager) List() []HostPower {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hosts := make([]HostPower, 0, len(m.hosts))
+	for _, h := range m.hosts {
+		hosts = append(hosts, *m.status[h.Name])
+	}
+	return hosts
+}
+
+// Sleep drains the host's Kubernetes nodes and shuts it down in the
+// background
+func (m *PowerManager) Sleep(name, reason string) error {
+	if m.kube == nil {
+		return fmt.Errorf("draining needs in-cluster Kubernetes access")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.status[name]
+	if !ok {
+		return errPowerHostNotFound
+	}
+	if st.busy {
+		return errHostBusy
+	}
+	if st.Phase != PowerOnline {
+		return fmt.Errorf("host %s is %s", name, st.Phase)
+	}
+	st.busy = true
+	st.Error = ""
+	st.setPhase(PowerDraining, reason)
+	log.Printf("Putting host %s to sleep: %s", name, reason)
+	go m.sleep(name)
+	return nil
+}
+
+func (m *PowerManager) sleep(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.drainTimeout+hostTransitionTimeout)
+	defer cancel()
+
+	fail := func(step string, err error) {
+		log.Printf("Failed to put host %s to sleep at %s: %v", name, step, err)
+		m.finish(name, PowerOnline, fmt.Sprintf("%s: %v", step, err))
+	}
+
+	hostNodes, controlPlane, err := m.hostNodes(ctx)
+	if err != nil {
+		fail("list", err)
+		return
+	}
+	if node := controlPlane[name]; node != "" {
+		fail("list", fmt.Errorf("node %s runs the control plane", node))
+		return
+	}
+	nodes := hostNodes[name]
+	for _, node := range nodes {
+		if node == m.selfNode {
+			fail("drain", fmt.Errorf("node %s runs proxmox-api", node))
+			return
+		}
+	}
+
+	uncordon := func() {
+		for _, node := range nodes {
+			if err := setUnschedulable(context.Background(), m.kube, node, false, powerCordonAnnotation); err != nil {
+				log.Printf("Failed to uncordon %s: %v", node, err)
+			}
+		}
+	}
+	for _, node := range nodes {
+		if err := setUnschedulable(ctx, m.kube, node, true, powerCordonAnnotation); err != nil {
+			uncordon()
+			fail("cordon", err)
+			return
+		}
+	}
+	drainCtx, drainCancel := context.WithTimeout(ctx, m.drainTimeout)
+	defer drainCancel()
+	for _, node := range nodes {
+		log.Printf("Draining %s from host %s", node, name)
+		if err := drain(drainCtx, m.kube, node); err != nil {
+			uncordon()
+			fail("drain", err)
+			return
+		}
+	}
+
+	m.mu.Lock()
+	m.status[name].setPhase(PowerShuttingDown, m.status[name].Reason)
+	m.mu.Unlock()
+	if err := m.pve.ShutdownHost(ctx, name); err != nil {
+		uncordon()
+		fail("shutdown", err)
+		return
+	}
+	if err := m.waitHost(ctx, name, false, nil); err != nil {
+		uncordon()
+		fail("shutdown", err)
+		return
+	}
+	m.finish(name, PowerAsleep, "")
+	log.Printf("Host %s is asleep", name)
+}
+
+// Wake powers the host on in the background, then starts the Kubernetes
+// node VMs it stopped and uncordons them. A host woken inside its sleep
+// window stays up until WakeAt.
+func (m *PowerManager) Wake(name, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.status[name]
+	if !ok {
+		return errPowerHostNotFound
+	}
+	if st.busy {
+		return errHostBusy
+	}
+	if st.SleepWindow {
+		st.KeepAwake = true
+	}
+	if st.Phase == PowerOnline {
+		return nil
+	}
+	st.busy = true
+	st.Error = ""
+	st.setPhase(PowerWaking, reason)
+	log.Printf("Waking host %s: %s", name, reason)
+	go m.wake(name)
+	return nil
+}
+
+func (m *PowerManager) wake(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), hostTransitionTimeout)
+	defer cancel()
+
+	h := m.host(name)
+	send := func() error {
+		if h.Wake == WakeIPMI {
+			return ipmiPowerOn(ctx, h.IPMI)
+		}
+		return m.pve.WakeOnLAN(ctx, name)
+	}
+	if err := send(); err != nil {
+		log.Printf("Failed to wake host %s: %v", name, err)
+		m.finish(name, PowerAsleep, fmt.Sprintf("wake: %v", err))
+		return
+	}
+	resend := func() {
+		if err := send(); err != nil {
+			log.Printf("Failed to resend wake to host %s: %v", name, err)
+		}
+	}
+	if err := m.waitHost(ctx, name, true, resend); err != nil {
+		log.Printf("Host %s did not wake: %v", name, err)
+		m.finish(name, PowerAsleep, fmt.Sprintf("wake: %v", err))
+		return
+	}
+
+	errMsg := ""
+	if err := m.resume(ctx, name); err != nil {
+		log.Printf("Failed to resume nodes on host %s: %v", name, err)
+		errMsg = fmt.Sprintf("resume: %v", err)
+	}
+	m.finish(name, PowerOnline, errMsg)
+	log.Printf("Host %s is awake", name)
+}
+
+// resume starts the stopped VMs of nodes cordoned for the host's sleep and
+// uncordons them; VMs set to start on boot are already running
+func (m *PowerManager) resume(ctx context.Context, name string) error {
+	if m.kube == nil {
+		return nil
+	}
+	nodes, err := m.kube.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	cordoned := make(map[string]bool)
+	for _, node := range nodes.Items {
+		if node.Annotations[powerCordonAnnotation] == "true" {
+			cordoned[node.Name] = true
+		}
+	}
+	vms, err := m.pve.ListClusterVMs(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	pve := m.pve.ForNode(name)
+	for _, vm := range vms {
+		if vm.Node != name || !cordoned[vm.Name] {
+			continue
+		}
+		if vm.Status != "running" {
+			if err := pve.Start(ctx, vm.VMID); err != nil {
+				errs = append(errs, fmt.Errorf("starting %s: %w", vm.Name, err))
+				continue
+			}
+		}
+		if err := setUnschedulable(ctx, m.kube, vm.Name, false, powerCordonAnnotation); err != nil {
+			errs = append(errs, fmt.Errorf("uncordoning %s: %w", vm.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hostNodes maps each host to the Kubernetes nodes whose VMs run on it, by
+// VM name, and each host holding a control-plane node VM, running or not,
+// to that node
+func (m *PowerManager) hostNodes(ctx context.Context) (nodes map[string][]string, controlPlane map[string]string, err error) {
+	vms, err := m.pve.ListClusterVMs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := m.kube.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	known := make(map[string]bool, len(list.Items))
+	isControlPlane := make(map[string]bool)
+	for _, node := range list.Items {
+		known[node.Name] = true
+		if _, ok := node.Labels[controlPlaneLabel]; ok {
+			isControlPlane[node.Name] = true
+		}
+	}
+	nodes, controlPlane = make(map[string][]string), make(map[string]string)
+	for _, vm := range vms {
+		if vm.Template != 0 || !known[vm.Name] {
+			continue
+		}
+		if isControlPlane[vm.Name] {
+			controlPlane[vm.Node] = vm.Name
+		}
+		if vm.Status == "running" {
+			nodes[vm.Node] = append(nodes[vm.Node], vm.Name)
+		}
+	}
+	return nodes, controlPlane, nil
+}
+
+// hostOnline reports whether Proxmox sees the host online
+func (m *PowerManager) hostOnline(ctx context.Context, name string) (bool, error) {
+	resources, err := m.pve.ClusterResources(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources {
+		if r.Type == "node" && r.Node == name {
+			return r.Status == "online", nil
+		}
+	}
+	return false, fmt.Errorf("host %s is not in the Proxmox cluster", name)
+}
+
+// waitHost polls until the host is online (or offline), calling retry
+// every wakeRetryInterval
+func (m *PowerManager) waitHost(ctx context.Context, name string, online bool, retry func()) error {
+	lastRetry := time.Now()
+	for {
+		if up, err := m.hostOnline(ctx, name); err == nil && up == online {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("host %s did not change power state: %w", name, ctx.Err())
+		case <-time.After(10 * time.Second):
+		}
+		if retry != nil && time.Since(lastRetry) > wakeRetryInterval {
+			retry()
+			lastRetry = time.Now()
+		}
+	}
+}
+
+func ipmiPowerOn(ctx context.Context, spec *IPMISpec) error {
+	args := []string{"-I", "lanplus", "-H", spec.Address, "-f", spec.PasswordFile}
+	if spec.Username != "" {
+		args = append(args, "-U", spec.Username)
+	}
+	args = append(args, "chassis", "power", "on")
+	out, err := exec.CommandContext(ctx, "ipmitool", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ipmitool: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Run follows the sleep schedules every minute: hosts idle inside their
+// window are put to sleep one at a time, windows closing wake their hosts,
+// and pods unschedulable for PENDING_WAKE_DELAY wake one sleeping host
+func (m *PowerManager) Run(ctx context.Context) {
+	if len(m.hosts) == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		m.step(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *PowerManager) step(ctx context.Context) {
+	resources, err := m.pve.ClusterResources(ctx)
+	if err != nil {
+		log.Printf("Failed to read host power states: %v", err)
+		return
+	}
+	online := make(map[string]bool)
+	cpu := make(map[string]float64)
+	for _, r := range resources {
+		if r.Type == "node" {
+			online[r.Node] = r.Status == "online"
+			cpu[r.Node] = r.CPU
+		}
+	}
+	// Without knowing whether pods are waiting, no host is put to sleep or
+	// woken for them; hosts holding the control plane never sleep
+	pending, decide := 0, m.kube != nil
+	var controlPlane map[string]string
+	if decide {
+		if pending, err = unschedulablePods(ctx, m.kube, m.pendingDelay); err != nil {
+			log.Printf("Failed to check for unschedulable pods: %v", err)
+			decide = false
+		}
+	}
+	if decide && pending == 0 {
+		if _, controlPlane, err = m.hostNodes(ctx); err != nil {
+			log.Printf("Failed to find the control-plane hosts: %v", err)
+			decide = false
+		}
+	}
+
+	now := time.Now()
+	wake := make(map[string]string)
+	var sleep []string
+	m.mu.Lock()
+	busy := false
+	for i := range m.hosts {
+		h := &m.hosts[i]
+		st := m.status[h.Name]
+		if h.sleepAt != nil {
+			if !now.Before(*st.NextSleep) {
+				next := h.sleepAt.Next(now)
+				st.NextSleep, st.SleepWindow = &next, true
+			}
+			if !now.Before(*st.NextWake) {
+				next := h.wakeAt.Next(now)
+				st.NextWake, st.SleepWindow, st.KeepAwake = &next, false, false
+				if st.Phase == PowerAsleep {
+					wake[h.Name] = "sleep window ended"
+				}
+			}
+		}
+
+		// Hosts switched on or off by hand
+		if !st.busy {
+			if online[h.Name] && st.Phase == PowerAsleep {
+				st.setPhase(PowerOnline, "powered on outside proxmox-api")
+			} else if !online[h.Name] && st.Phase == PowerOnline {
+				st.setPhase(PowerAsleep, "powered off outside proxmox-api")
+			}
+		}
+		busy = busy || st.busy
+	}
+
+	if decide && pending > 0 && !busy && len(wake) == 0 {
+		for _, h := range m.hosts {
+			if m.status[h.Name].Phase == PowerAsleep {
+				wake[h.Name] = fmt.Sprintf("%d pods unschedulable", pending)
+				break
+			}
+		}
+	}
+	if decide && pending == 0 && !busy {
+		for _, h := range m.hosts {
+			st := m.status[h.Name]
+			if st.SleepWindow && !st.KeepAwake && st.Phase == PowerOnline && cpu[h.Name] < h.IdleCPU && controlPlane[h.Name] == "" {
+				sleep = append(sleep, h.Name)
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for name, reason := range wake {
+		if err := m.Wake(name, reason); err != nil {
+			log.Printf("Skipping wake of host %s: %v", name, err)
+		}
+	}
+	for _, name := range sleep {
+		if err := m.Sleep(name, "idle in sleep window"); err != nil {
+			log.Printf("Skipping sleep of host %s: %v", name, err)
+		}
+	}
+}
+
+// writeMetrics appends the host power gauges to a /metrics response
+func (m *PowerManager) writeMetrics(b *strings.Builder, gauge func(name, help string)) {
+	hosts := m.List()
+	gauge("proxmox_power_host_asleep", "Whether the power-managed host is shut down")
+	for _, h := range hosts {
+		fmt.Fprintf(b, "proxmox_power_host_asleep{node=%q} %d\n", h.Name, boolMetric(h.Phase == PowerAsleep))
+	}
+}
+
+// handleHostPower serves GET /power
+func (s *Server) handleHostPower(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, s.power.List())
+}
+
+// handleHostPowerAction serves POST /power/{host}/{sleep|wake}
+func (s *Server) handleHostPowerAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/power/"), "/"), "/")
+	if len(parts) != 2 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	switch parts[1] {
+	case "sleep":
+		err = s.power.Sleep(parts[0], "requested through the API")
+	case "wake":
+		err = s.power.Wake(parts[0], "requested through the API")
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errPowerHostNotFound) {
+		http.Error(w, "Host not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Host %s: %s started", parts[0], parts[1])
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testPowerCluster has worker k8s-1 on pve2, control-plane k8s-cp on pve3,
+// and an empty pve4; every host is online and idle
+func testPowerCluster(t *testing.T) (*ProxmoxClient, *fake.Clientset) {
+	pve := newTestProxmox(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/cluster/resources":
+			writeData(w, []ClusterResource{
+				{Type: "node", Node: "pve", Status: "online"},
+				{Type: "node", Node: "pve2", Status: "online", CPU: 0.01},
+				{Type: "node", Node: "pve3", Status: "online", CPU: 0.01},
+				{Type: "node", Node: "pve4", Status: "online", CPU: 0.01},
+				{Type: "qemu", Node: "pve2", Name: "k8s-1", VMID: 101, Status: "running"},
+				{Type: "qemu", Node: "pve3", Name: "k8s-cp", VMID: 100, Status: "running"},
+			})
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/status"):
+			writeData(w, nil)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	kube := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "k8s-1"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "k8s-cp", Labels: map[string]string{controlPlaneLabel: "true"}}},
+	)
+	return pve, kube
+}
+
+func testPowerManager(pve *ProxmoxClient, kube *fake.Clientset, hosts ...string) *PowerManager {
+	var power []PowerHost
+	for _, name := range hosts {
+		power = append(power, PowerHost{Name: name, Wake: WakeWoL, IdleCPU: 0.15})
+	}
+	m := NewPowerManager(pve, kube, power, "k8s-api", time.Minute, time.Second)
+	for _, st := range m.status {
+		st.SleepWindow = true
+	}
+	return m
+}
+
+// waitIdle waits for the host's power change to finish
+func waitIdle(t *testing.T, m *PowerManager, name string) HostPower {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, h := range m.List() {
+			if h.Name == name && !h.busy {
+				return h
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("host %s still busy", name)
+	return HostPower{}
+}
+
+func phase(m *PowerManager, name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status[name].Phase
+}
+
+func TestStepSkipsDecisionsWithoutPendingPods(t *testing.T) {
+	pve, kube := testPowerCluster(t)
+	kube.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("apiserver unavailable")
+	})
+	m := testPowerManager(pve, kube, "pve4")
+
+	m.step(context.Background())
+	if got := phase(m, "pve4"); got != PowerOnline {
+		t.Fatalf("phase = %s, want the idle host left online", got)
+	}
+}
+
+func TestStepKeepsControlPlaneHostsAwake(t *testing.T) {
+	defer func(timeout time.Duration) { hostTransitionTimeout = timeout }(hostTransitionTimeout)
+	hostTransitionTimeout = 50 * time.Millisecond
+	pve, kube := testPowerCluster(t)
+	m := testPowerManager(pve, kube, "pve3", "pve4")
+
+	m.step(context.Background())
+	if got := phase(m, "pve3"); got != PowerOnline {
+		t.Fatalf("control-plane host phase = %s, want online", got)
+	}
+	if got := phase(m, "pve4"); got != PowerDraining {
+		t.Fatalf("idle host phase = %s, want draining", got)
+	}
+	waitIdle(t, m, "pve4")
+}
+
+func TestSleepRefusesControlPlaneHost(t *testing.T) {
+	pve, kube := testPowerCluster(t)
+	m := testPowerManager(pve, kube, "pve3")
+
+	if err := m.Sleep("pve3", "test"); err != nil {
+		t.Fatal(err)
+	}
+	h := waitIdle(t, m, "pve3")
+	if h.Phase != PowerOnline || !strings.Contains(h.Error, "k8s-cp runs the control plane") {
+		t.Fatalf("host = %s %q, want it kept online", h.Phase, h.Error)
+	}
+}
+
+func TestSleepUncordonsWhenHostStaysUp(t *testing.T) {
+	defer func(timeout time.Duration) { hostTransitionTimeout = timeout }(hostTransitionTimeout)
+	hostTransitionTimeout = 50 * time.Millisecond
+	pve, kube := testPowerCluster(t)
+	m := testPowerManager(pve, kube, "pve2")
+
+	if err := m.Sleep("pve2", "test"); err != nil {
+		t.Fatal(err)
+	}
+	h := waitIdle(t, m, "pve2")
+	if h.Phase != PowerOnline || !strings.HasPrefix(h.Error, "shutdown:") {
+		t.Fatalf("host = %s %q, want a failed shutdown", h.Phase, h.Error)
+	}
+	node, err := kube.CoreV1().Nodes().Get(context.Background(), "k8s-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, cordoned := node.Annotations[powerCordonAnnotation]; node.Spec.Unschedulable || cordoned {
+		t.Fatalf("k8s-1 left cordoned: %+v %v", node.Spec, node.Annotations)
+	}
+}
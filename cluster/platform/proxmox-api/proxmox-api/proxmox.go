@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ProxmoxClient is a minimal client for the Proxmox VE REST API using an API token
+type ProxmoxClient struct {
+	baseURL     string
+	tokenID     string
+	tokenSecret string
+	node        string
+	http        *http.Client
+}
+
+// VMStatus is the subset of /qemu/{vmid}/status/current we surface
+type VMStatus struct {
+	VMID   int    `json:"vmid"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Tags   string `json:"tags"`
+	// Template is 1 for templates
+	Template int     `json:"template"`
+	CPUs     float64 `json:"cpus"`
+	MaxMem   int64   `json:"maxmem"`
+	Uptime   int64   `json:"uptime"`
+	// Node is the PVE node running the VM, set by ListClusterVMs
+	Node string `json:"node,omitempty"`
+}
+
+func NewProxmoxClient(baseURL, tokenID, tokenSecret, node string, insecure bool) *ProxmoxClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		// Proxmox ships with a self-signed certificate
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &ProxmoxClient{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		tokenID:     tokenID,
+		tokenSecret: tokenSecret,
+		node:        node,
+		http:        &http.Client{Timeout: 60 * time.Second, Transport: transport},
+	}
+}
+
+// ForNode returns a client for the same cluster that addresses VMs on node
+func (p *ProxmoxClient) ForNode(node string) *ProxmoxClient {
+	c := *p
+	c.node = node
+	return &c
+}
+
+// call performs an API request with form-encoded params and decodes the "data" field into out
+func (p *ProxmoxClient) call(ctx context.Context, method, path string, params url.Values, out interface{}) error {
+	endpoint := p.baseURL + path
+	var body io.Reader
+	if params != nil {
+		if method == http.MethodGet || method == http.MethodDelete {
+			endpoint += "?" + params.Encode()
+		} else {
+			body = strings.NewReader(params.Encode())
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("PVEAPIToken=%s=%s", p.tokenID, p.tokenSecret))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("proxmox %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("proxmox %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	envelope := struct {
+		Data interface{} `json:"data"`
+	}{Data: out}
+	return json.Unmarshal(data, &envelope)
+}
+
+// Ping checks that the API answers with the configured token
+func (p *ProxmoxClient) Ping(ctx context.Context) error {
+	return p.call(ctx, http.MethodGet, "/version", nil, nil)
+}
+
+func (p *ProxmoxClient) qemuPath(vmid int, suffix string) string {
+	return fmt.Sprintf("/nodes/%s/qemu/%d%s", p.node, vmid, suffix)
+}
+
+// NextID asks the cluster for a free VM ID
+func (p *ProxmoxClient) NextID(ctx context.Context) (int, error) {
+	var id json.Number
+	if err := p.call(ctx, http.MethodGet, "/cluster/nextid", nil, &id); err != nil {
+		return 0, err
+	}
+	n, err := id.Int64()
+	return int(n), err
+}
+
+// Clone performs a full clone of template into newID and waits for the task
+func (p *ProxmoxClient) Clone(ctx context.Context, template, newID int, name, storage string) error {
+	params := url.Values{
+		"newid": {fmt.Sprint(newID)},
+		"name":  {name},
+		"full":  {"1"},
+	}
+	if storage != "" {
+		params.Set("storage", storage)
+	}
+
+	var upid string
+	if err := p.call(ctx, http.MethodPost, p.qemuPath(template, "/clone"), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// Configure updates VM config (cores, memory, cloud-init settings, tags)
+func (p *ProxmoxClient) Configure(ctx context.Context, vmid int, params url.Values) error {
+	var upid string
+	if err := p.call(ctx, http.MethodPost, p.qemuPath(vmid, "/config"), params, &upid); err != nil {
+		return err
+	}
+	if upid == "" {
+		return nil
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// ResizeDisk grows disk to the given size in GiB
+func (p *ProxmoxClient) ResizeDisk(ctx context.Context, vmid int, disk string, sizeGB int) error {
+	params := url.Values{"disk": {disk}, "size": {fmt.Sprintf("%dG", sizeGB)}}
+	var upid string
+	if err := p.call(ctx, http.MethodPut, p.qemuPath(vmid, "/resize"), params, &upid); err != nil {
+		return err
+	}
+	if upid == "" {
+		return nil
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// Start, Shutdown and Stop change the VM power state and wait for the task
+func (p *ProxmoxClient) Start(ctx context.Context, vmid int) error {
+	return p.statusTask(ctx, vmid, "start", nil)
+}
+
+func (p *ProxmoxClient) Shutdown(ctx context.Context, vmid int) error {
+	return p.statusTask(ctx, vmid, "shutdown", url.Values{"timeout": {"120"}, "forceStop": {"1"}})
+}
+
+func (p *ProxmoxClient) Stop(ctx context.Context, vmid int) error {
+	return p.statusTask(ctx, vmid, "stop", nil)
+}
+
+func (p *ProxmoxClient) statusTask(ctx context.Context, vmid int, action string, params url.Values) error {
+	var upid string
+	if err := p.call(ctx, http.MethodPost, p.qemuPath(vmid, "/status/"+action), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// Destroy removes the VM and its disks
+func (p *ProxmoxClient) Destroy(ctx context.Context, vmid int) error {
+	var upid string
+	params := url.Values{"purge": {"1"}, "destroy-unreferenced-disks": {"1"}}
+	if err := p.call(ctx, http.MethodDelete, p.qemuPath(vmid, ""), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// Status returns the current state of a VM
+func (p *ProxmoxClient) Status(ctx context.Context, vmid int) (*VMStatus, error) {
+	var status VMStatus
+	if err := p.call(ctx, http.MethodGet, p.qemuPath(vmid, "/status/current"), nil, &status); err != nil {
+		return nil, err
+	}
+	status.VMID = vmid
+	return &status, nil
+}
+
+// VMConfig is the subset of /qemu/{vmid}/config we read
+type VMConfig struct {
+	// IPConfig0 is the cloud-init network config, e.g. ip=192.168.68.60/24,gw=192.168.68.1
+	IPConfig0 string `json:"ipconfig0"`
+}
+
+// Config returns a VM's current configuration
+func (p *ProxmoxClient) Config(ctx context.Context, vmid int) (*VMConfig, error) {
+	var config VMConfig
+	if err := p.call(ctx, http.MethodGet, p.qemuPath(vmid, "/config"), nil, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ListVMs returns all VMs on the configured node
+func (p *ProxmoxClient) ListVMs(ctx context.Context) ([]VMStatus, error) {
+	var vms []VMStatus
+	if err := p.call(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/qemu", p.node), nil, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// ListClusterVMs returns the VMs on every node of the cluster, with Node set
+func (p *ProxmoxClient) ListClusterVMs(ctx context.Context) ([]VMStatus, error) {
+	resources, err := p.ClusterResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var vms []VMStatus
+	for _, r := range resources {
+		if r.Type != "qemu" {
+			continue
+		}
+		vms = append(vms, VMStatus{
+			VMID:     r.VMID,
+			Name:     r.Name,
+			Status:   r.Status,
+			Tags:     r.Tags,
+			Template: r.Template,
+			CPUs:     r.MaxCPU,
+			MaxMem:   r.MaxMem,
+			Uptime:   r.Uptime,
+			Node:     r.Node,
+		})
+	}
+	return vms, nil
+}
+
+// ClusterResource is an entry of /cluster/resources: a node, VM, container,
+// or storage depending on Type
+type ClusterResource struct {
+	Type     string  `json:"type"`
+	ID       string  `json:"id"`
+	Node     string  `json:"node"`
+	Status   string  `json:"status"`
+	Name     string  `json:"name"`
+	VMID     int     `json:"vmid"`
+	Template int     `json:"template"`
+	Tags     string  `json:"tags"`
+	Storage  string  `json:"storage"`
+	Plugin   string  `json:"plugintype"`
+	Shared   int     `json:"shared"`
+	CPU      float64 `json:"cpu"`
+	MaxCPU   float64 `json:"maxcpu"`
+	Mem      int64   `json:"mem"`
+	MaxMem   int64   `json:"maxmem"`
+	Disk     int64   `json:"disk"`
+	MaxDisk  int64   `json:"maxdisk"`
+	Uptime   int64   `json:"uptime"`
+	NetIn    int64   `json:"netin"`
+	NetOut   int64   `json:"netout"`
+}
+
+// ClusterResources returns every node, guest, and storage in the cluster
+func (p *ProxmoxClient) ClusterResources(ctx context.Context) ([]ClusterResource, error) {
+	var resources []ClusterResource
+	if err := p.call(ctx, http.MethodGet, "/cluster/resources", nil, &resources); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// Migrate moves a stopped VM and its local disks to the target node and
+// waits for the task
+func (p *ProxmoxClient) Migrate(ctx context.Context, vmid int, target string) error {
+	params := url.Values{"target": {target}, "with-local-disks": {"1"}}
+	var upid string
+	if err := p.call(ctx, http.MethodPost, p.qemuPath(vmid, "/migrate"), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// DeviceMapping is an entry of /cluster/mapping/{pci,usb}: a cluster-wide
+// name for a passthrough device, with one map entry per node device, e.g.
+// node=pve2,path=0000:01:00.0,id=10de:2204
+type DeviceMapping struct {
+	ID  string   `json:"id"`
+	Map []string `json:"map"`
+}
+
+// DeviceMappings returns the cluster's PCI or USB resource mappings
+func (p *ProxmoxClient) DeviceMappings(ctx context.Context, kind string) ([]DeviceMapping, error) {
+	var mappings []DeviceMapping
+	if err := p.call(ctx, http.MethodGet, "/cluster/mapping/"+kind, nil, &mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// DeviceConfig returns a VM's hostpciN and usbN config entries
+func (p *ProxmoxClient) DeviceConfig(ctx context.Context, vmid int) (map[string]string, error) {
+	var config map[string]interface{}
+	if err := p.call(ctx, http.MethodGet, p.qemuPath(vmid, "/config"), nil, &config); err != nil {
+		return nil, err
+	}
+	devices := make(map[string]string)
+	for key, value := range config {
+		if s, ok := value.(string); ok && (strings.HasPrefix(key, "hostpci") || strings.HasPrefix(key, "usb")) {
+			devices[key] = s
+		}
+	}
+	return devices, nil
+}
+
+// ShutdownHost powers off a PVE node, which first shuts down its guests
+func (p *ProxmoxClient) ShutdownHost(ctx context.Context, host string) error {
+	path := fmt.Sprintf("/nodes/%s/status", url.PathEscape(host))
+	return p.call(ctx, http.MethodPost, path, url.Values{"command": {"shutdown"}}, nil)
+}
+
+// WakeOnLAN has the node serving the API send a magic packet to host's MAC,
+// set with pvenode config set --wakeonlan
+func (p *ProxmoxClient) WakeOnLAN(ctx context.Context, host string) error {
+	path := fmt.Sprintf("/nodes/%s/wakeonlan", url.PathEscape(host))
+	return p.call(ctx, http.MethodPost, path, url.Values{}, nil)
+}
+
+// CreateVM creates a VM with the given config and waits for the task
+func (p *ProxmoxClient) CreateVM(ctx context.Context, vmid int, params url.Values) error {
+	params.Set("vmid", fmt.Sprint(vmid))
+	var upid string
+	if err := p.call(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/qemu", p.node), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// ConvertToTemplate turns a stopped VM into a template
+func (p *ProxmoxClient) ConvertToTemplate(ctx context.Context, vmid int) error {
+	var upid string
+	if err := p.call(ctx, http.MethodPost, p.qemuPath(vmid, "/template"), url.Values{}, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// DownloadURL has the node download imageURL into storage as an ISO-content
+// file (cloud images are accepted with an .img name) and waits for it
+func (p *ProxmoxClient) DownloadURL(ctx context.Context, storage, imageURL, filename string) error {
+	params := url.Values{
+		"content":  {"iso"},
+		"url":      {imageURL},
+		"filename": {filename},
+	}
+	var upid string
+	if err := p.call(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/storage/%s/download-url", p.node, storage), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// StorageConfig is the subset of /storage/{storage} we read
+type StorageConfig struct {
+	Type string `json:"type"`
+	// Path is the mount point of directory storages, e.g. /var/lib/vz
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// Storage returns a storage's cluster-wide configuration
+func (p *ProxmoxClient) Storage(ctx context.Context, storage string) (*StorageConfig, error) {
+	var config StorageConfig
+	if err := p.call(ctx, http.MethodGet, "/storage/"+url.PathEscape(storage), nil, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// DeleteVolume removes a volume such as local:iso/image.img from storage
+func (p *ProxmoxClient) DeleteVolume(ctx context.Context, storage, volid string) error {
+	var upid string
+	path := fmt.Sprintf("/nodes/%s/storage/%s/content/%s", p.node, storage, url.PathEscape(volid))
+	if err := p.call(ctx, http.MethodDelete, path, nil, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// Snapshot is an entry of /qemu/{vmid}/snapshot
+type Snapshot struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parent      string `json:"parent"`
+	SnapTime    int64  `json:"snaptime"`
+	VMState     int    `json:"vmstate"`
+}
+
+// CreateSnapshot takes a snapshot of the VM's disks and waits for it
+func (p *ProxmoxClient) CreateSnapshot(ctx context.Context, vmid int, name, description string) error {
+	params := url.Values{"snapname": {name}, "description": {description}}
+	var upid string
+	if err := p.call(ctx, http.MethodPost, p.qemuPath(vmid, "/snapshot"), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// ListSnapshots returns the VM's snapshots, leaving out the "current" pseudo-entry
+func (p *ProxmoxClient) ListSnapshots(ctx context.Context, vmid int) ([]Snapshot, error) {
+	var all []Snapshot
+	if err := p.call(ctx, http.MethodGet, p.qemuPath(vmid, "/snapshot"), nil, &all); err != nil {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, s := range all {
+		if s.Name != "current" {
+			snapshots = append(snapshots, s)
+		}
+	}
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes a snapshot and waits for the task
+func (p *ProxmoxClient) DeleteSnapshot(ctx context.Context, vmid int, name string) error {
+	var upid string
+	if err := p.call(ctx, http.MethodDelete, p.qemuPath(vmid, "/snapshot/"+url.PathEscape(name)), nil, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// RollbackSnapshot reverts the VM to a snapshot and waits for the task
+func (p *ProxmoxClient) RollbackSnapshot(ctx context.Context, vmid int, name string) error {
+	var upid string
+	path := p.qemuPath(vmid, "/snapshot/"+url.PathEscape(name)+"/rollback")
+	if err := p.call(ctx, http.MethodPost, path, url.Values{}, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// BackupVolume is a vzdump archive in storage
+type BackupVolume struct {
+	VolID string `json:"volid"`
+	VMID  int    `json:"vmid"`
+	Size  int64  `json:"size"`
+	CTime int64  `json:"ctime"`
+	Notes string `json:"notes"`
+	// Protected is 1 for archives excluded from pruning
+	Protected int `json:"protected"`
+}
+
+// Vzdump backs up a VM to storage and waits for the task. params carry
+// mode, compress, notes-template, and similar vzdump options.
+func (p *ProxmoxClient) Vzdump(ctx context.Context, vmid int, storage string, params url.Values) error {
+	params.Set("vmid", fmt.Sprint(vmid))
+	params.Set("storage", storage)
+	var upid string
+	if err := p.call(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/vzdump", p.node), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// ListBackups returns the VM's vzdump archives in storage
+func (p *ProxmoxClient) ListBackups(ctx context.Context, storage string, vmid int) ([]BackupVolume, error) {
+	params := url.Values{"content": {"backup"}, "vmid": {fmt.Sprint(vmid)}}
+	var backups []BackupVolume
+	path := fmt.Sprintf("/nodes/%s/storage/%s/content", p.node, storage)
+	if err := p.call(ctx, http.MethodGet, path, params, &backups); err != nil {
+		return nil, err
+	}
+	return backups, nil
+}
+
+// RestoreBackup recreates the VM from a vzdump archive, replacing its
+// current disks and config. The VM must be stopped.
+func (p *ProxmoxClient) RestoreBackup(ctx context.Context, vmid int, volid, storage string) error {
+	params := url.Values{
+		"vmid":    {fmt.Sprint(vmid)},
+		"archive": {volid},
+		"force":   {"1"},
+	}
+	if storage != "" {
+		params.Set("storage", storage)
+	}
+	var upid string
+	if err := p.call(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/qemu", p.node), params, &upid); err != nil {
+		return err
+	}
+	return p.WaitTask(ctx, upid)
+}
+
+// WaitTask polls a task UPID until it stops, returning an error if it did not exit OK
+func (p *ProxmoxClient) WaitTask(ctx context.Context, upid string) error {
+	if upid == "" {
+		return nil
+	}
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", p.node, url.PathEscape(upid))
+
+	for {
+		var task struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		if err := p.call(ctx, http.MethodGet, path, nil, &task); err != nil {
+			return err
+		}
+		if task.Status == "stopped" {
+			if task.ExitStatus != "OK" {
+				return fmt.Errorf("task %s failed: %s", upid, task.ExitStatus)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// AgentPing reports whether the QEMU guest agent in the VM is responding
+func (p *ProxmoxClient) AgentPing(ctx context.Context, vmid int) bool {
+	return p.call(ctx, http.MethodPost, p.qemuPath(vmid, "/agent/ping"), url.Values{}, nil) == nil
+}
+
+// AgentExec runs a command through the guest agent and waits for it to exit
+func (p *ProxmoxClient) AgentExec(ctx context.Context, vmid int, command []string) (string, error) {
+	params := url.Values{}
+	for _, arg := range command {
+		params.Add("command", arg)
+	}
+
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := p.call(ctx, http.MethodPost, p.qemuPath(vmid, "/agent/exec"), params, &started); err != nil {
+		return "", err
+	}
+
+	for {
+		var status struct {
+			Exited   int    `json:"exited"`
+			ExitCode int    `json:"exitcode"`
+			OutData  string `json:"out-data"`
+			ErrData  string `json:"err-data"`
+		}
+		params := url.Values{"pid": {fmt.Sprint(started.PID)}}
+		if err := p.call(ctx, http.MethodGet, p.qemuPath(vmid, "/agent/exec-status"), params, &status); err != nil {
+			return "", err
+		}
+		if status.Exited == 1 {
+			if status.ExitCode != 0 {
+				return status.OutData, fmt.Errorf("command exited %d: %s", status.ExitCode, strings.TrimSpace(status.ErrData))
+			}
+			return status.OutData, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
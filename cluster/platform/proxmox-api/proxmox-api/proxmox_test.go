@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestProxmox serves the Proxmox API from handler
+func newTestProxmox(t *testing.T, handler http.HandlerFunc) *ProxmoxClient {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return NewProxmoxClient(srv.URL, "root@pam!test", "s3cret", "pve", false)
+}
+
+// writeData writes v in the API's {"data": ...} envelope
+func writeData(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": v})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/homelab/internal/config"
+)
+
+// Config is read at startup: defaults, then the -settings YAML file
+// (SETTINGS_FILE), then the environment, then flags
+type Config struct {
+	Port string `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+
+	ProxmoxURL   string   `json:"proxmoxURL" env:"PROXMOX_API_URL" flag:"proxmox-url" usage:"Proxmox API, e.g. https://192.168.68.2:8006/api2/json"`
+	TokenID      string   `json:"tokenID" env:"PROXMOX_TOKEN_ID" flag:"token-id" usage:"Proxmox API token ID, e.g. root@pam!k8s"`
+	TokenSecret  string   `json:"-" env:"PROXMOX_TOKEN_SECRET"`
+	Node         string   `json:"node" env:"PROXMOX_NODE" flag:"node" usage:"Proxmox node to create VMs on"`
+	Insecure     bool     `json:"insecure" env:"PROXMOX_INSECURE" flag:"insecure" usage:"skip TLS verification of the Proxmox API"`
+	TemplateID   int      `json:"templateID" env:"TEMPLATE_ID" flag:"template-id" usage:"template VM to clone"`
+	Storage      string   `json:"storage" env:"STORAGE" flag:"storage" usage:"target storage for full clones"`
+	Gateway      string   `json:"gateway" env:"NETWORK_GATEWAY" flag:"gateway" usage:"gateway for static IPs"`
+	DNSServers   []string `json:"dnsServers" env:"DNS_SERVERS" flag:"dns-servers" usage:"nameservers, comma separated"`
+	VMUser       string   `json:"vmUser" env:"VM_USER" flag:"vm-user" usage:"cloud-init user"`
+	SSHPublicKey string   `json:"sshPublicKey" env:"SSH_PUBLIC_KEY" flag:"ssh-public-key"`
+
+	// k3s join settings; joining is disabled unless URL and token are set
+	K3sURL     string `json:"k3sURL" env:"K3S_URL" flag:"k3s-url"`
+	K3sToken   string `json:"-" env:"K3S_TOKEN"`
+	K3sChannel string `json:"k3sChannel" env:"K3S_CHANNEL" flag:"k3s-channel"`
+
+	// Bearer token required on every API call except health and metrics
+	APIToken string `json:"-" env:"API_TOKEN"`
+	// AllowUnauthenticated opens the API when no credentials are set;
+	// otherwise it refuses every request
+	AllowUnauthenticated bool `json:"allowUnauthenticated" env:"ALLOW_UNAUTHENTICATED" flag:"allow-unauthenticated"`
+
+	PrometheusURL    string `json:"prometheusURL" env:"PROMETHEUS_URL" flag:"prometheus-url" usage:"Prometheus to read node temperatures from"`
+	TemperatureQuery string `json:"temperatureQuery" env:"TEMPERATURE_QUERY" flag:"temperature-query" usage:"PromQL for a node's temperature"`
+
+	// ClustersDir keeps cluster specs in memory when empty
+	ClustersDir           string        `json:"clustersDir" env:"CLUSTERS_DIR" flag:"clusters-dir"`
+	ClusterResyncInterval time.Duration `json:"clusterResyncInterval" env:"CLUSTER_RESYNC_INTERVAL" flag:"cluster-resync-interval"`
+
+	Templates TemplateSettings `json:"templates"`
+	Backups   BackupSettings   `json:"backups"`
+	IPAM      IPAMSettings     `json:"ipam"`
+	UserData  UserDataSettings `json:"userData"`
+	Snippets  SnippetSettings  `json:"snippets"`
+	Power     PowerSettings    `json:"power"`
+}
+
+// JoinEnabled reports whether new nodes can be joined to k3s
+func (c *Config) JoinEnabled() bool {
+	return c.K3sURL != "" && c.K3sToken != ""
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:                  "8080",
+		Node:                  "pve",
+		Insecure:              true,
+		TemplateID:            9000,
+		Storage:               "local-lvm",
+		Gateway:               "192.168.68.1",
+		DNSServers:            []string{"192.168.68.1", "8.8.8.8"},
+		VMUser:                "ubuntu",
+		K3sChannel:            "stable",
+		TemperatureQuery:      defaultTemperatureQuery,
+		ClusterResyncInterval: 5 * time.Minute,
+		Templates: TemplateSettings{
+			Name:            "ubuntu-noble",
+			ImageURL:        "https://cloud-images.ubuntu.com/noble/current/noble-server-cloudimg-amd64.img",
+			Snippet:         "local:snippets/k8s-template.yaml",
+			RefreshInterval: "168h",
+		},
+		Backups: BackupSettings{
+			Keep:    7,
+			Type:    BackupVzdump,
+			Tag:     nodeTag,
+			Storage: "local",
+		},
+		Snippets: SnippetSettings{
+			Storage: "local",
+			SSHUser: "root",
+		},
+		Power: PowerSettings{
+			PendingWakeDelay: time.Minute,
+			DrainTimeout:     10 * time.Minute,
+		},
+	}
+}
+
+// loadConfig layers the file, environment, and flags over the defaults
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+	if err := config.Load(c, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate implements config.Validator
+func (c *Config) Validate() error {
+	if c.ProxmoxURL == "" || c.TokenID == "" || c.TokenSecret == "" {
+		return fmt.Errorf("PROXMOX_API_URL, PROXMOX_TOKEN_ID and PROXMOX_TOKEN_SECRET are required")
+	}
+	if c.ClusterResyncInterval <= 0 {
+		return fmt.Errorf("invalid CLUSTER_RESYNC_INTERVAL: must be positive")
+	}
+	if c.Power.PendingWakeDelay <= 0 {
+		return fmt.Errorf("invalid PENDING_WAKE_DELAY: must be positive")
+	}
+	if c.Power.DrainTimeout <= 0 {
+		return fmt.Errorf("invalid DRAIN_TIMEOUT: must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/homelab/internal/config"
+)
+
+func loadTestConfig(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	t.Setenv("PROXMOX_API_URL", "https://pve.test:8006/api2/json")
+	t.Setenv("PROXMOX_TOKEN_ID", "root@pam!k8s")
+	t.Setenv("PROXMOX_TOKEN_SECRET", "s3cret")
+	c := defaultConfig()
+	return c, config.Load(c, config.Options{Args: append([]string{}, args...)})
+}
+
+func TestConfigFeedsLoaders(t *testing.T) {
+	t.Setenv("BACKUP_SCHEDULE", "0 3 * * *")
+	t.Setenv("BACKUP_KEEP", "3")
+	t.Setenv("IPAM_SUBNET", "192.168.68.0/24")
+	t.Setenv("IPAM_RESERVED", "192.168.68.1, 192.168.68.2-192.168.68.9")
+	c, err := loadTestConfig(t, "-dns-servers=1.1.1.1,9.9.9.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.1.1.1", "9.9.9.9"}; !reflect.DeepEqual(c.DNSServers, want) {
+		t.Fatalf("DNSServers = %q, want %q", c.DNSServers, want)
+	}
+
+	policies, err := loadBackupPolicies(c.Backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].Keep != 3 || policies[0].Tag != nodeTag || policies[0].Storage != "local" {
+		t.Fatalf("policies = %+v", policies)
+	}
+
+	subnets, err := loadSubnets(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnets) != 1 || len(subnets[0].Reserved) != 2 {
+		t.Fatalf("subnets = %+v", subnets)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if _, err := loadTestConfig(t, "-drain-timeout=0s"); err == nil || !strings.Contains(err.Error(), "DRAIN_TIMEOUT") {
+		t.Fatalf("err = %v, want a DRAIN_TIMEOUT error", err)
+	}
+	t.Setenv("PROXMOX_TOKEN_SECRET", "")
+	c := defaultConfig()
+	if err := config.Load(c, config.Options{Args: []string{}}); err == nil {
+		t.Fatal("loaded without Proxmox credentials")
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+// templateTag marks golden templates built by this service
+const templateTag = "k8s-template"
+
+// templateTimeLayout suffixes template VM names with their build time
+const templateTimeLayout = "20060102-1504"
+
+// TemplateSpec describes a golden template: where its cloud image comes from
+// and how it is customized
+type TemplateSpec struct {
+	Name     string `json:"name"`
+	ImageURL string `json:"imageURL"`
+	// Snippet is the cloud-init vendor snippet run on first boot, e.g.
+	// local:snippets/k8s-template.yaml; it must power the VM off when done
+	Snippet string `json:"snippet"`
+	Disk    int    `json:"disk,omitempty"` // GiB
+	Cores   int    `json:"cores,omitempty"`
+	Memory  int    `json:"memory,omitempty"` // MiB
+	Bridge  string `json:"bridge,omitempty"`
+	// Storage holds the template disk; ImageStorage receives the download
+	Storage      string `json:"storage,omitempty"`
+	ImageStorage string `json:"imageStorage,omitempty"`
+	// RefreshInterval rebuilds the template once it is this old; empty or 0 disables
+	RefreshInterval string `json:"refreshInterval,omitempty"`
+	// Keep is how many built templates to retain, newest first
+	Keep int `json:"keep,omitempty"`
+
+	refresh time.Duration
+}
+
+// TemplateStatus is the build state reported by the API
+type TemplateStatus struct {
+	Name      string     `json:"name"`
+	Phase     string     `json:"phase"`
+	Step      string     `json:"step,omitempty"`
+	CurrentID int        `json:"currentId,omitempty"`
+	BuiltAt   *time.Time `json:"builtAt,omitempty"`
+	NextBuild *time.Time `json:"nextBuild,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Template phases
+const (
+	TemplateIdle     = "Idle"
+	TemplateBuilding = "Building"
+	TemplateFailed   = "Failed"
+)
+
+// builtTemplate is a template VM found in Proxmox
+type builtTemplate struct {
+	ID      int
+	BuiltAt time.Time
+}
+
+// TemplateManager builds golden templates and tracks which one new nodes clone
+type TemplateManager struct {
+	pve    *ProxmoxClient
+	config *Config
+	specs  []TemplateSpec
+
+	mu     sync.Mutex
+	status map[string]*TemplateStatus
+}
+
+// TemplateSettings configure golden templates; File replaces the single
+// spec built from the rest
+type TemplateSettings struct {
+	File            string `json:"file" env:"TEMPLATES_FILE" flag:"templates-file" usage:"JSON list of templates"`
+	Name            string `json:"name" env:"TEMPLATE_NAME" flag:"template-name"`
+	ImageURL        string `json:"imageURL" env:"TEMPLATE_IMAGE_URL" flag:"template-image-url" usage:"cloud image to build from"`
+	Snippet         string `json:"snippet" env:"TEMPLATE_SNIPPET" flag:"template-snippet" usage:"cloud-init vendor snippet"`
+	RefreshInterval string `json:"refreshInterval" env:"TEMPLATE_REFRESH_INTERVAL" flag:"template-refresh-interval" usage:"rebuild age; 0 disables scheduled builds"`
+}
+
+// loadTemplateSpecs reads TEMPLATES_FILE (a JSON list) or builds a single
+// spec from the TEMPLATE_* settings
+func loadTemplateSpecs(config *Config) ([]TemplateSpec, error) {
+	var specs []TemplateSpec
+	if path := config.Templates.File; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading TEMPLATES_FILE: %w", err)
+		}
+		if err := json.Unmarshal(data, &specs); err != nil {
+			return nil, fmt.Errorf("parsing TEMPLATES_FILE: %w", err)
+		}
+	} else {
+		specs = []TemplateSpec{{
+			Name:            config.Templates.Name,
+			ImageURL:        config.Templates.ImageURL,
+			Snippet:         config.Templates.Snippet,
+			RefreshInterval: config.Templates.RefreshInterval,
+		}}
+	}
+
+	for i := range specs {
+		s := &specs[i]
+		if !nodeNamePattern.MatchString(s.Name) {
+			return nil, fmt.Errorf("invalid template name %q", s.Name)
+		}
+		if s.ImageURL == "" || s.Snippet == "" {
+			return nil, fmt.Errorf("template %s needs imageURL and snippet", s.Name)
+		}
+		if s.Disk == 0 {
+			s.Disk = 20
+		}
+		if s.Cores == 0 {
+			s.Cores = 2
+		}
+		if s.Memory == 0 {
+			s.Memory = 2048
+		}
+		if s.Bridge == "" {
+			s.Bridge = "vmbr0"
+		}
+		if s.Storage == "" {
+			s.Storage = config.Storage
+		}
+		if s.ImageStorage == "" {
+			s.ImageStorage = "local"
+		}
+		if s.Keep == 0 {
+			s.Keep = 2
+		}
+		if s.RefreshInterval != "" && s.RefreshInterval != "0" {
+			d, err := time.ParseDuration(s.RefreshInterval)
+			if err != nil {
+				return nil, fmt.Errorf("template %s refreshInterval: %w", s.Name, err)
+			}
+			s.refresh = d
+		}
+	}
+	return specs, nil
+}
+
+func NewTemplateManager(pve *ProxmoxClient, config *Config, specs []TemplateSpec) *TemplateManager {
+	status := make(map[string]*TemplateStatus)
+	for _, s := range specs {
+		status[s.Name] = &TemplateStatus{Name: s.Name, Phase: TemplateIdle}
+	}
+	return &TemplateManager{pve: pve, config: config, specs: specs, status: status}
+}
+
+func (m *TemplateManager) spec(name string) *TemplateSpec {
+	for i := range m.specs {
+		if m.specs[i].Name == name {
+			return &m.specs[i]
+		}
+	}
+	return nil
+}
+
+// built returns the spec's templates in Proxmox, newest first
+func (m *TemplateManager) built(ctx context.Context, spec *TemplateSpec) ([]builtTemplate, error) {
+	vms, err := m.pve.ListVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []builtTemplate
+	prefix := spec.Name + "-"
+	for _, vm := range vms {
+		if vm.Template != 1 || !hasTag(vm.Tags, templateTag) || !strings.HasPrefix(vm.Name, prefix) {
+			continue
+		}
+		builtAt, err := time.Parse(templateTimeLayout, strings.TrimPrefix(vm.Name, prefix))
+		if err != nil {
+			continue
+		}
+		templates = append(templates, builtTemplate{ID: vm.VMID, BuiltAt: builtAt})
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].BuiltAt.After(templates[j].BuiltAt)
+	})
+	return templates, nil
+}
+
+// Current returns the VM ID new nodes clone: the newest build of the first
+// template, or TEMPLATE_ID until one has been built
+func (m *TemplateManager) Current(ctx context.Context) int {
+	if len(m.specs) == 0 {
+		return m.config.TemplateID
+	}
+	templates, err := m.built(ctx, &m.specs[0])
+	if err != nil {
+		log.Printf("Failed to list templates, using TEMPLATE_ID: %v", err)
+		return m.config.TemplateID
+	}
+	if len(templates) == 0 {
+		return m.config.TemplateID
+	}
+	return templates[0].ID
+}
+
+// List reports every template with its newest build
+func (m *TemplateManager) List(ctx context.Context) ([]TemplateStatus, error) {
+	var statuses []TemplateStatus
+	for i := range m.specs {
+		spec := &m.specs[i]
+		templates, err := m.built(ctx, spec)
+		if err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		status := *m.status[spec.Name]
+		m.mu.Unlock()
+		if len(templates) > 0 {
+			status.CurrentID = templates[0].ID
+			builtAt := templates[0].BuiltAt
+			status.BuiltAt = &builtAt
+			if spec.refresh > 0 {
+				next := builtAt.Add(spec.refresh)
+				status.NextBuild = &next
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Build starts a build of the named template in the background
+func (m *TemplateManager) Build(name string) error {
+	spec := m.spec(name)
+	if spec == nil {
+		return fmt.Errorf("unknown template %q", name)
+	}
+
+	m.mu.Lock()
+	status := m.status[name]
+	if status.Phase == TemplateBuilding {
+		m.mu.Unlock()
+		return errBuildInProgress
+	}
+	status.Phase, status.Step, status.Error = TemplateBuilding, "", ""
+	m.mu.Unlock()
+
+	go m.build(spec)
+	return nil
+}
+
+var errBuildInProgress = errors.New("build already in progress")
+
+func (m *TemplateManager) setStep(name, step string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status[name].Step = step
+}
+
+func (m *TemplateManager) finish(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status[name]
+	status.Step = ""
+	if err != nil {
+		status.Phase, status.Error = TemplateFailed, err.Error()
+		return
+	}
+	status.Phase, status.Error = TemplateIdle, ""
+}
+
+// build downloads the cloud image, boots it once with the vendor snippet to
+// install packages and updates, converts it to a template, and prunes old
+// builds
+func (m *TemplateManager) build(spec *TemplateSpec) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	builtAt := time.Now().UTC()
+	name := spec.Name + "-" + builtAt.Format(templateTimeLayout)
+	image := name + ".img"
+	id := 0
+
+	fail := func(step string, err error) {
+		log.Printf("Template %s failed at %s: %v", name, step, err)
+		m.finish(spec.Name, fmt.Errorf("%s: %v", step, err))
+		// Leave no half-built VM behind
+		if id != 0 {
+			cleanup, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			defer cancel()
+			_ = m.pve.Stop(cleanup, id)
+			if err := m.pve.Destroy(cleanup, id); err != nil {
+				log.Printf("Failed to destroy partial template %d: %v", id, err)
+			}
+		}
+	}
+
+	log.Printf("Building template %s from %s", name, spec.ImageURL)
+	m.setStep(spec.Name, "download")
+	if err := m.pve.DownloadURL(ctx, spec.ImageStorage, spec.ImageURL, image); err != nil {
+		fail("download", err)
+		return
+	}
+	volume := fmt.Sprintf("%s:iso/%s", spec.ImageStorage, image)
+	defer func() {
+		if err := m.pve.DeleteVolume(context.Background(), spec.ImageStorage, volume); err != nil {
+			log.Printf("Failed to delete %s: %v", volume, err)
+		}
+	}()
+
+	m.setStep(spec.Name, "create")
+	var err error
+	if id, err = m.pve.NextID(ctx); err != nil {
+		fail("create", err)
+		return
+	}
+	params := url.Values{
+		"name":        {name},
+		"tags":        {templateTag},
+		"description": {fmt.Sprintf("Built %s from %s by proxmox-api", builtAt.Format(time.RFC3339), spec.ImageURL)},
+		"cores":       {strconv.Itoa(spec.Cores)},
+		"memory":      {strconv.Itoa(spec.Memory)},
+		"cpu":         {"host"},
+		"agent":       {"1"},
+		"net0":        {"virtio,bridge=" + spec.Bridge},
+		"scsihw":      {"virtio-scsi-pci"},
+		"scsi0":       {fmt.Sprintf("%s:0,import-from=%s", spec.Storage, volume)},
+		"ide2":        {spec.Storage + ":cloudinit"},
+		"boot":        {"order=scsi0"},
+		"serial0":     {"socket"},
+		"vga":         {"serial0"},
+		"ciuser":      {m.config.VMUser},
+		"ipconfig0":   {"ip=dhcp"},
+		"cicustom":    {"vendor=" + spec.Snippet},
+	}
+	if len(m.config.DNSServers) > 0 {
+		params.Set("nameserver", strings.Join(m.config.DNSServers, " "))
+	}
+	if err := m.pve.CreateVM(ctx, id, params); err != nil {
+		fail("create", err)
+		return
+	}
+	if err := m.pve.ResizeDisk(ctx, id, "scsi0", spec.Disk); err != nil {
+		fail("resize", err)
+		return
+	}
+
+	// The vendor snippet upgrades packages, installs the guest agent, cleans
+	// cloud-init state, and powers off
+	m.setStep(spec.Name, "customize")
+	if err := m.pve.Start(ctx, id); err != nil {
+		fail("customize", err)
+		return
+	}
+	if err := m.waitStopped(ctx, id); err != nil {
+		fail("customize", err)
+		return
+	}
+
+	m.setStep(spec.Name, "convert")
+	// Clones get their own cloud-init config; the snippet would power them off
+	if err := m.pve.Configure(ctx, id, url.Values{"delete": {"cicustom"}}); err != nil {
+		fail("convert", err)
+		return
+	}
+	if err := m.pve.ConvertToTemplate(ctx, id); err != nil {
+		fail("convert", err)
+		return
+	}
+	log.Printf("Template %s (%d) built", name, id)
+
+	m.setStep(spec.Name, "prune")
+	m.prune(ctx, spec)
+	m.finish(spec.Name, nil)
+}
+
+// waitStopped polls until the VM has powered itself off
+func (m *TemplateManager) waitStopped(ctx context.Context, id int) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("VM never powered off: %w", ctx.Err())
+		case <-time.After(15 * time.Second):
+		}
+
+		status, err := m.pve.Status(ctx, id)
+		if err != nil {
+			return err
+		}
+		if status.Status == "stopped" {
+			return nil
+		}
+	}
+}
+
+// prune destroys builds beyond the spec's Keep count; nodes are full
+// clones, so removing their template does not affect them
+func (m *TemplateManager) prune(ctx context.Context, spec *TemplateSpec) {
+	templates, err := m.built(ctx, spec)
+	if err != nil {
+		log.Printf("Failed to list templates for pruning: %v", err)
+		return
+	}
+	for i := spec.Keep; i < len(templates); i++ {
+		if err := m.pve.Destroy(ctx, templates[i].ID); err != nil {
+			log.Printf("Failed to destroy old template %d: %v", templates[i].ID, err)
+			continue
+		}
+		log.Printf("Destroyed old template %s (%d)", spec.Name, templates[i].ID)
+	}
+}
+
+// Run rebuilds templates older than their refresh interval, checking hourly
+func (m *TemplateManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		for i := range m.specs {
+			spec := &m.specs[i]
+			if spec.refresh == 0 {
+				continue
+			}
+			templates, err := m.built(ctx, spec)
+			if err != nil {
+				log.Printf("Failed to check template %s: %v", spec.Name, err)
+				continue
+			}
+			if len(templates) > 0 && time.Since(templates[0].BuiltAt) < spec.refresh {
+				continue
+			}
+			if err := m.Build(spec.Name); err == nil {
+				log.Printf("Scheduled refresh of template %s", spec.Name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleTemplates serves GET /templates
+func (s *Server) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	templates, err := s.templates.List(r.Context())
+	if err != nil {
+		log.Printf("Failed to list templates: %v", err)
+		http.Error(w, "Failed to list templates", http.StatusBadGateway)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, templates)
+}
+
+// handleTemplate serves POST /templates/{name}/build
+func (s *Server) handleTemplate(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/templates/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "build" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := s.templates.Build(parts[0])
+	switch {
+	case err == errBuildInProgress:
+		http.Error(w, "Template build already in progress", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("Building template %s", parts[0])
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Building template %s", parts[0])
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// UserData is what user-data templates are rendered with
+type UserData struct {
+	Hostname string
+	VMID     int
+	// IP is the node's CIDR address, empty for DHCP
+	IP         string
+	Gateway    string
+	DNS        []string
+	User       string
+	SSHKeys    []string
+	Tags       []string
+	Join       bool
+	K3sURL     string
+	K3sToken   string
+	K3sChannel string
+	// RegistryCA is the PEM bundle from REGISTRY_CA_FILE
+	RegistryCA string
+	// NodeLabels are the key=value Kubernetes labels of the node's
+	// passthrough devices, for the k3s agent's --node-label
+	NodeLabels []string
+	// Vars are the request's userDataVars
+	Vars map[string]string
+}
+
+// UserDataManager renders cloud-init user-data templates per VM and stores
+// them as snippets the VMs boot with
+type UserDataManager struct {
+	templates *template.Template
+	// fallback is the template used when a request names none
+	fallback   string
+	registryCA string
+	snippets   *SnippetStore
+}
+
+// UserDataSettings configure user-data templates
+type UserDataSettings struct {
+	// Dir holds the templates; empty disables templating
+	Dir string `json:"dir" env:"USER_DATA_DIR" flag:"user-data-dir"`
+	// Template is used for nodes that name none
+	Template       string `json:"template" env:"USER_DATA_TEMPLATE" flag:"user-data-template"`
+	RegistryCAFile string `json:"registryCAFile" env:"REGISTRY_CA_FILE" flag:"registry-ca-file" usage:"PEM exposed to templates as .RegistryCA"`
+}
+
+// SnippetSettings say how rendered user-data reaches the Proxmox node
+type SnippetSettings struct {
+	Storage string `json:"storage" env:"SNIPPETS_STORAGE" flag:"snippets-storage" usage:"directory storage with the Snippets content type"`
+	// SSHHost defaults to the host of ProxmoxURL
+	SSHHost       string `json:"sshHost" env:"SNIPPETS_SSH_HOST" flag:"snippets-ssh-host"`
+	SSHUser       string `json:"sshUser" env:"SNIPPETS_SSH_USER" flag:"snippets-ssh-user"`
+	SSHKeyFile    string `json:"sshKeyFile" env:"SNIPPETS_SSH_KEY_FILE" flag:"snippets-ssh-key-file"`
+	SSHKnownHosts string `json:"sshKnownHosts" env:"SNIPPETS_SSH_KNOWN_HOSTS" flag:"snippets-ssh-known-hosts" usage:"known_hosts file; empty skips host key verification"`
+}
+
+// loadUserData parses the *.yaml templates in USER_DATA_DIR, each named
+// after its file; no USER_DATA_DIR disables templating
+func loadUserData(pve *ProxmoxClient, config *Config) (*UserDataManager, error) {
+	m := &UserDataManager{fallback: config.UserData.Template}
+	dir := config.UserData.Dir
+	if dir == "" {
+		if m.fallback != "" {
+			return nil, fmt.Errorf("USER_DATA_TEMPLATE needs USER_DATA_DIR")
+		}
+		return m, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 && m.fallback == "" {
+		return m, nil
+	}
+	m.templates = template.New("").Option("missingkey=error").Funcs(template.FuncMap{
+		"indent":  indent,
+		"nindent": func(n int, s string) string { return "\n" + indent(n, s) },
+		"join":    strings.Join,
+	})
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", p, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(p), ".yaml")
+		if _, err := m.templates.New(name).Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", p, err)
+		}
+	}
+	if m.fallback != "" && m.templates.Lookup(m.fallback) == nil {
+		return nil, fmt.Errorf("USER_DATA_TEMPLATE %q is not in %s", m.fallback, dir)
+	}
+
+	if path := config.UserData.RegistryCAFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading REGISTRY_CA_FILE: %w", err)
+		}
+		m.registryCA = string(data)
+	}
+
+	m.snippets, err = newSnippetStore(pve, config)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// indent prefixes every line of s with n spaces, for embedding multi-line
+// values such as certificates in YAML block scalars
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n"+pad)
+}
+
+// sshKeys splits an authorized_keys style list into keys
+func sshKeys(s string) []string {
+	var keys []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+// Templates returns the names of the loaded templates
+func (m *UserDataManager) Templates() []string {
+	names := []string{}
+	if m.templates == nil {
+		return names
+	}
+	for _, t := range m.templates.Templates() {
+		if t.Name() != "" {
+			names = append(names, t.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve returns the template a request uses, "" for none
+func (m *UserDataManager) resolve(name string) (string, error) {
+	if name == "" {
+		return m.fallback, nil
+	}
+	if m.templates == nil || m.templates.Lookup(name) == nil {
+		return "", fmt.Errorf("unknown user-data template %q", name)
+	}
+	return name, nil
+}
+
+// Render executes the named template
+func (m *UserDataManager) Render(name string, data *UserData) ([]byte, error) {
+	var b bytes.Buffer
+	if err := m.templates.ExecuteTemplate(&b, name, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Store renders the template for a VM and writes it as the VM's snippet,
+// returning the volume ID for cicustom
+func (m *UserDataManager) Store(ctx context.Context, name string, data *UserData) (string, error) {
+	rendered, err := m.Render(name, data)
+	if err != nil {
+		return "", fmt.Errorf("rendering %s: %w", name, err)
+	}
+	return m.snippets.Write(ctx, snippetName(data.VMID), rendered)
+}
+
+// Remove deletes a VM's snippet, if templating is enabled
+func (m *UserDataManager) Remove(ctx context.Context, vmid int) {
+	if m.snippets == nil {
+		return
+	}
+	if err := m.snippets.Delete(ctx, snippetName(vmid)); err != nil {
+		log.Printf("Failed to remove user-data snippet of %d: %v", vmid, err)
+	}
+}
+
+func snippetName(vmid int) string {
+	return fmt.Sprintf("proxmox-api-%d-user.yaml", vmid)
+}
+
+// SnippetStore writes files into a storage's snippets directory on the
+// Proxmox host. The upload API does not accept snippets, so files are
+// written over SSH.
+type SnippetStore struct {
+	pve     *ProxmoxClient
+	storage string
+	addr    string
+	ssh     *ssh.ClientConfig
+
+	mu  sync.Mutex
+	dir string
+}
+
+// newSnippetStore reads the SNIPPETS_* settings; the SSH host defaults to
+// the host of PROXMOX_API_URL
+func newSnippetStore(pve *ProxmoxClient, config *Config) (*SnippetStore, error) {
+	keyFile := config.Snippets.SSHKeyFile
+	if keyFile == "" {
+		return nil, fmt.Errorf("user-data templates need SNIPPETS_SSH_KEY_FILE")
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading SNIPPETS_SSH_KEY_FILE: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SNIPPETS_SSH_KEY_FILE: %w", err)
+	}
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if path := config.Snippets.SSHKnownHosts; path != "" {
+		if hostKey, err = knownhosts.New(path); err != nil {
+			return nil, fmt.Errorf("reading SNIPPETS_SSH_KNOWN_HOSTS: %w", err)
+		}
+	} else {
+		log.Printf("WARNING: SNIPPETS_SSH_KNOWN_HOSTS not set, the Proxmox host key is not verified")
+	}
+
+	host := config.Snippets.SSHHost
+	if host == "" {
+		u, err := url.Parse(config.ProxmoxURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXMOX_API_URL: %w", err)
+		}
+		host = u.Hostname()
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	return &SnippetStore{
+		pve:     pve,
+		storage: config.Snippets.Storage,
+		addr:    host,
+		ssh: &ssh.ClientConfig{
+			User:            config.Snippets.SSHUser,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKey,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+// snippetDir looks up the storage's path through the API, once
+func (s *SnippetStore) snippetDir(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		return s.dir, nil
+	}
+	config, err := s.pve.Storage(ctx, s.storage)
+	if err != nil {
+		return "", fmt.Errorf("reading storage %s: %w", s.storage, err)
+	}
+	if config.Path == "" || !hasTag(config.Content, "snippets") {
+		return "", fmt.Errorf("storage %s is not a directory storage with the snippets content type", s.storage)
+	}
+	s.dir = path.Join(config.Path, "snippets")
+	return s.dir, nil
+}
+
+// run executes a shell command on the Proxmox host with stdin
+func (s *SnippetStore) run(ctx context.Context, command string, stdin []byte) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.addr, s.ssh)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = bytes.NewReader(stdin)
+	if out, err := session.CombinedOutput(command); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Write stores data as the named snippet and returns its volume ID. The
+// file is only readable by root, as user-data carries the join token.
+func (s *SnippetStore) Write(ctx context.Context, name string, data []byte) (string, error) {
+	dir, err := s.snippetDir(ctx)
+	if err != nil {
+		return "", err
+	}
+	file := path.Join(dir, name)
+	command := fmt.Sprintf("umask 077 && mkdir -p '%s' && cat > '%s.tmp' && mv '%s.tmp' '%s'", dir, file, file, file)
+	if err := s.run(ctx, command, data); err != nil {
+		return "", fmt.Errorf("writing %s: %w", file, err)
+	}
+	return fmt.Sprintf("%s:snippets/%s", s.storage, name), nil
+}
+
+// Delete removes the named snippet; missing files are not an error
+func (s *SnippetStore) Delete(ctx context.Context, name string) error {
+	dir, err := s.snippetDir(ctx)
+	if err != nil {
+		return err
+	}
+	return s.run(ctx, fmt.Sprintf("rm -f '%s'", path.Join(dir, name)), nil)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func main() {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Create Kubernetes client
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("Failed to get in-cluster config: %v", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	scaler := NewScaler(kubeClient, NewProvisioner(config.ProvisionerURL, config.APIToken), config)
+
+	// /readyz fails while the API server or proxmox-api is unreachable;
+	// /health stays as an alias of /healthz
+	checks := health.New()
+	checks.Add("kubernetes", func(ctx context.Context) error {
+		return kubeClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+	})
+	checks.Add("proxmox-api", health.HTTP(nil, strings.TrimSuffix(config.ProvisionerURL, "/")+"/health"))
+	checks.Register(http.DefaultServeMux)
+	http.HandleFunc("/health", checks.Live)
+	port := config.Port
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, http.DefaultServeMux)); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	log.Printf("Starting proxmox-autoscaler (prefix %s, min %d, max %d, scale-down after %s)",
+		config.NodePrefix, config.MinNodes, config.MaxNodes, config.ScaleDownCooldown)
+	scaler.Run(ctx)
+	// Let in-flight requests finish
+	<-served
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProvisionedNode mirrors the Node type returned by the proxmox-api service
+type ProvisionedNode struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Phase string `json:"phase"`
+	Power string `json:"power,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// HostPower mirrors the power state of a host managed by proxmox-api
+type HostPower struct {
+	Name  string `json:"name"`
+	Phase string `json:"phase"`
+}
+
+// Provisioner talks to the proxmox-api service
+type Provisioner struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewProvisioner(baseURL, token string) *Provisioner {
+	return &Provisioner{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *Provisioner) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// List returns every node known to proxmox-api
+func (p *Provisioner) List(ctx context.Context) ([]ProvisionedNode, error) {
+	var nodes []ProvisionedNode
+	err := p.do(ctx, http.MethodGet, "/nodes", nil, &nodes)
+	return nodes, err
+}
+
+// Create requests a new worker VM
+func (p *Provisioner) Create(ctx context.Context, req map[string]interface{}) (*ProvisionedNode, error) {
+	var node ProvisionedNode
+	if err := p.do(ctx, http.MethodPost, "/nodes", req, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// Delete destroys a worker VM
+func (p *Provisioner) Delete(ctx context.Context, id int) error {
+	return p.do(ctx, http.MethodDelete, fmt.Sprintf("/nodes/%d", id), nil, nil)
+}
+
+// PowerHosts returns the power state of the hosts proxmox-api may shut down
+func (p *Provisioner) PowerHosts(ctx context.Context) ([]HostPower, error) {
+	var hosts []HostPower
+	err := p.do(ctx, http.MethodGet, "/power", nil, &hosts)
+	return hosts, err
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// powerCordonAnnotation marks nodes proxmox-api cordoned to put their host
+// to sleep
+const powerCordonAnnotation = "homelab.mcztest.com/power-cordoned"
+
+// Scaler adds Proxmox workers for unschedulable pods and removes empty ones
+type Scaler struct {
+	kube        kubernetes.Interface
+	provisioner *Provisioner
+	config      *Config
+
+	// idleSince records when each managed node was first seen empty
+	idleSince map[string]time.Time
+	// lastScaleUp throttles provisioning while a new node boots and joins
+	lastScaleUp time.Time
+}
+
+func NewScaler(kube kubernetes.Interface, provisioner *Provisioner, config *Config) *Scaler {
+	return &Scaler{
+		kube:        kube,
+		provisioner: provisioner,
+		config:      config,
+		idleSince:   make(map[string]time.Time),
+	}
+}
+
+// Run evaluates scaling decisions every interval until ctx is cancelled
+func (s *Scaler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.step(ctx); err != nil {
+			log.Printf("Autoscaler step failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scaler) managed(name string) bool {
+	return strings.HasPrefix(name, s.config.NodePrefix)
+}
+
+func (s *Scaler) step(ctx context.Context) error {
+	vms, err := s.provisioner.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing provisioned nodes: %w", err)
+	}
+
+	var managed []ProvisionedNode
+	inFlight := false
+	for _, vm := range vms {
+		if !s.managed(vm.Name) {
+			continue
+		}
+		managed = append(managed, vm)
+		if vm.Phase == "Provisioning" || vm.Phase == "Joining" || vm.Phase == "Deleting" {
+			inFlight = true
+		}
+	}
+
+	pending, err := s.unschedulablePods(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		s.idleSince = make(map[string]time.Time)
+		return s.scaleUp(ctx, managed, inFlight, pending)
+	}
+	if inFlight {
+		return nil
+	}
+	return s.scaleDown(ctx, managed)
+}
+
+// unschedulablePods returns pods the scheduler has marked Unschedulable for longer than ScaleUpDelay
+func (s *Scaler) unschedulablePods(ctx context.Context) ([]corev1.Pod, error) {
+	pods, err := s.kube.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase=Pending,spec.nodeName=",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing pending pods: %w", err)
+	}
+
+	var pending []corev1.Pod
+	for _, pod := range pods.Items {
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse &&
+				cond.Reason == corev1.PodReasonUnschedulable &&
+				time.Since(cond.LastTransitionTime.Time) > s.config.ScaleUpDelay {
+				pending = append(pending, pod)
+			}
+		}
+	}
+	return pending, nil
+}
+
+func (s *Scaler) scaleUp(ctx context.Context, managed []ProvisionedNode, inFlight bool, pending []corev1.Pod) error {
+	if inFlight || time.Since(s.lastScaleUp) < s.config.ScaleUpCooldown {
+		return nil
+	}
+	if len(managed) >= s.config.MaxNodes {
+		log.Printf("%d pods unschedulable but already at max %d autoscaled nodes", len(pending), s.config.MaxNodes)
+		return nil
+	}
+	// proxmox-api wakes sleeping hosts for pending pods, which brings back
+	// their nodes sooner than a new one
+	hosts, err := s.provisioner.PowerHosts(ctx)
+	if err != nil {
+		log.Printf("Failed to read host power states: %v", err)
+	}
+	for _, h := range hosts {
+		if h.Phase == "Asleep" || h.Phase == "Waking" {
+			log.Printf("%d pods unschedulable, waiting for host %s (%s)", len(pending), h.Name, h.Phase)
+			return nil
+		}
+	}
+
+	name := fmt.Sprintf("%s%d", s.config.NodePrefix, time.Now().Unix())
+	log.Printf("%d pods unschedulable (e.g. %s/%s), provisioning %s",
+		len(pending), pending[0].Namespace, pending[0].Name, name)
+
+	node, err := s.provisioner.Create(ctx, map[string]interface{}{
+		"name":   name,
+		"cores":  s.config.NodeCores,
+		"memory": s.config.NodeMemory,
+		"disk":   s.config.NodeDisk,
+	})
+	if err != nil {
+		return fmt.Errorf("provisioning %s: %w", name, err)
+	}
+
+	s.lastScaleUp = time.Now()
+	log.Printf("Requested node %s (VM %d)", node.Name, node.ID)
+	return nil
+}
+
+// scaleDown removes at most one managed node that has been empty for ScaleDownCooldown
+func (s *Scaler) scaleDown(ctx context.Context, managed []ProvisionedNode) error {
+	if len(managed) <= s.config.MinNodes {
+		return nil
+	}
+
+	byName := make(map[string]ProvisionedNode)
+	for _, vm := range managed {
+		byName[vm.Name] = vm
+	}
+
+	nodes, err := s.kube.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing nodes: %w", err)
+	}
+
+	for _, node := range nodes.Items {
+		vm, ok := byName[node.Name]
+		if !ok {
+			continue
+		}
+		// Nodes of a sleeping host come back when it wakes
+		if node.Annotations[powerCordonAnnotation] == "true" {
+			delete(s.idleSince, node.Name)
+			continue
+		}
+
+		busy, err := s.hasWorkload(ctx, node.Name)
+		if err != nil {
+			return err
+		}
+		if busy {
+			delete(s.idleSince, node.Name)
+			continue
+		}
+
+		since, seen := s.idleSince[node.Name]
+		if !seen {
+			s.idleSince[node.Name] = time.Now()
+			continue
+		}
+		if time.Since(since) < s.config.ScaleDownCooldown {
+			continue
+		}
+
+		log.Printf("Node %s idle for %s, removing", node.Name, time.Since(since).Round(time.Second))
+		if err := s.removeNode(ctx, node.Name, vm.ID); err != nil {
+			return err
+		}
+		delete(s.idleSince, node.Name)
+		return nil
+	}
+	return nil
+}
+
+// hasWorkload reports whether a node runs anything besides DaemonSet and mirror pods
+func (s *Scaler) hasWorkload(ctx context.Context, nodeName string) (bool, error) {
+	pods, err := s.kube.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + nodeName,
+	})
+	if err != nil {
+		return false, fmt.Errorf("listing pods on %s: %w", nodeName, err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if _, mirror := pod.Annotations[corev1.MirrorPodAnnotationKey]; mirror {
+			continue
+		}
+		daemon := false
+		for _, ref := range pod.OwnerReferences {
+			if ref.Kind == "DaemonSet" {
+				daemon = true
+			}
+		}
+		if !daemon {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeNode cordons the node, deletes it from Kubernetes, then destroys the VM
+func (s *Scaler) removeNode(ctx context.Context, nodeName string, vmID int) error {
+	cordon := []byte(`{"spec":{"unschedulable":true}}`)
+	if _, err := s.kube.CoreV1().Nodes().Patch(ctx, nodeName, types.StrategicMergePatchType, cordon, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("cordoning %s: %w", nodeName, err)
+	}
+
+	if err := s.kube.CoreV1().Nodes().Delete(ctx, nodeName, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("deleting node %s: %w", nodeName, err)
+	}
+
+	if err := s.provisioner.Delete(ctx, vmID); err != nil {
+		return fmt.Errorf("destroying VM %d: %w", vmID, err)
+	}
+	return nil
+}
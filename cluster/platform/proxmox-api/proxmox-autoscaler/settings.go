@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/homelab/internal/config"
+)
+
+// Config is read at startup: defaults, then the -settings YAML file
+// (SETTINGS_FILE), then the environment, then flags
+type Config struct {
+	Port string `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+
+	ProvisionerURL string `json:"provisionerURL" env:"PROVISIONER_URL" flag:"provisioner-url" usage:"proxmox-api base URL"`
+	APIToken       string `json:"-" env:"API_TOKEN"`
+
+	// Only nodes whose name starts with NodePrefix are created or removed
+	NodePrefix string `json:"nodePrefix" env:"NODE_PREFIX" flag:"node-prefix"`
+	MinNodes   int    `json:"minNodes" env:"MIN_NODES" flag:"min-nodes" usage:"autoscaled nodes always kept"`
+	MaxNodes   int    `json:"maxNodes" env:"MAX_NODES" flag:"max-nodes" usage:"most autoscaled nodes"`
+
+	NodeCores  int `json:"nodeCores" env:"NODE_CORES" flag:"node-cores"`
+	NodeMemory int `json:"nodeMemory" env:"NODE_MEMORY" flag:"node-memory" usage:"MiB"`
+	NodeDisk   int `json:"nodeDisk" env:"NODE_DISK" flag:"node-disk" usage:"GiB"`
+
+	Interval          time.Duration `json:"interval" env:"INTERVAL" flag:"interval" usage:"time between scaling decisions"`
+	ScaleUpDelay      time.Duration `json:"scaleUpDelay" env:"SCALE_UP_DELAY" flag:"scale-up-delay" usage:"how long pods stay unschedulable before a node is added"`
+	ScaleUpCooldown   time.Duration `json:"scaleUpCooldown" env:"SCALE_UP_COOLDOWN" flag:"scale-up-cooldown"`
+	ScaleDownCooldown time.Duration `json:"scaleDownCooldown" env:"SCALE_DOWN_COOLDOWN" flag:"scale-down-cooldown" usage:"how long a node runs only DaemonSet pods before removal"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:              "8080",
+		ProvisionerURL:    "http://proxmox-api.proxmox-system",
+		NodePrefix:        "k8s-auto-",
+		MaxNodes:          2,
+		NodeCores:         2,
+		NodeMemory:        4096,
+		NodeDisk:          20,
+		Interval:          30 * time.Second,
+		ScaleUpDelay:      30 * time.Second,
+		ScaleUpCooldown:   5 * time.Minute,
+		ScaleDownCooldown: 15 * time.Minute,
+	}
+}
+
+// loadConfig layers the file, environment, and flags over the defaults
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+	if err := config.Load(c, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate implements config.Validator
+func (c *Config) Validate() error {
+	if c.MinNodes > c.MaxNodes {
+		return fmt.Errorf("MIN_NODES (%d) exceeds MAX_NODES (%d)", c.MinNodes, c.MaxNodes)
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("invalid INTERVAL: must be positive")
+	}
+	return nil
+}
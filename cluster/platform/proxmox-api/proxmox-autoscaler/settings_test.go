@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homelab/internal/config"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("MAX_NODES", "4")
+	t.Setenv("SCALE_DOWN_COOLDOWN", "1h")
+	c := defaultConfig()
+	if err := config.Load(c, config.Options{Args: []string{"-min-nodes=1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if c.MinNodes != 1 || c.MaxNodes != 4 || c.ScaleDownCooldown != time.Hour || c.NodePrefix != "k8s-auto-" {
+		t.Fatalf("config = %+v", c)
+	}
+}
+
+func TestLoadConfigRejectsMinAboveMax(t *testing.T) {
+	t.Setenv("MIN_NODES", "3")
+	c := defaultConfig()
+	err := config.Load(c, config.Options{Args: []string{}})
+	if err == nil || !strings.Contains(err.Error(), "exceeds MAX_NODES") {
+		t.Fatalf("err = %v, want MIN_NODES above MAX_NODES rejected", err)
+	}
+}
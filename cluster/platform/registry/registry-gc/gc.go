@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// readOnlyEnv puts the registry into maintenance mode: pulls keep working,
+// pushes fail until it is removed again
+const readOnlyEnv = "REGISTRY_STORAGE_MAINTENANCE_READONLY"
+
+// Collector deletes manifests chosen by the planner and runs registry GC
+type Collector struct {
+	planner *Planner
+	kube    kubernetes.Interface
+	rest    *rest.Config
+
+	registryNamespace  string
+	registrySelector   string
+	registryDeployment string
+	// pollInterval paces the wait for registry rollouts
+	pollInterval time.Duration
+
+	// mu serializes runs; lastReport is served by GET /report
+	mu         sync.Mutex
+	lastReport *Report
+}
+
+// Run plans, deletes (unless dryRun), and triggers garbage collection
+func (c *Collector) Run(ctx context.Context, dryRun bool) (*Report, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report, err := c.planner.Plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.DryRun = dryRun
+
+	if !dryRun {
+		deleted := make(map[string]bool)
+		for _, d := range report.Decisions {
+			key := d.Repository + "@" + d.Digest
+			if d.Action != ActionDelete || deleted[key] {
+				continue
+			}
+			if err := c.planner.registry.DeleteManifest(ctx, d.Repository, d.Digest); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			deleted[key] = true
+			log.Printf("Deleted %s:%s (%s)", d.Repository, d.Tag, d.Digest)
+		}
+
+		output, err := c.collectReadOnly(ctx)
+		report.GCOutput = output
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("garbage-collect: %v", err))
+		}
+	}
+
+	log.Printf("GC run complete (dryRun=%t): %d kept, %d deleted, %d bytes reclaimable, %d errors",
+		dryRun, report.Kept, report.Deleted, report.ReclaimableBytes, len(report.Errors))
+	c.lastReport = report
+	return report, nil
+}
+
+// LastReport returns the most recent run, if any
+func (c *Collector) LastReport() *Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastReport
+}
+
+// collectReadOnly runs garbage collection with the registry in read-only
+// mode, since blobs uploaded while GC marks can be swept as unreferenced.
+// Switching modes rolls out the registry twice and pushes fail in between.
+// The registry is made writable again even when ctx has ended.
+func (c *Collector) collectReadOnly(ctx context.Context) (string, error) {
+	defer func() {
+		restoreCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if err := c.setReadOnly(restoreCtx, false); err != nil {
+			log.Printf("WARNING: registry %s/%s may still be read-only: %v", c.registryNamespace, c.registryDeployment, err)
+			return
+		}
+		if _, err := c.waitRegistry(restoreCtx, false); err != nil {
+			log.Printf("WARNING: registry %s/%s not writable again: %v", c.registryNamespace, c.registryDeployment, err)
+		}
+	}()
+
+	if err := c.setReadOnly(ctx, true); err != nil {
+		return "", fmt.Errorf("switching registry to read-only: %w", err)
+	}
+	pod, err := c.waitRegistry(ctx, true)
+	if err != nil {
+		return "", fmt.Errorf("waiting for read-only registry: %w", err)
+	}
+	return c.garbageCollect(ctx, pod)
+}
+
+// setReadOnly adds or removes readOnlyEnv on the registry Deployment's
+// registry container, which rolls out a new pod
+func (c *Collector) setReadOnly(ctx context.Context, readOnly bool) error {
+	env := map[string]interface{}{"name": readOnlyEnv, "$patch": "delete"}
+	if readOnly {
+		env = map[string]interface{}{"name": readOnlyEnv, "value": `{"enabled": true}`}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{
+			"containers": []interface{}{map[string]interface{}{"name": "registry", "env": []interface{}{env}}},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.kube.AppsV1().Deployments(c.registryNamespace).Patch(ctx, c.registryDeployment, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// waitRegistry waits until every registry pod runs in the wanted mode and
+// returns a ready one; pods of the previous rollout may still serve
+// requests, so they must be gone first
+func (c *Collector) waitRegistry(ctx context.Context, readOnly bool) (*corev1.Pod, error) {
+	for {
+		pod, err := c.registryPod(ctx, readOnly)
+		if err != nil || pod != nil {
+			return pod, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// registryPod returns a ready registry pod once all of them are in the
+// wanted mode, or nil while the rollout is in progress
+func (c *Collector) registryPod(ctx context.Context, readOnly bool) (*corev1.Pod, error) {
+	pods, err := c.kube.CoreV1().Pods(c.registryNamespace).List(ctx, metav1.ListOptions{LabelSelector: c.registrySelector})
+	if err != nil {
+		return nil, err
+	}
+	var ready *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if pod.DeletionTimestamp != nil || isReadOnly(pod) != readOnly {
+			return nil, nil
+		}
+		if ready == nil && podReady(pod) {
+			ready = pod
+		}
+	}
+	return ready, nil
+}
+
+// isReadOnly reports whether the pod's registry container has readOnlyEnv
+func isReadOnly(pod *corev1.Pod) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != "registry" {
+			continue
+		}
+		for _, env := range container.Env {
+			if env.Name == readOnlyEnv {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func podReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// garbageCollect runs `registry garbage-collect` inside the registry pod so
+// blobs of deleted manifests (and untagged manifests) are freed from the PVC
+func (c *Collector) garbageCollect(ctx context.Context, pod *corev1.Pod) (string, error) {
+	req := c.kube.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: "registry",
+			Command:   []string{"registry", "garbage-collect", "--delete-untagged", "/etc/docker/registry/config.yml"},
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(c.rest, "POST", req.URL())
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	return tail(stdout.String()+stderr.String(), 4096), err
+}
+
+// tail keeps the last n bytes of s
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[len(s)-n:]
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testCollector(objects ...runtime.Object) (*Collector, *fake.Clientset) {
+	kube := fake.NewSimpleClientset(objects...)
+	return &Collector{
+		kube:               kube,
+		registryNamespace:  "container-registry",
+		registrySelector:   "app=docker-registry",
+		registryDeployment: "docker-registry",
+		pollInterval:       10 * time.Millisecond,
+	}, kube
+}
+
+func registryPod(name string, readOnly, ready bool, mutate func(*corev1.Pod)) *corev1.Pod {
+	container := corev1.Container{Name: "registry"}
+	if readOnly {
+		container.Env = []corev1.EnvVar{{Name: readOnlyEnv, Value: `{"enabled": true}`}}
+	}
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "container-registry", Labels: map[string]string{"app": "docker-registry"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{container}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+	if mutate != nil {
+		mutate(pod)
+	}
+	return pod
+}
+
+func TestSetReadOnly(t *testing.T) {
+	ctx := context.Background()
+	c, kube := testCollector(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "docker-registry", Namespace: "container-registry"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "registry",
+				Env:  []corev1.EnvVar{{Name: "REGISTRY_STORAGE_DELETE_ENABLED", Value: "true"}},
+			}},
+		}}},
+	})
+	env := func() []corev1.EnvVar {
+		deploy, err := kube.AppsV1().Deployments("container-registry").Get(ctx, "docker-registry", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return deploy.Spec.Template.Spec.Containers[0].Env
+	}
+
+	if err := c.setReadOnly(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := env(); len(got) != 2 || !isReadOnly(&corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "registry", Env: got}}}}) {
+		t.Fatalf("read-only env = %+v", got)
+	}
+
+	if err := c.setReadOnly(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := env(); len(got) != 1 || got[0].Name != "REGISTRY_STORAGE_DELETE_ENABLED" {
+		t.Fatalf("writable env = %+v", got)
+	}
+}
+
+func TestRegistryPodWaitsForRollout(t *testing.T) {
+	tests := []struct {
+		name string
+		pods []runtime.Object
+		want string
+	}{
+		{
+			name: "old writable pod still running",
+			pods: []runtime.Object{registryPod("old", false, true, nil), registryPod("new", true, true, nil)},
+		},
+		{
+			name: "old pod terminating",
+			pods: []runtime.Object{
+				registryPod("old", true, true, func(p *corev1.Pod) { p.DeletionTimestamp = &metav1.Time{Time: time.Now()} }),
+				registryPod("new", true, true, nil),
+			},
+		},
+		{
+			name: "new pod not ready",
+			pods: []runtime.Object{registryPod("new", true, false, nil)},
+		},
+		{
+			name: "rolled out",
+			pods: []runtime.Object{
+				registryPod("evicted", false, false, func(p *corev1.Pod) { p.Status.Phase = corev1.PodFailed }),
+				registryPod("new", true, true, nil),
+			},
+			want: "new",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testCollector(tt.pods...)
+			pod, err := c.registryPod(context.Background(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if pod != nil {
+				got = pod.Name
+			}
+			if got != tt.want {
+				t.Fatalf("pod = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitRegistryTimesOut(t *testing.T) {
+	c, _ := testCollector(registryPod("old", false, true, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if pod, err := c.waitRegistry(ctx, true); err == nil {
+		t.Fatalf("waited for writable pod %s", pod.Name)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/homelab/internal/auth"
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Server serves the GC, storage, and mirror APIs
+type Server struct {
+	collector *Collector
+	storage   *StorageUsage
+	mirrors   *MirrorManager
+}
+
+func main() {
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+
+	// Create Kubernetes client
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("Failed to get in-cluster config: %v", err)
+	}
+
+	k8sClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	policy := Policy{
+		KeepLast:      settings.KeepLast,
+		MaxAge:        time.Duration(settings.MaxAgeDays) * 24 * time.Hour,
+		ProtectedTags: settings.ProtectedTags,
+		RegistryHosts: settings.RegistryHosts,
+	}
+
+	collector := &Collector{
+		planner: &Planner{
+			registry: NewRegistryClient(settings.RegistryURL, settings.RegistryAuthFile),
+			kube:     k8sClient,
+			pins: &PinStore{
+				kube:      k8sClient,
+				namespace: settings.RegistryNamespace,
+				name:      settings.PinsConfigMap,
+			},
+			policy: policy,
+		},
+		kube:               k8sClient,
+		rest:               config,
+		registryNamespace:  settings.RegistryNamespace,
+		registrySelector:   settings.RegistrySelector,
+		registryDeployment: settings.RegistryDeployment,
+		pollInterval:       5 * time.Second,
+	}
+
+	mirrorList, err := loadMirrors(settings.MirrorsFile, settings.Mirrors, settings.MirrorDomain)
+	if err != nil {
+		log.Fatalf("Invalid mirror config: %v", err)
+	}
+	prepull := settings.PrepullImages
+	mirrors := &MirrorManager{
+		kube:      k8sClient,
+		namespace: collector.registryNamespace,
+		mirrors:   mirrorList,
+		prepull:   prepull,
+		// No client timeout: pre-pull downloads are bounded by their context
+		http: &http.Client{},
+	}
+	for _, image := range prepull {
+		if _, _, _, err := mirrors.mirrorFor(image); err != nil {
+			log.Fatalf("Invalid PREPULL_IMAGES entry %s: %v", image, err)
+		}
+	}
+	go mirrors.Run(context.Background(), settings.PrepullInterval)
+
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+			if _, err := collector.Run(ctx, settings.DryRun); err != nil {
+				log.Printf("Scheduled GC run failed: %v", err)
+			}
+			cancel()
+			time.Sleep(settings.Interval)
+		}
+	}()
+
+	server := &Server{
+		collector: collector,
+		storage:   &StorageUsage{registry: collector.planner.registry},
+		mirrors:   mirrors,
+	}
+
+	// Reports are open; runs, pin changes, and pre-pulls need a token
+	apiAuth := auth.AllowUnauthenticated(auth.Bearer(settings.APIToken, "", "", nil), settings.AllowUnauthenticated, "GC run, pin, and pre-pull API")
+	http.HandleFunc("/report", server.handleReport)
+	http.HandleFunc("/run", auth.Require(server.handleRun, apiAuth...))
+	http.HandleFunc("/usage", server.handleUsage)
+	http.HandleFunc("/registry/usage", server.handleRegistryUsage)
+	http.HandleFunc("/registry/pins", requireWrites(server.handlePins, apiAuth...))
+	http.HandleFunc("/metrics", server.handleMetrics)
+	http.HandleFunc("/mirrors", server.handleMirrors)
+	http.HandleFunc("/mirrors/prepull", auth.Require(server.handlePrepull, apiAuth...))
+
+	// /readyz fails while the API server or the registry is unreachable;
+	// /health stays as an alias of /healthz
+	checks := health.New()
+	checks.Add("kubernetes", func(ctx context.Context) error {
+		return k8sClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+	})
+	checks.Add("registry", health.HTTP(nil, collector.planner.registry.baseURL+"/v2/"))
+	checks.Register(http.DefaultServeMux)
+	http.HandleFunc("/health", checks.Live)
+
+	port := settings.Port
+
+	log.Printf("Starting registry-gc on port %s (keep last %d, max age %dd, interval %s, scheduled dry-run %t, %d mirrors)",
+		port, settings.KeepLast, settings.MaxAgeDays, settings.Interval, settings.DryRun, len(mirrorList))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, http.DefaultServeMux)); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// requireWrites authenticates every request but GETs
+func requireWrites(next http.HandlerFunc, authenticators ...auth.Authenticator) http.HandlerFunc {
+	protected := auth.Require(next, authenticators...)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			next(w, r)
+			return
+		}
+		protected(w, r)
+	}
+}
+
+// handleReport returns a fresh dry-run plan (or the last run with ?cached=true)
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Query().Get("cached") == "true" {
+		report := s.collector.LastReport()
+		if report == nil {
+			http.Error(w, "No report yet", http.StatusNotFound)
+			return
+		}
+		httpkit.WriteJSON(w, http.StatusOK, report)
+		return
+	}
+
+	report, err := s.collector.planner.Plan(r.Context())
+	if err != nil {
+		log.Printf("Failed to build report: %v", err)
+		http.Error(w, "Failed to build report", http.StatusBadGateway)
+		return
+	}
+	report.DryRun = true
+	httpkit.WriteJSON(w, http.StatusOK, report)
+}
+
+// handleRun executes a collection; deletion requires ?dryRun=false
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") != "false"
+	report, err := s.collector.Run(r.Context(), dryRun)
+	if err != nil {
+		log.Printf("GC run failed: %v", err)
+		http.Error(w, "GC run failed", http.StatusBadGateway)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, report)
+}
+
+// handleUsage maps registry images to the workloads referencing them
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.collector.planner.Usage(r.Context())
+	if err != nil {
+		log.Printf("Failed to build usage report: %v", err)
+		http.Error(w, "Failed to build usage report", http.StatusBadGateway)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/homelab/internal/auth"
+)
+
+func TestRequireWrites(t *testing.T) {
+	handler := requireWrites(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, auth.Bearer("app-operator=s3cret", "", "", nil)...)
+
+	tests := []struct {
+		method string
+		token  string
+		want   int
+	}{
+		{method: http.MethodGet, want: http.StatusNoContent},
+		{method: http.MethodPost, want: http.StatusUnauthorized},
+		{method: http.MethodDelete, token: "wrong", want: http.StatusUnauthorized},
+		{method: http.MethodPost, token: "s3cret", want: http.StatusNoContent},
+		{method: http.MethodDelete, token: "s3cret", want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/registry/pins", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s with token %q: status = %d, want %d", tt.method, tt.token, w.Code, tt.want)
+		}
+	}
+}
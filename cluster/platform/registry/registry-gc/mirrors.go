@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	appsv1apply "k8s.io/client-go/applyconfigurations/apps/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	metav1apply "k8s.io/client-go/applyconfigurations/meta/v1"
+	networkingv1apply "k8s.io/client-go/applyconfigurations/networking/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// mirrorPrefix names each mirror's PVC, Deployment, Service, and Ingress
+	mirrorPrefix = "registry-mirror-"
+	// mirrorLabel selects a mirror's resources, so mirrors dropped from the
+	// config can be found and removed
+	mirrorLabel  = "homelab.mcztest.com/registry-mirror"
+	fieldManager = "registry-gc"
+)
+
+var mirrorNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Mirror is a pull-through cache of an upstream registry, run as its own
+// registry instance since a proxying registry cannot also accept pushes
+type Mirror struct {
+	// Upstream is the registry host images are referenced by, e.g. docker.io
+	Upstream string `json:"upstream"`
+	// Name defaults to Upstream with dots replaced by dashes
+	Name string `json:"name,omitempty"`
+	// RemoteURL defaults to https://<upstream> (Docker Hub's API host for
+	// docker.io)
+	RemoteURL string `json:"remoteURL,omitempty"`
+	// CredentialsSecret names a Secret with username and password keys,
+	// raising upstream rate limits
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+	// Storage is the cache PVC size
+	Storage string `json:"storage,omitempty"`
+	// Host exposes the mirror through an Ingress for node containerd
+	// configs; defaults to <name>.<MIRROR_DOMAIN> when that is set
+	Host string `json:"host,omitempty"`
+}
+
+// ProxyStats are a mirror's counters for blobs or manifests since it started
+type ProxyStats struct {
+	Requests    int64 `json:"requests"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	BytesPulled int64 `json:"bytesPulled"`
+	BytesPushed int64 `json:"bytesPushed"`
+}
+
+// MirrorStatus is served by GET /mirrors
+type MirrorStatus struct {
+	Mirror
+	Ready     bool        `json:"ready"`
+	Blobs     *ProxyStats `json:"blobs,omitempty"`
+	Manifests *ProxyStats `json:"manifests,omitempty"`
+	// HitRate is the share of blob requests served from the cache
+	HitRate *float64 `json:"hitRate,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// PrepullResult is the outcome of warming one image
+type PrepullResult struct {
+	Image string `json:"image"`
+	Blobs int    `json:"blobs"`
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+}
+
+// PrepullReport is the last pre-pull run
+type PrepullReport struct {
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt"`
+	Results    []PrepullResult `json:"results"`
+}
+
+// MirrorManager keeps the configured mirrors deployed and warms their caches
+type MirrorManager struct {
+	kube      kubernetes.Interface
+	namespace string
+	mirrors   []Mirror
+	// prepull lists image references pulled through the mirrors each run
+	prepull []string
+	http    *http.Client
+
+	// mu serializes pre-pull runs
+	mu          sync.Mutex
+	lastPrepull *PrepullReport
+}
+
+// loadMirrors reads file (a JSON list of mirrors) or builds mirrors from
+// upstreams; domain names the mirrors' ingress hosts
+func loadMirrors(file string, upstreams []string, domain string) ([]Mirror, error) {
+	var mirrors []Mirror
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading MIRRORS_FILE: %w", err)
+		}
+		if err := json.Unmarshal(data, &mirrors); err != nil {
+			return nil, fmt.Errorf("parsing MIRRORS_FILE: %w", err)
+		}
+	} else {
+		for _, upstream := range upstreams {
+			mirrors = append(mirrors, Mirror{Upstream: upstream})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := range mirrors {
+		m := &mirrors[i]
+		if m.Upstream == "" {
+			return nil, fmt.Errorf("mirror %d has no upstream", i)
+		}
+		if m.Name == "" {
+			m.Name = strings.ReplaceAll(m.Upstream, ".", "-")
+		}
+		if !mirrorNamePattern.MatchString(m.Name) || len(mirrorPrefix+m.Name) > 63 {
+			return nil, fmt.Errorf("invalid mirror name %q", m.Name)
+		}
+		if seen[m.Name] || seen[m.Upstream] {
+			return nil, fmt.Errorf("duplicate mirror %q", m.Name)
+		}
+		seen[m.Name], seen[m.Upstream] = true, true
+		if m.RemoteURL == "" {
+			m.RemoteURL = "https://" + m.Upstream
+			if m.Upstream == "docker.io" {
+				m.RemoteURL = "https://registry-1.docker.io"
+			}
+		}
+		if m.Storage == "" {
+			m.Storage = "10Gi"
+		}
+		if _, err := resource.ParseQuantity(m.Storage); err != nil {
+			return nil, fmt.Errorf("mirror %s storage: %w", m.Name, err)
+		}
+		if m.Host == "" && domain != "" {
+			m.Host = m.Name + "." + domain
+		}
+	}
+	return mirrors, nil
+}
+
+func (m *MirrorManager) serviceURL(mirror *Mirror, port int) string {
+	return fmt.Sprintf("http://%s%s.%s.svc.cluster.local:%d", mirrorPrefix, mirror.Name, m.namespace, port)
+}
+
+// Apply server-side applies every mirror's PVC, Deployment, Service, and
+// Ingress, and deletes the resources of mirrors no longer configured. Cache
+// PVCs of removed mirrors are deleted too; they only hold upstream copies.
+func (m *MirrorManager) Apply(ctx context.Context) error {
+	opts := metav1.ApplyOptions{FieldManager: fieldManager, Force: true}
+	for i := range m.mirrors {
+		mirror := &m.mirrors[i]
+		name := mirrorPrefix + mirror.Name
+		labels := map[string]string{"app": name, mirrorLabel: mirror.Name}
+
+		pvc := corev1apply.PersistentVolumeClaim(name, m.namespace).
+			WithLabels(labels).
+			WithSpec(corev1apply.PersistentVolumeClaimSpec().
+				WithAccessModes(corev1.ReadWriteOnce).
+				WithStorageClassName("local-path").
+				WithResources(corev1apply.ResourceRequirements().
+					WithRequests(corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(mirror.Storage)})))
+		if _, err := m.kube.CoreV1().PersistentVolumeClaims(m.namespace).Apply(ctx, pvc, opts); err != nil {
+			return fmt.Errorf("applying %s PVC: %w", name, err)
+		}
+
+		env := []*corev1apply.EnvVarApplyConfiguration{
+			corev1apply.EnvVar().WithName("REGISTRY_PROXY_REMOTEURL").WithValue(mirror.RemoteURL),
+			corev1apply.EnvVar().WithName("REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY").WithValue("/var/lib/registry"),
+			// The proxy expires cached content by deleting it
+			corev1apply.EnvVar().WithName("REGISTRY_STORAGE_DELETE_ENABLED").WithValue("true"),
+			// Serves the cache hit counters at /debug/vars
+			corev1apply.EnvVar().WithName("REGISTRY_HTTP_DEBUG_ADDR").WithValue(":5001"),
+		}
+		if mirror.CredentialsSecret != "" {
+			for _, key := range []string{"username", "password"} {
+				env = append(env, corev1apply.EnvVar().
+					WithName("REGISTRY_PROXY_"+strings.ToUpper(key)).
+					WithValueFrom(corev1apply.EnvVarSource().
+						WithSecretKeyRef(corev1apply.SecretKeySelector().WithName(mirror.CredentialsSecret).WithKey(key))))
+			}
+		}
+		deployment := appsv1apply.Deployment(name, m.namespace).
+			WithLabels(labels).
+			WithSpec(appsv1apply.DeploymentSpec().
+				WithReplicas(1).
+				// The cache PVC is ReadWriteOnce
+				WithStrategy(appsv1apply.DeploymentStrategy().WithType(appsv1.RecreateDeploymentStrategyType)).
+				WithSelector(metav1apply.LabelSelector().WithMatchLabels(labels)).
+				WithTemplate(corev1apply.PodTemplateSpec().
+					WithLabels(labels).
+					WithSpec(corev1apply.PodSpec().
+						WithContainers(corev1apply.Container().
+							WithName("registry").
+							WithImage("registry:2").
+							WithEnv(env...).
+							WithPorts(
+								corev1apply.ContainerPort().WithName("registry").WithContainerPort(5000),
+								corev1apply.ContainerPort().WithName("debug").WithContainerPort(5001),
+							).
+							WithVolumeMounts(corev1apply.VolumeMount().WithName("cache").WithMountPath("/var/lib/registry")).
+							WithReadinessProbe(corev1apply.Probe().
+								WithHTTPGet(corev1apply.HTTPGetAction().WithPath("/").WithPort(intstr.FromInt(5000))).
+								WithPeriodSeconds(10)).
+							WithResources(corev1apply.ResourceRequirements().
+								WithRequests(corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse("50m"),
+									corev1.ResourceMemory: resource.MustParse("64Mi"),
+								}).
+								WithLimits(corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse("500m"),
+									corev1.ResourceMemory: resource.MustParse("256Mi"),
+								}))).
+						WithVolumes(corev1apply.Volume().
+							WithName("cache").
+							WithPersistentVolumeClaim(corev1apply.PersistentVolumeClaimVolumeSource().WithClaimName(name))))))
+		if _, err := m.kube.AppsV1().Deployments(m.namespace).Apply(ctx, deployment, opts); err != nil {
+			return fmt.Errorf("applying %s Deployment: %w", name, err)
+		}
+
+		service := corev1apply.Service(name, m.namespace).
+			WithLabels(labels).
+			WithSpec(corev1apply.ServiceSpec().
+				WithSelector(labels).
+				WithPorts(
+					corev1apply.ServicePort().WithName("registry").WithPort(5000).WithTargetPort(intstr.FromInt(5000)),
+					corev1apply.ServicePort().WithName("debug").WithPort(5001).WithTargetPort(intstr.FromInt(5001)),
+				))
+		if _, err := m.kube.CoreV1().Services(m.namespace).Apply(ctx, service, opts); err != nil {
+			return fmt.Errorf("applying %s Service: %w", name, err)
+		}
+
+		if mirror.Host == "" {
+			if err := m.kube.NetworkingV1().Ingresses(m.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("deleting %s Ingress: %w", name, err)
+			}
+			continue
+		}
+		ingress := networkingv1apply.Ingress(name, m.namespace).
+			WithLabels(labels).
+			WithAnnotations(map[string]string{
+				"cert-manager.io/cluster-issuer":                 "letsencrypt-cloudflare",
+				"nginx.ingress.kubernetes.io/proxy-body-size":    "0",
+				"nginx.ingress.kubernetes.io/proxy-read-timeout": "600",
+			}).
+			WithSpec(networkingv1apply.IngressSpec().
+				WithIngressClassName("nginx").
+				WithTLS(networkingv1apply.IngressTLS().WithHosts(mirror.Host).WithSecretName(name + "-tls")).
+				WithRules(networkingv1apply.IngressRule().
+					WithHost(mirror.Host).
+					WithHTTP(networkingv1apply.HTTPIngressRuleValue().
+						WithPaths(networkingv1apply.HTTPIngressPath().
+							WithPath("/").
+							WithPathType("Prefix").
+							WithBackend(networkingv1apply.IngressBackend().
+								WithService(networkingv1apply.IngressServiceBackend().
+									WithName(name).
+									WithPort(networkingv1apply.ServiceBackendPort().WithNumber(5000))))))))
+		if _, err := m.kube.NetworkingV1().Ingresses(m.namespace).Apply(ctx, ingress, opts); err != nil {
+			return fmt.Errorf("applying %s Ingress: %w", name, err)
+		}
+	}
+	return m.prune(ctx)
+}
+
+// prune deletes the resources of mirrors removed from the config
+func (m *MirrorManager) prune(ctx context.Context) error {
+	names := make([]string, 0, len(m.mirrors))
+	for _, mirror := range m.mirrors {
+		names = append(names, mirror.Name)
+	}
+	selector := mirrorLabel
+	if len(names) > 0 {
+		selector = fmt.Sprintf("%s,%s notin (%s)", mirrorLabel, mirrorLabel, strings.Join(names, ","))
+	}
+	list := metav1.ListOptions{LabelSelector: selector}
+	deleteAll := metav1.DeleteOptions{}
+
+	if err := m.kube.AppsV1().Deployments(m.namespace).DeleteCollection(ctx, deleteAll, list); err != nil {
+		return fmt.Errorf("deleting removed mirror Deployments: %w", err)
+	}
+	if err := m.kube.NetworkingV1().Ingresses(m.namespace).DeleteCollection(ctx, deleteAll, list); err != nil {
+		return fmt.Errorf("deleting removed mirror Ingresses: %w", err)
+	}
+	if err := m.kube.CoreV1().PersistentVolumeClaims(m.namespace).DeleteCollection(ctx, deleteAll, list); err != nil {
+		return fmt.Errorf("deleting removed mirror PVCs: %w", err)
+	}
+	// Services have no deletecollection
+	services, err := m.kube.CoreV1().Services(m.namespace).List(ctx, list)
+	if err != nil {
+		return fmt.Errorf("listing removed mirror Services: %w", err)
+	}
+	for _, svc := range services.Items {
+		if err := m.kube.CoreV1().Services(m.namespace).Delete(ctx, svc.Name, deleteAll); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting Service %s: %w", svc.Name, err)
+		}
+		log.Printf("Removed mirror %s", svc.Labels[mirrorLabel])
+	}
+	return nil
+}
+
+// Status reports each mirror's readiness and cache hit counters
+func (m *MirrorManager) Status(ctx context.Context) []MirrorStatus {
+	statuses := []MirrorStatus{}
+	for i := range m.mirrors {
+		mirror := &m.mirrors[i]
+		status := MirrorStatus{Mirror: *mirror}
+
+		deployment, err := m.kube.AppsV1().Deployments(m.namespace).Get(ctx, mirrorPrefix+mirror.Name, metav1.GetOptions{})
+		if err != nil {
+			status.Error = err.Error()
+			statuses = append(statuses, status)
+			continue
+		}
+		status.Ready = deployment.Status.ReadyReplicas > 0
+
+		if status.Ready {
+			blobs, manifests, err := m.proxyStats(ctx, mirror)
+			if err != nil {
+				status.Error = err.Error()
+			} else {
+				status.Blobs, status.Manifests = blobs, manifests
+				if blobs.Requests > 0 {
+					rate := float64(blobs.Hits) / float64(blobs.Requests)
+					status.HitRate = &rate
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// proxyStats reads the proxy counters the registry publishes through expvar
+func (m *MirrorManager) proxyStats(ctx context.Context, mirror *Mirror) (*ProxyStats, *ProxyStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.serviceURL(mirror, 5001)+"/debug/vars", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("GET /debug/vars: %s", resp.Status)
+	}
+
+	type counters struct {
+		Requests    int64
+		Hits        int64
+		Misses      int64
+		BytesPulled int64
+		BytesPushed int64
+	}
+	var vars struct {
+		Registry struct {
+			Proxy struct {
+				Blobs     counters `json:"blobs"`
+				Manifests counters `json:"manifests"`
+			} `json:"proxy"`
+		} `json:"registry"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		return nil, nil, fmt.Errorf("decoding /debug/vars: %w", err)
+	}
+	blobs := ProxyStats(vars.Registry.Proxy.Blobs)
+	manifests := ProxyStats(vars.Registry.Proxy.Manifests)
+	return &blobs, &manifests, nil
+}
+
+// writeMetrics appends the mirror gauges to a /metrics response
+func (m *MirrorManager) writeMetrics(ctx context.Context, b *strings.Builder) {
+	statuses := m.Status(ctx)
+	gauge := func(name, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("registry_mirror_up", "Whether the mirror has a ready replica")
+	for _, s := range statuses {
+		fmt.Fprintf(b, "registry_mirror_up{mirror=%q,upstream=%q} %d\n", s.Name, s.Upstream, boolMetric(s.Ready))
+	}
+	gauge("registry_mirror_requests", "Proxied requests since the mirror started")
+	gauge("registry_mirror_hits", "Proxied requests served from the cache since the mirror started")
+	gauge("registry_mirror_pulled_bytes", "Bytes fetched from upstream since the mirror started")
+	for _, s := range statuses {
+		for kind, stats := range map[string]*ProxyStats{"blob": s.Blobs, "manifest": s.Manifests} {
+			if stats == nil {
+				continue
+			}
+			fmt.Fprintf(b, "registry_mirror_requests{mirror=%q,kind=%q} %d\n", s.Name, kind, stats.Requests)
+			fmt.Fprintf(b, "registry_mirror_hits{mirror=%q,kind=%q} %d\n", s.Name, kind, stats.Hits)
+			fmt.Fprintf(b, "registry_mirror_pulled_bytes{mirror=%q,kind=%q} %d\n", s.Name, kind, stats.BytesPulled)
+		}
+	}
+
+	m.mu.Lock()
+	last := m.lastPrepull
+	m.mu.Unlock()
+	if last != nil {
+		gauge("registry_mirror_prepull_timestamp_seconds", "When the last pre-pull finished")
+		fmt.Fprintf(b, "registry_mirror_prepull_timestamp_seconds %d\n", last.FinishedAt.Unix())
+		gauge("registry_mirror_prepull_success", "Whether the image was pulled through its mirror in the last pre-pull")
+		for _, r := range last.Results {
+			fmt.Fprintf(b, "registry_mirror_prepull_success{image=%q} %d\n", r.Image, boolMetric(r.Error == ""))
+		}
+	}
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// mirrorFor splits an image reference into its mirror, repository, and tag
+// or digest; Docker Hub short names get the implicit docker.io/library/
+func (m *MirrorManager) mirrorFor(image string) (*Mirror, string, string, error) {
+	host, rest := "docker.io", image
+	if i := strings.Index(image, "/"); i > 0 && strings.ContainsAny(image[:i], ".:") {
+		host, rest = image[:i], image[i+1:]
+	}
+	if host == "docker.io" && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+
+	repo, version := rest, "latest"
+	if i := strings.Index(rest, "@"); i >= 0 {
+		repo, version = rest[:i], rest[i+1:]
+	} else if i := strings.LastIndex(rest, ":"); i > 0 {
+		repo, version = rest[:i], rest[i+1:]
+	}
+
+	for i := range m.mirrors {
+		if m.mirrors[i].Upstream == host {
+			return &m.mirrors[i], repo, version, nil
+		}
+	}
+	return nil, "", "", fmt.Errorf("no mirror for %s", host)
+}
+
+// Prepull pulls every configured image through its mirror, manifests and
+// blobs, so the cache can serve it when the upstream is rate limiting
+func (m *MirrorManager) Prepull(ctx context.Context) *PrepullReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := &PrepullReport{StartedAt: time.Now(), Results: []PrepullResult{}}
+	for _, image := range m.prepull {
+		result := PrepullResult{Image: image}
+		if err := m.prepullImage(ctx, image, &result); err != nil {
+			log.Printf("Failed to pre-pull %s: %v", image, err)
+			result.Error = err.Error()
+		}
+		report.Results = append(report.Results, result)
+	}
+	report.FinishedAt = time.Now()
+
+	failed := 0
+	for _, r := range report.Results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	log.Printf("Pre-pulled %d images through mirrors, %d failed", len(report.Results)-failed, failed)
+	m.lastPrepull = report
+	return report
+}
+
+func (m *MirrorManager) prepullImage(ctx context.Context, image string, result *PrepullResult) error {
+	mirror, repo, version, err := m.mirrorFor(image)
+	if err != nil {
+		return err
+	}
+	client := NewRegistryClient(m.serviceURL(mirror, 5000), "")
+	// Blob downloads take longer than the client's API timeout
+	client.http = m.http
+
+	_, blobs, err := client.Blobs(ctx, repo, version)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, blob := range blobs {
+		if seen[blob.Digest] {
+			continue
+		}
+		seen[blob.Digest] = true
+		n, err := client.FetchBlob(ctx, repo, blob.Digest)
+		if err != nil {
+			return err
+		}
+		result.Blobs++
+		result.Bytes += n
+	}
+	return nil
+}
+
+// LastPrepull returns the most recent pre-pull run, if any
+func (m *MirrorManager) LastPrepull() *PrepullReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastPrepull
+}
+
+// Run applies the mirrors on startup and pre-pulls every interval; a
+// failed apply is retried at the next interval
+func (m *MirrorManager) Run(ctx context.Context, interval time.Duration) {
+	for {
+		applyCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		if err := m.Apply(applyCtx); err != nil {
+			log.Printf("Failed to apply registry mirrors: %v", err)
+		}
+		cancel()
+
+		if len(m.prepull) > 0 {
+			// Give freshly applied mirrors time to become ready
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
+			prepullCtx, cancel := context.WithTimeout(ctx, time.Hour)
+			m.Prepull(prepullCtx)
+			cancel()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// handleMirrors serves GET /mirrors
+func (s *Server) handleMirrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := s.mirrors.Status(r.Context())
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	httpkit.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"mirrors":     statuses,
+		"prepull":     s.mirrors.prepull,
+		"lastPrepull": s.mirrors.LastPrepull(),
+	})
+}
+
+// handlePrepull serves POST /mirrors/prepull, pre-pulling synchronously
+func (s *Server) handlePrepull(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, s.mirrors.Prepull(r.Context()))
+}
+
+// FetchBlob downloads a blob and discards it, returning its size
+func (c *RegistryClient) FetchBlob(ctx context.Context, repo, digest string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v2/%s/blobs/%s", c.baseURL, repo, digest), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("GET %s@%s: %s: %s", repo, digest, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return io.Copy(io.Discard, resp.Body)
+}
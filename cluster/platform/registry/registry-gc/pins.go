@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// pinsKey is the ConfigMap key holding the pins as JSON
+const pinsKey = "pins.json"
+
+// Pin exempts one image digest from retention rules
+type Pin struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	// Tag is the tag the pin was requested by, for reference only; the pin
+	// holds the digest even after the tag moves
+	Tag    string `json:"tag,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Owner identifies who pinned the digest, e.g. an Application; pinning
+	// the same digest again under the same owner refreshes the pin
+	Owner     string     `json:"owner,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// PinRequest is the body of POST /registry/pins
+type PinRequest struct {
+	// Image is repo:tag or repo@digest, optionally prefixed with one of
+	// REGISTRY_HOSTS
+	Image  string `json:"image"`
+	Reason string `json:"reason,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	// TTL expires the pin, e.g. 720h; unset pins until deleted
+	TTL string `json:"ttl,omitempty"`
+}
+
+func (p Pin) key() string {
+	return p.Repository + "@" + p.Digest
+}
+
+func (p Pin) expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !now.Before(*p.ExpiresAt)
+}
+
+// PinStore keeps pins in a ConfigMap so they survive restarts
+type PinStore struct {
+	kube      kubernetes.Interface
+	namespace string
+	name      string
+
+	// mu serialises read-modify-write cycles on the ConfigMap
+	mu sync.Mutex
+}
+
+// load returns the stored pins, expired ones included
+func (s *PinStore) load(ctx context.Context) ([]Pin, *corev1.ConfigMap, error) {
+	cm, err := s.kube.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading pins: %w", err)
+	}
+	var pins []Pin
+	if data := cm.Data[pinsKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &pins); err != nil {
+			return nil, nil, fmt.Errorf("parsing %s/%s: %w", s.name, pinsKey, err)
+		}
+	}
+	return pins, cm, nil
+}
+
+// save writes pins, dropping expired ones
+func (s *PinStore) save(ctx context.Context, cm *corev1.ConfigMap, pins []Pin) error {
+	now := time.Now()
+	kept := make([]Pin, 0, len(pins))
+	for _, p := range pins {
+		if !p.expired(now) {
+			kept = append(kept, p)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].key() != kept[j].key() {
+			return kept[i].key() < kept[j].key()
+		}
+		return kept[i].Owner < kept[j].Owner
+	})
+	data, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if cm == nil {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.name,
+				Namespace: s.namespace,
+				Labels:    map[string]string{"app": "registry-gc"},
+			},
+			Data: map[string]string{pinsKey: string(data)},
+		}
+		_, err = s.kube.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	} else {
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[pinsKey] = string(data)
+		_, err = s.kube.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("saving pins: %w", err)
+	}
+	return nil
+}
+
+// List returns the pins in effect
+func (s *PinStore) List(ctx context.Context) ([]Pin, error) {
+	pins, _, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	active := make([]Pin, 0, len(pins))
+	for _, p := range pins {
+		if !p.expired(now) {
+			active = append(active, p)
+		}
+	}
+	return active, nil
+}
+
+// Add stores pin, replacing the owner's earlier pin of the same digest
+func (s *PinStore) Add(ctx context.Context, pin Pin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins, cm, err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+	kept := pins[:0]
+	for _, p := range pins {
+		if p.key() != pin.key() || p.Owner != pin.Owner {
+			kept = append(kept, p)
+		}
+	}
+	return s.save(ctx, cm, append(kept, pin))
+}
+
+// Remove deletes the pins of repository@digest, only the owner's when
+// owner is set, and returns how many were removed
+func (s *PinStore) Remove(ctx context.Context, repository, digest, owner string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins, cm, err := s.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	kept := pins[:0]
+	for _, p := range pins {
+		if p.Repository == repository && p.Digest == digest && (owner == "" || p.Owner == owner) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	removed := len(pins) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.save(ctx, cm, kept)
+}
+
+// pinned maps repo@digest to the pins holding it. A failure is returned so
+// GC never runs without knowing what is pinned.
+func (p *Planner) pinned(ctx context.Context) (map[string][]Pin, error) {
+	pins, err := p.pins.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string][]Pin)
+	for _, pin := range pins {
+		byKey[pin.key()] = append(byKey[pin.key()], pin)
+	}
+	return byKey, nil
+}
+
+// describePins summarises why a digest is pinned for a Decision reason
+func describePins(pins []Pin) string {
+	var parts []string
+	for _, pin := range pins {
+		switch {
+		case pin.Reason != "":
+			parts = append(parts, pin.Reason)
+		case pin.Owner != "":
+			parts = append(parts, "by "+pin.Owner)
+		}
+	}
+	if len(parts) == 0 {
+		return "pinned"
+	}
+	return "pinned: " + strings.Join(parts, "; ")
+}
+
+// parseImage splits an image reference into repository and tag or digest,
+// accepting references with or without one of REGISTRY_HOSTS
+func (p *Planner) parseImage(image string) (repo, reference string, err error) {
+	ref, ok := p.registryKey(image)
+	if !ok {
+		ref = image
+		if i := strings.LastIndex(ref, ":"); !strings.Contains(ref, "@") && i <= strings.LastIndex(ref, "/") {
+			ref += ":latest"
+		}
+	}
+	if r, digest, found := strings.Cut(ref, "@"); found {
+		repo, reference = r, digest
+	} else {
+		i := strings.LastIndex(ref, ":")
+		repo, reference = ref[:i], ref[i+1:]
+	}
+	if repo == "" || reference == "" || strings.Contains(repo, ":") {
+		return "", "", fmt.Errorf("invalid image reference %q", image)
+	}
+	return repo, reference, nil
+}
+
+// handlePins serves GET, POST and DELETE /registry/pins
+func (s *Server) handlePins(w http.ResponseWriter, r *http.Request) {
+	planner := s.collector.planner
+	switch r.Method {
+	case http.MethodGet:
+		pins, err := planner.pins.List(r.Context())
+		if err != nil {
+			log.Printf("Failed to list pins: %v", err)
+			http.Error(w, "Failed to list pins", http.StatusBadGateway)
+			return
+		}
+		if repo := r.URL.Query().Get("repository"); repo != "" {
+			filtered := pins[:0]
+			for _, pin := range pins {
+				if pin.Repository == repo {
+					filtered = append(filtered, pin)
+				}
+			}
+			pins = filtered
+		}
+		httpkit.WriteJSON(w, http.StatusOK, pins)
+
+	case http.MethodPost:
+		var req PinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		repo, reference, err := planner.parseImage(req.Image)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pin := Pin{Repository: repo, Reason: req.Reason, Owner: req.Owner, CreatedAt: time.Now()}
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+			expires := pin.CreatedAt.Add(ttl)
+			pin.ExpiresAt = &expires
+		}
+
+		// Tags are resolved so the pin holds the digest, not a moving tag
+		info, err := planner.registry.Inspect(r.Context(), repo, reference)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, fmt.Sprintf("Image %s not found", req.Image), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to resolve %s: %v", req.Image, err)
+			http.Error(w, "Failed to resolve image", http.StatusBadGateway)
+			return
+		}
+		pin.Digest = info.Digest
+		if !strings.HasPrefix(reference, "sha256:") {
+			pin.Tag = reference
+		}
+
+		if err := planner.pins.Add(r.Context(), pin); err != nil {
+			log.Printf("Failed to pin %s: %v", pin.key(), err)
+			http.Error(w, "Failed to save pin", http.StatusBadGateway)
+			return
+		}
+		log.Printf("Pinned %s (owner %q, reason %q)", pin.key(), pin.Owner, pin.Reason)
+		httpkit.WriteJSON(w, http.StatusCreated, pin)
+
+	case http.MethodDelete:
+		query := r.URL.Query()
+		repo, digest := query.Get("repository"), query.Get("digest")
+		if repo == "" || !strings.HasPrefix(digest, "sha256:") {
+			http.Error(w, "repository and digest are required", http.StatusBadRequest)
+			return
+		}
+		removed, err := planner.pins.Remove(r.Context(), repo, digest, query.Get("owner"))
+		if err != nil {
+			log.Printf("Failed to unpin %s@%s: %v", repo, digest, err)
+			http.Error(w, "Failed to save pins", http.StatusBadGateway)
+			return
+		}
+		if removed == 0 {
+			http.Error(w, "Pin not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Unpinned %s@%s (%d pins)", repo, digest, removed)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Policy holds the retention rules applied to every repository
+type Policy struct {
+	// KeepLast tags per repository are always kept (newest first)
+	KeepLast int
+	// Tags beyond KeepLast are only deleted once older than MaxAge
+	MaxAge time.Duration
+	// ProtectedTags are never deleted (e.g. latest)
+	ProtectedTags []string
+	// RegistryHosts are the hostnames pods use to reference this registry
+	RegistryHosts []string
+}
+
+// Decision is the outcome for a single tag
+type Decision struct {
+	TagInfo
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	// UsedBy lists the workloads that protect the tag
+	UsedBy []ImageUser `json:"usedBy,omitempty"`
+	// Pins lists the pins that protect the tag's digest
+	Pins []Pin `json:"pins,omitempty"`
+}
+
+// Report is the result of evaluating the policy against the registry
+type Report struct {
+	GeneratedAt      time.Time  `json:"generatedAt"`
+	DryRun           bool       `json:"dryRun"`
+	Repositories     int        `json:"repositories"`
+	Kept             int        `json:"kept"`
+	Deleted          int        `json:"deleted"`
+	ReclaimableBytes int64      `json:"reclaimableBytes"`
+	Decisions        []Decision `json:"decisions"`
+	Errors           []string   `json:"errors,omitempty"`
+	GCOutput         string     `json:"gcOutput,omitempty"`
+}
+
+// Decision actions
+const (
+	ActionKeep   = "keep"
+	ActionDelete = "delete"
+)
+
+// Planner evaluates the retention policy
+type Planner struct {
+	registry *RegistryClient
+	kube     kubernetes.Interface
+	pins     *PinStore
+	policy   Policy
+}
+
+// Plan lists every tag and decides whether it is kept or deleted
+func (p *Planner) Plan(ctx context.Context) (*Report, error) {
+	inUse, err := p.imageUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pinned, err := p.pinned(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	repos, err := p.registry.Repositories(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing repositories: %w", err)
+	}
+
+	report := &Report{GeneratedAt: time.Now(), Repositories: len(repos)}
+	for _, repo := range repos {
+		decisions, err := p.planRepository(ctx, repo, inUse, pinned)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", repo, err))
+			continue
+		}
+		report.Decisions = append(report.Decisions, decisions...)
+	}
+
+	for _, d := range report.Decisions {
+		if d.Action == ActionDelete {
+			report.Deleted++
+			report.ReclaimableBytes += d.Size
+		} else {
+			report.Kept++
+		}
+	}
+	return report, nil
+}
+
+func (p *Planner) planRepository(ctx context.Context, repo string, inUse map[string][]ImageUser, pinned map[string][]Pin) ([]Decision, error) {
+	tags, err := p.registry.Tags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []TagInfo
+	for _, tag := range tags {
+		info, err := p.registry.Inspect(ctx, repo, tag)
+		if err != nil {
+			log.Printf("Skipping %s:%s: %v", repo, tag, err)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+
+	// Newest first so KeepLast counts the most recent builds
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.After(infos[j].Created) })
+
+	decisions := make([]Decision, len(infos))
+	keptDigests := make(map[string]bool)
+	for i, info := range infos {
+		d := Decision{TagInfo: info, Action: ActionDelete}
+		users := append(append([]ImageUser(nil), inUse[repo+":"+info.Tag]...), inUse[repo+"@"+info.Digest]...)
+		switch {
+		case p.isProtectedTag(info.Tag):
+			d.Action, d.Reason = ActionKeep, "protected tag"
+		case len(pinned[repo+"@"+info.Digest]) > 0:
+			d.Pins = pinned[repo+"@"+info.Digest]
+			d.Action, d.Reason = ActionKeep, describePins(d.Pins)
+		case len(users) > 0:
+			d.UsedBy = dedupeUsers(users)
+			d.Action, d.Reason = ActionKeep, "in use by "+describeUsers(d.UsedBy)
+		case i < p.policy.KeepLast:
+			d.Action, d.Reason = ActionKeep, fmt.Sprintf("within last %d tags", p.policy.KeepLast)
+		case info.Created.IsZero():
+			d.Action, d.Reason = ActionKeep, "unknown creation time"
+		case time.Since(info.Created) < p.policy.MaxAge:
+			d.Action, d.Reason = ActionKeep, fmt.Sprintf("newer than %s", p.policy.MaxAge)
+		default:
+			d.Reason = fmt.Sprintf("older than %s and beyond last %d tags", p.policy.MaxAge, p.policy.KeepLast)
+		}
+		if d.Action == ActionKeep {
+			keptDigests[info.Digest] = true
+		}
+		decisions[i] = d
+	}
+
+	// Deleting by digest removes every tag on it, so a kept tag protects its digest
+	for i := range decisions {
+		if decisions[i].Action == ActionDelete && keptDigests[decisions[i].Digest] {
+			decisions[i].Action, decisions[i].Reason = ActionKeep, "shares digest with a kept tag"
+		}
+	}
+	return decisions, nil
+}
+
+func (p *Planner) isProtectedTag(tag string) bool {
+	for _, t := range p.policy.ProtectedTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// registryKey strips a known registry host from an image reference, returning
+// repo:tag or repo@digest; ok is false for images from other registries
+func (p *Planner) registryKey(image string) (string, bool) {
+	image = strings.TrimPrefix(image, "docker-pullable://")
+	for _, host := range p.policy.RegistryHosts {
+		if !strings.HasPrefix(image, host+"/") {
+			continue
+		}
+		ref := strings.TrimPrefix(image, host+"/")
+		if strings.Contains(ref, "@") {
+			return ref, true
+		}
+		if i := strings.LastIndex(ref, ":"); i > 0 {
+			return ref, true
+		}
+		return ref + ":latest", true
+	}
+	return "", false
+}
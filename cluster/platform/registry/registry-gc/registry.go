@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/registryauth"
+)
+
+// Manifest media types accepted when resolving tags
+var manifestAccept = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}, ", ")
+
+// errNotFound is wrapped by requests for missing repositories, tags, or blobs
+var errNotFound = errors.New("not found")
+
+// RegistryClient is a minimal Docker Registry HTTP API v2 client
+type RegistryClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// TagInfo describes one tag in a repository
+type TagInfo struct {
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest"`
+	Created    time.Time `json:"created,omitempty"`
+	Size       int64     `json:"size"`
+}
+
+// NewRegistryClient logs in with the docker config at authFile, if set
+func NewRegistryClient(baseURL, authFile string) *RegistryClient {
+	return &RegistryClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    registryauth.Client(authFile, 30*time.Second),
+	}
+}
+
+func (c *RegistryClient) get(ctx context.Context, path, accept string, out interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("GET %s: %w: %s", path, errNotFound, strings.TrimSpace(string(body)))
+		}
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// Repositories lists every repository in the catalog, following pagination
+func (c *RegistryClient) Repositories(ctx context.Context) ([]string, error) {
+	var repos []string
+	path := "/v2/_catalog?n=1000"
+	for path != "" {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		header, err := c.get(ctx, path, "", &page)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, page.Repositories...)
+		path = nextLink(header)
+	}
+	return repos, nil
+}
+
+// Tags lists tags for a repository
+func (c *RegistryClient) Tags(ctx context.Context, repo string) ([]string, error) {
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+	if _, err := c.get(ctx, fmt.Sprintf("/v2/%s/tags/list", repo), "", &list); err != nil {
+		return nil, err
+	}
+	return list.Tags, nil
+}
+
+// Inspect resolves a tag to its digest, creation time, and compressed size
+func (c *RegistryClient) Inspect(ctx context.Context, repo, tag string) (*TagInfo, error) {
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+		Config    struct {
+			Digest string `json:"digest"`
+			Size   int64  `json:"size"`
+		} `json:"config"`
+		Layers []struct {
+			Size int64 `json:"size"`
+		} `json:"layers"`
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	header, err := c.get(ctx, fmt.Sprintf("/v2/%s/manifests/%s", repo, tag), manifestAccept, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TagInfo{Repository: repo, Tag: tag, Digest: header.Get("Docker-Content-Digest")}
+
+	// Multi-arch indexes have no config; report the first platform's creation time
+	if len(manifest.Manifests) > 0 && manifest.Config.Digest == "" {
+		child, err := c.Inspect(ctx, repo, manifest.Manifests[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+		info.Created, info.Size = child.Created, child.Size
+		return info, nil
+	}
+
+	info.Size = manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		info.Size += layer.Size
+	}
+
+	if manifest.Config.Digest != "" {
+		var config struct {
+			Created time.Time `json:"created"`
+		}
+		if _, err := c.get(ctx, fmt.Sprintf("/v2/%s/blobs/%s", repo, manifest.Config.Digest), "", &config); err == nil {
+			info.Created = config.Created
+		}
+	}
+	return info, nil
+}
+
+// Blob is a layer or config stored in the registry
+type Blob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// Blobs resolves a tag or digest and returns its digest with the layers and
+// configs it references; indexes contribute every platform, as all of them
+// are stored
+func (c *RegistryClient) Blobs(ctx context.Context, repo, reference string) (string, []Blob, error) {
+	var manifest struct {
+		Config    Blob   `json:"config"`
+		Layers    []Blob `json:"layers"`
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	header, err := c.get(ctx, fmt.Sprintf("/v2/%s/manifests/%s", repo, reference), manifestAccept, &manifest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var blobs []Blob
+	for _, child := range manifest.Manifests {
+		_, childBlobs, err := c.Blobs(ctx, repo, child.Digest)
+		if err != nil {
+			return "", nil, err
+		}
+		blobs = append(blobs, childBlobs...)
+	}
+	if manifest.Config.Digest != "" {
+		blobs = append(blobs, manifest.Config)
+	}
+	blobs = append(blobs, manifest.Layers...)
+	return header.Get("Docker-Content-Digest"), blobs, nil
+}
+
+// DeleteManifest deletes a manifest by digest, untagging every tag that points at it
+func (c *RegistryClient) DeleteManifest(ctx context.Context, repo, digest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repo, digest), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("DELETE %s@%s: %s: %s", repo, digest, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// nextLink extracts the path from a registry pagination Link header
+func nextLink(header http.Header) string {
+	link := header.Get("Link")
+	if link == "" {
+		return ""
+	}
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end <= start {
+		return ""
+	}
+	u, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+	return u.RequestURI()
+}
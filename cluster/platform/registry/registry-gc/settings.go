@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/homelab/internal/config"
+)
+
+// Settings are read at startup: defaults, then the -settings YAML file
+// (SETTINGS_FILE), then the environment, then flags
+type Settings struct {
+	Port string `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+
+	// Bearer tokens required by /run, pin changes, and pre-pulls
+	APIToken string `json:"-" env:"API_TOKEN"`
+	// AllowUnauthenticated opens the mutating endpoints when no credentials
+	// are set; otherwise they refuse every request
+	AllowUnauthenticated bool `json:"allowUnauthenticated" env:"ALLOW_UNAUTHENTICATED" flag:"allow-unauthenticated"`
+
+	KeepLast   int           `json:"keepLast" env:"KEEP_LAST" flag:"keep-last" usage:"newest tags kept per repository"`
+	MaxAgeDays int           `json:"maxAgeDays" env:"MAX_AGE_DAYS" flag:"max-age-days" usage:"tags younger than this are kept"`
+	Interval   time.Duration `json:"interval" env:"INTERVAL" flag:"interval" usage:"time between scheduled runs"`
+	// DryRun keeps scheduled runs to reports until it is set to false
+	DryRun        bool     `json:"dryRun" env:"DRY_RUN" flag:"dry-run" usage:"scheduled runs only report"`
+	ProtectedTags []string `json:"protectedTags" env:"PROTECTED_TAGS" flag:"protected-tags" usage:"tags never deleted, comma separated"`
+	RegistryHosts []string `json:"registryHosts" env:"REGISTRY_HOSTS" flag:"registry-hosts" usage:"registry hosts in pod image references, comma separated"`
+
+	RegistryURL       string `json:"registryURL" env:"REGISTRY_URL" flag:"registry-url" usage:"registry API"`
+	RegistryAuthFile  string `json:"registryAuthFile" env:"REGISTRY_AUTH_FILE" flag:"registry-auth-file" usage:"docker config with the registry login"`
+	RegistryNamespace string `json:"registryNamespace" env:"REGISTRY_NAMESPACE" flag:"registry-namespace"`
+	RegistrySelector  string `json:"registrySelector" env:"REGISTRY_SELECTOR" flag:"registry-selector" usage:"label selector of the registry pods"`
+	// RegistryDeployment is switched to read-only while garbage-collect runs
+	RegistryDeployment string `json:"registryDeployment" env:"REGISTRY_DEPLOYMENT" flag:"registry-deployment"`
+	PinsConfigMap      string `json:"pinsConfigMap" env:"PINS_CONFIGMAP" flag:"pins-configmap"`
+
+	// MirrorsFile is a JSON list of mirrors; without it Mirrors lists
+	// upstreams mirrored with default settings
+	MirrorsFile     string        `json:"mirrorsFile" env:"MIRRORS_FILE" flag:"mirrors-file"`
+	Mirrors         []string      `json:"mirrors" env:"MIRRORS" flag:"mirrors" usage:"upstream registries to mirror, comma separated"`
+	MirrorDomain    string        `json:"mirrorDomain" env:"MIRROR_DOMAIN" flag:"mirror-domain" usage:"mirrors get ingresses at <name>.<domain>"`
+	PrepullImages   []string      `json:"prepullImages" env:"PREPULL_IMAGES" flag:"prepull-images" usage:"images pulled through the mirrors, comma separated"`
+	PrepullInterval time.Duration `json:"prepullInterval" env:"PREPULL_INTERVAL" flag:"prepull-interval"`
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		Port:               "8080",
+		KeepLast:           5,
+		MaxAgeDays:         14,
+		Interval:           24 * time.Hour,
+		DryRun:             true,
+		ProtectedTags:      []string{"latest"},
+		RegistryHosts:      []string{"registry.home.mcztest.com"},
+		RegistryURL:        "https://docker-registry.container-registry.svc.cluster.local:5000",
+		RegistryNamespace:  "container-registry",
+		RegistrySelector:   "app=docker-registry",
+		RegistryDeployment: "docker-registry",
+		PinsConfigMap:      "registry-gc-pins",
+		PrepullInterval:    24 * time.Hour,
+	}
+}
+
+// loadSettings layers the file, environment, and flags over the defaults
+func loadSettings() (*Settings, error) {
+	s := defaultSettings()
+	if err := config.Load(s, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate implements config.Validator
+func (s *Settings) Validate() error {
+	if s.KeepLast < 0 || s.MaxAgeDays < 0 {
+		return fmt.Errorf("keep last and max age must not be negative")
+	}
+	if s.Interval <= 0 || s.PrepullInterval <= 0 {
+		return fmt.Errorf("intervals must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+// storageCacheTTL bounds how often the registry is walked; every tag costs
+// a manifest request, so scrapes reuse the last report
+const storageCacheTTL = 5 * time.Minute
+
+// TagStorage is one tag's share of the registry
+type TagStorage struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+	// SizeBytes counts every blob of the tag; UniqueBytes only the blobs no
+	// other manifest references, i.e. what deleting the tag's digest frees
+	SizeBytes   int64 `json:"sizeBytes"`
+	UniqueBytes int64 `json:"uniqueBytes"`
+}
+
+// RepositoryStorage is one repository's share of the registry
+type RepositoryStorage struct {
+	Repository string `json:"repository"`
+	// SizeBytes counts each of the repository's blobs once; UniqueBytes only
+	// those no other repository references, i.e. what deleting the whole
+	// repository frees
+	SizeBytes   int64        `json:"sizeBytes"`
+	UniqueBytes int64        `json:"uniqueBytes"`
+	Tags        []TagStorage `json:"tags"`
+}
+
+// StorageReport is served by GET /registry/usage
+type StorageReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	// TotalBytes counts every blob once, as the registry stores them;
+	// LogicalBytes sums the tags as if nothing were shared
+	TotalBytes   int64 `json:"totalBytes"`
+	LogicalBytes int64 `json:"logicalBytes"`
+	// Repositories are sorted by size, largest first
+	Repositories []RepositoryStorage `json:"repositories"`
+	Errors       []string            `json:"errors,omitempty"`
+}
+
+// StorageUsage measures blob storage per repository and tag, counting
+// layers shared between tags and repositories once
+type StorageUsage struct {
+	registry *RegistryClient
+
+	// mu also serializes walks, so concurrent scrapes share one
+	mu     sync.Mutex
+	report *StorageReport
+}
+
+// Report returns the cached report, walking the registry again when it is
+// older than storageCacheTTL or refresh is set
+func (s *StorageUsage) Report(ctx context.Context, refresh bool) (*StorageReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !refresh && s.report != nil && time.Since(s.report.GeneratedAt) < storageCacheTTL {
+		return s.report, nil
+	}
+	report, err := s.measure(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.report = report
+	return report, nil
+}
+
+func (s *StorageUsage) measure(ctx context.Context) (*StorageReport, error) {
+	repos, err := s.registry.Repositories(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing repositories: %w", err)
+	}
+
+	type manifest struct {
+		repo, tag, digest string
+		blobs             map[string]bool
+	}
+	var manifests []manifest
+	sizes := make(map[string]int64)
+	// Owners of each blob: manifests by repo@digest, and repositories
+	blobManifests := make(map[string]map[string]bool)
+	blobRepos := make(map[string]map[string]bool)
+
+	report := &StorageReport{GeneratedAt: time.Now(), Repositories: []RepositoryStorage{}}
+	for _, repo := range repos {
+		tags, err := s.registry.Tags(ctx, repo)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", repo, err))
+			continue
+		}
+		for _, tag := range tags {
+			digest, blobs, err := s.registry.Blobs(ctx, repo, tag)
+			if err != nil {
+				log.Printf("Skipping %s:%s: %v", repo, tag, err)
+				report.Errors = append(report.Errors, fmt.Sprintf("%s:%s: %v", repo, tag, err))
+				continue
+			}
+			m := manifest{repo: repo, tag: tag, digest: digest, blobs: make(map[string]bool)}
+			key := repo + "@" + digest
+			for _, b := range blobs {
+				m.blobs[b.Digest] = true
+				sizes[b.Digest] = b.Size
+				if blobManifests[b.Digest] == nil {
+					blobManifests[b.Digest] = make(map[string]bool)
+					blobRepos[b.Digest] = make(map[string]bool)
+				}
+				blobManifests[b.Digest][key] = true
+				blobRepos[b.Digest][repo] = true
+			}
+			manifests = append(manifests, m)
+		}
+	}
+
+	for _, size := range sizes {
+		report.TotalBytes += size
+	}
+
+	byRepo := make(map[string]*RepositoryStorage)
+	repoBlobs := make(map[string]map[string]bool)
+	for _, m := range manifests {
+		rs, ok := byRepo[m.repo]
+		if !ok {
+			rs = &RepositoryStorage{Repository: m.repo, Tags: []TagStorage{}}
+			byRepo[m.repo] = rs
+			repoBlobs[m.repo] = make(map[string]bool)
+		}
+		ts := TagStorage{Tag: m.tag, Digest: m.digest}
+		for digest := range m.blobs {
+			ts.SizeBytes += sizes[digest]
+			if len(blobManifests[digest]) == 1 {
+				ts.UniqueBytes += sizes[digest]
+			}
+			repoBlobs[m.repo][digest] = true
+		}
+		report.LogicalBytes += ts.SizeBytes
+		rs.Tags = append(rs.Tags, ts)
+	}
+
+	for repo, rs := range byRepo {
+		for digest := range repoBlobs[repo] {
+			rs.SizeBytes += sizes[digest]
+			if len(blobRepos[digest]) == 1 {
+				rs.UniqueBytes += sizes[digest]
+			}
+		}
+		sort.Slice(rs.Tags, func(i, j int) bool { return rs.Tags[i].SizeBytes > rs.Tags[j].SizeBytes })
+		report.Repositories = append(report.Repositories, *rs)
+	}
+	sort.Slice(report.Repositories, func(i, j int) bool {
+		return report.Repositories[i].SizeBytes > report.Repositories[j].SizeBytes
+	})
+	return report, nil
+}
+
+// writeMetrics renders the report as Prometheus gauges
+func (r *StorageReport) writeMetrics(b *strings.Builder) {
+	gauge := func(name, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("registry_storage_bytes", "Blob bytes stored, counting shared layers once")
+	fmt.Fprintf(b, "registry_storage_bytes %d\n", r.TotalBytes)
+	gauge("registry_storage_logical_bytes", "Blob bytes summed over tags without deduplication")
+	fmt.Fprintf(b, "registry_storage_logical_bytes %d\n", r.LogicalBytes)
+	gauge("registry_storage_generated_timestamp_seconds", "When the registry was last measured")
+	fmt.Fprintf(b, "registry_storage_generated_timestamp_seconds %d\n", r.GeneratedAt.Unix())
+
+	gauge("registry_repository_size_bytes", "Blob bytes of the repository, counting shared layers once")
+	for _, repo := range r.Repositories {
+		fmt.Fprintf(b, "registry_repository_size_bytes{repository=%q} %d\n", repo.Repository, repo.SizeBytes)
+	}
+	gauge("registry_repository_unique_bytes", "Blob bytes no other repository references")
+	for _, repo := range r.Repositories {
+		fmt.Fprintf(b, "registry_repository_unique_bytes{repository=%q} %d\n", repo.Repository, repo.UniqueBytes)
+	}
+	gauge("registry_repository_tags", "Tags in the repository")
+	for _, repo := range r.Repositories {
+		fmt.Fprintf(b, "registry_repository_tags{repository=%q} %d\n", repo.Repository, len(repo.Tags))
+	}
+	gauge("registry_tag_size_bytes", "Blob bytes of the tag")
+	for _, repo := range r.Repositories {
+		for _, tag := range repo.Tags {
+			fmt.Fprintf(b, "registry_tag_size_bytes{repository=%q,tag=%q} %d\n", repo.Repository, tag.Tag, tag.SizeBytes)
+		}
+	}
+	gauge("registry_tag_unique_bytes", "Blob bytes only the tag's manifest references")
+	for _, repo := range r.Repositories {
+		for _, tag := range repo.Tags {
+			fmt.Fprintf(b, "registry_tag_unique_bytes{repository=%q,tag=%q} %d\n", repo.Repository, tag.Tag, tag.UniqueBytes)
+		}
+	}
+}
+
+// handleRegistryUsage serves GET /registry/usage as JSON, or as Prometheus
+// text with ?format=prometheus; ?refresh=true skips the cache
+func (s *Server) handleRegistryUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.storage.Report(r.Context(), r.URL.Query().Get("refresh") == "true")
+	if err != nil {
+		log.Printf("Failed to measure registry storage: %v", err)
+		http.Error(w, "Failed to measure registry storage", http.StatusBadGateway)
+		return
+	}
+	if r.URL.Query().Get("format") == "prometheus" {
+		var b strings.Builder
+		report.writeMetrics(&b)
+		writeMetrics(w, &b)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, report)
+}
+
+// handleMetrics serves the storage and mirror gauges for Prometheus scrapes
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	report, err := s.storage.Report(r.Context(), false)
+	if err != nil {
+		log.Printf("Failed to measure registry storage: %v", err)
+		http.Error(w, "Failed to measure registry storage", http.StatusBadGateway)
+		return
+	}
+	var b strings.Builder
+	report.writeMetrics(&b)
+	s.mirrors.writeMetrics(r.Context(), &b)
+	writeMetrics(w, &b)
+}
+
+func writeMetrics(w http.ResponseWriter, b *strings.Builder) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
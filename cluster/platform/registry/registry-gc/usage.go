@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageUser is a workload that references a registry image
+type ImageUser struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+}
+
+func (u ImageUser) String() string {
+	return fmt.Sprintf("%s %s/%s", u.Kind, u.Namespace, u.Name)
+}
+
+// ImageUsage maps one registry image reference to the workloads using it
+type ImageUsage struct {
+	// Reference is repo:tag or repo@digest as written by the workloads
+	Reference  string `json:"reference"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	// Missing is set when the tag or digest is not in the registry, so the
+	// workloads cannot be rescheduled
+	Missing   bool        `json:"missing"`
+	Workloads []ImageUser `json:"workloads"`
+}
+
+// UsageReport is served by GET /usage
+type UsageReport struct {
+	GeneratedAt time.Time    `json:"generatedAt"`
+	Images      []ImageUsage `json:"images"`
+	Errors      []string     `json:"errors,omitempty"`
+}
+
+// imageUsage returns the repo:tag and repo@digest keys of every registry
+// image referenced by a pod, Deployment, StatefulSet, DaemonSet, or CronJob,
+// with the workloads using each. Any listing failure is returned so GC never
+// runs on a partial view of the cluster.
+func (p *Planner) imageUsage(ctx context.Context) (map[string][]ImageUser, error) {
+	usage := make(map[string][]ImageUser)
+	add := func(kind string, meta metav1.ObjectMeta, spec *corev1.PodSpec) {
+		for _, c := range append(append([]corev1.Container(nil), spec.InitContainers...), spec.Containers...) {
+			if key, ok := p.registryKey(c.Image); ok {
+				usage[key] = append(usage[key], ImageUser{Kind: kind, Namespace: meta.Namespace, Name: meta.Name, Container: c.Name})
+			}
+		}
+	}
+
+	pods, err := p.kube.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		add("Pod", pod.ObjectMeta, &pod.Spec)
+		// Running containers also report the resolved digest
+		for _, status := range append(pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses...) {
+			if key, ok := p.registryKey(status.ImageID); ok {
+				usage[key] = append(usage[key], ImageUser{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name, Container: status.Name})
+			}
+		}
+	}
+
+	// Controllers are checked too so images survive while scaled to zero or
+	// between CronJob runs
+	deployments, err := p.kube.AppsV1().Deployments("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing deployments: %w", err)
+	}
+	for _, d := range deployments.Items {
+		add("Deployment", d.ObjectMeta, &d.Spec.Template.Spec)
+	}
+
+	statefulSets, err := p.kube.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing statefulsets: %w", err)
+	}
+	for _, s := range statefulSets.Items {
+		add("StatefulSet", s.ObjectMeta, &s.Spec.Template.Spec)
+	}
+
+	daemonSets, err := p.kube.AppsV1().DaemonSets("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing daemonsets: %w", err)
+	}
+	for _, d := range daemonSets.Items {
+		add("DaemonSet", d.ObjectMeta, &d.Spec.Template.Spec)
+	}
+
+	cronJobs, err := p.kube.BatchV1().CronJobs("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing cronjobs: %w", err)
+	}
+	for _, c := range cronJobs.Items {
+		add("CronJob", c.ObjectMeta, &c.Spec.JobTemplate.Spec.Template.Spec)
+	}
+
+	for key, users := range usage {
+		usage[key] = dedupeUsers(users)
+	}
+	return usage, nil
+}
+
+// dedupeUsers drops repeats, e.g. a pod listed for both its spec and status
+func dedupeUsers(users []ImageUser) []ImageUser {
+	seen := make(map[ImageUser]bool)
+	var out []ImageUser
+	for _, u := range users {
+		if !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].String()+out[i].Container < out[j].String()+out[j].Container })
+	return out
+}
+
+// describeUsers summarizes workloads for a decision reason
+func describeUsers(users []ImageUser) string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, u := range users {
+		if name := u.String(); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) > 3 {
+		return fmt.Sprintf("%s and %d more", strings.Join(names[:3], ", "), len(names)-3)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Usage reports every registry image the cluster references, resolving tags
+// to digests and flagging references missing from the registry
+func (p *Planner) Usage(ctx context.Context) (*UsageReport, error) {
+	usage, err := p.imageUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{GeneratedAt: time.Now(), Images: []ImageUsage{}}
+	for ref, users := range usage {
+		image := ImageUsage{Reference: ref, Workloads: users}
+		if i := strings.Index(ref, "@"); i >= 0 {
+			image.Repository, image.Digest = ref[:i], ref[i+1:]
+		} else {
+			i := strings.LastIndex(ref, ":")
+			image.Repository, image.Tag = ref[:i], ref[i+1:]
+		}
+
+		// Inspect accepts a tag or a digest
+		version := image.Tag
+		if version == "" {
+			version = image.Digest
+		}
+		info, err := p.registry.Inspect(ctx, image.Repository, version)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				image.Missing = true
+			} else {
+				log.Printf("Failed to inspect %s: %v", ref, err)
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", ref, err))
+			}
+		} else if image.Digest == "" {
+			image.Digest = info.Digest
+		}
+		report.Images = append(report.Images, image)
+	}
+
+	sort.Slice(report.Images, func(i, j int) bool { return report.Images[i].Reference < report.Images[j].Reference })
+	return report, nil
+}
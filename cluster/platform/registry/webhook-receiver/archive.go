@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+// archivePrefix is where payloads are stored in the bucket
+const archivePrefix = "webhooks/"
+
+// deliveryPattern matches Gitea's X-Gitea-Delivery UUIDs
+var deliveryPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// ArchivedWebhook is a raw webhook delivery as stored in object storage
+type ArchivedWebhook struct {
+	Delivery   string            `json:"delivery"`
+	Event      string            `json:"event"`
+	ReceivedAt time.Time         `json:"receivedAt"`
+	Headers    map[string]string `json:"headers"`
+	Payload    json.RawMessage   `json:"payload"`
+}
+
+// PayloadArchive keeps raw webhook payloads in S3 for a retention period
+type PayloadArchive struct {
+	s3        *S3Client
+	retention time.Duration
+}
+
+func NewPayloadArchive(s3 *S3Client, retention time.Duration) *PayloadArchive {
+	return &PayloadArchive{s3: s3, retention: retention}
+}
+
+// Store archives a delivery; requests without a delivery ID are skipped
+func (a *PayloadArchive) Store(ctx context.Context, header http.Header, body []byte) error {
+	delivery := header.Get("X-Gitea-Delivery")
+	if !deliveryPattern.MatchString(delivery) {
+		return nil
+	}
+
+	headers := make(map[string]string)
+	for name := range header {
+		if strings.HasPrefix(name, "X-Gitea-") || name == "Content-Type" || name == "User-Agent" {
+			headers[name] = header.Get(name)
+		}
+	}
+	payload := json.RawMessage(body)
+	if !json.Valid(body) {
+		// Keep malformed payloads too; they are the ones worth debugging
+		payload, _ = json.Marshal(string(body))
+	}
+
+	data, err := json.Marshal(ArchivedWebhook{
+		Delivery:   delivery,
+		Event:      header.Get("X-Gitea-Event"),
+		ReceivedAt: time.Now().UTC(),
+		Headers:    headers,
+		Payload:    payload,
+	})
+	if err != nil {
+		return err
+	}
+	return a.s3.Put(ctx, archivePrefix+delivery+".json", "application/json", data)
+}
+
+// Get returns an archived delivery, or nil if it is not in the archive
+func (a *PayloadArchive) Get(ctx context.Context, delivery string) (*ArchivedWebhook, error) {
+	data, err := a.s3.Get(ctx, archivePrefix+delivery+".json")
+	if errors.Is(err, errObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var webhook ArchivedWebhook
+	if err := json.Unmarshal(data, &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// Prune deletes payloads older than the retention period
+func (a *PayloadArchive) Prune(ctx context.Context) (int, error) {
+	return pruneObjects(ctx, a.s3, archivePrefix, a.retention)
+}
+
+// Run prunes the archive every hour until ctx is cancelled
+func (a *PayloadArchive) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		n, err := a.Prune(ctx)
+		if err != nil {
+			log.Printf("Failed to prune webhook archive: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d webhook payloads older than %s", n, a.retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleArchivedWebhook serves archived payloads:
+//
+//	GET /webhooks/<delivery>
+func (s *Server) handleArchivedWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.archive == nil {
+		http.Error(w, "Webhook archive is not configured", http.StatusNotFound)
+		return
+	}
+
+	delivery := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+	if !deliveryPattern.MatchString(delivery) {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	webhook, err := s.archive.Get(r.Context(), delivery)
+	if err != nil {
+		log.Printf("Failed to load archived webhook %s: %v", delivery, err)
+		http.Error(w, "Failed to load webhook", http.StatusBadGateway)
+		return
+	}
+	if webhook == nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, webhook)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// artifactPrefix is where build artifacts are stored in the bucket
+const artifactPrefix = "artifacts/"
+
+// artifactTokenAnnotation holds the token a job uploads its artifacts with
+const artifactTokenAnnotation = "homelab.mcztest.com/artifact-token"
+
+// maxArtifactSize caps one uploaded artifact tarball
+const maxArtifactSize = 256 << 20
+
+// Artifact is a file or directory kept from the build, uploaded as
+// <name>.tar.gz. Without a stage, path is relative to the workspace the
+// pipeline steps share; with one, the Dockerfile stage is built and path is
+// read from its filesystem.
+type Artifact struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Stage string `json:"stage,omitempty"`
+}
+
+func validateArtifacts(artifacts []Artifact) error {
+	seen := make(map[string]bool)
+	for i, a := range artifacts {
+		if !stepNamePattern.MatchString(a.Name) {
+			return fmt.Errorf("artifacts[%d]: name %q must be lowercase alphanumerics and dashes", i, a.Name)
+		}
+		if seen[a.Name] {
+			return fmt.Errorf("artifacts: duplicate name %q", a.Name)
+		}
+		seen[a.Name] = true
+		if a.Path == "" || strings.ContainsAny(a.Path, " \t\n") || strings.Contains(a.Path, "..") {
+			return fmt.Errorf("artifacts[%d]: path %q must be set and contain no spaces or ..", i, a.Path)
+		}
+		if a.Stage != "" && strings.ContainsAny(a.Stage, " \t\n") {
+			return fmt.Errorf("artifacts[%d]: invalid stage %q", i, a.Stage)
+		}
+	}
+	return nil
+}
+
+// artifactScript unpacks the exported stage images, then tars and uploads
+// each artifact. ARTIFACTS has one "name stage path" line per artifact,
+// where stage is an index into the exported images or "-".
+const artifactScript = `set -eu
+mkdir -p /tmp/artifacts
+echo "$ARTIFACTS" | while read -r name stage path; do
+  [ -n "$name" ] || continue
+  root="$WORKSPACE"
+  if [ "$stage" != "-" ]; then
+    dir="$WORKSPACE/.artifacts/$stage"
+    root="$dir/rootfs"
+    if [ ! -d "$root" ]; then
+      mkdir -p "$root" "$dir/image"
+      tar -xf "$dir.tar" -C "$dir/image"
+      for layer in $(sed 's/.*"Layers":\[\([^]]*\)\].*/\1/' "$dir/image/manifest.json" | tr ',' ' ' | tr -d '"'); do
+        tar -xf "$dir/image/$layer" -C "$root"
+      done
+    fi
+  fi
+  if [ ! -e "$root/$path" ]; then
+    echo "Artifact $name: $path not found"
+    exit 1
+  fi
+  tar -czf "/tmp/artifacts/$name.tar.gz" -C "$(dirname "$root/$path")" "$(basename "$path")"
+  wget -q -O - --header="X-Artifact-Token: $ARTIFACT_TOKEN" --header="Content-Type: application/gzip" \
+    --post-file="/tmp/artifacts/$name.tar.gz" "$UPLOAD_URL/$name"
+  echo "Uploaded $name ($(wc -c < "/tmp/artifacts/$name.tar.gz") bytes)"
+done
+`
+
+// newArtifactToken returns the secret a build job uploads its artifacts with
+func newArtifactToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails when the OS has no entropy source
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// addArtifacts extends a build job to collect the declared artifacts. In a
+// pipeline every step becomes an init container and the upload runs last;
+// a plain build exports the stages and uploads before the image build.
+func addArtifacts(cfg *Config, job *batchv1.Job, src BuildSource, opts BuildOptions, artifacts []Artifact) {
+	spec := &job.Spec.Template.Spec
+	token := newArtifactToken()
+	job.Annotations[artifactTokenAnnotation] = token
+
+	var stages []string
+	var lines []string
+	for _, a := range artifacts {
+		stage := "-"
+		if a.Stage != "" {
+			i := indexOf(stages, a.Stage)
+			if i < 0 {
+				stages = append(stages, a.Stage)
+				i = len(stages) - 1
+			}
+			stage = strconv.Itoa(i)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s", a.Name, stage, a.Path))
+	}
+
+	upload := corev1.Container{
+		Name:    "artifacts",
+		Image:   cfg.CloneImage,
+		Command: []string{"sh", "-c", artifactScript},
+		Env: []corev1.EnvVar{
+			{Name: "WORKSPACE", Value: workspaceDir},
+			{Name: "ARTIFACTS", Value: strings.Join(lines, "\n")},
+			{Name: "ARTIFACT_TOKEN", Value: token},
+			{Name: "UPLOAD_URL", Value: strings.TrimSuffix(cfg.ReceiverURL, "/") + "/artifacts/" + job.Name},
+		},
+		VolumeMounts: []corev1.VolumeMount{workspaceMount},
+	}
+
+	if isPipelineJob(job) {
+		spec.InitContainers = append(spec.InitContainers, spec.Containers...)
+		spec.Containers = []corev1.Container{upload}
+		return
+	}
+
+	for i, stage := range stages {
+		stageOpts := opts
+		stageOpts.Target = stage
+		c := kanikoContainer(cfg, src, fmt.Sprintf("stage-%d", i), "dir://"+workspaceDir, stageOpts)
+		var args []string
+		for _, arg := range c.Args {
+			if !strings.HasPrefix(arg, "--destination=") {
+				args = append(args, arg)
+			}
+		}
+		c.Args = append(args, "--no-push", "--destination="+src.image(cfg),
+			fmt.Sprintf("--tar-path=%s/.artifacts/%d.tar", workspaceDir, i))
+		spec.InitContainers = append(spec.InitContainers, c)
+	}
+	spec.InitContainers = append(spec.InitContainers, upload)
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// BuildArtifact is one stored artifact of a build
+type BuildArtifact struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"sizeBytes"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	URL        string    `json:"url"`
+}
+
+// ArtifactStore keeps build artifacts in S3 for the history retention
+type ArtifactStore struct {
+	s3        *S3Client
+	retention time.Duration
+}
+
+func NewArtifactStore(s3 *S3Client, retention time.Duration) *ArtifactStore {
+	return &ArtifactStore{s3: s3, retention: retention}
+}
+
+func artifactKey(buildID, name string) string {
+	return artifactPrefix + buildID + "/" + name + ".tar.gz"
+}
+
+func (a *ArtifactStore) Put(ctx context.Context, buildID, name string, data []byte) error {
+	return a.s3.Put(ctx, artifactKey(buildID, name), "application/gzip", data)
+}
+
+// Get returns an artifact tarball, or nil if it does not exist
+func (a *ArtifactStore) Get(ctx context.Context, buildID, name string) ([]byte, error) {
+	data, err := a.s3.Get(ctx, artifactKey(buildID, name))
+	if errors.Is(err, errObjectNotFound) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// List returns a build's artifacts; matrix variants' are named variant/name
+func (a *ArtifactStore) List(ctx context.Context, buildID string) ([]BuildArtifact, error) {
+	prefix := artifactPrefix + buildID + "/"
+	objects, err := a.s3.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	artifacts := []BuildArtifact{}
+	for _, obj := range objects {
+		name := strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), ".tar.gz")
+		artifacts = append(artifacts, BuildArtifact{
+			Name:       name,
+			Size:       obj.Size,
+			UploadedAt: obj.LastModified,
+			URL:        "/builds/" + buildID + "/artifacts/" + name,
+		})
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Name < artifacts[j].Name })
+	return artifacts, nil
+}
+
+// Run prunes artifacts past the retention every hour until ctx is cancelled
+func (a *ArtifactStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		n, err := pruneObjects(ctx, a.s3, artifactPrefix, a.retention)
+		if err != nil {
+			log.Printf("Failed to prune build artifacts: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d build artifacts older than %s", n, a.retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneObjects deletes objects under prefix last modified before retention
+func pruneObjects(ctx context.Context, s3 *S3Client, prefix string, retention time.Duration) (int, error) {
+	objects, err := s3.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-retention)
+	deleted := 0
+	for _, obj := range objects {
+		if obj.LastModified.After(cutoff) {
+			continue
+		}
+		if err := s3.Delete(ctx, obj.Key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// handleArtifactUpload receives artifacts from build jobs, authenticated by
+// the token annotated on the job:
+//
+//	POST /artifacts/<job-name>/<artifact>
+func (s *Server) handleArtifactUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.artifacts == nil {
+		http.Error(w, "Artifact storage is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	jobName, name, ok := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/artifacts"), "/"), "/")
+	if !ok || !stepNamePattern.MatchString(name) {
+		http.Error(w, "Invalid artifact path", http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.kube.BatchV1().Jobs(buildNamespace).Get(r.Context(), jobName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load job %s: %v", jobName, err)
+		http.Error(w, "Failed to load build", http.StatusInternalServerError)
+		return
+	}
+	token := job.Annotations[artifactTokenAnnotation]
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Artifact-Token")), []byte(token)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxArtifactSize+1))
+	if err != nil {
+		http.Error(w, "Failed to read artifact", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxArtifactSize {
+		http.Error(w, fmt.Sprintf("Artifact exceeds %s", formatBytes(maxArtifactSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Matrix variants store under the build they report into
+	buildID := job.Name
+	if id := job.Annotations[matrixAnnotation]; id != "" {
+		buildID = id
+		name = job.Annotations[variantAnnotation] + "/" + name
+	}
+	if err := s.artifacts.Put(r.Context(), buildID, name, data); err != nil {
+		log.Printf("Failed to store artifact %s of %s: %v", name, buildID, err)
+		http.Error(w, "Failed to store artifact", http.StatusBadGateway)
+		return
+	}
+	log.Printf("Stored artifact %s of %s (%s)", name, buildID, formatBytes(int64(len(data))))
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Stored %s", name)
+}
+
+// handleBuildArtifacts lists or downloads a build's artifacts:
+//
+//	GET /builds/<id>/artifacts
+//	GET /builds/<id>/artifacts/<name>
+func (s *Server) handleBuildArtifacts(w http.ResponseWriter, r *http.Request, buildID, name string) {
+	if s.artifacts == nil {
+		http.Error(w, "Artifact storage is not configured", http.StatusNotFound)
+		return
+	}
+
+	if name == "" {
+		list, err := s.artifacts.List(r.Context(), buildID)
+		if err != nil {
+			log.Printf("Failed to list artifacts of %s: %v", buildID, err)
+			http.Error(w, "Failed to list artifacts", http.StatusBadGateway)
+			return
+		}
+		httpkit.WriteJSON(w, http.StatusOK, list)
+		return
+	}
+
+	data, err := s.artifacts.Get(r.Context(), buildID, name)
+	if err != nil {
+		log.Printf("Failed to load artifact %s of %s: %v", name, buildID, err)
+		http.Error(w, "Failed to load artifact", http.StatusBadGateway)
+		return
+	}
+	if data == nil {
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", buildID+"-"+path.Base(name)+".tar.gz"))
+	w.Write(data)
+}
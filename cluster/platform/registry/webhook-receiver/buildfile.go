@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// buildFile is read from the pushed commit alongside .pipeline.yaml
+const buildFile = ".build.yaml"
+
+// Annotations carrying the image size budget from webhook to tracker
+const (
+	maxImageSizeAnnotation    = "homelab.mcztest.com/max-image-size"
+	imageSizeActionAnnotation = "homelab.mcztest.com/image-size-action"
+)
+
+// Image size budget actions
+const (
+	SizeActionFail = "fail"
+	SizeActionWarn = "warn"
+)
+
+// BuildFile is the .build.yaml schema:
+//
+//	imageSize:
+//	  max: 250Mi      # compressed size of the pushed image (config + layers)
+//	  action: fail    # fail (default) or warn
+//	dependsOn:        # apps whose :latest image this Dockerfile builds FROM;
+//	- base-image      # a successful build of one rebuilds this app
+//	matrix:           # one job per entry, run in parallel, tagged <commit>-<name>
+//	- name: alpine
+//	  buildArgs: {BASE: "alpine:3.19"}
+//	- name: debian
+//	  dockerfile: Dockerfile.debian
+//	  target: runtime
+//	  default: true   # also pushes <commit> (and :latest); defaults to the first
+//	platforms:        # one job per arch on nodes of that arch, tagged
+//	- amd64           # <commit>-<arch>, with its own cache repo; <commit>
+//	- arm64           # (and :latest) become a manifest list of them
+//	language: rust    # picks the config's buildClasses entry; defaults to
+//	                  # the repo's main language as Gitea detects it
+//	registry: ghcr    # pushes to the config's registries entry of that name
+//	                  # instead of the default registry
+//	artifacts:        # kept per build, GET /builds/<id>/artifacts
+//	- name: coverage
+//	  path: coverage.out       # left in the workspace by a pipeline step
+//	- name: binaries
+//	  stage: builder           # Dockerfile stage to read path from
+//	  path: /out/
+type BuildFile struct {
+	ImageSize *SizeBudget   `json:"imageSize,omitempty"`
+	DependsOn []string      `json:"dependsOn,omitempty"`
+	Matrix    []MatrixEntry `json:"matrix,omitempty"`
+	Platforms []string      `json:"platforms,omitempty"`
+	Language  string        `json:"language,omitempty"`
+	// Registry names a destination from the server's registries to push to
+	Registry  string     `json:"registry,omitempty"`
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+}
+
+// SizeBudget caps the compressed size of the pushed image
+type SizeBudget struct {
+	Max    resource.Quantity `json:"max"`
+	Action string            `json:"action,omitempty"`
+}
+
+func (b *BuildFile) validate() error {
+	for _, app := range b.DependsOn {
+		if !stepNamePattern.MatchString(app) {
+			return fmt.Errorf("dependsOn: %q is not a valid app name", app)
+		}
+	}
+	if err := validateMatrix(b.Matrix); err != nil {
+		return err
+	}
+	if err := validatePlatforms(b.Platforms); err != nil {
+		return err
+	}
+	if len(b.Platforms) > 0 && len(b.Matrix) > 0 {
+		return fmt.Errorf("platforms cannot be combined with matrix")
+	}
+	if err := validateArtifacts(b.Artifacts); err != nil {
+		return err
+	}
+	if b.ImageSize == nil {
+		return nil
+	}
+	if b.ImageSize.Max.Sign() <= 0 {
+		return fmt.Errorf("imageSize.max must be positive")
+	}
+	switch b.ImageSize.Action {
+	case "":
+		b.ImageSize.Action = SizeActionFail
+	case SizeActionFail, SizeActionWarn:
+	default:
+		return fmt.Errorf("imageSize.action must be %q or %q", SizeActionFail, SizeActionWarn)
+	}
+	return nil
+}
+
+// annotate records the budget on the build job for the tracker
+func (b *BuildFile) annotate(annotations map[string]string) {
+	if b == nil || b.ImageSize == nil {
+		return
+	}
+	annotations[maxImageSizeAnnotation] = b.ImageSize.Max.String()
+	annotations[imageSizeActionAnnotation] = b.ImageSize.Action
+}
+
+// fetchBuildFile reads .build.yaml at commit from Gitea; a missing file
+// returns nil. As with fetchPipeline, only an invalid file is an
+// invalidBuildError.
+func fetchBuildFile(ctx context.Context, cfg *Config, fullName, commit string) (*BuildFile, error) {
+	data, err := fetchRepoFile(ctx, cfg, fullName, commit, buildFile)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var b BuildFile
+	if err := yaml.UnmarshalStrict(data, &b); err != nil {
+		return nil, &invalidBuildError{fmt.Errorf("parsing %s: %w", buildFile, err)}
+	}
+	if err := b.validate(); err != nil {
+		return nil, &invalidBuildError{fmt.Errorf("%s: %w", buildFile, err)}
+	}
+	return &b, nil
+}
+
+// checkSizeBudget compares a pushed image against the budget annotated on its
+// job, returning a message when it is over and whether the build should fail
+func checkSizeBudget(annotations map[string]string, image string, size int64) (string, bool) {
+	limit, ok := annotations[maxImageSizeAnnotation]
+	if !ok {
+		return "", false
+	}
+	max, err := resource.ParseQuantity(limit)
+	if err != nil || size <= max.Value() {
+		return "", false
+	}
+
+	action := annotations[imageSizeActionAnnotation]
+	msg := fmt.Sprintf("Image size budget exceeded: %s is %s compressed, over the %s limit in %s by %s",
+		image, formatBytes(size), limit, buildFile, formatBytes(size-max.Value()))
+	if action == SizeActionWarn {
+		return "WARNING: " + msg, false
+	}
+	return "FAILED: " + msg, true
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
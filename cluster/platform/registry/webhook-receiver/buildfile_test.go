@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFetchBuildFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			file: "imageSize:\n  max: 250Mi\ndependsOn: [base-image]\nmatrix:\n- name: alpine\n  buildArgs: {BASE: alpine}\n- name: debian\n  default: true\n",
+		},
+		{name: "unknown field", file: "depends: [base]\n", wantErr: "parsing .build.yaml"},
+		{name: "invalid dependency", file: "dependsOn: [Base_Image]\n", wantErr: "not a valid app name"},
+		{name: "two defaults", file: "matrix:\n- name: a\n  default: true\n- name: b\n  default: true\n", wantErr: "only one entry"},
+		{name: "unsupported platform", file: "platforms: [s390x]\n", wantErr: "unsupported arch"},
+		{name: "matrix and platforms", file: "platforms: [amd64]\nmatrix:\n- name: a\n", wantErr: "cannot be combined"},
+		{name: "artifact path", file: "artifacts:\n- name: out\n  path: ../secrets\n", wantErr: "path"},
+		{name: "zero image size", file: "imageSize:\n  max: 0\n", wantErr: "must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestGitea(t, repoFiles(map[string]string{buildFile: tt.file}))
+			b, err := fetchBuildFile(context.Background(), cfg, "owner/app", testCommit)
+			if tt.wantErr != "" {
+				var invalid *invalidBuildError
+				if !errors.As(err, &invalid) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want invalid build %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The default action is filled in
+			if b.ImageSize.Action != SizeActionFail || len(b.Matrix) != 2 {
+				t.Fatalf("build file = %+v", b)
+			}
+		})
+	}
+}
+
+func TestCheckSizeBudget(t *testing.T) {
+	annotations := map[string]string{maxImageSizeAnnotation: "100Mi", imageSizeActionAnnotation: SizeActionFail}
+	if msg, fail := checkSizeBudget(annotations, "app:1", 50<<20); msg != "" || fail {
+		t.Fatalf("under budget: %q, %v", msg, fail)
+	}
+	if msg, fail := checkSizeBudget(annotations, "app:1", 150<<20); !strings.HasPrefix(msg, "FAILED") || !fail {
+		t.Fatalf("over budget: %q, %v", msg, fail)
+	}
+	annotations[imageSizeActionAnnotation] = SizeActionWarn
+	if msg, fail := checkSizeBudget(annotations, "app:1", 150<<20); !strings.HasPrefix(msg, "WARNING") || fail {
+		t.Fatalf("over budget with warn: %q, %v", msg, fail)
+	}
+}
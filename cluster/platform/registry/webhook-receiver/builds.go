@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/homelab/internal/httpkit"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// handleBuilds serves build history:
+//
+//	GET /builds?app=<name>&limit=<n>
+//	GET /builds/<job-name>
+//	GET /builds/<job-name>/artifacts[/<name>]
+//	GET /builds/<job-name>/provenance
+//	GET /builds/events                  server-sent events, see handleBuildEvents
+func (s *Server) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/builds"), "/")
+	if buildID, rest, ok := strings.Cut(id, "/"); ok {
+		if rest == "provenance" {
+			s.handleBuildProvenance(w, r, buildID)
+			return
+		}
+		name, isArtifacts := strings.CutPrefix(rest, "artifacts")
+		if !isArtifacts || (name != "" && !strings.HasPrefix(name, "/")) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		s.handleBuildArtifacts(w, r, buildID, strings.Trim(name, "/"))
+		return
+	}
+
+	if id != "" {
+		build, err := s.history.Get(r.Context(), id)
+		if err != nil {
+			log.Printf("Failed to load build %s: %v", id, err)
+			http.Error(w, "Failed to load build", http.StatusInternalServerError)
+			return
+		}
+		if build == nil {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		// Steps are stored when the build finishes; read them live until then
+		if build.FinishedAt == nil {
+			job, err := s.kube.BatchV1().Jobs(buildNamespace).Get(r.Context(), id, metav1.GetOptions{})
+			if err == nil && isPipelineJob(job) {
+				if pod := latestPod(r.Context(), s.kube, job); pod != nil {
+					build.Steps = stepStatuses(pod)
+				}
+			}
+		}
+		httpkit.WriteJSON(w, http.StatusOK, build)
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	builds, err := s.history.List(r.Context(), r.URL.Query().Get("app"), limit)
+	if err != nil {
+		log.Printf("Failed to list builds: %v", err)
+		http.Error(w, "Failed to list builds", http.StatusInternalServerError)
+		return
+	}
+	if builds == nil {
+		builds = []BuildRecord{}
+	}
+	httpkit.WriteJSON(w, http.StatusOK, builds)
+}
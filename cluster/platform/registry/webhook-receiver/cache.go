@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+// CacheEntry is one file in the shared kaniko cache
+type CacheEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// CacheReport summarises the shared kaniko cache volume
+type CacheReport struct {
+	Path         string       `json:"path"`
+	TotalBytes   int64        `json:"totalBytes"`
+	Files        int          `json:"files"`
+	Entries      []CacheEntry `json:"entries,omitempty"`
+	Pruned       int          `json:"pruned,omitempty"`
+	PrunedBytes  int64        `json:"prunedBytes,omitempty"`
+	PruneCutoff  *time.Time   `json:"pruneCutoff,omitempty"`
+	ScanDuration string       `json:"scanDuration"`
+}
+
+// scanCache walks dir, deleting files last modified before cutoff when set
+func scanCache(dir string, cutoff time.Time) (*CacheReport, error) {
+	start := time.Now()
+	report := &CacheReport{Path: dir}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		if !cutoff.IsZero() && info.ModTime().Before(cutoff) {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to prune %s: %v", path, err)
+			} else {
+				report.Pruned++
+				report.PrunedBytes += info.Size()
+				return nil
+			}
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		report.Files++
+		report.TotalBytes += info.Size()
+		report.Entries = append(report.Entries, CacheEntry{Name: rel, Size: info.Size(), Modified: info.ModTime().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(report.Entries, func(i, j int) bool { return report.Entries[i].Size > report.Entries[j].Size })
+	if !cutoff.IsZero() {
+		c := cutoff.UTC()
+		report.PruneCutoff = &c
+	}
+	report.ScanDuration = time.Since(start).Round(time.Millisecond).String()
+	return report, nil
+}
+
+// handleCache reports or prunes the shared cache volume mounted at CACHE_DIR:
+//
+//	GET  /cache                        size and largest entries
+//	POST /cache/prune?olderThan=168h   delete entries not used since
+func (s *Server) handleCache(w http.ResponseWriter, r *http.Request) {
+	dir := s.cacheDir
+	if _, err := os.Stat(dir); err != nil {
+		http.Error(w, "Cache volume not mounted", http.StatusNotFound)
+		return
+	}
+
+	var cutoff time.Time
+	switch {
+	case r.URL.Path == "/cache" && r.Method == http.MethodGet:
+	case r.URL.Path == "/cache/prune" && r.Method == http.MethodPost:
+		olderThan, err := time.ParseDuration(r.URL.Query().Get("olderThan"))
+		if err != nil || olderThan <= 0 {
+			http.Error(w, "Invalid olderThan duration", http.StatusBadRequest)
+			return
+		}
+		cutoff = time.Now().Add(-olderThan)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	report, err := scanCache(dir, cutoff)
+	if err != nil {
+		log.Printf("Failed to scan cache: %v", err)
+		http.Error(w, "Failed to scan cache", http.StatusInternalServerError)
+		return
+	}
+	if report.Pruned > 0 {
+		log.Printf("Pruned %d cache files (%d bytes)", report.Pruned, report.PrunedBytes)
+	}
+
+	// Keep responses small on large caches
+	if len(report.Entries) > 50 {
+		report.Entries = report.Entries[:50]
+	}
+	httpkit.WriteJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GiteaRelease is the payload of a release event
+type GiteaRelease struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName    string `json:"tag_name"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+	} `json:"release"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+		Owner    struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+// chartVersionPattern is SemVer 2, which Helm requires of chart versions
+var chartVersionPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// chartScript lints, packages, and pushes the chart. oci:// repositories are
+// pushed with helm push; http(s) ones are uploaded to ChartMuseum's API.
+const chartScript = `set -eu
+cd "$WORKSPACE/$CHART_DIR"
+if grep -q '^dependencies:' Chart.yaml; then
+  helm dependency build .
+fi
+helm lint .
+helm package . --version "$CHART_VERSION" --app-version "$CHART_VERSION" --destination /tmp/charts
+package=$(ls /tmp/charts/*.tgz)
+case "$CHART_REPO" in
+oci://*)
+  helm push "$package" "$CHART_REPO" $HELM_PUSH_FLAGS
+  ;;
+*)
+  wget -q -O - --post-file="$package" --header="Content-Type: application/octet-stream" "${CHART_REPO%/}/api/charts"
+  echo
+  ;;
+esac
+echo "Published $(basename "$package") to $CHART_REPO"
+`
+
+// handleRelease publishes the repository's Helm chart for a published release
+func (s *Server) handleRelease(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	var event GiteaRelease
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		log.Printf("Failed to decode release webhook: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if cfg.ChartRepo == "" {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Chart publishing is disabled")
+		return
+	}
+	if event.Action != "published" || event.Release.Draft {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Ignoring %s release", event.Action)
+		return
+	}
+
+	fullName := event.Repository.FullName
+	if fullName == "" {
+		fullName = event.Repository.Owner.Login + "/" + event.Repository.Name
+	}
+	if !cfg.Repos.Allowed(fullName) {
+		log.Printf("Ignoring release for filtered repo: %s", fullName)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Repository %s is not enabled for builds", fullName)
+		return
+	}
+
+	tag := event.Release.TagName
+	version := strings.TrimPrefix(tag, "v")
+	if !chartVersionPattern.MatchString(version) {
+		log.Printf("Ignoring release %s of %s: not a SemVer version", tag, fullName)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Release %s is not a SemVer version; no chart published", tag)
+		return
+	}
+
+	// Without a configured chartDir, chart/ is used, then the layout
+	// generated by pk8s new app
+	candidates := []string{"chart", "deploy/helm/" + event.Repository.Name}
+	if dir := cfg.SettingsFor(fullName).ChartDir; dir != "" {
+		candidates = []string{dir}
+	}
+	chartDir := ""
+	for _, dir := range candidates {
+		chart, err := fetchRepoFile(r.Context(), cfg, fullName, tag, dir+"/Chart.yaml")
+		if err != nil {
+			log.Printf("Failed to look up chart of %s@%s: %v", fullName, tag, err)
+			http.Error(w, "Failed to look up chart", http.StatusBadGateway)
+			return
+		}
+		if chart != nil {
+			chartDir = dir
+			break
+		}
+	}
+	if chartDir == "" {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "No Chart.yaml in %s of %s; nothing to publish", strings.Join(candidates, " or "), tag)
+		return
+	}
+
+	gitURL := strings.Replace(event.Repository.CloneURL, "https://", "http://", 1)
+	gitURL = strings.Replace(gitURL, cfg.GiteaHost, cfg.GiteaInternalHost, 1)
+
+	// The clone container checks out the tag as both branch and commit
+	src := BuildSource{App: event.Repository.Name, GitURL: gitURL, Branch: tag, Commit: tag, Tag: version}
+	job := createChartJob(cfg, src, chartDir, cfg.SettingsFor(fullName))
+	job.Annotations = map[string]string{
+		repoAnnotation:   fullName,
+		commitAnnotation: tag,
+	}
+
+	if err := admit(r.Context(), cfg, job); err != nil {
+		var denied *policyDeniedError
+		if errors.As(err, &denied) {
+			http.Error(w, "Chart "+denied.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Failed to admit chart job for %s@%s: %v", fullName, tag, err)
+		http.Error(w, "Failed to evaluate build policy", http.StatusInternalServerError)
+		return
+	}
+	harden(cfg, job)
+	created, err := s.kube.BatchV1().Jobs(buildNamespace).Create(r.Context(), job, metav1.CreateOptions{})
+	if err != nil {
+		log.Printf("Failed to create chart job for %s@%s: %v", fullName, tag, err)
+		http.Error(w, "Failed to create chart job", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Publishing chart %s %s to %s (job %s)", src.App, version, cfg.ChartRepo, created.Name)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Chart job created for %s %s", src.App, version)
+}
+
+// createChartJob clones the release tag and runs helm lint, package, and push
+func createChartJob(cfg *Config, src BuildSource, chartDir string, settings RepoSettings) *batchv1.Job {
+	opts := BuildOptions{Submodules: settings.Submodules, LFS: settings.LFS}
+	pushFlags := ""
+	if cfg.ChartPlainHTTP {
+		pushFlags = "--plain-http"
+	}
+	spec := basePodSpec(cfg, opts)
+	addWorkspace(&spec)
+	spec.InitContainers = []corev1.Container{cloneContainer(cfg, src, opts)}
+	spec.Containers = []corev1.Container{{
+		Name:    "helm",
+		Image:   cfg.HelmImage,
+		Command: []string{"sh", "-c", chartScript},
+		Env: []corev1.EnvVar{
+			{Name: "WORKSPACE", Value: workspaceDir},
+			{Name: "CHART_DIR", Value: chartDir},
+			{Name: "CHART_VERSION", Value: src.Tag},
+			{Name: "CHART_REPO", Value: cfg.ChartRepo},
+			{Name: "HELM_PUSH_FLAGS", Value: pushFlags},
+			// Same docker config kaniko pushes images with
+			{Name: "HELM_REGISTRY_CONFIG", Value: "/kaniko/.docker/config.json"},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			workspaceMount,
+			{Name: "docker-config", MountPath: "/kaniko/.docker/"},
+		},
+	}}
+	// Trusted by helm push and dependency pulls alongside the system roots
+	if cfg.CAConfigMap != "" {
+		helm := &spec.Containers[0]
+		helm.Env = append(helm.Env, corev1.EnvVar{Name: "SSL_CERT_DIR", Value: "/etc/ssl/certs:" + internalCADir})
+		helm.VolumeMounts = append(helm.VolumeMounts, internalCAMount)
+	}
+
+	job := newBuildJob(cfg, src, spec)
+	// Not an image build, so the tracker and dependency rebuilds ignore it
+	job.Name = fmt.Sprintf("chart-%s-%s", src.App, jobNameSafe(src.Tag))
+	job.Labels["app"] = "chart-job"
+	job.Spec.Template.Labels["app"] = "chart-job"
+	return job
+}
+
+// jobNameSafe lowercases a version and replaces characters not allowed in
+// object names
+func jobNameSafe(version string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, version)
+}
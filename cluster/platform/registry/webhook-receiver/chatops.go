@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ChatOpsSettings runs commands posted as the first line of issue and pull
+// request comments:
+//
+//	/build            builds the PR's head branch, or the default branch
+//	/deploy <stage>   approves the image waiting for a promotion stage
+//	/rollback         rebuilds the default branch's previous commit
+//
+// The receiver replies with the outcome as a comment, so GITEA_TOKEN needs
+// write access to the repos. The hook must send issue comment events.
+type ChatOpsSettings struct {
+	Enabled bool `json:"enabled"`
+	// Permission is the least repo permission a commenter needs: write or
+	// admin
+	Permission string `json:"permission"`
+	// OperatorURL is the app-operator API /deploy approves promotions through
+	OperatorURL string `json:"operatorURL"`
+}
+
+// permissionRanks orders Gitea's collaborator permissions
+var permissionRanks = map[string]int{"read": 1, "write": 2, "admin": 3, "owner": 4}
+
+func (c ChatOpsSettings) validate() error {
+	if c.Permission != "write" && c.Permission != "admin" {
+		return fmt.Errorf("chatOps: permission must be write or admin")
+	}
+	if c.Enabled && c.OperatorURL == "" {
+		return fmt.Errorf("chatOps: operatorURL is required")
+	}
+	return nil
+}
+
+// GiteaIssueComment is the payload of issue_comment events, sent for
+// comments on both issues and pull requests
+type GiteaIssueComment struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number int `json:"number"`
+	} `json:"issue"`
+	Comment struct {
+		Body string `json:"body"`
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"comment"`
+	IsPull     bool `json:"is_pull"`
+	Repository struct {
+		Name          string `json:"name"`
+		FullName      string `json:"full_name"`
+		CloneURL      string `json:"clone_url"`
+		DefaultBranch string `json:"default_branch"`
+		Owner         struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+// chatCommand is a parsed comment command, e.g. /deploy staging
+type chatCommand struct {
+	Name string
+	Args []string
+}
+
+// parseChatCommand reads a command from the comment's first non-empty line
+func parseChatCommand(body string) (chatCommand, bool) {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			return chatCommand{}, false
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) == 0 {
+			return chatCommand{}, false
+		}
+		return chatCommand{Name: strings.ToLower(fields[0]), Args: fields[1:]}, true
+	}
+	return chatCommand{}, false
+}
+
+// handleIssueComment accepts a ChatOps command and runs it in the
+// background, as builds and Gitea calls can outlast Gitea's hook timeout
+func (s *Server) handleIssueComment(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	var event GiteaIssueComment
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		log.Printf("Failed to decode issue comment webhook: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if !cfg.ChatOps.Enabled {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "ChatOps is disabled")
+		return
+	}
+	cmd, ok := parseChatCommand(event.Comment.Body)
+	if event.Action != "created" || !ok {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "No command")
+		return
+	}
+	switch cmd.Name {
+	case "build", "deploy", "rollback":
+	default:
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Ignoring unknown command /%s", cmd.Name)
+		return
+	}
+
+	fullName := event.Repository.FullName
+	if fullName == "" {
+		fullName = event.Repository.Owner.Login + "/" + event.Repository.Name
+	}
+	if !cfg.Repos.Allowed(fullName) {
+		log.Printf("Ignoring command for filtered repo: %s", fullName)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Repository %s is not enabled for builds", fullName)
+		return
+	}
+
+	log.Printf("Running /%s from %s on %s#%d", cmd.Name, event.Comment.User.Login, fullName, event.Issue.Number)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+
+		reply, err := s.runChatCommand(ctx, cfg, fullName, &event, cmd)
+		if err != nil {
+			log.Printf("Command /%s on %s#%d failed: %v", cmd.Name, fullName, event.Issue.Number, err)
+			reply = "Failed: " + err.Error()
+		}
+		body := fmt.Sprintf("> /%s\n\n@%s %s", strings.Join(append([]string{cmd.Name}, cmd.Args...), " "), event.Comment.User.Login, reply)
+		payload := map[string]string{"body": body}
+		if err := giteaJSON(ctx, cfg, http.MethodPost, fmt.Sprintf("/repos/%s/issues/%d/comments", fullName, event.Issue.Number), payload, nil); err != nil {
+			log.Printf("Failed to reply to /%s on %s#%d: %v", cmd.Name, fullName, event.Issue.Number, err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Running /%s", cmd.Name)
+}
+
+// runChatCommand checks the commenter may run commands and runs one,
+// returning the reply
+func (s *Server) runChatCommand(ctx context.Context, cfg *Config, fullName string, event *GiteaIssueComment, cmd chatCommand) (string, error) {
+	user := event.Comment.User.Login
+	var perm struct {
+		Permission string `json:"permission"`
+	}
+	if err := giteaJSON(ctx, cfg, http.MethodGet, fmt.Sprintf("/repos/%s/collaborators/%s/permission", fullName, url.PathEscape(user)), nil, &perm); err != nil {
+		return "", fmt.Errorf("checking permissions of %s: %w", user, err)
+	}
+	if permissionRanks[perm.Permission] < permissionRanks[cfg.ChatOps.Permission] {
+		return fmt.Sprintf("needs %s access to this repository to run commands.", cfg.ChatOps.Permission), nil
+	}
+
+	switch cmd.Name {
+	case "build":
+		if len(cmd.Args) > 0 {
+			return "usage: `/build`", nil
+		}
+		return s.chatBuild(ctx, cfg, fullName, event)
+	case "deploy":
+		if len(cmd.Args) != 1 {
+			return "usage: `/deploy <stage>`", nil
+		}
+		return s.chatDeploy(ctx, cfg, fullName, cmd.Args[0])
+	default:
+		if len(cmd.Args) > 0 {
+			return "usage: `/rollback`", nil
+		}
+		return s.chatRollback(ctx, cfg, fullName, event)
+	}
+}
+
+// chatSource is the build source for a branch of the commented repo
+func chatSource(cfg *Config, event *GiteaIssueComment, branch, commit, tag string) BuildSource {
+	gitURL := strings.Replace(event.Repository.CloneURL, "https://", "http://", 1)
+	gitURL = strings.Replace(gitURL, cfg.GiteaHost, cfg.GiteaInternalHost, 1)
+	return BuildSource{App: event.Repository.Name, GitURL: gitURL, Branch: branch, Commit: commit, Tag: tag}
+}
+
+// startChatBuild starts a build and renders the reply. Kaniko's git context
+// only builds the branch head, so a pinned build clones the source and
+// checks out src.Commit instead.
+func (s *Server) startChatBuild(ctx context.Context, cfg *Config, fullName string, src BuildSource, pinned bool) (string, error) {
+	settings := cfg.SettingsFor(fullName)
+	opts := BuildOptions{Submodules: settings.Submodules, LFS: settings.LFS, Workspace: pinned}
+	buildID, err := s.startBuild(ctx, cfg, fullName, src, opts, nil)
+	if apierrors.IsAlreadyExists(err) {
+		return fmt.Sprintf("`%s` of `%s` is already built as `build-%s-%s`.", shortCommit(src.Commit), src.Branch, src.App, src.Tag), nil
+	}
+	var invalid *invalidBuildError
+	var denied *policyDeniedError
+	if errors.As(err, &invalid) || errors.As(err, &denied) {
+		return fmt.Sprintf("cannot build `%s`: %v", shortCommit(src.Commit), err), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("started build `%s` of `%s` at `%s`.", buildID, src.Branch, shortCommit(src.Commit)), nil
+}
+
+// chatBuild builds the head of a pull request's branch, or of the default
+// branch when commented on an issue
+func (s *Server) chatBuild(ctx context.Context, cfg *Config, fullName string, event *GiteaIssueComment) (string, error) {
+	branch := event.Repository.DefaultBranch
+	if event.IsPull {
+		var pr pullRequest
+		if err := giteaJSON(ctx, cfg, http.MethodGet, fmt.Sprintf("/repos/%s/pulls/%d", fullName, event.Issue.Number), nil, &pr); err != nil {
+			return "", fmt.Errorf("loading pull request: %w", err)
+		}
+		// Fork branches would build with the repo's push credentials
+		if pr.Head.Repo.FullName != fullName {
+			return "cannot build branches of forks.", nil
+		}
+		branch = pr.Head.Ref
+	}
+	commit, err := branchHead(ctx, cfg, fullName, branch)
+	if err != nil {
+		return "", err
+	}
+	return s.startChatBuild(ctx, cfg, fullName, chatSource(cfg, event, branch, commit, commit[:7]), false)
+}
+
+// chatRollback rebuilds the default branch's last good commit before the
+// one currently built, so apps following the latest build (tagPolicy
+// LatestBuild) return to it. Commits are ordered by their first successful
+// build, so a commit rebuilt by an earlier rollback does not count as new.
+func (s *Server) chatRollback(ctx context.Context, cfg *Config, fullName string, event *GiteaIssueComment) (string, error) {
+	branch := event.Repository.DefaultBranch
+	builds, err := s.history.List(ctx, event.Repository.Name, 200)
+	if err != nil {
+		return "", err
+	}
+
+	current := ""
+	firstBuilt := make(map[string]time.Time)
+	for _, b := range builds {
+		if b.Repo != fullName || b.Branch != branch || b.Status != BuildSucceeded {
+			continue
+		}
+		if current == "" {
+			current = b.Commit
+		}
+		// Newest first, so the last seen is the earliest
+		firstBuilt[b.Commit] = b.CreatedAt
+	}
+	if current == "" {
+		return fmt.Sprintf("`%s` has no successful builds to roll back from.", branch), nil
+	}
+	target := ""
+	for commit, at := range firstBuilt {
+		if at.Before(firstBuilt[current]) && (target == "" || at.After(firstBuilt[target])) {
+			target = commit
+		}
+	}
+	if target == "" {
+		return fmt.Sprintf("`%s` has no earlier successful build than `%s`.", branch, shortCommit(current)), nil
+	}
+
+	// Distinct from the commit's earlier builds, whose jobs may still exist.
+	// The target is behind the branch head, so the build is pinned to it.
+	tag := fmt.Sprintf("%s-rollback-%d", target[:7], time.Now().Unix())
+	reply, err := s.startChatBuild(ctx, cfg, fullName, chatSource(cfg, event, branch, target, tag), true)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("rolling back from `%s`: %s", shortCommit(current), reply), nil
+}
+
+// chatDeploy approves the image waiting for stage in the promotion
+// pipeline of the repo's Application
+func (s *Server) chatDeploy(ctx context.Context, cfg *Config, fullName, stage string) (string, error) {
+	app := cfg.SettingsFor(fullName).Application
+	namespace, name, ok := strings.Cut(app, "/")
+	if !ok {
+		return "no Application is configured for this repository.", nil
+	}
+
+	query := url.Values{"namespace": {namespace}, "name": {name}, "stage": {stage}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(cfg.ChatOps.OperatorURL, "/")+"/api/v1/promote?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if s.operatorToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.operatorToken)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("approving promotion: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// The operator explains rejections, e.g. nothing awaiting approval
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Sprintf("cannot deploy %s to %s: %s", app, stage, strings.TrimSpace(string(msg))), nil
+	}
+	var result struct {
+		Approved string `json:"approved"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("approved `%s` for %s of %s.", result.Approved, stage, app), nil
+}
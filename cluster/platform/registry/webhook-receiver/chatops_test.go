@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestChatRollbackBuildsTargetCommit(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestGitea(t, nil)
+	s, kube := newTestServer(t, cfg)
+
+	good := "1111111111111111111111111111111111111111"
+	bad := "2222222222222222222222222222222222222222"
+	start := time.Now().Add(-time.Hour)
+	for i, commit := range []string{good, bad} {
+		err := s.history.Record(ctx, &BuildRecord{
+			ID: "build-app-" + commit[:7], App: "app", Repo: "owner/app", Commit: commit,
+			Branch: "main", Tag: commit[:7], Status: BuildSucceeded, CreatedAt: start.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	event := &GiteaIssueComment{}
+	event.Repository.Name = "app"
+	event.Repository.FullName = "owner/app"
+	event.Repository.CloneURL = "https://" + cfg.GiteaHost + "/owner/app.git"
+	event.Repository.DefaultBranch = "main"
+
+	reply, err := s.chatRollback(ctx, cfg, "owner/app", event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply, "rolling back from `"+bad[:7]+"`") {
+		t.Fatalf("reply = %q", reply)
+	}
+
+	jobs, err := kube.BatchV1().Jobs(buildNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 1 {
+		t.Fatalf("created %d jobs, want 1", len(jobs.Items))
+	}
+	spec := jobs.Items[0].Spec.Template.Spec
+	// Kaniko's git context would build the branch head, not the target
+	for _, arg := range spec.Containers[0].Args {
+		if strings.HasPrefix(arg, "--context=") && arg != "--context=dir://"+workspaceDir {
+			t.Fatalf("kaniko builds %s, want the cloned workspace", arg)
+		}
+	}
+	if len(spec.InitContainers) == 0 || spec.InitContainers[0].Name != "clone" {
+		t.Fatalf("no clone init container: %v", spec.InitContainers)
+	}
+	checkout := ""
+	for _, env := range spec.InitContainers[0].Env {
+		if env.Name == "GIT_COMMIT" {
+			checkout = env.Value
+		}
+	}
+	if checkout != good {
+		t.Fatalf("clone checks out %q, want %s", checkout, good)
+	}
+}
+
+func TestChatDeploySendsOperatorToken(t *testing.T) {
+	var got *http.Request
+	operator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		fmt.Fprint(w, `{"stage":"prod","approved":"registry.home.mcztest.com/app:0123456"}`)
+	}))
+	t.Cleanup(operator.Close)
+
+	cfg := defaultConfig()
+	cfg.ChatOps.OperatorURL = operator.URL
+	cfg.Repositories = []RepoSettings{{Match: "owner/app", Application: "apps/app"}}
+	s, _ := newTestServer(t, cfg)
+	s.operatorToken = "s3cret"
+
+	reply, err := s.chatDeploy(context.Background(), cfg, "owner/app", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(reply, "approved ") {
+		t.Fatalf("reply = %q", reply)
+	}
+	if got.URL.Query().Get("namespace") != "apps" || got.URL.Query().Get("stage") != "prod" {
+		t.Fatalf("query = %s", got.URL.RawQuery)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Fatalf("Authorization = %q", auth)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// clusterAnnotation names the cluster a build job was dispatched to; jobs
+// without it run on the receiver's own cluster
+const clusterAnnotation = "homelab.mcztest.com/cluster"
+
+// DispatchSettings sends builds to other clusters, e.g. ones on other
+// Proxmox hosts, when this one is busy or lacks the build's arch
+type DispatchSettings struct {
+	// MaxActiveBuilds is how many build jobs may run here before plain
+	// builds overflow to clusters marked overflow; 0 never overflows
+	MaxActiveBuilds int `json:"maxActiveBuilds,omitempty"`
+	// Clusters are tried in order
+	Clusters []ClusterTarget `json:"clusters,omitempty"`
+}
+
+// ClusterTarget is a remote cluster builds can be dispatched to. It needs
+// the build namespace with the same push, cache, and cosign Secrets, and
+// must reach the registry and Gitea.
+type ClusterTarget struct {
+	Name string `json:"name"`
+	// KubeconfigSecret is a Secret in the build namespace whose kubeconfig
+	// key reaches the cluster; its user needs the receiver's Role there
+	KubeconfigSecret string `json:"kubeconfigSecret"`
+	// Arches routes builds pinned to these architectures here, e.g. arm64
+	// when only another host has arm64 nodes
+	Arches []string `json:"arches,omitempty"`
+	// Overflow takes plain builds while this cluster is at MaxActiveBuilds
+	Overflow bool `json:"overflow,omitempty"`
+	// MaxActiveBuilds caps overflow builds running there; 0 is unlimited
+	MaxActiveBuilds int `json:"maxActiveBuilds,omitempty"`
+	// GiteaHost replaces giteaInternalHost in clone URLs, as the cluster
+	// cannot resolve this one's service names
+	GiteaHost string `json:"giteaHost"`
+}
+
+func (d DispatchSettings) validate() error {
+	seen := make(map[string]bool)
+	for i, c := range d.Clusters {
+		if !stepNamePattern.MatchString(c.Name) {
+			return fmt.Errorf("dispatch.clusters[%d]: name %q must be lowercase alphanumerics and dashes", i, c.Name)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("dispatch.clusters: duplicate name %q", c.Name)
+		}
+		seen[c.Name] = true
+		if c.KubeconfigSecret == "" || c.GiteaHost == "" {
+			return fmt.Errorf("dispatch.clusters: %s: kubeconfigSecret and giteaHost are required", c.Name)
+		}
+		if len(c.Arches) == 0 && !c.Overflow {
+			return fmt.Errorf("dispatch.clusters: %s takes no builds: set arches or overflow", c.Name)
+		}
+		for _, arch := range c.Arches {
+			if !supportedArches[arch] {
+				return fmt.Errorf("dispatch.clusters: %s: unsupported arch %q", c.Name, arch)
+			}
+		}
+	}
+	if d.MaxActiveBuilds < 0 {
+		return fmt.Errorf("dispatch: maxActiveBuilds cannot be negative")
+	}
+	return nil
+}
+
+// remoteCluster is a connected cluster and the tracker following its jobs
+type remoteCluster struct {
+	version string
+	kube    kubernetes.Interface
+	cancel  context.CancelFunc
+}
+
+// Clusters holds clients for the dispatch targets, built from their
+// kubeconfig Secrets on first use and rebuilt when a Secret changes. Each
+// client gets a tracker, so remote builds are recorded like local ones.
+type Clusters struct {
+	ctx  context.Context
+	kube kubernetes.Interface
+	// track starts following a cluster's build jobs
+	track func(ctx context.Context, kube kubernetes.Interface)
+
+	mu      sync.Mutex
+	remotes map[string]*remoteCluster
+}
+
+func NewClusters(ctx context.Context, kube kubernetes.Interface, track func(context.Context, kubernetes.Interface)) *Clusters {
+	return &Clusters{ctx: ctx, kube: kube, track: track, remotes: make(map[string]*remoteCluster)}
+}
+
+// Client returns the target's client, or the local one for nil
+func (c *Clusters) Client(ctx context.Context, target *ClusterTarget) (kubernetes.Interface, error) {
+	if target == nil {
+		return c.kube, nil
+	}
+	secret, err := c.kube.CoreV1().Secrets(buildNamespace).Get(ctx, target.KubeconfigSecret, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("loading kubeconfig of %s: %w", target.Name, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.remotes[target.Name]; ok && r.version == secret.ResourceVersion {
+		return r.kube, nil
+	}
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(secret.Data["kubeconfig"])
+	if err != nil {
+		return nil, fmt.Errorf("parsing kubeconfig of %s: %w", target.Name, err)
+	}
+	traceKubeClient(restConfig)
+	kube, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", target.Name, err)
+	}
+	if r, ok := c.remotes[target.Name]; ok {
+		r.cancel()
+	}
+	trackCtx, cancel := context.WithCancel(c.ctx)
+	c.remotes[target.Name] = &remoteCluster{version: secret.ResourceVersion, kube: kube, cancel: cancel}
+	go c.track(trackCtx, kube)
+	log.Printf("Connected to build cluster %s", target.Name)
+	return kube, nil
+}
+
+// Connect starts tracking every configured cluster, so builds dispatched
+// before a restart are still recorded
+func (c *Clusters) Connect(ctx context.Context, cfg *Config) {
+	for i := range cfg.Dispatch.Clusters {
+		if _, err := c.Client(ctx, &cfg.Dispatch.Clusters[i]); err != nil {
+			log.Printf("Failed to connect to build cluster %s: %v", cfg.Dispatch.Clusters[i].Name, err)
+		}
+	}
+}
+
+// Cluster returns the named dispatch target, or nil
+func (c *Config) Cluster(name string) *ClusterTarget {
+	for i := range c.Dispatch.Clusters {
+		if c.Dispatch.Clusters[i].Name == name {
+			return &c.Dispatch.Clusters[i]
+		}
+	}
+	return nil
+}
+
+// activeBuilds counts unfinished build jobs on a cluster
+func activeBuilds(ctx context.Context, kube kubernetes.Interface) (int, error) {
+	jobs, err := kube.BatchV1().Jobs(buildNamespace).List(ctx, metav1.ListOptions{LabelSelector: "app=build-job"})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range jobs.Items {
+		if status, _ := jobResult(&jobs.Items[i]); status == BuildPending || status == BuildRunning {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// route picks the cluster for a build: the first listing its pinned arch,
+// else while this cluster is at MaxActiveBuilds the first overflow cluster
+// with room, else this one (nil). Unreachable clusters are skipped.
+func (c *Clusters) route(ctx context.Context, cfg *Config, opts BuildOptions) *ClusterTarget {
+	d := cfg.Dispatch
+	if len(d.Clusters) == 0 {
+		return nil
+	}
+	if opts.Arch != "" {
+		for i := range d.Clusters {
+			t := &d.Clusters[i]
+			for _, arch := range t.Arches {
+				if arch != opts.Arch {
+					continue
+				}
+				if _, err := c.Client(ctx, t); err != nil {
+					log.Printf("Skipping build cluster %s: %v", t.Name, err)
+					break
+				}
+				return t
+			}
+		}
+		return nil
+	}
+
+	if d.MaxActiveBuilds == 0 {
+		return nil
+	}
+	local, err := activeBuilds(ctx, c.kube)
+	if err != nil {
+		log.Printf("Failed to count active builds, building locally: %v", err)
+		return nil
+	}
+	if local < d.MaxActiveBuilds {
+		return nil
+	}
+	for i := range d.Clusters {
+		t := &d.Clusters[i]
+		if !t.Overflow {
+			continue
+		}
+		kube, err := c.Client(ctx, t)
+		if err != nil {
+			log.Printf("Skipping build cluster %s: %v", t.Name, err)
+			continue
+		}
+		if t.MaxActiveBuilds > 0 {
+			n, err := activeBuilds(ctx, kube)
+			if err != nil {
+				log.Printf("Skipping build cluster %s: %v", t.Name, err)
+				continue
+			}
+			if n >= t.MaxActiveBuilds {
+				continue
+			}
+		}
+		return t
+	}
+	return nil
+}
+
+// dispatch chooses where a build job runs and returns that cluster's
+// client. Jobs sent elsewhere are annotated with the cluster, clone from
+// its Gitea host, and go without the Go cache volume, which lives here.
+// Builds uploading artifacts stay here, as remote pods cannot reach the
+// receiver's service.
+func (s *Server) dispatch(ctx context.Context, cfg *Config, job *batchv1.Job, opts BuildOptions) kubernetes.Interface {
+	if job.Annotations[artifactTokenAnnotation] != "" {
+		return s.kube
+	}
+	target := s.clusters.route(ctx, cfg, opts)
+	if target == nil {
+		return s.kube
+	}
+	kube, err := s.clusters.Client(ctx, target)
+	if err != nil {
+		log.Printf("Failed to reach build cluster %s, building locally: %v", target.Name, err)
+		return s.kube
+	}
+	job.Annotations[clusterAnnotation] = target.Name
+	delete(job.Annotations, goCacheAnnotation)
+
+	spec := &job.Spec.Template.Spec
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			for j, arg := range c.Args {
+				c.Args[j] = strings.ReplaceAll(arg, cfg.GiteaInternalHost, target.GiteaHost)
+			}
+			for j := range c.Env {
+				c.Env[j].Value = strings.ReplaceAll(c.Env[j].Value, cfg.GiteaInternalHost, target.GiteaHost)
+			}
+		}
+	}
+	log.Printf("Dispatching build %s to cluster %s", job.Name, target.Name)
+	return kube
+}
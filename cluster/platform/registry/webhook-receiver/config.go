@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the receiver's runtime configuration, loaded from a
+// ConfigMap-mounted YAML file and reloaded when it changes
+type Config struct {
+	// Registry is the host images are pushed to
+	Registry string `json:"registry"`
+	// CacheRepo stores kaniko layer cache
+	CacheRepo string `json:"cacheRepo"`
+	// CacheVolume is a PVC mounted into every build as kaniko's --cache-dir,
+	// shared across builds; empty disables it
+	CacheVolume string `json:"cacheVolume,omitempty"`
+	// PushSecret is a dockerconfigjson Secret in the build namespace mounted
+	// as kaniko's config.json; builds push anonymously while it is missing
+	PushSecret string `json:"pushSecret,omitempty"`
+	// ChartRepo receives Helm charts packaged on release events: an oci://
+	// registry path or a ChartMuseum URL; empty disables chart publishing
+	ChartRepo string `json:"chartRepo,omitempty"`
+	// ChartPlainHTTP pushes to an oci:// ChartRepo over plain HTTP
+	ChartPlainHTTP bool `json:"chartPlainHTTP,omitempty"`
+	// CAConfigMap holds the internal CA (ca.crt) kept in every namespace by
+	// the secrets operator. Builds verify Registry and CacheRepo against it
+	// instead of skipping TLS verification, and chart jobs trust it.
+	CAConfigMap string `json:"caConfigMap,omitempty"`
+	// RegistryTLS sets TLS per registry host for builds: Registry, CacheRepo,
+	// or base image registries. With it or CAConfigMap set, builds drop
+	// kaniko's blanket --insecure and --skip-tls-verify.
+	RegistryTLS []RegistryTLS `json:"registryTLS,omitempty"`
+	// HelmImage runs chart publishing jobs
+	HelmImage string `json:"helmImage"`
+	// KanikoImage is the executor image for build jobs
+	KanikoImage string `json:"kanikoImage"`
+	// Branches are glob patterns of branches that trigger builds
+	Branches []string `json:"branches"`
+	// Repos filters owner/name for org-level webhooks
+	Repos RepoFilter `json:"repos"`
+	// Resources applies to the kaniko container
+	Resources corev1.ResourceRequirements `json:"resources"`
+	// JobTTLSeconds keeps finished jobs around for log access
+	JobTTLSeconds int32 `json:"jobTTLSeconds"`
+	// CloneImage runs the init-container clone for repos that need it, and
+	// artifact uploads
+	CloneImage string `json:"cloneImage"`
+	// ReceiverURL is where build jobs upload artifacts
+	ReceiverURL string `json:"receiverURL"`
+	// Policy admits, denies, or mutates jobs before they are created
+	Policy PolicySettings `json:"policy"`
+	// Security hardens build and chart pods
+	Security SecurityProfile `json:"security"`
+	// PRComments keeps a build summary comment on open pull requests whose
+	// head branch is built; GITEA_TOKEN needs write access to the repos
+	PRComments bool `json:"prComments,omitempty"`
+	// Runners sends plain builds to the build-runner pool instead of Jobs
+	Runners RunnerSettings `json:"runners"`
+	// Provenance attests how each image was built
+	Provenance ProvenanceSettings `json:"provenance"`
+	// BuildClasses place builds on nodes by the repo's language
+	BuildClasses []BuildClass `json:"buildClasses,omitempty"`
+	// Registries are destinations repos may push to instead of Registry
+	Registries []Destination `json:"registries,omitempty"`
+	// GoCache gives each Go app a persistent module and build cache
+	GoCache GoCacheSettings `json:"goCache"`
+	// Dispatch runs builds on other clusters
+	Dispatch DispatchSettings `json:"dispatch"`
+	// ChatOps runs commands from issue and pull request comments
+	ChatOps ChatOpsSettings `json:"chatOps"`
+	// DeadLetter retries pushes whose build could not be started
+	DeadLetter DeadLetterSettings `json:"deadLetter"`
+	// Repositories holds per-repo build settings; the first match wins
+	Repositories []RepoSettings `json:"repositories,omitempty"`
+	// GiteaHost is rewritten to GiteaInternalHost in clone URLs
+	GiteaHost         string `json:"giteaHost"`
+	GiteaInternalHost string `json:"giteaInternalHost"`
+	// GiteaToken authenticates internal API calls; it comes from Settings,
+	// never the file, and carries over reloads
+	GiteaToken string `json:"-"`
+}
+
+// RunnerSettings enables the pool of long-lived build runners. Builds that
+// need more than a single kaniko container (pipelines, matrix, clone or
+// artifacts, arch pinning) still run as Jobs.
+type RunnerSettings struct {
+	Enabled bool `json:"enabled"`
+	// TimeoutSeconds fails a claimed build whose runner has not reported
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// RepoSettings adjusts how repos matching Match (a glob on owner/name) build
+type RepoSettings struct {
+	Match string `json:"match"`
+	// Submodules and LFS need a full git clone: kaniko's git:// context
+	// fetches neither, so the repo is cloned by an init container and
+	// kaniko builds from the checked-out directory instead
+	Submodules bool `json:"submodules,omitempty"`
+	LFS        bool `json:"lfs,omitempty"`
+	// ChartDir is the Helm chart published on releases (default chart)
+	ChartDir string `json:"chartDir,omitempty"`
+	// Registry names the destination in registries images are pushed to;
+	// .build.yaml registry overrides it
+	Registry string `json:"registry,omitempty"`
+	// Application is the namespace/name of the Application deployed from
+	// the repo, whose promotion stages /deploy approves
+	Application string `json:"application,omitempty"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Registry:          "registry.home.mcztest.com",
+		CacheRepo:         "registry.home.mcztest.com/cache",
+		PushSecret:        "registry-credentials",
+		HelmImage:         "alpine/helm:3.14.0",
+		KanikoImage:       "gcr.io/kaniko-project/executor:latest",
+		Branches:          []string{"main"},
+		JobTTLSeconds:     3600,
+		CloneImage:        "alpine/git:2.43.0",
+		ReceiverURL:       "http://webhook-receiver.container-registry.svc.cluster.local",
+		Runners:           RunnerSettings{TimeoutSeconds: 3600},
+		Provenance:        ProvenanceSettings{CosignImage: "gcr.io/projectsigstore/cosign:v2.2.3", KeySecret: "cosign-key"},
+		GoCache:           GoCacheSettings{StorageClass: "local-path", Size: resource.MustParse("5Gi")},
+		ChatOps:           ChatOpsSettings{Permission: "write", OperatorURL: "http://app-operator.app-operator.svc.cluster.local:8080"},
+		DeadLetter:        DeadLetterSettings{MaxAttempts: 12, BackoffSeconds: 30},
+		GiteaHost:         "gitea.home.mcztest.com",
+		GiteaInternalHost: "gitea-http.gitea.svc.cluster.local:3000",
+	}
+}
+
+// loadConfig reads the file over the defaults; a missing file keeps defaults
+func loadConfig(file string) (*Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if c.Registry == "" {
+		return fmt.Errorf("registry is required")
+	}
+	if len(c.Branches) == 0 {
+		return fmt.Errorf("at least one branch pattern is required")
+	}
+	if err := c.Security.validate(); err != nil {
+		return err
+	}
+	if c.Runners.Enabled && c.Runners.TimeoutSeconds <= 0 {
+		return fmt.Errorf("runners: timeoutSeconds must be positive")
+	}
+	if c.Provenance.Enabled && (c.Provenance.CosignImage == "" || c.Provenance.KeySecret == "") {
+		return fmt.Errorf("provenance: cosignImage and keySecret are required")
+	}
+	if c.GoCache.Enabled && c.GoCache.Size.Sign() <= 0 {
+		return fmt.Errorf("goCache: size must be positive")
+	}
+	if c.DeadLetter.MaxAttempts <= 0 || c.DeadLetter.BackoffSeconds <= 0 {
+		return fmt.Errorf("deadLetter: maxAttempts and backoffSeconds must be positive")
+	}
+	if err := validateBuildClasses(c.BuildClasses); err != nil {
+		return err
+	}
+	if err := validateDestinations(c.Registries); err != nil {
+		return err
+	}
+	if err := validateRegistryTLS(c.RegistryTLS); err != nil {
+		return err
+	}
+	if err := c.Dispatch.validate(); err != nil {
+		return err
+	}
+	if err := c.ChatOps.validate(); err != nil {
+		return err
+	}
+	patterns := append(append(append([]string{}, c.Branches...), c.Repos.Allow...), c.Repos.Deny...)
+	for _, rs := range c.Repositories {
+		if rs.Match == "" {
+			return fmt.Errorf("repositories: match is required")
+		}
+		if rs.Registry != "" && c.Destination(rs.Registry) == nil {
+			return fmt.Errorf("repositories: %s: registry %q is not configured", rs.Match, rs.Registry)
+		}
+		if namespace, name, ok := strings.Cut(rs.Application, "/"); rs.Application != "" && (!ok || namespace == "" || name == "") {
+			return fmt.Errorf("repositories: %s: application must be namespace/name", rs.Match)
+		}
+		patterns = append(patterns, rs.Match)
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// SettingsFor returns the settings of the first entry matching fullName
+func (c *Config) SettingsFor(fullName string) RepoSettings {
+	for _, rs := range c.Repositories {
+		if matchAny([]string{rs.Match}, strings.ToLower(fullName)) {
+			return rs
+		}
+	}
+	return RepoSettings{}
+}
+
+// BuildsBranch reports whether pushes to branch trigger builds
+func (c *Config) BuildsBranch(branch string) bool {
+	for _, p := range c.Branches {
+		if ok, _ := path.Match(p, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// watchConfig reloads the file whenever it changes. ConfigMap volumes update
+// by swapping a symlink, so the parent directory is watched rather than the
+// file. An invalid file is logged and the previous config stays active.
+func (s *Server) watchConfig(file string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		// Coalesce the burst of events from one ConfigMap update
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
+					reload = time.After(500 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v", err)
+			case <-reload:
+				reload = nil
+				cfg, err := loadConfig(file)
+				if err != nil {
+					log.Printf("Failed to reload config, keeping previous: %v", err)
+					continue
+				}
+				cfg.GiteaToken = s.config().GiteaToken
+				s.cfg.Store(cfg)
+				log.Printf("Reloaded config from %s", file)
+			}
+		}
+	}()
+	return nil
+}
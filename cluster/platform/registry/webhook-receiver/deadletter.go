@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Dead letter status values
+const (
+	DeadLetterRetrying  = "retrying"
+	DeadLetterExhausted = "exhausted"
+)
+
+// deadLetterInterval is how often due dead letters are retried
+const deadLetterInterval = 30 * time.Second
+
+// maxDeadLetterBackoff caps the delay between retries
+const maxDeadLetterBackoff = time.Hour
+
+const deadLetterSchema = `
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id           TEXT PRIMARY KEY,
+	repo         TEXT NOT NULL,
+	source       TEXT NOT NULL,
+	options      TEXT NOT NULL,
+	error        TEXT NOT NULL DEFAULT '',
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	status       TEXT NOT NULL,
+	created_at   INTEGER NOT NULL,
+	next_attempt INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS dead_letters_next ON dead_letters (status, next_attempt);
+`
+
+// DeadLetterSettings retries pushes whose build could not be started, e.g.
+// while the Kubernetes API is down, instead of failing the webhook
+type DeadLetterSettings struct {
+	// MaxAttempts stops retrying a build, leaving it for inspection
+	MaxAttempts int `json:"maxAttempts"`
+	// BackoffSeconds is the first retry's delay, doubled for each attempt
+	// up to an hour
+	BackoffSeconds int `json:"backoffSeconds"`
+}
+
+func (d DeadLetterSettings) backoff(attempts int) time.Duration {
+	delay := time.Duration(d.BackoffSeconds) * time.Second
+	for i := 1; i < attempts && delay < maxDeadLetterBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxDeadLetterBackoff {
+		delay = maxDeadLetterBackoff
+	}
+	return delay
+}
+
+// DeadLetter is a push whose build is waiting to be retried. Its ID is the
+// build job's name, so a redelivered push replaces it.
+type DeadLetter struct {
+	ID            string       `json:"id"`
+	Repo          string       `json:"repo"`
+	Source        BuildSource  `json:"source"`
+	Options       BuildOptions `json:"options"`
+	Error         string       `json:"error"`
+	Attempts      int          `json:"attempts"`
+	Status        string       `json:"status"`
+	CreatedAt     time.Time    `json:"createdAt"`
+	NextAttemptAt time.Time    `json:"nextAttemptAt"`
+}
+
+// retryable reports whether a failed build start is worth retrying: the
+// pusher's mistakes and policy denials are not, nor a job that exists
+func retryable(err error) bool {
+	var invalid *invalidBuildError
+	var denied *policyDeniedError
+	return !errors.As(err, &invalid) && !errors.As(err, &denied) && !apierrors.IsAlreadyExists(err)
+}
+
+// AddDeadLetter stores a build to retry, replacing one with the same ID
+func (h *BuildHistory) AddDeadLetter(ctx context.Context, d *DeadLetter) error {
+	source, err := json.Marshal(d.Source)
+	if err != nil {
+		return err
+	}
+	options, err := json.Marshal(d.Options)
+	if err != nil {
+		return err
+	}
+	_, err = h.db.ExecContext(ctx, `
+		INSERT INTO dead_letters (id, repo, source, options, error, attempts, status, created_at, next_attempt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			repo = excluded.repo, source = excluded.source, options = excluded.options,
+			error = excluded.error, attempts = excluded.attempts, status = excluded.status,
+			next_attempt = excluded.next_attempt`,
+		d.ID, d.Repo, string(source), string(options), d.Error, d.Attempts, d.Status,
+		d.CreatedAt.Unix(), d.NextAttemptAt.Unix())
+	return err
+}
+
+// UpdateDeadLetter records the outcome of a failed retry
+func (h *BuildHistory) UpdateDeadLetter(ctx context.Context, d *DeadLetter) error {
+	_, err := h.db.ExecContext(ctx, `
+		UPDATE dead_letters SET error = ?, attempts = ?, status = ?, next_attempt = ? WHERE id = ?`,
+		d.Error, d.Attempts, d.Status, d.NextAttemptAt.Unix(), d.ID)
+	return err
+}
+
+// DeleteDeadLetter removes a dead letter, reporting whether it existed
+func (h *BuildHistory) DeleteDeadLetter(ctx context.Context, id string) (bool, error) {
+	res, err := h.db.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RequeueDeadLetter makes a dead letter due now with a fresh set of attempts
+func (h *BuildHistory) RequeueDeadLetter(ctx context.Context, id string) (bool, error) {
+	res, err := h.db.ExecContext(ctx, `
+		UPDATE dead_letters SET attempts = 0, status = ?, next_attempt = ? WHERE id = ?`,
+		DeadLetterRetrying, time.Now().Unix(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const selectDeadLetters = `
+	SELECT id, repo, source, options, error, attempts, status, created_at, next_attempt FROM dead_letters`
+
+// DeadLetter returns one dead letter, or nil if there is none
+func (h *BuildHistory) DeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	letters, err := h.queryDeadLetters(ctx, selectDeadLetters+` WHERE id = ?`, id)
+	if err != nil || len(letters) == 0 {
+		return nil, err
+	}
+	return &letters[0], nil
+}
+
+// DeadLetters lists every dead letter, oldest first
+func (h *BuildHistory) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	return h.queryDeadLetters(ctx, selectDeadLetters+` ORDER BY created_at, id`)
+}
+
+// DueDeadLetters lists the dead letters to retry now
+func (h *BuildHistory) DueDeadLetters(ctx context.Context, now time.Time) ([]DeadLetter, error) {
+	return h.queryDeadLetters(ctx, selectDeadLetters+`
+		WHERE status = ? AND next_attempt <= ? ORDER BY next_attempt, id`, DeadLetterRetrying, now.Unix())
+}
+
+func (h *BuildHistory) queryDeadLetters(ctx context.Context, query string, args ...interface{}) ([]DeadLetter, error) {
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		var d DeadLetter
+		var source, options string
+		var createdAt, nextAttempt int64
+		if err := rows.Scan(&d.ID, &d.Repo, &source, &options, &d.Error, &d.Attempts, &d.Status, &createdAt, &nextAttempt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(source), &d.Source); err != nil {
+			return nil, fmt.Errorf("decoding source of %s: %w", d.ID, err)
+		}
+		if err := json.Unmarshal([]byte(options), &d.Options); err != nil {
+			return nil, fmt.Errorf("decoding options of %s: %w", d.ID, err)
+		}
+		d.CreatedAt = time.Unix(createdAt, 0).UTC()
+		d.NextAttemptAt = time.Unix(nextAttempt, 0).UTC()
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+// DeadLetterCounts counts dead letters by status, for metrics
+func (h *BuildHistory) DeadLetterCounts(ctx context.Context) (map[string]int, error) {
+	counts := map[string]int{DeadLetterRetrying: 0, DeadLetterExhausted: 0}
+	rows, err := h.db.QueryContext(ctx, `SELECT status, COUNT(*) FROM dead_letters GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// deadLetter stores a push whose build failed to start, for retryDeadLetters
+func (s *Server) deadLetter(ctx context.Context, cfg *Config, fullName string, src BuildSource, opts BuildOptions, cause error) error {
+	now := time.Now().UTC()
+	d := &DeadLetter{
+		ID:            fmt.Sprintf("build-%s-%s", src.App, src.Tag),
+		Repo:          fullName,
+		Source:        src,
+		Options:       opts,
+		Error:         cause.Error(),
+		Attempts:      1,
+		Status:        DeadLetterRetrying,
+		CreatedAt:     now,
+		NextAttemptAt: now.Add(cfg.DeadLetter.backoff(1)),
+	}
+	if err := s.history.AddDeadLetter(ctx, d); err != nil {
+		return err
+	}
+	log.Printf("Queued build %s for retry at %s: %v", d.ID, d.NextAttemptAt.Format(time.RFC3339), cause)
+	return nil
+}
+
+// retryDeadLetters starts the builds of due dead letters until they succeed
+// or run out of attempts
+func (s *Server) retryDeadLetters(ctx context.Context) {
+	ticker := time.NewTicker(deadLetterInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		letters, err := s.history.DueDeadLetters(ctx, time.Now())
+		if err != nil {
+			log.Printf("Failed to load dead letters: %v", err)
+			continue
+		}
+		for i := range letters {
+			s.retryDeadLetter(ctx, &letters[i])
+		}
+	}
+}
+
+func (s *Server) retryDeadLetter(ctx context.Context, d *DeadLetter) {
+	cfg := s.config()
+	buildCtx, cancel := context.WithTimeout(ctx, httpkit.RequestTimeout)
+	defer cancel()
+
+	_, err := s.startBuild(buildCtx, cfg, d.Repo, d.Source, d.Options, nil)
+	if err == nil || apierrors.IsAlreadyExists(err) {
+		if _, err := s.history.DeleteDeadLetter(ctx, d.ID); err != nil {
+			log.Printf("Failed to delete dead letter %s: %v", d.ID, err)
+			return
+		}
+		log.Printf("Started build %s after %d failed attempts", d.ID, d.Attempts)
+		return
+	}
+
+	d.Attempts++
+	d.Error = err.Error()
+	switch {
+	case !retryable(err):
+		d.Status = DeadLetterExhausted
+		log.Printf("Giving up on build %s: %v", d.ID, err)
+	case d.Attempts >= cfg.DeadLetter.MaxAttempts:
+		d.Status = DeadLetterExhausted
+		log.Printf("Giving up on build %s after %d attempts: %v", d.ID, d.Attempts, err)
+	default:
+		d.NextAttemptAt = time.Now().UTC().Add(cfg.DeadLetter.backoff(d.Attempts))
+		log.Printf("Retry %d of build %s failed, next at %s: %v", d.Attempts, d.ID, d.NextAttemptAt.Format(time.RFC3339), err)
+	}
+	if err := s.history.UpdateDeadLetter(ctx, d); err != nil {
+		log.Printf("Failed to update dead letter %s: %v", d.ID, err)
+	}
+}
+
+// handleDeadLetters inspects and manages builds waiting to be retried:
+//
+//	GET    /deadletter                list them, oldest first
+//	GET    /deadletter/<id>           one of them
+//	POST   /deadletter/<id>/retry     retry now, with fresh attempts
+//	DELETE /deadletter/<id>           drop it
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/deadletter"), "/")
+	id, action, _ := strings.Cut(path, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		letters, err := s.history.DeadLetters(r.Context())
+		if err != nil {
+			log.Printf("Failed to list dead letters: %v", err)
+			http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+			return
+		}
+		if letters == nil {
+			letters = []DeadLetter{}
+		}
+		httpkit.WriteJSON(w, http.StatusOK, letters)
+
+	case id != "" && action == "" && r.Method == http.MethodGet:
+		d, err := s.history.DeadLetter(r.Context(), id)
+		if err != nil {
+			log.Printf("Failed to load dead letter %s: %v", id, err)
+			http.Error(w, "Failed to load dead letter", http.StatusInternalServerError)
+			return
+		}
+		if d == nil {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		httpkit.WriteJSON(w, http.StatusOK, d)
+
+	case id != "" && action == "retry" && r.Method == http.MethodPost:
+		s.manageDeadLetter(w, r, id, "requeue", s.history.RequeueDeadLetter)
+
+	case id != "" && action == "" && r.Method == http.MethodDelete:
+		s.manageDeadLetter(w, r, id, "delete", s.history.DeleteDeadLetter)
+
+	case id == "" || (action != "" && action != "retry"):
+		http.Error(w, "Not found", http.StatusNotFound)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) manageDeadLetter(w http.ResponseWriter, r *http.Request, id, verb string, apply func(context.Context, string) (bool, error)) {
+	found, err := apply(r.Context(), id)
+	if err != nil {
+		log.Printf("Failed to %s dead letter %s: %v", verb, id, err)
+		http.Error(w, "Failed to "+verb+" dead letter", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
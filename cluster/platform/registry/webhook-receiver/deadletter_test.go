@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRetryable(t *testing.T) {
+	jobs := schema.GroupResource{Group: "batch", Resource: "jobs"}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "api server unavailable", err: apierrors.NewServiceUnavailable("down"), want: true},
+		{name: "network error", err: errors.New("dial tcp: connection refused"), want: true},
+		{name: "wrapped timeout", err: fmt.Errorf("recording dependencies: %w", apierrors.NewTimeoutError("slow", 1)), want: true},
+		{name: "invalid build files", err: &invalidBuildError{errors.New(".pipeline.yaml: no steps defined")}},
+		{name: "wrapped invalid build files", err: fmt.Errorf("starting build: %w", &invalidBuildError{errors.New("bad")})},
+		{name: "policy denial", err: &policyDeniedError{reasons: []string{"privileged containers are not allowed"}}},
+		{name: "job exists", err: apierrors.NewAlreadyExists(jobs, "build-app-0123456")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Fatalf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadLetterBackoff(t *testing.T) {
+	d := DeadLetterSettings{MaxAttempts: 12, BackoffSeconds: 30}
+	for attempts, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 20: maxDeadLetterBackoff} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
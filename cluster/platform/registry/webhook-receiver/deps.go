@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/homelab/internal/httpkit"
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// triggeredByAnnotation names the upstream build that queued a dependent rebuild
+const triggeredByAnnotation = "homelab.mcztest.com/triggered-by"
+
+const dependenciesSchema = `
+CREATE TABLE IF NOT EXISTS app_dependencies (
+	app        TEXT PRIMARY KEY,
+	repo       TEXT NOT NULL,
+	git_url    TEXT NOT NULL,
+	branch     TEXT NOT NULL,
+	depends_on TEXT NOT NULL DEFAULT ''
+);
+`
+
+// AppSource is where an app was last built from and the apps its image
+// builds FROM, as declared in .build.yaml
+type AppSource struct {
+	App       string   `json:"app"`
+	Repo      string   `json:"repo"`
+	GitURL    string   `json:"gitUrl"`
+	Branch    string   `json:"branch"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// cycleError reports a dependency cycle, e.g. [a b a]
+type cycleError struct {
+	path []string
+}
+
+func (e *cycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.path, " -> ")
+}
+
+// Dependencies returns every app's last known source, keyed by app
+func (h *BuildHistory) Dependencies(ctx context.Context) (map[string]AppSource, error) {
+	rows, err := h.db.QueryContext(ctx, `SELECT app, repo, git_url, branch, depends_on FROM app_dependencies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	graph := make(map[string]AppSource)
+	for rows.Next() {
+		var a AppSource
+		var deps string
+		if err := rows.Scan(&a.App, &a.Repo, &a.GitURL, &a.Branch, &deps); err != nil {
+			return nil, err
+		}
+		if deps != "" {
+			a.DependsOn = strings.Split(deps, ",")
+		}
+		graph[a.App] = a
+	}
+	return graph, rows.Err()
+}
+
+// SetDependencies stores what src depends on, refusing changes that would
+// introduce a cycle
+func (h *BuildHistory) SetDependencies(ctx context.Context, src AppSource, dependsOn []string) error {
+	graph, err := h.Dependencies(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	src.DependsOn = nil
+	for _, dep := range dependsOn {
+		if !seen[dep] {
+			seen[dep] = true
+			src.DependsOn = append(src.DependsOn, dep)
+		}
+	}
+	sort.Strings(src.DependsOn)
+
+	graph[src.App] = src
+	if path := findCycle(graph, src.App); path != nil {
+		return &cycleError{path: path}
+	}
+
+	_, err = h.db.ExecContext(ctx, `
+		INSERT INTO app_dependencies (app, repo, git_url, branch, depends_on)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (app) DO UPDATE SET
+			repo = excluded.repo, git_url = excluded.git_url,
+			branch = excluded.branch, depends_on = excluded.depends_on`,
+		src.App, src.Repo, src.GitURL, src.Branch, strings.Join(src.DependsOn, ","))
+	return err
+}
+
+// Dependents returns the apps that build FROM app directly
+func (h *BuildHistory) Dependents(ctx context.Context, app string) ([]string, error) {
+	graph, err := h.Dependencies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dependentsOf(graph)[app], nil
+}
+
+// findCycle returns a path from start back to itself, if any; the graph was
+// acyclic before start's edges changed, so any new cycle passes through it
+func findCycle(graph map[string]AppSource, start string) []string {
+	visited := make(map[string]bool)
+	var walk func(app string, path []string) []string
+	walk = func(app string, path []string) []string {
+		for _, dep := range graph[app].DependsOn {
+			if dep == start {
+				return append(path, dep)
+			}
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			if cycle := walk(dep, append(path, dep)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return walk(start, []string{start})
+}
+
+// dependentsOf inverts the graph: app -> apps that depend on it
+func dependentsOf(graph map[string]AppSource) map[string][]string {
+	dependents := make(map[string][]string)
+	for _, a := range graph {
+		for _, dep := range a.DependsOn {
+			dependents[dep] = append(dependents[dep], a.App)
+		}
+	}
+	for _, apps := range dependents {
+		sort.Strings(apps)
+	}
+	return dependents
+}
+
+// downstreamOrder returns every app transitively depending on root in
+// topological order (Kahn's algorithm), plus any left over by a cycle
+func downstreamOrder(graph map[string]AppSource, root string) (order, cyclic []string) {
+	dependents := dependentsOf(graph)
+
+	downstream := make(map[string]bool)
+	queue := []string{root}
+	for len(queue) > 0 {
+		app := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[app] {
+			if !downstream[d] && d != root {
+				downstream[d] = true
+				queue = append(queue, d)
+			}
+		}
+	}
+
+	// Count each app's unbuilt upstreams within the cascade
+	inDegree := make(map[string]int)
+	for app := range downstream {
+		for _, dep := range graph[app].DependsOn {
+			if downstream[dep] {
+				inDegree[app]++
+			}
+		}
+	}
+
+	var ready []string
+	for app := range downstream {
+		if inDegree[app] == 0 {
+			ready = append(ready, app)
+		}
+	}
+	sort.Strings(ready)
+	for len(ready) > 0 {
+		app := ready[0]
+		ready = ready[1:]
+		order = append(order, app)
+		for _, d := range dependents[app] {
+			if !downstream[d] {
+				continue
+			}
+			if inDegree[d]--; inDegree[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+
+	for app := range downstream {
+		if inDegree[app] > 0 {
+			cyclic = append(cyclic, app)
+		}
+	}
+	sort.Strings(cyclic)
+	return order, cyclic
+}
+
+// pendingRebuild is a dependent waiting for its upstreams in a cascade
+type pendingRebuild struct {
+	Root      string          `json:"root"`
+	RootTag   string          `json:"-"`
+	WaitingOn map[string]bool `json:"waitingOn"`
+}
+
+// DependencyScheduler rebuilds dependents after an upstream build succeeds.
+// Each app in the cascade starts once every upstream in the same cascade has
+// built, so they run in topological order; a failure drops everything
+// downstream of it.
+type DependencyScheduler struct {
+	history *BuildHistory
+	// config returns the active config, as Server.config
+	config func() *Config
+	// start creates a build, as Server.startBuild
+	start func(ctx context.Context, cfg *Config, fullName string, src BuildSource, opts BuildOptions, extra map[string]string) (string, error)
+
+	mu      sync.Mutex
+	pending map[string]*pendingRebuild
+}
+
+func NewDependencyScheduler(history *BuildHistory, config func() *Config) *DependencyScheduler {
+	return &DependencyScheduler{history: history, config: config, pending: make(map[string]*pendingRebuild)}
+}
+
+// Succeeded plans a cascade for a pushed build, or advances the one that
+// triggered it
+func (s *DependencyScheduler) Succeeded(ctx context.Context, job *batchv1.Job, rec *BuildRecord) {
+	graph, err := s.history.Dependencies(ctx)
+	if err != nil {
+		log.Printf("Failed to load dependencies: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	if _, triggered := job.Annotations[triggeredByAnnotation]; !triggered {
+		order, cyclic := downstreamOrder(graph, rec.App)
+		if len(cyclic) > 0 {
+			log.Printf("Not rebuilding %s after %s: dependency cycle", strings.Join(cyclic, ", "), rec.ID)
+		}
+		inCascade := make(map[string]bool, len(order))
+		for _, app := range order {
+			inCascade[app] = true
+		}
+		for _, app := range order {
+			p := &pendingRebuild{Root: rec.ID, RootTag: rec.Tag, WaitingOn: make(map[string]bool)}
+			for _, dep := range graph[app].DependsOn {
+				if inCascade[dep] {
+					p.WaitingOn[dep] = true
+				}
+			}
+			s.pending[app] = p
+		}
+		if len(order) > 0 {
+			log.Printf("Build %s queues dependent rebuilds: %s", rec.ID, strings.Join(order, ", "))
+		}
+	}
+
+	var ready []string
+	for app, p := range s.pending {
+		delete(p.WaitingOn, rec.App)
+		if len(p.WaitingOn) == 0 {
+			ready = append(ready, app)
+		}
+	}
+	sort.Strings(ready)
+	starts := make(map[string]*pendingRebuild, len(ready))
+	for _, app := range ready {
+		starts[app] = s.pending[app]
+		delete(s.pending, app)
+	}
+	s.mu.Unlock()
+
+	for _, app := range ready {
+		source, ok := graph[app]
+		if !ok {
+			continue
+		}
+		if err := s.rebuild(ctx, source, starts[app]); err != nil {
+			log.Printf("Failed to rebuild %s after %s: %v", app, starts[app].Root, err)
+			s.Failed(app)
+		}
+	}
+}
+
+// Failed drops every pending rebuild downstream of app
+func (s *DependencyScheduler) Failed(app string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blocked := []string{app}
+	for len(blocked) > 0 {
+		upstream := blocked[0]
+		blocked = blocked[1:]
+		for name, p := range s.pending {
+			if p.WaitingOn[upstream] {
+				log.Printf("Skipping rebuild of %s: upstream %s failed", name, upstream)
+				delete(s.pending, name)
+				blocked = append(blocked, name)
+			}
+		}
+	}
+}
+
+// rebuild builds the head of the app's branch against the fresh upstream
+func (s *DependencyScheduler) rebuild(ctx context.Context, source AppSource, p *pendingRebuild) error {
+	cfg := s.config()
+	commit, err := branchHead(ctx, cfg, source.Repo, source.Branch)
+	if err != nil {
+		return err
+	}
+
+	settings := cfg.SettingsFor(source.Repo)
+	opts := BuildOptions{Submodules: settings.Submodules, LFS: settings.LFS}
+	src := BuildSource{
+		App:    source.App,
+		GitURL: source.GitURL,
+		Branch: source.Branch,
+		Commit: commit,
+		// Distinct from the commit's own build, which may still exist
+		Tag: commit[:7] + "-" + p.RootTag,
+	}
+
+	buildID, err := s.start(ctx, cfg, source.Repo, src, opts, map[string]string{triggeredByAnnotation: p.Root})
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebuilding %s as %s after %s", source.App, buildID, p.Root)
+	return nil
+}
+
+// handleDependencies serves the dependency graph and queued rebuilds:
+//
+//	GET /dependencies
+func (s *Server) handleDependencies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	graph, err := s.history.Dependencies(r.Context())
+	if err != nil {
+		log.Printf("Failed to load dependencies: %v", err)
+		http.Error(w, "Failed to load dependencies", http.StatusInternalServerError)
+		return
+	}
+	apps := make([]AppSource, 0, len(graph))
+	for _, a := range graph {
+		apps = append(apps, a)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].App < apps[j].App })
+
+	s.deps.mu.Lock()
+	pending := make(map[string]pendingRebuild, len(s.deps.pending))
+	for app, p := range s.deps.pending {
+		waiting := make(map[string]bool, len(p.WaitingOn))
+		for dep := range p.WaitingOn {
+			waiting[dep] = true
+		}
+		pending[app] = pendingRebuild{Root: p.Root, WaitingOn: waiting}
+	}
+	s.deps.mu.Unlock()
+
+	httpkit.WriteJSON(w, http.StatusOK, struct {
+		Apps    []AppSource               `json:"apps"`
+		Pending map[string]pendingRebuild `json:"pending"`
+	}{apps, pending})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BuildOptions are per-build overrides taken from the commit message
+type BuildOptions struct {
+	Skip       bool
+	NoCache    bool
+	Arch       string
+	Dockerfile string
+	Target     string
+	BuildArgs  map[string]string
+
+	// Set from repo settings rather than the commit message
+	Submodules bool
+	LFS        bool
+	// Workspace clones the source even without submodules or LFS, for
+	// builds that collect artifacts
+	Workspace bool
+}
+
+// needsClone reports whether the source must be cloned by an init container
+func (o BuildOptions) needsClone() bool {
+	return o.Submodules || o.LFS || o.Workspace
+}
+
+// directivePattern matches bracketed directives such as [skip ci] or [build arch=arm64]
+var directivePattern = regexp.MustCompile(`\[([a-zA-Z][^\[\]]*)\]`)
+
+var supportedArches = map[string]bool{"amd64": true, "arm64": true}
+
+// parseDirectives reads CI-style directives from a commit message:
+//
+//	[skip ci] / [ci skip]          no build
+//	[no-cache]                     build without the kaniko layer cache
+//	[build arch=arm64]             build on a node of that architecture
+//	[build dockerfile=path]        use another Dockerfile
+//	[build target=stage]           stop at a multi-stage target
+//	[build arg:NAME=value]         pass a --build-arg
+//
+// Unknown directives are reported so the caller can log them rather than fail.
+func parseDirectives(message string) (BuildOptions, []string) {
+	opts := BuildOptions{BuildArgs: map[string]string{}}
+	var warnings []string
+
+	for _, m := range directivePattern.FindAllStringSubmatch(message, -1) {
+		fields := strings.Fields(strings.ToLower(m[1]))
+		raw := strings.Fields(m[1])
+
+		switch {
+		case len(fields) == 2 && (fields[0] == "skip" && fields[1] == "ci" || fields[0] == "ci" && fields[1] == "skip"):
+			opts.Skip = true
+		case len(fields) == 1 && fields[0] == "no-cache":
+			opts.NoCache = true
+		case len(fields) > 1 && fields[0] == "build":
+			for _, kv := range raw[1:] {
+				key, value, ok := strings.Cut(kv, "=")
+				if !ok || value == "" {
+					warnings = append(warnings, fmt.Sprintf("ignoring malformed build option %q", kv))
+					continue
+				}
+				switch k := strings.ToLower(key); {
+				case k == "arch":
+					if !supportedArches[strings.ToLower(value)] {
+						warnings = append(warnings, fmt.Sprintf("ignoring unsupported arch %q", value))
+						continue
+					}
+					opts.Arch = strings.ToLower(value)
+				case k == "dockerfile":
+					opts.Dockerfile = value
+				case k == "target":
+					opts.Target = value
+				case k == "no-cache":
+					opts.NoCache = value == "true"
+				case strings.HasPrefix(k, "arg:"):
+					opts.BuildArgs[key[len("arg:"):]] = value
+				default:
+					warnings = append(warnings, fmt.Sprintf("ignoring unknown build option %q", key))
+				}
+			}
+		}
+	}
+
+	return opts, warnings
+}
+
+// kanikoArgs returns the extra executor flags for the options
+func (o BuildOptions) kanikoArgs() []string {
+	var args []string
+	if o.Arch != "" {
+		args = append(args, "--custom-platform=linux/"+o.Arch)
+	}
+	if o.Target != "" {
+		args = append(args, "--target="+o.Target)
+	}
+
+	names := make([]string, 0, len(o.BuildArgs))
+	for name := range o.BuildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, fmt.Sprintf("--build-arg=%s=%s", name, o.BuildArgs[name]))
+	}
+	return args
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDirectives(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		want     BuildOptions
+		warnings int
+	}{
+		{name: "none", message: "Fix the thing", want: BuildOptions{}},
+		{name: "skip ci", message: "Docs only [skip ci]", want: BuildOptions{Skip: true}},
+		{name: "ci skip", message: "Docs only [CI Skip]", want: BuildOptions{Skip: true}},
+		{name: "no cache", message: "Bump base [no-cache]", want: BuildOptions{NoCache: true}},
+		{
+			name:    "build options",
+			message: "Try arm [build arch=ARM64 dockerfile=docker/Dockerfile target=runtime arg:VERSION=1.2]",
+			want: BuildOptions{
+				Arch: "arm64", Dockerfile: "docker/Dockerfile", Target: "runtime",
+				BuildArgs: map[string]string{"VERSION": "1.2"},
+			},
+		},
+		{name: "several directives", message: "[no-cache] then [build arch=amd64]", want: BuildOptions{NoCache: true, Arch: "amd64"}},
+		{name: "unsupported arch", message: "[build arch=riscv64]", want: BuildOptions{}, warnings: 1},
+		{name: "malformed and unknown options", message: "[build arch memory=4Gi]", want: BuildOptions{}, warnings: 2},
+		{name: "links are not directives", message: "See [1] and [the docs](http://example.com)", want: BuildOptions{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings := parseDirectives(tt.message)
+			if tt.want.BuildArgs == nil {
+				tt.want.BuildArgs = map[string]string{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("options = %+v, want %+v", got, tt.want)
+			}
+			if len(warnings) != tt.warnings {
+				t.Errorf("warnings = %q, want %d", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestKanikoArgsAreOrdered(t *testing.T) {
+	opts := BuildOptions{Arch: "arm64", Target: "runtime", BuildArgs: map[string]string{"B": "2", "A": "1"}}
+	want := []string{"--custom-platform=linux/arm64", "--target=runtime", "--build-arg=A=1", "--build-arg=B=2"}
+	if got := opts.kanikoArgs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("args = %q, want %q", got, want)
+	}
+}
+
+func TestNeedsClone(t *testing.T) {
+	for _, opts := range []BuildOptions{{Submodules: true}, {LFS: true}, {Workspace: true}} {
+		if !opts.needsClone() {
+			t.Errorf("%+v does not clone", opts)
+		}
+	}
+	if (BuildOptions{NoCache: true, Arch: "amd64"}).needsClone() {
+		t.Error("plain build clones")
+	}
+}
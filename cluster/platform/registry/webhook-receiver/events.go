@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Build event types
+const (
+	EventStatus   = "status"
+	EventProgress = "progress"
+)
+
+// Progress phases parsed from the kaniko log
+const (
+	PhaseStage = "stage"
+	PhaseStep  = "step"
+	PhasePush  = "push"
+)
+
+// eventBuffer is how many events a slow subscriber may fall behind before
+// events are dropped for it
+const eventBuffer = 64
+
+// eventKeepalive keeps idle streams open through proxies
+const eventKeepalive = 15 * time.Second
+
+// BuildEvent is a build lifecycle change, or a progress line of a running
+// build: kaniko starting a stage, running a Dockerfile instruction (step of
+// steps, when the Dockerfile could be read), or pushing
+type BuildEvent struct {
+	Type    string    `json:"type"`
+	Build   string    `json:"build"`
+	Variant string    `json:"variant,omitempty"`
+	App     string    `json:"app"`
+	Status  string    `json:"status,omitempty"`
+	Phase   string    `json:"phase,omitempty"`
+	Step    int       `json:"step,omitempty"`
+	Steps   int       `json:"steps,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// EventHub fans build events out to /builds/events subscribers
+type EventHub struct {
+	mu   sync.Mutex
+	subs map[chan BuildEvent]struct{}
+	// last is the status last published per build and variant, as the
+	// tracker sees the same state on every informer update
+	last map[string]string
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[chan BuildEvent]struct{}), last: make(map[string]string)}
+}
+
+// Subscribe returns a channel of events and a function ending the
+// subscription
+func (h *EventHub) Subscribe() (<-chan BuildEvent, func()) {
+	ch := make(chan BuildEvent, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *EventHub) publish(ev BuildEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Status publishes a build's or variant's status if it changed, reporting
+// whether it did
+func (h *EventHub) Status(build, variant, app, status string) bool {
+	if h == nil {
+		return false
+	}
+	key := build + "/" + variant
+	h.mu.Lock()
+	changed := h.last[key] != status
+	if status == BuildSucceeded || status == BuildFailed {
+		delete(h.last, key)
+	} else {
+		h.last[key] = status
+	}
+	h.mu.Unlock()
+	if changed {
+		h.publish(BuildEvent{Type: EventStatus, Build: build, Variant: variant, App: app, Status: status})
+	}
+	return changed
+}
+
+// kanikoLogPattern matches kaniko's logrus lines, e.g. INFO[0012] RUN make
+var kanikoLogPattern = regexp.MustCompile(`^(?:INFO|WARN)\[\d+\] (.*)$`)
+
+// dockerInstructions are the instructions kaniko logs as it executes them
+var dockerInstructions = map[string]bool{
+	"RUN": true, "COPY": true, "ADD": true, "WORKDIR": true, "ENV": true, "ARG": true,
+	"USER": true, "EXPOSE": true, "CMD": true, "ENTRYPOINT": true, "LABEL": true,
+	"VOLUME": true, "SHELL": true, "HEALTHCHECK": true, "STOPSIGNAL": true, "ONBUILD": true,
+}
+
+// countInstructions counts the instructions kaniko will log for a
+// Dockerfile: everything but FROM, across all stages
+func countInstructions(dockerfile string) int {
+	n := 0
+	continued := false
+	for _, line := range strings.Split(dockerfile, "\n") {
+		line = strings.TrimSpace(line)
+		wasContinued := continued
+		continued = strings.HasSuffix(line, "\\")
+		if wasContinued || line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		word, _, _ := strings.Cut(line, " ")
+		if dockerInstructions[strings.ToUpper(word)] {
+			n++
+		}
+	}
+	return n
+}
+
+// dockerfileSteps reads the job's Dockerfile from Gitea to size its
+// progress, or returns 0
+func dockerfileSteps(ctx context.Context, cfg *Config, job *batchv1.Job, c corev1.Container) int {
+	path := "Dockerfile"
+	for _, arg := range c.Args {
+		if v, ok := strings.CutPrefix(arg, "--dockerfile="); ok {
+			path = strings.TrimPrefix(strings.TrimPrefix(v, workspaceDir+"/"), "./")
+		}
+	}
+	data, err := fetchRepoFile(ctx, cfg, job.Annotations[repoAnnotation], job.Annotations[commitAnnotation], path)
+	if err != nil || data == nil {
+		return 0
+	}
+	return countInstructions(string(data))
+}
+
+// followProgress streams a running build's kaniko log and publishes its
+// stages, steps, and push as progress events until the container exits
+func (t *BuildTracker) followProgress(ctx context.Context, job *batchv1.Job, build, variant string) {
+	if t.events == nil || isPipelineJob(job) {
+		return
+	}
+	var kaniko *corev1.Container
+	for i := range job.Spec.Template.Spec.Containers {
+		if job.Spec.Template.Spec.Containers[i].Name == "kaniko" {
+			kaniko = &job.Spec.Template.Spec.Containers[i]
+		}
+	}
+	if kaniko == nil {
+		return
+	}
+	app := job.Labels["app-name"]
+	steps := dockerfileSteps(ctx, t.config(), job, *kaniko)
+
+	// The pod may still be cloning; logs are available once kaniko starts
+	var stream io.ReadCloser
+	for attempt := 0; attempt < 60 && stream == nil; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		pod := latestPod(ctx, t.kube, job)
+		if pod == nil {
+			continue
+		}
+		s, err := t.kube.CoreV1().Pods(job.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container: "kaniko",
+			Follow:    true,
+		}).Stream(ctx)
+		if err == nil {
+			stream = s
+		}
+	}
+	if stream == nil {
+		log.Printf("Failed to follow the log of %s, no progress events", job.Name)
+		return
+	}
+	defer stream.Close()
+
+	step := 0
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := kanikoLogPattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		msg := m[1]
+		ev := BuildEvent{Type: EventProgress, Build: build, Variant: variant, App: app, Steps: steps}
+		word, _, _ := strings.Cut(msg, " ")
+		switch {
+		case strings.HasPrefix(msg, "Building stage "):
+			ev.Phase = PhaseStage
+		case dockerInstructions[word]:
+			step++
+			ev.Phase = PhaseStep
+			// Cached and skipped layers can log more than counted
+			if steps > 0 && step > steps {
+				step = steps
+			}
+		case strings.HasPrefix(msg, "Pushing image to "):
+			ev.Phase = PhasePush
+		default:
+			continue
+		}
+		ev.Step = step
+		if len(msg) > 200 {
+			msg = msg[:200] + "..."
+		}
+		ev.Message = msg
+		t.events.publish(ev)
+	}
+}
+
+// handleBuildEvents streams build events as server-sent events:
+//
+//	GET /builds/events?app=<name>&build=<id>
+//
+// Each event's name is its type (status or progress) and its data the JSON
+// BuildEvent. Both filters are optional.
+func (s *Server) handleBuildEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rc := http.NewResponseController(w)
+	// Streams outlive the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	app, build := r.URL.Query().Get("app"), r.URL.Query().Get("build")
+
+	events, cancel := s.tracker.events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops ingress-nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-events:
+			if (app != "" && ev.App != app) || (build != "" && ev.Build != build) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("Failed to encode build event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// RepoFilter decides which repositories get builds when a single org-level
+// webhook delivers pushes for every repo in the organization. Patterns are
+// globs on "owner/name", e.g. "homelab/*" or "*/scratch-*".
+type RepoFilter struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Allowed reports whether fullName passes the filter. Deny wins over allow;
+// an empty allowlist allows everything not denied.
+func (f *RepoFilter) Allowed(fullName string) bool {
+	fullName = strings.ToLower(fullName)
+	if matchAny(f.Deny, fullName) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchAny(f.Allow, fullName)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// giteaRequest creates an internal API request, authenticated when the
+// config has a Gitea token; a body is sent as JSON
+func giteaRequest(ctx context.Context, cfg *Config, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s/api/v1%s", cfg.GiteaInternalHost, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cfg.GiteaToken != "" {
+		req.Header.Set("Authorization", "token "+cfg.GiteaToken)
+	}
+	return req, nil
+}
+
+// fetchRepoFile reads a file at commit through the Gitea raw API; a missing
+// file returns nil
+func fetchRepoFile(ctx context.Context, cfg *Config, fullName, commit, file string) ([]byte, error) {
+	req, err := giteaRequest(ctx, cfg, http.MethodGet, fmt.Sprintf("/repos/%s/raw/%s?ref=%s", fullName, file, url.QueryEscape(commit)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", file, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 256*1024))
+}
+
+// branchHead returns the commit a branch currently points at
+func branchHead(ctx context.Context, cfg *Config, fullName, branch string) (string, error) {
+	req, err := giteaRequest(ctx, cfg, http.MethodGet, fmt.Sprintf("/repos/%s/branches/%s", fullName, url.PathEscape(branch)), nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching branch %s of %s: %s", branch, fullName, resp.Status)
+	}
+
+	var b struct {
+		Commit struct {
+			ID string `json:"id"`
+		} `json:"commit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		return "", err
+	}
+	if len(b.Commit.ID) < 7 {
+		return "", fmt.Errorf("branch %s of %s has no commit", branch, fullName)
+	}
+	return b.Commit.ID, nil
+}
+
+// giteaJSON sends in (when non-nil) and decodes the response into out (when
+// non-nil)
+func giteaJSON(ctx context.Context, cfg *Config, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := giteaRequest(ctx, cfg, method, path, body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestGiteaRequestUsesConfigToken(t *testing.T) {
+	cfg := defaultConfig()
+	r, err := giteaRequest(context.Background(), cfg, http.MethodGet, "/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		t.Fatalf("anonymous request sent %q", auth)
+	}
+
+	cfg.GiteaToken = "s3cret"
+	r, err = giteaRequest(context.Background(), cfg, http.MethodGet, "/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "token s3cret" {
+		t.Fatalf("Authorization = %q", auth)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// goCacheAnnotation marks builds of Go modules, which get their app's Go
+// cache volume
+const goCacheAnnotation = "homelab.mcztest.com/go-cache"
+
+// goCacheDir is where the Go cache volume is mounted in kaniko containers
+const goCacheDir = "/go-cache"
+
+// GoCacheSettings keeps a volume per Go app for its module and build
+// caches, so incremental builds skip downloading and compiling what has
+// not changed. Kaniko has no RUN cache mounts, so the caches reach the
+// build as build args: a Dockerfile opts in by declaring
+//
+//	ARG GOMODCACHE
+//	ARG GOCACHE
+//
+// in the stage running go build, which exports them to its RUN steps. The
+// mount is left out of the image.
+type GoCacheSettings struct {
+	Enabled      bool              `json:"enabled"`
+	StorageClass string            `json:"storageClass"`
+	Size         resource.Quantity `json:"size"`
+}
+
+// goCacheClaim names an app's cache PVC; arch-pinned builds get one per
+// arch, as node-local volumes would otherwise pin them to the first node
+func goCacheClaim(app, arch string) string {
+	name := "go-cache-" + app
+	if arch != "" {
+		name += "-" + arch
+	}
+	return name
+}
+
+// isGoModule reports whether the commit has a go.mod at the repo root
+func isGoModule(ctx context.Context, cfg *Config, fullName, commit string) bool {
+	if !cfg.GoCache.Enabled {
+		return false
+	}
+	data, err := fetchRepoFile(ctx, cfg, fullName, commit, "go.mod")
+	if err != nil {
+		log.Printf("Failed to look up go.mod of %s, building without the Go cache: %v", fullName, err)
+		return false
+	}
+	return data != nil
+}
+
+// ensureGoCache creates the app's cache PVC if it does not exist yet
+func (s *Server) ensureGoCache(ctx context.Context, cfg *Config, claim, app string) error {
+	pvcs := s.kube.CoreV1().PersistentVolumeClaims(buildNamespace)
+	if _, err := pvcs.Get(ctx, claim, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		return err
+	}
+	storageClass := cfg.GoCache.StorageClass
+	_, err := pvcs.Create(ctx, &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      claim,
+			Namespace: buildNamespace,
+			Labels:    map[string]string{"app": "go-cache", "app-name": app},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: &storageClass,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: cfg.GoCache.Size},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err == nil {
+		log.Printf("Created Go cache volume %s", claim)
+	}
+	return err
+}
+
+// addGoCache mounts the app's Go cache into the job's kaniko containers.
+// When the volume cannot be created the build runs without it.
+func (s *Server) addGoCache(ctx context.Context, cfg *Config, job *batchv1.Job, opts BuildOptions) {
+	if job.Annotations[goCacheAnnotation] == "" {
+		return
+	}
+	app := job.Labels["app-name"]
+	claim := goCacheClaim(app, opts.Arch)
+	if err := s.ensureGoCache(ctx, cfg, claim, app); err != nil {
+		log.Printf("Failed to create Go cache volume %s, building without it: %v", claim, err)
+		delete(job.Annotations, goCacheAnnotation)
+		return
+	}
+	job.Annotations[goCacheAnnotation] = claim
+
+	spec := &job.Spec.Template.Spec
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "go-cache",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+		},
+	})
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			if c.Image != cfg.KanikoImage {
+				continue
+			}
+			c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: "go-cache", MountPath: goCacheDir})
+			c.Args = append(c.Args,
+				fmt.Sprintf("--build-arg=GOMODCACHE=%s/mod", goCacheDir),
+				fmt.Sprintf("--build-arg=GOCACHE=%s/build", goCacheDir))
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Build status values stored in history
+const (
+	BuildPending   = "pending"
+	BuildRunning   = "running"
+	BuildSucceeded = "succeeded"
+	BuildFailed    = "failed"
+)
+
+// BuildRecord is one build in the history database
+type BuildRecord struct {
+	ID         string       `json:"id"`
+	App        string       `json:"app"`
+	Repo       string       `json:"repo"`
+	Commit     string       `json:"commit"`
+	Branch     string       `json:"branch"`
+	Tag        string       `json:"tag"`
+	Image      string       `json:"image"`
+	Status     string       `json:"status"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+	Duration   float64      `json:"durationSeconds,omitempty"`
+	ImageSize  int64        `json:"imageSizeBytes,omitempty"`
+	LogExcerpt string       `json:"logExcerpt,omitempty"`
+	Steps      []StepStatus `json:"steps,omitempty"`
+	// Variants are the jobs of a matrix build
+	Variants []VariantStatus `json:"variants,omitempty"`
+}
+
+// BuildHistory persists build records in SQLite so they survive restarts
+type BuildHistory struct {
+	db *sql.DB
+}
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS builds (
+	id          TEXT PRIMARY KEY,
+	app         TEXT NOT NULL,
+	repo        TEXT NOT NULL DEFAULT '',
+	commit_sha  TEXT NOT NULL DEFAULT '',
+	branch      TEXT NOT NULL DEFAULT '',
+	tag         TEXT NOT NULL DEFAULT '',
+	image       TEXT NOT NULL DEFAULT '',
+	status      TEXT NOT NULL,
+	created_at  INTEGER NOT NULL,
+	finished_at INTEGER,
+	duration    REAL NOT NULL DEFAULT 0,
+	log_excerpt TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS builds_app_created ON builds (app, created_at);
+CREATE INDEX IF NOT EXISTS builds_created ON builds (created_at);
+`
+
+// OpenBuildHistory opens (and migrates) the database at path
+func OpenBuildHistory(path string) (*BuildHistory, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; avoid SQLITE_BUSY between goroutines
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(historySchema + dependenciesSchema + runnerQueueSchema + deadLetterSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+	// Columns added after the initial schema; each fails harmlessly once it exists
+	for _, column := range []string{
+		`steps TEXT NOT NULL DEFAULT ''`,
+		`image_size INTEGER NOT NULL DEFAULT 0`,
+		`variants TEXT NOT NULL DEFAULT ''`,
+		`provenance TEXT NOT NULL DEFAULT ''`,
+	} {
+		if _, err := db.Exec(`ALTER TABLE builds ADD COLUMN ` + column); err != nil &&
+			!strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("migrating schema: %w", err)
+		}
+	}
+	return &BuildHistory{db: db}, nil
+}
+
+func (h *BuildHistory) Close() error {
+	return h.db.Close()
+}
+
+// Record inserts a new build, or leaves an existing one untouched
+func (h *BuildHistory) Record(ctx context.Context, b *BuildRecord) error {
+	variants, err := marshalVariants(b.Variants)
+	if err != nil {
+		return err
+	}
+	_, err = h.db.ExecContext(ctx, `
+		INSERT INTO builds (id, app, repo, commit_sha, branch, tag, image, status, created_at, variants)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		b.ID, b.App, b.Repo, b.Commit, b.Branch, b.Tag, b.Image, b.Status, b.CreatedAt.Unix(), variants)
+	return err
+}
+
+// SetVariants updates the per-variant results of a matrix build
+func (h *BuildHistory) SetVariants(ctx context.Context, id string, variants []VariantStatus) error {
+	data, err := marshalVariants(variants)
+	if err != nil {
+		return err
+	}
+	_, err = h.db.ExecContext(ctx, `UPDATE builds SET variants = ? WHERE id = ?`, data, id)
+	return err
+}
+
+func marshalVariants(variants []VariantStatus) (string, error) {
+	if len(variants) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(variants)
+	return string(data), err
+}
+
+// SetStatus updates a running build
+func (h *BuildHistory) SetStatus(ctx context.Context, id, status string) error {
+	_, err := h.db.ExecContext(ctx, `
+		UPDATE builds SET status = ? WHERE id = ? AND finished_at IS NULL`, status, id)
+	return err
+}
+
+// Finish records the result of a build and, for pipelines, its steps
+func (h *BuildHistory) Finish(ctx context.Context, id, status string, finishedAt time.Time, logExcerpt string, steps []StepStatus) error {
+	stepsJSON := ""
+	if len(steps) > 0 {
+		data, err := json.Marshal(steps)
+		if err != nil {
+			return err
+		}
+		stepsJSON = string(data)
+	}
+
+	_, err := h.db.ExecContext(ctx, `
+		UPDATE builds
+		SET status = ?, finished_at = ?, duration = MAX(? - created_at, 0), log_excerpt = ?, steps = ?
+		WHERE id = ?`,
+		status, finishedAt.Unix(), finishedAt.Unix(), logExcerpt, stepsJSON, id)
+	return err
+}
+
+// SetImageSize records the compressed size of a pushed image
+func (h *BuildHistory) SetImageSize(ctx context.Context, id string, size int64) error {
+	_, err := h.db.ExecContext(ctx, `UPDATE builds SET image_size = ? WHERE id = ?`, size, id)
+	return err
+}
+
+// SetProvenance stores the in-toto provenance statement of a build
+func (h *BuildHistory) SetProvenance(ctx context.Context, id, statement string) error {
+	_, err := h.db.ExecContext(ctx, `UPDATE builds SET provenance = ? WHERE id = ?`, statement, id)
+	return err
+}
+
+// Provenance returns a build's provenance statement, or "" if it has none
+func (h *BuildHistory) Provenance(ctx context.Context, id string) (string, error) {
+	var statement string
+	err := h.db.QueryRowContext(ctx, `SELECT provenance FROM builds WHERE id = ?`, id).Scan(&statement)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return statement, err
+}
+
+// Finished reports whether the build already has a result
+func (h *BuildHistory) Finished(ctx context.Context, id string) (bool, error) {
+	var finished sql.NullInt64
+	err := h.db.QueryRowContext(ctx, `SELECT finished_at FROM builds WHERE id = ?`, id).Scan(&finished)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return finished.Valid, err
+}
+
+// Get returns a single build
+func (h *BuildHistory) Get(ctx context.Context, id string) (*BuildRecord, error) {
+	rows, err := h.db.QueryContext(ctx, selectBuilds+` WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	builds, err := scanBuilds(rows)
+	if err != nil || len(builds) == 0 {
+		return nil, err
+	}
+	return &builds[0], nil
+}
+
+// List returns the newest builds first, optionally for one app
+func (h *BuildHistory) List(ctx context.Context, app string, limit int) ([]BuildRecord, error) {
+	query := selectBuilds
+	var args []interface{}
+	if app != "" {
+		query += ` WHERE app = ?`
+		args = append(args, app)
+	}
+	query += ` ORDER BY created_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanBuilds(rows)
+}
+
+// Since returns finished builds created after since, oldest first,
+// optionally for one app
+func (h *BuildHistory) Since(ctx context.Context, app string, since time.Time) ([]BuildRecord, error) {
+	query := selectBuilds + ` WHERE created_at >= ? AND finished_at IS NOT NULL`
+	args := []interface{}{since.Unix()}
+	if app != "" {
+		query += ` AND app = ?`
+		args = append(args, app)
+	}
+	query += ` ORDER BY created_at ASC`
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanBuilds(rows)
+}
+
+// Prune deletes finished builds older than retention
+func (h *BuildHistory) Prune(ctx context.Context, retention time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-retention).Unix()
+	res, err := h.db.ExecContext(ctx, `
+		DELETE FROM builds WHERE created_at < ? AND finished_at IS NOT NULL`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const selectBuilds = `
+	SELECT id, app, repo, commit_sha, branch, tag, image, status, created_at, finished_at, duration, log_excerpt, steps, image_size, variants
+	FROM builds`
+
+func scanBuilds(rows *sql.Rows) ([]BuildRecord, error) {
+	defer rows.Close()
+
+	var builds []BuildRecord
+	for rows.Next() {
+		var b BuildRecord
+		var created int64
+		var finished sql.NullInt64
+		var steps, variants string
+		if err := rows.Scan(&b.ID, &b.App, &b.Repo, &b.Commit, &b.Branch, &b.Tag, &b.Image,
+			&b.Status, &created, &finished, &b.Duration, &b.LogExcerpt, &steps, &b.ImageSize, &variants); err != nil {
+			return nil, err
+		}
+		if steps != "" {
+			if err := json.Unmarshal([]byte(steps), &b.Steps); err != nil {
+				return nil, err
+			}
+		}
+		if variants != "" {
+			if err := json.Unmarshal([]byte(variants), &b.Variants); err != nil {
+				return nil, err
+			}
+		}
+		b.CreatedAt = time.Unix(created, 0).UTC()
+		if finished.Valid {
+			t := time.Unix(finished.Int64, 0).UTC()
+			b.FinishedAt = &t
+		}
+		builds = append(builds, b)
+	}
+	return builds, rows.Err()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workspaceDir holds the init-container clone for dir:// builds
+const workspaceDir = "/workspace"
+
+// kanikoCacheDir is where the shared cache volume is mounted in builds
+const kanikoCacheDir = "/cache"
+
+// internalCADir is where build and chart pods mount the CAConfigMap
+const internalCADir = "/etc/ssl/internal"
+
+// BuildSource identifies what a job builds
+type BuildSource struct {
+	App    string
+	GitURL string
+	Branch string
+	Commit string
+	Tag    string
+	// PushLatest also tags the image :latest, for apps others build FROM
+	PushLatest bool
+	// Registry names the destination pushed to; empty is Config.Registry
+	Registry string
+}
+
+func (s BuildSource) registry(cfg *Config) string {
+	if d := cfg.Destination(s.Registry); d != nil {
+		return d.Host
+	}
+	return cfg.Registry
+}
+
+func (s BuildSource) image(cfg *Config) string {
+	return fmt.Sprintf("%s/%s:%s", s.registry(cfg), s.App, s.Tag)
+}
+
+// latest is the :latest alias pushed for apps others build FROM
+func (s BuildSource) latest(cfg *Config) string {
+	return fmt.Sprintf("%s/%s:latest", s.registry(cfg), s.App)
+}
+
+func createBuildJob(cfg *Config, src BuildSource, opts BuildOptions) *batchv1.Job {
+	buildContext := fmt.Sprintf("git://%s#refs/heads/%s", src.GitURL, src.Branch)
+	if opts.needsClone() {
+		buildContext = "dir://" + workspaceDir
+	}
+
+	spec := basePodSpec(cfg, opts)
+	if opts.needsClone() {
+		addWorkspace(&spec)
+		spec.InitContainers = append(spec.InitContainers, cloneContainer(cfg, src, opts))
+	}
+	spec.Containers = []corev1.Container{kanikoContainer(cfg, src, "kaniko", buildContext, opts)}
+
+	return newBuildJob(cfg, src, spec)
+}
+
+func newBuildJob(cfg *Config, src BuildSource, spec corev1.PodSpec) *batchv1.Job {
+	jobName := fmt.Sprintf("build-%s-%s", src.App, src.Tag)
+	ttl := cfg.JobTTLSeconds
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: buildNamespace,
+			Labels: map[string]string{
+				"app":      "build-job",
+				"app-name": src.App,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"app": "build-job",
+					},
+				},
+				Spec: spec,
+			},
+		},
+	}
+}
+
+// basePodSpec has the kaniko docker config, internal CA, registry
+// certificate, and cache volumes and arch pinning
+func basePodSpec(cfg *Config, opts BuildOptions) corev1.PodSpec {
+	spec := corev1.PodSpec{
+		RestartPolicy: corev1.RestartPolicyNever,
+		Volumes: []corev1.Volume{
+			{
+				Name: "docker-config",
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			},
+		},
+	}
+
+	// Push credentials rotated by the secrets operator; pods read the Secret
+	// at start, and the previous credentials stay valid for running builds
+	if cfg.PushSecret != "" {
+		optional := true
+		spec.Volumes[0].VolumeSource = corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: cfg.PushSecret,
+				Optional:   &optional,
+				Items:      []corev1.KeyToPath{{Key: corev1.DockerConfigJsonKey, Path: "config.json"}},
+			},
+		}
+	}
+
+	if cfg.CAConfigMap != "" {
+		optional := true
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name: "internal-ca",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: cfg.CAConfigMap},
+					Optional:             &optional,
+				},
+			},
+		})
+	}
+
+	for _, t := range cfg.RegistryTLS {
+		if t.CASecret != "" {
+			addRegistryCert(&spec, t)
+		}
+	}
+
+	if cfg.CacheVolume != "" {
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name: "kaniko-cache",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: cfg.CacheVolume},
+			},
+		})
+	}
+
+	// Kaniko cannot cross-compile, so pin the pod to a node of the target arch
+	if opts.Arch != "" {
+		spec.NodeSelector = map[string]string{"kubernetes.io/arch": opts.Arch}
+	}
+	return spec
+}
+
+func addWorkspace(spec *corev1.PodSpec) {
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name:         "workspace",
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+}
+
+var workspaceMount = corev1.VolumeMount{Name: "workspace", MountPath: workspaceDir}
+
+var internalCAMount = corev1.VolumeMount{Name: "internal-ca", MountPath: internalCADir, ReadOnly: true}
+
+// kanikoContainer builds and pushes src from buildContext
+func kanikoContainer(cfg *Config, src BuildSource, name, buildContext string, opts BuildOptions) corev1.Container {
+	dockerfilePath := "./Dockerfile"
+	if opts.Dockerfile != "" {
+		dockerfilePath = opts.Dockerfile
+	}
+	if buildContext == "dir://"+workspaceDir {
+		dockerfilePath = path.Join(workspaceDir, dockerfilePath)
+	}
+
+	args := []string{
+		fmt.Sprintf("--dockerfile=%s", dockerfilePath),
+		fmt.Sprintf("--context=%s", buildContext),
+		fmt.Sprintf("--destination=%s", src.image(cfg)),
+	}
+	args = append(args, registryTLSArgs(cfg)...)
+	if src.PushLatest {
+		args = append(args, "--destination="+src.latest(cfg))
+	}
+	if opts.NoCache {
+		args = append(args, "--cache=false")
+	} else {
+		// Layers cached by a build of another arch are never hits, so each
+		// arch keeps its own cache rather than evicting the other's
+		cacheRepo, cacheDir := cfg.CacheRepo, kanikoCacheDir
+		if opts.Arch != "" {
+			cacheRepo += "/" + opts.Arch
+			cacheDir += "/" + opts.Arch
+		}
+		args = append(args, "--cache=true", "--cache-repo="+cacheRepo)
+		if cfg.CacheVolume != "" {
+			args = append(args, "--cache-dir="+cacheDir)
+		}
+	}
+	args = append(args, opts.kanikoArgs()...)
+
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "docker-config",
+			MountPath: "/kaniko/.docker/",
+		},
+	}
+	if buildContext == "dir://"+workspaceDir {
+		mounts = append(mounts, workspaceMount)
+	}
+	if cfg.CAConfigMap != "" {
+		mounts = append(mounts, internalCAMount)
+	}
+	if cfg.hasRegistryCerts() {
+		mounts = append(mounts, registryCertsMount)
+	}
+	if cfg.CacheVolume != "" {
+		mounts = append(mounts, corev1.VolumeMount{Name: "kaniko-cache", MountPath: kanikoCacheDir})
+	}
+
+	return corev1.Container{
+		Name:         name,
+		Image:        cfg.KanikoImage,
+		Args:         args,
+		Resources:    cfg.Resources,
+		VolumeMounts: mounts,
+	}
+}
+
+// cloneScript checks out the exact commit with submodules and LFS objects
+const cloneScript = `set -eu
+if [ "$GIT_LFS" = "true" ] && ! command -v git-lfs >/dev/null; then
+  apk add --no-cache git-lfs >/dev/null
+fi
+# Absolute submodule URLs point at the public Gitea host
+git config --global url."http://$GITEA_INTERNAL_HOST/".insteadOf "https://$GITEA_HOST/"
+git clone --branch "$GIT_BRANCH" "$GIT_URL" "$WORKSPACE"
+cd "$WORKSPACE"
+git checkout --quiet "$GIT_COMMIT"
+if [ "$GIT_SUBMODULES" = "true" ]; then
+  git submodule update --init --recursive --depth 1
+fi
+if [ "$GIT_LFS" = "true" ]; then
+  git lfs install --local
+  git lfs pull
+fi
+git log -1 --oneline
+`
+
+func cloneContainer(cfg *Config, src BuildSource, opts BuildOptions) corev1.Container {
+	return corev1.Container{
+		Name:    "clone",
+		Image:   cfg.CloneImage,
+		Command: []string{"sh", "-c", cloneScript},
+		Env: []corev1.EnvVar{
+			{Name: "GIT_URL", Value: src.GitURL},
+			{Name: "GIT_BRANCH", Value: src.Branch},
+			{Name: "GIT_COMMIT", Value: src.Commit},
+			{Name: "GIT_SUBMODULES", Value: strconv.FormatBool(opts.Submodules)},
+			{Name: "GIT_LFS", Value: strconv.FormatBool(opts.LFS)},
+			{Name: "WORKSPACE", Value: workspaceDir},
+			{Name: "GITEA_HOST", Value: cfg.GiteaHost},
+			{Name: "GITEA_INTERNAL_HOST", Value: cfg.GiteaInternalHost},
+		},
+		VolumeMounts: []corev1.VolumeMount{workspaceMount},
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Annotations recording how a build was placed, for the policy and logs
+const (
+	languageAnnotation   = "homelab.mcztest.com/language"
+	buildClassAnnotation = "homelab.mcztest.com/build-class"
+)
+
+// BuildClass places builds of its languages, e.g. Rust and Java, which
+// need far more CPU and memory to compile than the default node pool has
+type BuildClass struct {
+	Name string `json:"name"`
+	// Languages are matched case-insensitively against .build.yaml language
+	// or the repo's main language as Gitea detects it (Rust, Java, Go, ...)
+	Languages []string `json:"languages"`
+	// Affinity is set on the build pod, e.g. preferring nodes labelled
+	// homelab.mcztest.com/build-class=heavy
+	Affinity *corev1.NodeAffinity `json:"affinity,omitempty"`
+	// Tolerations let builds onto nodes tainted for them
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+func validateBuildClasses(classes []BuildClass) error {
+	seen := make(map[string]bool)
+	languages := make(map[string]string)
+	for i, c := range classes {
+		if !stepNamePattern.MatchString(c.Name) {
+			return fmt.Errorf("buildClasses[%d]: name %q must be lowercase alphanumerics and dashes", i, c.Name)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("buildClasses: duplicate name %q", c.Name)
+		}
+		seen[c.Name] = true
+		if len(c.Languages) == 0 {
+			return fmt.Errorf("buildClasses: %s lists no languages", c.Name)
+		}
+		for _, lang := range c.Languages {
+			if other, ok := languages[strings.ToLower(lang)]; ok {
+				return fmt.Errorf("buildClasses: %s is in both %s and %s", lang, other, c.Name)
+			}
+			languages[strings.ToLower(lang)] = c.Name
+		}
+	}
+	return nil
+}
+
+// BuildClass returns the class for a language, or nil
+func (c *Config) BuildClass(language string) *BuildClass {
+	for i := range c.BuildClasses {
+		for _, lang := range c.BuildClasses[i].Languages {
+			if strings.EqualFold(lang, language) {
+				return &c.BuildClasses[i]
+			}
+		}
+	}
+	return nil
+}
+
+// repoLanguage returns the language .build.yaml declares, else the one
+// with the most bytes in the repo according to Gitea
+func repoLanguage(ctx context.Context, cfg *Config, fullName string, build *BuildFile) (string, error) {
+	if build != nil && build.Language != "" {
+		return build.Language, nil
+	}
+	var languages map[string]int64
+	if err := giteaJSON(ctx, cfg, http.MethodGet, "/repos/"+fullName+"/languages", nil, &languages); err != nil {
+		return "", err
+	}
+	top := ""
+	for lang, size := range languages {
+		if size > languages[top] || size == languages[top] && lang < top {
+			top = lang
+		}
+	}
+	return top, nil
+}
+
+// classifyBuild annotates a build's language and class. Without configured
+// classes Gitea is not asked; when it cannot be reached the build runs
+// unplaced rather than failing.
+func classifyBuild(ctx context.Context, cfg *Config, fullName string, build *BuildFile, annotations map[string]string) {
+	if len(cfg.BuildClasses) == 0 {
+		return
+	}
+	language, err := repoLanguage(ctx, cfg, fullName, build)
+	if err != nil {
+		log.Printf("Failed to detect language of %s, building without a class: %v", fullName, err)
+		return
+	}
+	if language == "" {
+		return
+	}
+	annotations[languageAnnotation] = language
+	if class := cfg.BuildClass(language); class != nil {
+		annotations[buildClassAnnotation] = class.Name
+	}
+}
+
+// placeBuild applies the affinity and tolerations of the job's build class
+func placeBuild(cfg *Config, job *batchv1.Job) {
+	name := job.Annotations[buildClassAnnotation]
+	if name == "" {
+		return
+	}
+	for i := range cfg.BuildClasses {
+		class := &cfg.BuildClasses[i]
+		if class.Name != name {
+			continue
+		}
+		spec := &job.Spec.Template.Spec
+		if class.Affinity != nil {
+			spec.Affinity = &corev1.Affinity{NodeAffinity: class.Affinity.DeepCopy()}
+		}
+		spec.Tolerations = append(spec.Tolerations, class.Tolerations...)
+		return
+	}
+}
@@ -1,170 +1,176 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
-	batchv1 "k8s.io/api/batch/v1"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"github.com/homelab/internal/auth"
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
-// GiteaWebhook represents the webhook payload from Gitea
-type GiteaWebhook struct {
-	Ref        string `json:"ref"`
-	Repository struct {
-		Name     string `json:"name"`
-		CloneURL string `json:"clone_url"`
-		SSHURL   string `json:"ssh_url"`
-	} `json:"repository"`
-	HeadCommit struct {
-		ID string `json:"id"`
-	} `json:"head_commit"`
-}
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-var k8sClient *kubernetes.Clientset
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+
+	shutdownTracing, err := initTracing(ctx, settings)
+	if err != nil {
+		log.Fatalf("Failed to initialise tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
 
-func main() {
 	// Create Kubernetes client
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		log.Fatalf("Failed to get in-cluster config: %v", err)
 	}
+	traceKubeClient(config)
 
-	k8sClient, err = kubernetes.NewForConfig(config)
+	kube, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		log.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
 
-	http.HandleFunc("/webhook", handleWebhook)
-	http.HandleFunc("/health", healthCheck)
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	configFile := settings.ConfigFile
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
 	}
+	cfg.GiteaToken = settings.GiteaToken
 
-	log.Printf("Starting webhook receiver on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	history, err := OpenBuildHistory(settings.HistoryDB)
+	if err != nil {
+		log.Fatalf("Failed to open build history: %v", err)
 	}
-}
+	defer history.Close()
+	retention := time.Duration(settings.HistoryRetentionDays) * 24 * time.Hour
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "OK")
-}
-
-func handleWebhook(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	registry := NewRegistryClient(settings.RegistryURL, settings.RegistryAuthFile)
+	server := NewServer(kube, history, cfg)
+	if err := server.watchConfig(configFile); err != nil {
+		log.Printf("Failed to watch config, hot reload disabled: %v", err)
 	}
-
-	var webhook GiteaWebhook
-	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
-		log.Printf("Failed to decode webhook: %v", err)
-		http.Error(w, "Invalid payload", http.StatusBadRequest)
-		return
+	server.cacheDir = settings.CacheDir
+	server.operatorToken = settings.OperatorToken
+	server.tracker = &BuildTracker{kube: kube, config: server.config, history: history, registry: registry, deps: server.deps, comments: NewPRCommenter(history, server.config), events: NewEventHub()}
+	go server.tracker.Run(ctx)
+	server.clusters = NewClusters(ctx, kube, func(ctx context.Context, remote kubernetes.Interface) {
+		server.tracker.forCluster(remote).Run(ctx)
+	})
+	go server.clusters.Connect(ctx, cfg)
+	go server.reapRunners(ctx)
+	go server.retryDeadLetters(ctx)
+	go pruneHistory(ctx, history, retention)
+
+	if s3 := settings.S3; s3.Endpoint != "" {
+		bucket := func(name string) *S3Client {
+			return NewS3Client(s3.Endpoint, name, s3.Region, s3.AccessKey, s3.SecretKey)
+		}
+		server.archive = NewPayloadArchive(bucket(s3.ArchiveBucket), time.Duration(s3.ArchiveRetentionDays)*24*time.Hour)
+		go server.archive.Run(ctx)
+		// Artifacts are kept as long as the builds they belong to
+		server.artifacts = NewArtifactStore(bucket(s3.ArtifactsBucket), retention)
+		go server.artifacts.Run(ctx)
+		log.Printf("Archiving webhook payloads for %d days and build artifacts to %s", s3.ArchiveRetentionDays, s3.Endpoint)
 	}
 
-	// Only build on push to main branch
-	if webhook.Ref != "refs/heads/main" {
-		log.Printf("Ignoring webhook for ref: %s", webhook.Ref)
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "Ignoring non-main branch")
-		return
+	// Gitea signs webhooks; the API takes bearer tokens or OIDC tokens.
+	// Metrics and health stay open for Prometheus and probes.
+	webhookAuth := webhookAuthenticators(settings)
+	apiAuth := apiAuthenticators(settings)
+	mux := http.NewServeMux()
+	handle := func(route string, h http.Handler) {
+		mux.Handle(route, httpMetrics.Instrument(route, h))
+	}
+	handle("/webhook", otelhttp.NewHandler(auth.Require(server.handleWebhook, webhookAuth...), "webhook"))
+	handle("/builds", auth.Require(server.handleBuilds, apiAuth...))
+	// Not instrumented: the timeout handler would end the stream and its
+	// writer cannot flush
+	mux.Handle("/builds/events", auth.Require(server.handleBuildEvents, apiAuth...))
+	handle("/builds/", auth.Require(server.handleBuilds, apiAuth...))
+	handle("/webhooks/", auth.Require(server.handleArchivedWebhook, apiAuth...))
+	// Build jobs upload with a per-job token instead of API credentials
+	handle("/artifacts/", http.HandlerFunc(server.handleArtifactUpload))
+	// The build-runner pool shares RUNNER_TOKEN
+	handle("/runner/", auth.Require(server.handleRunner, runnerAuthenticators(settings)...))
+	handle("/deadletter", auth.Require(server.handleDeadLetters, apiAuth...))
+	handle("/deadletter/", auth.Require(server.handleDeadLetters, apiAuth...))
+	handle("/dependencies", auth.Require(server.handleDependencies, apiAuth...))
+	handle("/api/v1/stats/builds", auth.Require(server.handleBuildStats, apiAuth...))
+	handle("/metrics", http.HandlerFunc(server.handleMetrics))
+	handle("/cache", auth.Require(server.handleCache, apiAuth...))
+	handle("/cache/", auth.Require(server.handleCache, apiAuth...))
+
+	// /readyz fails while the API server, the history and cache volumes, or
+	// the registry are unusable; /health stays as an alias of /healthz
+	checks := health.New()
+	checks.Add("kubernetes", kubeReachable(kube))
+	checks.Add("history", health.Writable(filepath.Dir(settings.HistoryDB)))
+	checks.Add("cache", health.Writable(settings.CacheDir))
+	checks.Add("registry", health.HTTP(nil, strings.TrimSuffix(settings.RegistryURL, "/")+"/v2/"))
+	handle("/healthz", http.HandlerFunc(checks.Live))
+	handle("/health", http.HandlerFunc(checks.Live))
+	handle("/readyz", http.HandlerFunc(checks.Ready))
+
+	// HTTPS alongside HTTP, with a certificate from the secrets operator's
+	// internal CA, for in-cluster clients that verify the receiver
+	if settings.TLSCertFile != "" {
+		certs := httpkit.NewCertReloader(settings.TLSCertFile, settings.TLSKeyFile)
+		tlsServer := httpkit.NewServer(":"+settings.TLSPort, mux)
+		tlsServer.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		log.Printf("Serving HTTPS on port %s", settings.TLSPort)
+		go func() {
+			if err := httpkit.Serve(ctx, tlsServer); err != nil {
+				log.Fatalf("Failed to start HTTPS server: %v", err)
+			}
+		}()
 	}
 
-	appName := webhook.Repository.Name
-	commitSHA := webhook.HeadCommit.ID[:7] // Short SHA
-	imageTag := commitSHA
-
-	// Use internal Gitea URL
-	gitURL := strings.Replace(webhook.Repository.CloneURL, "https://", "http://", 1)
-	gitURL = strings.Replace(gitURL, "gitea.home.mcztest.com", "gitea-http.gitea.svc.cluster.local:3000", 1)
-
-	log.Printf("Triggering build for %s:%s (git: %s)", appName, imageTag, gitURL)
-
-	// Create Kubernetes Job
-	job := createBuildJob(appName, gitURL, "main", imageTag, "./Dockerfile")
+	port := settings.Port
+	log.Printf("Starting webhook receiver on port %s", port)
+	if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, mux)); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
 
-	ctx := context.Background()
-	_, err := k8sClient.BatchV1().Jobs("container-registry").Create(ctx, job, metav1.CreateOptions{})
-	if err != nil {
-		log.Printf("Failed to create build job: %v", err)
-		http.Error(w, "Failed to create build job", http.StatusInternalServerError)
-		return
+// kubeReachable checks that the API server answers its readiness endpoint
+func kubeReachable(kube kubernetes.Interface) health.Check {
+	return func(ctx context.Context) error {
+		return kube.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
 	}
+}
 
-	log.Printf("Build job created successfully for %s:%s", appName, imageTag)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Build job created for %s:%s", appName, imageTag)
+// apiAuthenticators builds the authenticators for the read and admin API
+// from API_TOKENS and OIDC_ISSUER; without either the API is closed unless
+// ALLOW_UNAUTHENTICATED is set
+func apiAuthenticators(settings *Settings) []auth.Authenticator {
+	authenticators := auth.Bearer(settings.APITokens, settings.OIDCIssuer, settings.OIDCAudience, settings.OIDCGroups)
+	if len(authenticators) > 0 {
+		return authenticators
+	}
+	return auth.AllowUnauthenticated(nil, settings.AllowUnauthenticated, "build API")
 }
 
-func createBuildJob(appName, gitURL, branch, imageTag, dockerfilePath string) *batchv1.Job {
-	jobName := fmt.Sprintf("build-%s-%s", appName, imageTag)
-	ttl := int32(3600) // 1 hour
-
-	return &batchv1.Job{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      jobName,
-			Namespace: "container-registry",
-			Labels: map[string]string{
-				"app":      "build-job",
-				"app-name": appName,
-			},
-		},
-		Spec: batchv1.JobSpec{
-			TTLSecondsAfterFinished: &ttl,
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": "build-job",
-					},
-				},
-				Spec: corev1.PodSpec{
-					RestartPolicy: corev1.RestartPolicyNever,
-					Containers: []corev1.Container{
-						{
-							Name:  "kaniko",
-							Image: "gcr.io/kaniko-project/executor:latest",
-							Args: []string{
-								fmt.Sprintf("--dockerfile=%s", dockerfilePath),
-								fmt.Sprintf("--context=git://%s#refs/heads/%s", gitURL, branch),
-								fmt.Sprintf("--destination=registry.home.mcztest.com/%s:%s", appName, imageTag),
-								"--insecure",
-								"--skip-tls-verify",
-								"--cache=true",
-								"--cache-repo=registry.home.mcztest.com/cache",
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "docker-config",
-									MountPath: "/kaniko/.docker/",
-								},
-							},
-						},
-					},
-					Volumes: []corev1.Volume{
-						{
-							Name: "docker-config",
-							VolumeSource: corev1.VolumeSource{
-								EmptyDir: &corev1.EmptyDirVolumeSource{},
-							},
-						},
-					},
-				},
-			},
-		},
+// webhookAuthenticators verifies Gitea's signature with WEBHOOK_SECRET
+func webhookAuthenticators(settings *Settings) []auth.Authenticator {
+	if secret := settings.WebhookSecret; secret != "" {
+		return []auth.Authenticator{auth.NewHMACAuth(secret)}
 	}
+	return auth.AllowUnauthenticated(nil, settings.AllowUnauthenticated, "webhook")
 }
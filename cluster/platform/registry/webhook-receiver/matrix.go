@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations linking a matrix job to the build record it reports into
+const (
+	matrixAnnotation  = "homelab.mcztest.com/matrix-build"
+	variantAnnotation = "homelab.mcztest.com/matrix-variant"
+	// platformsAnnotation marks a multi-arch build, whose variants are
+	// joined into a manifest list at the plain tag once all succeed
+	platformsAnnotation  = "homelab.mcztest.com/platforms"
+	pushLatestAnnotation = "homelab.mcztest.com/push-latest"
+)
+
+// maxVariantName keeps build-<app>-<tag>-<variant> within object name limits
+const maxVariantName = 20
+
+// MatrixEntry is one variant of a matrix build. Its image is tagged
+// <commit>-<name>; the default variant (the first unless one sets default)
+// also pushes the plain <commit> tag that deployments use.
+type MatrixEntry struct {
+	Name       string            `json:"name"`
+	Dockerfile string            `json:"dockerfile,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	BuildArgs  map[string]string `json:"buildArgs,omitempty"`
+	Default    bool              `json:"default,omitempty"`
+	// Arch pins the variant to nodes of that architecture; set for the
+	// variants of .build.yaml platforms
+	Arch string `json:"-"`
+}
+
+// VariantStatus is the result of one matrix job, stored on the build record
+type VariantStatus struct {
+	Name       string     `json:"name"`
+	Job        string     `json:"job"`
+	Image      string     `json:"image"`
+	Status     string     `json:"status"`
+	Default    bool       `json:"default,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	ImageSize  int64      `json:"imageSizeBytes,omitempty"`
+	LogExcerpt string     `json:"logExcerpt,omitempty"`
+}
+
+func validateMatrix(matrix []MatrixEntry) error {
+	seen := make(map[string]bool)
+	defaults := 0
+	for i, entry := range matrix {
+		if !stepNamePattern.MatchString(entry.Name) || len(entry.Name) > maxVariantName {
+			return fmt.Errorf("matrix[%d]: name %q must be lowercase alphanumerics and dashes, at most %d characters", i, entry.Name, maxVariantName)
+		}
+		if seen[entry.Name] {
+			return fmt.Errorf("matrix: duplicate name %q", entry.Name)
+		}
+		seen[entry.Name] = true
+		if entry.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return fmt.Errorf("matrix: only one entry may set default")
+	}
+	return nil
+}
+
+func validatePlatforms(platforms []string) error {
+	seen := make(map[string]bool)
+	for _, arch := range platforms {
+		if !supportedArches[arch] {
+			return fmt.Errorf("platforms: unsupported arch %q", arch)
+		}
+		if seen[arch] {
+			return fmt.Errorf("platforms: duplicate arch %q", arch)
+		}
+		seen[arch] = true
+	}
+	return nil
+}
+
+// platformMatrix turns platforms into one variant per arch, named after it
+func platformMatrix(platforms []string) []MatrixEntry {
+	matrix := make([]MatrixEntry, 0, len(platforms))
+	for _, arch := range platforms {
+		matrix = append(matrix, MatrixEntry{Name: arch, Arch: arch})
+	}
+	return matrix
+}
+
+// defaultVariant returns the index of the entry that pushes the plain tag
+func defaultVariant(matrix []MatrixEntry) int {
+	for i, entry := range matrix {
+		if entry.Default {
+			return i
+		}
+	}
+	return 0
+}
+
+// variantOptions applies a matrix entry over the commit's build options;
+// the entry wins where both set a value
+func variantOptions(opts BuildOptions, entry MatrixEntry) BuildOptions {
+	args := make(map[string]string, len(opts.BuildArgs)+len(entry.BuildArgs))
+	for k, v := range opts.BuildArgs {
+		args[k] = v
+	}
+	for k, v := range entry.BuildArgs {
+		args[k] = v
+	}
+	opts.BuildArgs = args
+	if entry.Dockerfile != "" {
+		opts.Dockerfile = entry.Dockerfile
+	}
+	if entry.Target != "" {
+		opts.Target = entry.Target
+	}
+	if entry.Arch != "" {
+		opts.Arch = entry.Arch
+	}
+	return opts
+}
+
+// startMatrixBuild records one build for the commit and creates a job per
+// matrix entry, or per platform. If any job cannot be created the others are
+// deleted and the build is recorded as failed.
+func (s *Server) startMatrixBuild(ctx context.Context, cfg *Config, fullName string, src BuildSource, opts BuildOptions, build *BuildFile, annotations map[string]string) (string, error) {
+	rec := &BuildRecord{
+		ID:        fmt.Sprintf("build-%s-%s", src.App, src.Tag),
+		App:       src.App,
+		Repo:      fullName,
+		Commit:    src.Commit,
+		Branch:    src.Branch,
+		Tag:       src.Tag,
+		Image:     src.image(cfg),
+		Status:    BuildPending,
+		CreatedAt: time.Now(),
+	}
+	matrix := build.Matrix
+	def := defaultVariant(matrix)
+	if len(build.Platforms) > 0 {
+		// No variant pushes the plain tag; the tracker joins them into a
+		// manifest list there
+		matrix = platformMatrix(build.Platforms)
+		def = -1
+		annotations[platformsAnnotation] = strings.Join(build.Platforms, ",")
+		if src.PushLatest {
+			annotations[pushLatestAnnotation] = "true"
+		}
+	}
+
+	jobs := make([]*batchv1.Job, len(matrix))
+	clients := make([]kubernetes.Interface, len(matrix))
+	for i, entry := range matrix {
+		variant := src
+		variant.Tag = src.Tag + "-" + entry.Name
+		variant.PushLatest = false
+		vopts := variantOptions(opts, entry)
+
+		job := createBuildJob(cfg, variant, vopts)
+		if i == def {
+			// The plain tag and :latest come from the default variant
+			extra := []string{"--destination=" + src.image(cfg)}
+			if src.PushLatest {
+				extra = append(extra, "--destination="+src.latest(cfg))
+			}
+			job.Spec.Template.Spec.Containers[0].Args = append(job.Spec.Template.Spec.Containers[0].Args, extra...)
+		}
+		job.Annotations = map[string]string{
+			matrixAnnotation:  rec.ID,
+			variantAnnotation: entry.Name,
+		}
+		for k, v := range annotations {
+			job.Annotations[k] = v
+		}
+		if len(build.Artifacts) > 0 {
+			addArtifacts(cfg, job, variant, vopts, build.Artifacts)
+		}
+		placeBuild(cfg, job)
+		addDestination(cfg, job)
+		clients[i] = s.dispatch(ctx, cfg, job, vopts)
+		s.addGoCache(ctx, cfg, job, vopts)
+		if err := admit(ctx, cfg, job); err != nil {
+			return "", err
+		}
+		harden(cfg, job)
+		jobs[i] = job
+		rec.Variants = append(rec.Variants, VariantStatus{
+			Name:    entry.Name,
+			Job:     job.Name,
+			Image:   variant.image(cfg),
+			Status:  BuildPending,
+			Default: i == def,
+		})
+	}
+
+	// Recorded first so the tracker finds it when the jobs appear
+	if err := s.history.Record(ctx, rec); err != nil {
+		return "", fmt.Errorf("recording build: %w", err)
+	}
+
+	log.Printf("Running %d-variant matrix build for %s:%s", len(jobs), src.App, src.Tag)
+	for i, job := range jobs {
+		created, err := clients[i].BatchV1().Jobs(buildNamespace).Create(ctx, job, metav1.CreateOptions{})
+		cleanup := jobs[:i]
+		if err == nil {
+			if err = createDockerConfig(ctx, clients[i], created); err != nil {
+				err = fmt.Errorf("writing push credentials: %w", err)
+				cleanup = jobs[:i+1]
+			}
+		}
+		if err != nil {
+			propagation := metav1.DeletePropagationBackground
+			for j, created := range cleanup {
+				if err := clients[j].BatchV1().Jobs(buildNamespace).Delete(ctx, created.Name, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil {
+					log.Printf("Failed to delete matrix job %s: %v", created.Name, err)
+				}
+			}
+			msg := fmt.Sprintf("Failed to create job for variant %s: %v", rec.Variants[i].Name, err)
+			if ferr := s.history.Finish(ctx, rec.ID, BuildFailed, time.Now(), msg, nil); ferr != nil {
+				log.Printf("Failed to record result for %s: %v", rec.ID, ferr)
+			}
+			return "", err
+		}
+	}
+	return rec.ID, nil
+}
+
+// observeVariant records a matrix job's progress on its build and, once every
+// variant has finished, the build's overall result
+func (t *BuildTracker) observeVariant(ctx context.Context, job *batchv1.Job) {
+	id := job.Annotations[matrixAnnotation]
+	build, err := t.history.Get(ctx, id)
+	if err != nil || build == nil {
+		if err != nil {
+			log.Printf("Failed to load matrix build %s: %v", id, err)
+		}
+		return
+	}
+	if build.FinishedAt != nil {
+		return
+	}
+	i := -1
+	for j, v := range build.Variants {
+		if v.Name == job.Annotations[variantAnnotation] {
+			i = j
+		}
+	}
+	if i < 0 || build.Variants[i].FinishedAt != nil {
+		return
+	}
+	v := &build.Variants[i]
+
+	status, finishedAt := jobResult(job)
+	switch status {
+	case BuildPending:
+		return
+	case BuildRunning:
+		if v.Status == BuildRunning {
+			return
+		}
+		v.Status = BuildRunning
+		t.events.Status(id, v.Name, build.App, BuildRunning)
+		go t.followProgress(ctx, job, id, v.Name)
+	default:
+		rec := recordFromJob(job)
+		excerpt, _ := t.podSummary(ctx, job)
+		if status == BuildSucceeded && rec.Image != "" && job.Annotations[registryAnnotation] == "" {
+			var msg string
+			_, v.ImageSize, msg, status = t.checkImage(ctx, job, rec)
+			if msg != "" {
+				excerpt = msg + "\n\n" + excerpt
+			}
+		}
+		v.Status = status
+		v.FinishedAt = &finishedAt
+		v.LogExcerpt = excerpt
+
+		var started time.Time
+		if job.Status.StartTime != nil {
+			started = job.Status.StartTime.Time
+		}
+		recordJobSpan(rec, job.Annotations[traceAnnotation], status, started, finishedAt)
+		log.Printf("Build %s variant %s %s", id, v.Name, status)
+		t.events.Status(id, v.Name, build.App, status)
+	}
+
+	if err := t.history.SetVariants(ctx, id, build.Variants); err != nil {
+		log.Printf("Failed to update build %s: %v", id, err)
+		return
+	}
+	t.finishMatrix(ctx, job, build)
+}
+
+// finishMatrix rolls variant results up into the build: running while any
+// variant runs, failed if any failed once all have finished
+func (t *BuildTracker) finishMatrix(ctx context.Context, job *batchv1.Job, build *BuildRecord) {
+	var finishedAt time.Time
+	var failed []string
+	var size int64
+	platforms := job.Annotations[platformsAnnotation] != ""
+	for i, v := range build.Variants {
+		if v.FinishedAt == nil {
+			if err := t.history.SetStatus(ctx, build.ID, BuildRunning); err != nil {
+				log.Printf("Failed to update build %s: %v", build.ID, err)
+			}
+			t.comments.Update(build.ID)
+			t.events.Status(build.ID, "", build.App, BuildRunning)
+			return
+		}
+		if v.FinishedAt.After(finishedAt) {
+			finishedAt = *v.FinishedAt
+		}
+		if v.Status != BuildSucceeded {
+			failed = append(failed, v.Name)
+		}
+		if v.Default || platforms && i == 0 {
+			size = v.ImageSize
+		}
+	}
+
+	status := BuildSucceeded
+	excerpt := ""
+	if len(failed) > 0 {
+		status = BuildFailed
+		sort.Strings(failed)
+		excerpt = fmt.Sprintf("Failed variants: %s", strings.Join(failed, ", "))
+	} else if platforms {
+		if err := t.pushManifestList(ctx, job, build); err != nil {
+			log.Printf("Failed to push manifest list for %s: %v", build.ID, err)
+			status = BuildFailed
+			excerpt = fmt.Sprintf("Failed to push manifest list %s: %v", build.Image, err)
+		}
+	}
+	if err := t.history.Finish(ctx, build.ID, status, finishedAt, excerpt, nil); err != nil {
+		log.Printf("Failed to record result for %s: %v", build.ID, err)
+		return
+	}
+	if size > 0 {
+		if err := t.history.SetImageSize(ctx, build.ID, size); err != nil {
+			log.Printf("Failed to record image size for %s: %v", build.ID, err)
+		}
+	}
+	log.Printf("Build %s %s", build.ID, status)
+	t.comments.Update(build.ID)
+	t.events.Status(build.ID, "", build.App, status)
+
+	if status == BuildSucceeded {
+		t.deps.Succeeded(ctx, job, build)
+	} else {
+		t.deps.Failed(build.App)
+	}
+}
+
+// pushManifestList tags the build's plain image (and :latest when dependents
+// build FROM it) as a manifest list of the per-arch variant images
+func (t *BuildTracker) pushManifestList(ctx context.Context, job *batchv1.Job, build *BuildRecord) error {
+	repo, tag := splitImage(build.Image)
+	var entries []ManifestListEntry
+	for _, v := range build.Variants {
+		_, variantTag := splitImage(v.Image)
+		entry, err := t.registry.Describe(ctx, repo, variantTag)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", v.Image, err)
+		}
+		entry.Arch = v.Name
+		entries = append(entries, entry)
+	}
+
+	tags := []string{tag}
+	if job.Annotations[pushLatestAnnotation] == "true" {
+		tags = append(tags, "latest")
+	}
+	for _, tag := range tags {
+		if err := t.registry.PutManifestList(ctx, repo, tag, entries); err != nil {
+			return err
+		}
+	}
+	log.Printf("Pushed manifest list %s for %s", build.Image, job.Annotations[platformsAnnotation])
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testMatrix = `matrix:
+- name: alpine
+  buildArgs: {BASE: "alpine:3.19"}
+- name: debian
+  dockerfile: Dockerfile.debian
+  default: true
+`
+
+func getJob(t *testing.T, kube *fake.Clientset, name string) *batchv1.Job {
+	t.Helper()
+	job, err := kube.BatchV1().Jobs(buildNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// finishJob marks a job complete or failed, as the job controller would
+func finishJob(job *batchv1.Job, succeeded bool) *batchv1.Job {
+	job = job.DeepCopy()
+	condition := batchv1.JobComplete
+	if !succeeded {
+		condition = batchv1.JobFailed
+	}
+	job.Status.Conditions = []batchv1.JobCondition{{
+		Type:               condition,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+	}}
+	return job
+}
+
+func TestHandleWebhookMatrixBuild(t *testing.T) {
+	s, kube := newTestServer(t, newTestGitea(t, repoFiles(map[string]string{buildFile: testMatrix})))
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work [build arg:VERSION=1.2]"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	for _, tt := range []struct {
+		job     string
+		want    []string
+		notWant string
+	}{
+		{
+			job: "build-app-0123456-alpine",
+			want: []string{
+				"--destination=registry.home.mcztest.com/app:0123456-alpine",
+				"--build-arg=BASE=alpine:3.19",
+				"--build-arg=VERSION=1.2",
+			},
+			notWant: "--destination=registry.home.mcztest.com/app:0123456 ",
+		},
+		{
+			job: "build-app-0123456-debian",
+			want: []string{
+				"--destination=registry.home.mcztest.com/app:0123456-debian",
+				"--destination=registry.home.mcztest.com/app:0123456 ",
+				"--dockerfile=Dockerfile.debian",
+				"--build-arg=VERSION=1.2",
+			},
+		},
+	} {
+		job := getJob(t, kube, tt.job)
+		if job.Annotations[matrixAnnotation] != "build-app-0123456" || job.Annotations[repoAnnotation] != "owner/app" {
+			t.Fatalf("%s annotations = %v", tt.job, job.Annotations)
+		}
+		args := strings.Join(job.Spec.Template.Spec.Containers[0].Args, " ") + " "
+		for _, want := range tt.want {
+			if !strings.Contains(args, want) {
+				t.Errorf("%s args lack %s: %s", tt.job, want, args)
+			}
+		}
+		if tt.notWant != "" && strings.Contains(args, tt.notWant) {
+			t.Errorf("%s args contain %s: %s", tt.job, tt.notWant, args)
+		}
+	}
+
+	rec, err := s.history.Get(context.Background(), "build-app-0123456")
+	if err != nil || rec == nil {
+		t.Fatalf("history record = %v, %v", rec, err)
+	}
+	var variants []string
+	for _, v := range rec.Variants {
+		variants = append(variants, v.Name+"="+v.Job)
+		if v.Default != (v.Name == "debian") {
+			t.Fatalf("variant %s default = %v", v.Name, v.Default)
+		}
+	}
+	if want := []string{"alpine=build-app-0123456-alpine", "debian=build-app-0123456-debian"}; !reflect.DeepEqual(variants, want) {
+		t.Fatalf("variants = %v, want %v", variants, want)
+	}
+}
+
+func TestHandleWebhookPlatformBuild(t *testing.T) {
+	s, kube := newTestServer(t, newTestGitea(t, repoFiles(map[string]string{buildFile: "platforms: [amd64, arm64]\n"})))
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		job := getJob(t, kube, "build-app-0123456-"+arch)
+		if got := job.Spec.Template.Spec.NodeSelector["kubernetes.io/arch"]; got != arch {
+			t.Fatalf("%s runs on %q nodes", job.Name, got)
+		}
+		if job.Annotations[platformsAnnotation] != "amd64,arm64" {
+			t.Fatalf("%s annotations = %v", job.Name, job.Annotations)
+		}
+		// The plain tag becomes a manifest list, so no variant pushes it
+		args := strings.Join(job.Spec.Template.Spec.Containers[0].Args, " ") + " "
+		if strings.Contains(args, "--destination=registry.home.mcztest.com/app:0123456 ") {
+			t.Fatalf("%s pushes the plain tag: %s", job.Name, args)
+		}
+	}
+}
+
+func TestMatrixBuildDeletesJobsWhenOneFails(t *testing.T) {
+	s, kube := newTestServer(t, newTestGitea(t, repoFiles(map[string]string{buildFile: testMatrix})))
+	kube.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+		if strings.HasSuffix(job.Name, "-debian") {
+			return true, nil, apierrors.NewForbidden(batchv1.Resource("jobs"), job.Name, nil)
+		}
+		return false, nil, nil
+	})
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+
+	if jobs := listJobs(t, kube); len(jobs) != 0 {
+		t.Fatalf("left jobs %v", jobs)
+	}
+	rec, err := s.history.Get(context.Background(), "build-app-0123456")
+	if err != nil || rec == nil {
+		t.Fatalf("history record = %v, %v", rec, err)
+	}
+	if rec.Status != BuildFailed || !strings.Contains(rec.LogExcerpt, "variant debian") {
+		t.Fatalf("build = %s %q", rec.Status, rec.LogExcerpt)
+	}
+}
+
+func TestObserveVariantRollsUpBuild(t *testing.T) {
+	tests := []struct {
+		name       string
+		succeeded  map[string]bool
+		wantStatus string
+		wantList   bool
+	}{
+		{
+			name:       "all variants succeed",
+			succeeded:  map[string]bool{"amd64": true, "arm64": true},
+			wantStatus: BuildSucceeded,
+			wantList:   true,
+		},
+		{
+			name:       "one variant fails",
+			succeeded:  map[string]bool{"amd64": true, "arm64": false},
+			wantStatus: BuildFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, kube := newTestServer(t, newTestGitea(t, repoFiles(map[string]string{buildFile: "platforms: [amd64, arm64]\n"})))
+			var mu sync.Mutex
+			var pushed []string
+			tracker := newTestTracker(t, s, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut {
+					mu.Lock()
+					pushed = append(pushed, r.URL.Path)
+					mu.Unlock()
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+				w.Header().Set("Content-Type", dockerManifestV2)
+				w.Header().Set("Docker-Content-Digest", "sha256:"+strings.Repeat("a", 64))
+				w.Write([]byte(`{"config": {"size": 100}, "layers": [{"size": 1000}]}`))
+			})
+
+			w := httptest.NewRecorder()
+			s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			ctx := context.Background()
+			tracker.observeVariant(ctx, finishJob(getJob(t, kube, "build-app-0123456-amd64"), tt.succeeded["amd64"]))
+			rec, _ := s.history.Get(ctx, "build-app-0123456")
+			if rec.Status != BuildRunning || rec.FinishedAt != nil {
+				t.Fatalf("with a variant left, build = %s", rec.Status)
+			}
+
+			tracker.observeVariant(ctx, finishJob(getJob(t, kube, "build-app-0123456-arm64"), tt.succeeded["arm64"]))
+			rec, _ = s.history.Get(ctx, "build-app-0123456")
+			if rec.Status != tt.wantStatus || rec.FinishedAt == nil {
+				t.Fatalf("build = %s, want %s: %q", rec.Status, tt.wantStatus, rec.LogExcerpt)
+			}
+			for _, v := range rec.Variants {
+				if v.FinishedAt == nil || (v.Status == BuildSucceeded) != tt.succeeded[v.Name] {
+					t.Fatalf("variant %+v", v)
+				}
+			}
+			if tt.wantStatus == BuildFailed && rec.LogExcerpt != "Failed variants: arm64" {
+				t.Fatalf("excerpt = %q", rec.LogExcerpt)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			var want []string
+			if tt.wantList {
+				want = []string{"/v2/app/manifests/0123456"}
+			}
+			if !reflect.DeepEqual(pushed, want) {
+				t.Fatalf("pushed %v, want %v", pushed, want)
+			}
+		})
+	}
+}
+
+// Observing a finished variant again, e.g. after an informer resync, does
+// not change the recorded result
+func TestObserveVariantIgnoresRepeats(t *testing.T) {
+	s, kube := newTestServer(t, newTestGitea(t, repoFiles(map[string]string{buildFile: testMatrix})))
+	tracker := newTestTracker(t, s, nil)
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+
+	ctx := context.Background()
+	failed := finishJob(getJob(t, kube, "build-app-0123456-alpine"), false)
+	tracker.observeVariant(ctx, failed)
+	first, _ := s.history.Get(ctx, "build-app-0123456")
+
+	tracker.observeVariant(ctx, finishJob(getJob(t, kube, "build-app-0123456-alpine"), true))
+	again, _ := s.history.Get(ctx, "build-app-0123456")
+	if !reflect.DeepEqual(first.Variants, again.Variants) {
+		t.Fatalf("variants changed from %+v to %+v", first.Variants, again.Variants)
+	}
+}
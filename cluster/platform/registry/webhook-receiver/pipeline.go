@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// pipelineFile is read from the pushed commit; repos without it get the
+// default single kaniko build
+const pipelineFile = ".pipeline.yaml"
+
+// pipelineLabel marks jobs that run a multi-step pipeline
+const pipelineLabel = "homelab.mcztest.com/pipeline"
+
+// Pipeline is the .pipeline.yaml schema:
+//
+//	steps:
+//	- name: test
+//	  image: golang:1.21
+//	  run: go test ./...
+//	- name: build
+//	  build: {}                 # kaniko build and push of the repo Dockerfile
+//	- name: deploy
+//	  image: bitnami/kubectl
+//	  run: kubectl -n apps set image deploy/$APP_NAME app=$IMAGE
+type Pipeline struct {
+	Steps []Step `json:"steps"`
+}
+
+// Step is one container in the pipeline; steps run in order and stop at the
+// first failure
+type Step struct {
+	Name      string                      `json:"name"`
+	Image     string                      `json:"image,omitempty"`
+	Run       string                      `json:"run,omitempty"`
+	Env       map[string]string           `json:"env,omitempty"`
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	Build     *BuildStep                  `json:"build,omitempty"`
+}
+
+// BuildStep runs kaniko against the checked-out workspace
+type BuildStep struct {
+	Dockerfile string `json:"dockerfile,omitempty"`
+	Target     string `json:"target,omitempty"`
+}
+
+var stepNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+func (p *Pipeline) validate() error {
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("no steps defined")
+	}
+	seen := map[string]bool{"clone": true}
+	for i, step := range p.Steps {
+		if !stepNamePattern.MatchString(step.Name) || len(step.Name) > 50 {
+			return fmt.Errorf("step %d: name %q must be a lowercase DNS label", i+1, step.Name)
+		}
+		if seen[step.Name] {
+			return fmt.Errorf("step %s: duplicate or reserved name", step.Name)
+		}
+		seen[step.Name] = true
+
+		if step.Build == nil && (step.Image == "" || step.Run == "") {
+			return fmt.Errorf("step %s: image and run are required unless build is set", step.Name)
+		}
+	}
+	return nil
+}
+
+// fetchPipeline reads .pipeline.yaml at commit from Gitea; a missing file
+// returns nil. Only a file that does not parse or validate is an
+// invalidBuildError: Gitea being unreachable is worth retrying.
+func fetchPipeline(ctx context.Context, cfg *Config, fullName, commit string) (*Pipeline, error) {
+	data, err := fetchRepoFile(ctx, cfg, fullName, commit, pipelineFile)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var p Pipeline
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, &invalidBuildError{fmt.Errorf("parsing %s: %w", pipelineFile, err)}
+	}
+	if err := p.validate(); err != nil {
+		return nil, &invalidBuildError{fmt.Errorf("%s: %w", pipelineFile, err)}
+	}
+	return &p, nil
+}
+
+// createPipelineJob runs the steps as one pod: the clone and every step but
+// the last are init containers, which Kubernetes runs sequentially and stops
+// at the first failure; the last step is the pod's main container
+func createPipelineJob(cfg *Config, src BuildSource, p *Pipeline, opts BuildOptions) *batchv1.Job {
+	spec := basePodSpec(cfg, opts)
+	addWorkspace(&spec)
+	spec.InitContainers = append(spec.InitContainers, cloneContainer(cfg, src, opts))
+
+	containers := make([]corev1.Container, 0, len(p.Steps))
+	for _, step := range p.Steps {
+		containers = append(containers, stepContainer(cfg, src, step, opts))
+	}
+	spec.InitContainers = append(spec.InitContainers, containers[:len(containers)-1]...)
+	spec.Containers = containers[len(containers)-1:]
+
+	// A failed step fails the pipeline; retrying would repeat side effects
+	backoffLimit := int32(0)
+	job := newBuildJob(cfg, src, spec)
+	job.Labels[pipelineLabel] = "true"
+	job.Spec.BackoffLimit = &backoffLimit
+	return job
+}
+
+func stepContainer(cfg *Config, src BuildSource, step Step, opts BuildOptions) corev1.Container {
+	if step.Build != nil {
+		if step.Build.Dockerfile != "" {
+			opts.Dockerfile = step.Build.Dockerfile
+		}
+		if step.Build.Target != "" {
+			opts.Target = step.Build.Target
+		}
+		c := kanikoContainer(cfg, src, step.Name, "dir://"+workspaceDir, opts)
+		if len(step.Resources.Requests) > 0 || len(step.Resources.Limits) > 0 {
+			c.Resources = step.Resources
+		}
+		return c
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "APP_NAME", Value: src.App},
+		{Name: "GIT_BRANCH", Value: src.Branch},
+		{Name: "GIT_COMMIT", Value: src.Commit},
+		{Name: "IMAGE", Value: src.image(cfg)},
+	}
+	names := make([]string, 0, len(step.Env))
+	for name := range step.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, corev1.EnvVar{Name: name, Value: step.Env[name]})
+	}
+
+	return corev1.Container{
+		Name:         step.Name,
+		Image:        step.Image,
+		Command:      []string{"sh", "-ec", step.Run},
+		WorkingDir:   workspaceDir,
+		Env:          env,
+		Resources:    step.Resources,
+		VolumeMounts: []corev1.VolumeMount{workspaceMount},
+	}
+}
+
+// StepStatus is the state of one pipeline step
+type StepStatus struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	ExitCode   *int32     `json:"exitCode,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+}
+
+// stepStatuses reads per-step state from the pipeline pod, in run order
+func stepStatuses(pod *corev1.Pod) []StepStatus {
+	byName := make(map[string]corev1.ContainerStatus)
+	for _, cs := range append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...) {
+		byName[cs.Name] = cs
+	}
+
+	var steps []StepStatus
+	for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		step := StepStatus{Name: c.Name, Status: BuildPending}
+		cs, ok := byName[c.Name]
+		if ok {
+			switch {
+			case cs.State.Running != nil:
+				step.Status = BuildRunning
+				t := cs.State.Running.StartedAt.Time
+				step.StartedAt = &t
+			case cs.State.Terminated != nil:
+				term := cs.State.Terminated
+				step.Status = BuildSucceeded
+				if term.ExitCode != 0 {
+					step.Status = BuildFailed
+				}
+				started, finished := term.StartedAt.Time, term.FinishedAt.Time
+				step.StartedAt, step.FinishedAt = &started, &finished
+				step.ExitCode = &term.ExitCode
+				step.Reason = term.Reason
+			case cs.State.Waiting != nil && cs.State.Waiting.Reason != "PodInitializing":
+				step.Reason = cs.State.Waiting.Reason
+			}
+		}
+		steps = append(steps, step)
+	}
+
+	// Steps after a failure never run
+	for i := range steps {
+		if steps[i].Status == BuildFailed {
+			for j := i + 1; j < len(steps); j++ {
+				if steps[j].Status == BuildPending {
+					steps[j].Status = "skipped"
+				}
+			}
+			break
+		}
+	}
+	return steps
+}
+
+// failedContainer returns the first step that failed, for log excerpts
+func failedContainer(pod *corev1.Pod) string {
+	for _, s := range stepStatuses(pod) {
+		if s.Status == BuildFailed {
+			return s.Name
+		}
+	}
+	return ""
+}
+
+func isPipelineJob(job *batchv1.Job) bool {
+	return strings.EqualFold(job.Labels[pipelineLabel], "true")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFetchPipeline(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		steps   int
+		wantErr string
+	}{
+		{name: "missing"},
+		{
+			name:  "steps",
+			file:  "steps:\n- name: test\n  image: golang:1.21\n  run: go test ./...\n- name: build\n  build:\n    target: runtime\n",
+			steps: 2,
+		},
+		{name: "no steps", file: "steps: []\n", wantErr: "no steps defined"},
+		{name: "unknown field", file: "steps:\n- name: test\n  script: make\n", wantErr: "parsing .pipeline.yaml"},
+		{name: "invalid name", file: "steps:\n- name: Test_1\n  image: alpine\n  run: 'true'\n", wantErr: "lowercase DNS label"},
+		{name: "reserved name", file: "steps:\n- name: clone\n  image: alpine\n  run: 'true'\n", wantErr: "duplicate or reserved"},
+		{name: "duplicate name", file: "steps:\n- name: a\n  build: {}\n- name: a\n  build: {}\n", wantErr: "duplicate or reserved"},
+		{name: "run without image", file: "steps:\n- name: test\n  run: make\n", wantErr: "image and run are required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{}
+			if tt.file != "" {
+				files[pipelineFile] = tt.file
+			}
+			cfg := newTestGitea(t, repoFiles(files))
+			p, err := fetchPipeline(context.Background(), cfg, "owner/app", testCommit)
+			if tt.wantErr != "" {
+				var invalid *invalidBuildError
+				if !errors.As(err, &invalid) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want invalid build %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps := 0
+			if p != nil {
+				steps = len(p.Steps)
+			}
+			if steps != tt.steps {
+				t.Fatalf("steps = %d, want %d", steps, tt.steps)
+			}
+		})
+	}
+}
+
+func TestFetchPipelineGiteaFailureIsRetryable(t *testing.T) {
+	cfg := newTestGitea(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	})
+	_, err := fetchPipeline(context.Background(), cfg, "owner/app", testCommit)
+	if err == nil || !retryable(err) {
+		t.Fatalf("error = %v, want a retryable error", err)
+	}
+}
+
+func TestCreatePipelineJobRunsStepsInOrder(t *testing.T) {
+	p := &Pipeline{Steps: []Step{
+		{Name: "test", Image: "golang:1.21", Run: "go test ./...", Env: map[string]string{"CGO_ENABLED": "0"}},
+		{Name: "lint", Image: "golangci/golangci-lint", Run: "golangci-lint run"},
+		{Name: "build", Build: &BuildStep{Target: "runtime"}},
+	}}
+	src := BuildSource{App: "app", GitURL: "http://gitea/owner/app.git", Branch: "main", Commit: testCommit, Tag: "0123456"}
+	job := createPipelineJob(defaultConfig(), src, p, BuildOptions{})
+
+	spec := job.Spec.Template.Spec
+	var order []string
+	for _, c := range append(spec.InitContainers, spec.Containers...) {
+		order = append(order, c.Name)
+	}
+	if got := strings.Join(order, ","); got != "clone,test,lint,build" {
+		t.Fatalf("containers = %s", got)
+	}
+	if len(spec.Containers) != 1 || !strings.Contains(strings.Join(spec.Containers[0].Args, " "), "--target=runtime") {
+		t.Fatalf("last step is not the kaniko build: %+v", spec.Containers)
+	}
+	if *job.Spec.BackoffLimit != 0 || !isPipelineJob(job) {
+		t.Fatalf("backoffLimit = %d, labels = %v", *job.Spec.BackoffLimit, job.Labels)
+	}
+	env := map[string]string{}
+	for _, e := range spec.InitContainers[1].Env {
+		env[e.Name] = e.Value
+	}
+	if env["GIT_COMMIT"] != testCommit || env["CGO_ENABLED"] != "0" || env["IMAGE"] != "registry.home.mcztest.com/app:0123456" {
+		t.Fatalf("step env = %v", env)
+	}
+}
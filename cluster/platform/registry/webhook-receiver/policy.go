@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PolicySettings send every job to Open Policy Agent before it is created
+type PolicySettings struct {
+	// URL is the OPA data API document holding the decision, e.g.
+	// http://127.0.0.1:8181/v1/data/builds/admission; empty disables
+	URL string `json:"url,omitempty"`
+	// FailOpen creates jobs when OPA is unreachable or has no decision
+	FailOpen bool `json:"failOpen,omitempty"`
+}
+
+// BuildAdmission is the normalised job a policy decides on, sent as input
+type BuildAdmission struct {
+	// Kind is "build" or "chart"
+	Kind   string `json:"kind"`
+	App    string `json:"app"`
+	Repo   string `json:"repo"`
+	Owner  string `json:"owner"`
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit"`
+	// Destinations are the image tags, or the chart repository, pushed to
+	Destinations []string `json:"destinations"`
+	// Images are every container image the job runs, pipeline steps included
+	Images    []string                    `json:"images"`
+	Resources corev1.ResourceRequirements `json:"resources"`
+	Arch      string                      `json:"arch,omitempty"`
+	Variant   string                      `json:"variant,omitempty"`
+	// Language and BuildClass are how the build was placed
+	Language   string `json:"language,omitempty"`
+	BuildClass string `json:"buildClass,omitempty"`
+	// TriggeredBy is the app whose build started a dependency rebuild
+	TriggeredBy string `json:"triggeredBy,omitempty"`
+}
+
+// AdmissionDecision is the policy document's value
+type AdmissionDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons,omitempty"`
+	// Resources replaces the kaniko containers' resources
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Annotations are added to the job
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// policyDeniedError is a job the policy rejected, reported back to the pusher
+type policyDeniedError struct {
+	reasons []string
+}
+
+func (e *policyDeniedError) Error() string {
+	if len(e.reasons) == 0 {
+		return "denied by build policy"
+	}
+	return "denied by build policy: " + strings.Join(e.reasons, "; ")
+}
+
+// admit evaluates the policy for a job about to be created and applies its
+// mutations; a denial is a *policyDeniedError
+func admit(ctx context.Context, cfg *Config, job *batchv1.Job) error {
+	if cfg.Policy.URL == "" {
+		return nil
+	}
+	input := admissionFor(cfg, job)
+
+	decision, err := evaluatePolicy(ctx, cfg.Policy.URL, input)
+	if err != nil {
+		if cfg.Policy.FailOpen {
+			log.Printf("Failed to evaluate build policy for %s, admitting: %v", job.Name, err)
+			return nil
+		}
+		return fmt.Errorf("evaluating build policy: %w", err)
+	}
+	if !decision.Allow {
+		log.Printf("Build policy denied %s: %s", job.Name, strings.Join(decision.Reasons, "; "))
+		return &policyDeniedError{reasons: decision.Reasons}
+	}
+
+	if decision.Resources != nil {
+		for _, containers := range [][]corev1.Container{job.Spec.Template.Spec.InitContainers, job.Spec.Template.Spec.Containers} {
+			for i := range containers {
+				if containers[i].Image == cfg.KanikoImage {
+					containers[i].Resources = *decision.Resources
+				}
+			}
+		}
+	}
+	if len(decision.Annotations) > 0 && job.Annotations == nil {
+		job.Annotations = make(map[string]string)
+	}
+	for k, v := range decision.Annotations {
+		job.Annotations[k] = v
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// admissionFor reads the policy input from the job's containers
+func admissionFor(cfg *Config, job *batchv1.Job) *BuildAdmission {
+	spec := job.Spec.Template.Spec
+	repo := job.Annotations[repoAnnotation]
+	owner, _, _ := strings.Cut(repo, "/")
+	input := &BuildAdmission{
+		Kind:         "build",
+		App:          job.Labels["app-name"],
+		Repo:         repo,
+		Owner:        owner,
+		Branch:       job.Annotations[branchAnnotation],
+		Commit:       job.Annotations[commitAnnotation],
+		Destinations: []string{},
+		Images:       []string{},
+		Arch:         spec.NodeSelector["kubernetes.io/arch"],
+		Variant:      job.Annotations[variantAnnotation],
+		Language:     job.Annotations[languageAnnotation],
+		BuildClass:   job.Annotations[buildClassAnnotation],
+		TriggeredBy:  job.Annotations[triggeredByAnnotation],
+	}
+	if job.Labels["app"] == "chart-job" {
+		input.Kind = "chart"
+	}
+
+	for _, c := range append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...) {
+		if !contains(input.Images, c.Image) {
+			input.Images = append(input.Images, c.Image)
+		}
+		for _, arg := range c.Args {
+			if dest, ok := strings.CutPrefix(arg, "--destination="); ok {
+				input.Destinations = append(input.Destinations, dest)
+			}
+		}
+		for _, e := range c.Env {
+			if e.Name == "CHART_REPO" {
+				input.Destinations = append(input.Destinations, e.Value)
+			}
+		}
+		if c.Image == cfg.KanikoImage {
+			input.Resources = c.Resources
+		}
+	}
+	return input
+}
+
+func evaluatePolicy(ctx context.Context, url string, input *BuildAdmission) (*AdmissionDecision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+
+	var result struct {
+		Result *AdmissionDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding decision: %w", err)
+	}
+	// OPA omits the result when the document is undefined, e.g. a typo in
+	// the URL's package path
+	if result.Result == nil {
+		return nil, fmt.Errorf("no decision at %s", url)
+	}
+	return result.Result, nil
+}
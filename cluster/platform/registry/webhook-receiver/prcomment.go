@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prCommentMarker identifies the receiver's summary among a PR's comments
+const prCommentMarker = "<!-- webhook-receiver:build-summary -->"
+
+type pullRequest struct {
+	Number int `json:"number"`
+	Head   struct {
+		Ref  string `json:"ref"`
+		Repo struct {
+			FullName string `json:"full_name"`
+		} `json:"repo"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+type issueComment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// PRCommenter keeps a single build summary comment up to date on each open
+// pull request whose head branch was built
+type PRCommenter struct {
+	history *BuildHistory
+	config  func() *Config
+
+	// mu serialises updates so a PR never gets two summaries, and an older
+	// status never overwrites a newer one
+	mu     sync.Mutex
+	posted map[string]string // build ID -> status last commented
+}
+
+func NewPRCommenter(history *BuildHistory, config func() *Config) *PRCommenter {
+	return &PRCommenter{history: history, config: config, posted: make(map[string]string)}
+}
+
+// Update comments on the build's pull requests if its status changed since
+// the last update. Gitea is called in the background.
+func (c *PRCommenter) Update(id string) {
+	if c == nil {
+		return
+	}
+	cfg := c.config()
+	if !cfg.PRComments {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// Read under the lock so every update posts the latest state
+		rec, err := c.history.Get(ctx, id)
+		if err != nil || rec == nil || rec.Repo == "" || rec.Branch == "" {
+			return
+		}
+		if c.posted[id] == rec.Status {
+			return
+		}
+		if err := c.post(ctx, cfg, rec); err != nil {
+			log.Printf("Failed to comment on pull requests for %s: %v", id, err)
+			return
+		}
+		if rec.FinishedAt != nil {
+			delete(c.posted, id)
+		} else {
+			c.posted[id] = rec.Status
+		}
+	}()
+}
+
+func (c *PRCommenter) post(ctx context.Context, cfg *Config, rec *BuildRecord) error {
+	var pulls []pullRequest
+	if err := giteaJSON(ctx, cfg, http.MethodGet, fmt.Sprintf("/repos/%s/pulls?state=open&limit=50", rec.Repo), nil, &pulls); err != nil {
+		return err
+	}
+	for _, pr := range pulls {
+		// PRs from forks share branch names with the base repo
+		if pr.Head.Ref != rec.Branch || pr.Head.Repo.FullName != rec.Repo {
+			continue
+		}
+		body := c.summary(ctx, rec, pr.Base.Ref)
+		if err := upsertComment(ctx, cfg, rec.Repo, pr.Number, body); err != nil {
+			return fmt.Errorf("PR #%d: %w", pr.Number, err)
+		}
+	}
+	return nil
+}
+
+// upsertComment edits the PR's summary comment, or adds it
+func upsertComment(ctx context.Context, cfg *Config, repo string, number int, body string) error {
+	var comments []issueComment
+	if err := giteaJSON(ctx, cfg, http.MethodGet, fmt.Sprintf("/repos/%s/issues/%d/comments", repo, number), nil, &comments); err != nil {
+		return err
+	}
+	payload := map[string]string{"body": body}
+	for _, comment := range comments {
+		if strings.Contains(comment.Body, prCommentMarker) {
+			return giteaJSON(ctx, cfg, http.MethodPatch, fmt.Sprintf("/repos/%s/issues/comments/%d", repo, comment.ID), payload, nil)
+		}
+	}
+	return giteaJSON(ctx, cfg, http.MethodPost, fmt.Sprintf("/repos/%s/issues/%d/comments", repo, number), payload, nil)
+}
+
+// summary renders the comment: status, image, size against the latest
+// successful build of the PR's base branch, steps or variants, and the log
+// excerpt of a failed build
+func (c *PRCommenter) summary(ctx context.Context, rec *BuildRecord, base string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n**Build %s** for `%s`\n\n", prCommentMarker, rec.Status, shortCommit(rec.Commit))
+	fmt.Fprintf(&b, "| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Build | `%s` |\n", rec.ID)
+	if rec.Image != "" {
+		fmt.Fprintf(&b, "| Image | `%s` |\n", rec.Image)
+	}
+	if rec.ImageSize > 0 {
+		size := formatBytes(rec.ImageSize)
+		if prev := c.baseSize(ctx, rec, base); prev > 0 {
+			size += fmt.Sprintf(" (%s vs %s)", formatDelta(rec.ImageSize-prev), base)
+		}
+		fmt.Fprintf(&b, "| Size | %s |\n", size)
+	}
+	if rec.FinishedAt != nil {
+		fmt.Fprintf(&b, "| Duration | %s |\n", (time.Duration(rec.Duration) * time.Second).String())
+	}
+
+	if len(rec.Steps) > 0 {
+		b.WriteString("\n**Steps**\n\n")
+		for _, step := range rec.Steps {
+			fmt.Fprintf(&b, "- %s: %s\n", step.Name, step.Status)
+		}
+	}
+	if len(rec.Variants) > 0 {
+		b.WriteString("\n**Variants**\n\n")
+		for _, v := range rec.Variants {
+			fmt.Fprintf(&b, "- %s: %s `%s`\n", v.Name, v.Status, v.Image)
+		}
+	}
+	if rec.Status == BuildFailed && rec.LogExcerpt != "" {
+		fmt.Fprintf(&b, "\n<details><summary>Log excerpt</summary>\n\n```\n%s\n```\n</details>\n", rec.LogExcerpt)
+	}
+	fmt.Fprintf(&b, "\n_Updated %s_\n", time.Now().UTC().Format(time.RFC3339))
+	return b.String()
+}
+
+// baseSize returns the image size of the app's latest successful build of
+// branch, or 0
+func (c *PRCommenter) baseSize(ctx context.Context, rec *BuildRecord, branch string) int64 {
+	builds, err := c.history.List(ctx, rec.App, 100)
+	if err != nil {
+		return 0
+	}
+	for _, b := range builds {
+		if b.ID != rec.ID && b.Branch == branch && b.Status == BuildSucceeded && b.ImageSize > 0 {
+			return b.ImageSize
+		}
+	}
+	return 0
+}
+
+func formatDelta(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+	return "+" + formatBytes(n)
+}
+
+func shortCommit(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	slsaPredicateType   = "https://slsa.dev/provenance/v0.2"
+	// kanikoBuildType names the build steps a predicate's parameters
+	// describe: kaniko run with the recorded args
+	kanikoBuildType = "https://homelab.mcztest.com/webhook-receiver/kaniko@v1"
+)
+
+// ProvenanceSettings generates SLSA provenance for every successful image
+// build, signed and attached to the image by a cosign job
+type ProvenanceSettings struct {
+	Enabled bool `json:"enabled"`
+	// CosignImage runs the attest jobs
+	CosignImage string `json:"cosignImage"`
+	// KeySecret holds the signing key as cosign.key and its password as
+	// cosign.password, as written by cosign generate-key-pair k8s://
+	KeySecret string `json:"keySecret"`
+	// BuilderID identifies this builder in the predicate (default:
+	// receiverURL)
+	BuilderID string `json:"builderID,omitempty"`
+}
+
+// Statement is an in-toto statement carrying a SLSA v0.2 predicate
+type Statement struct {
+	Type          string              `json:"_type"`
+	PredicateType string              `json:"predicateType"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	Predicate     SLSAPredicate       `json:"predicate"`
+}
+
+type ProvenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type SLSAPredicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string               `json:"buildType"`
+	Invocation ProvenanceInvocation `json:"invocation"`
+	Metadata   ProvenanceMetadata   `json:"metadata"`
+	Materials  []ProvenanceMaterial `json:"materials"`
+}
+
+type ProvenanceInvocation struct {
+	ConfigSource ProvenanceMaterial `json:"configSource"`
+	// Parameters are the kaniko args the image was built with
+	Parameters  map[string]interface{} `json:"parameters"`
+	Environment map[string]string      `json:"environment,omitempty"`
+}
+
+type ProvenanceMetadata struct {
+	BuildInvocationID string    `json:"buildInvocationID"`
+	BuildStartedOn    time.Time `json:"buildStartedOn,omitempty"`
+	BuildFinishedOn   time.Time `json:"buildFinishedOn"`
+	Completeness      struct {
+		Parameters  bool `json:"parameters"`
+		Environment bool `json:"environment"`
+		Materials   bool `json:"materials"`
+	} `json:"completeness"`
+	Reproducible bool `json:"reproducible"`
+}
+
+type ProvenanceMaterial struct {
+	URI        string            `json:"uri"`
+	Digest     map[string]string `json:"digest,omitempty"`
+	EntryPoint string            `json:"entryPoint,omitempty"`
+}
+
+// buildProvenance describes how the job built rec's image, pushed as
+// digest. Only the source commit is listed as a material: base images are
+// resolved by kaniko and not reported back.
+func buildProvenance(cfg *Config, job *batchv1.Job, rec *BuildRecord, digest string, started, finished time.Time) *Statement {
+	repo, _ := splitImage(rec.Image)
+	algorithm, hex, _ := strings.Cut(digest, ":")
+
+	var args []string
+	dockerfile := "Dockerfile"
+	for _, c := range job.Spec.Template.Spec.Containers {
+		if !hasDestination(c.Args, rec.Image) {
+			continue
+		}
+		for _, arg := range c.Args {
+			if v, ok := strings.CutPrefix(arg, "--dockerfile="); ok {
+				dockerfile = strings.TrimPrefix(strings.TrimPrefix(v, workspaceDir+"/"), "./")
+			}
+			args = append(args, arg)
+		}
+		break
+	}
+
+	source := ProvenanceMaterial{
+		URI:    fmt.Sprintf("git+https://%s/%s.git@refs/heads/%s", cfg.GiteaHost, rec.Repo, rec.Branch),
+		Digest: map[string]string{"sha1": rec.Commit},
+	}
+
+	st := &Statement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaPredicateType,
+		Subject: []ProvenanceSubject{{
+			Name:   cfg.Registry + "/" + repo,
+			Digest: map[string]string{algorithm: hex},
+		}},
+	}
+	p := &st.Predicate
+	p.Builder.ID = cfg.Provenance.BuilderID
+	if p.Builder.ID == "" {
+		p.Builder.ID = cfg.ReceiverURL
+	}
+	p.BuildType = kanikoBuildType
+	p.Invocation = ProvenanceInvocation{
+		ConfigSource: ProvenanceMaterial{URI: source.URI, Digest: source.Digest, EntryPoint: dockerfile},
+		Parameters:   map[string]interface{}{"args": args},
+		Environment:  map[string]string{"app": rec.App, "tag": rec.Tag},
+	}
+	if arch := job.Spec.Template.Spec.NodeSelector["kubernetes.io/arch"]; arch != "" {
+		p.Invocation.Environment["arch"] = arch
+	}
+	if by := job.Annotations[triggeredByAnnotation]; by != "" {
+		p.Invocation.Environment["triggeredBy"] = by
+	}
+	p.Metadata = ProvenanceMetadata{
+		BuildInvocationID: job.Name,
+		BuildStartedOn:    started,
+		BuildFinishedOn:   finished,
+	}
+	p.Metadata.Completeness.Parameters = true
+	p.Materials = []ProvenanceMaterial{source}
+	return st
+}
+
+func hasDestination(args []string, image string) bool {
+	for _, arg := range args {
+		if arg == "--destination="+image {
+			return true
+		}
+	}
+	return false
+}
+
+// attestScript writes the predicate where cosign reads it; the cosign
+// image has no shell
+const attestScript = `set -eu
+printf '%s' "$PREDICATE" > /provenance/predicate.json
+`
+
+// createAttestJob signs the predicate with the configured key and attaches
+// it to the image as a cosign attestation. Transparency log upload is off:
+// the registry and key are private.
+func createAttestJob(cfg *Config, rec *BuildRecord, st *Statement) (*batchv1.Job, error) {
+	predicate, err := json.Marshal(st.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	repo, _ := splitImage(rec.Image)
+	subject := cfg.Registry + "/" + repo + "@sha256:" + st.Subject[0].Digest["sha256"]
+	optional := true
+
+	spec := basePodSpec(cfg, BuildOptions{})
+	// Only the registry credentials; the kaniko cache is not needed
+	spec.Volumes = append(spec.Volumes[:1], corev1.Volume{
+		Name:         "provenance",
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	provenanceMount := corev1.VolumeMount{Name: "provenance", MountPath: "/provenance"}
+	spec.InitContainers = []corev1.Container{{
+		Name:         "predicate",
+		Image:        cfg.CloneImage,
+		Command:      []string{"sh", "-c", attestScript},
+		Env:          []corev1.EnvVar{{Name: "PREDICATE", Value: string(predicate)}},
+		VolumeMounts: []corev1.VolumeMount{provenanceMount},
+	}}
+	spec.Containers = []corev1.Container{{
+		Name:  "cosign",
+		Image: cfg.Provenance.CosignImage,
+		Args: []string{
+			"attest", "--yes",
+			"--key=env://COSIGN_PRIVATE_KEY",
+			"--type=slsaprovenance",
+			"--predicate=/provenance/predicate.json",
+			"--tlog-upload=false",
+			"--allow-insecure-registry",
+			subject,
+		},
+		Env: []corev1.EnvVar{
+			{Name: "DOCKER_CONFIG", Value: "/kaniko/.docker"},
+			{Name: "COSIGN_PRIVATE_KEY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: cfg.Provenance.KeySecret},
+				Key:                  "cosign.key",
+			}}},
+			{Name: "COSIGN_PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: cfg.Provenance.KeySecret},
+				Key:                  "cosign.password",
+				Optional:             &optional,
+			}}},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			provenanceMount,
+			{Name: "docker-config", MountPath: "/kaniko/.docker/"},
+		},
+	}}
+
+	job := newBuildJob(cfg, BuildSource{App: rec.App, Tag: rec.Tag}, spec)
+	// Not an image build, so the tracker ignores it
+	job.Name = "attest-" + strings.TrimPrefix(rec.ID, "build-")
+	if len(job.Name) > 63 {
+		job.Name = strings.TrimRight(job.Name[:63], "-")
+	}
+	job.Labels["app"] = "attest-job"
+	job.Spec.Template.Labels["app"] = "attest-job"
+	backoff := int32(2)
+	job.Spec.BackoffLimit = &backoff
+	return job, nil
+}
+
+// attest records the provenance of a successful build and starts the job
+// signing it. Failures are logged; the build result stands.
+func (t *BuildTracker) attest(ctx context.Context, job *batchv1.Job, rec *BuildRecord, digest string, started, finished time.Time) {
+	cfg := t.config()
+	if !cfg.Provenance.Enabled || !strings.HasPrefix(digest, "sha256:") {
+		return
+	}
+
+	st := buildProvenance(cfg, job, rec, digest, started, finished)
+	data, err := json.Marshal(st)
+	if err != nil {
+		log.Printf("Failed to encode provenance of %s: %v", rec.ID, err)
+		return
+	}
+	if err := t.history.SetProvenance(ctx, rec.ID, string(data)); err != nil {
+		log.Printf("Failed to record provenance of %s: %v", rec.ID, err)
+		return
+	}
+
+	attestJob, err := createAttestJob(cfg, rec, st)
+	if err != nil {
+		log.Printf("Failed to create attest job for %s: %v", rec.ID, err)
+		return
+	}
+	harden(cfg, attestJob)
+	if _, err := t.kube.BatchV1().Jobs(buildNamespace).Create(ctx, attestJob, metav1.CreateOptions{}); err != nil {
+		log.Printf("Failed to create attest job for %s: %v", rec.ID, err)
+		return
+	}
+	log.Printf("Attesting provenance of %s@%s (job %s)", rec.Image, digest, attestJob.Name)
+}
+
+// handleBuildProvenance serves a build's in-toto provenance statement:
+//
+//	GET /builds/<id>/provenance
+//
+// The signed attestation is attached to the image; verify it with
+// cosign verify-attestation --type slsaprovenance --key cosign.pub.
+func (s *Server) handleBuildProvenance(w http.ResponseWriter, r *http.Request, buildID string) {
+	data, err := s.history.Provenance(r.Context(), buildID)
+	if err != nil {
+		log.Printf("Failed to load provenance of %s: %v", buildID, err)
+		http.Error(w, "Failed to load provenance", http.StatusInternalServerError)
+		return
+	}
+	if data == "" {
+		http.Error(w, "Provenance not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.in-toto+json")
+	fmt.Fprint(w, data)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var testDigest = "sha256:" + strings.Repeat("a", 64)
+
+func TestBuildProvenance(t *testing.T) {
+	cfg := defaultConfig()
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "build-app-0123456",
+			Annotations: map[string]string{triggeredByAnnotation: "build-lib-fedcba9"},
+		},
+	}
+	job.Spec.Template.Spec.NodeSelector = map[string]string{"kubernetes.io/arch": "arm64"}
+	job.Spec.Template.Spec.Containers = []corev1.Container{
+		{Name: "sidecar", Args: []string{"--destination=registry.home.mcztest.com/other:1"}},
+		{Name: "kaniko", Args: []string{
+			"--dockerfile=/workspace/./docker/Dockerfile.prod",
+			"--context=/workspace",
+			"--destination=registry.home.mcztest.com/app:0123456",
+		}},
+	}
+	rec := &BuildRecord{
+		ID:     "build-app-0123456",
+		App:    "app",
+		Repo:   "owner/app",
+		Branch: "main",
+		Commit: testCommit,
+		Tag:    "0123456",
+		Image:  "registry.home.mcztest.com/app:0123456",
+	}
+	started := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	finished := started.Add(2 * time.Minute)
+
+	st := buildProvenance(cfg, job, rec, testDigest, started, finished)
+	if st.Type != inTotoStatementType || st.PredicateType != slsaPredicateType {
+		t.Fatalf("statement types = %q, %q", st.Type, st.PredicateType)
+	}
+	wantSubject := []ProvenanceSubject{{Name: "registry.home.mcztest.com/app", Digest: map[string]string{"sha256": strings.Repeat("a", 64)}}}
+	if !reflect.DeepEqual(st.Subject, wantSubject) {
+		t.Fatalf("subject = %+v", st.Subject)
+	}
+
+	p := st.Predicate
+	if p.Builder.ID != cfg.ReceiverURL || p.BuildType != kanikoBuildType {
+		t.Fatalf("builder = %q, build type = %q", p.Builder.ID, p.BuildType)
+	}
+	source := "git+https://gitea.home.mcztest.com/owner/app.git@refs/heads/main"
+	if p.Invocation.ConfigSource.URI != source || p.Invocation.ConfigSource.Digest["sha1"] != testCommit {
+		t.Fatalf("config source = %+v", p.Invocation.ConfigSource)
+	}
+	if p.Invocation.ConfigSource.EntryPoint != "docker/Dockerfile.prod" {
+		t.Fatalf("entry point = %q", p.Invocation.ConfigSource.EntryPoint)
+	}
+	// Only the container pushing the image contributes parameters
+	if args := p.Invocation.Parameters["args"].([]string); len(args) != 3 || args[2] != "--destination="+rec.Image {
+		t.Fatalf("args = %v", args)
+	}
+	wantEnv := map[string]string{"app": "app", "tag": "0123456", "arch": "arm64", "triggeredBy": "build-lib-fedcba9"}
+	if !reflect.DeepEqual(p.Invocation.Environment, wantEnv) {
+		t.Fatalf("environment = %v", p.Invocation.Environment)
+	}
+	if p.Metadata.BuildInvocationID != job.Name || !p.Metadata.BuildStartedOn.Equal(started) || !p.Metadata.BuildFinishedOn.Equal(finished) {
+		t.Fatalf("metadata = %+v", p.Metadata)
+	}
+	if len(p.Materials) != 1 || p.Materials[0].URI != source {
+		t.Fatalf("materials = %+v", p.Materials)
+	}
+
+	cfg.Provenance.BuilderID = "https://builds.example.com"
+	if st := buildProvenance(cfg, job, rec, testDigest, started, finished); st.Predicate.Builder.ID != "https://builds.example.com" {
+		t.Fatalf("builder = %q", st.Predicate.Builder.ID)
+	}
+}
+
+func TestAttestSuccessfulBuild(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		digest     string
+		wantAttest bool
+	}{
+		{name: "attested", enabled: true, digest: testDigest, wantAttest: true},
+		{name: "disabled", digest: testDigest},
+		{name: "no digest from the registry", enabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestGitea(t, nil)
+			cfg.Provenance.Enabled = tt.enabled
+			s, kube := newTestServer(t, cfg)
+			tracker := newTestTracker(t, s, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", dockerManifestV2)
+				if tt.digest != "" {
+					w.Header().Set("Docker-Content-Digest", tt.digest)
+				}
+				w.Write([]byte(`{"config": {"size": 100}, "layers": [{"size": 1000}]}`))
+			})
+
+			w := httptest.NewRecorder()
+			s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			tracker.observe(context.Background(), finishJob(getJob(t, kube, "build-app-0123456"), true))
+
+			jobs := listJobs(t, kube)
+			if !tt.wantAttest {
+				if len(jobs) != 1 {
+					t.Fatalf("jobs = %v, want no attest job", jobs)
+				}
+				w := httptest.NewRecorder()
+				s.handleBuilds(w, httptest.NewRequest(http.MethodGet, "/builds/build-app-0123456/provenance", nil))
+				if w.Code != http.StatusNotFound {
+					t.Fatalf("provenance status = %d, want 404", w.Code)
+				}
+				return
+			}
+
+			job := getJob(t, kube, "attest-app-0123456")
+			if job.Labels["app"] != "attest-job" || recordFromJob(job).Image != "" {
+				t.Fatalf("attest job would be tracked as a build: labels %v", job.Labels)
+			}
+			if len(job.Spec.Template.Spec.InitContainers) != 1 || len(job.Spec.Template.Spec.Containers) != 1 {
+				t.Fatalf("containers = %+v", job.Spec.Template.Spec)
+			}
+			cosign := job.Spec.Template.Spec.Containers[0]
+			if cosign.Image != cfg.Provenance.CosignImage {
+				t.Fatalf("image = %q", cosign.Image)
+			}
+			if subject := cosign.Args[len(cosign.Args)-1]; subject != "registry.home.mcztest.com/app@"+testDigest {
+				t.Fatalf("subject = %q", subject)
+			}
+			for _, env := range cosign.Env {
+				if env.Name == "COSIGN_PRIVATE_KEY" && env.ValueFrom.SecretKeyRef.Name != "cosign-key" {
+					t.Fatalf("key from %+v", env.ValueFrom.SecretKeyRef)
+				}
+			}
+
+			w = httptest.NewRecorder()
+			s.handleBuilds(w, httptest.NewRequest(http.MethodGet, "/builds/build-app-0123456/provenance", nil))
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/vnd.in-toto+json" {
+				t.Fatalf("provenance status = %d, type %q", w.Code, w.Header().Get("Content-Type"))
+			}
+			var st Statement
+			if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+				t.Fatal(err)
+			}
+			if st.Subject[0].Digest["sha256"] != strings.Repeat("a", 64) || st.Predicate.Invocation.ConfigSource.Digest["sha1"] != testCommit {
+				t.Fatalf("statement = %+v", st)
+			}
+
+			// The init container hands cosign the same predicate
+			var predicate SLSAPredicate
+			if err := json.Unmarshal([]byte(job.Spec.Template.Spec.InitContainers[0].Env[0].Value), &predicate); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(predicate.Materials, st.Predicate.Materials) {
+				t.Fatalf("predicate materials = %+v", predicate.Materials)
+			}
+		})
+	}
+}
+
+func TestCreateAttestJobTruncatesName(t *testing.T) {
+	rec := &BuildRecord{
+		// attest- plus the app name fills the limit up to a dash
+		ID:    "build-" + strings.Repeat("a", 55) + "-0123456",
+		App:   strings.Repeat("a", 55),
+		Tag:   "0123456",
+		Image: "registry.home.mcztest.com/app:0123456",
+	}
+	st := &Statement{Subject: []ProvenanceSubject{{Digest: map[string]string{"sha256": strings.Repeat("a", 64)}}}}
+	job, err := createAttestJob(defaultConfig(), rec, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Name != "attest-"+strings.Repeat("a", 55) {
+		t.Fatalf("name = %q", job.Name)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// registryAnnotation names the destination registry of builds that do not
+// push to the default one
+const registryAnnotation = "homelab.mcztest.com/registry"
+
+// pushSecretsAnnotation lists the dockerconfigjson Secrets merged into the
+// job's own docker config Secret, named <job>-docker-config
+const pushSecretsAnnotation = "homelab.mcztest.com/push-secrets"
+
+// registryCertsDir is where the registry-certs volume, the CA certificates
+// of registryTLS and destinations by host, is mounted in kaniko containers
+const registryCertsDir = "/kaniko/registry-certs"
+
+var registryCertsMount = corev1.VolumeMount{Name: "registry-certs", MountPath: registryCertsDir, ReadOnly: true}
+
+// RegistryTLS is how builds reach one registry: the default registry, the
+// cache repo, or one base images are pulled from
+type RegistryTLS struct {
+	// Host is the registry host, with its port if it has one
+	Host string `json:"host"`
+	// Insecure pulls and pushes over plain HTTP
+	Insecure bool `json:"insecure,omitempty"`
+	// SkipTLSVerify accepts any certificate
+	SkipTLSVerify bool `json:"skipTLSVerify,omitempty"`
+	// CASecret is a Secret holding ca.crt, the CA that signed the
+	// registry's certificate; without it the host is verified against the
+	// system roots and CAConfigMap
+	CASecret string `json:"caSecret,omitempty"`
+}
+
+// certFile is the registry's file in the registry-certs volume
+func (t RegistryTLS) certFile() string {
+	return strings.ReplaceAll(t.Host, ":", "_") + ".crt"
+}
+
+// args renders kaniko's flags for the registry
+func (t RegistryTLS) args(cfg *Config) []string {
+	var args []string
+	if t.Insecure {
+		args = append(args, "--insecure-registry="+t.Host)
+	}
+	if t.SkipTLSVerify {
+		args = append(args, "--skip-tls-verify-registry="+t.Host)
+	}
+	switch {
+	case t.CASecret != "":
+		args = append(args, fmt.Sprintf("--registry-certificate=%s=%s/%s", t.Host, registryCertsDir, t.certFile()))
+	case cfg.CAConfigMap != "" && !t.Insecure && !t.SkipTLSVerify:
+		args = append(args, fmt.Sprintf("--registry-certificate=%s=%s/ca.crt", t.Host, internalCADir))
+	}
+	return args
+}
+
+func validateRegistryTLS(hosts []RegistryTLS) error {
+	seen := make(map[string]bool)
+	for i, t := range hosts {
+		if t.Host == "" || strings.Contains(t.Host, "/") {
+			return fmt.Errorf("registryTLS[%d]: host must be a registry host without a scheme or path, e.g. registry.lab:5000", i)
+		}
+		if seen[t.Host] {
+			return fmt.Errorf("registryTLS: duplicate host %q", t.Host)
+		}
+		seen[t.Host] = true
+		if t.Insecure && t.CASecret != "" {
+			return fmt.Errorf("registryTLS: %s: caSecret has no effect on an insecure registry", t.Host)
+		}
+	}
+	return nil
+}
+
+// verifiesTLS reports whether builds get per-registry TLS settings rather
+// than kaniko's blanket --insecure and --skip-tls-verify
+func (c *Config) verifiesTLS() bool {
+	return c.CAConfigMap != "" || len(c.RegistryTLS) > 0
+}
+
+// buildTLS returns the TLS settings of every build: registryTLS, plus the
+// default registry and cache repo with default settings unless listed there
+func (c *Config) buildTLS() []RegistryTLS {
+	hosts := append([]RegistryTLS(nil), c.RegistryTLS...)
+	for _, host := range []string{registryHost(c.Registry), registryHost(c.CacheRepo)} {
+		listed := false
+		for _, t := range hosts {
+			listed = listed || t.Host == host
+		}
+		if !listed {
+			hosts = append(hosts, RegistryTLS{Host: host})
+		}
+	}
+	return hosts
+}
+
+// registryTLSArgs are the TLS flags of every kaniko container
+func registryTLSArgs(cfg *Config) []string {
+	if !cfg.verifiesTLS() {
+		return []string{"--insecure", "--skip-tls-verify"}
+	}
+	var args []string
+	for _, t := range cfg.buildTLS() {
+		args = append(args, t.args(cfg)...)
+	}
+	return args
+}
+
+// hasRegistryCerts reports whether build pods mount the registry-certs volume
+func (c *Config) hasRegistryCerts() bool {
+	for _, t := range c.RegistryTLS {
+		if t.CASecret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// addRegistryCert projects a registry's CA Secret into the registry-certs
+// volume, creating it on first use; a second Secret for the host replaces
+// the first
+func addRegistryCert(spec *corev1.PodSpec, t RegistryTLS) {
+	source := corev1.VolumeProjection{Secret: &corev1.SecretProjection{
+		LocalObjectReference: corev1.LocalObjectReference{Name: t.CASecret},
+		Items:                []corev1.KeyToPath{{Key: "ca.crt", Path: t.certFile()}},
+	}}
+	for i := range spec.Volumes {
+		if spec.Volumes[i].Name != "registry-certs" {
+			continue
+		}
+		projected := spec.Volumes[i].Projected
+		for j := range projected.Sources {
+			if projected.Sources[j].Secret.Items[0].Path == t.certFile() {
+				projected.Sources[j] = source
+				return
+			}
+		}
+		projected.Sources = append(projected.Sources, source)
+		return
+	}
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "registry-certs",
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{source}},
+		},
+	})
+}
+
+// Destination is a registry builds can push to instead of Config.Registry,
+// e.g. ghcr.io or a second internal registry. Repos choose one by name in
+// repositories[].registry or .build.yaml registry.
+type Destination struct {
+	Name string `json:"name"`
+	// Host is the registry, optionally with a namespace images are pushed
+	// under, e.g. ghcr.io/mzakany23
+	Host string `json:"host"`
+	// PushSecret is a dockerconfigjson Secret in the build namespace with
+	// the destination's credentials. Kaniko reads a single config.json, so
+	// it is merged with Config.PushSecret, which base images and the cache
+	// repo still need; the destination's entries win for the same host.
+	PushSecret string `json:"pushSecret,omitempty"`
+	// Insecure pushes over plain HTTP
+	Insecure bool `json:"insecure,omitempty"`
+	// SkipTLSVerify accepts any certificate
+	SkipTLSVerify bool `json:"skipTLSVerify,omitempty"`
+	// CASecret is a Secret holding ca.crt, the CA that signed the
+	// registry's certificate, for registries with a private CA
+	CASecret string `json:"caSecret,omitempty"`
+}
+
+// hasTLS reports whether the destination sets any TLS settings of its own
+func (d *Destination) hasTLS() bool {
+	return d.Insecure || d.SkipTLSVerify || d.CASecret != ""
+}
+
+// tls returns the destination's TLS settings
+func (d *Destination) tls() RegistryTLS {
+	return RegistryTLS{Host: registryHost(d.Host), Insecure: d.Insecure, SkipTLSVerify: d.SkipTLSVerify, CASecret: d.CASecret}
+}
+
+// registryHost is the host of an image reference or registry path
+func registryHost(ref string) string {
+	host, _, _ := strings.Cut(ref, "/")
+	return host
+}
+
+func validateDestinations(dests []Destination) error {
+	seen := make(map[string]bool)
+	for i, d := range dests {
+		if !stepNamePattern.MatchString(d.Name) {
+			return fmt.Errorf("registries[%d]: name %q must be lowercase alphanumerics and dashes", i, d.Name)
+		}
+		if seen[d.Name] {
+			return fmt.Errorf("registries: duplicate name %q", d.Name)
+		}
+		seen[d.Name] = true
+		if d.Host == "" || strings.Contains(d.Host, "://") || strings.HasSuffix(d.Host, "/") {
+			return fmt.Errorf("registries: %s: host must be a registry host or path without a scheme, e.g. ghcr.io/owner", d.Name)
+		}
+	}
+	return nil
+}
+
+// Destination returns the named destination, or nil
+func (c *Config) Destination(name string) *Destination {
+	for i := range c.Registries {
+		if c.Registries[i].Name == name {
+			return &c.Registries[i]
+		}
+	}
+	return nil
+}
+
+// destinationFor resolves where a repo's build pushes: .build.yaml registry,
+// else the repo's settings, else "" for Config.Registry
+func (c *Config) destinationFor(fullName string, build *BuildFile) (string, error) {
+	name := c.SettingsFor(fullName).Registry
+	if build != nil && build.Registry != "" {
+		name = build.Registry
+	}
+	if name == "" {
+		return "", nil
+	}
+	if c.Destination(name) == nil {
+		return "", fmt.Errorf("registry %q is not configured", name)
+	}
+	if build != nil && len(build.Platforms) > 0 {
+		// Manifest lists are assembled through the default registry's API
+		return "", fmt.Errorf("platforms are only supported on the default registry, not %s", name)
+	}
+	return name, nil
+}
+
+// addDestination points a job at its destination registry: its push
+// credentials, and TLS settings for it alone. Builds without registryTLS or
+// caConfigMap keep the blanket --insecure and --skip-tls-verify unless the
+// destination sets its own TLS; then they are narrowed to the default
+// registry and cache repo, which base images and layers still come from.
+// The destination's own TLS settings replace those registryTLS has for its
+// host; without any, registryTLS's stand.
+func addDestination(cfg *Config, job *batchv1.Job) {
+	dest := cfg.Destination(job.Annotations[registryAnnotation])
+	if dest == nil {
+		return
+	}
+	spec := &job.Spec.Template.Spec
+	if dest.PushSecret != "" {
+		for i := range spec.Volumes {
+			if spec.Volumes[i].Name != "docker-config" {
+				continue
+			}
+			secret, optional := dest.PushSecret, true
+			if cfg.PushSecret != "" {
+				// Written by createDockerConfig once the job exists; the
+				// pod waits for it
+				secret, optional = job.Name+"-docker-config", false
+				job.Annotations[pushSecretsAnnotation] = cfg.PushSecret + "," + dest.PushSecret
+			}
+			spec.Volumes[i].VolumeSource = corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: secret,
+					Optional:   &optional,
+					Items:      []corev1.KeyToPath{{Key: corev1.DockerConfigJsonKey, Path: "config.json"}},
+				},
+			}
+		}
+	}
+	destTLS := dest.tls()
+	if destTLS.CASecret != "" {
+		addRegistryCert(spec, destTLS)
+	}
+
+	var tlsArgs []string
+	if !cfg.verifiesTLS() {
+		if !dest.hasTLS() {
+			return
+		}
+		hosts := []string{registryHost(cfg.Registry)}
+		if cacheHost := registryHost(cfg.CacheRepo); cacheHost != hosts[0] {
+			hosts = append(hosts, cacheHost)
+		}
+		for _, host := range hosts {
+			if host != destTLS.Host {
+				tlsArgs = append(tlsArgs, "--insecure-registry="+host, "--skip-tls-verify-registry="+host)
+			}
+		}
+	}
+	replace := true
+	if cfg.verifiesTLS() && !dest.hasTLS() {
+		for _, t := range cfg.buildTLS() {
+			replace = replace && t.Host != destTLS.Host
+		}
+	}
+	if replace {
+		tlsArgs = append(tlsArgs, destTLS.args(cfg)...)
+	}
+
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			if c.Image != cfg.KanikoImage {
+				continue
+			}
+			args := make([]string, 0, len(c.Args)+len(tlsArgs))
+			for _, arg := range c.Args {
+				if arg == "--insecure" || arg == "--skip-tls-verify" || replace && registryArg(arg, destTLS.Host) {
+					continue
+				}
+				args = append(args, arg)
+			}
+			c.Args = append(args, tlsArgs...)
+			if destTLS.CASecret != "" && !cfg.hasRegistryCerts() {
+				c.VolumeMounts = append(c.VolumeMounts, registryCertsMount)
+			}
+		}
+	}
+}
+
+// registryArg reports whether arg is one of kaniko's TLS flags for host
+func registryArg(arg, host string) bool {
+	for _, flag := range []string{"--insecure-registry=", "--skip-tls-verify-registry=", "--registry-certificate="} {
+		if value, ok := strings.CutPrefix(arg, flag); ok {
+			return value == host || strings.HasPrefix(value, host+"=")
+		}
+	}
+	return false
+}
+
+// createDockerConfig writes the docker config Secret of a job created with
+// pushSecretsAnnotation: the auths of each listed Secret, later ones winning
+// for the same host, and missing Secrets skipped like optional mounts. The
+// job owns the Secret, so it is deleted with it.
+func createDockerConfig(ctx context.Context, kube kubernetes.Interface, job *batchv1.Job) error {
+	names := job.Annotations[pushSecretsAnnotation]
+	if names == "" {
+		return nil
+	}
+	secrets := kube.CoreV1().Secrets(job.Namespace)
+	auths := make(map[string]json.RawMessage)
+	for _, name := range strings.Split(names, ",") {
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var config struct {
+			Auths map[string]json.RawMessage `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for host, auth := range config.Auths {
+			auths[host] = auth
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name + "-docker-config",
+			Namespace: job.Namespace,
+			Labels:    map[string]string{"app": "docker-config", "app-name": job.Labels["app-name"]},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "batch/v1",
+				Kind:       "Job",
+				Name:       job.Name,
+				UID:        job.UID,
+			}},
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: data},
+	}
+	_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// Left by an earlier job of the same name not yet collected
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAddDestinationTLSArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		dest        Destination
+		registryTLS []RegistryTLS
+		want        []string
+		notWant     []string
+	}{
+		{
+			name:    "no TLS settings keep the blanket flags",
+			dest:    Destination{Name: "ghcr", Host: "ghcr.io/owner"},
+			want:    []string{"--insecure", "--skip-tls-verify"},
+			notWant: []string{"--insecure-registry=", "--skip-tls-verify-registry="},
+		},
+		{
+			name: "destination TLS narrows the blanket flags",
+			dest: Destination{Name: "lab", Host: "registry.lab:5000", Insecure: true},
+			want: []string{
+				"--insecure-registry=registry.home.mcztest.com",
+				"--skip-tls-verify-registry=registry.home.mcztest.com",
+				"--insecure-registry=registry.lab:5000",
+			},
+			notWant: []string{"--insecure", "--skip-tls-verify"},
+		},
+		{
+			name:        "registryTLS verifies the other registries",
+			dest:        Destination{Name: "lab", Host: "registry.lab:5000", SkipTLSVerify: true},
+			registryTLS: []RegistryTLS{{Host: "registry.home.mcztest.com"}},
+			want:        []string{"--skip-tls-verify-registry=registry.lab:5000"},
+			notWant:     []string{"--insecure", "--skip-tls-verify", "--insecure-registry=registry.home.mcztest.com"},
+		},
+		{
+			name:        "destination TLS replaces registryTLS for its host",
+			dest:        Destination{Name: "lab", Host: "registry.lab:5000", Insecure: true},
+			registryTLS: []RegistryTLS{{Host: "registry.lab:5000", CASecret: "lab-ca"}},
+			want:        []string{"--insecure-registry=registry.lab:5000"},
+			notWant:     []string{"--registry-certificate=registry.lab:5000="},
+		},
+		{
+			name:        "registryTLS stands for a destination without TLS",
+			dest:        Destination{Name: "lab", Host: "registry.lab:5000/team"},
+			registryTLS: []RegistryTLS{{Host: "registry.lab:5000", CASecret: "lab-ca"}},
+			want:        []string{"--registry-certificate=registry.lab:5000=" + registryCertsDir + "/registry.lab_5000.crt"},
+		},
+		{
+			name:    "destination TLS replaces the blanket flags for its host",
+			dest:    Destination{Name: "mirror", Host: "registry.home.mcztest.com/mirror", SkipTLSVerify: true},
+			want:    []string{"--skip-tls-verify-registry=registry.home.mcztest.com"},
+			notWant: []string{"--insecure", "--insecure-registry="},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestGitea(t, nil)
+			cfg.Registries = []Destination{tt.dest}
+			cfg.Repositories = []RepoSettings{{Match: "owner/app", Registry: tt.dest.Name}}
+			cfg.RegistryTLS = tt.registryTLS
+			s, kube := newTestServer(t, cfg)
+
+			w := httptest.NewRecorder()
+			s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			job, err := kube.BatchV1().Jobs(buildNamespace).Get(context.Background(), "build-app-0123456", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := job.Spec.Template.Spec.Containers[0].Args
+			has := func(want string) bool {
+				for _, arg := range args {
+					if arg == want || strings.HasSuffix(want, "=") && strings.HasPrefix(arg, want) {
+						return true
+					}
+				}
+				return false
+			}
+			for _, want := range tt.want {
+				if !has(want) {
+					t.Errorf("kaniko args lack %s: %q", want, args)
+				}
+			}
+			for _, unwanted := range tt.notWant {
+				if has(unwanted) {
+					t.Errorf("kaniko args have %s: %q", unwanted, args)
+				}
+			}
+			seen := make(map[string]bool)
+			for _, arg := range args {
+				if seen[arg] {
+					t.Errorf("kaniko args repeat %s: %q", arg, args)
+				}
+				seen[arg] = true
+			}
+		})
+	}
+}
+
+func TestAddDestinationPushSecret(t *testing.T) {
+	ctx := context.Background()
+	dockerConfig := func(auths string) *corev1.Secret {
+		return &corev1.Secret{Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths": {` + auths + `}}`)}}
+	}
+
+	tests := []struct {
+		name       string
+		pushSecret string
+		// wantVolume is the Secret mounted as the docker config
+		wantVolume string
+		wantAuths  map[string]string
+	}{
+		{
+			name:       "destination without credentials keeps the default",
+			wantVolume: "registry-credentials",
+		},
+		{
+			name:       "destination credentials merged with the default",
+			pushSecret: "ghcr-credentials",
+			wantVolume: "build-app-0123456-docker-config",
+			wantAuths: map[string]string{
+				"registry.home.mcztest.com": "homelab",
+				"ghcr.io":                   "bot",
+				"docker.io":                 "ghcr-bot",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestGitea(t, nil)
+			cfg.Registries = []Destination{{Name: "ghcr", Host: "ghcr.io/owner", PushSecret: tt.pushSecret}}
+			cfg.Repositories = []RepoSettings{{Match: "owner/app", Registry: "ghcr"}}
+			s, kube := newTestServer(t, cfg)
+			for name, auths := range map[string]string{
+				"registry-credentials": `"registry.home.mcztest.com": {"username": "homelab"}, "docker.io": {"username": "homelab-bot"}`,
+				"ghcr-credentials":     `"ghcr.io": {"username": "bot"}, "docker.io": {"username": "ghcr-bot"}`,
+			} {
+				secret := dockerConfig(auths)
+				secret.Name, secret.Namespace = name, buildNamespace
+				if _, err := kube.CoreV1().Secrets(buildNamespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			job, err := kube.BatchV1().Jobs(buildNamespace).Get(ctx, "build-app-0123456", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var mounted string
+			for _, v := range job.Spec.Template.Spec.Volumes {
+				if v.Name == "docker-config" && v.Secret != nil {
+					mounted = v.Secret.SecretName
+				}
+			}
+			if mounted != tt.wantVolume {
+				t.Fatalf("docker-config mounts %q, want %q", mounted, tt.wantVolume)
+			}
+			if tt.wantAuths == nil {
+				return
+			}
+
+			secret, err := kube.CoreV1().Secrets(buildNamespace).Get(ctx, tt.wantVolume, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if owners := secret.OwnerReferences; len(owners) != 1 || owners[0].Kind != "Job" || owners[0].Name != job.Name {
+				t.Fatalf("owners = %+v", owners)
+			}
+			var merged struct {
+				Auths map[string]struct {
+					Username string `json:"username"`
+				} `json:"auths"`
+			}
+			if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &merged); err != nil {
+				t.Fatal(err)
+			}
+			users := make(map[string]string)
+			for host, auth := range merged.Auths {
+				users[host] = auth.Username
+			}
+			if !reflect.DeepEqual(users, tt.wantAuths) {
+				t.Fatalf("merged auths = %v, want %v", users, tt.wantAuths)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/registryauth"
+)
+
+// Manifest media types accepted when resolving tags
+var manifestAccept = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}, ", ")
+
+// RegistryClient reads manifests from the Docker Registry HTTP API v2
+type RegistryClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewRegistryClient logs in with the docker config at authFile, if set
+func NewRegistryClient(baseURL, authFile string) *RegistryClient {
+	return &RegistryClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    registryauth.Client(authFile, 30*time.Second),
+	}
+}
+
+// ImageSize returns the manifest digest and compressed size (config plus
+// layers) of repo:tag; for multi-arch indexes, the first platform's size
+func (c *RegistryClient) ImageSize(ctx context.Context, repo, tag string) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repo, tag), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Accept", manifestAccept)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", 0, fmt.Errorf("GET manifest %s:%s: %s: %s", repo, tag, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+			Size   int64  `json:"size"`
+		} `json:"config"`
+		Layers []struct {
+			Size int64 `json:"size"`
+		} `json:"layers"`
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return "", 0, fmt.Errorf("decoding manifest %s:%s: %w", repo, tag, err)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if len(manifest.Manifests) > 0 && manifest.Config.Digest == "" {
+		_, size, err := c.ImageSize(ctx, repo, manifest.Manifests[0].Digest)
+		return digest, size, err
+	}
+
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return digest, size, nil
+}
+
+// DeleteManifest deletes a manifest by digest, untagging every tag that points at it
+func (c *RegistryClient) DeleteManifest(ctx context.Context, repo, digest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repo, digest), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("DELETE %s@%s: %s: %s", repo, digest, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Manifest list media types, matching the children's format
+const (
+	dockerManifestV2   = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociImageIndex      = "application/vnd.oci.image.index.v1+json"
+)
+
+// ManifestListEntry is one platform's image in a manifest list
+type ManifestListEntry struct {
+	MediaType string
+	Digest    string
+	Size      int64
+	Arch      string
+}
+
+// Describe returns the media type, digest, and size of repo:ref's manifest
+func (c *RegistryClient) Describe(ctx context.Context, repo, ref string) (ManifestListEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repo, ref), nil)
+	if err != nil {
+		return ManifestListEntry{}, err
+	}
+	req.Header.Set("Accept", manifestAccept)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return ManifestListEntry{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return ManifestListEntry{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ManifestListEntry{}, fmt.Errorf("GET manifest %s:%s: %s: %s", repo, ref, resp.Status, strings.TrimSpace(string(body)))
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return ManifestListEntry{}, fmt.Errorf("GET manifest %s:%s: registry returned no digest", repo, ref)
+	}
+	return ManifestListEntry{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digest,
+		Size:      int64(len(body)),
+	}, nil
+}
+
+// PutManifestList tags repo:tag as a list of the entries, all in repo. It
+// is a Docker manifest list when every entry is a Docker manifest, else an
+// OCI index.
+func (c *RegistryClient) PutManifestList(ctx context.Context, repo, tag string, entries []ManifestListEntry) error {
+	type platform struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	}
+	type descriptor struct {
+		MediaType string   `json:"mediaType"`
+		Digest    string   `json:"digest"`
+		Size      int64    `json:"size"`
+		Platform  platform `json:"platform"`
+	}
+	list := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Manifests     []descriptor `json:"manifests"`
+	}{SchemaVersion: 2, MediaType: dockerManifestList}
+	for _, e := range entries {
+		if e.MediaType != dockerManifestV2 {
+			list.MediaType = ociImageIndex
+		}
+		list.Manifests = append(list.Manifests, descriptor{
+			MediaType: e.MediaType,
+			Digest:    e.Digest,
+			Size:      e.Size,
+			Platform:  platform{Architecture: e.Arch, OS: "linux"},
+		})
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repo, tag), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", list.MediaType)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("PUT manifest list %s:%s: %s: %s", repo, tag, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// splitImage splits "registry.example.com/app:tag" into repository and tag
+func splitImage(image string) (repo, tag string) {
+	if i := strings.Index(image, "/"); i >= 0 {
+		image = image[i+1:]
+	}
+	repo, tag = image, "latest"
+	if i := strings.LastIndex(image, ":"); i >= 0 {
+		repo, tag = image[:i], image[i+1:]
+	}
+	return repo, tag
+}
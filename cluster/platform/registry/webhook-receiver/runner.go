@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/auth"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Runner mode: instead of a Job per build, plain kaniko builds are queued
+// here and pulled by long-lived build-runner pods, which skips pod
+// scheduling and image pulls on every build. Pipelines, matrix, clone and
+// artifact builds, and arch-pinned builds keep using Jobs.
+
+const runnerQueueSchema = `
+CREATE TABLE IF NOT EXISTS runner_queue (
+	id          TEXT PRIMARY KEY,
+	app         TEXT NOT NULL,
+	args        TEXT NOT NULL,
+	annotations TEXT NOT NULL DEFAULT '',
+	queued_at   INTEGER NOT NULL,
+	runner      TEXT NOT NULL DEFAULT '',
+	claimed_at  INTEGER
+);
+CREATE INDEX IF NOT EXISTS runner_queue_queued ON runner_queue (queued_at);
+`
+
+// runnerLogLimit caps the log tail a runner reports
+const runnerLogLimit = 64 << 10
+
+// RunnerWork is a queued build: the kaniko arguments and the annotations its
+// job would have carried
+type RunnerWork struct {
+	ID          string
+	App         string
+	Args        []string
+	Annotations map[string]string
+	QueuedAt    time.Time
+	Runner      string
+	ClaimedAt   time.Time
+}
+
+// job returns a stand-in for the Job the work replaced, so results go
+// through the same tracker path as Job builds
+func (w *RunnerWork) job() *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        w.ID,
+			Namespace:   buildNamespace,
+			Labels:      map[string]string{"app": "build-job", "app-name": w.App},
+			Annotations: w.Annotations,
+		},
+	}
+}
+
+// runnerArgs adapts a build job's kaniko arguments for a runner: its cache
+// is an emptyDir at kanikoCacheDir, and --cleanup resets the filesystem
+// between builds
+func runnerArgs(job *batchv1.Job) []string {
+	var args []string
+	for _, arg := range job.Spec.Template.Spec.Containers[0].Args {
+		if !strings.HasPrefix(arg, "--cache-dir=") {
+			args = append(args, arg)
+		}
+	}
+	return append(args, "--cache-dir="+kanikoCacheDir, "--cleanup")
+}
+
+// runnable reports whether a plain build job can go to the runner pool:
+// runners have no workspace, node pinning, build class placement, Go cache
+// volume, credentials for other registries, or registry certificates beyond
+// the internal CA, run on this cluster, and read arguments by line
+func runnable(job *batchv1.Job, opts BuildOptions) bool {
+	if opts.needsClone() || opts.Arch != "" || job.Annotations[buildClassAnnotation] != "" ||
+		job.Annotations[goCacheAnnotation] != "" || job.Annotations[registryAnnotation] != "" ||
+		job.Annotations[clusterAnnotation] != "" {
+		return false
+	}
+	for _, v := range job.Spec.Template.Spec.Volumes {
+		if v.Name == "registry-certs" {
+			return false
+		}
+	}
+	for _, arg := range job.Spec.Template.Spec.Containers[0].Args {
+		if strings.Contains(arg, "\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// Enqueue adds a build to the runner queue; a build already queued is an error
+func (h *BuildHistory) Enqueue(ctx context.Context, w *RunnerWork) error {
+	args, err := json.Marshal(w.Args)
+	if err != nil {
+		return err
+	}
+	annotations, err := json.Marshal(w.Annotations)
+	if err != nil {
+		return err
+	}
+	res, err := h.db.ExecContext(ctx, `
+		INSERT INTO runner_queue (id, app, args, annotations, queued_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		w.ID, w.App, string(args), string(annotations), w.QueuedAt.Unix())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("build %s is already queued", w.ID)
+	}
+	return nil
+}
+
+// Claim assigns the oldest unclaimed build to runner and marks it running,
+// or returns nil when the queue is empty
+func (h *BuildHistory) Claim(ctx context.Context, runner string) (*RunnerWork, error) {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	w, err := scanRunnerWork(tx.QueryRowContext(ctx, `
+		SELECT id, app, args, annotations, queued_at, runner, claimed_at FROM runner_queue
+		WHERE claimed_at IS NULL ORDER BY queued_at, id LIMIT 1`))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w.Runner, w.ClaimedAt = runner, time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `UPDATE runner_queue SET runner = ?, claimed_at = ? WHERE id = ?`,
+		w.Runner, w.ClaimedAt.Unix(), w.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE builds SET status = ? WHERE id = ? AND finished_at IS NULL`, BuildRunning, w.ID); err != nil {
+		return nil, err
+	}
+	return w, tx.Commit()
+}
+
+// Complete removes a claimed build from the queue and returns it, or nil if
+// it is not claimed (never was, or the reaper already failed it)
+func (h *BuildHistory) Complete(ctx context.Context, id string) (*RunnerWork, error) {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	w, err := scanRunnerWork(tx.QueryRowContext(ctx, `
+		SELECT id, app, args, annotations, queued_at, runner, claimed_at FROM runner_queue
+		WHERE id = ? AND claimed_at IS NOT NULL`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM runner_queue WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return w, tx.Commit()
+}
+
+// Expired returns builds claimed before cutoff
+func (h *BuildHistory) Expired(ctx context.Context, cutoff time.Time) ([]string, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT id FROM runner_queue WHERE claimed_at < ? ORDER BY claimed_at`, cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// QueueDepth counts unclaimed builds, for scaling the runner pool
+func (h *BuildHistory) QueueDepth(ctx context.Context) (int, error) {
+	var n int
+	err := h.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM runner_queue WHERE claimed_at IS NULL`).Scan(&n)
+	return n, err
+}
+
+func scanRunnerWork(row *sql.Row) (*RunnerWork, error) {
+	var w RunnerWork
+	var args, annotations string
+	var queuedAt int64
+	var claimedAt sql.NullInt64
+	if err := row.Scan(&w.ID, &w.App, &args, &annotations, &queuedAt, &w.Runner, &claimedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(args), &w.Args); err != nil {
+		return nil, fmt.Errorf("decoding args of %s: %w", w.ID, err)
+	}
+	if annotations != "" {
+		if err := json.Unmarshal([]byte(annotations), &w.Annotations); err != nil {
+			return nil, fmt.Errorf("decoding annotations of %s: %w", w.ID, err)
+		}
+	}
+	w.QueuedAt = time.Unix(queuedAt, 0).UTC()
+	if claimedAt.Valid {
+		w.ClaimedAt = time.Unix(claimedAt.Int64, 0).UTC()
+	}
+	return &w, nil
+}
+
+// enqueue records a build job's kaniko run for the runner pool instead of
+// creating the job
+func (s *Server) enqueue(ctx context.Context, job *batchv1.Job) (string, error) {
+	job.CreationTimestamp = metav1.Now()
+	work := &RunnerWork{
+		ID:          job.Name,
+		App:         job.Labels["app-name"],
+		Args:        runnerArgs(job),
+		Annotations: job.Annotations,
+		QueuedAt:    job.CreationTimestamp.UTC(),
+	}
+	if err := s.history.Enqueue(ctx, work); err != nil {
+		return "", err
+	}
+	if err := s.history.Record(ctx, recordFromJob(job)); err != nil {
+		log.Printf("Failed to record build %s: %v", job.Name, err)
+	}
+	log.Printf("Queued build %s for the runner pool", job.Name)
+	s.tracker.comments.Update(job.Name)
+	s.tracker.events.Status(job.Name, "", work.App, BuildPending)
+	return job.Name, nil
+}
+
+// handleRunner serves the runner pool:
+//
+//	POST /runner/claim?runner=<name>        next build, or 204 when idle
+//	POST /runner/builds/<id>/succeeded      report a result; the body is
+//	POST /runner/builds/<id>/failed         the tail of the build log
+//
+// A claimed build is returned as text/plain: the build ID on the first line,
+// then one kaniko argument per line, so busybox sh can run it.
+func (s *Server) handleRunner(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/runner"), "/")
+	if path == "claim" {
+		s.handleRunnerClaim(w, r)
+		return
+	}
+	rest, ok := strings.CutPrefix(path, "builds/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	id, result, ok := strings.Cut(rest, "/")
+	if !ok || (result != BuildSucceeded && result != BuildFailed) {
+		http.NotFound(w, r)
+		return
+	}
+	s.handleRunnerResult(w, r, id, result)
+}
+
+func (s *Server) handleRunnerClaim(w http.ResponseWriter, r *http.Request) {
+	runner := r.URL.Query().Get("runner")
+	if runner == "" {
+		http.Error(w, "Missing runner", http.StatusBadRequest)
+		return
+	}
+
+	work, err := s.history.Claim(r.Context(), runner)
+	if err != nil {
+		log.Printf("Failed to claim build for %s: %v", runner, err)
+		http.Error(w, "Failed to claim build", http.StatusInternalServerError)
+		return
+	}
+	if work == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Printf("Build %s claimed by %s", work.ID, runner)
+	s.tracker.comments.Update(work.ID)
+	s.tracker.events.Status(work.ID, "", work.App, BuildRunning)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, work.ID)
+	for _, arg := range work.Args {
+		fmt.Fprintln(w, arg)
+	}
+}
+
+func (s *Server) handleRunnerResult(w http.ResponseWriter, r *http.Request, id, status string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, runnerLogLimit))
+	if err != nil {
+		http.Error(w, "Failed to read log", http.StatusBadRequest)
+		return
+	}
+
+	work, err := s.history.Complete(r.Context(), id)
+	if err != nil {
+		log.Printf("Failed to complete build %s: %v", id, err)
+		http.Error(w, "Failed to complete build", http.StatusInternalServerError)
+		return
+	}
+	if work == nil {
+		http.Error(w, "Build is not claimed", http.StatusConflict)
+		return
+	}
+	s.finishRunnerWork(r.Context(), work, status, strings.TrimSpace(string(body)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishRunnerWork records a runner build's result through the tracker
+func (s *Server) finishRunnerWork(ctx context.Context, work *RunnerWork, status, excerpt string) {
+	rec, err := s.history.Get(ctx, work.ID)
+	if err != nil || rec == nil {
+		log.Printf("Failed to load build %s: %v", work.ID, err)
+		return
+	}
+	s.tracker.finish(ctx, work.job(), rec, status, work.ClaimedAt, time.Now().UTC(), excerpt, nil)
+}
+
+// reapRunners fails builds whose runner has not reported within the
+// configured timeout, e.g. because its pod was evicted mid-build
+func (s *Server) reapRunners(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		timeout := time.Duration(s.config().Runners.TimeoutSeconds) * time.Second
+		ids, err := s.history.Expired(ctx, time.Now().Add(-timeout))
+		if err != nil {
+			log.Printf("Failed to load expired runner builds: %v", err)
+			continue
+		}
+		for _, id := range ids {
+			work, err := s.history.Complete(ctx, id)
+			if err != nil || work == nil {
+				continue
+			}
+			log.Printf("Build %s timed out on runner %s", id, work.Runner)
+			s.finishRunnerWork(ctx, work, BuildFailed,
+				fmt.Sprintf("runner %s did not report a result within %s", work.Runner, timeout))
+		}
+	}
+}
+
+// runnerAuthenticators accept the runner pool's RUNNER_TOKEN
+func runnerAuthenticators(settings *Settings) []auth.Authenticator {
+	if token := settings.RunnerToken; token != "" {
+		return []auth.Authenticator{auth.NewTokenAuth("runner=" + token)}
+	}
+	return auth.AllowUnauthenticated(nil, settings.AllowUnauthenticated, "runner API")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestRunnerServer has runner mode on and a tracker for results
+func newTestRunnerServer(t *testing.T, files map[string]string) (*Server, *fake.Clientset) {
+	t.Helper()
+	cfg := newTestGitea(t, repoFiles(files))
+	cfg.Runners.Enabled = true
+	s, kube := newTestServer(t, cfg)
+	newTestTracker(t, s, nil)
+	return s, kube
+}
+
+func runnerRequest(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handleRunner(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func buildStatus(t *testing.T, s *Server, id string) *BuildRecord {
+	t.Helper()
+	rec, err := s.history.Get(context.Background(), id)
+	if err != nil || rec == nil {
+		t.Fatalf("history record of %s = %v, %v", id, rec, err)
+	}
+	return rec
+}
+
+func TestHandleWebhookQueuesRunnerBuild(t *testing.T) {
+	s, kube := newTestRunnerServer(t, nil)
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if jobs := listJobs(t, kube); len(jobs) != 0 {
+		t.Fatalf("created jobs %v for a runner build", jobs)
+	}
+	if depth, err := s.history.QueueDepth(context.Background()); err != nil || depth != 1 {
+		t.Fatalf("queue depth = %d, %v", depth, err)
+	}
+	if rec := buildStatus(t, s, "build-app-0123456"); rec.Status != BuildPending {
+		t.Fatalf("build = %s", rec.Status)
+	}
+}
+
+func TestHandleWebhookKeepsJobsForPipelines(t *testing.T) {
+	s, kube := newTestRunnerServer(t, map[string]string{
+		pipelineFile: "steps:\n- name: test\n  image: golang:1.21\n  run: go test ./...\n- name: build\n  build: {}\n",
+	})
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+	if jobs := listJobs(t, kube); len(jobs) != 1 {
+		t.Fatalf("jobs = %v, want the pipeline job", jobs)
+	}
+	if depth, _ := s.history.QueueDepth(context.Background()); depth != 0 {
+		t.Fatalf("queued %d builds", depth)
+	}
+}
+
+func TestRunnerClaimAndReport(t *testing.T) {
+	s, _ := newTestRunnerServer(t, nil)
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+
+	if w := runnerRequest(s, http.MethodPost, "/runner/claim", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("claim without a runner: status = %d", w.Code)
+	}
+
+	w = runnerRequest(s, http.MethodPost, "/runner/claim?runner=build-runner-0", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("claim: status = %d: %s", w.Code, w.Body)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if lines[0] != "build-app-0123456" {
+		t.Fatalf("claimed %q", lines[0])
+	}
+	args := strings.Join(lines[1:], " ")
+	for _, want := range []string{"--destination=registry.home.mcztest.com/app:0123456", "--cache-dir=" + kanikoCacheDir, "--cleanup"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args lack %s: %s", want, args)
+		}
+	}
+	if n := strings.Count(args, "--cache-dir="); n != 1 {
+		t.Errorf("%d cache dirs: %s", n, args)
+	}
+	if rec := buildStatus(t, s, "build-app-0123456"); rec.Status != BuildRunning {
+		t.Fatalf("claimed build = %s", rec.Status)
+	}
+
+	// The queue is empty until the next push
+	if w := runnerRequest(s, http.MethodPost, "/runner/claim?runner=build-runner-1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("idle claim: status = %d", w.Code)
+	}
+
+	w = runnerRequest(s, http.MethodPost, "/runner/builds/build-app-0123456/failed", "error building image: RUN make exited 2\n")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("report: status = %d: %s", w.Code, w.Body)
+	}
+	rec := buildStatus(t, s, "build-app-0123456")
+	if rec.Status != BuildFailed || rec.FinishedAt == nil || rec.LogExcerpt != "error building image: RUN make exited 2" {
+		t.Fatalf("build = %s %q", rec.Status, rec.LogExcerpt)
+	}
+
+	// A result for a build that is no longer claimed is refused
+	if w := runnerRequest(s, http.MethodPost, "/runner/builds/build-app-0123456/succeeded", ""); w.Code != http.StatusConflict {
+		t.Fatalf("repeated report: status = %d", w.Code)
+	}
+	if rec := buildStatus(t, s, "build-app-0123456"); rec.Status != BuildFailed {
+		t.Fatalf("repeated report changed the build to %s", rec.Status)
+	}
+}
+
+func TestRunnerReportsSuccess(t *testing.T) {
+	s, _ := newTestRunnerServer(t, nil)
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+	runnerRequest(s, http.MethodPost, "/runner/claim?runner=build-runner-0", "")
+
+	if w := runnerRequest(s, http.MethodPost, "/runner/builds/build-app-0123456/succeeded", "Pushed image"); w.Code != http.StatusNoContent {
+		t.Fatalf("report: status = %d: %s", w.Code, w.Body)
+	}
+	if rec := buildStatus(t, s, "build-app-0123456"); rec.Status != BuildSucceeded {
+		t.Fatalf("build = %s", rec.Status)
+	}
+	if depth, _ := s.history.QueueDepth(context.Background()); depth != 0 {
+		t.Fatalf("queue depth = %d", depth)
+	}
+}
+
+func TestHandleRunnerRoutes(t *testing.T) {
+	s, _ := newTestRunnerServer(t, nil)
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/runner/claim?runner=build-runner-0", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/runner/builds/build-app-0123456", http.StatusNotFound},
+		{http.MethodPost, "/runner/builds/build-app-0123456/cancelled", http.StatusNotFound},
+		{http.MethodPost, "/runner/builds/build-app-0123456/succeeded", http.StatusConflict},
+		{http.MethodPost, "/runner/status", http.StatusNotFound},
+	} {
+		if w := runnerRequest(s, tt.method, tt.path, ""); w.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func TestRunnerQueueExpiry(t *testing.T) {
+	s, _ := newTestRunnerServer(t, nil)
+	ctx := context.Background()
+	for _, id := range []string{"build-a-1111111", "build-b-2222222"} {
+		if err := s.history.Enqueue(ctx, &RunnerWork{ID: id, App: "a", Args: []string{"--no-push"}, QueuedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.history.Enqueue(ctx, &RunnerWork{ID: "build-a-1111111", QueuedAt: time.Now()}); err == nil {
+		t.Fatal("queued a build twice")
+	}
+
+	work, err := s.history.Claim(ctx, "build-runner-0")
+	if err != nil || work == nil || work.ID != "build-a-1111111" {
+		t.Fatalf("claimed %+v, %v", work, err)
+	}
+	// Only claimed builds time out
+	expired, err := s.history.Expired(ctx, time.Now().Add(time.Hour))
+	if err != nil || len(expired) != 1 || expired[0] != "build-a-1111111" {
+		t.Fatalf("expired = %v, %v", expired, err)
+	}
+	if expired, _ := s.history.Expired(ctx, time.Now().Add(-time.Hour)); len(expired) != 0 {
+		t.Fatalf("expired a fresh claim: %v", expired)
+	}
+}
+
+func TestRunnable(t *testing.T) {
+	plain := func() *batchv1.Job {
+		job := &batchv1.Job{}
+		job.Annotations = map[string]string{}
+		job.Spec.Template.Spec.Containers = []corev1.Container{{Name: "kaniko", Args: []string{"--destination=registry.home.mcztest.com/app:0123456"}}}
+		return job
+	}
+
+	tests := []struct {
+		name string
+		job  func() *batchv1.Job
+		opts BuildOptions
+		want bool
+	}{
+		{name: "plain build", job: plain, want: true},
+		{name: "clone", job: plain, opts: BuildOptions{Submodules: true}},
+		{name: "arch pinned", job: plain, opts: BuildOptions{Arch: "arm64"}},
+		{name: "other registry", job: func() *batchv1.Job {
+			job := plain()
+			job.Annotations[registryAnnotation] = "ghcr"
+			return job
+		}},
+		{name: "other cluster", job: func() *batchv1.Job {
+			job := plain()
+			job.Annotations[clusterAnnotation] = "edge"
+			return job
+		}},
+		{name: "registry certificates", job: func() *batchv1.Job {
+			job := plain()
+			job.Spec.Template.Spec.Volumes = []corev1.Volume{{Name: "registry-certs"}}
+			return job
+		}},
+		{name: "multi-line argument", job: func() *batchv1.Job {
+			job := plain()
+			job.Spec.Template.Spec.Containers[0].Args = append(job.Spec.Template.Spec.Containers[0].Args, "--build-arg=NOTES=a\nb")
+			return job
+		}},
+	}
+	for _, tt := range tests {
+		if got := runnable(tt.job(), tt.opts); got != tt.want {
+			t.Errorf("%s: runnable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
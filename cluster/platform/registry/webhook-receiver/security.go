@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SecurityProfile hardens build and chart pods. The zero value only turns
+// off the service account token, which no build container uses.
+type SecurityProfile struct {
+	// ServiceAccount runs build pods; it needs no RBAC (default: the
+	// namespace's default account)
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// AutomountToken mounts the service account token into build pods
+	AutomountToken bool `json:"automountToken,omitempty"`
+	// Seccomp is the pod seccomp profile: RuntimeDefault, Unconfined, or
+	// Localhost/<profile>
+	Seccomp string `json:"seccomp,omitempty"`
+	// DropCapabilities drops all capabilities and privilege escalation.
+	// Kaniko keeps the few it needs to unpack and chown image layers.
+	DropCapabilities bool `json:"dropCapabilities,omitempty"`
+	// RunAsUser runs every container except kaniko as this non-root UID;
+	// pipeline step images and cloneImage must work without root (clones of
+	// LFS repos need git-lfs in the image). 0 keeps each image's user.
+	RunAsUser int64 `json:"runAsUser,omitempty"`
+}
+
+// kanikoCapabilities are what kaniko needs as root to extract base image
+// layers with their owners and modes
+var kanikoCapabilities = []corev1.Capability{"CHOWN", "DAC_OVERRIDE", "FOWNER", "SETFCAP", "SETGID", "SETUID"}
+
+func (p SecurityProfile) validate() error {
+	switch kind, _, _ := strings.Cut(p.Seccomp, "/"); corev1.SeccompProfileType(kind) {
+	case "", corev1.SeccompProfileTypeRuntimeDefault, corev1.SeccompProfileTypeUnconfined:
+		if strings.Contains(p.Seccomp, "/") {
+			return fmt.Errorf("security: seccomp %q takes no profile path", p.Seccomp)
+		}
+	case corev1.SeccompProfileTypeLocalhost:
+		if !strings.Contains(p.Seccomp, "/") {
+			return fmt.Errorf("security: seccomp Localhost needs a profile, e.g. Localhost/profiles/kaniko.json")
+		}
+	default:
+		return fmt.Errorf("security: unknown seccomp profile %q", p.Seccomp)
+	}
+	if p.RunAsUser < 0 {
+		return fmt.Errorf("security: runAsUser must not be negative")
+	}
+	return nil
+}
+
+// harden applies the config's security profile to a job about to be
+// created, after every container has been added
+func harden(cfg *Config, job *batchv1.Job) {
+	p := cfg.Security
+	spec := &job.Spec.Template.Spec
+
+	automount := p.AutomountToken
+	spec.AutomountServiceAccountToken = &automount
+	spec.ServiceAccountName = p.ServiceAccount
+	if p.Seccomp != "" {
+		kind, profile, _ := strings.Cut(p.Seccomp, "/")
+		seccomp := &corev1.SeccompProfile{Type: corev1.SeccompProfileType(kind)}
+		if profile != "" {
+			seccomp.LocalhostProfile = &profile
+		}
+		spec.SecurityContext = &corev1.PodSecurityContext{SeccompProfile: seccomp}
+	}
+
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			hardenContainer(cfg, &containers[i])
+		}
+	}
+}
+
+func hardenContainer(cfg *Config, c *corev1.Container) {
+	p := cfg.Security
+	kaniko := c.Image == cfg.KanikoImage
+	sc := &corev1.SecurityContext{}
+
+	if p.DropCapabilities {
+		escalate := false
+		sc.AllowPrivilegeEscalation = &escalate
+		sc.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+		if kaniko {
+			sc.Capabilities.Add = kanikoCapabilities
+		}
+	}
+	if p.RunAsUser != 0 && !kaniko {
+		nonRoot := true
+		uid := p.RunAsUser
+		sc.RunAsUser = &uid
+		sc.RunAsNonRoot = &nonRoot
+		// Image home directories belong to root; git and helm write there
+		if !hasEnv(c, "HOME") {
+			c.Env = append(c.Env, corev1.EnvVar{Name: "HOME", Value: "/tmp"})
+		}
+	}
+
+	if sc.Capabilities != nil || sc.RunAsUser != nil {
+		c.SecurityContext = sc
+	}
+}
+
+func hasEnv(c *corev1.Container, name string) bool {
+	for _, e := range c.Env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Server holds the receiver's clients, stores, and configuration. Handlers
+// and build creation are its methods, so each takes its Kubernetes client
+// and settings from here rather than from package state and can run against
+// a fake clientset.
+type Server struct {
+	// cfg is the active config; handlers take one snapshot per request so
+	// a reload never changes settings mid-build
+	cfg     atomic.Pointer[Config]
+	kube    kubernetes.Interface
+	history *BuildHistory
+	deps    *DependencyScheduler
+	// tracker records results reported by the runner pool
+	tracker *BuildTracker
+	// archive and artifacts are nil unless S3_ENDPOINT is set
+	archive   *PayloadArchive
+	artifacts *ArtifactStore
+	// cacheDir is the mounted kaniko cache volume
+	cacheDir string
+	// clusters are where builds may be dispatched besides this cluster
+	clusters *Clusters
+	// operatorToken authenticates /deploy to the app-operator API
+	operatorToken string
+}
+
+// NewServer wires the dependency scheduler to start rebuilds through s
+func NewServer(kube kubernetes.Interface, history *BuildHistory, cfg *Config) *Server {
+	s := &Server{kube: kube, history: history}
+	s.cfg.Store(cfg)
+	s.deps = NewDependencyScheduler(history, s.config)
+	s.deps.start = s.startBuild
+	return s
+}
+
+// config returns the active config
+func (s *Server) config() *Config {
+	return s.cfg.Load()
+}
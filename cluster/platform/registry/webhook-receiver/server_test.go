@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testCommit = "0123456789abcdef0123456789abcdef01234567"
+
+// newTestServer runs a Server against a fake clientset and a fresh history
+// database
+func newTestServer(t *testing.T, cfg *Config) (*Server, *fake.Clientset) {
+	t.Helper()
+	history, err := OpenBuildHistory(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { history.Close() })
+	kube := fake.NewSimpleClientset()
+	return NewServer(kube, history, cfg), kube
+}
+
+// newTestTracker attaches a build tracker to s, with registry serving the
+// registry API; nil answers every request with 404
+func newTestTracker(t *testing.T, s *Server, registry http.HandlerFunc) *BuildTracker {
+	t.Helper()
+	if registry == nil {
+		registry = http.NotFound
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+	s.tracker = &BuildTracker{
+		kube:     s.kube,
+		config:   s.config,
+		history:  s.history,
+		registry: NewRegistryClient(srv.URL, ""),
+		deps:     s.deps,
+		events:   NewEventHub(),
+	}
+	return s.tracker
+}
+
+// newTestGitea serves handler as the internal Gitea host of a default
+// config; repo files it does not serve are missing
+func newTestGitea(t *testing.T, handler http.HandlerFunc) *Config {
+	t.Helper()
+	if handler == nil {
+		handler = http.NotFound
+	}
+	gitea := httptest.NewServer(handler)
+	t.Cleanup(gitea.Close)
+	cfg := defaultConfig()
+	cfg.GiteaInternalHost = strings.TrimPrefix(gitea.URL, "http://")
+	return cfg
+}
+
+// repoFiles serves the raw API for owner/app with the given files
+func repoFiles(files map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, "/api/v1/repos/owner/app/raw/")
+		content, found := files[name]
+		if !ok || !found {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, content)
+	}
+}
+
+func pushRequest(t *testing.T, ref, message string) *http.Request {
+	t.Helper()
+	var push GiteaWebhook
+	push.Ref = ref
+	push.Repository.Name = "app"
+	push.Repository.FullName = "owner/app"
+	push.Repository.CloneURL = "https://gitea.home.mcztest.com/owner/app.git"
+	push.HeadCommit.ID = testCommit
+	push.HeadCommit.Message = message
+	body, err := json.Marshal(push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(string(body)))
+	r.Header.Set("X-Gitea-Event", "push")
+	return r
+}
+
+func listJobs(t *testing.T, kube *fake.Clientset) []string {
+	t.Helper()
+	jobs, err := kube.BatchV1().Jobs(buildNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, j := range jobs.Items {
+		names = append(names, j.Name)
+	}
+	return names
+}
+
+func TestHandleWebhookCreatesBuildJob(t *testing.T) {
+	cfg := newTestGitea(t, nil)
+	s, kube := newTestServer(t, cfg)
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Fix the thing [build arg:VERSION=1.2]"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	job, err := kube.BatchV1().Jobs(buildNamespace).Get(context.Background(), "build-app-0123456", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Annotations[repoAnnotation] != "owner/app" || job.Annotations[commitAnnotation] != testCommit || job.Annotations[branchAnnotation] != "main" {
+		t.Fatalf("annotations = %v", job.Annotations)
+	}
+	args := strings.Join(job.Spec.Template.Spec.Containers[0].Args, " ")
+	for _, want := range []string{
+		"--context=git://http://" + cfg.GiteaInternalHost + "/owner/app.git#refs/heads/main",
+		"--destination=registry.home.mcztest.com/app:0123456",
+		"--build-arg=VERSION=1.2",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("kaniko args lack %s: %s", want, args)
+		}
+	}
+
+	rec, err := s.history.Get(context.Background(), job.Name)
+	if err != nil || rec == nil {
+		t.Fatalf("history record = %v, %v", rec, err)
+	}
+}
+
+func TestHandleWebhookPipelineJob(t *testing.T) {
+	cfg := newTestGitea(t, repoFiles(map[string]string{
+		pipelineFile: "steps:\n- name: test\n  image: golang:1.21\n  run: go test ./...\n- name: build\n  build: {}\n",
+	}))
+	s, kube := newTestServer(t, cfg)
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Add tests"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	job, err := kube.BatchV1().Jobs(buildNamespace).Get(context.Background(), "build-app-0123456", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPipelineJob(job) {
+		t.Fatalf("labels = %v, want a pipeline job", job.Labels)
+	}
+}
+
+func TestHandleWebhookIgnored(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func(t *testing.T) *http.Request
+		want    int
+	}{
+		{
+			name:    "unconfigured branch",
+			request: func(t *testing.T) *http.Request { return pushRequest(t, "refs/heads/feature", "Work") },
+			want:    http.StatusOK,
+		},
+		{
+			name:    "tag push",
+			request: func(t *testing.T) *http.Request { return pushRequest(t, "refs/tags/v1.0.0", "Release") },
+			want:    http.StatusOK,
+		},
+		{
+			name:    "skip directive",
+			request: func(t *testing.T) *http.Request { return pushRequest(t, "refs/heads/main", "Docs [skip ci]") },
+			want:    http.StatusOK,
+		},
+		{
+			name: "other event",
+			request: func(t *testing.T) *http.Request {
+				r := pushRequest(t, "refs/heads/main", "Work")
+				r.Header.Set("X-Gitea-Event", "create")
+				return r
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "not a POST",
+			request: func(t *testing.T) *http.Request { return httptest.NewRequest(http.MethodGet, "/webhook", nil) },
+			want:    http.StatusMethodNotAllowed,
+		},
+		{
+			name: "malformed payload",
+			request: func(t *testing.T) *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("{"))
+			},
+			want: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, kube := newTestServer(t, newTestGitea(t, nil))
+			w := httptest.NewRecorder()
+			s.handleWebhook(w, tt.request(t))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if jobs := listJobs(t, kube); len(jobs) != 0 {
+				t.Fatalf("created jobs %v", jobs)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookInvalidBuildFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{name: "empty pipeline", files: map[string]string{pipelineFile: "steps: []\n"}},
+		{name: "unknown pipeline field", files: map[string]string{pipelineFile: "stages: []\n"}},
+		{name: "bad image size action", files: map[string]string{buildFile: "imageSize:\n  max: 100Mi\n  action: explode\n"}},
+		{name: "matrix with pipeline", files: map[string]string{
+			pipelineFile: "steps:\n- name: build\n  build: {}\n",
+			buildFile:    "platforms: [amd64, arm64]\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, kube := newTestServer(t, newTestGitea(t, repoFiles(tt.files)))
+			w := httptest.NewRecorder()
+			s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want 422: %s", w.Code, w.Body)
+			}
+			if jobs := listJobs(t, kube); len(jobs) != 0 {
+				t.Fatalf("created jobs %v", jobs)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookQueuesFailedJobCreation(t *testing.T) {
+	s, kube := newTestServer(t, newTestGitea(t, nil))
+	kube.PrependReactor("create", "jobs", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("etcd is down")
+	})
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body)
+	}
+	letters, err := s.history.DeadLetters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Source.Commit != testCommit {
+		t.Fatalf("dead letters = %+v", letters)
+	}
+}
+
+func TestHandleWebhookQueuesGiteaFailure(t *testing.T) {
+	// Build files cannot be read while Gitea fails; the push is kept
+	cfg := newTestGitea(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database is locked", http.StatusInternalServerError)
+	})
+	s, kube := newTestServer(t, cfg)
+
+	w := httptest.NewRecorder()
+	s.handleWebhook(w, pushRequest(t, "refs/heads/main", "Work"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body)
+	}
+	if jobs := listJobs(t, kube); len(jobs) != 0 {
+		t.Fatalf("created jobs %v", jobs)
+	}
+	letters, err := s.history.DeadLetters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || !strings.Contains(letters[0].Error, "500") {
+		t.Fatalf("dead letters = %+v", letters)
+	}
+}
+
+func TestConfigReloadIsPerServer(t *testing.T) {
+	a, _ := newTestServer(t, defaultConfig())
+	b, _ := newTestServer(t, defaultConfig())
+
+	reloaded := defaultConfig()
+	reloaded.Branches = []string{"release/*"}
+	a.cfg.Store(reloaded)
+	if !a.config().BuildsBranch("release/1.0") {
+		t.Fatal("reloaded config not active")
+	}
+	if b.config().BuildsBranch("release/1.0") {
+		t.Fatal("reload leaked into another server")
+	}
+}
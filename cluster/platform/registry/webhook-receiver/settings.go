@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/homelab/internal/config"
+)
+
+// Settings are the receiver's process settings, fixed at startup: defaults,
+// then the -settings YAML file (SETTINGS_FILE), then the environment, then
+// flags. Build behaviour lives in Config, which is reloaded on change.
+type Settings struct {
+	Port string `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+	// TLSPort serves the same routes over HTTPS while TLSCertFile is set;
+	// the files are reread when the mounted Secret is renewed
+	TLSPort     string `json:"tlsPort" env:"TLS_PORT" flag:"tls-port" usage:"HTTPS listen port"`
+	TLSCertFile string `json:"tlsCertFile" env:"TLS_CERT_FILE" flag:"tls-cert" usage:"TLS certificate; unset disables HTTPS"`
+	TLSKeyFile  string `json:"tlsKeyFile" env:"TLS_KEY_FILE" flag:"tls-key" usage:"TLS private key"`
+	// ConfigFile is the hot-reloaded build config
+	ConfigFile string `json:"configFile" env:"CONFIG_FILE" flag:"config" usage:"build config file"`
+
+	HistoryDB            string `json:"historyDB" env:"HISTORY_DB" flag:"history-db" usage:"build history SQLite database"`
+	HistoryRetentionDays int    `json:"historyRetentionDays" env:"HISTORY_RETENTION_DAYS" flag:"history-retention-days" usage:"days builds and their artifacts are kept"`
+	RegistryURL          string `json:"registryURL" env:"REGISTRY_URL" flag:"registry-url" usage:"registry API for image sizes and manifest lists"`
+	RegistryAuthFile     string `json:"registryAuthFile" env:"REGISTRY_AUTH_FILE" flag:"registry-auth-file" usage:"docker config with the registry login"`
+	// CacheDir is the shared cache volume /cache reports on
+	CacheDir string `json:"cacheDir" env:"CACHE_DIR" flag:"cache-dir" usage:"mounted kaniko cache volume"`
+
+	// TracingEndpoint is an OTLP/HTTP collector base URL (e.g. Tempo on
+	// :4318), TracesEndpoint a full traces URL overriding it; tracing is
+	// off while both are empty
+	TracingEndpoint string `json:"tracingEndpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" flag:"otlp-endpoint" usage:"OTLP/HTTP collector URL; empty disables tracing"`
+	TracesEndpoint  string `json:"tracesEndpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT" flag:"otlp-traces-endpoint" usage:"OTLP/HTTP traces URL"`
+
+	// S3 enables the payload archive and artifact store when Endpoint is set
+	S3 S3Settings `json:"s3"`
+
+	// Credentials are only read from the environment
+	GiteaToken    string   `json:"-" env:"GITEA_TOKEN"`
+	WebhookSecret string   `json:"-" env:"WEBHOOK_SECRET"`
+	APITokens     string   `json:"-" env:"API_TOKENS"`
+	RunnerToken   string   `json:"-" env:"RUNNER_TOKEN"`
+	OperatorToken string   `json:"-" env:"OPERATOR_TOKEN"`
+	OIDCIssuer    string   `json:"oidcIssuer" env:"OIDC_ISSUER" flag:"oidc-issuer" usage:"OIDC issuer accepted on the API"`
+	OIDCAudience  string   `json:"oidcAudience" env:"OIDC_AUDIENCE" flag:"oidc-audience" usage:"required OIDC audience"`
+	OIDCGroups    []string `json:"oidcGroups" env:"OIDC_GROUPS" flag:"oidc-groups" usage:"OIDC groups allowed on the API, comma separated"`
+	// AllowUnauthenticated opens the webhook, API, and runner endpoints
+	// whose credentials are not set;
+	// otherwise those refuse every request
+	AllowUnauthenticated bool `json:"allowUnauthenticated" env:"ALLOW_UNAUTHENTICATED" flag:"allow-unauthenticated"`
+}
+
+type S3Settings struct {
+	Endpoint             string `json:"endpoint" env:"S3_ENDPOINT" flag:"s3-endpoint" usage:"S3 endpoint for payloads and artifacts"`
+	Region               string `json:"region" env:"S3_REGION" flag:"s3-region"`
+	AccessKey            string `json:"-" env:"S3_ACCESS_KEY"`
+	SecretKey            string `json:"-" env:"S3_SECRET_KEY"`
+	ArchiveBucket        string `json:"archiveBucket" env:"ARCHIVE_S3_BUCKET" flag:"archive-bucket"`
+	ArchiveRetentionDays int    `json:"archiveRetentionDays" env:"ARCHIVE_RETENTION_DAYS" flag:"archive-retention-days" usage:"days webhook payloads are kept"`
+	ArtifactsBucket      string `json:"artifactsBucket" env:"ARTIFACTS_S3_BUCKET" flag:"artifacts-bucket"`
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		Port:                 "8080",
+		TLSPort:              "8443",
+		ConfigFile:           "/etc/webhook-receiver/config.yaml",
+		HistoryDB:            "/data/builds.db",
+		HistoryRetentionDays: 90,
+		RegistryURL:          "https://docker-registry.container-registry.svc.cluster.local:5000",
+		CacheDir:             "/cache",
+		S3: S3Settings{
+			Region:               "us-east-1",
+			ArchiveBucket:        "webhook-payloads",
+			ArchiveRetentionDays: 30,
+			ArtifactsBucket:      "build-artifacts",
+		},
+	}
+}
+
+// loadSettings layers the file, environment, and flags over the defaults
+func loadSettings() (*Settings, error) {
+	s := defaultSettings()
+	if err := config.Load(s, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate implements config.Validator
+func (s *Settings) Validate() error {
+	if s.HistoryRetentionDays <= 0 {
+		return fmt.Errorf("history retention must be positive")
+	}
+	if s.S3.Endpoint != "" && s.S3.ArchiveRetentionDays <= 0 {
+		return fmt.Errorf("archive retention must be positive")
+	}
+	if s.TLSCertFile != "" && s.TLSKeyFile == "" {
+		return fmt.Errorf("TLS key file is required with a TLS certificate")
+	}
+	if s.RegistryURL == "" || s.ConfigFile == "" || s.HistoryDB == "" {
+		return fmt.Errorf("registry URL, config file, and history database are required")
+	}
+	return nil
+}
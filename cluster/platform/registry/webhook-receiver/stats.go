@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+)
+
+// metricsWindow is how much history the Prometheus gauges summarise
+const metricsWindow = 7 * 24 * time.Hour
+
+// BuildStats aggregates finished builds over a window
+type BuildStats struct {
+	Since time.Time  `json:"since"`
+	Until time.Time  `json:"until"`
+	Apps  []AppStats `json:"apps"`
+}
+
+// AppStats summarises one app's builds
+type AppStats struct {
+	App         string         `json:"app"`
+	Builds      int            `json:"builds"`
+	Succeeded   int            `json:"succeeded"`
+	Failed      int            `json:"failed"`
+	SuccessRate float64        `json:"successRate"`
+	Duration    DurationStats  `json:"durationSeconds"`
+	Daily       []DailyStats   `json:"daily"`
+	ImageSizes  []ImageSizeRef `json:"imageSizes,omitempty"`
+	// ImageSizeChange is the latest image size relative to the first in the
+	// window, e.g. 0.25 for 25% larger
+	ImageSizeChange float64 `json:"imageSizeChange,omitempty"`
+}
+
+// DurationStats describes build durations in seconds
+type DurationStats struct {
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	Max float64 `json:"max"`
+}
+
+// DailyStats is one day of an app's success rate trend
+type DailyStats struct {
+	Date        string  `json:"date"`
+	Builds      int     `json:"builds"`
+	Succeeded   int     `json:"succeeded"`
+	SuccessRate float64 `json:"successRate"`
+}
+
+// ImageSizeRef is the pushed image size for one successful build
+type ImageSizeRef struct {
+	Tag       string    `json:"tag"`
+	Size      int64     `json:"sizeBytes"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// aggregateBuilds groups builds (oldest first) by app
+func aggregateBuilds(builds []BuildRecord, since, until time.Time) *BuildStats {
+	byApp := make(map[string][]BuildRecord)
+	for _, b := range builds {
+		byApp[b.App] = append(byApp[b.App], b)
+	}
+
+	stats := &BuildStats{Since: since, Until: until, Apps: []AppStats{}}
+	for app, records := range byApp {
+		stats.Apps = append(stats.Apps, appStats(app, records))
+	}
+	sort.Slice(stats.Apps, func(i, j int) bool { return stats.Apps[i].App < stats.Apps[j].App })
+	return stats
+}
+
+func appStats(app string, builds []BuildRecord) AppStats {
+	s := AppStats{App: app, Builds: len(builds)}
+
+	var durations []float64
+	var days []string
+	daily := make(map[string]*DailyStats)
+	for _, b := range builds {
+		day := b.CreatedAt.UTC().Format("2006-01-02")
+		d, ok := daily[day]
+		if !ok {
+			d = &DailyStats{Date: day}
+			daily[day] = d
+			days = append(days, day)
+		}
+		d.Builds++
+
+		switch b.Status {
+		case BuildSucceeded:
+			s.Succeeded++
+			d.Succeeded++
+			if b.ImageSize > 0 {
+				s.ImageSizes = append(s.ImageSizes, ImageSizeRef{Tag: b.Tag, Size: b.ImageSize, CreatedAt: b.CreatedAt})
+			}
+		case BuildFailed:
+			s.Failed++
+		}
+		durations = append(durations, b.Duration)
+	}
+
+	s.SuccessRate = ratio(s.Succeeded, s.Builds)
+	s.Duration = durationStats(durations)
+	for _, day := range days {
+		d := daily[day]
+		d.SuccessRate = ratio(d.Succeeded, d.Builds)
+		s.Daily = append(s.Daily, *d)
+	}
+	if n := len(s.ImageSizes); n > 1 {
+		first, last := s.ImageSizes[0].Size, s.ImageSizes[n-1].Size
+		s.ImageSizeChange = math.Round(float64(last-first)/float64(first)*1000) / 1000
+	}
+	return s
+}
+
+func durationStats(durations []float64) DurationStats {
+	if len(durations) == 0 {
+		return DurationStats{}
+	}
+	sort.Float64s(durations)
+
+	var total float64
+	for _, d := range durations {
+		total += d
+	}
+	return DurationStats{
+		Avg: math.Round(total/float64(len(durations))*10) / 10,
+		P50: percentile(durations, 0.50),
+		P90: percentile(durations, 0.90),
+		P95: percentile(durations, 0.95),
+		Max: durations[len(durations)-1],
+	}
+}
+
+// percentile uses the nearest-rank method on sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)/float64(total)*1000) / 1000
+}
+
+// handleBuildStats serves aggregated build statistics:
+//
+//	GET /api/v1/stats/builds?app=<name>&days=<n>
+func (s *Server) handleBuildStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	until := time.Now().UTC()
+	since := until.Add(-time.Duration(days) * 24 * time.Hour)
+	builds, err := s.history.Since(r.Context(), r.URL.Query().Get("app"), since)
+	if err != nil {
+		log.Printf("Failed to load build stats: %v", err)
+		http.Error(w, "Failed to load build stats", http.StatusInternalServerError)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, aggregateBuilds(builds, since, until))
+}
+
+// httpMetrics counts requests to every instrumented route
+var httpMetrics = httpkit.NewMetrics("webhook_receiver")
+
+// handleMetrics exposes build stats over metricsWindow as Prometheus gauges,
+// followed by the HTTP request counters
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	until := time.Now().UTC()
+	since := until.Add(-metricsWindow)
+	builds, err := s.history.Since(r.Context(), "", since)
+	if err != nil {
+		log.Printf("Failed to load build stats: %v", err)
+		http.Error(w, "Failed to load build stats", http.StatusInternalServerError)
+		return
+	}
+	stats := aggregateBuilds(builds, since, until)
+
+	var b strings.Builder
+	gauge := func(name, help string, value func(AppStats, func(labels string, v float64))) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, app := range stats.Apps {
+			value(app, func(labels string, v float64) {
+				fmt.Fprintf(&b, "%s{app=%q%s} %g\n", name, app.App, labels, v)
+			})
+		}
+	}
+
+	gauge("webhook_receiver_builds", "Finished builds in the last 7 days by result.", func(a AppStats, emit func(string, float64)) {
+		emit(`,status="succeeded"`, float64(a.Succeeded))
+		emit(`,status="failed"`, float64(a.Failed))
+	})
+	gauge("webhook_receiver_build_success_ratio", "Fraction of builds in the last 7 days that succeeded.", func(a AppStats, emit func(string, float64)) {
+		emit("", a.SuccessRate)
+	})
+	gauge("webhook_receiver_build_duration_seconds", "Build duration quantiles over the last 7 days.", func(a AppStats, emit func(string, float64)) {
+		emit(`,quantile="0.5"`, a.Duration.P50)
+		emit(`,quantile="0.9"`, a.Duration.P90)
+		emit(`,quantile="0.95"`, a.Duration.P95)
+	})
+	gauge("webhook_receiver_build_duration_avg_seconds", "Mean build duration over the last 7 days.", func(a AppStats, emit func(string, float64)) {
+		emit("", a.Duration.Avg)
+	})
+	gauge("webhook_receiver_image_size_bytes", "Compressed size of the most recently pushed image.", func(a AppStats, emit func(string, float64)) {
+		if n := len(a.ImageSizes); n > 0 {
+			emit("", float64(a.ImageSizes[n-1].Size))
+		}
+	})
+
+	if depth, err := s.history.QueueDepth(r.Context()); err != nil {
+		log.Printf("Failed to load runner queue depth: %v", err)
+	} else {
+		fmt.Fprintf(&b, "# HELP webhook_receiver_runner_queue_depth Builds waiting for a runner.\n# TYPE webhook_receiver_runner_queue_depth gauge\nwebhook_receiver_runner_queue_depth %d\n", depth)
+	}
+
+	if counts, err := s.history.DeadLetterCounts(r.Context()); err != nil {
+		log.Printf("Failed to count dead letters: %v", err)
+	} else {
+		b.WriteString("# HELP webhook_receiver_dead_letters Builds that failed to start, by retry status.\n# TYPE webhook_receiver_dead_letters gauge\n")
+		for _, status := range []string{DeadLetterRetrying, DeadLetterExhausted} {
+			fmt.Fprintf(&b, "webhook_receiver_dead_letters{status=%q} %d\n", status, counts[status])
+		}
+	}
+
+	httpMetrics.Write(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
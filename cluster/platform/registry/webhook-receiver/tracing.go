@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/rest"
+)
+
+// traceAnnotation carries the webhook's trace context onto the build Job so
+// the job lifecycle span joins the push -> job -> registry push trace
+const traceAnnotation = "homelab.mcztest.com/traceparent"
+
+var tracer = otel.Tracer("github.com/homelab/webhook-receiver")
+
+// initTracing exports spans over OTLP/HTTP when a collector is configured
+// (e.g. Tempo or Jaeger on :4318); otherwise tracing is a no-op.
+func initTracing(ctx context.Context, settings *Settings) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	opts, err := exporterOptions(settings.TracingEndpoint, settings.TracesEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithAttributes(attribute.String("service.name", "webhook-receiver")),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	log.Printf("Tracing enabled, exporting via OTLP")
+	return provider.Shutdown, nil
+}
+
+// exporterOptions points the exporter at traces, or at endpoint's
+// /v1/traces; nil means neither is set
+func exporterOptions(endpoint, traces string) ([]otlptracehttp.Option, error) {
+	raw := traces
+	if raw == "" {
+		if endpoint == "" {
+			return nil, nil
+		}
+		raw = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", raw)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host), otlptracehttp.WithURLPath(u.Path)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	return opts, nil
+}
+
+// traceKubeClient records Kubernetes API calls made within a traced request.
+// Informer list/watch traffic has no parent span and is left untraced.
+func traceKubeClient(config *rest.Config) {
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return otelhttp.NewTransport(rt,
+			otelhttp.WithFilter(func(r *http.Request) bool {
+				return trace.SpanFromContext(r.Context()).SpanContext().IsValid()
+			}),
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return "k8s " + r.Method + " " + r.URL.Path
+			}),
+		)
+	})
+}
+
+// injectTraceContext stores the current span context in the job annotations
+func injectTraceContext(ctx context.Context, annotations map[string]string) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if tp := carrier.Get("traceparent"); tp != "" {
+		annotations[traceAnnotation] = tp
+	}
+}
+
+// recordJobSpan emits a span covering the build job, parented to the webhook
+// request that created it
+func recordJobSpan(rec *BuildRecord, traceparent, status string, started, finished time.Time) {
+	if traceparent == "" {
+		return
+	}
+	parent := otel.GetTextMapPropagator().Extract(context.Background(),
+		propagation.MapCarrier{"traceparent": traceparent})
+
+	_, span := tracer.Start(parent, "build job",
+		trace.WithTimestamp(rec.CreatedAt),
+		trace.WithAttributes(
+			attribute.String("build.job", rec.ID),
+			attribute.String("build.app", rec.App),
+			attribute.String("build.repo", rec.Repo),
+			attribute.String("build.commit", rec.Commit),
+			attribute.String("build.image", rec.Image),
+			attribute.String("build.status", status),
+		))
+
+	if !started.IsZero() {
+		span.AddEvent("pod started", trace.WithTimestamp(started))
+	}
+	if status == BuildSucceeded {
+		span.AddEvent("image pushed", trace.WithTimestamp(finished),
+			trace.WithAttributes(attribute.String("registry.image", rec.Image)))
+	} else {
+		span.SetStatus(codes.Error, "build failed")
+	}
+	span.End(trace.WithTimestamp(finished))
+}
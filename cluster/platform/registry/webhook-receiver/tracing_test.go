@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestExporterOptions(t *testing.T) {
+	tests := []struct {
+		name, endpoint, traces string
+		want                   int
+		wantErr                bool
+	}{
+		{name: "disabled", want: 0},
+		{name: "collector", endpoint: "http://tempo.monitoring:4318", want: 3},
+		{name: "https collector", endpoint: "https://tempo.monitoring:4318/", want: 2},
+		{name: "traces URL wins", endpoint: "not a url", traces: "http://jaeger:4318/v1/traces", want: 3},
+		{name: "no scheme", endpoint: "tempo.monitoring:4318", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := exporterOptions(tt.endpoint, tt.traces)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			if len(opts) != tt.want {
+				t.Fatalf("got %d options, want %d", len(opts), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	buildNamespace = "container-registry"
+
+	repoAnnotation   = "homelab.mcztest.com/repo"
+	commitAnnotation = "homelab.mcztest.com/commit"
+	branchAnnotation = "homelab.mcztest.com/branch"
+
+	// logExcerptLines is how much of the kaniko log is kept per build
+	logExcerptLines = 50
+)
+
+// BuildTracker follows build Jobs and writes their lifecycle to history
+type BuildTracker struct {
+	kube     kubernetes.Interface
+	config   func() *Config
+	history  *BuildHistory
+	registry *RegistryClient
+	deps     *DependencyScheduler
+	comments *PRCommenter
+	// events streams lifecycle and progress to /builds/events
+	events *EventHub
+}
+
+// forCluster returns a tracker for another cluster's build jobs, sharing
+// this one's history, scheduler, and subscribers
+func (t *BuildTracker) forCluster(kube kubernetes.Interface) *BuildTracker {
+	remote := *t
+	remote.kube = kube
+	return &remote
+}
+
+// Run watches build jobs until ctx is cancelled
+func (t *BuildTracker) Run(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(t.kube, 10*time.Minute,
+		informers.WithNamespace(buildNamespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = "app=build-job"
+		}))
+
+	informer := factory.Batch().V1().Jobs().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { t.observe(ctx, obj.(*batchv1.Job)) },
+		UpdateFunc: func(_, obj interface{}) { t.observe(ctx, obj.(*batchv1.Job)) },
+	})
+
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+}
+
+// observe records the job and its result once it finishes
+func (t *BuildTracker) observe(ctx context.Context, job *batchv1.Job) {
+	// Matrix jobs report into the build record shared by their variants
+	if job.Annotations[matrixAnnotation] != "" {
+		t.observeVariant(ctx, job)
+		return
+	}
+
+	rec := recordFromJob(job)
+	if err := t.history.Record(ctx, rec); err != nil {
+		log.Printf("Failed to record build %s: %v", job.Name, err)
+		return
+	}
+
+	status, finishedAt := jobResult(job)
+	switch status {
+	case BuildSucceeded, BuildFailed:
+		finished, err := t.history.Finished(ctx, job.Name)
+		if err != nil || finished {
+			return
+		}
+		excerpt, steps := t.podSummary(ctx, job)
+		var started time.Time
+		if job.Status.StartTime != nil {
+			started = job.Status.StartTime.Time
+		}
+		t.finish(ctx, job, rec, status, started, finishedAt, excerpt, steps)
+	case BuildRunning:
+		if err := t.history.SetStatus(ctx, job.Name, status); err != nil {
+			log.Printf("Failed to update build %s: %v", job.Name, err)
+		}
+		t.comments.Update(job.Name)
+		if t.events.Status(job.Name, "", rec.App, status) {
+			go t.followProgress(ctx, job, job.Name, "")
+		}
+	case BuildPending:
+		t.comments.Update(job.Name)
+		t.events.Status(job.Name, "", rec.App, status)
+	}
+}
+
+// finish records a build's result after checking its image against the
+// size budget, then advances or drops dependent rebuilds. Builds run by the
+// runner pool pass a job that was never created, carrying the annotations.
+func (t *BuildTracker) finish(ctx context.Context, job *batchv1.Job, rec *BuildRecord, status string, started, finishedAt time.Time, excerpt string, steps []StepStatus) {
+	var size int64
+	var digest string
+	// Images on other registries are not inspected, sized, or attested
+	if status == BuildSucceeded && rec.Image != "" && job.Annotations[registryAnnotation] == "" {
+		var msg string
+		digest, size, msg, status = t.checkImage(ctx, job, rec)
+		if msg != "" {
+			excerpt = msg + "\n\n" + excerpt
+		}
+	}
+	if err := t.history.Finish(ctx, job.Name, status, finishedAt, excerpt, steps); err != nil {
+		log.Printf("Failed to record result for %s: %v", job.Name, err)
+		return
+	}
+	if size > 0 {
+		if err := t.history.SetImageSize(ctx, job.Name, size); err != nil {
+			log.Printf("Failed to record image size for %s: %v", job.Name, err)
+		}
+	}
+
+	recordJobSpan(rec, job.Annotations[traceAnnotation], status, started, finishedAt)
+	log.Printf("Build %s %s", job.Name, status)
+	t.comments.Update(job.Name)
+	t.events.Status(job.Name, "", rec.App, status)
+
+	if status == BuildSucceeded {
+		if digest != "" {
+			t.attest(ctx, job, rec, digest, started, finishedAt)
+		}
+		t.deps.Succeeded(ctx, job, rec)
+	} else {
+		t.deps.Failed(rec.App)
+	}
+}
+
+func recordFromJob(job *batchv1.Job) *BuildRecord {
+	app := job.Labels["app-name"]
+	tag := strings.TrimPrefix(job.Name, "build-"+app+"-")
+
+	image := ""
+	for _, c := range job.Spec.Template.Spec.Containers {
+		for _, arg := range c.Args {
+			// The first destination is the commit tag; later ones are aliases
+			if strings.HasPrefix(arg, "--destination=") && image == "" {
+				image = strings.TrimPrefix(arg, "--destination=")
+			}
+		}
+	}
+
+	return &BuildRecord{
+		ID:        job.Name,
+		App:       app,
+		Repo:      job.Annotations[repoAnnotation],
+		Commit:    job.Annotations[commitAnnotation],
+		Branch:    job.Annotations[branchAnnotation],
+		Tag:       tag,
+		Image:     image,
+		Status:    BuildPending,
+		CreatedAt: job.CreationTimestamp.Time,
+	}
+}
+
+// checkImage reads the pushed image's digest and compressed size, for
+// provenance and size trends, and enforces the job's .build.yaml size
+// budget. An image over a failing budget is deleted from the registry so it
+// cannot be deployed.
+func (t *BuildTracker) checkImage(ctx context.Context, job *batchv1.Job, rec *BuildRecord) (string, int64, string, string) {
+	repo, tag := splitImage(rec.Image)
+	digest, size, err := t.registry.ImageSize(ctx, repo, tag)
+	if err != nil {
+		log.Printf("Failed to get image size for %s: %v", rec.Image, err)
+		return "", 0, "", BuildSucceeded
+	}
+
+	msg, fail := checkSizeBudget(job.Annotations, rec.Image, size)
+	if msg == "" {
+		return digest, size, "", BuildSucceeded
+	}
+	log.Printf("Build %s: %s", job.Name, msg)
+	if !fail {
+		return digest, size, msg, BuildSucceeded
+	}
+
+	if digest == "" {
+		log.Printf("Not deleting over-budget image %s: registry returned no digest", rec.Image)
+	} else if err := t.registry.DeleteManifest(ctx, repo, digest); err != nil {
+		log.Printf("Failed to delete over-budget image %s: %v", rec.Image, err)
+	}
+	return "", size, msg, BuildFailed
+}
+
+// jobResult maps Job status onto a build status
+func jobResult(job *batchv1.Job) (string, time.Time) {
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch cond.Type {
+		case batchv1.JobComplete:
+			return BuildSucceeded, cond.LastTransitionTime.Time
+		case batchv1.JobFailed:
+			return BuildFailed, cond.LastTransitionTime.Time
+		}
+	}
+	if job.Status.Active > 0 {
+		return BuildRunning, time.Time{}
+	}
+	return BuildPending, time.Time{}
+}
+
+// latestPod returns the job's most recent pod, or nil
+func latestPod(ctx context.Context, kube kubernetes.Interface, job *batchv1.Job) *corev1.Pod {
+	pods, err := kube.CoreV1().Pods(job.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "job-name=" + job.Name,
+	})
+	if err != nil || len(pods.Items) == 0 {
+		return nil
+	}
+
+	latest := &pods.Items[0]
+	for i := range pods.Items[1:] {
+		if p := &pods.Items[i+1]; p.CreationTimestamp.After(latest.CreationTimestamp.Time) {
+			latest = p
+		}
+	}
+	return latest
+}
+
+// podSummary returns the log tail of the kaniko container (or the failed
+// pipeline step) and, for pipelines, the per-step results
+func (t *BuildTracker) podSummary(ctx context.Context, job *batchv1.Job) (string, []StepStatus) {
+	pod := latestPod(ctx, t.kube, job)
+	if pod == nil {
+		return "", nil
+	}
+
+	container := "kaniko"
+	var steps []StepStatus
+	if isPipelineJob(job) {
+		steps = stepStatuses(pod)
+		container = failedContainer(pod)
+		if container == "" {
+			container = pod.Spec.Containers[0].Name
+		}
+	} else if failed := failedContainer(pod); failed != "" {
+		// A clone, stage export, or artifact upload failed before kaniko ran
+		container = failed
+	}
+
+	lines := int64(logExcerptLines)
+	stream, err := t.kube.CoreV1().Pods(job.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: container,
+		TailLines: &lines,
+	}).Stream(ctx)
+	if err != nil {
+		return fmt.Sprintf("(logs unavailable: %v)", err), steps
+	}
+	defer stream.Close()
+
+	data, err := io.ReadAll(io.LimitReader(stream, 16*1024))
+	if err != nil {
+		return "", steps
+	}
+	return string(data), steps
+}
+
+// pruneHistory deletes old records every hour
+func pruneHistory(ctx context.Context, history *BuildHistory, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		n, err := history.Prune(ctx, retention)
+		if err != nil {
+			log.Printf("Failed to prune build history: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d builds older than %s", n, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
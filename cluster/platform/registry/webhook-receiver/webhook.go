@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GiteaWebhook represents the webhook payload from Gitea
+type GiteaWebhook struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		Owner    struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+	HeadCommit struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	} `json:"head_commit"`
+}
+
+// maxPayloadSize caps the webhook body read and archived
+const maxPayloadSize = 5 << 20
+
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
+	if err != nil {
+		log.Printf("Failed to read webhook: %v", err)
+		http.Error(w, "Failed to read payload", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if s.archive != nil {
+		// Archived in the background so slow storage cannot time out Gitea
+		header := r.Header.Clone()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := s.archive.Store(ctx, header, body); err != nil {
+				log.Printf("Failed to archive webhook %s: %v", header.Get("X-Gitea-Delivery"), err)
+			}
+		}()
+	}
+
+	// Releases publish the repo's Helm chart
+	if r.Header.Get("X-Gitea-Event") == "release" {
+		s.handleRelease(w, r, s.config())
+		return
+	}
+
+	// Issue and pull request comments may carry ChatOps commands
+	if r.Header.Get("X-Gitea-Event") == "issue_comment" {
+		s.handleIssueComment(w, r, s.config())
+		return
+	}
+
+	// Org-level hooks may be subscribed to more than pushes
+	if event := r.Header.Get("X-Gitea-Event"); event != "" && event != "push" {
+		log.Printf("Ignoring %s event", event)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Ignoring %s event", event)
+		return
+	}
+
+	var webhook GiteaWebhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		log.Printf("Failed to decode webhook: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	// Snapshot config so a reload mid-request cannot mix settings
+	cfg := s.config()
+
+	// Only build on pushes to configured branches
+	branch, isBranch := strings.CutPrefix(webhook.Ref, "refs/heads/")
+	if !isBranch || !cfg.BuildsBranch(branch) {
+		log.Printf("Ignoring webhook for ref: %s", webhook.Ref)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Ignoring branch %s", webhook.Ref)
+		return
+	}
+
+	fullName := webhook.Repository.FullName
+	if fullName == "" {
+		fullName = webhook.Repository.Owner.Login + "/" + webhook.Repository.Name
+	}
+	if !cfg.Repos.Allowed(fullName) {
+		log.Printf("Ignoring webhook for filtered repo: %s", fullName)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Repository %s is not enabled for builds", fullName)
+		return
+	}
+
+	// Branch deletions carry no head commit
+	if len(webhook.HeadCommit.ID) < 7 {
+		log.Printf("Ignoring webhook without head commit for %s", fullName)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "No commit to build")
+		return
+	}
+
+	opts, warnings := parseDirectives(webhook.HeadCommit.Message)
+	for _, warning := range warnings {
+		log.Printf("Commit %s: %s", webhook.HeadCommit.ID[:7], warning)
+	}
+	if opts.Skip {
+		log.Printf("Skipping build for %s@%s: [skip ci]", fullName, webhook.HeadCommit.ID[:7])
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Build skipped by commit message")
+		return
+	}
+
+	appName := webhook.Repository.Name
+	commitSHA := webhook.HeadCommit.ID[:7] // Short SHA
+	imageTag := commitSHA
+
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("build.repo", fullName),
+		attribute.String("build.commit", webhook.HeadCommit.ID),
+		attribute.String("build.app", appName),
+	)
+
+	// Use internal Gitea URL
+	gitURL := strings.Replace(webhook.Repository.CloneURL, "https://", "http://", 1)
+	gitURL = strings.Replace(gitURL, cfg.GiteaHost, cfg.GiteaInternalHost, 1)
+
+	log.Printf("Triggering build for %s:%s (git: %s)", appName, imageTag, gitURL)
+
+	// Create Kubernetes Job
+	ctx, span := tracer.Start(r.Context(), "create build job")
+	defer span.End()
+
+	settings := cfg.SettingsFor(fullName)
+	opts.Submodules = settings.Submodules
+	opts.LFS = settings.LFS
+
+	src := BuildSource{
+		App:    appName,
+		GitURL: gitURL,
+		Branch: branch,
+		Commit: webhook.HeadCommit.ID,
+		Tag:    imageTag,
+	}
+
+	buildID, err := s.startBuild(ctx, cfg, fullName, src, opts, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "job creation failed")
+		log.Printf("Failed to create build job for %s@%s: %v", fullName, commitSHA, err)
+		var invalid *invalidBuildError
+		if errors.As(err, &invalid) {
+			http.Error(w, "Invalid build configuration: "+invalid.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		var denied *policyDeniedError
+		if errors.As(err, &denied) {
+			http.Error(w, "Build "+denied.Error(), http.StatusForbidden)
+			return
+		}
+		// Keep the push rather than lose it while e.g. the API server is down
+		if retryable(err) {
+			qerr := s.deadLetter(ctx, cfg, fullName, src, opts, err)
+			if qerr == nil {
+				w.WriteHeader(http.StatusAccepted)
+				fmt.Fprintf(w, "Build for %s:%s queued for retry", appName, imageTag)
+				return
+			}
+			log.Printf("Failed to queue build for %s@%s for retry: %v", fullName, commitSHA, qerr)
+		}
+		http.Error(w, "Failed to create build job", http.StatusInternalServerError)
+		return
+	}
+	span.SetAttributes(attribute.String("build.job", buildID))
+
+	log.Printf("Build job created successfully for %s:%s", appName, imageTag)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Build job created for %s:%s", appName, imageTag)
+}
+
+// invalidBuildError is a problem with the repo's build files, reported back
+// to the pusher rather than treated as a server error
+type invalidBuildError struct {
+	err error
+}
+
+func (e *invalidBuildError) Error() string { return e.err.Error() }
+
+// startBuild loads the commit's .pipeline.yaml and .build.yaml, records its
+// declared dependencies and creates the build job, or one job per variant for
+// a matrix or multi-arch build. Extra annotations are added to the jobs, e.g. for
+// dependency-triggered builds. It returns the build ID.
+func (s *Server) startBuild(ctx context.Context, cfg *Config, fullName string, src BuildSource, opts BuildOptions, extra map[string]string) (string, error) {
+	pipeline, err := fetchPipeline(ctx, cfg, fullName, src.Commit)
+	if err != nil {
+		return "", fmt.Errorf("loading pipeline: %w", err)
+	}
+	build, err := fetchBuildFile(ctx, cfg, fullName, src.Commit)
+	if err != nil {
+		return "", fmt.Errorf("loading build settings: %w", err)
+	}
+	matrix := build != nil && (len(build.Matrix) > 0 || len(build.Platforms) > 0)
+	if matrix && pipeline != nil {
+		return "", &invalidBuildError{fmt.Errorf("%s matrix and platforms cannot be combined with %s", buildFile, pipelineFile)}
+	}
+	var collect []Artifact
+	if build != nil {
+		collect = build.Artifacts
+	}
+	for _, a := range collect {
+		if a.Stage != "" && pipeline != nil {
+			return "", &invalidBuildError{fmt.Errorf("%s: artifact %s: stage is not supported with %s; write it to the workspace from a step", buildFile, a.Name, pipelineFile)}
+		}
+	}
+	if len(collect) > 0 {
+		// Artifacts are read from a cloned workspace
+		opts.Workspace = true
+	}
+
+	var dependsOn []string
+	if build != nil {
+		dependsOn = build.DependsOn
+	}
+	if err := s.history.SetDependencies(ctx, AppSource{App: src.App, Repo: fullName, GitURL: src.GitURL, Branch: src.Branch}, dependsOn); err != nil {
+		var cycle *cycleError
+		if errors.As(err, &cycle) {
+			return "", &invalidBuildError{fmt.Errorf("%s: %w", buildFile, err)}
+		}
+		return "", fmt.Errorf("recording dependencies: %w", err)
+	}
+	dependents, err := s.history.Dependents(ctx, src.App)
+	if err != nil {
+		return "", fmt.Errorf("loading dependents: %w", err)
+	}
+	src.PushLatest = len(dependents) > 0
+	if src.Registry, err = cfg.destinationFor(fullName, build); err != nil {
+		return "", &invalidBuildError{err}
+	}
+
+	annotations := map[string]string{
+		repoAnnotation:   fullName,
+		commitAnnotation: src.Commit,
+		branchAnnotation: src.Branch,
+	}
+	for k, v := range extra {
+		annotations[k] = v
+	}
+	if src.Registry != "" {
+		annotations[registryAnnotation] = src.Registry
+	}
+	build.annotate(annotations)
+	classifyBuild(ctx, cfg, fullName, build, annotations)
+	if isGoModule(ctx, cfg, fullName, src.Commit) {
+		annotations[goCacheAnnotation] = "true"
+	}
+	injectTraceContext(ctx, annotations)
+
+	if matrix {
+		return s.startMatrixBuild(ctx, cfg, fullName, src, opts, build, annotations)
+	}
+
+	job := createBuildJob(cfg, src, opts)
+	if pipeline != nil {
+		log.Printf("Running %d-step pipeline for %s:%s", len(pipeline.Steps), src.App, src.Tag)
+		job = createPipelineJob(cfg, src, pipeline, opts)
+	}
+	job.Annotations = annotations
+	if len(collect) > 0 {
+		addArtifacts(cfg, job, src, opts, collect)
+	}
+	placeBuild(cfg, job)
+	addDestination(cfg, job)
+	kube := s.dispatch(ctx, cfg, job, opts)
+	s.addGoCache(ctx, cfg, job, opts)
+
+	if err := admit(ctx, cfg, job); err != nil {
+		return "", err
+	}
+	if cfg.Runners.Enabled && pipeline == nil && runnable(job, opts) {
+		return s.enqueue(ctx, job)
+	}
+
+	harden(cfg, job)
+	created, err := kube.BatchV1().Jobs(buildNamespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	if err := createDockerConfig(ctx, kube, created); err != nil {
+		propagation := metav1.DeletePropagationBackground
+		if derr := kube.BatchV1().Jobs(buildNamespace).Delete(ctx, created.Name, metav1.DeleteOptions{PropagationPolicy: &propagation}); derr != nil {
+			log.Printf("Failed to delete job %s: %v", created.Name, derr)
+		}
+		return "", fmt.Errorf("writing push credentials: %w", err)
+	}
+	if err := s.history.Record(ctx, recordFromJob(created)); err != nil {
+		log.Printf("Failed to record build %s: %v", created.Name, err)
+	}
+	return created.Name, nil
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Service annotations requesting a certificate from the internal CA
+const (
+	// tlsSecretAnnotation names the kubernetes.io/tls Secret to issue into,
+	// in the Service's namespace
+	tlsSecretAnnotation = "homelab.mcztest.com/tls-secret"
+	// tlsDNSNamesAnnotation adds comma-separated names to the Service's
+	// cluster DNS names
+	tlsDNSNamesAnnotation = "homelab.mcztest.com/tls-dns-names"
+	// tlsRestartAnnotation names Deployments to restart after an issue, for
+	// servers that only read their certificate at startup
+	tlsRestartAnnotation = "homelab.mcztest.com/tls-restart"
+	// tlsIngressAnnotation names Ingresses whose backend is switched to
+	// HTTPS once the certificate exists, for servers that fall back to
+	// HTTP without it
+	tlsIngressAnnotation = "homelab.mcztest.com/tls-ingress"
+)
+
+// backendProtocolAnnotation is ingress-nginx's upstream protocol
+const backendProtocolAnnotation = "nginx.ingress.kubernetes.io/backend-protocol"
+
+// Annotations recording what an issued Secret holds
+const (
+	certNotAfterAnnotation = "homelab.mcztest.com/not-after"
+	certDNSNamesAnnotation = "homelab.mcztest.com/dns-names"
+	// certIssuerAnnotation is the CA fingerprint, so certificates are
+	// reissued when the CA is replaced
+	certIssuerAnnotation = "homelab.mcztest.com/issuer"
+	// certRenewedAtAnnotation restarts Deployments when set on their pod
+	// template
+	certRenewedAtAnnotation = "homelab.mcztest.com/cert-renewed-at"
+)
+
+// caValidity is the lifetime of a generated CA
+const caValidity = 10 * 365 * 24 * time.Hour
+
+// CAConfig configures the internal CA
+type CAConfig struct {
+	// Namespace and Secret hold the CA certificate and key; the CA is
+	// disabled while Secret is empty
+	Namespace string `json:"namespace" env:"POD_NAMESPACE" flag:"namespace"`
+	Secret    string `json:"secret" env:"INTERNAL_CA_SECRET" flag:"ca-secret" usage:"Secret holding the internal CA; empty disables it"`
+	// BundleConfigMap is written to every namespace with the CA under ca.crt
+	BundleConfigMap string `json:"bundleConfigMap" env:"CA_BUNDLE_CONFIGMAP" flag:"ca-bundle-configmap"`
+	// CertDuration is the lifetime of issued certificates; they are renewed
+	// with a third of it left
+	CertDuration      time.Duration `json:"certDuration" env:"CERT_DURATION" flag:"cert-duration"`
+	ClusterDomain     string        `json:"clusterDomain" env:"CLUSTER_DOMAIN" flag:"cluster-domain"`
+	ExcludeNamespaces []string      `json:"excludeNamespaces" env:"CA_EXCLUDE_NAMESPACES" flag:"ca-exclude-namespaces" usage:"namespaces without certificates, comma separated"`
+	// AllowedDNSNames are extra names any Service may request besides
+	// those under its own <svc>.<ns>.svc; *.example.com allows subdomains
+	AllowedDNSNames []string `json:"allowedDNSNames" env:"CA_ALLOWED_DNS_NAMES" flag:"ca-allowed-dns-names" usage:"names Services may add, comma separated"`
+}
+
+// CertStatus is one issued certificate reported by GET /certs
+type CertStatus struct {
+	Namespace string   `json:"namespace"`
+	Service   string   `json:"service"`
+	Secret    string   `json:"secret"`
+	DNSNames  []string `json:"dnsNames"`
+	// Rejected names were requested but are not the Service's to claim
+	Rejected []string   `json:"rejectedDNSNames,omitempty"`
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// CAStatus is reported by GET /certs
+type CAStatus struct {
+	Fingerprint  string       `json:"fingerprint,omitempty"`
+	NotAfter     *time.Time   `json:"notAfter,omitempty"`
+	Certificates []CertStatus `json:"certificates"`
+	// Namespaces received the CA bundle on the last pass
+	Namespaces int      `json:"namespaces"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// CertIssuer runs a private CA: it issues and renews TLS Secrets for
+// annotated Services and distributes the CA certificate to every namespace,
+// so in-cluster clients can verify internal services
+type CertIssuer struct {
+	kube   kubernetes.Interface
+	config CAConfig
+
+	ca          *x509.Certificate
+	caKey       *ecdsa.PrivateKey
+	caPEM       []byte
+	fingerprint string
+
+	statusMu sync.Mutex
+	status   CAStatus
+	// bundle is the CA PEM served by /ca.crt
+	bundle []byte
+}
+
+func NewCertIssuer(kube kubernetes.Interface, config CAConfig) *CertIssuer {
+	return &CertIssuer{kube: kube, config: config}
+}
+
+// Run issues and renews certificates and refreshes the CA bundle every
+// 5 minutes, which also covers Services and namespaces created since
+func (i *CertIssuer) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if err := i.reconcile(ctx); err != nil {
+			log.Printf("Failed to reconcile internal certificates: %v", err)
+			i.statusMu.Lock()
+			i.status.Errors = []string{err.Error()}
+			i.statusMu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (i *CertIssuer) reconcile(ctx context.Context) error {
+	if err := i.loadCA(ctx); err != nil {
+		return err
+	}
+
+	services, err := i.kube.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing services: %w", err)
+	}
+	var certs []CertStatus
+	for idx := range services.Items {
+		svc := &services.Items[idx]
+		if svc.Annotations[tlsSecretAnnotation] == "" {
+			continue
+		}
+		status := i.ensureCert(ctx, svc)
+		if status.Error != "" {
+			log.Printf("Failed to issue certificate for %s/%s: %s", svc.Namespace, svc.Name, status.Error)
+		}
+		certs = append(certs, status)
+	}
+
+	n, errs := i.distribute(ctx)
+
+	notAfter := i.ca.NotAfter
+	i.statusMu.Lock()
+	i.status = CAStatus{
+		Fingerprint:  i.fingerprint,
+		NotAfter:     &notAfter,
+		Certificates: certs,
+		Namespaces:   n,
+		Errors:       errs,
+	}
+	i.bundle = i.caPEM
+	i.statusMu.Unlock()
+	return nil
+}
+
+// loadCA reads the CA from its Secret, generating it on first start
+func (i *CertIssuer) loadCA(ctx context.Context) error {
+	secrets := i.kube.CoreV1().Secrets(i.config.Namespace)
+	secret, err := secrets.Get(ctx, i.config.Secret, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret, err = i.generateCA()
+		if err != nil {
+			return fmt.Errorf("generating CA: %w", err)
+		}
+		// Created rather than applied so a CA is never overwritten
+		secret, err = secrets.Create(ctx, secret, metav1.CreateOptions{FieldManager: fieldManager})
+		if apierrors.IsAlreadyExists(err) {
+			secret, err = secrets.Get(ctx, i.config.Secret, metav1.GetOptions{})
+		}
+		if err == nil {
+			log.Printf("Generated internal CA in %s/%s", i.config.Namespace, i.config.Secret)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("reading CA secret: %w", err)
+	}
+
+	certPEM := secret.Data[corev1.TLSCertKey]
+	if i.ca != nil && bytes.Equal(certPEM, i.caPEM) {
+		return nil
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(secret.Data[corev1.TLSPrivateKeyKey])
+	if certBlock == nil || keyBlock == nil {
+		return fmt.Errorf("CA secret %s/%s has no PEM tls.crt and tls.key", i.config.Namespace, i.config.Secret)
+	}
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing CA certificate: %w", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing CA key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("CA key must be ECDSA")
+	}
+
+	sum := sha256.Sum256(ca.Raw)
+	i.ca, i.caKey, i.caPEM, i.fingerprint = ca, ecKey, certPEM, hex.EncodeToString(sum[:])
+	return nil
+}
+
+func (i *CertIssuer) generateCA() (*corev1.Secret, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "homelab internal CA", Organization: []string{"homelab"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      i.config.Secret,
+			Namespace: i.config.Namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": fieldManager},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}, nil
+}
+
+// dnsNames are the Service's cluster DNS names plus those from its
+// annotation it may claim; any annotated Service could otherwise get a
+// certificate for another Service's or an external name
+func (i *CertIssuer) dnsNames(svc *corev1.Service) (names, rejected []string) {
+	own := svc.Name + "." + svc.Namespace + ".svc"
+	names = []string{
+		svc.Name,
+		svc.Name + "." + svc.Namespace,
+		own,
+		own + "." + i.config.ClusterDomain,
+	}
+	for _, name := range strings.Split(svc.Annotations[tlsDNSNamesAnnotation], ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || contains(names, name) {
+			continue
+		}
+		if strings.HasSuffix(name, "."+own) || strings.HasSuffix(name, "."+own+"."+i.config.ClusterDomain) || i.allowedName(name) {
+			names = append(names, name)
+		} else {
+			rejected = append(rejected, name)
+		}
+	}
+	return names, rejected
+}
+
+// allowedName reports whether name is in AllowedDNSNames, directly or
+// through a *. entry
+func (i *CertIssuer) allowedName(name string) bool {
+	for _, allowed := range i.config.AllowedDNSNames {
+		if name == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(name, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureCert issues the Service's certificate unless its Secret already
+// holds one from this CA, for the same names, with a third of its lifetime
+// left
+func (i *CertIssuer) ensureCert(ctx context.Context, svc *corev1.Service) CertStatus {
+	names, rejected := i.dnsNames(svc)
+	status := CertStatus{
+		Namespace: svc.Namespace,
+		Service:   svc.Name,
+		Secret:    svc.Annotations[tlsSecretAnnotation],
+		DNSNames:  names,
+		Rejected:  rejected,
+	}
+	if len(rejected) > 0 {
+		log.Printf("Not issuing %s for Service %s/%s: neither under %s.%s.svc nor in CA_ALLOWED_DNS_NAMES",
+			strings.Join(rejected, ", "), svc.Namespace, svc.Name, svc.Name, svc.Namespace)
+	}
+
+	existing, err := i.kube.CoreV1().Secrets(svc.Namespace).Get(ctx, status.Secret, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		status.Error = err.Error()
+		return status
+	}
+	if err == nil {
+		notAfter, _ := time.Parse(time.RFC3339, existing.Annotations[certNotAfterAnnotation])
+		if existing.Annotations[certIssuerAnnotation] == i.fingerprint &&
+			existing.Annotations[certDNSNamesAnnotation] == strings.Join(names, ",") &&
+			time.Until(notAfter) > i.config.CertDuration/3 {
+			status.NotAfter = &notAfter
+			if err := i.switchIngresses(ctx, svc); err != nil {
+				status.Error = err.Error()
+			}
+			return status
+		}
+	}
+
+	secret, notAfter, err := i.issue(svc, status.Secret, names)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	body, err := json.Marshal(secret)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	force := true
+	if _, err := i.kube.CoreV1().Secrets(svc.Namespace).Patch(ctx, secret.Name, types.ApplyPatchType, body,
+		metav1.PatchOptions{FieldManager: fieldManager, Force: &force}); err != nil {
+		status.Error = fmt.Sprintf("writing %s: %v", secret.Name, err)
+		return status
+	}
+	status.NotAfter = &notAfter
+	log.Printf("Issued certificate %s/%s for %s (expires %s)", svc.Namespace, secret.Name, strings.Join(names, ", "), notAfter.Format(time.RFC3339))
+
+	// Servers started before the first issue run without TLS, so they are
+	// restarted then too
+	if err := errors.Join(i.restart(ctx, svc), i.switchIngresses(ctx, svc)); err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// issue signs a server certificate for names and renders its Secret, owned
+// by the Service
+func (i *CertIssuer) issue(svc *corev1.Service, name string, names []string) (*corev1.Secret, time.Time, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	now := time.Now()
+	notAfter := now.Add(i.config.CertDuration)
+	if notAfter.After(i.ca.NotAfter) {
+		notAfter = i.ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, i.ca, &key.PublicKey, i.caKey)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// Truncated to the annotation's precision so renewal checks line up
+	notAfter = notAfter.Truncate(time.Second)
+	controller := true
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: svc.Namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": fieldManager},
+			Annotations: map[string]string{
+				certNotAfterAnnotation: notAfter.UTC().Format(time.RFC3339),
+				certDNSNamesAnnotation: strings.Join(names, ","),
+				certIssuerAnnotation:   i.fingerprint,
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Service",
+				Name:       svc.Name,
+				UID:        svc.UID,
+				Controller: &controller,
+			}},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			corev1.TLSPrivateKeyKey: keyPEM,
+			"ca.crt":                i.caPEM,
+		},
+	}, notAfter, nil
+}
+
+// restart rolls the Deployments named by the Service's tls-restart
+// annotation so they load the new certificate
+func (i *CertIssuer) restart(ctx context.Context, svc *corev1.Service) error {
+	var errs []error
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		certRenewedAtAnnotation, time.Now().UTC().Format(time.RFC3339))
+	for _, name := range strings.Split(svc.Annotations[tlsRestartAnnotation], ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, err := i.kube.AppsV1().Deployments(svc.Namespace).Patch(ctx, name, types.MergePatchType, []byte(patch),
+			metav1.PatchOptions{FieldManager: fieldManager}); err != nil {
+			errs = append(errs, fmt.Errorf("restarting %s: %w", name, err))
+			continue
+		}
+		log.Printf("Restarted %s/%s for its new certificate", svc.Namespace, name)
+	}
+	return errors.Join(errs...)
+}
+
+// switchIngresses points the Ingresses named by the Service's tls-ingress
+// annotation at its HTTPS port, once there is a certificate to serve
+func (i *CertIssuer) switchIngresses(ctx context.Context, svc *corev1.Service) error {
+	var errs []error
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:"HTTPS"}}}`, backendProtocolAnnotation)
+	for _, name := range strings.Split(svc.Annotations[tlsIngressAnnotation], ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		ingress, err := i.kube.NetworkingV1().Ingresses(svc.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("switching %s to HTTPS: %w", name, err))
+			continue
+		}
+		if ingress.Annotations[backendProtocolAnnotation] == "HTTPS" {
+			continue
+		}
+		if _, err := i.kube.NetworkingV1().Ingresses(svc.Namespace).Patch(ctx, name, types.MergePatchType, []byte(patch),
+			metav1.PatchOptions{FieldManager: fieldManager}); err != nil {
+			errs = append(errs, fmt.Errorf("switching %s to HTTPS: %w", name, err))
+			continue
+		}
+		log.Printf("Switched Ingress %s/%s to its HTTPS backend", svc.Namespace, name)
+	}
+	return errors.Join(errs...)
+}
+
+// distribute writes the CA bundle ConfigMap to every namespace
+func (i *CertIssuer) distribute(ctx context.Context) (int, []string) {
+	namespaces, err := i.kube.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, []string{fmt.Sprintf("listing namespaces: %v", err)}
+	}
+
+	var errs []string
+	updated := 0
+	force := true
+	for _, ns := range namespaces.Items {
+		if ns.Status.Phase == corev1.NamespaceTerminating || contains(i.config.ExcludeNamespaces, ns.Name) {
+			continue
+		}
+		cm := &corev1.ConfigMap{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      i.config.BundleConfigMap,
+				Namespace: ns.Name,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": fieldManager},
+			},
+			Data: map[string]string{"ca.crt": string(i.caPEM)},
+		}
+		body, err := json.Marshal(cm)
+		if err != nil {
+			return updated, append(errs, err.Error())
+		}
+		if _, err := i.kube.CoreV1().ConfigMaps(ns.Name).Patch(ctx, cm.Name, types.ApplyPatchType, body,
+			metav1.PatchOptions{FieldManager: fieldManager, Force: &force}); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", ns.Name, err))
+			continue
+		}
+		updated++
+	}
+	return updated, errs
+}
+
+// Status returns the CA and the certificates of the last pass
+func (i *CertIssuer) Status() CAStatus {
+	i.statusMu.Lock()
+	defer i.statusMu.Unlock()
+	status := i.status
+	status.Certificates = append([]CertStatus(nil), i.status.Certificates...)
+	sort.Slice(status.Certificates, func(a, b int) bool {
+		ca, cb := status.Certificates[a], status.Certificates[b]
+		if ca.Namespace != cb.Namespace {
+			return ca.Namespace < cb.Namespace
+		}
+		return ca.Service < cb.Service
+	})
+	status.Errors = append([]string(nil), i.status.Errors...)
+	return status
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// handleCA serves GET /ca.crt, the CA certificate in PEM, without a token
+// so nodes and workstations can fetch it to trust internal services
+func (i *CertIssuer) handleCA(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	i.statusMu.Lock()
+	bundle := i.bundle
+	i.statusMu.Unlock()
+	if bundle == nil {
+		http.Error(w, "CA not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(bundle)
+}
+
+// handleCerts serves GET /certs
+func (i *CertIssuer) handleCerts(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	httpkit.WriteJSON(w, http.StatusOK, i.Status())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDNSNames(t *testing.T) {
+	issuer := NewCertIssuer(nil, CAConfig{
+		ClusterDomain:   "cluster.local",
+		AllowedDNSNames: []string{"registry.internal", "*.apps.internal"},
+	})
+	own := []string{
+		"docker-registry",
+		"docker-registry.container-registry",
+		"docker-registry.container-registry.svc",
+		"docker-registry.container-registry.svc.cluster.local",
+	}
+
+	tests := []struct {
+		name         string
+		annotation   string
+		wantExtra    []string
+		wantRejected []string
+	}{
+		{name: "no annotation"},
+		{
+			name:       "subdomains of the service",
+			annotation: "mirror.docker-registry.container-registry.svc, a.docker-registry.container-registry.svc.cluster.local",
+			wantExtra:  []string{"mirror.docker-registry.container-registry.svc", "a.docker-registry.container-registry.svc.cluster.local"},
+		},
+		{
+			name:       "allowlisted names",
+			annotation: "Registry.Internal,web.apps.internal",
+			wantExtra:  []string{"registry.internal", "web.apps.internal"},
+		},
+		{
+			name:         "other services and external names",
+			annotation:   "kubernetes.default.svc,gitea.gitea.svc.cluster.local,apps.internal,evildocker-registry.container-registry.svc,example.com",
+			wantRejected: []string{"kubernetes.default.svc", "gitea.gitea.svc.cluster.local", "apps.internal", "evildocker-registry.container-registry.svc", "example.com"},
+		},
+		{
+			name:       "duplicates of the default names",
+			annotation: "docker-registry.container-registry.svc, ,",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+				Name:        "docker-registry",
+				Namespace:   "container-registry",
+				Annotations: map[string]string{tlsDNSNamesAnnotation: tt.annotation},
+			}}
+			names, rejected := issuer.dnsNames(svc)
+			if want := append(append([]string{}, own...), tt.wantExtra...); !reflect.DeepEqual(names, want) {
+				t.Errorf("names = %q, want %q", names, want)
+			}
+			if !reflect.DeepEqual(rejected, tt.wantRejected) {
+				t.Errorf("rejected = %q, want %q", rejected, tt.wantRejected)
+			}
+		})
+	}
+}
+
+func TestSwitchIngresses(t *testing.T) {
+	ctx := context.Background()
+	kube := fake.NewSimpleClientset(&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Name:        "docker-registry",
+		Namespace:   "container-registry",
+		Annotations: map[string]string{"nginx.ingress.kubernetes.io/proxy-body-size": "0"},
+	}})
+	issuer := NewCertIssuer(kube, CAConfig{})
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:        "docker-registry",
+		Namespace:   "container-registry",
+		Annotations: map[string]string{tlsIngressAnnotation: "docker-registry"},
+	}}
+
+	if err := issuer.switchIngresses(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+	ingress, err := kube.NetworkingV1().Ingresses("container-registry").Get(ctx, "docker-registry", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ingress.Annotations[backendProtocolAnnotation] != "HTTPS" || ingress.Annotations["nginx.ingress.kubernetes.io/proxy-body-size"] != "0" {
+		t.Fatalf("annotations = %v", ingress.Annotations)
+	}
+
+	// Switched Ingresses are left alone
+	kube.ClearActions()
+	if err := issuer.switchIngresses(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range kube.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Fatalf("patched a switched Ingress: %v", action)
+		}
+	}
+
+	svc.Annotations[tlsIngressAnnotation] = "missing"
+	if err := issuer.switchIngresses(ctx, svc); err == nil {
+		t.Fatal("switched a missing Ingress")
+	}
+}
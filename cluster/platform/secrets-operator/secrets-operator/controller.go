@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller watches SecretClaims and keeps their Secrets in sync
+type Controller struct {
+	kube      kubernetes.Interface
+	dynamic   dynamic.Interface
+	providers map[string]Provider
+
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+func NewController(kube kubernetes.Interface, dyn dynamic.Interface, providers map[string]Provider) *Controller {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dyn, 0)
+
+	c := &Controller{
+		kube:      kube,
+		dynamic:   dyn,
+		providers: providers,
+		factory:   factory,
+		informer:  factory.ForResource(secretClaimGVR).Informer(),
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Only spec changes matter; periodic refresh is scheduled with AddAfter
+			if oldObj.(*unstructured.Unstructured).GetGeneration() != newObj.(*unstructured.Unstructured).GetGeneration() {
+				c.enqueue(newObj)
+			}
+		},
+	})
+	return c
+}
+
+// Run starts the informer and workers, blocking until ctx is cancelled
+func (c *Controller) Run(ctx context.Context, workers int) error {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+		return fmt.Errorf("timed out waiting for caches to sync")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	refresh, err := c.sync(ctx, key)
+	if err != nil {
+		log.Printf("Failed to sync %s: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	if refresh > 0 {
+		c.queue.AddAfter(key, refresh)
+	}
+	return true
+}
+
+// sync reconciles one claim and returns when it should be refreshed next
+func (c *Controller) sync(ctx context.Context, key string) (time.Duration, error) {
+	obj, exists, err := c.informer.GetStore().GetByKey(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		// The generated Secret is garbage collected through its owner reference
+		return 0, nil
+	}
+
+	claim, err := fromUnstructured(obj.(*unstructured.Unstructured))
+	if err != nil {
+		return 0, fmt.Errorf("decoding secret claim: %w", err)
+	}
+
+	refresh := time.Hour
+	if claim.Spec.RefreshInterval != "" {
+		refresh, err = time.ParseDuration(claim.Spec.RefreshInterval)
+		if err != nil {
+			return 0, c.setStatus(ctx, claim, nil, "InvalidSpec", fmt.Errorf("invalid refreshInterval: %w", err))
+		}
+	}
+
+	return refresh, c.syncClaim(ctx, claim)
+}
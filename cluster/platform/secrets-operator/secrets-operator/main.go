@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/homelab/internal/auth"
+	"github.com/homelab/internal/health"
+	"github.com/homelab/internal/httpkit"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func main() {
+	settings, err := loadSettings()
+	if err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+	// Validated by loadSettings
+	rotation, _ := settings.rotation()
+	caConfig := settings.ca()
+
+	providers := newProviders(&settings.Providers)
+	if len(providers) == 0 && rotation == nil && caConfig == nil {
+		log.Fatalf("No providers configured: set VAULT_ADDR, OP_CONNECT_HOST, or SOPS_ROOT")
+	}
+
+	// Create Kubernetes clients
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("Failed to get in-cluster config: %v", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create dynamic client: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Rotation and certificate status take API_TOKEN; the CA is public
+	apiAuth := auth.AllowUnauthenticated(auth.Bearer(settings.APIToken, "", "", nil), settings.AllowUnauthenticated, "rotation and certificate API")
+	// /readyz fails while the API server is unreachable; /health stays as
+	// an alias of /healthz
+	checks := health.New()
+	checks.Add("kubernetes", func(ctx context.Context) error {
+		return kubeClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+	})
+	checks.Register(http.DefaultServeMux)
+	http.HandleFunc("/health", checks.Live)
+	if rotation != nil {
+		rotator := NewRotator(kubeClient, *rotation)
+		http.HandleFunc("/rotate/registry", auth.Require(rotator.handleRotate, apiAuth...))
+		go rotator.Run(ctx)
+		log.Printf("Rotating registry credentials every %s", rotation.Interval)
+	}
+	if caConfig != nil {
+		issuer := NewCertIssuer(kubeClient, *caConfig)
+		http.HandleFunc("/ca.crt", issuer.handleCA)
+		http.HandleFunc("/certs", auth.Require(issuer.handleCerts, apiAuth...))
+		go issuer.Run(ctx)
+		log.Printf("Issuing internal certificates from %s/%s, valid %s", caConfig.Namespace, caConfig.Secret, caConfig.CertDuration)
+	}
+
+	port := settings.Port
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := httpkit.Serve(ctx, httpkit.NewServer(":"+port, http.DefaultServeMux)); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	log.Printf("Starting secrets-operator (providers: %s)", strings.Join(names, ", "))
+
+	controller := NewController(kubeClient, dynamicClient, providers)
+	if err := controller.Run(ctx, 2); err != nil {
+		log.Fatalf("Controller stopped: %v", err)
+	}
+	// Let in-flight requests finish
+	<-served
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Provider reads a flat key/value map from an external secret store
+type Provider interface {
+	Fetch(ctx context.Context, path string) (map[string]string, error)
+}
+
+// httpJSON performs an authenticated GET and decodes the JSON body
+func httpJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GET %s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// VaultProvider reads Vault KV v2 secrets using a token
+type VaultProvider struct {
+	Addr  string
+	Token string
+	http  *http.Client
+}
+
+func (v *VaultProvider) Fetch(ctx context.Context, path string) (map[string]string, error) {
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	url := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(v.Addr, "/"), strings.TrimPrefix(path, "/"))
+	if err := httpJSON(ctx, v.http, url, map[string]string{"X-Vault-Token": v.Token}, &resp); err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(resp.Data.Data))
+	for k, val := range resp.Data.Data {
+		data[k] = stringify(val)
+	}
+	return data, nil
+}
+
+// OnePasswordProvider reads item fields through a 1Password Connect server
+type OnePasswordProvider struct {
+	Host  string
+	Token string
+	http  *http.Client
+}
+
+func (o *OnePasswordProvider) Fetch(ctx context.Context, path string) (map[string]string, error) {
+	vault, item, ok := strings.Cut(path, "/")
+	if !ok {
+		return nil, fmt.Errorf("onepassword path must be <vault-id>/<item-id>, got %q", path)
+	}
+
+	var resp struct {
+		Fields []struct {
+			Label string `json:"label"`
+			Value string `json:"value"`
+		} `json:"fields"`
+	}
+	url := fmt.Sprintf("%s/v1/vaults/%s/items/%s", strings.TrimSuffix(o.Host, "/"), vault, item)
+	if err := httpJSON(ctx, o.http, url, map[string]string{"Authorization": "Bearer " + o.Token}, &resp); err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(resp.Fields))
+	for _, f := range resp.Fields {
+		if f.Label != "" && f.Value != "" {
+			data[f.Label] = f.Value
+		}
+	}
+	return data, nil
+}
+
+// SOPSProvider decrypts files from a git checkout (kept fresh by a git-sync sidecar)
+type SOPSProvider struct {
+	Root string
+}
+
+func (s *SOPSProvider) Fetch(ctx context.Context, path string) (map[string]string, error) {
+	file := filepath.Join(s.Root, filepath.Clean("/"+path))
+
+	out, err := exec.CommandContext(ctx, "sops", "--decrypt", "--output-type", "json", file).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("sops decrypt %s: %s", path, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("sops decrypt %s: %w", path, err)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return nil, fmt.Errorf("parsing decrypted %s: %w", path, err)
+	}
+
+	data := make(map[string]string, len(raw))
+	for k, val := range raw {
+		if k == "sops" {
+			continue
+		}
+		data[k] = stringify(val)
+	}
+	return data, nil
+}
+
+// stringify renders scalar values as-is and nested values as JSON
+func stringify(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// newProviders builds the configured providers; unconfigured ones are omitted
+func newProviders(cfg *Config) map[string]Provider {
+	client := &http.Client{Timeout: 30 * time.Second}
+	providers := make(map[string]Provider)
+	if cfg.VaultAddr != "" {
+		providers["vault"] = &VaultProvider{Addr: cfg.VaultAddr, Token: cfg.VaultToken, http: client}
+	}
+	if cfg.OnePasswordHost != "" {
+		providers["onepassword"] = &OnePasswordProvider{Host: cfg.OnePasswordHost, Token: cfg.OnePasswordToken, http: client}
+	}
+	if cfg.SOPSRoot != "" {
+		providers["sops"] = &SOPSProvider{Root: cfg.SOPSRoot}
+	}
+	return providers
+}
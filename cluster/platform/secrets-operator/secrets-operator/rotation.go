@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homelab/internal/httpkit"
+	"github.com/homelab/internal/registryauth"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rotatedAtAnnotation records the last rotation on the htpasswd Secret and
+// restarts the registry when set on its pod template
+const rotatedAtAnnotation = "homelab.mcztest.com/rotated-at"
+
+// userAnnotation names the current registry user on the htpasswd Secret
+const userAnnotation = "homelab.mcztest.com/user"
+
+// previousPasswordKey keeps the password of the htpasswd Secret's second
+// user, which the next rotation drops and checks the registry refuses. The
+// registry only mounts the htpasswd key.
+const previousPasswordKey = "previous-password"
+
+// RotationConfig configures registry credential rotation
+type RotationConfig struct {
+	// Interval between rotations; 0 disables scheduled rotation. It is set
+	// from Settings.RotationInterval, which also enables rotation.
+	Interval time.Duration `json:"-"`
+	// Namespace, Deployment, and HtpasswdSecret locate the registry
+	Namespace      string `json:"namespace" env:"REGISTRY_NAMESPACE" flag:"registry-namespace"`
+	Deployment     string `json:"deployment" env:"REGISTRY_DEPLOYMENT" flag:"registry-deployment"`
+	HtpasswdSecret string `json:"htpasswdSecret" env:"REGISTRY_HTPASSWD_SECRET" flag:"registry-htpasswd-secret"`
+	// CredentialsSecret is the dockerconfigjson Secret written to every
+	// namespace for pulls and mounted by Kaniko for pushes
+	CredentialsSecret string `json:"credentialsSecret" env:"REGISTRY_CREDENTIALS_SECRET" flag:"registry-credentials-secret"`
+	// Hosts are the registry names written into the docker config
+	Hosts []string `json:"hosts" env:"REGISTRY_HOSTS" flag:"registry-hosts" usage:"registry names in the docker config, comma separated"`
+	// RegistryURL is used to check the new credentials before handing them out
+	RegistryURL       string   `json:"registryURL" env:"REGISTRY_URL" flag:"registry-url"`
+	UserPrefix        string   `json:"userPrefix" env:"REGISTRY_USER_PREFIX" flag:"registry-user-prefix"`
+	ExcludeNamespaces []string `json:"excludeNamespaces" env:"REGISTRY_EXCLUDE_NAMESPACES" flag:"registry-exclude-namespaces" usage:"namespaces without the pull Secret, comma separated"`
+	// PatchServiceAccounts adds the pull Secret to every default ServiceAccount
+	PatchServiceAccounts bool `json:"patchServiceAccounts" env:"REGISTRY_PATCH_SERVICE_ACCOUNTS" flag:"registry-patch-service-accounts"`
+}
+
+// RotationStatus is reported by GET /rotate/registry
+type RotationStatus struct {
+	Running      bool       `json:"running"`
+	User         string     `json:"user,omitempty"`
+	LastRotation *time.Time `json:"lastRotation,omitempty"`
+	NextRotation *time.Time `json:"nextRotation,omitempty"`
+	Namespaces   int        `json:"namespaces"`
+	Errors       []string   `json:"errors,omitempty"`
+}
+
+// Rotator rotates the registry's htpasswd credentials and distributes them.
+// The htpasswd file keeps the previous user as well as the new one, so pods
+// and builds holding the old Secret keep working until the next rotation.
+type Rotator struct {
+	kube   kubernetes.Interface
+	config RotationConfig
+	http   *http.Client
+	// pollInterval and propagationTimeout pace the wait for the registry to
+	// pick up a new htpasswd
+	pollInterval       time.Duration
+	propagationTimeout time.Duration
+
+	// mu serializes rotations and distribution
+	mu sync.Mutex
+
+	statusMu sync.Mutex
+	status   RotationStatus
+	// failedAt holds off scheduled retries, each of which restarts the registry
+	failedAt time.Time
+}
+
+func NewRotator(kube kubernetes.Interface, config RotationConfig) *Rotator {
+	return &Rotator{
+		kube:   kube,
+		config: config,
+		http:   &http.Client{Timeout: 10 * time.Second},
+
+		pollInterval: 5 * time.Second,
+		// The kubelet syncs mounted Secrets every minute, plus its cache TTL
+		propagationTimeout: 3 * time.Minute,
+	}
+}
+
+var errRotationInProgress = errors.New("rotation already in progress")
+
+// Status returns the state of the last rotation
+func (r *Rotator) Status() RotationStatus {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	status := r.status
+	status.Errors = append([]string(nil), r.status.Errors...)
+	return status
+}
+
+// Trigger starts a rotation in the background
+func (r *Rotator) Trigger() error {
+	r.statusMu.Lock()
+	if r.status.Running {
+		r.statusMu.Unlock()
+		return errRotationInProgress
+	}
+	r.status.Running = true
+	r.statusMu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+		defer cancel()
+		if err := r.rotate(ctx); err != nil {
+			log.Printf("Failed to rotate registry credentials: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Run rotates when the credentials are older than the interval, and
+// otherwise copies the current Secret into namespaces created since
+func (r *Rotator) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if err := r.reconcile(ctx); err != nil {
+			log.Printf("Failed to reconcile registry credentials: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Rotator) reconcile(ctx context.Context) error {
+	htpasswd, err := r.kube.CoreV1().Secrets(r.config.Namespace).Get(ctx, r.config.HtpasswdSecret, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	var rotatedAt time.Time
+	if err == nil {
+		rotatedAt, _ = time.Parse(time.RFC3339, htpasswd.Annotations[rotatedAtAnnotation])
+	}
+	if rotatedAt.IsZero() || (r.config.Interval > 0 && time.Since(rotatedAt) >= r.config.Interval) {
+		r.statusMu.Lock()
+		backoff := time.Since(r.failedAt) < time.Hour
+		r.statusMu.Unlock()
+		if backoff {
+			return nil
+		}
+		if err := r.Trigger(); err != nil && !errors.Is(err, errRotationInProgress) {
+			return err
+		}
+		return nil
+	}
+	r.setRotated(htpasswd.Annotations[userAnnotation], rotatedAt)
+
+	creds, err := r.kube.CoreV1().Secrets(r.config.Namespace).Get(ctx, r.config.CredentialsSecret, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", r.config.CredentialsSecret, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, errs := r.distribute(ctx, creds.Data[corev1.DockerConfigJsonKey])
+	r.setDistributed(n, errs)
+	return nil
+}
+
+// rotate generates a new user, adds it to the registry's htpasswd next to the
+// current one, waits for the registry to accept it and refuse the user it
+// replaces, and only then writes the new docker config everywhere
+func (r *Rotator) rotate(ctx context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() {
+		r.statusMu.Lock()
+		r.status.Running = false
+		if err != nil {
+			r.status.Errors = []string{err.Error()}
+			r.failedAt = time.Now()
+		}
+		r.statusMu.Unlock()
+	}()
+
+	secrets := r.kube.CoreV1().Secrets(r.config.Namespace)
+	old, err := secrets.Get(ctx, r.config.HtpasswdSecret, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	var previous, previousPassword string
+	var retired *registryauth.Credential
+	if err == nil {
+		// The first line is the current user, kept for the pods holding its
+		// Secret; the second, if any, is retired
+		lines := strings.Split(strings.TrimSpace(string(old.Data["htpasswd"])), "\n")
+		previous = lines[0]
+		if len(lines) > 1 && len(old.Data[previousPasswordKey]) > 0 {
+			name, _, _ := strings.Cut(lines[1], ":")
+			retired = &registryauth.Credential{Username: name, Password: string(old.Data[previousPasswordKey])}
+		}
+		name, _, _ := strings.Cut(previous, ":")
+		previousPassword = r.password(ctx, name)
+	} else {
+		old = nil
+	}
+
+	now := time.Now().UTC()
+	user := fmt.Sprintf("%s-%s", r.config.UserPrefix, now.Format("20060102150405"))
+	password, err := randomPassword()
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	htpasswd := user + ":" + string(hash) + "\n"
+	if previous != "" {
+		htpasswd += previous + "\n"
+	}
+
+	log.Printf("Rotating registry credentials to %s", user)
+	if err := r.applySecret(ctx, r.config.Namespace, r.htpasswdSecret(user, now, htpasswd, previousPassword)); err != nil {
+		return fmt.Errorf("writing htpasswd: %w", err)
+	}
+
+	restarted, err := r.activate(ctx, now, registryauth.Credential{Username: user, Password: password}, retired)
+	if err != nil {
+		// Nothing has the new password yet, so putting the old file back is
+		// safe; the registry rereads it like any other update
+		if old != nil {
+			restore := r.htpasswdSecret(old.Annotations[userAnnotation], now, string(old.Data["htpasswd"]), string(old.Data[previousPasswordKey]))
+			restore.Annotations[rotatedAtAnnotation] = old.Annotations[rotatedAtAnnotation]
+			if rerr := r.applySecret(ctx, r.config.Namespace, restore); rerr != nil {
+				log.Printf("Failed to restore previous htpasswd: %v", rerr)
+			}
+		} else if rerr := secrets.Delete(ctx, r.config.HtpasswdSecret, metav1.DeleteOptions{}); rerr != nil && !apierrors.IsNotFound(rerr) {
+			log.Printf("Failed to remove new htpasswd: %v", rerr)
+		} else if restarted {
+			// Without a login anyone holds, open the registry again
+			if rerr := r.restartRegistry(ctx, time.Now().UTC()); rerr != nil {
+				log.Printf("Failed to restart registry after removing htpasswd: %v", rerr)
+			}
+		}
+		return fmt.Errorf("activating new credentials: %w", err)
+	}
+
+	dockerConfig, err := r.dockerConfig(user, password)
+	if err != nil {
+		return err
+	}
+	// Kaniko's push credentials first, then every namespace's pull Secret
+	if err := r.applySecret(ctx, r.config.Namespace, r.credentialsSecret(r.config.Namespace, dockerConfig)); err != nil {
+		return fmt.Errorf("writing push credentials: %w", err)
+	}
+	n, errs := r.distribute(ctx, dockerConfig)
+
+	r.setRotated(user, now)
+	r.setDistributed(n, errs)
+	log.Printf("Rotated registry credentials to %s (%d namespaces, %d errors)", user, n, len(errs))
+	return nil
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (r *Rotator) htpasswdSecret(user string, rotatedAt time.Time, htpasswd, previousPassword string) *corev1.Secret {
+	data := map[string]string{"htpasswd": htpasswd}
+	if previousPassword != "" {
+		data[previousPasswordKey] = previousPassword
+	}
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.config.HtpasswdSecret,
+			Namespace: r.config.Namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": fieldManager},
+			Annotations: map[string]string{
+				rotatedAtAnnotation: rotatedAt.Format(time.RFC3339),
+				userAnnotation:      user,
+			},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: data,
+	}
+}
+
+func (r *Rotator) credentialsSecret(namespace string, dockerConfig []byte) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.config.CredentialsSecret,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": fieldManager},
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: dockerConfig},
+	}
+}
+
+func (r *Rotator) applySecret(ctx context.Context, namespace string, secret *corev1.Secret) error {
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = r.kube.CoreV1().Secrets(namespace).Patch(ctx, secret.Name, types.ApplyPatchType, body,
+		metav1.PatchOptions{FieldManager: fieldManager, Force: &force})
+	return err
+}
+
+// password returns user's password from the current credentials Secret, or
+// "" if it has another user
+func (r *Rotator) password(ctx context.Context, user string) string {
+	creds, err := r.kube.CoreV1().Secrets(r.config.Namespace).Get(ctx, r.config.CredentialsSecret, metav1.GetOptions{})
+	if err != nil {
+		return ""
+	}
+	auths, err := registryauth.Parse(creds.Data[corev1.DockerConfigJsonKey])
+	if err != nil {
+		return ""
+	}
+	for _, cred := range auths {
+		if cred.Username == user {
+			return cred.Password
+		}
+	}
+	return ""
+}
+
+// dockerConfig renders a .dockerconfigjson with the user for every host
+func (r *Rotator) dockerConfig(user, password string) ([]byte, error) {
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	auths := make(map[string]interface{}, len(r.config.Hosts))
+	for _, host := range r.config.Hosts {
+		auths[host] = map[string]string{"username": user, "password": password, "auth": auth}
+	}
+	return json.Marshal(map[string]interface{}{"auths": auths})
+}
+
+// activate waits for the registry to accept the new htpasswd. The registry
+// rereads the file when the kubelet updates the mounted Secret, so it stays
+// up; only one that does not require logins yet is restarted, since it turns
+// authentication on at startup. That is the first rotation on a new cluster,
+// and pulls fail for the minute the single replica takes to come back.
+func (r *Rotator) activate(ctx context.Context, at time.Time, cred registryauth.Credential, retired *registryauth.Credential) (restarted bool, err error) {
+	status, err := r.login(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("checking registry: %w", err)
+	}
+	if status == http.StatusOK {
+		log.Printf("Registry accepts requests without a login; restarting it to enable htpasswd")
+		if err := r.restartRegistry(ctx, at); err != nil {
+			return false, err
+		}
+		restarted = true
+	}
+	return restarted, r.verify(ctx, cred, retired)
+}
+
+// restartRegistry rolls the registry and waits for the new pod
+func (r *Rotator) restartRegistry(ctx context.Context, at time.Time) error {
+	deployments := r.kube.AppsV1().Deployments(r.config.Namespace)
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`, rotatedAtAnnotation, at.Format(time.RFC3339))
+	if _, err := deployments.Patch(ctx, r.config.Deployment, types.MergePatchType, []byte(patch), metav1.PatchOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("restarting registry: %w", err)
+	}
+
+	deadline, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	for {
+		d, err := deployments.Get(deadline, r.config.Deployment, metav1.GetOptions{})
+		if err == nil && d.Status.ObservedGeneration >= d.Generation &&
+			d.Status.UpdatedReplicas == d.Status.Replicas && d.Status.AvailableReplicas == d.Status.Replicas &&
+			d.Status.Replicas > 0 {
+			return nil
+		}
+
+		select {
+		case <-deadline.Done():
+			return fmt.Errorf("registry did not become ready: %w", deadline.Err())
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// verify waits for the registry to accept the new login, then checks that it
+// refuses requests without one and the retired user's
+func (r *Rotator) verify(ctx context.Context, cred registryauth.Credential, retired *registryauth.Credential) error {
+	deadline, cancel := context.WithTimeout(ctx, r.propagationTimeout)
+	defer cancel()
+	for {
+		status, err := r.login(deadline, &cred)
+		if err == nil && status == http.StatusOK {
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("registry login returned %d", status)
+		}
+
+		select {
+		case <-deadline.Done():
+			return fmt.Errorf("new credentials not accepted: %w", err)
+		case <-time.After(r.pollInterval):
+		}
+	}
+
+	status, err := r.login(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusUnauthorized {
+		return fmt.Errorf("registry answered a request without a login with %d", status)
+	}
+	if retired != nil {
+		status, err := r.login(ctx, retired)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusUnauthorized {
+			return fmt.Errorf("registry still accepts retired user %s (%d)", retired.Username, status)
+		}
+	}
+	return nil
+}
+
+// login requests the registry API root with cred, or without a login if nil,
+// and returns the status
+func (r *Rotator) login(ctx context.Context, cred *registryauth.Credential) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(r.config.RegistryURL, "/")+"/v2/", nil)
+	if err != nil {
+		return 0, err
+	}
+	if cred != nil {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// distribute writes the pull Secret to every namespace and, if configured,
+// attaches it to the default ServiceAccount
+func (r *Rotator) distribute(ctx context.Context, dockerConfig []byte) (int, []string) {
+	namespaces, err := r.kube.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, []string{fmt.Sprintf("listing namespaces: %v", err)}
+	}
+
+	var errs []string
+	updated := 0
+	for _, ns := range namespaces.Items {
+		if ns.Status.Phase == corev1.NamespaceTerminating || contains(r.config.ExcludeNamespaces, ns.Name) {
+			continue
+		}
+		if err := r.applySecret(ctx, ns.Name, r.credentialsSecret(ns.Name, dockerConfig)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", ns.Name, err))
+			continue
+		}
+		if r.config.PatchServiceAccounts {
+			if err := r.attachPullSecret(ctx, ns.Name); err != nil {
+				errs = append(errs, fmt.Sprintf("%s/default: %v", ns.Name, err))
+				continue
+			}
+		}
+		updated++
+	}
+	return updated, errs
+}
+
+func (r *Rotator) attachPullSecret(ctx context.Context, namespace string) error {
+	accounts := r.kube.CoreV1().ServiceAccounts(namespace)
+	sa, err := accounts.Get(ctx, "default", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// Created by the controller manager shortly after the namespace
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, ref := range sa.ImagePullSecrets {
+		if ref.Name == r.config.CredentialsSecret {
+			return nil
+		}
+	}
+	sa.ImagePullSecrets = append(sa.ImagePullSecrets, corev1.LocalObjectReference{Name: r.config.CredentialsSecret})
+	_, err = accounts.Update(ctx, sa, metav1.UpdateOptions{FieldManager: fieldManager})
+	return err
+}
+
+func (r *Rotator) setRotated(user string, at time.Time) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.User = user
+	r.status.LastRotation = &at
+	if r.config.Interval > 0 {
+		next := at.Add(r.config.Interval)
+		r.status.NextRotation = &next
+	}
+}
+
+func (r *Rotator) setDistributed(namespaces int, errs []string) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.Namespaces = namespaces
+	r.status.Errors = errs
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRotate serves GET /rotate/registry (status) and POST (rotate now)
+func (r *Rotator) handleRotate(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		httpkit.WriteJSON(w, http.StatusOK, r.Status())
+
+	case http.MethodPost:
+		if err := r.Trigger(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Registry credential rotation requested")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Rotating registry credentials")
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/homelab/internal/registryauth"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testRegistry answers /v2/ like a registry with htpasswd auth: open until
+// enforcing is set, then only for the users in logins
+type testRegistry struct {
+	mu        sync.Mutex
+	enforcing bool
+	logins    map[string]string
+}
+
+func (reg *testRegistry) set(enforcing bool, logins map[string]string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.enforcing, reg.logins = enforcing, logins
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	user, password, ok := r.BasicAuth()
+	if reg.enforcing && (!ok || reg.logins[user] != password) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+func testRotator(t *testing.T, reg *testRegistry, kube *fake.Clientset) *Rotator {
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+	r := NewRotator(kube, RotationConfig{Namespace: "container-registry", Deployment: "docker-registry", RegistryURL: srv.URL})
+	r.pollInterval = 10 * time.Millisecond
+	r.propagationTimeout = 500 * time.Millisecond
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	current := registryauth.Credential{Username: "homelab-3", Password: "three"}
+	retired := &registryauth.Credential{Username: "homelab-1", Password: "one"}
+
+	tests := []struct {
+		name    string
+		logins  map[string]string
+		open    bool
+		wantErr string
+	}{
+		{
+			name:   "new login accepted, retired refused",
+			logins: map[string]string{"homelab-3": "three", "homelab-2": "two"},
+		},
+		{
+			name:    "new login never accepted",
+			logins:  map[string]string{"homelab-2": "two", "homelab-1": "one"},
+			wantErr: "new credentials not accepted",
+		},
+		{
+			name:    "retired login still accepted",
+			logins:  map[string]string{"homelab-3": "three", "homelab-1": "one"},
+			wantErr: "still accepts retired user homelab-1",
+		},
+		{
+			name:    "anonymous requests accepted",
+			open:    true,
+			wantErr: "without a login with 200",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &testRegistry{}
+			reg.set(!tt.open, tt.logins)
+			r := testRotator(t, reg, fake.NewSimpleClientset())
+
+			err := r.verify(context.Background(), current, retired)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyWaitsForPropagation(t *testing.T) {
+	reg := &testRegistry{}
+	reg.set(true, map[string]string{"homelab-1": "one"})
+	r := testRotator(t, reg, fake.NewSimpleClientset())
+
+	// The kubelet updates the mounted htpasswd a little later
+	time.AfterFunc(100*time.Millisecond, func() {
+		reg.set(true, map[string]string{"homelab-2": "two", "homelab-1": "one"})
+	})
+	if err := r.verify(context.Background(), registryauth.Credential{Username: "homelab-2", Password: "two"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestActivate(t *testing.T) {
+	ready := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "docker-registry", Namespace: "container-registry"},
+		Status:     appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+	}
+	cred := registryauth.Credential{Username: "homelab-1", Password: "one"}
+
+	t.Run("reloads without a restart", func(t *testing.T) {
+		kube := fake.NewSimpleClientset(ready.DeepCopy())
+		reg := &testRegistry{}
+		reg.set(true, map[string]string{"homelab-1": "one"})
+		r := testRotator(t, reg, kube)
+
+		restarted, err := r.activate(context.Background(), time.Now(), cred, nil)
+		if err != nil || restarted {
+			t.Fatalf("restarted = %v, err = %v", restarted, err)
+		}
+		for _, action := range kube.Actions() {
+			if action.GetVerb() == "patch" {
+				t.Fatalf("restarted an enforcing registry: %v", action)
+			}
+		}
+	})
+
+	t.Run("restarts an open registry", func(t *testing.T) {
+		kube := fake.NewSimpleClientset(ready.DeepCopy())
+		reg := &testRegistry{}
+		reg.set(false, map[string]string{"homelab-1": "one"})
+		// The new pod starts with the htpasswd file and requires logins
+		kube.PrependReactor("patch", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+			reg.set(true, map[string]string{"homelab-1": "one"})
+			return false, nil, nil
+		})
+		r := testRotator(t, reg, kube)
+
+		restarted, err := r.activate(context.Background(), time.Now(), cred, nil)
+		if err != nil || !restarted {
+			t.Fatalf("restarted = %v, err = %v", restarted, err)
+		}
+	})
+}
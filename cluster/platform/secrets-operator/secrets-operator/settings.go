@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/homelab/internal/config"
+)
+
+// Settings are read at startup: defaults, then the -settings YAML file
+// (SETTINGS_FILE), then the environment, then flags
+type Settings struct {
+	Port      string `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+	Providers Config `json:"providers"`
+
+	// RotationInterval enables registry credential rotation when set; "0"
+	// only rotates on request
+	RotationInterval string         `json:"rotationInterval" env:"REGISTRY_ROTATION_INTERVAL" flag:"rotation-interval" usage:"time between registry credential rotations; 0 rotates on request only"`
+	Rotation         RotationConfig `json:"rotation"`
+	CA               CAConfig       `json:"ca"`
+
+	// APIToken guards rotation and certificate status; only read from the
+	// environment
+	APIToken string `json:"-" env:"API_TOKEN"`
+	// AllowUnauthenticated opens the API when no credentials are set;
+	// otherwise it refuses every request
+	AllowUnauthenticated bool `json:"allowUnauthenticated" env:"ALLOW_UNAUTHENTICATED" flag:"allow-unauthenticated"`
+}
+
+// Config holds provider endpoints and credentials; the credentials are only
+// read from the environment
+type Config struct {
+	VaultAddr        string `json:"vaultAddr" env:"VAULT_ADDR" flag:"vault-addr"`
+	VaultToken       string `json:"-" env:"VAULT_TOKEN"`
+	OnePasswordHost  string `json:"onePasswordHost" env:"OP_CONNECT_HOST" flag:"op-connect-host"`
+	OnePasswordToken string `json:"-" env:"OP_CONNECT_TOKEN"`
+	SOPSRoot         string `json:"sopsRoot" env:"SOPS_ROOT" flag:"sops-root"`
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		Port: "8080",
+		Rotation: RotationConfig{
+			Namespace:            "container-registry",
+			Deployment:           "docker-registry",
+			HtpasswdSecret:       "registry-htpasswd",
+			CredentialsSecret:    "registry-credentials",
+			Hosts:                []string{"registry.home.mcztest.com"},
+			RegistryURL:          "https://docker-registry.container-registry.svc.cluster.local:5000",
+			UserPrefix:           "homelab",
+			ExcludeNamespaces:    []string{"kube-system", "kube-public", "kube-node-lease"},
+			PatchServiceAccounts: true,
+		},
+		CA: CAConfig{
+			Namespace:         "secrets-operator",
+			BundleConfigMap:   "internal-ca",
+			CertDuration:      90 * 24 * time.Hour,
+			ClusterDomain:     "cluster.local",
+			ExcludeNamespaces: []string{"kube-public", "kube-node-lease"},
+		},
+	}
+}
+
+// loadSettings layers the file, environment, and flags over the defaults
+func loadSettings() (*Settings, error) {
+	s := defaultSettings()
+	if err := config.Load(s, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate implements config.Validator
+func (s *Settings) Validate() error {
+	if _, err := s.rotation(); err != nil {
+		return err
+	}
+	if s.CA.Secret != "" && s.CA.CertDuration < time.Hour {
+		return fmt.Errorf("invalid CERT_DURATION: must be at least 1h")
+	}
+	return nil
+}
+
+// rotation returns nil unless RotationInterval is set
+func (s *Settings) rotation() (*RotationConfig, error) {
+	if s.RotationInterval == "" {
+		return nil, nil
+	}
+	rotation := s.Rotation
+	if s.RotationInterval != "0" {
+		interval, err := time.ParseDuration(s.RotationInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REGISTRY_ROTATION_INTERVAL: %w", err)
+		}
+		rotation.Interval = interval
+	}
+	return &rotation, nil
+}
+
+// ca returns nil unless the CA Secret is set
+func (s *Settings) ca() *CAConfig {
+	if s.CA.Secret == "" {
+		return nil
+	}
+	return &s.CA
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const fieldManager = "secrets-operator"
+
+// syncClaim fetches the source data and applies the target Secret
+func (c *Controller) syncClaim(ctx context.Context, claim *SecretClaim) error {
+	provider, ok := c.providers[claim.Spec.Provider]
+	if !ok {
+		return c.setStatus(ctx, claim, nil, "ProviderNotConfigured",
+			fmt.Errorf("provider %q is not configured on the operator", claim.Spec.Provider))
+	}
+
+	remote, err := provider.Fetch(ctx, claim.Spec.Path)
+	if err != nil {
+		return c.setStatus(ctx, claim, nil, "FetchFailed", err)
+	}
+
+	data, err := mapKeys(claim, remote)
+	if err != nil {
+		return c.setStatus(ctx, claim, nil, "KeyMissing", err)
+	}
+
+	secret := renderSecret(claim, data)
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = c.kube.CoreV1().Secrets(claim.Namespace).Patch(ctx, secret.Name, types.ApplyPatchType, body,
+		metav1.PatchOptions{FieldManager: fieldManager, Force: &force})
+	if err != nil {
+		return c.setStatus(ctx, claim, nil, "ApplyFailed", fmt.Errorf("applying secret %s: %w", secret.Name, err))
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	log.Printf("Synced %s/%s from %s (%d keys)", claim.Namespace, secret.Name, claim.Spec.Provider, len(keys))
+	return c.setStatus(ctx, claim, keys, "Synced", nil)
+}
+
+// mapKeys applies spec.data; with no mappings every remote key is copied
+func mapKeys(claim *SecretClaim, remote map[string]string) (map[string]string, error) {
+	if len(claim.Spec.Data) == 0 {
+		return remote, nil
+	}
+
+	data := make(map[string]string, len(claim.Spec.Data))
+	for _, m := range claim.Spec.Data {
+		v, ok := remote[m.RemoteKey]
+		if !ok {
+			return nil, fmt.Errorf("key %q not found at %s", m.RemoteKey, claim.Spec.Path)
+		}
+		data[m.SecretKey] = v
+	}
+	return data, nil
+}
+
+func renderSecret(claim *SecretClaim, data map[string]string) *corev1.Secret {
+	name := claim.Spec.Target.Name
+	if name == "" {
+		name = claim.Name
+	}
+	secretType := corev1.SecretTypeOpaque
+	if claim.Spec.Target.Type != "" {
+		secretType = corev1.SecretType(claim.Spec.Target.Type)
+	}
+
+	labels := map[string]string{"app.kubernetes.io/managed-by": fieldManager}
+	for k, v := range claim.Spec.Target.Labels {
+		labels[k] = v
+	}
+
+	controller := true
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: claim.Namespace,
+			Labels:    labels,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: secretClaimGVR.GroupVersion().String(),
+				Kind:       "SecretClaim",
+				Name:       claim.Name,
+				UID:        claim.UID,
+				Controller: &controller,
+			}},
+		},
+		Type:       secretType,
+		StringData: data,
+	}
+}
+
+// setStatus records the sync outcome; cause is returned so failures are retried
+func (c *Controller) setStatus(ctx context.Context, claim *SecretClaim, keys []string, reason string, cause error) error {
+	cond := metav1.Condition{
+		Type:               "Synced",
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		ObservedGeneration: claim.Generation,
+		LastTransitionTime: metav1.Now(),
+	}
+	if cause != nil {
+		cond.Status = metav1.ConditionFalse
+		cond.Message = cause.Error()
+	} else {
+		now := metav1.Now()
+		claim.Status.LastSyncTime = &now
+		claim.Status.SyncedKeys = keys
+	}
+
+	replaced := false
+	for i, existing := range claim.Status.Conditions {
+		if existing.Type == cond.Type {
+			if existing.Status == cond.Status {
+				cond.LastTransitionTime = existing.LastTransitionTime
+			}
+			claim.Status.Conditions[i] = cond
+			replaced = true
+		}
+	}
+	if !replaced {
+		claim.Status.Conditions = append(claim.Status.Conditions, cond)
+	}
+	claim.Status.ObservedGeneration = claim.Generation
+
+	u, err := toUnstructured(claim)
+	if err != nil {
+		return err
+	}
+	if _, err := c.dynamic.Resource(secretClaimGVR).Namespace(claim.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{}); err != nil {
+		log.Printf("Failed to update status for %s/%s: %v", claim.Namespace, claim.Name, err)
+	}
+	return cause
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// secretClaimGVR identifies the SecretClaim custom resource
+var secretClaimGVR = schema.GroupVersionResource{
+	Group:    "homelab.mcztest.com",
+	Version:  "v1alpha1",
+	Resource: "secretclaims",
+}
+
+// SecretClaim declares a Secret populated from an external store
+type SecretClaim struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SecretClaimSpec   `json:"spec"`
+	Status SecretClaimStatus `json:"status,omitempty"`
+}
+
+// SecretClaimSpec selects the source and the shape of the target Secret
+type SecretClaimSpec struct {
+	Provider        string       `json:"provider"`
+	Path            string       `json:"path"`
+	Data            []KeyMapping `json:"data,omitempty"`
+	Target          TargetSpec   `json:"target,omitempty"`
+	RefreshInterval string       `json:"refreshInterval,omitempty"`
+}
+
+// KeyMapping copies remoteKey from the source into secretKey of the Secret
+type KeyMapping struct {
+	SecretKey string `json:"secretKey"`
+	RemoteKey string `json:"remoteKey"`
+}
+
+// TargetSpec describes the generated Secret
+type TargetSpec struct {
+	Name   string            `json:"name,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// SecretClaimStatus is written back after each sync
+type SecretClaimStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	LastSyncTime       *metav1.Time       `json:"lastSyncTime,omitempty"`
+	SyncedKeys         []string           `json:"syncedKeys,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+func fromUnstructured(u *unstructured.Unstructured) (*SecretClaim, error) {
+	var claim SecretClaim
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &claim); err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+func toUnstructured(claim *SecretClaim) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(claim)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// App is an entry in the app registry API
+type App struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+	Category    string `json:"category,omitempty"`
+}
+
+func newAppCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "app",
+		Short: "Manage apps in the app registry",
+	}
+	cmd.AddCommand(newAppListCmd())
+	cmd.AddCommand(newAppAddCmd())
+	cmd.AddCommand(newAppPortForwardCmd())
+	cmd.AddCommand(newAppExecCmd())
+	cmd.AddCommand(newAppLogsCmd())
+	return cmd
+}
+
+func newAppListCmd() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List registered apps",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+
+			apps, err := listApps(ctx)
+			if err != nil {
+				return err
+			}
+
+			if output == "json" {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(apps)
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tCATEGORY\tURL")
+			for _, app := range apps {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", app.Name, app.Category, app.URL)
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "output format (table or json)")
+	return cmd
+}
+
+func newAppAddCmd() *cobra.Command {
+	var app App
+
+	cmd := &cobra.Command{
+		Use:   "add <name>",
+		Short: "Register an app",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+
+			app.Name = args[0]
+			if app.URL == "" {
+				return fmt.Errorf("--url is required")
+			}
+
+			if err := ctx.registryClient().do(http.MethodPost, "/api/v1/apps", app, nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "App %s registered\n", app.Name)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&app.URL, "url", "", "app URL")
+	cmd.Flags().StringVar(&app.Description, "description", "", "short description")
+	cmd.Flags().StringVar(&app.Category, "category", "apps", "dashboard category")
+	return cmd
+}
+
+// listApps fetches all apps from the context's registry
+func listApps(ctx *Context) ([]App, error) {
+	return fetchApps(ctx.registryClient())
+}
+
+// fetchApps fetches all apps, accepting either a bare array or an {"apps": [...]} envelope
+func fetchApps(client *apiClient) ([]App, error) {
+	var raw json.RawMessage
+	if err := client.do(http.MethodGet, "/api/v1/apps", nil, &raw); err != nil {
+		return nil, err
+	}
+
+	var apps []App
+	if err := json.Unmarshal(raw, &apps); err == nil {
+		return apps, nil
+	}
+
+	var envelope struct {
+		Apps []App `json:"apps"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, fmt.Errorf("decoding app list: %w", err)
+	}
+	return envelope.Apps, nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// pushPayload is the subset of a Gitea push event the webhook receiver reads
+type pushPayload struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+	} `json:"repository"`
+	HeadCommit struct {
+		ID string `json:"id"`
+	} `json:"head_commit"`
+}
+
+func newBuildCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "build",
+		Short: "Trigger and inspect image builds",
+	}
+	cmd.AddCommand(newBuildTriggerCmd())
+	cmd.AddCommand(newBuildListCmd())
+	cmd.AddCommand(newBuildLogsCmd())
+	return cmd
+}
+
+func newBuildTriggerCmd() *cobra.Command {
+	var branch, commit string
+
+	cmd := &cobra.Command{
+		Use:               "trigger <owner/repo>",
+		Short:             "Trigger a build by sending a push event to the webhook receiver",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeRepos),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+
+			owner, repo, ok := strings.Cut(args[0], "/")
+			if !ok || owner == "" || repo == "" {
+				return fmt.Errorf("repository must be in owner/repo form, got %q", args[0])
+			}
+
+			// Resolve the branch head through the Gitea API unless a commit was given
+			if commit == "" {
+				var b struct {
+					Commit struct {
+						ID string `json:"id"`
+					} `json:"commit"`
+				}
+				path := fmt.Sprintf("/api/v1/repos/%s/%s/branches/%s", owner, repo, branch)
+				if err := ctx.giteaClient().do(http.MethodGet, path, nil, &b); err != nil {
+					return fmt.Errorf("resolving %s@%s: %w", args[0], branch, err)
+				}
+				commit = b.Commit.ID
+			}
+			if len(commit) < 7 {
+				return fmt.Errorf("commit %q is too short, need at least 7 characters", commit)
+			}
+
+			var payload pushPayload
+			payload.Ref = "refs/heads/" + branch
+			payload.Repository.Name = repo
+			payload.Repository.FullName = owner + "/" + repo
+			payload.Repository.CloneURL = fmt.Sprintf("%s/%s/%s.git", strings.TrimSuffix(ctx.Gitea, "/"), owner, repo)
+			payload.HeadCommit.ID = commit
+
+			// The receiver only takes pushes signed with its WEBHOOK_SECRET
+			var reply string
+			if err := ctx.webhookClient().do(http.MethodPost, "/webhook", payload, &reply); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), reply)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&branch, "branch", "b", "main", "branch to build")
+	cmd.Flags().StringVar(&commit, "commit", "", "commit SHA to build (defaults to the branch head)")
+	return cmd
+}
+
+func newBuildListCmd() *cobra.Command {
+	var app string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List recent build jobs",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+
+			jobs, err := listBuildJobs(cmd.Context(), client, ctx.BuildNamespace, app)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tAPP\tSTATUS\tAGE")
+			for _, job := range jobs {
+				age := time.Since(job.CreationTimestamp.Time).Round(time.Second)
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", job.Name, job.Labels["app-name"], jobStatus(&job), age)
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&app, "app", "", "only show builds for this app")
+	_ = cmd.RegisterFlagCompletionFunc("app", completeApps)
+	return cmd
+}
+
+func newBuildLogsCmd() *cobra.Command {
+	var follow bool
+
+	cmd := &cobra.Command{
+		Use:               "logs <job-or-app>",
+		Short:             "Print the logs of a build (or the latest build of an app)",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeBuilds),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+
+			job, err := resolveBuildJob(cmd.Context(), client, ctx.BuildNamespace, args[0])
+			if errors.Is(err, errNoBuildJob) {
+				// Runner builds have no job; the receiver keeps their log tail
+				return printBuildExcerpt(cmd.Context(), ctx.receiverClient(), args[0], follow, cmd.OutOrStdout())
+			}
+			if err != nil {
+				return err
+			}
+			return streamJobLogs(cmd.Context(), client, job, follow, cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "stream logs until the build finishes")
+	return cmd
+}
+
+// listBuildJobs returns build jobs, newest first, optionally filtered by app
+func listBuildJobs(ctx context.Context, client kubernetes.Interface, namespace, app string) ([]batchv1.Job, error) {
+	selector := "app=build-job"
+	if app != "" {
+		selector += ",app-name=" + app
+	}
+
+	list, err := client.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("listing build jobs: %w", err)
+	}
+
+	jobs := list.Items
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[j].CreationTimestamp.Before(&jobs[i].CreationTimestamp)
+	})
+	return jobs, nil
+}
+
+// errNoBuildJob means neither a job nor an app's jobs matched; builds run
+// by the runner pool have no job
+var errNoBuildJob = errors.New("no build job")
+
+// resolveBuildJob accepts either a job name or an app name and returns the
+// job, the app's latest when given an app
+func resolveBuildJob(ctx context.Context, client kubernetes.Interface, namespace, name string) (*batchv1.Job, error) {
+	if job, err := client.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil {
+		return job, nil
+	}
+
+	jobs, err := listBuildJobs(ctx, client, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%w or app named %q", errNoBuildJob, name)
+	}
+	return &jobs[0], nil
+}
+
+func jobStatus(job *batchv1.Job) string {
+	switch {
+	case job.Status.Succeeded > 0:
+		return "Succeeded"
+	case job.Status.Failed > 0:
+		return "Failed"
+	case job.Status.Active > 0:
+		return "Running"
+	default:
+		return "Pending"
+	}
+}
+
+// buildContainers lists the containers of a build job's pod in the order
+// they run: the init containers (clone, stage exports, all but the last
+// pipeline step), then the main container, kaniko or the last step
+func buildContainers(job *batchv1.Job) []string {
+	spec := job.Spec.Template.Spec
+	names := make([]string, 0, len(spec.InitContainers)+len(spec.Containers))
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, c := range containers {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// streamJobLogs copies the logs of the job's pod to out, one container after
+// another, with a header per container when there are several. Containers
+// that never ran, e.g. the steps after a failed one, are skipped.
+func streamJobLogs(ctx context.Context, client kubernetes.Interface, job *batchv1.Job, follow bool, out io.Writer) error {
+	pod, err := waitForJobPod(ctx, client, job.Namespace, job.Name, follow)
+	if err != nil {
+		return err
+	}
+
+	containers := buildContainers(job)
+	for _, container := range containers {
+		started, err := waitForContainer(ctx, client, job.Namespace, pod, container, follow)
+		if err != nil {
+			return err
+		}
+		if !started {
+			continue
+		}
+		if len(containers) > 1 {
+			fmt.Fprintf(out, "==> %s <==\n", container)
+		}
+
+		req := client.CoreV1().Pods(job.Namespace).GetLogs(pod, &corev1.PodLogOptions{
+			Container: container,
+			Follow:    follow,
+		})
+		stream, err := req.Stream(ctx)
+		if err != nil {
+			return fmt.Errorf("streaming logs for %s/%s: %w", pod, container, err)
+		}
+		_, err = io.Copy(out, stream)
+		stream.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForJobPod finds the job's pod, polling until it starts when follow is set
+func waitForJobPod(ctx context.Context, client kubernetes.Interface, namespace, jobName string, follow bool) (string, error) {
+	for {
+		pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "job-name=" + jobName,
+		})
+		if err != nil {
+			return "", fmt.Errorf("listing pods for %s: %w", jobName, err)
+		}
+
+		for _, pod := range pods.Items {
+			if pod.Status.Phase != corev1.PodPending {
+				return pod.Name, nil
+			}
+		}
+		if !follow {
+			return "", fmt.Errorf("build %s has no running pod yet", jobName)
+		}
+
+		fmt.Fprintf(os.Stderr, "Waiting for %s to start...\n", jobName)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// waitForContainer reports whether the container has started, and so has
+// logs. With follow set it polls until the container starts or the pod
+// finishes without running it.
+func waitForContainer(ctx context.Context, client kubernetes.Interface, namespace, podName, container string, follow bool) (bool, error) {
+	for {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("getting pod %s: %w", podName, err)
+		}
+
+		for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+			for _, cs := range statuses {
+				if cs.Name == container && (cs.State.Running != nil || cs.State.Terminated != nil) {
+					return true, nil
+				}
+			}
+		}
+		if !follow || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			return false, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// buildRecord is the part of a receiver build history entry pk8s reads
+type buildRecord struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	LogExcerpt string     `json:"logExcerpt,omitempty"`
+}
+
+// printBuildExcerpt prints the log tail the receiver recorded for a build,
+// or an app's latest build. Runner builds report it when they finish, so
+// with follow set this waits for that.
+func printBuildExcerpt(ctx context.Context, client *apiClient, name string, follow bool, out io.Writer) error {
+	for {
+		var rec buildRecord
+		if err := client.do(http.MethodGet, "/builds/"+url.PathEscape(name), nil, &rec); err != nil {
+			var recs []buildRecord
+			path := "/builds?limit=1&app=" + url.QueryEscape(name)
+			if err := client.do(http.MethodGet, path, nil, &recs); err != nil || len(recs) == 0 {
+				return fmt.Errorf("no build job, build, or app named %q", name)
+			}
+			rec = recs[0]
+		}
+
+		if rec.FinishedAt != nil {
+			fmt.Fprintln(out, rec.LogExcerpt)
+			return nil
+		}
+		if !follow {
+			return fmt.Errorf("build %s is %s on the runner pool; its log is available when it finishes", rec.ID, strings.ToLower(rec.Status))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
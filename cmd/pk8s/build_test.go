@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testBuildJob(name, app string, created time.Time, init []string, main string) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "container-registry",
+			Labels:            map[string]string{"app": "build-job", "app-name": app},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+	}
+	spec := &job.Spec.Template.Spec
+	for _, c := range init {
+		spec.InitContainers = append(spec.InitContainers, corev1.Container{Name: c})
+	}
+	spec.Containers = []corev1.Container{{Name: main}}
+	return job
+}
+
+func TestBuildTrigger(t *testing.T) {
+	gitea := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/repos/homelab/my-app/branches/dev" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"commit": {"id": "0123456789abcdef"}}`)
+	}))
+	defer gitea.Close()
+
+	var payload pushPayload
+	var signature string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Gitea-Signature")
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "Build job created: build-my-app-0123456")
+	}))
+	defer receiver.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	cfg := &Config{CurrentContext: "test", Contexts: []Context{{
+		Name: "test", Receiver: receiver.URL, Gitea: gitea.URL + "/", WebhookSecret: "s3cret",
+	}}}
+	if err := cfg.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runPk8s(t, path, "build", "trigger", "homelab/my-app", "--branch", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "build-my-app-0123456") {
+		t.Fatalf("output = %q", out)
+	}
+	var want pushPayload
+	want.Ref = "refs/heads/dev"
+	want.Repository.Name = "my-app"
+	want.Repository.FullName = "homelab/my-app"
+	want.Repository.CloneURL = gitea.URL + "/homelab/my-app.git"
+	want.HeadCommit.ID = "0123456789abcdef"
+	if payload != want {
+		t.Fatalf("payload = %+v, want %+v", payload, want)
+	}
+	if signature == "" {
+		t.Fatal("push event not signed")
+	}
+
+	// A given commit skips the branch lookup
+	if _, err := runPk8s(t, path, "build", "trigger", "homelab/my-app", "--commit", "fedcba9"); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Ref != "refs/heads/main" || payload.HeadCommit.ID != "fedcba9" {
+		t.Fatalf("payload = %+v", payload)
+	}
+
+	for _, args := range [][]string{
+		{"build", "trigger", "my-app"},
+		{"build", "trigger", "homelab/my-app", "--commit", "abc"},
+	} {
+		if _, err := runPk8s(t, path, args...); err == nil {
+			t.Fatalf("%v succeeded", args)
+		}
+	}
+}
+
+func TestResolveBuildJob(t *testing.T) {
+	now := time.Now()
+	client := fake.NewSimpleClientset(
+		testBuildJob("build-my-app-1111111", "my-app", now.Add(-time.Hour), nil, "kaniko"),
+		testBuildJob("build-my-app-2222222", "my-app", now, nil, "kaniko"),
+		testBuildJob("build-other-3333333", "other", now.Add(time.Minute), nil, "kaniko"),
+	)
+
+	for name, want := range map[string]string{
+		"build-my-app-1111111": "build-my-app-1111111",
+		"my-app":               "build-my-app-2222222",
+		"other":                "build-other-3333333",
+	} {
+		job, err := resolveBuildJob(context.Background(), client, "container-registry", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Name != want {
+			t.Fatalf("resolveBuildJob(%s) = %s, want %s", name, job.Name, want)
+		}
+	}
+
+	if _, err := resolveBuildJob(context.Background(), client, "container-registry", "missing"); !errors.Is(err, errNoBuildJob) {
+		t.Fatalf("err = %v, want errNoBuildJob", err)
+	}
+}
+
+func TestStreamJobLogs(t *testing.T) {
+	terminated := func(name string, code int32) corev1.ContainerStatus {
+		return corev1.ContainerStatus{Name: name, State: corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{ExitCode: code},
+		}}
+	}
+	waiting := func(name string) corev1.ContainerStatus {
+		return corev1.ContainerStatus{Name: name, State: corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		job     *batchv1.Job
+		status  corev1.PodStatus
+		want    []string
+		headers bool
+	}{
+		{
+			name: "plain build",
+			job:  testBuildJob("build-my-app-0123456", "my-app", time.Now(), nil, "kaniko"),
+			status: corev1.PodStatus{
+				Phase:             corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "kaniko", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}},
+			},
+			want: []string{"kaniko"},
+		},
+		{
+			name: "pipeline stops at the failed step",
+			job:  testBuildJob("build-my-app-0123456", "my-app", time.Now(), []string{"clone", "test", "build"}, "deploy"),
+			status: corev1.PodStatus{
+				Phase:                 corev1.PodFailed,
+				InitContainerStatuses: []corev1.ContainerStatus{terminated("clone", 0), terminated("test", 1), waiting("build")},
+				ContainerStatuses:     []corev1.ContainerStatus{waiting("deploy")},
+			},
+			want:    []string{"clone", "test"},
+			headers: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      tt.job.Name + "-abcde",
+					Namespace: tt.job.Namespace,
+					Labels:    map[string]string{"job-name": tt.job.Name},
+				},
+				Status: tt.status,
+			}
+			client := fake.NewSimpleClientset(tt.job, pod)
+
+			var out bytes.Buffer
+			if err := streamJobLogs(context.Background(), client, tt.job, true, &out); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, action := range client.Actions() {
+				if action.GetSubresource() == "log" {
+					opts := action.(k8stesting.GenericAction).GetValue().(*corev1.PodLogOptions)
+					got = append(got, opts.Container)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("streamed %v, want %v", got, tt.want)
+			}
+			if hasHeader := strings.Contains(out.String(), "==> "+tt.want[0]+" <=="); hasHeader != tt.headers {
+				t.Fatalf("output = %q", out.String())
+			}
+		})
+	}
+}
+
+func TestPrintBuildExcerpt(t *testing.T) {
+	finished := time.Now()
+	builds := map[string]buildRecord{
+		"build-my-app-0123456": {ID: "build-my-app-0123456", Status: "succeeded", FinishedAt: &finished, LogExcerpt: "Pushed image"},
+		"build-my-app-fedcba9": {ID: "build-my-app-fedcba9", Status: "running"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app := r.URL.Query().Get("app"); r.URL.Path == "/builds" && app == "my-app" {
+			json.NewEncoder(w).Encode([]buildRecord{builds["build-my-app-0123456"]})
+			return
+		}
+		rec, ok := builds[strings.TrimPrefix(r.URL.Path, "/builds/")]
+		if !ok {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(rec)
+	}))
+	defer srv.Close()
+	client := newAPIClient(srv.URL, "", false)
+
+	for _, name := range []string{"build-my-app-0123456", "my-app"} {
+		var out bytes.Buffer
+		if err := printBuildExcerpt(context.Background(), client, name, false, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != "Pushed image\n" {
+			t.Fatalf("%s: output = %q", name, out.String())
+		}
+	}
+
+	err := printBuildExcerpt(context.Background(), client, "build-my-app-fedcba9", false, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "is running on the runner pool") {
+		t.Fatalf("err = %v", err)
+	}
+	if err := printBuildExcerpt(context.Background(), client, "missing", false, io.Discard); err == nil {
+		t.Fatal("printed a build that does not exist")
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+// bundleVersion is bumped when the bundle layout changes incompatibly
+const bundleVersion = 1
+
+// Bundle is bundle.json, the index of an exported app
+type Bundle struct {
+	Version    int       `json:"version"`
+	App        App       `json:"app"`
+	Namespace  string    `json:"namespace"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// Manifests are applied in order on import
+	Manifests []string      `json:"manifests"`
+	Images    []BundleImage `json:"images"`
+}
+
+// BundleImage is an image saved with crane pull
+type BundleImage struct {
+	Ref  string `json:"ref"`
+	File string `json:"file"`
+}
+
+// bundleKind is a resource exported with an app
+type bundleKind struct {
+	kind     string
+	resource schema.GroupVersionResource
+}
+
+// bundleKinds are exported in the order they are applied on import: config
+// before the workloads that read it
+var bundleKinds = []bundleKind{
+	{"ConfigMap", schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}},
+	{"Secret", schema.GroupVersionResource{Version: "v1", Resource: "secrets"}},
+	{"Application", schema.GroupVersionResource{Group: "homelab.mcztest.com", Version: "v1alpha1", Resource: "applications"}},
+	{"Deployment", schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}},
+	{"Service", schema.GroupVersionResource{Version: "v1", Resource: "services"}},
+	{"Ingress", schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}},
+}
+
+func bundleResource(kind string) (schema.GroupVersionResource, bool) {
+	for _, k := range bundleKinds {
+		if k.kind == kind {
+			return k.resource, true
+		}
+	}
+	return schema.GroupVersionResource{}, false
+}
+
+func newExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export apps to offline bundles",
+	}
+	cmd.AddCommand(newExportAppCmd())
+	return cmd
+}
+
+func newImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Restore apps from offline bundles",
+	}
+	cmd.AddCommand(newImportAppCmd())
+	return cmd
+}
+
+func newExportAppCmd() *cobra.Command {
+	var (
+		namespace      string
+		output         string
+		platform       string
+		includeSecrets bool
+	)
+
+	cmd := &cobra.Command{
+		Use:               "app <name>",
+		Short:             "Write an app's manifests, images, and registry entry to a tarball",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeApps),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			name := args[0]
+			if output == "" {
+				output = name + ".tar.gz"
+			}
+
+			app, err := registryApp(ctx, name)
+			if err != nil {
+				return err
+			}
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+			dyn, err := ctx.dynamicClient()
+			if err != nil {
+				return err
+			}
+			deployment, err := findDeployment(cmd.Context(), ctx, client, name, namespace)
+			if err != nil {
+				return err
+			}
+
+			objects, skipped, err := collectObjects(cmd.Context(), dyn, name, deployment.Namespace, &deployment.Spec.Template.Spec, includeSecrets)
+			if err != nil {
+				return err
+			}
+			for _, s := range skipped {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Skipping Secret %s (use --include-secrets)\n", s)
+			}
+
+			tmp, err := os.MkdirTemp("", "pk8s-export-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmp)
+
+			bundle := &Bundle{Version: bundleVersion, App: *app, Namespace: deployment.Namespace, ExportedAt: time.Now().UTC()}
+			for i, ref := range bundleImages(&deployment.Spec.Template.Spec) {
+				file := fmt.Sprintf("images/%02d.tar", i)
+				fmt.Fprintf(cmd.ErrOrStderr(), "Pulling %s\n", ref)
+				if err := crane(ctx, platform, "pull", ref, filepath.Join(tmp, filepath.Base(file))); err != nil {
+					return fmt.Errorf("pulling %s: %w", ref, err)
+				}
+				bundle.Images = append(bundle.Images, BundleImage{Ref: ref, File: file})
+			}
+
+			manifests := make(map[string][]byte)
+			for i, obj := range objects {
+				data, err := yaml.Marshal(obj.Object)
+				if err != nil {
+					return err
+				}
+				file := fmt.Sprintf("manifests/%02d-%s-%s.yaml", i, strings.ToLower(obj.GetKind()), obj.GetName())
+				bundle.Manifests = append(bundle.Manifests, file)
+				manifests[file] = data
+			}
+
+			if err := writeBundle(output, bundle, manifests, tmp); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Exported %s (%d objects, %d images) to %s\n", name, len(objects), len(bundle.Images), output)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "namespace (default: search all, preferring the context's app namespace)")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "bundle path (default <name>.tar.gz)")
+	cmd.Flags().StringVar(&platform, "platform", "linux/amd64", "image platform to save")
+	cmd.Flags().BoolVar(&includeSecrets, "include-secrets", false, "export the Secrets the app references (stored unencrypted)")
+	return cmd
+}
+
+func newImportAppCmd() *cobra.Command {
+	var (
+		namespace    string
+		skipImages   bool
+		skipRegistry bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "app <bundle.tar.gz>",
+		Short: "Push a bundle's images, apply its manifests, and register the app",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			tmp, err := os.MkdirTemp("", "pk8s-import-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmp)
+
+			bundle, err := extractBundle(args[0], tmp)
+			if err != nil {
+				return err
+			}
+			if namespace == "" {
+				namespace = bundle.Namespace
+			}
+
+			if !skipImages {
+				for _, image := range bundle.Images {
+					ref := pushRef(image.Ref)
+					fmt.Fprintf(cmd.ErrOrStderr(), "Pushing %s\n", ref)
+					if err := crane(ctx, "", "push", filepath.Join(tmp, image.File), ref); err != nil {
+						return fmt.Errorf("pushing %s: %w", ref, err)
+					}
+				}
+			}
+
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+			dyn, err := ctx.dynamicClient()
+			if err != nil {
+				return err
+			}
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+			if _, err := client.CoreV1().Namespaces().Create(cmd.Context(), ns, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+				return fmt.Errorf("creating namespace %s: %w", namespace, err)
+			}
+
+			for _, file := range bundle.Manifests {
+				data, err := os.ReadFile(filepath.Join(tmp, file))
+				if err != nil {
+					return err
+				}
+				obj := &unstructured.Unstructured{}
+				if err := yaml.Unmarshal(data, &obj.Object); err != nil {
+					return fmt.Errorf("decoding %s: %w", file, err)
+				}
+				if err := applyBundleObject(cmd.Context(), dyn, namespace, obj); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Applied %s %s/%s\n", obj.GetKind(), namespace, obj.GetName())
+			}
+
+			if !skipRegistry {
+				if _, err := registryApp(ctx, bundle.App.Name); err == nil {
+					fmt.Fprintf(cmd.OutOrStdout(), "App %s already registered\n", bundle.App.Name)
+				} else if err := ctx.registryClient().do(http.MethodPost, "/api/v1/apps", bundle.App, nil); err != nil {
+					return fmt.Errorf("registering app: %w", err)
+				} else {
+					fmt.Fprintf(cmd.OutOrStdout(), "App %s registered\n", bundle.App.Name)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "namespace to restore into (default: the exported one)")
+	cmd.Flags().BoolVar(&skipImages, "skip-images", false, "do not push the bundled images")
+	cmd.Flags().BoolVar(&skipRegistry, "skip-registry", false, "do not register the app")
+	return cmd
+}
+
+// collectObjects gathers the app's labelled objects and the ConfigMaps and
+// Secrets its pods reference. Objects the app operator renders from an
+// Application are left to it. Secrets are only returned with
+// includeSecrets; otherwise their names are returned as skipped.
+func collectObjects(ctx context.Context, dyn dynamic.Interface, name, namespace string, pod *corev1.PodSpec, includeSecrets bool) ([]*unstructured.Unstructured, []string, error) {
+	referenced := podConfigRefs(pod)
+	var objects []*unstructured.Unstructured
+	var skipped []string
+	seen := make(map[string]bool)
+
+	for _, k := range bundleKinds {
+		client := dyn.Resource(k.resource).Namespace(namespace)
+		var items []unstructured.Unstructured
+		if k.kind == "Application" {
+			obj, err := client.Get(ctx, name, metav1.GetOptions{})
+			// NotFound also covers clusters without the app operator's CRD
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("getting application: %w", err)
+			}
+			items = []unstructured.Unstructured{*obj}
+		} else {
+			list, err := client.List(ctx, metav1.ListOptions{LabelSelector: instanceSelector(name)})
+			if err != nil {
+				return nil, nil, fmt.Errorf("listing %s: %w", k.resource.Resource, err)
+			}
+			items = list.Items
+			for _, ref := range referenced[k.kind] {
+				obj, err := client.Get(ctx, ref, metav1.GetOptions{})
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				if err != nil {
+					return nil, nil, fmt.Errorf("getting %s %s: %w", k.kind, ref, err)
+				}
+				items = append(items, *obj)
+			}
+		}
+
+		for i := range items {
+			obj := &items[i]
+			key := k.kind + "/" + obj.GetName()
+			if seen[key] || ownedByApplication(obj) {
+				continue
+			}
+			seen[key] = true
+			if k.kind == "Secret" && !includeSecrets {
+				skipped = append(skipped, obj.GetName())
+				continue
+			}
+			// Service account tokens are recreated by the cluster
+			if k.kind == "Secret" && strings.HasPrefix(fmt.Sprint(obj.Object["type"]), "kubernetes.io/service-account-token") {
+				continue
+			}
+			objects = append(objects, cleanObject(obj))
+		}
+	}
+	return objects, skipped, nil
+}
+
+// podConfigRefs lists the ConfigMaps and Secrets a pod reads, by kind
+func podConfigRefs(pod *corev1.PodSpec) map[string][]string {
+	refs := make(map[string][]string)
+	add := func(kind, name string) {
+		if name != "" && !contains(refs[kind], name) {
+			refs[kind] = append(refs[kind], name)
+		}
+	}
+	for _, c := range append(append([]corev1.Container{}, pod.InitContainers...), pod.Containers...) {
+		for _, e := range c.Env {
+			if e.ValueFrom == nil {
+				continue
+			}
+			if r := e.ValueFrom.ConfigMapKeyRef; r != nil {
+				add("ConfigMap", r.Name)
+			}
+			if r := e.ValueFrom.SecretKeyRef; r != nil {
+				add("Secret", r.Name)
+			}
+		}
+		for _, e := range c.EnvFrom {
+			if e.ConfigMapRef != nil {
+				add("ConfigMap", e.ConfigMapRef.Name)
+			}
+			if e.SecretRef != nil {
+				add("Secret", e.SecretRef.Name)
+			}
+		}
+	}
+	for _, v := range pod.Volumes {
+		if v.ConfigMap != nil {
+			add("ConfigMap", v.ConfigMap.Name)
+		}
+		if v.Secret != nil {
+			add("Secret", v.Secret.SecretName)
+		}
+	}
+	for _, s := range pod.ImagePullSecrets {
+		add("Secret", s.Name)
+	}
+	return refs
+}
+
+func ownedByApplication(obj *unstructured.Unstructured) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Kind == "Application" && strings.HasPrefix(ref.APIVersion, "homelab.mcztest.com/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanObject drops the fields the API server assigns, so the manifest can be
+// applied to another cluster
+func cleanObject(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	out := &unstructured.Unstructured{Object: runtime.DeepCopyJSON(obj.Object)}
+	delete(out.Object, "status")
+	for _, field := range []string{"uid", "resourceVersion", "generation", "creationTimestamp", "managedFields", "ownerReferences", "namespace"} {
+		unstructured.RemoveNestedField(out.Object, "metadata", field)
+	}
+	for _, annotation := range []string{"deployment.kubernetes.io/revision", "kubectl.kubernetes.io/last-applied-configuration"} {
+		unstructured.RemoveNestedField(out.Object, "metadata", "annotations", annotation)
+	}
+	if out.GetKind() == "Service" {
+		for _, field := range []string{"clusterIP", "clusterIPs"} {
+			unstructured.RemoveNestedField(out.Object, "spec", field)
+		}
+	}
+	return out
+}
+
+// bundleImages lists the pod's distinct container images
+func bundleImages(pod *corev1.PodSpec) []string {
+	var images []string
+	for _, c := range append(append([]corev1.Container{}, pod.InitContainers...), pod.Containers...) {
+		if !contains(images, c.Image) {
+			images = append(images, c.Image)
+		}
+	}
+	return images
+}
+
+// pushRef is where a saved image is pushed back: its tag, or a restore tag
+// for a digest-only reference (the digest is unchanged, so the manifests
+// still resolve)
+func pushRef(ref string) string {
+	repo, _, pinned := strings.Cut(ref, "@")
+	if !pinned {
+		return ref
+	}
+	if strings.Contains(repo[strings.LastIndex(repo, "/")+1:], ":") {
+		return repo
+	}
+	return repo + ":pk8s-restore"
+}
+
+// crane runs the crane CLI, plain HTTP and unverified TLS allowed for
+// insecure contexts
+func crane(ctx *Context, platform string, args ...string) error {
+	if ctx.Insecure {
+		args = append(args, "--insecure")
+	}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	cmd := exec.Command("crane", args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("crane %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// applyBundleObject server-side applies obj into namespace
+func applyBundleObject(ctx context.Context, dyn dynamic.Interface, namespace string, obj *unstructured.Unstructured) error {
+	resource, ok := bundleResource(obj.GetKind())
+	if !ok {
+		return fmt.Errorf("unsupported kind %s in bundle", obj.GetKind())
+	}
+	obj.SetNamespace(namespace)
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = dyn.Resource(resource).Namespace(namespace).Patch(ctx, obj.GetName(), types.ApplyPatchType, data,
+		metav1.PatchOptions{FieldManager: "pk8s", Force: &force})
+	if err != nil {
+		return fmt.Errorf("applying %s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+	return nil
+}
+
+// writeBundle writes bundle.json, the manifests, and the pulled image
+// tarballs from imageDir to a gzipped tarball at path
+func writeBundle(path string, bundle *Bundle, manifests map[string][]byte, imageDir string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	index, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "bundle.json", int64(len(index)), bytes.NewReader(index)); err != nil {
+		return err
+	}
+	for _, file := range bundle.Manifests {
+		data := manifests[file]
+		if err := writeTarFile(tw, file, int64(len(data)), bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	for _, image := range bundle.Images {
+		src, err := os.Open(filepath.Join(imageDir, filepath.Base(image.File)))
+		if err != nil {
+			return err
+		}
+		info, err := src.Stat()
+		if err == nil {
+			err = writeTarFile(tw, image.File, info.Size(), src)
+		}
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0o644, Size: size, ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// extractBundle unpacks the bundle at path into dir and reads its index
+func extractBundle(path, dir string) (*Bundle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading bundle: %w", err)
+		}
+		target := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return nil, err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "bundle.json"))
+	if err != nil {
+		return nil, fmt.Errorf("bundle has no bundle.json: %w", err)
+	}
+	var bundle Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("decoding bundle.json: %w", err)
+	}
+	if bundle.Version != bundleVersion {
+		return nil, fmt.Errorf("bundle version %d is not supported (want %d)", bundle.Version, bundleVersion)
+	}
+	return &bundle, nil
+}
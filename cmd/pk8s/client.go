@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// apiClient is a small JSON-over-HTTP client for the platform APIs
+type apiClient struct {
+	baseURL string
+	token   string
+	// webhookSecret signs request bodies as Gitea does, in X-Gitea-Signature
+	webhookSecret string
+	http          *http.Client
+}
+
+func newAPIClient(baseURL, token string, insecure bool) *apiClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &apiClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+// do sends body (if non-nil) as JSON and decodes a JSON response into out (if non-nil)
+func (c *apiClient) do(method, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.webhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(c.webhookSecret))
+		mac.Write(data)
+		req.Header.Set("X-Gitea-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if s, ok := out.(*string); ok {
+		*s = string(data)
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (ctx *Context) receiverClient() *apiClient {
+	return newAPIClient(ctx.Receiver, ctx.Token, ctx.Insecure)
+}
+
+// webhookClient posts to the receiver's /webhook, signed with the
+// context's WebhookSecret like a Gitea delivery
+func (ctx *Context) webhookClient() *apiClient {
+	c := ctx.receiverClient()
+	c.webhookSecret = ctx.WebhookSecret
+	return c
+}
+
+func (ctx *Context) registryClient() *apiClient {
+	return newAPIClient(ctx.Registry, ctx.Token, ctx.Insecure)
+}
+
+func (ctx *Context) giteaClient() *apiClient {
+	return newAPIClient(ctx.Gitea, ctx.GiteaToken, ctx.Insecure)
+}
+
+// kubeClient builds a clientset from the context's kubeconfig settings
+func (ctx *Context) kubeClient() (kubernetes.Interface, error) {
+	config, err := ctx.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// dynamicClient builds a dynamic client for the kinds pk8s has no typed
+// client for, e.g. Applications
+func (ctx *Context) dynamicClient() (dynamic.Interface, error) {
+	config, err := ctx.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// restConfig loads the context's kubeconfig, for streaming APIs that need
+// more than a clientset
+func (ctx *Context) restConfig() (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if ctx.Kubeconfig != "" {
+		rules.ExplicitPath = ctx.Kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: ctx.KubeContext}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading kubeconfig: %w", err)
+	}
+	return config, nil
+}
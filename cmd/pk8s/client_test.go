@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookClientSignsBody(t *testing.T) {
+	var signature string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Gitea-Signature")
+		body, _ = io.ReadAll(r.Body)
+		io.WriteString(w, "queued")
+	}))
+	defer srv.Close()
+
+	ctx := &Context{Receiver: srv.URL, WebhookSecret: "s3cret"}
+	var reply string
+	if err := ctx.webhookClient().do(http.MethodPost, "/webhook", map[string]string{"ref": "refs/heads/main"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "queued" {
+		t.Fatalf("reply = %q", reply)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if want := hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Fatalf("X-Gitea-Signature = %q, want %q", signature, want)
+	}
+
+	signature = "unset"
+	if err := ctx.receiverClient().do(http.MethodPost, "/webhook", map[string]string{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if signature != "" {
+		t.Fatalf("receiver API call signed: %q", signature)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// completionTimeout keeps a slow or unreachable API from hanging the shell
+const completionTimeout = 3 * time.Second
+
+// completionFunc is the signature cobra calls for argument and flag values
+type completionFunc func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective)
+
+// firstArg completes only the command's first argument
+func firstArg(complete completionFunc) completionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return complete(cmd, args, toComplete)
+	}
+}
+
+// completionClient is an API client with a short timeout
+func completionClient(c *apiClient) *apiClient {
+	c.http.Timeout = completionTimeout
+	return c
+}
+
+// completeApps offers app names from the app registry of the context
+// selected by --context, described by their URL
+func completeApps(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	ctx, err := loadContext()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	apps, err := fetchApps(completionClient(ctx.registryClient()))
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var names []string
+	for _, app := range apps {
+		if strings.HasPrefix(app.Name, toComplete) {
+			names = append(names, app.Name+"\t"+app.URL)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeBuilds offers build job names, newest first and described by app
+// and status, then the apps they belong to
+func completeBuilds(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	ctx, err := loadContext()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	client, err := ctx.kubeClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+	jobs, err := listBuildJobs(reqCtx, client, ctx.BuildNamespace, "")
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var names, apps []string
+	seen := make(map[string]bool)
+	for _, job := range jobs {
+		if strings.HasPrefix(job.Name, toComplete) {
+			names = append(names, fmt.Sprintf("%s\t%s %s", job.Name, job.Labels["app-name"], jobStatus(&job)))
+		}
+		app := job.Labels["app-name"]
+		if app != "" && !seen[app] && strings.HasPrefix(app, toComplete) {
+			seen[app] = true
+			apps = append(apps, app+"\tlatest build")
+		}
+	}
+	return append(names, apps...), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeRepos offers owner/repo names from Gitea matching what has been
+// typed so far
+func completeRepos(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	ctx, err := loadContext()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	// Gitea searches repo names, not owners
+	query := toComplete
+	if _, name, ok := strings.Cut(toComplete, "/"); ok {
+		query = name
+	}
+	var result struct {
+		Data []struct {
+			FullName    string `json:"full_name"`
+			Description string `json:"description"`
+		} `json:"data"`
+	}
+	path := "/api/v1/repos/search?limit=50&q=" + url.QueryEscape(query)
+	if err := completionClient(ctx.giteaClient()).do(http.MethodGet, path, nil, &result); err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var repos []string
+	for _, r := range result.Data {
+		if strings.HasPrefix(r.FullName, toComplete) {
+			repos = append(repos, r.FullName+"\t"+r.Description)
+		}
+	}
+	return repos, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeContexts offers the context names in the config file
+func completeContexts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var names []string
+	for _, c := range cfg.Contexts {
+		if strings.HasPrefix(c.Name, toComplete) {
+			names = append(names, c.Name+"\t"+c.Receiver)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
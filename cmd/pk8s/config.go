@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the on-disk pk8s configuration, modelled after kubeconfig:
+// a list of named contexts plus the one currently in use
+type Config struct {
+	CurrentContext string    `json:"current-context"`
+	Contexts       []Context `json:"contexts"`
+}
+
+// Context holds the endpoints and credentials for one platform installation
+type Context struct {
+	Name string `json:"name"`
+
+	// Platform API endpoints
+	Receiver string `json:"receiver,omitempty"`
+	Registry string `json:"registry,omitempty"`
+	Gitea    string `json:"gitea,omitempty"`
+
+	// Bearer token sent to the receiver and registry APIs
+	Token string `json:"token,omitempty"`
+	// Gitea API token used to resolve branch heads
+	GiteaToken string `json:"giteaToken,omitempty"`
+	// Secret set on created webhooks, the receiver's WEBHOOK_SECRET
+	WebhookSecret string `json:"webhookSecret,omitempty"`
+
+	// Kubernetes access for logs and deploy status
+	Kubeconfig     string `json:"kubeconfig,omitempty"`
+	KubeContext    string `json:"kubeContext,omitempty"`
+	BuildNamespace string `json:"buildNamespace,omitempty"`
+	AppNamespace   string `json:"appNamespace,omitempty"`
+
+	// templates/ directory of the platform repo used by pk8s new app
+	Templates string `json:"templates,omitempty"`
+
+	// Skip TLS verification for self-signed homelab endpoints
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// defaultContext mirrors the in-cluster defaults used by the platform services
+var defaultContext = Context{
+	Name:           "default",
+	Receiver:       "http://webhook-receiver.container-registry.svc.cluster.local",
+	Registry:       "https://registry-api.home.mcztest.com",
+	Gitea:          "https://gitea.home.mcztest.com",
+	BuildNamespace: "container-registry",
+	AppNamespace:   "apps",
+}
+
+func defaultConfigPath() string {
+	if p := os.Getenv("PK8S_CONFIG"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".pk8s.yaml"
+	}
+	return filepath.Join(home, ".pk8s", "config.yaml")
+}
+
+// LoadConfig reads the config file, returning an empty config if it does not exist
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Save writes the config file, creating its directory if needed
+func (c *Config) Save(path string) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// Resolve returns the named context (or the current one) with defaults filled in
+func (c *Config) Resolve(name string) (*Context, error) {
+	if name == "" {
+		name = c.CurrentContext
+	}
+
+	ctx := defaultContext
+	if name != "" {
+		found := c.context(name)
+		if found == nil {
+			return nil, fmt.Errorf("context %q not found in %s", name, configPath)
+		}
+		ctx = *found
+	}
+
+	if ctx.Receiver == "" {
+		ctx.Receiver = defaultContext.Receiver
+	}
+	if ctx.Registry == "" {
+		ctx.Registry = defaultContext.Registry
+	}
+	if ctx.Gitea == "" {
+		ctx.Gitea = defaultContext.Gitea
+	}
+	if ctx.BuildNamespace == "" {
+		ctx.BuildNamespace = defaultContext.BuildNamespace
+	}
+	if ctx.AppNamespace == "" {
+		ctx.AppNamespace = defaultContext.AppNamespace
+	}
+	return &ctx, nil
+}
+
+// context returns the named context as stored, or nil
+func (c *Config) context(name string) *Context {
+	for i := range c.Contexts {
+		if c.Contexts[i].Name == name {
+			return &c.Contexts[i]
+		}
+	}
+	return nil
+}
+
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the pk8s configuration",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "view",
+		Short: "Print the resolved active context",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			if ctx.Token != "" {
+				ctx.Token = "REDACTED"
+			}
+			if ctx.GiteaToken != "" {
+				ctx.GiteaToken = "REDACTED"
+			}
+			if ctx.WebhookSecret != "" {
+				ctx.WebhookSecret = "REDACTED"
+			}
+			data, err := yaml.Marshal(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(cmd.OutOrStdout(), string(data))
+			return nil
+		},
+	})
+
+	return cmd
+}
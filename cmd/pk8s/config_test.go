@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runPk8s runs the root command against the config file at path
+func runPk8s(t *testing.T, path string, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	root := newRootCmd()
+	root.SetOut(&out)
+	root.SetErr(&out)
+	root.SetArgs(append([]string{"--config", path}, args...))
+	err := root.Execute()
+	return out.String(), err
+}
+
+func TestResolve(t *testing.T) {
+	cfg := &Config{
+		CurrentContext: "home",
+		Contexts: []Context{
+			{Name: "home", Receiver: "https://receiver.home.example.com", BuildNamespace: "builds"},
+			{Name: "lab", Gitea: "https://gitea.lab.example.com"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		cfg     *Config
+		context string
+		want    Context
+		wantErr string
+	}{
+		{
+			name: "no config",
+			cfg:  &Config{},
+			want: defaultContext,
+		},
+		{
+			name: "current context with defaults filled in",
+			cfg:  cfg,
+			want: Context{
+				Name:           "home",
+				Receiver:       "https://receiver.home.example.com",
+				Registry:       defaultContext.Registry,
+				Gitea:          defaultContext.Gitea,
+				BuildNamespace: "builds",
+				AppNamespace:   defaultContext.AppNamespace,
+			},
+		},
+		{
+			name:    "named context overrides the current one",
+			cfg:     cfg,
+			context: "lab",
+			want: Context{
+				Name:           "lab",
+				Receiver:       defaultContext.Receiver,
+				Registry:       defaultContext.Registry,
+				Gitea:          "https://gitea.lab.example.com",
+				BuildNamespace: defaultContext.BuildNamespace,
+				AppNamespace:   defaultContext.AppNamespace,
+			},
+		},
+		{
+			name:    "unknown context",
+			cfg:     cfg,
+			context: "prod",
+			wantErr: `context "prod" not found`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.Resolve(tt.context)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Fatalf("context = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCtxCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	if _, err := runPk8s(t, path, "ctx", "set", "home", "--receiver", "https://receiver.example.com", "--token", "t0ken"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runPk8s(t, path, "ctx", "set", "lab", "--gitea", "https://gitea.lab.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the flags given change an existing context
+	if _, err := runPk8s(t, path, "ctx", "set", "home", "--insecure"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CurrentContext != "home" {
+		t.Fatalf("current-context = %q, want the first context set", cfg.CurrentContext)
+	}
+	home := cfg.context("home")
+	if home == nil || home.Receiver != "https://receiver.example.com" || home.Token != "t0ken" || !home.Insecure {
+		t.Fatalf("home = %+v", home)
+	}
+
+	if out, err := runPk8s(t, path, "ctx", "current"); err != nil || out != "home\n" {
+		t.Fatalf("ctx current = %q, %v", out, err)
+	}
+	if out, err := runPk8s(t, path, "--context", "lab", "ctx", "current"); err != nil || out != "lab\n" {
+		t.Fatalf("ctx current --context lab = %q, %v", out, err)
+	}
+	t.Setenv("PK8S_CONTEXT", "lab")
+	if out, err := runPk8s(t, path, "ctx", "current"); err != nil || out != "lab\n" {
+		t.Fatalf("ctx current with PK8S_CONTEXT = %q, %v", out, err)
+	}
+
+	// Tokens are redacted from config view
+	out, err := runPk8s(t, path, "--context", "home", "config", "view")
+	if err != nil || !strings.Contains(out, "token: REDACTED") || strings.Contains(out, "t0ken") {
+		t.Fatalf("config view = %q, %v", out, err)
+	}
+
+	if _, err := runPk8s(t, path, "ctx", "use", "prod"); err == nil {
+		t.Fatal("switched to an unknown context")
+	}
+	if _, err := runPk8s(t, path, "ctx", "delete", "home"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, _ = LoadConfig(path); cfg.CurrentContext != "" || cfg.context("home") != nil {
+		t.Fatalf("after delete: %+v", cfg)
+	}
+}
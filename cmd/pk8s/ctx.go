@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func newCtxCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "ctx",
+		Aliases: []string{"context"},
+		Short:   "Manage named contexts for multiple clusters and endpoints",
+	}
+	cmd.AddCommand(newCtxListCmd())
+	cmd.AddCommand(newCtxCurrentCmd())
+	cmd.AddCommand(newCtxUseCmd())
+	cmd.AddCommand(newCtxSetCmd())
+	cmd.AddCommand(newCtxDeleteCmd())
+	return cmd
+}
+
+func newCtxListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List contexts, marking the current one",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := LoadConfig(configPath)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "CURRENT\tNAME\tRECEIVER\tKUBE CONTEXT")
+			for _, c := range cfg.Contexts {
+				current := ""
+				if c.Name == cfg.CurrentContext {
+					current = "*"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", current, c.Name, c.Receiver, c.KubeContext)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newCtxCurrentCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "current",
+		Short: "Print the context in use",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), ctx.Name)
+			return nil
+		},
+	}
+}
+
+func newCtxUseCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "use <name>",
+		Short:             "Switch the current context",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeContexts),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := LoadConfig(configPath)
+			if err != nil {
+				return err
+			}
+			if cfg.context(args[0]) == nil {
+				return fmt.Errorf("context %q not found in %s", args[0], configPath)
+			}
+
+			cfg.CurrentContext = args[0]
+			if err := cfg.Save(configPath); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Switched to context %s\n", args[0])
+			return nil
+		},
+	}
+}
+
+func newCtxSetCmd() *cobra.Command {
+	var c Context
+
+	cmd := &cobra.Command{
+		Use:               "set <name>",
+		Short:             "Create a context, or update the given fields of an existing one",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeContexts),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := LoadConfig(configPath)
+			if err != nil {
+				return err
+			}
+
+			existing := cfg.context(args[0])
+			if existing == nil {
+				cfg.Contexts = append(cfg.Contexts, Context{Name: args[0]})
+				existing = &cfg.Contexts[len(cfg.Contexts)-1]
+			}
+			// Only flags given on the command line change the context
+			setString := func(flag string, dst *string, value string) {
+				if cmd.Flags().Changed(flag) {
+					*dst = value
+				}
+			}
+			setString("receiver", &existing.Receiver, c.Receiver)
+			setString("registry", &existing.Registry, c.Registry)
+			setString("gitea", &existing.Gitea, c.Gitea)
+			setString("token", &existing.Token, c.Token)
+			setString("gitea-token", &existing.GiteaToken, c.GiteaToken)
+			setString("webhook-secret", &existing.WebhookSecret, c.WebhookSecret)
+			setString("kubeconfig", &existing.Kubeconfig, c.Kubeconfig)
+			setString("kube-context", &existing.KubeContext, c.KubeContext)
+			setString("build-namespace", &existing.BuildNamespace, c.BuildNamespace)
+			setString("app-namespace", &existing.AppNamespace, c.AppNamespace)
+			setString("templates", &existing.Templates, c.Templates)
+			if cmd.Flags().Changed("insecure") {
+				existing.Insecure = c.Insecure
+			}
+			if cfg.CurrentContext == "" {
+				cfg.CurrentContext = args[0]
+			}
+
+			if err := cfg.Save(configPath); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Context %s saved\n", args[0])
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&c.Receiver, "receiver", "", "webhook receiver URL")
+	flags.StringVar(&c.Registry, "registry", "", "app registry API URL")
+	flags.StringVar(&c.Gitea, "gitea", "", "Gitea URL")
+	flags.StringVar(&c.Token, "token", "", "receiver and registry API token")
+	flags.StringVar(&c.GiteaToken, "gitea-token", "", "Gitea API token")
+	flags.StringVar(&c.WebhookSecret, "webhook-secret", "", "secret set on created webhooks")
+	flags.StringVar(&c.Kubeconfig, "kubeconfig", "", "kubeconfig path")
+	flags.StringVar(&c.KubeContext, "kube-context", "", "kubeconfig context")
+	flags.StringVar(&c.BuildNamespace, "build-namespace", "", "namespace of build jobs")
+	flags.StringVar(&c.AppNamespace, "app-namespace", "", "default namespace of apps")
+	flags.StringVar(&c.Templates, "templates", "", "templates/ directory of the platform repo")
+	flags.BoolVar(&c.Insecure, "insecure", false, "skip TLS verification")
+	return cmd
+}
+
+func newCtxDeleteCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "delete <name>",
+		Short:             "Delete a context",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeContexts),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := LoadConfig(configPath)
+			if err != nil {
+				return err
+			}
+
+			kept := cfg.Contexts[:0]
+			for _, c := range cfg.Contexts {
+				if c.Name != args[0] {
+					kept = append(kept, c)
+				}
+			}
+			if len(kept) == len(cfg.Contexts) {
+				return fmt.Errorf("context %q not found in %s", args[0], configPath)
+			}
+			cfg.Contexts = kept
+			if cfg.CurrentContext == args[0] {
+				cfg.CurrentContext = ""
+			}
+
+			if err := cfg.Save(configPath); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Context %s deleted\n", args[0])
+			return nil
+		},
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newDeployCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deploy",
+		Short: "Inspect app deployments",
+	}
+	cmd.AddCommand(newDeployStatusCmd())
+	return cmd
+}
+
+func newDeployStatusCmd() *cobra.Command {
+	var namespace string
+
+	cmd := &cobra.Command{
+		Use:               "status <app>",
+		Short:             "Show rollout status for an app's Deployments",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeApps),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+			if namespace == "" {
+				namespace = ctx.AppNamespace
+			}
+
+			// Apps deployed via the homelab-app chart use the release name as instance label
+			list, err := client.AppsV1().Deployments(namespace).List(cmd.Context(), metav1.ListOptions{
+				LabelSelector: "app.kubernetes.io/instance=" + args[0],
+			})
+			if err != nil {
+				return fmt.Errorf("listing deployments: %w", err)
+			}
+			if len(list.Items) == 0 {
+				return fmt.Errorf("no deployments for app %q in namespace %s", args[0], namespace)
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "DEPLOYMENT\tREADY\tUP-TO-DATE\tAVAILABLE\tIMAGE")
+			for _, d := range list.Items {
+				desired := int32(1)
+				if d.Spec.Replicas != nil {
+					desired = *d.Spec.Replicas
+				}
+				image := ""
+				if len(d.Spec.Template.Spec.Containers) > 0 {
+					image = d.Spec.Template.Spec.Containers[0].Image
+				}
+				fmt.Fprintf(w, "%s\t%d/%d\t%d\t%d\t%s\n", d.Name, d.Status.ReadyReplicas, desired,
+					d.Status.UpdatedReplicas, d.Status.AvailableReplicas, image)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			for _, d := range list.Items {
+				for _, c := range d.Status.Conditions {
+					if c.Status != "True" {
+						fmt.Fprintf(cmd.OutOrStdout(), "%s: %s=%s: %s\n", d.Name, c.Type, c.Status, c.Message)
+					}
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "namespace (defaults to the context's app namespace)")
+	return cmd
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func newAppExecCmd() *cobra.Command {
+	var (
+		namespace string
+		container string
+		noTTY     bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "exec <name> [-- command...]",
+		Short: "Run a command in a ready pod of an app",
+		Long: `Run a command in a ready pod of an app, sh by default.
+
+Stdin is attached, with a TTY when it is a terminal.`,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: firstArg(completeApps),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			config, err := ctx.restConfig()
+			if err != nil {
+				return err
+			}
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+
+			target, err := resolveApp(cmd.Context(), ctx, client, args[0], namespace)
+			if err != nil {
+				return err
+			}
+			command := args[1:]
+			if len(command) == 0 {
+				command = []string{"sh"}
+			}
+			pod := target.Pod
+			if container == "" {
+				container = pod.Spec.Containers[0].Name
+			}
+
+			stdin := int(os.Stdin.Fd())
+			tty := !noTTY && term.IsTerminal(stdin)
+			req := client.CoreV1().RESTClient().Post().
+				Resource("pods").Namespace(pod.Namespace).Name(pod.Name).SubResource("exec").
+				VersionedParams(&corev1.PodExecOptions{
+					Container: container,
+					Command:   command,
+					Stdin:     true,
+					Stdout:    true,
+					Stderr:    !tty,
+					TTY:       tty,
+				}, scheme.ParameterCodec)
+			executor, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+			if err != nil {
+				return fmt.Errorf("connecting to %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+
+			opts := remotecommand.StreamOptions{
+				Stdin:  cmd.InOrStdin(),
+				Stdout: cmd.OutOrStdout(),
+				Tty:    tty,
+			}
+			if tty {
+				state, err := term.MakeRaw(stdin)
+				if err != nil {
+					return err
+				}
+				defer term.Restore(stdin, state)
+				if width, height, err := term.GetSize(stdin); err == nil {
+					opts.TerminalSizeQueue = &fixedSize{size: &remotecommand.TerminalSize{Width: uint16(width), Height: uint16(height)}}
+				}
+			} else {
+				opts.Stderr = cmd.ErrOrStderr()
+			}
+			return executor.StreamWithContext(cmd.Context(), opts)
+		},
+	}
+
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "namespace (default: search all, preferring the context's app namespace)")
+	cmd.Flags().StringVarP(&container, "container", "c", "", "container (default: the pod's first)")
+	cmd.Flags().BoolVarP(&noTTY, "no-tty", "T", false, "never allocate a TTY")
+	return cmd
+}
+
+// fixedSize reports the terminal size once, at the start of the session
+type fixedSize struct {
+	size *remotecommand.TerminalSize
+}
+
+func (f *fixedSize) Next() *remotecommand.TerminalSize {
+	size := f.size
+	f.size = nil
+	return size
+}
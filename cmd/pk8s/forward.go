@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+func newAppPortForwardCmd() *cobra.Command {
+	var (
+		namespace string
+		ports     []string
+		addresses []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "port-forward <name>",
+		Short: "Forward local ports to a ready pod of an app",
+		Long: `Forward local ports to a ready pod of an app.
+
+Ports are given as [LOCAL:]REMOTE. Without --port, the pod port behind the
+app's Service is forwarded to the same local port.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeApps),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			config, err := ctx.restConfig()
+			if err != nil {
+				return err
+			}
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+
+			target, err := resolveApp(cmd.Context(), ctx, client, args[0], namespace)
+			if err != nil {
+				return err
+			}
+			if len(ports) == 0 {
+				port, err := defaultPort(target)
+				if err != nil {
+					return err
+				}
+				ports = []string{strconv.Itoa(int(port))}
+			}
+
+			pod := target.Pod
+			req := client.CoreV1().RESTClient().Post().
+				Resource("pods").Namespace(pod.Namespace).Name(pod.Name).SubResource("portforward")
+			transport, upgrader, err := spdy.RoundTripperFor(config)
+			if err != nil {
+				return err
+			}
+			dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+
+			ready := make(chan struct{})
+			go func() {
+				<-ready
+				fmt.Fprintf(cmd.OutOrStdout(), "Forwarding to %s/%s (Ctrl-C to stop)\n", pod.Namespace, pod.Name)
+			}()
+			fw, err := portforward.NewOnAddresses(dialer, addresses, ports, cmd.Context().Done(), ready, cmd.OutOrStdout(), cmd.ErrOrStderr())
+			if err != nil {
+				return err
+			}
+			return fw.ForwardPorts()
+		},
+	}
+
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "namespace (default: search all, preferring the context's app namespace)")
+	cmd.Flags().StringSliceVarP(&ports, "port", "p", nil, "ports to forward as [LOCAL:]REMOTE (repeatable)")
+	cmd.Flags().StringSliceVar(&addresses, "address", []string{"localhost"}, "local addresses to listen on")
+	return cmd
+}
+
+// defaultPort is the pod port behind the app's Service, or the first
+// container port when it has none
+func defaultPort(target *appTarget) (int32, error) {
+	containers := target.Pod.Spec.Containers
+	if target.Service != nil && len(target.Service.Spec.Ports) > 0 {
+		targetPort := target.Service.Spec.Ports[0].TargetPort
+		if targetPort.Type == intstr.Int && targetPort.IntVal != 0 {
+			return targetPort.IntVal, nil
+		}
+		if port, ok := namedPort(containers, targetPort.StrVal); ok {
+			return port, nil
+		}
+		if targetPort.StrVal == "" {
+			return target.Service.Spec.Ports[0].Port, nil
+		}
+	}
+	for _, c := range containers {
+		if len(c.Ports) > 0 {
+			return c.Ports[0].ContainerPort, nil
+		}
+	}
+	return 0, fmt.Errorf("pod %s exposes no ports; pass --port", target.Pod.Name)
+}
+
+func namedPort(containers []corev1.Container, name string) (int32, bool) {
+	if name == "" {
+		return 0, false
+	}
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.Name == name {
+				return p.ContainerPort, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podPollInterval is how often pk8s app logs -f looks for new pods
+const podPollInterval = 2 * time.Second
+
+// podColors are assigned to pods in the order they are found
+var podColors = []lipgloss.Color{"10", "12", "11", "13", "14", "9", "2", "4", "3", "5", "6"}
+
+func newAppLogsCmd() *cobra.Command {
+	var (
+		namespace string
+		container string
+		grep      string
+		since     time.Duration
+		follow    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "logs <name>",
+		Short: "Print the merged logs of all pods of an app",
+		Long: `Print the merged logs of all pods of an app.
+
+Each line is prefixed with its pod, colour coded per pod. Without -f the
+lines of all pods are ordered by time. With -f they are printed as they
+arrive, and pods started later (rollouts, scale-ups, restarts) are picked
+up as they appear.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: firstArg(completeApps),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var filter *regexp.Regexp
+			if grep != "" {
+				re, err := regexp.Compile(grep)
+				if err != nil {
+					return fmt.Errorf("invalid --grep: %w", err)
+				}
+				filter = re
+			}
+
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+			if _, err := registryApp(ctx, args[0]); err != nil {
+				return err
+			}
+			deployment, err := findDeployment(cmd.Context(), ctx, client, args[0], namespace)
+			if err != nil {
+				return err
+			}
+
+			t := &logTail{
+				client:    client,
+				namespace: deployment.Namespace,
+				app:       args[0],
+				container: container,
+				since:     since,
+				filter:    filter,
+				out:       cmd.OutOrStdout(),
+				errOut:    cmd.ErrOrStderr(),
+				colors:    make(map[string]lipgloss.Color),
+			}
+			if follow {
+				return t.follow(cmd.Context())
+			}
+			return t.print(cmd.Context())
+		},
+	}
+
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "namespace (default: search all, preferring the context's app namespace)")
+	cmd.Flags().StringVarP(&container, "container", "c", "", "only this container (default: all)")
+	cmd.Flags().StringVarP(&grep, "grep", "g", "", "only lines matching this regular expression")
+	cmd.Flags().DurationVar(&since, "since", 0, "only lines newer than this, e.g. 1h (default: all)")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "stream new lines until interrupted")
+	return cmd
+}
+
+// logTail reads the logs of every pod of one app
+type logTail struct {
+	client    kubernetes.Interface
+	namespace string
+	app       string
+	container string
+	since     time.Duration
+	filter    *regexp.Regexp
+	out       io.Writer
+	errOut    io.Writer
+
+	// colors is only used by the goroutine listing pods
+	colors map[string]lipgloss.Color
+	mu     sync.Mutex
+}
+
+// logSource is one container of one pod
+type logSource struct {
+	pod       string
+	container string
+	label     string
+	color     lipgloss.Color
+}
+
+type logLine struct {
+	src  logSource
+	time time.Time
+	text string
+}
+
+// pods returns the pods of all the app's Deployments, including canary and
+// blue/green slots, by name
+func (t *logTail) pods(ctx context.Context) ([]corev1.Pod, error) {
+	deployments, err := t.client.AppsV1().Deployments(t.namespace).List(ctx, metav1.ListOptions{LabelSelector: instanceSelector(t.app)})
+	if err != nil {
+		return nil, fmt.Errorf("listing deployments: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var pods []corev1.Pod
+	for _, d := range deployments.Items {
+		list, err := t.client.CoreV1().Pods(t.namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: metav1.FormatLabelSelector(d.Spec.Selector),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing pods: %w", err)
+		}
+		for _, pod := range list.Items {
+			if !seen[pod.Name] {
+				seen[pod.Name] = true
+				pods = append(pods, pod)
+			}
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+// sources lists the containers of pod that have started, and so have logs
+func (t *logTail) sources(pod *corev1.Pod) []logSource {
+	var names []string
+	for _, status := range pod.Status.ContainerStatuses {
+		if t.container != "" && status.Name != t.container {
+			continue
+		}
+		if status.State.Running != nil || status.State.Terminated != nil {
+			names = append(names, status.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	color, ok := t.colors[pod.Name]
+	if !ok {
+		color = podColors[len(t.colors)%len(podColors)]
+		t.colors[pod.Name] = color
+	}
+	sources := make([]logSource, 0, len(names))
+	for _, name := range names {
+		label := pod.Name
+		if len(pod.Spec.Containers) > 1 && t.container == "" {
+			label += "/" + name
+		}
+		sources = append(sources, logSource{pod: pod.Name, container: name, label: label, color: color})
+	}
+	return sources
+}
+
+// stream reads src's log lines newer than after (or --since when after is
+// zero), passing those that match the filter to emit. It returns the time
+// of the last line read.
+func (t *logTail) stream(ctx context.Context, src logSource, after time.Time, follow bool, emit func(logLine)) (time.Time, error) {
+	opts := &corev1.PodLogOptions{
+		Container:  src.container,
+		Follow:     follow,
+		Timestamps: true,
+	}
+	if !after.IsZero() {
+		sinceTime := metav1.NewTime(after)
+		opts.SinceTime = &sinceTime
+	} else if t.since > 0 {
+		seconds := int64(t.since.Seconds())
+		opts.SinceSeconds = &seconds
+	}
+
+	stream, err := t.client.CoreV1().Pods(t.namespace).GetLogs(src.pod, opts).Stream(ctx)
+	if err != nil {
+		return after, err
+	}
+	defer stream.Close()
+
+	last := after
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		stamp, text, _ := strings.Cut(scanner.Text(), " ")
+		ts, err := time.Parse(time.RFC3339Nano, stamp)
+		if err != nil {
+			ts, text = time.Now(), scanner.Text()
+		}
+		// SinceTime has second precision, so skip lines already seen
+		if !ts.After(after) {
+			continue
+		}
+		last = ts
+		if t.filter != nil && !t.filter.MatchString(text) {
+			continue
+		}
+		emit(logLine{src: src, time: ts, text: text})
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return last, err
+	}
+	return last, nil
+}
+
+// print writes the logs read so far of all pods, ordered by time
+func (t *logTail) print(ctx context.Context) error {
+	pods, err := t.pods(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg    sync.WaitGroup
+		lines []logLine
+		found bool
+	)
+	for i := range pods {
+		for _, src := range t.sources(&pods[i]) {
+			found = true
+			wg.Add(1)
+			go func(src logSource) {
+				defer wg.Done()
+				_, err := t.stream(ctx, src, time.Time{}, false, func(line logLine) {
+					t.mu.Lock()
+					lines = append(lines, line)
+					t.mu.Unlock()
+				})
+				if err != nil {
+					t.mu.Lock()
+					fmt.Fprintf(t.errOut, "Skipping %s: %v\n", src.label, err)
+					t.mu.Unlock()
+				}
+			}(src)
+		}
+	}
+	if !found {
+		return fmt.Errorf("app %q has no started pods in %s", t.app, t.namespace)
+	}
+	wg.Wait()
+
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].time.Before(lines[j].time) })
+	for _, line := range lines {
+		t.write(line)
+	}
+	return nil
+}
+
+// follow streams the logs of all pods until ctx is done, starting a stream
+// for each container that appears or restarts
+func (t *logTail) follow(ctx context.Context) error {
+	active := make(map[logSource]bool)
+	last := make(map[logSource]time.Time)
+
+	for {
+		pods, err := t.pods(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		for i := range pods {
+			for _, src := range t.sources(&pods[i]) {
+				t.mu.Lock()
+				if active[src] {
+					t.mu.Unlock()
+					continue
+				}
+				active[src] = true
+				after := last[src]
+				t.mu.Unlock()
+
+				go func(src logSource, after time.Time) {
+					end, err := t.stream(ctx, src, after, true, func(line logLine) {
+						t.mu.Lock()
+						t.write(line)
+						t.mu.Unlock()
+					})
+					t.mu.Lock()
+					defer t.mu.Unlock()
+					delete(active, src)
+					last[src] = end
+					if err != nil && ctx.Err() == nil {
+						fmt.Fprintf(t.errOut, "Lost %s: %v\n", src.label, err)
+					}
+				}(src, after)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(podPollInterval):
+		}
+	}
+}
+
+// write prints one line behind its coloured pod label; callers serialise it
+func (t *logTail) write(line logLine) {
+	label := lipgloss.NewStyle().Foreground(line.src.color).Render(line.src.label)
+	fmt.Fprintf(t.out, "%s %s\n", label, line.text)
+}
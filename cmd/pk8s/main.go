@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// Global flags shared by every subcommand
+var (
+	configPath  string
+	contextName string
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := newRootCmd().ExecuteContext(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func newRootCmd() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "pk8s",
+		Short:         "Homelab platform CLI for builds, apps, and deploys",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	root.PersistentFlags().StringVar(&configPath, "config", defaultConfigPath(), "path to the pk8s config file")
+	root.PersistentFlags().StringVar(&contextName, "context", os.Getenv("PK8S_CONTEXT"), "context to use (overrides current-context)")
+
+	root.AddCommand(newBuildCmd())
+	root.AddCommand(newAppCmd())
+	root.AddCommand(newDeployCmd())
+	root.AddCommand(newExportCmd())
+	root.AddCommand(newImportCmd())
+	root.AddCommand(newNewCmd())
+	root.AddCommand(newTUICmd())
+	root.AddCommand(newConfigCmd())
+	root.AddCommand(newCtxCmd())
+
+	_ = root.RegisterFlagCompletionFunc("context", completeContexts)
+
+	return root
+}
+
+// loadContext reads the config file and resolves the active context
+func loadContext() (*Context, error) {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Resolve(contextName)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Languages with a Dockerfile in templates/app/deploy/docker
+var appLanguages = []string{"go", "python", "node", "static"}
+
+var appNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// defaultBuildFile is written as the new app's .build.yaml
+const defaultBuildFile = `# Build settings read by the webhook receiver on every push
+imageSize:
+  max: 500Mi
+  action: warn
+# dependsOn:
+# - base-image
+# matrix:            # parallel variants, tagged <commit>-<name>
+# - name: alpine
+#   buildArgs: {BASE: "alpine:3.19"}
+# - name: debian
+#   dockerfile: Dockerfile.debian
+`
+
+// newAppOptions are the flags of pk8s new app
+type newAppOptions struct {
+	Lang      string
+	Port      int
+	Owner     string
+	Dir       string
+	Templates string
+	Private   bool
+	NoRepo    bool
+	NoPush    bool
+}
+
+func newNewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "new",
+		Short: "Scaffold new platform resources",
+	}
+	cmd.AddCommand(newNewAppCmd())
+	return cmd
+}
+
+func newNewAppCmd() *cobra.Command {
+	var opts newAppOptions
+
+	cmd := &cobra.Command{
+		Use:   "app <name>",
+		Short: "Generate an app from templates/, create its Gitea repo, and register the build webhook",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+
+			name := args[0]
+			if !appNamePattern.MatchString(name) {
+				return fmt.Errorf("app name %q must be lowercase letters, digits, and dashes", name)
+			}
+			if !contains(appLanguages, opts.Lang) {
+				return fmt.Errorf("--lang must be one of %s", strings.Join(appLanguages, ", "))
+			}
+			if opts.Port < 1 || opts.Port > 65535 {
+				return fmt.Errorf("--port must be between 1 and 65535")
+			}
+			if opts.Dir == "" {
+				opts.Dir = name
+			}
+			if opts.Templates == "" {
+				opts.Templates = ctx.Templates
+			}
+			templates, err := findTemplates(opts.Templates)
+			if err != nil {
+				return err
+			}
+			if err := checkEmptyDir(opts.Dir); err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			var login string
+			if !opts.NoRepo {
+				var user struct {
+					Login string `json:"login"`
+				}
+				if err := ctx.giteaClient().do(http.MethodGet, "/api/v1/user", nil, &user); err != nil {
+					return fmt.Errorf("looking up Gitea user: %w", err)
+				}
+				login = user.Login
+			}
+			owner := opts.Owner
+			if owner == "" {
+				owner = login
+			}
+			if owner == "" {
+				owner = "homelab"
+			}
+			cloneURL := fmt.Sprintf("%s/%s/%s.git", strings.TrimSuffix(ctx.Gitea, "/"), owner, name)
+
+			replacer := strings.NewReplacer(
+				"REPLACE_APP_NAME", name,
+				"REPLACE_PORT", strconv.Itoa(opts.Port),
+				"REPLACE_GITEA_URL", cloneURL,
+			)
+			if err := renderApp(templates, opts.Dir, name, opts.Lang, replacer); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Generated %s app in %s\n", opts.Lang, opts.Dir)
+
+			if opts.NoRepo {
+				return nil
+			}
+
+			if err := createGiteaRepo(ctx, owner, name, opts.Private, owner != login); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Created repository %s/%s\n", owner, name)
+
+			hookURL := strings.TrimSuffix(ctx.Receiver, "/") + "/webhook"
+			if err := createPushHook(ctx, owner, name, hookURL); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Registered push webhook -> %s\n", hookURL)
+
+			if err := initGitRepo(opts.Dir, cloneURL, !opts.NoPush); err != nil {
+				return err
+			}
+			if opts.NoPush {
+				fmt.Fprintf(out, "Push with: cd %s && git push -u origin main\n", opts.Dir)
+			} else {
+				fmt.Fprintf(out, "Pushed to %s; follow the build with: pk8s build logs %s -f\n", cloneURL, name)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.Lang, "lang", "go", "language: "+strings.Join(appLanguages, ", "))
+	cmd.Flags().IntVar(&opts.Port, "port", 8080, "port the app listens on")
+	cmd.Flags().StringVar(&opts.Owner, "owner", "", "Gitea user or organization (defaults to the token's user)")
+	cmd.Flags().StringVar(&opts.Dir, "dir", "", "output directory (defaults to ./<name>)")
+	cmd.Flags().StringVar(&opts.Templates, "templates", "", "templates/ directory of the platform repo (defaults to the context's, or the nearest parent's)")
+	cmd.Flags().BoolVar(&opts.Private, "private", false, "create a private repository")
+	cmd.Flags().BoolVar(&opts.NoRepo, "no-repo", false, "only generate files; skip Gitea and git")
+	cmd.Flags().BoolVar(&opts.NoPush, "no-push", false, "create the repository but do not push the first commit")
+	return cmd
+}
+
+// findTemplates returns the templates/app directory under dir, or under the
+// nearest parent of the working directory that has one
+func findTemplates(dir string) (string, error) {
+	if dir != "" {
+		app := filepath.Join(dir, "app")
+		if _, err := os.Stat(filepath.Join(app, "deploy")); err != nil {
+			return "", fmt.Errorf("%s is not a templates directory: %w", dir, err)
+		}
+		return app, nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		app := filepath.Join(wd, "templates", "app")
+		if _, err := os.Stat(filepath.Join(app, "deploy")); err == nil {
+			return app, nil
+		}
+		parent := filepath.Dir(wd)
+		if parent == wd {
+			return "", fmt.Errorf("templates/app not found; pass --templates or set templates in the context")
+		}
+		wd = parent
+	}
+}
+
+// checkEmptyDir refuses to generate into a directory with files in it
+func checkEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s already exists and is not empty", dir)
+	}
+	return nil
+}
+
+// renderApp copies the Dockerfile for lang to the repository root (where the
+// webhook receiver builds it), the Helm chart to deploy/helm/<name>, and the
+// ArgoCD Application, substituting placeholders
+func renderApp(templates, dir, name, lang string, replacer *strings.Replacer) error {
+	docker := filepath.Join(templates, "deploy", "docker")
+	files := map[string]string{
+		filepath.Join(docker, "Dockerfile."+lang):                        "Dockerfile",
+		filepath.Join(docker, ".dockerignore"):                           ".dockerignore",
+		filepath.Join(templates, "deploy", "argocd", "application.yaml"): filepath.Join("deploy", "argocd", "application.yaml"),
+		filepath.Join(templates, "deploy", "README.md"):                  filepath.Join("deploy", "README.md"),
+	}
+	for src, dst := range files {
+		if err := renderFile(src, filepath.Join(dir, dst), replacer); err != nil {
+			return err
+		}
+	}
+
+	chart := filepath.Join(templates, "deploy", "helm", "app-template")
+	err := filepath.WalkDir(chart, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(chart, path)
+		if err != nil {
+			return err
+		}
+		return renderFile(path, filepath.Join(dir, "deploy", "helm", name, rel), replacer)
+	})
+	if err != nil {
+		return fmt.Errorf("rendering Helm chart: %w", err)
+	}
+
+	return os.WriteFile(filepath.Join(dir, ".build.yaml"), []byte(defaultBuildFile), 0o644)
+}
+
+// renderFile writes src to dst with placeholders replaced, dropping the
+// "# Replace REPLACE_..." instructions meant for manual copies
+func renderFile(src, dst string, replacer *strings.Replacer) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("reading template: %w", err)
+	}
+	var lines []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.HasPrefix(line, "# Replace REPLACE_") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, []byte(replacer.Replace(strings.Join(lines, ""))), 0o644)
+}
+
+// createGiteaRepo creates owner/name, under the organization when org is set
+// and under the token's user otherwise
+func createGiteaRepo(ctx *Context, owner, name string, private, org bool) error {
+	path := "/api/v1/user/repos"
+	if org {
+		path = fmt.Sprintf("/api/v1/orgs/%s/repos", owner)
+	}
+	body := map[string]interface{}{
+		"name":           name,
+		"private":        private,
+		"default_branch": "main",
+	}
+	if err := ctx.giteaClient().do(http.MethodPost, path, body, nil); err != nil {
+		return fmt.Errorf("creating repository: %w", err)
+	}
+	return nil
+}
+
+// createPushHook registers the webhook receiver for push events, which build
+// images, and release events, which publish the Helm chart, on owner/name
+func createPushHook(ctx *Context, owner, name, hookURL string) error {
+	body := map[string]interface{}{
+		"type":   "gitea",
+		"active": true,
+		"events": []string{"push", "release"},
+		"config": map[string]string{
+			"url":          hookURL,
+			"content_type": "json",
+			"secret":       ctx.WebhookSecret,
+		},
+	}
+	path := fmt.Sprintf("/api/v1/repos/%s/%s/hooks", owner, name)
+	if err := ctx.giteaClient().do(http.MethodPost, path, body, nil); err != nil {
+		return fmt.Errorf("registering webhook: %w", err)
+	}
+	return nil
+}
+
+// initGitRepo commits the generated files on main and adds the Gitea remote
+func initGitRepo(dir, remote string, push bool) error {
+	steps := [][]string{
+		{"init", "-b", "main"},
+		{"add", "-A"},
+		{"commit", "-m", "Initial commit from pk8s new app"},
+		{"remote", "add", "origin", remote},
+	}
+	if push {
+		steps = append(steps, []string{"push", "-u", "origin", "main"})
+	}
+
+	for _, args := range steps {
+		git := exec.Command("git", args...)
+		git.Dir = dir
+		git.Stdout, git.Stderr = os.Stderr, os.Stderr
+		// Pushing may prompt for Gitea credentials
+		git.Stdin = os.Stdin
+		if err := git.Run(); err != nil {
+			return fmt.Errorf("git %s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
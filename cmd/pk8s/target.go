@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// appTarget is the running workload behind an app registry entry
+type appTarget struct {
+	Deployment *appsv1.Deployment
+	// Service selects the Deployment's pods, if the app has one
+	Service *corev1.Service
+	Pod     *corev1.Pod
+}
+
+// resolveApp finds name's Deployment and a ready pod of it. Apps are matched
+// by the app.kubernetes.io/instance label the homelab-app chart and the app
+// operator both set; without a namespace, every namespace is searched and the
+// context's app namespace wins ties.
+func resolveApp(ctx context.Context, pctx *Context, client kubernetes.Interface, name, namespace string) (*appTarget, error) {
+	if _, err := registryApp(pctx, name); err != nil {
+		return nil, err
+	}
+	deployment, err := findDeployment(ctx, pctx, client, name, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := client.CoreV1().Pods(deployment.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: metav1.FormatLabelSelector(deployment.Spec.Selector),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods: %w", err)
+	}
+	target := &appTarget{Deployment: deployment}
+	for i := range pods.Items {
+		if podReady(&pods.Items[i]) {
+			target.Pod = &pods.Items[i]
+			break
+		}
+	}
+	if target.Pod == nil {
+		return nil, fmt.Errorf("deployment %s/%s has no ready pods", deployment.Namespace, deployment.Name)
+	}
+
+	services, err := client.CoreV1().Services(deployment.Namespace).List(ctx, metav1.ListOptions{LabelSelector: instanceSelector(name)})
+	if err != nil {
+		return nil, fmt.Errorf("listing services: %w", err)
+	}
+	for i, svc := range services.Items {
+		if selects(svc.Spec.Selector, target.Pod.Labels) {
+			target.Service = &services.Items[i]
+			break
+		}
+	}
+	return target, nil
+}
+
+// registryApp returns name's app registry entry
+func registryApp(pctx *Context, name string) (*App, error) {
+	apps, err := listApps(pctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range apps {
+		if apps[i].Name == name {
+			return &apps[i], nil
+		}
+	}
+	return nil, fmt.Errorf("app %q is not in the registry (see pk8s app list)", name)
+}
+
+func instanceSelector(name string) string {
+	return "app.kubernetes.io/instance=" + name
+}
+
+// findDeployment returns the app's Deployment, searching every namespace
+// when namespace is empty
+func findDeployment(ctx context.Context, pctx *Context, client kubernetes.Interface, name, namespace string) (*appsv1.Deployment, error) {
+	list, err := client.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{LabelSelector: instanceSelector(name)})
+	if err != nil {
+		return nil, fmt.Errorf("listing deployments: %w", err)
+	}
+	return pickDeployment(list.Items, name, pctx.AppNamespace)
+}
+
+// pickDeployment chooses among the Deployments labelled for an app: the
+// stable one (named after the app) in a single namespace
+func pickDeployment(items []appsv1.Deployment, name, appNamespace string) (*appsv1.Deployment, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no deployments for app %q", name)
+	}
+
+	byNamespace := make(map[string][]int)
+	for i, d := range items {
+		byNamespace[d.Namespace] = append(byNamespace[d.Namespace], i)
+	}
+	namespace := items[0].Namespace
+	if len(byNamespace) > 1 {
+		if _, ok := byNamespace[appNamespace]; !ok {
+			namespaces := make([]string, 0, len(byNamespace))
+			for ns := range byNamespace {
+				namespaces = append(namespaces, ns)
+			}
+			sort.Strings(namespaces)
+			return nil, fmt.Errorf("app %q runs in namespaces %s; pick one with -n", name, strings.Join(namespaces, ", "))
+		}
+		namespace = appNamespace
+	}
+
+	candidates := byNamespace[namespace]
+	for _, i := range candidates {
+		if items[i].Name == name {
+			return &items[i], nil
+		}
+	}
+	return &items[candidates[0]], nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// selects reports whether a Service selector matches the pod labels
+func selects(selector, labels map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Dashboard limits
+const (
+	tuiMaxBuilds      = 15
+	tuiMaxDeployments = 10
+	tuiLogLines       = 200
+)
+
+func newTUICmd() *cobra.Command {
+	var interval time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "tui",
+		Short: "Live terminal dashboard of builds, deployments, and app health",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadContext()
+			if err != nil {
+				return err
+			}
+			client, err := ctx.kubeClient()
+			if err != nil {
+				return err
+			}
+
+			m := newDashboard(cmd.Context(), ctx, client, interval)
+			defer m.stopLogs()
+			_, err = tea.NewProgram(m, tea.WithAltScreen(), tea.WithContext(cmd.Context())).Run()
+			return err
+		},
+	}
+
+	cmd.Flags().DurationVar(&interval, "interval", 5*time.Second, "refresh interval")
+	return cmd
+}
+
+// appHealth is the result of probing one registered app's URL
+type appHealth struct {
+	App     App
+	Status  int
+	Latency time.Duration
+	Err     error
+}
+
+// snapshotMsg carries one refresh of everything except logs
+type snapshotMsg struct {
+	builds      []batchv1.Job
+	deployments []appsv1.Deployment
+	apps        []appHealth
+	err         error
+}
+
+type tickMsg struct{}
+
+// logLineMsg is one line of the selected build's log; closed is set when
+// the stream ends
+type logLineMsg struct {
+	job    string
+	line   string
+	closed bool
+}
+
+// dashboard is the bubbletea model behind pk8s tui
+type dashboard struct {
+	ctx      context.Context
+	pctx     *Context
+	client   kubernetes.Interface
+	interval time.Duration
+
+	snapshot snapshotMsg
+	updated  time.Time
+	selected int
+	width    int
+	height   int
+
+	// Log stream of the selected build
+	logJob     string
+	logStarted bool
+	logLines   []string
+	logCh      chan logLineMsg
+	logCancel  context.CancelFunc
+}
+
+func newDashboard(ctx context.Context, pctx *Context, client kubernetes.Interface, interval time.Duration) *dashboard {
+	return &dashboard{ctx: ctx, pctx: pctx, client: client, interval: interval}
+}
+
+func (m *dashboard) Init() tea.Cmd {
+	return m.refresh()
+}
+
+func (m *dashboard) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		case "up", "k":
+			if m.selected > 0 {
+				m.selected--
+				return m, m.followSelected()
+			}
+		case "down", "j":
+			if m.selected < len(m.snapshot.builds)-1 {
+				m.selected++
+				return m, m.followSelected()
+			}
+		case "r":
+			return m, m.refresh()
+		}
+
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+
+	case tickMsg:
+		return m, m.refresh()
+
+	case snapshotMsg:
+		m.snapshot = msg
+		m.updated = time.Now()
+		if m.selected >= len(msg.builds) {
+			m.selected = len(msg.builds) - 1
+		}
+		if m.selected < 0 {
+			m.selected = 0
+		}
+		next := tea.Tick(m.interval, func(time.Time) tea.Msg { return tickMsg{} })
+		return m, tea.Batch(next, m.followSelected())
+
+	case logLineMsg:
+		if msg.job != m.logJob {
+			return m, nil
+		}
+		if msg.closed {
+			m.logCh = nil
+			return m, nil
+		}
+		m.logLines = append(m.logLines, msg.line)
+		if len(m.logLines) > tuiLogLines {
+			m.logLines = m.logLines[len(m.logLines)-tuiLogLines:]
+		}
+		return m, waitForLogLine(m.logCh)
+	}
+	return m, nil
+}
+
+// refresh fetches a new snapshot in the background
+func (m *dashboard) refresh() tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(m.ctx, 15*time.Second)
+		defer cancel()
+		return fetchSnapshot(ctx, m.pctx, m.client)
+	}
+}
+
+// followSelected starts the log stream when the selected build changed or
+// its pod has started since the last attempt
+func (m *dashboard) followSelected() tea.Cmd {
+	if len(m.snapshot.builds) == 0 {
+		return nil
+	}
+	build := m.snapshot.builds[m.selected]
+	job := build.Name
+	if job == m.logJob && m.logStarted {
+		return nil
+	}
+
+	m.stopLogs()
+	m.logJob = job
+	pod, err := waitForJobPod(m.ctx, m.client, m.pctx.BuildNamespace, job, false)
+	if err != nil {
+		m.logLines = []string{err.Error()}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	m.logCancel = cancel
+	m.logStarted = true
+	m.logLines = nil
+	m.logCh = make(chan logLineMsg, 64)
+	go streamLogLines(ctx, m.client, &build, pod, m.logCh)
+	return waitForLogLine(m.logCh)
+}
+
+func (m *dashboard) stopLogs() {
+	if m.logCancel != nil {
+		m.logCancel()
+		m.logCancel = nil
+	}
+	m.logCh = nil
+	m.logStarted = false
+}
+
+func waitForLogLine(ch chan logLineMsg) tea.Cmd {
+	if ch == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		return <-ch
+	}
+}
+
+// streamLogLines follows the logs of the build's pod, one container after
+// another as they run, sending one message per line
+func streamLogLines(ctx context.Context, client kubernetes.Interface, job *batchv1.Job, pod string, ch chan<- logLineMsg) {
+	send := func(line string) bool {
+		select {
+		case ch <- logLineMsg{job: job.Name, line: line}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	defer func() {
+		select {
+		case ch <- logLineMsg{job: job.Name, closed: true}:
+		case <-ctx.Done():
+		}
+	}()
+
+	containers := buildContainers(job)
+	for _, container := range containers {
+		started, err := waitForContainer(ctx, client, job.Namespace, pod, container, true)
+		if err != nil {
+			send(err.Error())
+			return
+		}
+		if !started {
+			continue
+		}
+		if len(containers) > 1 && !send("==> "+container+" <==") {
+			return
+		}
+
+		tail := int64(tuiLogLines)
+		stream, err := client.CoreV1().Pods(job.Namespace).GetLogs(pod, &corev1.PodLogOptions{
+			Container: container,
+			Follow:    true,
+			TailLines: &tail,
+		}).Stream(ctx)
+		if err != nil {
+			send(fmt.Sprintf("streaming logs for %s/%s: %v", pod, container, err))
+			return
+		}
+
+		scanner := bufio.NewScanner(stream)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if !send(scanner.Text()) {
+				stream.Close()
+				return
+			}
+		}
+		stream.Close()
+	}
+}
+
+// fetchSnapshot lists build jobs and Deployments and probes registered apps
+func fetchSnapshot(ctx context.Context, pctx *Context, client kubernetes.Interface) snapshotMsg {
+	var msg snapshotMsg
+	var errs []string
+
+	jobs, err := listBuildJobs(ctx, client, pctx.BuildNamespace, "")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	// Queued and running builds first, then the most recent finished ones
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return buildRank(&jobs[i]) < buildRank(&jobs[j])
+	})
+	if len(jobs) > tuiMaxBuilds {
+		jobs = jobs[:tuiMaxBuilds]
+	}
+	msg.builds = jobs
+
+	deployments, err := client.AppsV1().Deployments(pctx.AppNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("listing deployments: %v", err))
+	} else {
+		items := deployments.Items
+		sort.Slice(items, func(i, j int) bool {
+			return lastRollout(&items[j]).Before(lastRollout(&items[i]))
+		})
+		if len(items) > tuiMaxDeployments {
+			items = items[:tuiMaxDeployments]
+		}
+		msg.deployments = items
+	}
+
+	apps, err := listApps(pctx)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("listing apps: %v", err))
+	} else {
+		msg.apps = probeApps(ctx, apps, pctx.Insecure)
+	}
+
+	if len(errs) > 0 {
+		msg.err = fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return msg
+}
+
+func buildRank(job *batchv1.Job) int {
+	switch jobStatus(job) {
+	case "Running":
+		return 0
+	case "Pending":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// lastRollout is when a Deployment last progressed, falling back to its creation
+func lastRollout(d *appsv1.Deployment) time.Time {
+	latest := d.CreationTimestamp.Time
+	for _, c := range d.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.LastUpdateTime.After(latest) {
+			latest = c.LastUpdateTime.Time
+		}
+	}
+	return latest
+}
+
+// probeApps GETs every app URL concurrently
+func probeApps(ctx context.Context, apps []App, insecure bool) []appHealth {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{Timeout: 5 * time.Second, Transport: transport}
+
+	results := make([]appHealth, len(apps))
+	var wg sync.WaitGroup
+	for i, app := range apps {
+		wg.Add(1)
+		go func(i int, app App) {
+			defer wg.Done()
+			results[i].App = app
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, app.URL, nil)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			start := time.Now()
+			resp, err := client.Do(req)
+			results[i].Latency = time.Since(start)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			resp.Body.Close()
+			results[i].Status = resp.StatusCode
+		}(i, app)
+	}
+	wg.Wait()
+	return results
+}
+
+var (
+	titleStyle    = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12"))
+	selectedStyle = lipgloss.NewStyle().Reverse(true)
+	dimStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	okStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
+	warnStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("11"))
+	errStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+	panelStyle    = lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).Padding(0, 1)
+)
+
+func (m *dashboard) View() string {
+	if m.width == 0 {
+		return "Loading..."
+	}
+	half := m.width/2 - 2
+
+	top := lipgloss.JoinHorizontal(lipgloss.Top,
+		panelStyle.Width(half).Render(m.viewBuilds()),
+		panelStyle.Width(half).Render(m.viewLogs(half)),
+	)
+	bottom := lipgloss.JoinHorizontal(lipgloss.Top,
+		panelStyle.Width(half).Render(m.viewDeployments()),
+		panelStyle.Width(half).Render(m.viewApps()),
+	)
+
+	status := dimStyle.Render(fmt.Sprintf("context %s · updated %s · ↑/↓ select build · r refresh · q quit",
+		m.pctx.Name, m.updated.Format("15:04:05")))
+	if m.snapshot.err != nil {
+		status = errStyle.Render(m.snapshot.err.Error())
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, top, bottom, status)
+}
+
+func (m *dashboard) viewBuilds() string {
+	var b strings.Builder
+	b.WriteString(titleStyle.Render("Builds") + "\n")
+	if len(m.snapshot.builds) == 0 {
+		b.WriteString(dimStyle.Render("no build jobs"))
+	}
+	for i, job := range m.snapshot.builds {
+		status := jobStatus(&job)
+		line := fmt.Sprintf("%-9s %-20s %s", statusStyle(status).Render(status), truncate(job.Labels["app-name"], 20),
+			dimStyle.Render(age(job.CreationTimestamp.Time)))
+		if i == m.selected {
+			line = selectedStyle.Render(fmt.Sprintf("%-9s %-20s %s", status, truncate(job.Labels["app-name"], 20),
+				age(job.CreationTimestamp.Time)))
+		}
+		b.WriteString(line + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func (m *dashboard) viewLogs(width int) string {
+	var b strings.Builder
+	title := "Logs"
+	if m.logJob != "" {
+		title += " · " + m.logJob
+	}
+	b.WriteString(titleStyle.Render(title) + "\n")
+
+	// Show as many trailing lines as the builds panel is tall
+	height := tuiMaxBuilds
+	lines := m.logLines
+	if len(lines) > height {
+		lines = lines[len(lines)-height:]
+	}
+	for _, line := range lines {
+		b.WriteString(truncate(line, width) + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func (m *dashboard) viewDeployments() string {
+	var b strings.Builder
+	b.WriteString(titleStyle.Render("Recent deployments") + "\n")
+	if len(m.snapshot.deployments) == 0 {
+		b.WriteString(dimStyle.Render("no deployments in " + m.pctx.AppNamespace))
+	}
+	for _, d := range m.snapshot.deployments {
+		desired := int32(1)
+		if d.Spec.Replicas != nil {
+			desired = *d.Spec.Replicas
+		}
+		ready := fmt.Sprintf("%d/%d", d.Status.ReadyReplicas, desired)
+		style := okStyle
+		if d.Status.ReadyReplicas < desired {
+			style = warnStyle
+		}
+		tag := ""
+		if len(d.Spec.Template.Spec.Containers) > 0 {
+			image := d.Spec.Template.Spec.Containers[0].Image
+			tag = image[strings.LastIndexAny(image, ":@")+1:]
+		}
+		fmt.Fprintf(&b, "%-20s %s %-12s %s\n", truncate(d.Name, 20), style.Render(fmt.Sprintf("%-5s", ready)),
+			truncate(tag, 12), dimStyle.Render(age(lastRollout(&d))))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func (m *dashboard) viewApps() string {
+	var b strings.Builder
+	b.WriteString(titleStyle.Render("App health") + "\n")
+	if len(m.snapshot.apps) == 0 {
+		b.WriteString(dimStyle.Render("no registered apps"))
+	}
+	for _, h := range m.snapshot.apps {
+		var state string
+		switch {
+		case h.Err != nil:
+			state = errStyle.Render("down")
+		case h.Status >= 500:
+			state = errStyle.Render(fmt.Sprintf("%d", h.Status))
+		case h.Status >= 400:
+			state = warnStyle.Render(fmt.Sprintf("%d", h.Status))
+		default:
+			state = okStyle.Render(fmt.Sprintf("%d", h.Status))
+		}
+		fmt.Fprintf(&b, "%-20s %-4s %s\n", truncate(h.App.Name, 20), state,
+			dimStyle.Render(h.Latency.Round(time.Millisecond).String()))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func statusStyle(status string) lipgloss.Style {
+	switch status {
+	case "Succeeded":
+		return okStyle
+	case "Failed":
+		return errStyle
+	case "Running":
+		return warnStyle
+	default:
+		return dimStyle
+	}
+}
+
+func truncate(s string, n int) string {
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	if n <= 1 {
+		return s[:n]
+	}
+	return s[:n-1] + "…"
+}
+
+func age(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
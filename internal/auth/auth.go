@@ -0,0 +1,408 @@
+// Package auth authenticates requests to the platform services' HTTP APIs.
+// Each Authenticator checks one kind of credential:
+//
+//	TokenAuth  static bearer tokens, e.g. from API_TOKENS
+//	OIDCAuth   RS256 tokens from an OpenID Connect issuer
+//	HMACAuth   Gitea's X-Gitea-Signature webhook signature
+//
+// Require wraps a handler with a chain of them. A request without credentials
+// any authenticator accepts is a 401; a valid identity refused access (an
+// OIDC token outside the allowed groups) is a 403. The caller's Identity is
+// added to the request context for handlers to read with IdentityFrom.
+//
+// Without authenticators every request is refused. Services that must run
+// open say so explicitly by adding Anonymous, e.g. for ALLOW_UNAUTHENTICATED.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication failures: ErrUnauthenticated is a 401 (no or bad
+// credentials), ErrForbidden a 403 (valid identity without access). Any
+// other error from an Authenticator is a 503.
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// maxBodySize caps the body read to verify a signature
+const maxBodySize = 5 << 20
+
+// Identity is the authenticated caller, available to handlers through
+// IdentityFrom
+type Identity struct {
+	Subject string   `json:"subject"`
+	Method  string   `json:"method"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+// Authenticator checks one kind of credential. It returns nil, nil when the
+// request does not carry that kind, so the next authenticator can try.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type identityKey struct{}
+
+// IdentityFrom returns the identity set by Require, or nil
+func IdentityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// Require accepts the request if any authenticator does and adds the
+// identity to its context. With no authenticators every request is a 401.
+func Require(next http.HandlerFunc, authenticators ...Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		forbidden := false
+		for _, a := range authenticators {
+			id, err := a.Authenticate(r)
+			if errors.Is(err, ErrForbidden) {
+				forbidden = true
+				continue
+			}
+			if err != nil && !errors.Is(err, ErrUnauthenticated) {
+				log.Printf("Failed to authenticate %s %s: %v", r.Method, r.URL.Path, err)
+				http.Error(w, "Authentication unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if id != nil {
+				next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+				return
+			}
+		}
+		if forbidden {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="homelab"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// Anonymous accepts every request. It is only for services explicitly
+// configured to run without authentication.
+type Anonymous struct{}
+
+func (Anonymous) Authenticate(*http.Request) (*Identity, error) {
+	return &Identity{Subject: "anonymous", Method: "none"}, nil
+}
+
+// AllowUnauthenticated appends Anonymous when allow is set, logging that
+// api is open; otherwise it warns when authenticators is empty, since api
+// then refuses every request
+func AllowUnauthenticated(authenticators []Authenticator, allow bool, api string) []Authenticator {
+	if allow {
+		log.Printf("WARNING: ALLOW_UNAUTHENTICATED set, %s accepts unauthenticated requests", api)
+		return append(authenticators, Anonymous{})
+	}
+	if len(authenticators) == 0 {
+		log.Printf("WARNING: no credentials configured, %s refuses every request", api)
+	}
+	return authenticators
+}
+
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// TokenAuth accepts static bearer tokens, configured as a comma-separated
+// list of name=token or bare tokens (named "token"). Base64 padding is not
+// taken for a name separator.
+type TokenAuth struct {
+	tokens map[string]string // token -> name
+}
+
+func NewTokenAuth(spec string) *TokenAuth {
+	a := &TokenAuth{tokens: make(map[string]string)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || strings.Trim(token, "=") == "" {
+			name, token = "token", entry
+		}
+		a.tokens[token] = name
+	}
+	return a
+}
+
+// Len is the number of tokens accepted
+func (a *TokenAuth) Len() int {
+	return len(a.tokens)
+}
+
+func (a *TokenAuth) Authenticate(r *http.Request) (*Identity, error) {
+	got := bearerToken(r)
+	// JWTs are left for OIDCAuth
+	if got == "" || strings.Count(got, ".") == 2 {
+		return nil, nil
+	}
+	for token, name := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return &Identity{Subject: name, Method: "token"}, nil
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+// HMACAuth verifies the X-Gitea-Signature header, a hex HMAC-SHA256 of the
+// body with the webhook secret. The body is restored for the handler.
+type HMACAuth struct {
+	secret []byte
+}
+
+func NewHMACAuth(secret string) *HMACAuth {
+	return &HMACAuth{secret: []byte(secret)}
+}
+
+func (a *HMACAuth) Authenticate(r *http.Request) (*Identity, error) {
+	signature := r.Header.Get("X-Gitea-Signature")
+	if signature == "" {
+		return nil, nil
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, ErrUnauthenticated
+	}
+	return &Identity{Subject: "gitea", Method: "hmac"}, nil
+}
+
+// OIDCAuth verifies RS256 ID or access tokens from an OpenID Connect issuer
+// (e.g. Authentik or Keycloak) against its published keys. When groups are
+// set, the token's groups claim must contain one of them.
+type OIDCAuth struct {
+	issuer   string
+	audience string
+	groups   []string
+	http     *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func NewOIDCAuth(issuer, audience string, groups []string) *OIDCAuth {
+	return &OIDCAuth{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		groups:   groups,
+		http:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (a *OIDCAuth) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return nil, ErrUnauthenticated
+	}
+	key, err := a.key(r.Context(), header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrUnauthenticated
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	var claims struct {
+		Issuer   string          `json:"iss"`
+		Subject  string          `json:"sub"`
+		Email    string          `json:"email"`
+		Audience json.RawMessage `json:"aud"`
+		Expiry   int64           `json:"exp"`
+		Groups   []string        `json:"groups"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrUnauthenticated
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != a.issuer || time.Now().Unix() >= claims.Expiry {
+		return nil, ErrUnauthenticated
+	}
+	if a.audience != "" && !audienceContains(claims.Audience, a.audience) {
+		return nil, ErrUnauthenticated
+	}
+
+	id := &Identity{Subject: claims.Subject, Method: "oidc", Groups: claims.Groups}
+	if claims.Email != "" {
+		id.Subject = claims.Email
+	}
+	if len(a.groups) > 0 {
+		for _, g := range claims.Groups {
+			if contains(a.groups, g) {
+				return id, nil
+			}
+		}
+		return nil, ErrForbidden
+	}
+	return id, nil
+}
+
+// key returns the issuer's signing key, refetching the key set for unknown
+// key IDs at most once a minute
+func (a *OIDCAuth) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if key, ok := a.keys[kid]; ok && time.Since(a.fetched) < 24*time.Hour {
+		return key, nil
+	}
+	if time.Since(a.fetched) < time.Minute {
+		return a.keys[kid], nil
+	}
+	keys, err := a.fetchKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching OIDC keys: %w", err)
+	}
+	a.keys, a.fetched = keys, time.Now()
+	return keys[kid], nil
+}
+
+func (a *OIDCAuth) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := a.getJSON(ctx, a.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := a.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+func (a *OIDCAuth) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains handles aud as a string or a list
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		return contains(many, audience)
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Bearer returns the authenticators of an API taking static tokens (a
+// TokenAuth spec) and OIDC tokens from issuer; either may be empty. None
+// means Require refuses every request.
+func Bearer(tokens, issuer, audience string, groups []string) []Authenticator {
+	var auth []Authenticator
+	if t := NewTokenAuth(tokens); t.Len() > 0 {
+		auth = append(auth, t)
+	}
+	if issuer != "" {
+		auth = append(auth, NewOIDCAuth(issuer, audience, groups))
+	}
+	return auth
+}
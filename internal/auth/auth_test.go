@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuth(t *testing.T) {
+	body := `{"ref":"refs/heads/main"}`
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(body))
+	valid := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{name: "valid", signature: valid, want: http.StatusOK},
+		{name: "missing", want: http.StatusUnauthorized},
+		{name: "wrong secret", signature: strings.Repeat("ab", 32), want: http.StatusUnauthorized},
+		{name: "not hex", signature: "zz", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := Require(func(w http.ResponseWriter, r *http.Request) {
+				// The handler still reads the verified body
+				data, _ := io.ReadAll(r.Body)
+				got = string(data)
+			}, NewHMACAuth("s3cret"))
+
+			r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			if tt.signature != "" {
+				r.Header.Set("X-Gitea-Signature", tt.signature)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && got != body {
+				t.Fatalf("handler read %q", got)
+			}
+		})
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	auth := NewTokenAuth("ci=abc123, bare-token, cGFkZGVk==")
+	tests := []struct {
+		header      string
+		wantSubject string
+		wantErr     bool
+	}{
+		{header: "Bearer abc123", wantSubject: "ci"},
+		{header: "Bearer bare-token", wantSubject: "token"},
+		{header: "Bearer cGFkZGVk==", wantSubject: "token"},
+		{header: "Bearer wrong", wantErr: true},
+		{header: ""},
+		{header: "Basic YWJjOjEyMw=="},
+		// JWTs are left for OIDCAuth
+		{header: "Bearer a.b.c"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/builds", nil)
+		r.Header.Set("Authorization", tt.header)
+		id, err := auth.Authenticate(r)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: accepted", tt.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.header, err)
+			continue
+		}
+		subject := ""
+		if id != nil {
+			subject = id.Subject
+		}
+		if subject != tt.wantSubject {
+			t.Errorf("%q: subject = %q, want %q", tt.header, subject, tt.wantSubject)
+		}
+	}
+}
+
+// testIssuer is an OIDC issuer publishing one RSA key
+type testIssuer struct {
+	url string
+	key *rsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.url, "jwks_uri": issuer.url + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "k1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	issuer.url = srv.URL
+	return issuer
+}
+
+// token signs claims with the issuer's key under key ID kid
+func (i *testIssuer) token(t *testing.T, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": kid}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCAuth(t *testing.T) {
+	issuer := newTestIssuer(t)
+	claims := func(edit func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    issuer.url,
+			"sub":    "u-1",
+			"email":  "dev@example.com",
+			"aud":    []string{"webhook-receiver"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"developers"},
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		groups []string
+		token  string
+		want   int
+	}{
+		{name: "valid", token: issuer.token(t, "k1", claims(nil)), want: http.StatusOK},
+		{name: "in allowed group", groups: []string{"admins", "developers"}, token: issuer.token(t, "k1", claims(nil)), want: http.StatusOK},
+		{name: "outside allowed groups", groups: []string{"admins"}, token: issuer.token(t, "k1", claims(nil)), want: http.StatusForbidden},
+		{name: "expired", token: issuer.token(t, "k1", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), want: http.StatusUnauthorized},
+		{name: "other issuer", token: issuer.token(t, "k1", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })), want: http.StatusUnauthorized},
+		{name: "other audience", token: issuer.token(t, "k1", claims(func(c map[string]interface{}) { c["aud"] = "grafana" })), want: http.StatusUnauthorized},
+		{name: "unknown key", token: issuer.token(t, "k2", claims(nil)), want: http.StatusUnauthorized},
+		{name: "tampered", token: tamper(issuer.token(t, "k1", claims(nil))), want: http.StatusUnauthorized},
+		{name: "no token", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *Identity
+			h := Require(func(w http.ResponseWriter, r *http.Request) {
+				got = IdentityFrom(r.Context())
+			}, NewOIDCAuth(issuer.url, "webhook-receiver", tt.groups))
+
+			r := httptest.NewRequest(http.MethodGet, "/builds", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && (got == nil || got.Subject != "dev@example.com" || got.Method != "oidc") {
+				t.Fatalf("identity = %+v", got)
+			}
+		})
+	}
+}
+
+// tamper swaps the token's claims for ones it was not signed with
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(claims), "u-1", "u-2", 1)))
+	return strings.Join(parts, ".")
+}
+
+func TestRequireUnavailableIssuer(t *testing.T) {
+	issuer := newTestIssuer(t)
+	token := issuer.token(t, "k1", map[string]interface{}{"iss": "http://127.0.0.1:1", "exp": time.Now().Add(time.Hour).Unix()})
+	// The issuer's keys cannot be fetched: a server problem, not the caller's
+	h := Require(func(http.ResponseWriter, *http.Request) {}, NewOIDCAuth("http://127.0.0.1:1", "", nil))
+
+	r := httptest.NewRequest(http.MethodGet, "/builds", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+}
+
+func TestRequireClosedWithoutAuthenticators(t *testing.T) {
+	called := false
+	h := Require(func(http.ResponseWriter, *http.Request) { called = true })
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/builds", nil))
+	if called || w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, called = %t; want a 401", w.Code, called)
+	}
+}
+
+func TestAllowUnauthenticated(t *testing.T) {
+	tokens := Bearer("ci=s3cret", "", "", nil)
+	if got := AllowUnauthenticated(tokens, false, "test API"); len(got) != 1 {
+		t.Fatalf("not allowed: %d authenticators, want the token only", len(got))
+	}
+
+	var id *Identity
+	h := Require(func(w http.ResponseWriter, r *http.Request) { id = IdentityFrom(r.Context()) },
+		AllowUnauthenticated(nil, true, "test API")...)
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/builds", nil))
+	if w.Code != http.StatusOK || id == nil || id.Method != "none" {
+		t.Fatalf("allowed: status = %d, identity = %+v", w.Code, id)
+	}
+}
+
+func TestBearer(t *testing.T) {
+	if got := Bearer("", "", "", nil); len(got) != 0 {
+		t.Fatalf("no settings: %d authenticators, want none", len(got))
+	}
+	if got := Bearer(" , ", "https://auth.example.com", "", nil); len(got) != 1 {
+		t.Fatalf("issuer only: %d authenticators, want 1", len(got))
+	}
+	if got := Bearer("a,b", "https://auth.example.com", "", nil); len(got) != 2 {
+		t.Fatalf("tokens and issuer: %d authenticators, want 2", len(got))
+	}
+}
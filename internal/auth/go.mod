@@ -0,0 +1,3 @@
+module github.com/homelab/internal/auth
+
+go 1.21
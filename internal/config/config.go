@@ -0,0 +1,383 @@
+// Package config loads a service's settings into a typed struct in layers,
+// each overriding the one before:
+//
+//  1. defaults: whatever the struct holds when Load is called
+//  2. a YAML file, keyed by the fields' json tags (or names); durations are
+//     written as in Go, e.g. 90s
+//  3. environment variables, named by env tags
+//  4. command-line flags, named by flag tags, described by usage tags
+//
+// For example:
+//
+//	type Settings struct {
+//		Port     string        `json:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+//		Interval time.Duration `json:"interval" env:"INTERVAL" flag:"interval"`
+//		Token    string        `json:"-" env:"API_TOKEN"`
+//	}
+//
+//	s := Settings{Port: "8080", Interval: time.Hour}
+//	err := config.Load(&s, config.Options{FileEnv: "SETTINGS_FILE", FileFlag: "settings"})
+//
+// Secrets should carry only an env tag: flags show up in process listings.
+// Nested structs are walked, so their fields can be tagged too. Fields may be
+// strings, bools, integers, floats, time.Duration, or []string (comma
+// separated in env and flags). Once every layer is applied, a struct
+// implementing Validator is validated. -h prints the flags and Load returns
+// flag.ErrHelp.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Validator is implemented by settings that check themselves once loaded
+type Validator interface {
+	Validate() error
+}
+
+// Options says where the file and flags come from
+type Options struct {
+	// File is the YAML file read by default; empty reads none unless FileEnv
+	// or FileFlag names one
+	File string
+	// FileEnv and FileFlag name an environment variable and a flag that
+	// override File
+	FileEnv  string
+	FileFlag string
+	// RequireFile fails when the file does not exist; otherwise a missing
+	// file keeps the defaults
+	RequireFile bool
+	// Args are the command-line arguments, without the program name;
+	// nil reads os.Args[1:]
+	Args []string
+	// Name is the flag set's name in usage output (default os.Args[0])
+	Name string
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field is a tagged setting found in the struct
+type field struct {
+	value reflect.Value
+	path  string
+	env   string
+	flag  string
+	usage string
+}
+
+// Load fills the struct cfg points to from the file, environment, and
+// flags over its current values, then validates it
+func Load(cfg interface{}, opts Options) error {
+	root := reflect.ValueOf(cfg)
+	if root.Kind() != reflect.Ptr || root.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Load needs a pointer to a struct, got %T", cfg)
+	}
+	var fields []field
+	if err := collect(root.Elem(), "", &fields); err != nil {
+		return err
+	}
+
+	// Flags are parsed first, to find the file, but applied last
+	name := opts.Name
+	if name == "" {
+		name = os.Args[0]
+	}
+	set := flag.NewFlagSet(name, flag.ContinueOnError)
+	flagValues := make(map[string]*recorded)
+	for _, f := range fields {
+		if f.flag == "" {
+			continue
+		}
+		r := &recorded{def: format(f.value), isBool: f.value.Kind() == reflect.Bool}
+		flagValues[f.flag] = r
+		set.Var(r, f.flag, f.usage)
+	}
+	file := opts.File
+	if opts.FileFlag != "" {
+		set.StringVar(&file, opts.FileFlag, file, "YAML settings file")
+	}
+	args := opts.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if set.NArg() > 0 {
+		return fmt.Errorf("config: unexpected arguments %q", set.Args())
+	}
+	fileSet := false
+	set.Visit(func(f *flag.Flag) { fileSet = fileSet || f.Name == opts.FileFlag })
+	if opts.FileEnv != "" && !fileSet {
+		if v := os.Getenv(opts.FileEnv); v != "" {
+			file = v
+		}
+	}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		switch {
+		case errors.Is(err, os.ErrNotExist) && !opts.RequireFile:
+		case err != nil:
+			return fmt.Errorf("config: %w", err)
+		default:
+			var values map[string]interface{}
+			if err := yaml.Unmarshal(data, &values); err != nil {
+				return fmt.Errorf("config: parsing %s: %w", file, err)
+			}
+			if err := decode(root.Elem(), values, ""); err != nil {
+				return fmt.Errorf("config: %s: %w", file, err)
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		if v, ok := os.LookupEnv(f.env); ok && v != "" {
+			if err := parse(f.value, v); err != nil {
+				return fmt.Errorf("config: %s: %w", f.env, err)
+			}
+		}
+	}
+
+	var err error
+	set.Visit(func(fl *flag.Flag) {
+		r, ok := flagValues[fl.Name]
+		if !ok || err != nil {
+			return
+		}
+		for _, f := range fields {
+			if f.flag == fl.Name {
+				if perr := parse(f.value, r.value); perr != nil {
+					err = fmt.Errorf("config: -%s: %w", fl.Name, perr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	return nil
+}
+
+// decode sets the struct's fields from a file's values, recursing into
+// nested structs; unknown keys are an error
+func decode(v reflect.Value, values map[string]interface{}, prefix string) error {
+	for key, value := range values {
+		fv, ok := fieldByJSONName(v, key)
+		if !ok {
+			return fmt.Errorf("unknown setting %s%s", prefix, key)
+		}
+		if fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct {
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		}
+		if nested, ok := value.(map[string]interface{}); ok && fv.Kind() == reflect.Struct {
+			if err := decode(fv, nested, prefix+key+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		if s, ok := value.(string); ok && fv.Type() == durationType {
+			if err := parse(fv, s); err != nil {
+				return fmt.Errorf("%s%s: %w", prefix, key, err)
+			}
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, fv.Addr().Interface()); err != nil {
+			return fmt.Errorf("%s%s: %w", prefix, key, err)
+		}
+	}
+	return nil
+}
+
+// fieldByJSONName finds the exported field a file key sets
+func fieldByJSONName(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if name == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// collect walks the struct for tagged fields, descending into nested
+// structs and non-nil struct pointers
+func collect(v reflect.Value, prefix string, fields *[]field) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		path := prefix + sf.Name
+		env, flagName := sf.Tag.Get("env"), sf.Tag.Get("flag")
+
+		if env == "" && flagName == "" {
+			switch {
+			case fv.Kind() == reflect.Struct:
+				if err := collect(fv, path+".", fields); err != nil {
+					return err
+				}
+			case fv.Kind() == reflect.Ptr && !fv.IsNil() && fv.Elem().Kind() == reflect.Struct:
+				if err := collect(fv.Elem(), path+".", fields); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !supported(fv) {
+			return fmt.Errorf("config: %s: unsupported type %s", path, fv.Type())
+		}
+		*fields = append(*fields, field{value: fv, path: path, env: env, flag: flagName, usage: usage(sf, env)})
+	}
+	return nil
+}
+
+// usage describes a flag, mentioning the variable that also sets it
+func usage(sf reflect.StructField, env string) string {
+	u := sf.Tag.Get("usage")
+	if env != "" {
+		if u != "" {
+			u += " "
+		}
+		u += "($" + env + ")"
+	}
+	return u
+}
+
+func supported(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return v.Type().Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// parse sets v from its string form
+func parse(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list).Convert(v.Type()))
+	}
+	return nil
+}
+
+// format renders v's current value as a flag default
+func format(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	if v.Kind() == reflect.Slice {
+		return strings.Join(v.Convert(reflect.TypeOf([]string{})).Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// recorded holds a flag's raw value until the flag layer is applied
+type recorded struct {
+	def    string
+	value  string
+	isBool bool
+}
+
+func (r *recorded) String() string {
+	if r == nil {
+		return ""
+	}
+	if r.value != "" {
+		return r.value
+	}
+	return r.def
+}
+
+func (r *recorded) Set(s string) error {
+	r.value = s
+	return nil
+}
+
+// IsBoolFlag lets bool settings be set by a bare -flag
+func (r *recorded) IsBoolFlag() bool {
+	return r.isBool
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testNested struct {
+	Hosts []string `json:"hosts" env:"TEST_HOSTS" flag:"hosts"`
+}
+
+type testSettings struct {
+	Port     string        `json:"port" env:"TEST_PORT" flag:"port"`
+	Interval time.Duration `json:"interval" env:"TEST_INTERVAL" flag:"interval"`
+	DryRun   bool          `json:"dryRun" env:"TEST_DRY_RUN" flag:"dry-run"`
+	Keep     int           `json:"keep" env:"TEST_KEEP" flag:"keep"`
+	Token    string        `json:"-" env:"TEST_TOKEN"`
+	Nested   testNested    `json:"nested"`
+}
+
+func (s *testSettings) Validate() error {
+	if s.Keep < 0 {
+		return errors.New("keep must not be negative")
+	}
+	return nil
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "settings.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := writeFile(t, "port: \"9000\"\ninterval: 90s\nkeep: 3\nnested:\n  hosts: [a, b]\n")
+	t.Setenv("TEST_SETTINGS_FILE", path)
+	t.Setenv("TEST_KEEP", "4")
+	t.Setenv("TEST_HOSTS", " c , d ,")
+	t.Setenv("TEST_TOKEN", "s3cret")
+	// Empty variables count as unset
+	t.Setenv("TEST_PORT", "")
+
+	s := testSettings{Port: "8080", Interval: time.Minute, DryRun: true}
+	err := Load(&s, Options{FileEnv: "TEST_SETTINGS_FILE", FileFlag: "settings", Args: []string{"-keep=5", "-dry-run=false"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testSettings{
+		Port:     "9000",
+		Interval: 90 * time.Second,
+		DryRun:   false,
+		Keep:     5,
+		Token:    "s3cret",
+		Nested:   testNested{Hosts: []string{"c", "d"}},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Fatalf("settings = %+v, want %+v", s, want)
+	}
+}
+
+func TestLoadFileFlagOverridesEnv(t *testing.T) {
+	t.Setenv("TEST_SETTINGS_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	path := writeFile(t, "port: \"9001\"\n")
+	var s testSettings
+	if err := Load(&s, Options{FileEnv: "TEST_SETTINGS_FILE", FileFlag: "settings", Args: []string{"-settings", path}}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Port != "9001" {
+		t.Fatalf("port = %q, want the flag's file", s.Port)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		opts Options
+	}{
+		{name: "bad duration", env: map[string]string{"TEST_INTERVAL": "soon"}, opts: Options{Args: []string{}}},
+		{name: "bad integer flag", opts: Options{Args: []string{"-keep=many"}}},
+		{name: "invalid", opts: Options{Args: []string{"-keep=-1"}}},
+		{name: "unknown file field", opts: Options{File: writeFile(t, "prot: \"80\"\n"), Args: []string{}}},
+		{name: "missing required file", opts: Options{File: "/nonexistent/settings.yaml", RequireFile: true, Args: []string{}}},
+		{name: "extra arguments", opts: Options{Args: []string{"serve"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var s testSettings
+			if err := Load(&s, tt.opts); err == nil {
+				t.Fatalf("loaded %+v", s)
+			}
+		})
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	var s testSettings
+	opts := Options{Args: []string{"-h"}}
+	if err := Load(&s, opts); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("err = %v, want flag.ErrHelp", err)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/homelab/internal/health
+
+go 1.21
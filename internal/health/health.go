@@ -0,0 +1,190 @@
+// Package health serves the standard probe endpoints:
+//
+//	/healthz  liveness: the process is up and serving
+//	/readyz   readiness: every registered dependency check passes
+//
+// Both answer JSON. /readyz runs its checks concurrently, each bounded by
+// the handler's timeout, and returns 503 with the failing checks' errors
+// when any fails, e.g.
+//
+//	{"status":"fail","checks":{"kubernetes":{"status":"ok","durationMs":3},
+//	 "registry":{"status":"fail","error":"...","durationMs":2000}}}
+//
+// /healthz deliberately runs no checks: a dependency outage should take a
+// pod out of rotation, not restart it.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency is usable
+type Check func(ctx context.Context) error
+
+// DefaultTimeout bounds each readiness check unless Handler.Timeout is set
+const DefaultTimeout = 2 * time.Second
+
+// Result is one check's outcome in a readiness report
+type Result struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Report is the body of /healthz and /readyz
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// Handler holds the readiness checks of a service
+type Handler struct {
+	// Timeout bounds each check (default DefaultTimeout)
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	checks map[string]Check
+}
+
+// New returns a handler without checks; /readyz passes until some are added
+func New() *Handler {
+	return &Handler{checks: make(map[string]Check)}
+}
+
+// Add registers a readiness check, replacing any of the same name
+func (h *Handler) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Register mounts /healthz and /readyz on the mux
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.Live)
+	mux.HandleFunc("/readyz", h.Ready)
+}
+
+// Live answers the liveness probe
+func (h *Handler) Live(w http.ResponseWriter, r *http.Request) {
+	write(w, http.StatusOK, Report{Status: "ok"})
+}
+
+// Ready runs the checks and answers the readiness probe; ?verbose=false
+// leaves the per-check results out
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	report := h.Run(r.Context())
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+		for name, result := range report.Checks {
+			if result.Status != "ok" {
+				log.Printf("Readiness check %s failed: %s", name, result.Error)
+			}
+		}
+	}
+	if r.URL.Query().Get("verbose") == "false" {
+		report.Checks = nil
+	}
+	write(w, status, report)
+}
+
+// Run executes every check concurrently
+func (h *Handler) Run(ctx context.Context) Report {
+	h.mu.Lock()
+	checks := make(map[string]Check, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.Unlock()
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	report := Report{Status: "ok", Checks: make(map[string]Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := check(ctx)
+			result := Result{Status: "ok", DurationMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if err != nil {
+				report.Status = "fail"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+func write(w http.ResponseWriter, status int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Failed to encode health report: %v", err)
+	}
+}
+
+// HTTP checks that a GET of url answers without a server error. Any status
+// below 500 passes, so endpoints that want credentials, like a registry's
+// /v2/, still count as reachable.
+func HTTP(client *http.Client, url string) Check {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// Writable checks that a file can be created in dir
+func Writable(dir string) Check {
+	return func(ctx context.Context) error {
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return err
+		}
+		name := f.Name()
+		_, err = f.WriteString("ok")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if rerr := os.Remove(name); err == nil && rerr != nil {
+			err = fmt.Errorf("removing %s: %w", filepath.Base(name), rerr)
+		}
+		return err
+	}
+}
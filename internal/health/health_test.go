@@ -0,0 +1,88 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, h *Handler, path string) (int, Report) {
+	t.Helper()
+	mux := http.NewServeMux()
+	h.Register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var report Report
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, report
+}
+
+func TestReady(t *testing.T) {
+	h := New()
+	if code, report := serve(t, h, "/readyz"); code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("without checks: %d %+v", code, report)
+	}
+
+	h.Add("kubernetes", func(context.Context) error { return nil })
+	h.Add("registry", func(context.Context) error { return errors.New("connection refused") })
+	code, report := serve(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != "fail" {
+		t.Fatalf("with a failing check: %d %+v", code, report)
+	}
+	if report.Checks["kubernetes"].Status != "ok" || report.Checks["registry"].Error != "connection refused" {
+		t.Fatalf("checks = %+v", report.Checks)
+	}
+	if _, report := serve(t, h, "/readyz?verbose=false"); report.Checks != nil {
+		t.Fatalf("terse report has checks: %+v", report.Checks)
+	}
+
+	// Liveness ignores dependencies
+	if code, report := serve(t, h, "/healthz"); code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("liveness: %d %+v", code, report)
+	}
+}
+
+func TestReadyTimeout(t *testing.T) {
+	h := New()
+	h.Timeout = 10 * time.Millisecond
+	h.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	report := h.Run(context.Background())
+	if report.Status != "fail" || report.Checks["slow"].Error != context.DeadlineExceeded.Error() {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	status := http.StatusUnauthorized
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer upstream.Close()
+
+	check := HTTP(nil, upstream.URL+"/v2/")
+	if err := check(context.Background()); err != nil {
+		t.Fatalf("401 should pass: %v", err)
+	}
+	status = http.StatusBadGateway
+	if err := check(context.Background()); err == nil {
+		t.Fatal("502 passed")
+	}
+}
+
+func TestWritable(t *testing.T) {
+	if err := Writable(t.TempDir())(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Writable("/nonexistent/dir")(context.Background()); err == nil {
+		t.Fatal("missing directory passed")
+	}
+}
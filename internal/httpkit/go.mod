@@ -0,0 +1,3 @@
+module github.com/homelab/internal/httpkit
+
+go 1.21
@@ -0,0 +1,136 @@
+// Package httpkit holds the HTTP plumbing the platform services share:
+// JSON responses, a status-recording ResponseWriter, per-route middleware
+// (request ID, access log, metrics, panic recovery, timeout), and a server
+// with timeouts and graceful shutdown.
+package httpkit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+)
+
+// RequestTimeout bounds handler time under Instrument
+const RequestTimeout = time.Minute
+
+// WriteJSON writes v as a JSON response with the given status
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// StatusRecorder captures the status and size of a response
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// NewStatusRecorder records the response written through w
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush keeps streamed responses flowing through the recorder
+func (r *StatusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Written reports whether the response has started
+func (r *StatusRecorder) Written() bool {
+	return r.status != 0
+}
+
+// Status is the response status; a handler that wrote nothing sent 200
+func (r *StatusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Bytes is the size of the response body written so far
+func (r *StatusRecorder) Bytes() int {
+	return r.bytes
+}
+
+// requestIDPattern accepts IDs set by ingress-nginx or the api-gateway
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// RequestIDFrom returns the request's ID, or "" outside Instrument
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Instrument wraps a route's handler with, outermost first: request ID,
+// access log and metrics, panic recovery, and a timeout. Health and metrics
+// scrapes are not logged.
+func (m *Metrics) Instrument(route string, next http.Handler) http.Handler {
+	next = http.TimeoutHandler(next, RequestTimeout, "Request timed out")
+	quiet := route == "/health" || route == "/healthz" || route == "/readyz" || route == "/metrics"
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rec := NewStatusRecorder(w)
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, id, p, debug.Stack())
+				if !rec.Written() {
+					http.Error(rec, "Internal server error", http.StatusInternalServerError)
+				}
+			}
+			elapsed := time.Since(start)
+			m.observe(route, r.Method, rec.Status(), elapsed)
+			if !quiet {
+				log.Printf("%s %s %d %dB %s request=%s", r.Method, r.URL.RequestURI(), rec.Status(), rec.Bytes(), elapsed.Round(time.Millisecond), id)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,88 @@
+package httpkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteJSON(w, http.StatusCreated, map[string]string{"name": "app"})
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, content type = %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != `{"name":"app"}` {
+		t.Fatalf("body = %s", got)
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		bytes   int
+	}{
+		{"nothing written", func(w http.ResponseWriter, r *http.Request) {}, http.StatusOK, 0},
+		{"implicit status", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) }, http.StatusOK, 5},
+		{"explicit status", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "gone", http.StatusGone) }, http.StatusGone, 5},
+		{"first status wins", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			w.WriteHeader(http.StatusTeapot)
+		}, http.StatusAccepted, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := NewStatusRecorder(httptest.NewRecorder())
+			tt.handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Status() != tt.status || rec.Bytes() != tt.bytes {
+				t.Fatalf("status = %d, bytes = %d; want %d, %d", rec.Status(), rec.Bytes(), tt.status, tt.bytes)
+			}
+		})
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	m := NewMetrics("test")
+	var seen string
+	h := m.Instrument("/builds", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFrom(r.Context())
+		if r.URL.Query().Has("panic") {
+			panic("boom")
+		}
+		WriteJSON(w, http.StatusOK, []string{})
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/builds", nil)
+	r.Header.Set("X-Request-Id", "from-gateway")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if seen != "from-gateway" || w.Header().Get("X-Request-Id") != "from-gateway" {
+		t.Fatalf("request ID = %q, header %q", seen, w.Header().Get("X-Request-Id"))
+	}
+
+	// Invalid IDs are replaced
+	r = httptest.NewRequest(http.MethodGet, "/builds?panic", nil)
+	r.Header.Set("X-Request-Id", "bad id\n")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("panicking handler: status = %d, want 500", w.Code)
+	}
+	if seen == "" || seen == "bad id\n" {
+		t.Fatalf("request ID = %q, want a generated one", seen)
+	}
+
+	var b strings.Builder
+	m.Write(&b)
+	for _, want := range []string{
+		`test_http_requests_total{route="/builds",method="GET",code="200"} 1`,
+		`test_http_requests_total{route="/builds",method="GET",code="500"} 1`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics lack %s:\n%s", want, b.String())
+		}
+	}
+}
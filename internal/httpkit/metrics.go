@@ -0,0 +1,78 @@
+package httpkit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics counts requests and their latency per route, method, and status
+type Metrics struct {
+	// namespace prefixes the metric names, e.g. webhook_receiver
+	namespace string
+
+	mu       sync.Mutex
+	requests map[series]*stats
+}
+
+type series struct {
+	route, method string
+	code          int
+}
+
+type stats struct {
+	count   int64
+	seconds float64
+}
+
+// NewMetrics exports <namespace>_http_requests_total and
+// <namespace>_http_request_duration_seconds_sum
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{namespace: namespace, requests: make(map[series]*stats)}
+}
+
+func (m *Metrics) observe(route, method string, code int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := series{route, method, code}
+	s, ok := m.requests[key]
+	if !ok {
+		s = &stats{}
+		m.requests[key] = s
+	}
+	s.count++
+	s.seconds += elapsed.Seconds()
+}
+
+// Write appends the counters in Prometheus text format
+func (m *Metrics) Write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]series, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, c := keys[i], keys[j]
+		if a.route != c.route {
+			return a.route < c.route
+		}
+		if a.method != c.method {
+			return a.method < c.method
+		}
+		return a.code < c.code
+	})
+
+	fmt.Fprintf(b, "# HELP %s_http_requests_total HTTP requests by route, method, and status.\n# TYPE %[1]s_http_requests_total counter\n", m.namespace)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s_http_requests_total{route=%q,method=%q,code=\"%d\"} %d\n", m.namespace, k.route, k.method, k.code, m.requests[k].count)
+	}
+	fmt.Fprintf(b, "# HELP %s_http_request_duration_seconds_sum Total time spent serving requests.\n# TYPE %[1]s_http_request_duration_seconds_sum counter\n", m.namespace)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s_http_request_duration_seconds_sum{route=%q,method=%q,code=\"%d\"} %g\n", m.namespace, k.route, k.method, k.code, m.requests[k].seconds)
+	}
+}
@@ -0,0 +1,108 @@
+package httpkit
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewServer returns a server with timeouts so slow clients cannot hold
+// connections open; WriteTimeout leaves room for RequestTimeout
+func NewServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      RequestTimeout + 30*time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// Serve runs the server until ctx is cancelled, then drains in-flight
+// requests for up to 10 seconds
+func Serve(ctx context.Context, server *http.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errc <- server.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// CertReloader serves a certificate from files, rereading them when they
+// change so a renewed Secret is picked up without a restart
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// NewCertReloader loads the certificate if it exists yet; until it does,
+// TLS handshakes fail and HTTP keeps working
+func NewCertReloader(certFile, keyFile string) *CertReloader {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		log.Printf("TLS certificate not loaded yet: %v", err)
+	}
+	return r
+}
+
+// GetCertificate implements tls.Config.GetCertificate, checking the files at
+// most once a minute
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cert != nil && time.Since(r.checked) < time.Minute {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && info.ModTime().Equal(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			log.Printf("Failed to reload certificate %s, keeping the previous one: %v", r.certFile, err)
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil {
+		log.Printf("Reloaded certificate %s", r.certFile)
+	}
+	r.cert, r.modTime = &cert, info.ModTime()
+	return r.cert, nil
+}
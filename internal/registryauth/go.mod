@@ -0,0 +1,3 @@
+module github.com/homelab/internal/registryauth
+
+go 1.21
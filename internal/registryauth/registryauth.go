@@ -0,0 +1,132 @@
+// Package registryauth logs the platform services in to the in-cluster
+// registry with the credentials the secrets operator rotates. They read the
+// registry-credentials dockerconfigjson Secret mounted as a file, which the
+// kubelet updates in place after every rotation.
+package registryauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential is one registry login from a docker config
+type Credential struct {
+	Username string
+	Password string
+}
+
+// Transport adds basic auth from the docker config at Path to requests for
+// the hosts it lists; requests to other hosts are sent unchanged. The file is
+// reread when it changes. Without Path, or while the file does not exist,
+// requests go out without credentials.
+type Transport struct {
+	Path string
+	// Base sends the requests; nil is http.DefaultTransport
+	Base http.RoundTripper
+
+	mu      sync.Mutex
+	modTime time.Time
+	auths   map[string]Credential
+}
+
+// Client returns an HTTP client with the given timeout using a Transport for
+// the docker config at path
+func Client(path string, timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: &Transport{Path: path}}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Path == "" || req.Header.Get("Authorization") != "" {
+		return base.RoundTrip(req)
+	}
+
+	cred, ok, err := t.lookup(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return base.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(cred.Username, cred.Password)
+	return base.RoundTrip(req)
+}
+
+func (t *Transport) lookup(host string) (Credential, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.Path)
+	if os.IsNotExist(err) {
+		// Not rotated yet; the registry is still open
+		return Credential{}, false, nil
+	}
+	if err != nil {
+		return Credential{}, false, err
+	}
+	if t.auths == nil || !info.ModTime().Equal(t.modTime) {
+		data, err := os.ReadFile(t.Path)
+		if err != nil {
+			return Credential{}, false, err
+		}
+		auths, err := Parse(data)
+		if err != nil {
+			return Credential{}, false, fmt.Errorf("%s: %w", t.Path, err)
+		}
+		t.auths, t.modTime = auths, info.ModTime()
+	}
+	cred, ok := t.auths[host]
+	return cred, ok, nil
+}
+
+// Parse reads the logins from a docker config (.dockerconfigjson), keyed by
+// registry host. Keys written as URLs, e.g. "https://registry.example.com/v1/",
+// are reduced to their host.
+func Parse(data []byte) (map[string]Credential, error) {
+	var config struct {
+		Auths map[string]struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Auth     string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	auths := make(map[string]Credential, len(config.Auths))
+	for key, entry := range config.Auths {
+		cred := Credential{Username: entry.Username, Password: entry.Password}
+		if cred.Username == "" && entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("auth for %s: %w", key, err)
+			}
+			cred.Username, cred.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		auths[host(key)] = cred
+	}
+	return auths, nil
+}
+
+func host(key string) string {
+	if strings.Contains(key, "://") {
+		if u, err := url.Parse(key); err == nil {
+			return u.Host
+		}
+	}
+	host, _, _ := strings.Cut(key, "/")
+	return host
+}
@@ -0,0 +1,79 @@
+package registryauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	auths, err := Parse([]byte(`{"auths": {
+		"registry.example.com": {"username": "homelab-1", "password": "s3cret"},
+		"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNzOndvcmQ="}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Credential{
+		"registry.example.com": {Username: "homelab-1", Password: "s3cret"},
+		"index.docker.io":      {Username: "user", Password: "pass:word"},
+	}
+	if !reflect.DeepEqual(auths, want) {
+		t.Fatalf("auths = %+v, want %+v", auths, want)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		got = append(got, user+":"+password)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	client := Client(path, time.Second)
+	get := func() string {
+		t.Helper()
+		resp, err := client.Get(srv.URL + "/v2/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return got[len(got)-1]
+	}
+
+	if cred := get(); cred != ":" {
+		t.Fatalf("without a config sent %q", cred)
+	}
+
+	write := func(config string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"auths": {"other.example.com": {"username": "a", "password": "b"}}}`, time.Unix(1, 0))
+	if cred := get(); cred != ":" {
+		t.Fatalf("sent %q for another host's login", cred)
+	}
+
+	write(`{"auths": {"`+host+`": {"username": "homelab-1", "password": "one"}}}`, time.Unix(2, 0))
+	if cred := get(); cred != "homelab-1:one" {
+		t.Fatalf("sent %q", cred)
+	}
+	// Rotated credentials are picked up
+	write(`{"auths": {"`+host+`": {"username": "homelab-2", "password": "two"}}}`, time.Unix(3, 0))
+	if cred := get(); cred != "homelab-2:two" {
+		t.Fatalf("after rotation sent %q", cred)
+	}
+}
@@ -1,19 +1,62 @@
 #!/bin/bash
 
 # Configure k3s to use the internal container registry
-# This allows nodes to pull images from the cluster-internal registry
+# This allows nodes to pull images from the cluster-internal registry, and
+# to pull docker.io, ghcr.io, and quay.io images through the pull-through
+# caches registry-gc deploys (containerd falls back to the upstream when a
+# mirror is down)
 
 REGISTRY_CONFIG="/etc/rancher/k3s/registries.yaml"
+MIRROR_DOMAIN="${MIRROR_DOMAIN:-home.mcztest.com}"
+# The in-cluster registry serves TLS from the secrets operator's internal CA,
+# published in the internal-ca ConfigMap of every namespace
+INTERNAL_CA_FILE="${INTERNAL_CA_FILE:-/etc/rancher/k3s/internal-ca.crt}"
+
+# The registry serves HTTPS once its docker-registry-tls Secret exists and
+# plain HTTP before that. Nodes without kubectl get REGISTRY_SCHEME from
+# scripts/migrate-registry-tls.sh.
+if [ -z "$REGISTRY_SCHEME" ]; then
+  REGISTRY_SCHEME=http
+  if command -v kubectl >/dev/null 2>&1 \
+    && kubectl -n container-registry get secret docker-registry-tls >/dev/null 2>&1; then
+    REGISTRY_SCHEME=https
+  fi
+fi
+
+if [ "$REGISTRY_SCHEME" = https ] && [ ! -s "$INTERNAL_CA_FILE" ] && command -v kubectl >/dev/null 2>&1; then
+  kubectl -n kube-system get configmap internal-ca -o jsonpath='{.data.ca\.crt}' \
+    | sudo tee "$INTERNAL_CA_FILE" >/dev/null
+fi
+if [ "$REGISTRY_SCHEME" = https ] && [ -s "$INTERNAL_CA_FILE" ]; then
+  REGISTRY_TLS="ca_file: \"$INTERNAL_CA_FILE\""
+else
+  if [ "$REGISTRY_SCHEME" = https ]; then
+    # Copy ca.crt from the internal-ca ConfigMap to $INTERNAL_CA_FILE and rerun
+    echo "No internal CA at $INTERNAL_CA_FILE; skipping TLS verification for the in-cluster registry"
+  else
+    echo "docker-registry-tls not issued yet; using plain HTTP for the in-cluster registry"
+  fi
+  REGISTRY_TLS="insecure_skip_verify: true"
+fi
 
 cat <<EOF | sudo tee $REGISTRY_CONFIG
 mirrors:
+  docker.io:
+    endpoint:
+      - "https://docker-io.${MIRROR_DOMAIN}"
+  ghcr.io:
+    endpoint:
+      - "https://ghcr-io.${MIRROR_DOMAIN}"
+  quay.io:
+    endpoint:
+      - "https://quay-io.${MIRROR_DOMAIN}"
   docker-registry.container-registry.svc.cluster.local:5000:
     endpoint:
-      - "http://docker-registry.container-registry.svc.cluster.local:5000"
+      - "${REGISTRY_SCHEME}://docker-registry.container-registry.svc.cluster.local:5000"
 configs:
   "docker-registry.container-registry.svc.cluster.local:5000":
     tls:
-      insecure_skip_verify: true
+      ${REGISTRY_TLS}
 EOF
 
 echo "Registry configuration created at $REGISTRY_CONFIG"
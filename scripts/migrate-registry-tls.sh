@@ -0,0 +1,60 @@
+#!/bin/bash
+# Switch every node's containerd to the in-cluster registry's HTTPS endpoint
+#
+# Nodes configured before the registry served TLS pull from
+# http://docker-registry.container-registry.svc.cluster.local:5000, which
+# stops working once the secrets operator issues docker-registry-tls. This
+# waits for that certificate, then reruns configure-registry.sh on each node
+# over SSH, one node at a time, waiting for it to be Ready after k3s
+# restarts. Rerunning it is harmless.
+#
+# Usage: ./scripts/migrate-registry-tls.sh [node...]   (default: all nodes)
+
+set -e
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+NODE_USER="${NODE_USER:-ubuntu}"
+INTERNAL_CA_FILE="${INTERNAL_CA_FILE:-/etc/rancher/k3s/internal-ca.crt}"
+TIMEOUT="${TIMEOUT:-600}"
+
+echo "Waiting for the registry certificate..."
+deadline=$((SECONDS + TIMEOUT))
+until kubectl -n container-registry get secret docker-registry-tls >/dev/null 2>&1; do
+  if [ $SECONDS -ge $deadline ]; then
+    echo "docker-registry-tls not issued after ${TIMEOUT}s; check the secrets operator" >&2
+    exit 1
+  fi
+  sleep 10
+done
+
+CA="$(kubectl -n kube-system get configmap internal-ca -o jsonpath='{.data.ca\.crt}')"
+if [ -z "$CA" ]; then
+  echo "No ca.crt in kube-system/internal-ca; is the secrets operator's CA enabled?" >&2
+  exit 1
+fi
+
+NODES=("$@")
+if [ ${#NODES[@]} -eq 0 ]; then
+  read -r -a NODES <<< "$(kubectl get nodes -o jsonpath='{.items[*].metadata.name}')"
+fi
+
+for node in "${NODES[@]}"; do
+  address="$(kubectl get node "$node" -o jsonpath='{.status.addresses[?(@.type=="InternalIP")].address}')"
+  echo "Configuring $node ($address)..."
+  echo "$CA" | ssh "$NODE_USER@$address" "sudo tee '$INTERNAL_CA_FILE' >/dev/null"
+  ssh "$NODE_USER@$address" "REGISTRY_SCHEME=https INTERNAL_CA_FILE='$INTERNAL_CA_FILE' bash -s" \
+    < "$SCRIPT_DIR/configure-registry.sh"
+  # k3s takes a moment to report the restart, and the API is briefly down
+  # when the node is a server
+  sleep 15
+  deadline=$((SECONDS + TIMEOUT))
+  until kubectl wait --for=condition=Ready "node/$node" --timeout=10s >/dev/null 2>&1; do
+    if [ $SECONDS -ge $deadline ]; then
+      echo "$node not Ready after ${TIMEOUT}s; stopping before the next node" >&2
+      exit 1
+    fi
+    sleep 5
+  done
+done
+
+echo "Done! All nodes pull from the registry over HTTPS."